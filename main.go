@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/options"
 	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/provider"
 	"k8s.io/component-base/logs"
@@ -17,6 +18,17 @@ func main() {
 	opts := options.NewAlibabaMetricsAdapterOptions()
 	opts.AddFlags()
 	opts.Flags().AddGoFlagSet(flag.CommandLine)
+
+	// adapter validate-config --config <file> --prometheus-url <url>
+	if len(os.Args) > 1 && os.Args[1] == validateConfigCommand {
+		failOnZeroSeries := opts.Flags().Bool("fail-on-zero-series", true,
+			"with validate-config, fail if a rule matches no series.")
+		if err := opts.Flags().Parse(os.Args[2:]); err != nil {
+			klog.Fatalf("unable to parse flags: %v", err)
+		}
+		os.Exit(validateConfig(opts, *failOnZeroSeries))
+	}
+
 	if err := opts.Flags().Parse(os.Args); err != nil {
 		klog.Fatalf("unable to parse flags: %v", err)
 	}
@@ -34,10 +46,20 @@ func main() {
 	// register external metrics provider
 	opts.WithExternalMetrics(providerManager)
 
-	// export reload endpoint
+	// export reload endpoint, the config is applied by the restart
 	http.HandleFunc("/reload", func(writer http.ResponseWriter, request *http.Request) {
+		if len(opts.AdapterConfigFiles) > 0 {
+			if err := opts.ReloadConfig(); err != nil {
+				http.Error(writer, fmt.Sprintf("keeping the running config: %v", err), http.StatusServiceUnavailable)
+				return
+			}
+		}
 		os.Exit(0)
 	})
+	http.Handle("/debug/slow-metrics", provider.SlowMetricsHandler())
+	if opts.EnableProviderRegistry {
+		http.Handle("/debug/providers", provider.ProviderRegistryHandler())
+	}
 	go func() {
 		http.ListenAndServe(":8080", nil)
 	}()
@@ -0,0 +1,133 @@
+package audit
+
+import (
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// BatcherConfig tells how a Batcher buffers and batches its items.
+type BatcherConfig struct {
+	// Items names the items in the logs, e.g. "audit samples".
+	Items string
+	// Buffer names the buffer in the logs, e.g. "remote write".
+	Buffer string
+	// BufferSize is the number of items which may wait to be sent, DefaultBufferSize if 0 or less.
+	BufferSize int
+	// BatchSize is the maximum number of items sent at once.
+	BatchSize int
+	// FlushInterval is how long the items of a batch which isn't full wait to be sent.
+	FlushInterval time.Duration
+	// OnDrop is called for each item dropped because the buffer was full, if set.
+	OnDrop func()
+}
+
+// Batcher sends the items queued by the callers in batches in the background, e.g. the samples of a
+// RemoteWriter. Queueing never blocks the caller, the items are dropped when the buffer is full.
+type Batcher struct {
+	config  BatcherConfig
+	send    func(batch []interface{})
+	items   chan interface{}
+	dropped uint64
+}
+
+// NewBatcher creates a batcher which hands the batches of its items to send, which reports its own
+// failures: the items are sent on a best effort basis, they are not retried.
+func NewBatcher(config BatcherConfig, send func(batch []interface{})) *Batcher {
+	if config.BufferSize <= 0 {
+		config.BufferSize = DefaultBufferSize
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 1
+	}
+	return &Batcher{
+		config: config,
+		send:   send,
+		items:  make(chan interface{}, config.BufferSize),
+	}
+}
+
+// Add queues the item, or drops it if the buffer is full.
+func (b *Batcher) Add(item interface{}) {
+	select {
+	case b.items <- item:
+	default:
+		atomic.AddUint64(&b.dropped, 1)
+		if b.config.OnDrop != nil {
+			b.config.OnDrop()
+		}
+	}
+}
+
+// Dropped returns how many items have been dropped because the buffer was full.
+func (b *Batcher) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
+
+// RunUntil sends the queued items in batches until stopCh is closed, and then the ones queued already.
+func (b *Batcher) RunUntil(stopCh <-chan struct{}) {
+	go b.run(stopCh)
+}
+
+func (b *Batcher) run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(b.config.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]interface{}, 0, b.config.BatchSize)
+	var reportedDropped uint64
+	reportDropped := func() {
+		if dropped := b.Dropped(); dropped != reportedDropped {
+			klog.Warningf("%d %s dropped because the %s buffer was full", dropped-reportedDropped, b.config.Items, b.config.Buffer)
+			reportedDropped = dropped
+		}
+	}
+	flush := func() {
+		if len(batch) > 0 {
+			b.send(batch)
+			batch = make([]interface{}, 0, b.config.BatchSize)
+		}
+		reportDropped()
+	}
+
+	for {
+		select {
+		case <-stopCh:
+			// send what is queued already, without waiting for more
+			b.drain(batch)
+			reportDropped()
+			return
+		case item := <-b.items:
+			batch = append(batch, item)
+			if len(batch) >= b.config.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Flush sends the queued items in batches, without waiting for more.
+func (b *Batcher) Flush() {
+	b.drain(make([]interface{}, 0, b.config.BatchSize))
+}
+
+// drain sends the batch and the queued items in batches.
+func (b *Batcher) drain(batch []interface{}) {
+	for {
+		select {
+		case item := <-b.items:
+			batch = append(batch, item)
+			if len(batch) >= b.config.BatchSize {
+				b.send(batch)
+				batch = make([]interface{}, 0, b.config.BatchSize)
+			}
+		default:
+			if len(batch) > 0 {
+				b.send(batch)
+			}
+			return
+		}
+	}
+}
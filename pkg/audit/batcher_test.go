@@ -0,0 +1,78 @@
+package audit
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// batchRecorder records the batches sent by a batcher.
+type batchRecorder struct {
+	lock    sync.Mutex
+	batches [][]interface{}
+}
+
+func (r *batchRecorder) send(batch []interface{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.batches = append(r.batches, batch)
+}
+
+func (r *batchRecorder) sizes() []int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	sizes := make([]int, 0, len(r.batches))
+	for _, batch := range r.batches {
+		sizes = append(sizes, len(batch))
+	}
+	return sizes
+}
+
+func TestBatcherDrainsOnStop(t *testing.T) {
+	recorder := &batchRecorder{}
+	batcher := NewBatcher(BatcherConfig{BufferSize: 10, BatchSize: 3, FlushInterval: time.Hour}, recorder.send)
+	for i := 0; i < 7; i++ {
+		batcher.Add(i)
+	}
+
+	stopCh := make(chan struct{})
+	close(stopCh)
+	// the queued items are sent in full batches, and then the rest
+	batcher.run(stopCh)
+	if sizes := recorder.sizes(); len(sizes) != 3 || sizes[0] != 3 || sizes[1] != 3 || sizes[2] != 1 {
+		t.Errorf("expected batches of 3, 3 and 1 items, got %v", sizes)
+	}
+	if recorder.batches[2][0] != 6 {
+		t.Errorf("expected the items to be sent in order, got %v", recorder.batches)
+	}
+}
+
+func TestBatcherFlushesOnTick(t *testing.T) {
+	recorder := &batchRecorder{}
+	batcher := NewBatcher(BatcherConfig{BufferSize: 10, BatchSize: 100, FlushInterval: 10 * time.Millisecond}, recorder.send)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	batcher.RunUntil(stopCh)
+
+	batcher.Add("a")
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return len(recorder.sizes()) > 0, nil
+	})
+	if err != nil {
+		t.Errorf("expected a batch which isn't full to be sent after the flush interval")
+	}
+}
+
+func TestBatcherDropsWhenFull(t *testing.T) {
+	var onDrop int
+	batcher := NewBatcher(BatcherConfig{BufferSize: 2, BatchSize: 10, FlushInterval: time.Hour, OnDrop: func() { onDrop++ }}, (&batchRecorder{}).send)
+	// without running the batcher nothing drains the buffer
+	for i := 0; i < 5; i++ {
+		batcher.Add(i)
+	}
+	if batcher.Dropped() != 3 || onDrop != 3 {
+		t.Errorf("expected the items beyond the buffer to be dropped and counted, got %d dropped and %d counted", batcher.Dropped(), onDrop)
+	}
+}
@@ -0,0 +1,73 @@
+package audit
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// The remote write protocol is a snappy compressed protobuf message. Its messages are small
+// enough to be encoded by hand, which saves pulling in prometheus and snappy as dependencies.
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendTag(b []byte, field int, wireType int) []byte {
+	return appendUvarint(b, uint64(field<<3|wireType))
+}
+
+func appendVarint(b []byte, field int, v uint64) []byte {
+	b = appendTag(b, field, wireVarint)
+	return appendUvarint(b, v)
+}
+
+func appendFixed64(b []byte, field int, v float64) []byte {
+	b = appendTag(b, field, wireFixed64)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+	return append(b, buf[:]...)
+}
+
+func appendBytes(b []byte, field int, v []byte) []byte {
+	b = appendTag(b, field, wireBytes)
+	b = appendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendLabel(b []byte, name, value string) []byte {
+	b = appendBytes(b, 1, []byte(name))
+	return appendBytes(b, 2, []byte(value))
+}
+
+// maxLiteralLength is the longest literal whose length fits into the two byte length of a literal tag.
+const maxLiteralLength = 1 << 16
+
+// snappyEncode frames the data as a snappy block made of literals only. It doesn't compress,
+// but any snappy decoder reads it, and the audit samples are small.
+func snappyEncode(data []byte) []byte {
+	b := appendUvarint(make([]byte, 0, len(data)+len(data)/maxLiteralLength*3+16), uint64(len(data)))
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxLiteralLength {
+			n = maxLiteralLength
+		}
+		switch {
+		case n <= 60:
+			b = append(b, byte(n-1)<<2)
+		case n <= 1<<8:
+			b = append(b, 60<<2, byte(n-1))
+		default:
+			b = append(b, 61<<2, byte(n-1), byte((n-1)>>8))
+		}
+		b = append(b, data[:n]...)
+		data = data[n:]
+	}
+	return b
+}
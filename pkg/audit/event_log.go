@@ -0,0 +1,181 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// StdoutEventLog is the --audit-log path which writes the events to the standard output.
+const StdoutEventLog = "-"
+
+// eventLogBatchSize is the maximum number of events written at once.
+const eventLogBatchSize = 100
+
+// eventsDropped counts the events which weren't written because the buffer was full.
+var eventsDropped = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "adapter_audit_events_dropped_total",
+		Help: "Number of audit events dropped instead of being written to the audit log because the buffer was full.",
+	},
+)
+
+// The results of the requests recorded by the events.
+const (
+	ResultSuccess = "success"
+	ResultError   = "error"
+)
+
+// Event records a metric request the adapter has served.
+type Event struct {
+	Time time.Time `json:"time"`
+	// User is the name of the user of the request, e.g. the service account of the HPA controller
+	User string `json:"user,omitempty"`
+	// API is external or custom
+	API       string `json:"api"`
+	Metric    string `json:"metric"`
+	Namespace string `json:"namespace,omitempty"`
+	// Object is the described object of a custom metric requested by name, or the selector of the objects
+	Object   string `json:"object,omitempty"`
+	Selector string `json:"selector,omitempty"`
+	Result   string `json:"result"`
+	// Code is the HTTP status code of a failed request
+	Code           int32     `json:"code,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	Values         []float64 `json:"values,omitempty"`
+	LatencySeconds float64   `json:"latencySeconds"`
+}
+
+// NewEvent records a request of the metric of the api which started at start and failed with err, if not nil.
+// Its values are added with WithExternalValues or WithCustomValues.
+func NewEvent(ctx context.Context, api, metric, namespace, object, selector string, start time.Time, err error) Event {
+	now := time.Now()
+	e := Event{
+		Time:           now,
+		API:            api,
+		Metric:         metric,
+		Namespace:      namespace,
+		Object:         object,
+		Selector:       selector,
+		Result:         ResultSuccess,
+		LatencySeconds: now.Sub(start).Seconds(),
+	}
+	if u, found := request.UserFrom(ctx); found {
+		e.User = u.GetName()
+	}
+	if err != nil {
+		e.Result = ResultError
+		e.Error = err.Error()
+		if status, ok := err.(apierr.APIStatus); ok {
+			e.Code = status.Status().Code
+		}
+	}
+	return e
+}
+
+// WithExternalValues adds the values of an external metric to the event.
+func (e Event) WithExternalValues(values *external_metrics.ExternalMetricValueList) Event {
+	if values != nil {
+		for _, item := range values.Items {
+			e.Values = append(e.Values, item.Value.AsApproximateFloat64())
+		}
+	}
+	return e
+}
+
+// WithCustomValues adds the values of a custom metric to the event.
+func (e Event) WithCustomValues(values ...custom_metrics.MetricValue) Event {
+	for _, item := range values {
+		e.Values = append(e.Values, item.Value.AsApproximateFloat64())
+	}
+	return e
+}
+
+// OpenEventLog opens the file the events are appended to, or the standard output for StdoutEventLog.
+func OpenEventLog(path string) (io.Writer, error) {
+	if path == StdoutEventLog {
+		return os.Stdout, nil
+	}
+	return os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+}
+
+// EventLogger writes the events as JSON lines in the background. Logging never blocks the request,
+// the events are dropped when the buffer is full.
+type EventLogger struct {
+	lock sync.Mutex
+	out  io.Writer
+	// buffered batches the writes to out
+	buffered *bufio.Writer
+	batcher  *Batcher
+}
+
+// NewEventLogger creates a logger to out which buffers up to bufferSize events.
+func NewEventLogger(out io.Writer, bufferSize int) *EventLogger {
+	utils.RegisterMetrics(eventsDropped)
+	l := &EventLogger{out: out, buffered: bufio.NewWriter(out)}
+	l.batcher = NewBatcher(BatcherConfig{
+		Items:         "audit events",
+		Buffer:        "audit log",
+		BufferSize:    bufferSize,
+		BatchSize:     eventLogBatchSize,
+		FlushInterval: flushInterval,
+		OnDrop:        eventsDropped.Inc,
+	}, l.writeBatch)
+	return l
+}
+
+// Log queues the event. It's a no-op on a nil logger.
+func (l *EventLogger) Log(e Event) {
+	if l == nil {
+		return
+	}
+	l.batcher.Add(e)
+}
+
+// Dropped returns how many events have been dropped because the buffer was full.
+func (l *EventLogger) Dropped() uint64 {
+	return l.batcher.Dropped()
+}
+
+// RunUntil writes the queued events until stopCh is closed, and then the ones queued already.
+func (l *EventLogger) RunUntil(stopCh <-chan struct{}) {
+	l.batcher.RunUntil(stopCh)
+}
+
+// Flush writes the queued events, without waiting for more.
+func (l *EventLogger) Flush() {
+	l.batcher.Flush()
+}
+
+// writeBatch writes a batch of events at once, so that the log isn't written to once per event.
+func (l *EventLogger) writeBatch(batch []interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, item := range batch {
+		e := item.(Event)
+		line, err := json.Marshal(e)
+		if err != nil {
+			klog.Warningf("Failed to encode the audit event of metric %s, because of %v", e.Metric, err)
+			continue
+		}
+		// the errors are sticky, they are returned by Flush
+		l.buffered.Write(append(line, '\n'))
+	}
+	if err := l.buffered.Flush(); err != nil {
+		// auditing is best effort, the events are not retried
+		klog.Warningf("Failed to write %d audit events, because of %v", len(batch), err)
+		l.buffered.Reset(l.out)
+	}
+}
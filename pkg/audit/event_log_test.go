@@ -0,0 +1,108 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+func TestEventLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewEventLogger(&out, 10)
+
+	ctx := request.WithUser(context.TODO(), &user.DefaultInfo{Name: "system:serviceaccount:kube-system:horizontal-pod-autoscaler"})
+	values := &external_metrics.ExternalMetricValueList{Items: []external_metrics.ExternalMetricValue{
+		{Value: *resource.NewMilliQuantity(1500, resource.DecimalSI)},
+	}}
+	logger.Log(NewEvent(ctx, "external", "slb_l7_qps", "default", "", "slb.instance.id=lb-1", time.Now().Add(-time.Second), nil).WithExternalValues(values))
+	logger.Log(NewEvent(context.TODO(), "external", "slb_l7_qps", "default", "", "", time.Now(), apierr.NewNotFound(external_metrics.Resource("slb_l7_qps"), "")))
+	logger.Flush()
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected an event per request, got %q", out.String())
+	}
+	var success, failure Event
+	if err := json.Unmarshal([]byte(lines[0]), &success); err != nil {
+		t.Fatalf("Failed to decode event, because of %v", err)
+	}
+	if success.User != "system:serviceaccount:kube-system:horizontal-pod-autoscaler" || success.Metric != "slb_l7_qps" ||
+		success.Selector != "slb.instance.id=lb-1" || success.Result != ResultSuccess || len(success.Values) != 1 || success.Values[0] != 1.5 ||
+		success.LatencySeconds < 1 {
+		t.Errorf("unexpected event of a successful request %s", lines[0])
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &failure); err != nil {
+		t.Fatalf("Failed to decode event, because of %v", err)
+	}
+	if failure.User != "" || failure.Result != ResultError || failure.Code != 404 || failure.Error == "" || len(failure.Values) != 0 {
+		t.Errorf("unexpected event of a failed request %s", lines[1])
+	}
+}
+
+func TestEventLoggerDropsWhenFull(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewEventLogger(&out, 1)
+	before := testutil.ToFloat64(eventsDropped)
+	for i := 0; i < 3; i++ {
+		logger.Log(Event{Metric: "slb_l7_qps"})
+	}
+	if logger.Dropped() != 2 {
+		t.Errorf("expected the events beyond the buffer to be dropped, got %d dropped", logger.Dropped())
+	}
+	if dropped := testutil.ToFloat64(eventsDropped) - before; dropped != 2 {
+		t.Errorf("expected the dropped events to be counted, got %v", dropped)
+	}
+
+	// a nil logger is a no-op
+	var disabled *EventLogger
+	disabled.Log(Event{Metric: "slb_l7_qps"})
+}
+
+// countingWriter counts the writes to it, and fails them while err is set.
+type countingWriter struct {
+	bytes.Buffer
+	err    error
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestEventLoggerBatchesWrites(t *testing.T) {
+	out := &countingWriter{}
+	logger := NewEventLogger(out, 10)
+	for i := 0; i < 3; i++ {
+		logger.Log(Event{Metric: "slb_l7_qps"})
+	}
+	logger.Flush()
+	if out.writes != 1 || strings.Count(out.String(), "\n") != 3 {
+		t.Errorf("expected the events to be written at once, got %d writes of %q", out.writes, out.String())
+	}
+
+	// a failed write doesn't keep the next events from being written
+	out.err = errors.New("disk full")
+	logger.Log(Event{Metric: "slb_l7_qps"})
+	logger.Flush()
+	out.err = nil
+	logger.Log(Event{Metric: "slb_l7_rt"})
+	logger.Flush()
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 4 || !strings.Contains(lines[3], "slb_l7_rt") {
+		t.Errorf("expected the event after the failure to be written, got %q", out.String())
+	}
+}
@@ -0,0 +1,211 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+
+	"k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+const (
+	// DefaultBufferSize is the number of samples which may wait to be written.
+	DefaultBufferSize = 10000
+
+	maxBatchSize  = 500
+	flushInterval = 5 * time.Second
+	writeTimeout  = 10 * time.Second
+)
+
+// Sample is a metric value the adapter has returned.
+type Sample struct {
+	Name      string
+	Labels    map[string]string
+	Value     float64
+	Timestamp time.Time
+}
+
+// RemoteWriter pushes the samples to a Prometheus remote write endpoint in the background.
+// Writing never blocks the caller, the samples are dropped when the buffer is full.
+type RemoteWriter struct {
+	url     string
+	client  *http.Client
+	batcher *Batcher
+}
+
+// NewRemoteWriter creates a writer to the url which buffers up to bufferSize samples.
+func NewRemoteWriter(url string, bufferSize int) *RemoteWriter {
+	w := &RemoteWriter{
+		url:    url,
+		client: &http.Client{Timeout: writeTimeout},
+	}
+	w.batcher = NewBatcher(BatcherConfig{
+		Items:         "audit samples",
+		Buffer:        "remote write",
+		BufferSize:    bufferSize,
+		BatchSize:     maxBatchSize,
+		FlushInterval: flushInterval,
+	}, w.write)
+	return w
+}
+
+// Write queues the samples. It's a no-op on a nil writer.
+func (w *RemoteWriter) Write(samples ...Sample) {
+	if w == nil {
+		return
+	}
+	for _, s := range samples {
+		w.batcher.Add(s)
+	}
+}
+
+// WriteExternalMetrics queues the values of an external metric returned for the namespace.
+func (w *RemoteWriter) WriteExternalMetrics(namespace string, values *external_metrics.ExternalMetricValueList) {
+	if w == nil {
+		return
+	}
+	w.Write(ExternalSamples(namespace, values)...)
+}
+
+// WriteCustomMetrics queues the values of a custom metric.
+func (w *RemoteWriter) WriteCustomMetrics(values ...custom_metrics.MetricValue) {
+	if w == nil {
+		return
+	}
+	w.Write(CustomSamples(values...)...)
+}
+
+// ExternalSamples converts the values of an external metric returned for the namespace into samples.
+func ExternalSamples(namespace string, values *external_metrics.ExternalMetricValueList) []Sample {
+	if values == nil {
+		return nil
+	}
+	samples := make([]Sample, 0, len(values.Items))
+	for _, item := range values.Items {
+		labels := make(map[string]string, len(item.MetricLabels)+1)
+		for k, v := range item.MetricLabels {
+			labels[k] = v
+		}
+		if namespace != "" {
+			labels["namespace"] = namespace
+		}
+		samples = append(samples, Sample{
+			Name:      item.MetricName,
+			Labels:    labels,
+			Value:     item.Value.AsApproximateFloat64(),
+			Timestamp: item.Timestamp.Time,
+		})
+	}
+	return samples
+}
+
+// CustomSamples converts the values of a custom metric into samples labeled with their object.
+func CustomSamples(values ...custom_metrics.MetricValue) []Sample {
+	samples := make([]Sample, 0, len(values))
+	for _, item := range values {
+		labels := map[string]string{
+			"kind": item.DescribedObject.Kind,
+			"name": item.DescribedObject.Name,
+		}
+		if item.DescribedObject.Namespace != "" {
+			labels["namespace"] = item.DescribedObject.Namespace
+		}
+		samples = append(samples, Sample{
+			Name:      item.Metric.Name,
+			Labels:    labels,
+			Value:     item.Value.AsApproximateFloat64(),
+			Timestamp: item.Timestamp.Time,
+		})
+	}
+	return samples
+}
+
+// Dropped returns how many samples have been dropped because the buffer was full.
+func (w *RemoteWriter) Dropped() uint64 {
+	return w.batcher.Dropped()
+}
+
+// RunUntil sends the queued samples in batches until stopCh is closed.
+func (w *RemoteWriter) RunUntil(stopCh <-chan struct{}) {
+	w.batcher.RunUntil(stopCh)
+}
+
+// write sends a batch of samples.
+func (w *RemoteWriter) write(batch []interface{}) {
+	samples := make([]Sample, 0, len(batch))
+	for _, s := range batch {
+		samples = append(samples, s.(Sample))
+	}
+	if err := w.send(samples); err != nil {
+		// auditing is best effort, the samples are not retried
+		klog.Warningf("Failed to remote write %d audit samples to %s, because of %v", len(samples), w.url, err)
+	}
+}
+
+func (w *RemoteWriter) send(samples []Sample) error {
+	ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
+
+	body := snappyEncode(encodeWriteRequest(samples))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("server returned %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// encodeWriteRequest encodes the samples as a prometheus.WriteRequest protobuf message,
+// one time series per sample.
+func encodeWriteRequest(samples []Sample) []byte {
+	var request []byte
+	for _, s := range samples {
+		labels := make(map[string]string, len(s.Labels)+1)
+		for name, value := range s.Labels {
+			labels[name] = value
+		}
+		labels["__name__"] = s.Name
+		names := make([]string, 0, len(labels))
+		for name := range labels {
+			names = append(names, name)
+		}
+		// the labels of a series must be sorted by name
+		sort.Strings(names)
+
+		var series []byte
+		for _, name := range names {
+			series = appendBytes(series, 1, appendLabel(nil, name, labels[name]))
+		}
+
+		timestamp := s.Timestamp
+		if timestamp.IsZero() {
+			timestamp = time.Now()
+		}
+		var sample []byte
+		sample = appendFixed64(sample, 1, s.Value)
+		sample = appendVarint(sample, 2, uint64(timestamp.UnixNano()/int64(time.Millisecond)))
+		series = appendBytes(series, 2, sample)
+
+		request = appendBytes(request, 1, series)
+	}
+	return request
+}
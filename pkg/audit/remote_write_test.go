@@ -0,0 +1,211 @@
+package audit
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// receivedSeries is a time series decoded by the fake receiver.
+type receivedSeries struct {
+	labels    map[string]string
+	value     float64
+	timestamp int64
+}
+
+// fakeReceiver is a remote write endpoint which decodes the requests it gets.
+type fakeReceiver struct {
+	lock   sync.Mutex
+	series []receivedSeries
+	errs   []error
+}
+
+func (r *fakeReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if req.Header.Get("Content-Encoding") != "snappy" || req.Header.Get("Content-Type") != "application/x-protobuf" {
+		r.errs = append(r.errs, errors.New("unexpected remote write headers"))
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	data, err := snappyDecodeLiterals(body)
+	if err == nil {
+		err = r.decodeWriteRequest(data)
+	}
+	if err != nil {
+		r.errs = append(r.errs, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r *fakeReceiver) received() ([]receivedSeries, []error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]receivedSeries(nil), r.series...), append([]error(nil), r.errs...)
+}
+
+// snappyDecodeLiterals decodes a snappy block which only holds literals.
+func snappyDecodeLiterals(b []byte) ([]byte, error) {
+	length, n := binary.Uvarint(b)
+	if n <= 0 {
+		return nil, errors.New("invalid snappy length")
+	}
+	b = b[n:]
+	var data []byte
+	for len(b) > 0 {
+		tag := b[0]
+		if tag&3 != 0 {
+			return nil, errors.New("unexpected snappy copy")
+		}
+		size := int(tag >> 2)
+		b = b[1:]
+		switch size {
+		case 60:
+			size, b = int(b[0]), b[1:]
+		case 61:
+			size, b = int(b[0])|int(b[1])<<8, b[2:]
+		}
+		size++
+		data, b = append(data, b[:size]...), b[size:]
+	}
+	if uint64(len(data)) != length {
+		return nil, errors.New("snappy length mismatch")
+	}
+	return data, nil
+}
+
+// fields decodes a protobuf message into its fields, bytes fields as []byte and the others as uint64.
+func fields(b []byte) ([][2]interface{}, error) {
+	var result [][2]interface{}
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("invalid tag")
+		}
+		b = b[n:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case wireVarint:
+			v, n := binary.Uvarint(b)
+			result, b = append(result, [2]interface{}{field, v}), b[n:]
+		case wireFixed64:
+			result, b = append(result, [2]interface{}{field, binary.LittleEndian.Uint64(b)}), b[8:]
+		case wireBytes:
+			size, n := binary.Uvarint(b)
+			b = b[n:]
+			result, b = append(result, [2]interface{}{field, b[:size]}), b[size:]
+		default:
+			return nil, errors.New("unexpected wire type")
+		}
+	}
+	return result, nil
+}
+
+func (r *fakeReceiver) decodeWriteRequest(b []byte) error {
+	request, err := fields(b)
+	if err != nil {
+		return err
+	}
+	for _, ts := range request {
+		series := receivedSeries{labels: make(map[string]string)}
+		tsFields, err := fields(ts[1].([]byte))
+		if err != nil {
+			return err
+		}
+		for _, f := range tsFields {
+			inner, err := fields(f[1].([]byte))
+			if err != nil {
+				return err
+			}
+			switch f[0] {
+			case 1:
+				series.labels[string(inner[0][1].([]byte))] = string(inner[1][1].([]byte))
+			case 2:
+				series.value = math.Float64frombits(inner[0][1].(uint64))
+				series.timestamp = int64(inner[1][1].(uint64))
+			}
+		}
+		r.series = append(r.series, series)
+	}
+	return nil
+}
+
+func TestRemoteWriteExternalMetrics(t *testing.T) {
+	receiver := &fakeReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	stopCh := make(chan struct{})
+	writer := NewRemoteWriter(server.URL, 10)
+	writer.RunUntil(stopCh)
+
+	timestamp := metav1.NewTime(time.Unix(1620000000, 0))
+	writer.WriteExternalMetrics("default", &external_metrics.ExternalMetricValueList{
+		Items: []external_metrics.ExternalMetricValue{{
+			MetricName:   "slb_l7_qps",
+			MetricLabels: map[string]string{"window": "60s"},
+			Value:        *resource.NewMilliQuantity(1500, resource.DecimalSI),
+			Timestamp:    timestamp,
+		}},
+	})
+	// the samples are flushed on stop
+	close(stopCh)
+
+	var series []receivedSeries
+	var errs []error
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		series, errs = receiver.received()
+		return len(series) > 0 || len(errs) > 0, nil
+	})
+	if err != nil || len(errs) > 0 {
+		t.Fatalf("expected the sample to be received, got %v %v", err, errs)
+	}
+
+	s := series[0]
+	if s.labels["__name__"] != "slb_l7_qps" || s.labels["namespace"] != "default" || s.labels["window"] != "60s" {
+		t.Errorf("unexpected labels %v", s.labels)
+	}
+	if s.value != 1.5 || s.timestamp != 1620000000000 {
+		t.Errorf("unexpected sample %v at %d", s.value, s.timestamp)
+	}
+}
+
+func TestRemoteWriteDropsOnOverflow(t *testing.T) {
+	// without running the writer nothing drains the buffer
+	writer := NewRemoteWriter("http://localhost", 2)
+	for i := 0; i < 5; i++ {
+		writer.Write(Sample{Name: "slb_l7_qps"})
+	}
+	if writer.Dropped() != 3 {
+		t.Errorf("expected the samples beyond the buffer to be dropped, got %d dropped", writer.Dropped())
+	}
+}
+
+func TestNilRemoteWriter(t *testing.T) {
+	var writer *RemoteWriter
+	// auditing is disabled without a writer
+	writer.Write(Sample{Name: "slb_l7_qps"})
+	writer.WriteExternalMetrics("default", &external_metrics.ExternalMetricValueList{})
+}
+
+func TestSnappyEncodeLongData(t *testing.T) {
+	data := []byte(strings.Repeat("audit", maxLiteralLength))
+	decoded, err := snappyDecodeLiterals(snappyEncode(data))
+	if err != nil || string(decoded) != string(data) {
+		t.Errorf("expected long data to survive the snappy framing, got %v", err)
+	}
+}
@@ -0,0 +1,719 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	pmodel "github.com/prometheus/common/model"
+	yaml "gopkg.in/yaml.v2"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+	cfg "sigs.k8s.io/prometheus-adapter/pkg/config"
+)
+
+// MetricsDiscoveryConfig is the prometheus-adapter metrics discovery configuration
+// extended with the settings which only alibaba-cloud-metrics-adapter understands.
+type MetricsDiscoveryConfig struct {
+	// APIVersion is the version of the configuration layout. Older versions are upgraded
+	// to CurrentAPIVersion when loaded, and an empty one stands for APIVersionV1.
+	APIVersion string `json:"apiVersion,omitempty" yaml:"apiVersion,omitempty"`
+	// Rules specifies how to discover and map Prometheus metrics to
+	// custom metrics API resources.
+	Rules         []DiscoveryRule `json:"rules" yaml:"rules"`
+	ExternalRules []DiscoveryRule `json:"externalRules,omitempty" yaml:"externalRules,omitempty"`
+	// CustomResources are the namespaced custom resources which the rules may attach metrics to.
+	CustomResources []CustomResource `json:"customResources,omitempty" yaml:"customResources,omitempty"`
+	// ExternalMetrics holds the per metric settings of the external metrics.
+	ExternalMetrics []ExternalMetric `json:"externalMetrics,omitempty" yaml:"externalMetrics,omitempty"`
+	// CMSDimensionLabels translate the labels of the selectors of the CMS custom metrics to dimensions.
+	CMSDimensionLabels []CMSDimensionLabel `json:"cmsDimensionLabels,omitempty" yaml:"cmsDimensionLabels,omitempty"`
+	// ServiceAccountLabelMatchers restrict the series the service accounts requesting the metrics may read.
+	ServiceAccountLabelMatchers []ServiceAccountLabelMatchers `json:"serviceAccountLabelMatchers,omitempty" yaml:"serviceAccountLabelMatchers,omitempty"`
+	// AnnotationMetrics are custom metrics whose value is read from an annotation of the requested object.
+	AnnotationMetrics []AnnotationMetric `json:"annotationMetrics,omitempty" yaml:"annotationMetrics,omitempty"`
+}
+
+// AnnotationMetric is a custom metric whose value is written into an annotation of the object it's requested
+// for, e.g. a manual override of the scaling of a Deployment, rather than read from a backend.
+type AnnotationMetric struct {
+	Name string `json:"name" yaml:"name"`
+	// Annotation holds the value of the metric, a quantity such as `10` or `1500m`.
+	Annotation string `json:"annotation" yaml:"annotation"`
+	// Resources are the resources the metric is served for, e.g. `deployments.apps`.
+	Resources []string `json:"resources" yaml:"resources"`
+}
+
+// ServiceAccountLabelMatchers are ANDed into the selectors of the metrics a service account requests,
+// e.g. `tenant: team-a`, so that a tenant only reads its own series.
+type ServiceAccountLabelMatchers struct {
+	// ServiceAccount is the namespace/name of the service account.
+	ServiceAccount string `json:"serviceAccount" yaml:"serviceAccount"`
+	// LabelMatchers are the labels the series read by the service account must have.
+	LabelMatchers map[string]string `json:"labelMatchers" yaml:"labelMatchers"`
+}
+
+// CMSDimensionLabel lets the selectors of the CMS custom metrics reference an instance by a friendly
+// label, e.g. `instance: checkout`, which is translated to a CMS dimension, e.g. `instanceId: i-2ze...`,
+// before CMS is queried. A value missing from the lookup table fails the request.
+type CMSDimensionLabel struct {
+	Label string `json:"label" yaml:"label"`
+	// Dimension is the CMS dimension of the label. It defaults to utils.DefaultCMSDimension.
+	Dimension string `json:"dimension,omitempty" yaml:"dimension,omitempty"`
+	// Values maps the values of the label to the ones of the dimension.
+	Values map[string]string `json:"values" yaml:"values"`
+}
+
+// ExternalMetric holds the settings of an external metric, e.g. k8s_workload_cpu_util.
+type ExternalMetric struct {
+	Name string `json:"name" yaml:"name"`
+	// Base makes this a derived metric, which exposes the smoothed values of the base metric
+	// under its own name, while the base metric keeps returning the raw values.
+	Base string `json:"base,omitempty" yaml:"base,omitempty"`
+	// NoDataGracePeriod is how long the last known value keeps being returned, flagged as stale,
+	// while the metric has no data or its backend fails. It smooths the occasional gaps of CMS,
+	// and only applies to the metrics served from Alibaba Cloud. The errors of the query, e.g. a
+	// bad request or a metric not found, aren't bridged.
+	NoDataGracePeriod time.Duration `json:"noDataGracePeriod,omitempty" yaml:"noDataGracePeriod,omitempty"`
+	// Smoothing returns an exponentially weighted moving average of the values instead of the raw ones.
+	Smoothing *Smoothing `json:"smoothing,omitempty" yaml:"smoothing,omitempty"`
+	// AnomalyRejection replaces a value which deviates too much from the recent average, e.g. a bad data point,
+	// with the last good value.
+	AnomalyRejection *AnomalyRejection `json:"anomalyRejection,omitempty" yaml:"anomalyRejection,omitempty"`
+	// LabelRename renames the labels of the returned values, from the name the backend uses
+	// to the one the HPAs use. Selectors on the new names are matched against the old ones.
+	LabelRename map[string]string `json:"labelRename,omitempty" yaml:"labelRename,omitempty"`
+	// KeepLabels are the only labels of the returned values which are kept, by their names after LabelRename.
+	// The labels the selector of a request matches on are kept too.
+	KeepLabels []string `json:"keepLabels,omitempty" yaml:"keepLabels,omitempty"`
+	// DropLabels are the labels dropped from the returned values, by their names after LabelRename, e.g. the
+	// high cardinality ones. The requests may not select on them.
+	DropLabels []string `json:"dropLabels,omitempty" yaml:"dropLabels,omitempty"`
+	// Period is the statistics period in seconds of a metric served from CMS, which is one of
+	// utils.CMSPeriods. It defaults to utils.DefaultCMSPeriod, and the period given in the
+	// selector of a request takes precedence.
+	Period int `json:"period,omitempty" yaml:"period,omitempty"`
+	// Statistic is the statistic read from the data points of a metric served from CMS, which is
+	// one of utils.CMSStatistics. It defaults to utils.DefaultCMSStatistic, except for the workload
+	// metrics which keep reading the Sum, and the statistic given in the selector of a CMS custom
+	// metric takes precedence.
+	Statistic string `json:"statistic,omitempty" yaml:"statistic,omitempty"`
+	// NoInstancesPolicy tells what a metric served from CMS returns when its selector matches no
+	// instance, e.g. because the load balancer has been deleted, which is one of utils.NoInstancesPolicies.
+	// It defaults to utils.DefaultNoInstancesPolicy.
+	NoInstancesPolicy string `json:"noInstancesPolicy,omitempty" yaml:"noInstancesPolicy,omitempty"`
+	// ScaleToZero returns the genuine zero values of the metric as 0, so that the HPAs may scale the workloads
+	// to zero: an SLS ingress query without requests in its interval returns 0 rather than no value, and the
+	// AnomalyRejection accepts a drop to 0. The zero values of the other metrics keep their handling.
+	ScaleToZero bool `json:"scaleToZero,omitempty" yaml:"scaleToZero,omitempty"`
+	// FallbackRegion is the region a metric served from CMS is queried in when the region of the adapter
+	// can't be reached or answers with a server error, e.g. a region the custom metrics are also pushed to.
+	FallbackRegion string `json:"fallbackRegion,omitempty" yaml:"fallbackRegion,omitempty"`
+	// HedgeDelay is how long a query of a metric served from CMS runs before the same query is sent to
+	// its FallbackRegion too, the first answer winning. It needs a FallbackRegion, 0 never hedges the query.
+	HedgeDelay time.Duration `json:"hedgeDelay,omitempty" yaml:"hedgeDelay,omitempty"`
+	// CMSAPI is the API a CMS custom metric is queried with, one of utils.CMSAPIs. It defaults to
+	// utils.CMSMetricListAPI, the metrics reported to the hybrid monitoring need utils.CMSHybridAPI.
+	CMSAPI string `json:"cmsAPI,omitempty" yaml:"cmsAPI,omitempty"`
+	// HybridNamespace is the hybrid monitoring namespace a metric queried with utils.CMSHybridAPI is reported to.
+	HybridNamespace string `json:"hybridNamespace,omitempty" yaml:"hybridNamespace,omitempty"`
+	// Expression post-processes each value the backend returns, which it refers to as `value`,
+	// e.g. `value / 1024` or `min(value, 100)`. See utils.Expression for what it may contain.
+	Expression string `json:"expression,omitempty" yaml:"expression,omitempty"`
+	// Sources makes this a metric served by one of several other external metrics, e.g. the same
+	// metric from Prometheus and from CMS during a migration. The sources are in order of preference:
+	// the first source whose latest value is at most FreshnessTolerance older than the newest value
+	// of all the sources is returned.
+	Sources []string `json:"sources,omitempty" yaml:"sources,omitempty"`
+	// FreshnessTolerance is how much older the latest value of a source may be than the newest one
+	// for the source to be preferred still.
+	FreshnessTolerance time.Duration `json:"freshnessTolerance,omitempty" yaml:"freshnessTolerance,omitempty"`
+	// MaxParallelSources is how many of the Sources are queried at a time, all of them if zero.
+	MaxParallelSources int `json:"maxParallelSources,omitempty" yaml:"maxParallelSources,omitempty"`
+	// Ratio makes this a metric served by dividing the values of an external metric by the ones of another,
+	// e.g. the errors by the requests, both queried with the selector of the request.
+	Ratio *Ratio `json:"ratio,omitempty" yaml:"ratio,omitempty"`
+	// Quantization rounds the returned values, after their smoothing, to steady the scaling decisions.
+	Quantization *Quantization `json:"quantization,omitempty" yaml:"quantization,omitempty"`
+	// MinRefreshInterval is the minimum time between two queries of the backend for the same selector
+	// of the metric, whatever the requests and the cache ask for. The last result of the backend is
+	// returned in between, which protects a fragile backend from frequent polls.
+	MinRefreshInterval time.Duration `json:"minRefreshInterval,omitempty" yaml:"minRefreshInterval,omitempty"`
+	// RangeAggregation queries a metric served from Prometheus over a window instead of at an instant,
+	// e.g. the max of the last 5 minutes, and reduces the samples of each series to a single value.
+	RangeAggregation *RangeAggregation `json:"rangeAggregation,omitempty" yaml:"rangeAggregation,omitempty"`
+	// Sampling estimates the total of the series the query of a metric served from Prometheus returns from a
+	// share of them, e.g. for a selector matching thousands of series, and returns it as a single value. The
+	// estimate is off when a few series carry most of the total, and Prometheus still evaluates every series.
+	Sampling *Sampling `json:"sampling,omitempty" yaml:"sampling,omitempty"`
+	// ScalarLabels are the labels of the single value of a metric served from Prometheus whose query
+	// returns a scalar, e.g. `scalar(...)`, which has none otherwise.
+	ScalarLabels map[string]string `json:"scalarLabels,omitempty" yaml:"scalarLabels,omitempty"`
+	// CustomMetric serves the metric on the custom metrics API as well, under its name, from a custom
+	// metric of the Prometheus rules, e.g. the per pod requests of the external total requests. The values
+	// of both APIs are post-processed by the Expression and the Quantization of the metric.
+	CustomMetric string `json:"customMetric,omitempty" yaml:"customMetric,omitempty"`
+	// Backend is the provider the metric is served by, one of utils.KnownProviders, e.g. prometheus for a
+	// Prometheus metric named like a CMS one. By default the metric is served by whichever provider has it.
+	Backend string `json:"backend,omitempty" yaml:"backend,omitempty"`
+}
+
+// RangeAggregation reduces the samples of a range query over a window to a single value per series.
+type RangeAggregation struct {
+	// Window is how far back from the evaluation time the samples are queried.
+	Window time.Duration `json:"window" yaml:"window"`
+	// Operator reduces the samples, which is one of utils.RangeAggregationOperators.
+	Operator string `json:"operator" yaml:"operator"`
+	// Step is the resolution of the range query. It defaults to a tenth of the window.
+	Step time.Duration `json:"step,omitempty" yaml:"step,omitempty"`
+}
+
+// Sampling keeps a deterministic share of the series of a query, the same ones from one query to the next.
+type Sampling struct {
+	// Ratio is the share of the series which are kept, between 0 (exclusive) and 1.
+	Ratio float64 `json:"ratio" yaml:"ratio"`
+	// MinSeries is how many series a result has at most to be returned whole. Every result is sampled if it's 0.
+	MinSeries int `json:"minSeries,omitempty" yaml:"minSeries,omitempty"`
+}
+
+// Quantization rounds the values of a metric to the nearest multiple of a step.
+type Quantization struct {
+	// Step is the multiple the values are rounded to. It defaults to 1, the nearest integer.
+	Step float64 `json:"step,omitempty" yaml:"step,omitempty"`
+}
+
+// DefaultSmoothingExpireAfter is how long the moving average of a selector is kept while it isn't queried.
+const DefaultSmoothingExpireAfter = 10 * time.Minute
+
+// Smoothing configures the exponentially weighted moving average of a metric.
+type Smoothing struct {
+	// Alpha is the weight of the latest value, between 0 (exclusive) and 1.
+	Alpha float64 `json:"alpha" yaml:"alpha"`
+	// ExpireAfter is how long the moving average is kept while it isn't queried.
+	// It defaults to DefaultSmoothingExpireAfter.
+	ExpireAfter time.Duration `json:"expireAfter,omitempty" yaml:"expireAfter,omitempty"`
+}
+
+// The defaults of the anomaly rejection of a metric.
+const (
+	DefaultAnomalyWindow        = 5
+	DefaultAnomalyMaxRejections = 3
+	DefaultAnomalyExpireAfter   = 10 * time.Minute
+)
+
+// AnomalyRejection configures the rejection of the values of a metric which deviate more than a factor
+// from the average of its recent values.
+type AnomalyRejection struct {
+	// Factor is how many times greater, or smaller, than the average a value may be, more than 1.
+	Factor float64 `json:"factor" yaml:"factor"`
+	// Window is the number of recent values averaged, which have to be known for a value to be rejected.
+	// It defaults to DefaultAnomalyWindow.
+	Window int `json:"window,omitempty" yaml:"window,omitempty"`
+	// MaxRejections is the number of values rejected in a row after which the values are accepted again,
+	// so that a lasting change of the level of the metric isn't rejected forever. It defaults to DefaultAnomalyMaxRejections.
+	MaxRejections int `json:"maxRejections,omitempty" yaml:"maxRejections,omitempty"`
+	// ExpireAfter is how long the recent values are kept while they aren't queried.
+	// It defaults to DefaultAnomalyExpireAfter.
+	ExpireAfter time.Duration `json:"expireAfter,omitempty" yaml:"expireAfter,omitempty"`
+}
+
+// Ratio divides the values of the Numerator metric by the ones of the Denominator metric, group by group.
+type Ratio struct {
+	Numerator   string `json:"numerator" yaml:"numerator"`
+	Denominator string `json:"denominator" yaml:"denominator"`
+	// On are the labels which group the values of both metrics, the values of a group being summed before the
+	// division, e.g. [service]. The values are grouped by all their labels if it's empty.
+	On []string `json:"on,omitempty" yaml:"on,omitempty"`
+}
+
+// CustomResource is a namespaced custom resource, e.g. a CRD, which metrics can be attached to
+// through the resource overrides of a rule, even if the discovery of the apiserver doesn't know it.
+type CustomResource struct {
+	Group   string `json:"group" yaml:"group"`
+	Version string `json:"version" yaml:"version"`
+	Kind    string `json:"kind" yaml:"kind"`
+	// Resource is the plural name of the resource. It's guessed from the kind if empty.
+	Resource string `json:"resource,omitempty" yaml:"resource,omitempty"`
+}
+
+// GroupVersionKind returns the kind of the custom resource.
+func (r CustomResource) GroupVersionKind() schema.GroupVersionKind {
+	return schema.GroupVersionKind{Group: r.Group, Version: r.Version, Kind: r.Kind}
+}
+
+// GroupVersionResource returns the plural resource of the custom resource.
+func (r CustomResource) GroupVersionResource() schema.GroupVersionResource {
+	if r.Resource == "" {
+		plural, _ := apimeta.UnsafeGuessKindToResource(r.GroupVersionKind())
+		return plural
+	}
+	return schema.GroupVersionResource{Group: r.Group, Version: r.Version, Resource: r.Resource}
+}
+
+const (
+	// RecordingRuleType marks a rule targeting series produced by Prometheus recording
+	// rules, named following the level:metric:operations convention (e.g. namespace_pod:http_requests:rate5m).
+	RecordingRuleType = "recording"
+
+	// recordingRuleNameMatches splits a recording rule name into its level, metric and operations.
+	recordingRuleNameMatches = `^([^:]+):([^:]+):([^:]+)$`
+	// recordingRuleNameAs exposes the metric together with its operations, so that the
+	// rate window of the rollup (e.g. rate5m) stays part of the API name.
+	recordingRuleNameAs = "${2}_${3}"
+	// recordingRuleMetricsQuery doesn't apply any rate, since the series already are precomputed rollups.
+	recordingRuleMetricsQuery = "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)"
+
+	// HistogramRuleType marks a rule targeting the _bucket series of Prometheus histograms, which
+	// exposes a quantile of each histogram, e.g. http_request_duration_seconds_p95.
+	HistogramRuleType = "histogram"
+	// DefaultHistogramWindow is the window the buckets of a histogram rule are turned into rates over.
+	DefaultHistogramWindow = 2 * time.Minute
+
+	histogramRuleNameMatches = `^(.*)_bucket$`
+	// histogramRuleMetricsQuery keeps the le label of the buckets, which histogram_quantile needs, the external
+	// metrics having no group by labels.
+	histogramRuleMetricsQuery = "histogram_quantile(%s, sum(rate(<<.Series>>{<<.LabelMatchers>>}[%s])) by (<<if .GroupBy>><<.GroupBy>>, <<end>>le))"
+)
+
+// DiscoveryRule is a prometheus-adapter discovery rule plus the adapter specific extensions.
+type DiscoveryRule struct {
+	cfg.DiscoveryRule `json:",inline" yaml:",inline"`
+	// Type is the kind of the rule. It's empty for plain prometheus-adapter rules.
+	Type string `json:"type,omitempty" yaml:"type,omitempty"`
+	// LabelMatchers are ANDed into every query generated by this rule. They override the
+	// default label matchers of the same name, and an empty value drops that default matcher.
+	LabelMatchers map[string]string `json:"labelMatchers,omitempty" yaml:"labelMatchers,omitempty"`
+	// Timeout bounds the series query of the rule on a relist. A rule which times out keeps
+	// its previous series instead of failing the whole relist. 0 means no timeout.
+	Timeout time.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	// Quantile is the quantile a histogram rule exposes, between 0 and 1, e.g. 0.95.
+	Quantile float64 `json:"quantile,omitempty" yaml:"quantile,omitempty"`
+	// Window is the window the buckets of a histogram rule are turned into rates over, DefaultHistogramWindow if zero.
+	Window time.Duration `json:"window,omitempty" yaml:"window,omitempty"`
+	// UnitConventions overrides --prometheus-unit-conventions for the rule, which then names and queries
+	// its series after the suffix of their names, e.g. the _total counters become rates.
+	UnitConventions *bool `json:"unitConventions,omitempty" yaml:"unitConventions,omitempty"`
+}
+
+// PrometheusRule returns the plain prometheus-adapter form of the rule.
+func (r DiscoveryRule) PrometheusRule() cfg.DiscoveryRule {
+	rule := r.DiscoveryRule
+	if r.Type == HistogramRuleType {
+		return r.histogramRule()
+	}
+	if r.Type != RecordingRuleType {
+		return rule
+	}
+
+	// only fill in what the user didn't set, so recording rules can still be narrowed down
+	if rule.SeriesQuery == "" {
+		rule.SeriesQuery = fmt.Sprintf("{__name__=~%q}", recordingRuleNameMatches)
+	}
+	if rule.Name.Matches == "" {
+		rule.Name.Matches = recordingRuleNameMatches
+	}
+	if rule.Name.As == "" {
+		rule.Name.As = recordingRuleNameAs
+	}
+	if rule.MetricsQuery == "" {
+		rule.MetricsQuery = recordingRuleMetricsQuery
+	}
+	// the level of a recording rule lists the labels it keeps, which are named after the resources
+	if rule.Resources.Template == "" && len(rule.Resources.Overrides) == 0 {
+		rule.Resources.Template = "<<.Resource>>"
+	}
+	return rule
+}
+
+// histogramRule returns the plain prometheus-adapter form of a histogram rule, whose name and metrics
+// query are generated from its quantile unless the user set them.
+func (r DiscoveryRule) histogramRule() cfg.DiscoveryRule {
+	rule := r.DiscoveryRule
+	if rule.SeriesQuery == "" {
+		rule.SeriesQuery = fmt.Sprintf("{__name__=~%q}", histogramRuleNameMatches)
+	}
+	if rule.Name.Matches == "" {
+		rule.Name.Matches = histogramRuleNameMatches
+	}
+	if rule.Name.As == "" {
+		rule.Name.As = "${1}_" + quantileName(r.Quantile)
+	}
+	if rule.MetricsQuery == "" {
+		window := r.Window
+		if window == 0 {
+			window = DefaultHistogramWindow
+		}
+		rule.MetricsQuery = fmt.Sprintf(histogramRuleMetricsQuery, strconv.FormatFloat(r.Quantile, 'f', -1, 64), pmodel.Duration(window))
+	}
+	return rule
+}
+
+// quantileName names a quantile as a percentile, e.g. p95 for 0.95 or p99_9 for 0.999.
+func quantileName(quantile float64) string {
+	percentile := math.Round(quantile*1e6) / 1e4
+	return "p" + strings.Replace(strconv.FormatFloat(percentile, 'f', -1, 64), ".", "_", 1)
+}
+
+// PrometheusRules returns the plain prometheus-adapter form of the given rules.
+func PrometheusRules(rules []DiscoveryRule) []cfg.DiscoveryRule {
+	res := make([]cfg.DiscoveryRule, 0, len(rules))
+	for _, rule := range rules {
+		res = append(res, rule.PrometheusRule())
+	}
+	return res
+}
+
+func (c *MetricsDiscoveryConfig) validate() error {
+	for _, rules := range [][]DiscoveryRule{c.Rules, c.ExternalRules} {
+		for _, rule := range rules {
+			if rule.Type != "" && rule.Type != RecordingRuleType && rule.Type != HistogramRuleType {
+				return fmt.Errorf("unknown type %q of rule with series query %q", rule.Type, rule.SeriesQuery)
+			}
+			if rule.Type == HistogramRuleType {
+				if rule.Quantile <= 0 || rule.Quantile >= 1 {
+					return fmt.Errorf("quantile %v of histogram rule with series query %q must be between 0 and 1, e.g. 0.95", rule.Quantile, rule.SeriesQuery)
+				}
+				if rule.Window < 0 {
+					return fmt.Errorf("window of histogram rule with series query %q must not be negative", rule.SeriesQuery)
+				}
+			} else if rule.Quantile != 0 || rule.Window != 0 {
+				return fmt.Errorf("rule with series query %q must be a histogram rule to have a quantile or a window", rule.SeriesQuery)
+			}
+			if rule.Timeout < 0 {
+				return fmt.Errorf("timeout of rule with series query %q must not be negative", rule.SeriesQuery)
+			}
+			if rule.UnitConventions != nil && *rule.UnitConventions && !rule.followsUnitConventions(true) {
+				return fmt.Errorf("rule with series query %q can't follow the unit conventions, which name and query its metrics, with a type, a name or a metrics query", rule.SeriesQuery)
+			}
+		}
+	}
+	for _, resource := range c.CustomResources {
+		if resource.Version == "" || resource.Kind == "" {
+			return fmt.Errorf("custom resource %s must have both a version and a kind", resource.GroupVersionKind())
+		}
+	}
+	translatedLabels := make(map[string]bool, len(c.CMSDimensionLabels))
+	for _, label := range c.CMSDimensionLabels {
+		if label.Label == "" || strings.HasPrefix(label.Label, "cms.custom.") {
+			return fmt.Errorf("cms dimension labels must have a label which isn't a cms.custom. parameter, got %q", label.Label)
+		}
+		if translatedLabels[label.Label] {
+			return fmt.Errorf("cms dimension label %s is configured several times", label.Label)
+		}
+		translatedLabels[label.Label] = true
+		if len(label.Values) == 0 {
+			return fmt.Errorf("cms dimension label %s must have values", label.Label)
+		}
+	}
+	annotationMetrics := make(map[string]bool, len(c.AnnotationMetrics))
+	for _, m := range c.AnnotationMetrics {
+		if m.Name == "" {
+			return fmt.Errorf("annotation metrics must have a name")
+		}
+		if annotationMetrics[m.Name] {
+			return fmt.Errorf("annotation metric %s is configured several times", m.Name)
+		}
+		annotationMetrics[m.Name] = true
+		if errs := validation.IsQualifiedName(m.Annotation); len(errs) > 0 {
+			return fmt.Errorf("annotation %q of annotation metric %s is no valid annotation name: %s", m.Annotation, m.Name, strings.Join(errs, ", "))
+		}
+		if len(m.Resources) == 0 {
+			return fmt.Errorf("annotation metric %s must have resources", m.Name)
+		}
+		for _, resource := range m.Resources {
+			if resource == "" || strings.HasPrefix(resource, ".") {
+				return fmt.Errorf("resource %q of annotation metric %s must be a resource, e.g. deployments.apps", resource, m.Name)
+			}
+		}
+	}
+	serviceAccounts := make(map[string]bool, len(c.ServiceAccountLabelMatchers))
+	for _, m := range c.ServiceAccountLabelMatchers {
+		parts := strings.Split(m.ServiceAccount, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("service account label matchers must have a service account of the form namespace/name, got %q", m.ServiceAccount)
+		}
+		if serviceAccounts[m.ServiceAccount] {
+			return fmt.Errorf("label matchers of service account %s are configured several times", m.ServiceAccount)
+		}
+		serviceAccounts[m.ServiceAccount] = true
+		if len(m.LabelMatchers) == 0 {
+			return fmt.Errorf("service account %s must have label matchers", m.ServiceAccount)
+		}
+		for label := range m.LabelMatchers {
+			if label == "" {
+				return fmt.Errorf("label matchers of service account %s must not have empty label names", m.ServiceAccount)
+			}
+		}
+	}
+	derived := make(map[string]bool)
+	sourced := make(map[string]bool)
+	aliased := make(map[string]bool)
+	ratios := make(map[string]bool)
+	for _, metric := range c.ExternalMetrics {
+		if metric.Ratio != nil {
+			ratios[metric.Name] = true
+		}
+		if metric.Base != "" {
+			derived[metric.Name] = true
+		}
+		if metric.CustomMetric != "" {
+			aliased[metric.Name] = true
+		}
+		if len(metric.Sources) > 0 {
+			sourced[metric.Name] = true
+		}
+	}
+	for _, metric := range c.ExternalMetrics {
+		if metric.Name == "" {
+			return fmt.Errorf("external metrics must have a name")
+		}
+		if metric.Base != "" {
+			if metric.Base == metric.Name || derived[metric.Base] {
+				return fmt.Errorf("derived external metric %s must be based on a metric which isn't derived itself", metric.Name)
+			}
+			if metric.Smoothing == nil {
+				return fmt.Errorf("derived external metric %s must configure smoothing", metric.Name)
+			}
+		}
+		if len(metric.Sources) > 0 {
+			if metric.Base != "" {
+				return fmt.Errorf("external metric %s must not have both a base and sources", metric.Name)
+			}
+			for _, source := range metric.Sources {
+				if source == "" || source == metric.Name || derived[source] || sourced[source] {
+					return fmt.Errorf("source %q of external metric %s must be a metric which is neither derived nor has sources itself", source, metric.Name)
+				}
+			}
+		}
+		if r := metric.Ratio; r != nil {
+			if metric.Base != "" || len(metric.Sources) > 0 {
+				return fmt.Errorf("external metric %s must not have a ratio and a base or sources", metric.Name)
+			}
+			for _, operand := range []string{r.Numerator, r.Denominator} {
+				if operand == "" || operand == metric.Name || derived[operand] || ratios[operand] {
+					return fmt.Errorf("numerator and denominator of external metric %s must be set to metrics which are neither derived nor ratios themselves", metric.Name)
+				}
+			}
+			for _, label := range r.On {
+				if label == "" {
+					return fmt.Errorf("ratio of external metric %s must not group on empty label names", metric.Name)
+				}
+			}
+		}
+		if metric.FreshnessTolerance < 0 {
+			return fmt.Errorf("freshness tolerance of external metric %s must not be negative", metric.Name)
+		}
+		if metric.MaxParallelSources < 0 {
+			return fmt.Errorf("maximum parallel sources of external metric %s must not be negative", metric.Name)
+		}
+		if metric.MinRefreshInterval < 0 {
+			return fmt.Errorf("minimum refresh interval of external metric %s must not be negative", metric.Name)
+		}
+		if metric.NoDataGracePeriod < 0 {
+			return fmt.Errorf("no data grace period of external metric %s must not be negative", metric.Name)
+		}
+		if s := metric.Smoothing; s != nil && (s.Alpha <= 0 || s.Alpha > 1 || s.ExpireAfter < 0) {
+			return fmt.Errorf("smoothing of external metric %s must have an alpha in (0, 1] and a non negative expiry", metric.Name)
+		}
+		if a := metric.AnomalyRejection; a != nil && (a.Factor <= 1 || a.Window < 0 || a.MaxRejections < 0 || a.ExpireAfter < 0) {
+			return fmt.Errorf("anomaly rejection of external metric %s must have a factor greater than 1, and a non negative window, max rejections and expiry", metric.Name)
+		}
+		if q := metric.Quantization; q != nil && q.Step < 0 {
+			return fmt.Errorf("quantization step of external metric %s must not be negative", metric.Name)
+		}
+		if metric.Period != 0 && !utils.IsCMSPeriod(metric.Period) {
+			return fmt.Errorf("period %d of external metric %s is not supported by CMS, it must be one of %v seconds", metric.Period, metric.Name, utils.CMSPeriods)
+		}
+		if metric.Statistic != "" && !utils.IsCMSStatistic(metric.Statistic) {
+			return fmt.Errorf("statistic %q of external metric %s is not supported, it must be one of %v", metric.Statistic, metric.Name, utils.CMSStatistics)
+		}
+		if a := metric.RangeAggregation; a != nil {
+			if a.Window <= 0 || a.Step < 0 || a.Step > a.Window {
+				return fmt.Errorf("range aggregation of external metric %s must have a positive window and a step which is at most the window", metric.Name)
+			}
+			if !utils.IsRangeAggregationOperator(a.Operator) {
+				return fmt.Errorf("range aggregation operator %q of external metric %s is not supported, it must be one of %v", a.Operator, metric.Name, utils.RangeAggregationOperators)
+			}
+		}
+		if s := metric.Sampling; s != nil {
+			if s.Ratio <= 0 || s.Ratio > 1 || s.MinSeries < 0 {
+				return fmt.Errorf("sampling of external metric %s must have a ratio between 0 (exclusive) and 1 and a non negative minSeries", metric.Name)
+			}
+			if metric.Base != "" || len(metric.Sources) > 0 || metric.Ratio != nil {
+				return fmt.Errorf("external metric %s must not have a sampling, it's served from other external metrics", metric.Name)
+			}
+		}
+		if metric.NoInstancesPolicy != "" && !utils.IsNoInstancesPolicy(metric.NoInstancesPolicy) {
+			return fmt.Errorf("no instances policy %q of external metric %s is not supported, it must be one of %v", metric.NoInstancesPolicy, metric.Name, utils.NoInstancesPolicies)
+		}
+		if metric.Backend != "" {
+			if !utils.IsKnownProvider(metric.Backend) {
+				return fmt.Errorf("backend %q of external metric %s is not supported, it must be one of %v", metric.Backend, metric.Name, utils.KnownProviders)
+			}
+			if metric.Base != "" || len(metric.Sources) > 0 || metric.Ratio != nil {
+				return fmt.Errorf("external metric %s must not have a backend, it's served from other external metrics", metric.Name)
+			}
+		}
+		if metric.CMSAPI != "" && !utils.IsCMSAPI(metric.CMSAPI) {
+			return fmt.Errorf("cms api %q of external metric %s is not supported, it must be one of %v", metric.CMSAPI, metric.Name, utils.CMSAPIs)
+		}
+		if hybrid := metric.CMSAPI == utils.CMSHybridAPI; hybrid != (metric.HybridNamespace != "") {
+			return fmt.Errorf("external metric %s must have a hybridNamespace if and only if its cmsAPI is %s", metric.Name, utils.CMSHybridAPI)
+		}
+		if custom := strings.TrimPrefix(metric.Name, utils.CMSCustomMetricPrefix); metric.CMSAPI != "" && (custom == "" || custom == metric.Name) {
+			return fmt.Errorf("external metric %s has a cmsAPI but is no cms custom metric, its name must be %s<metric name>", metric.Name, utils.CMSCustomMetricPrefix)
+		}
+		if metric.CustomMetric != "" && metric.CustomMetric != metric.Name && aliased[metric.CustomMetric] {
+			return fmt.Errorf("custom metric %s of external metric %s is served from a custom metric itself", metric.CustomMetric, metric.Name)
+		}
+		if metric.FallbackRegion != "" && !utils.IsRegion(metric.FallbackRegion) {
+			return fmt.Errorf("fallback region %q of external metric %s is no region id, e.g. cn-hangzhou", metric.FallbackRegion, metric.Name)
+		}
+		if metric.HedgeDelay < 0 {
+			return fmt.Errorf("hedge delay of external metric %s must not be negative", metric.Name)
+		}
+		if metric.HedgeDelay > 0 && metric.FallbackRegion == "" {
+			return fmt.Errorf("external metric %s has a hedge delay but no fallback region to hedge its queries to", metric.Name)
+		}
+		if metric.Expression != "" {
+			if _, err := utils.CompileExpression(metric.Expression); err != nil {
+				return fmt.Errorf("external metric %s: %v", metric.Name, err)
+			}
+		}
+		for name, value := range metric.ScalarLabels {
+			if !pmodel.LabelName(name).IsValid() || !pmodel.LabelValue(value).IsValid() {
+				return fmt.Errorf("scalar label %s=%q of external metric %s is no valid Prometheus label", name, value, metric.Name)
+			}
+		}
+		if len(metric.KeepLabels) > 0 && len(metric.DropLabels) > 0 {
+			return fmt.Errorf("external metric %s must not have both keep labels and drop labels", metric.Name)
+		}
+		for _, label := range append(append([]string(nil), metric.KeepLabels...), metric.DropLabels...) {
+			if label == "" {
+				return fmt.Errorf("keep labels and drop labels of external metric %s must not have empty label names", metric.Name)
+			}
+		}
+		renamedTo := make(map[string]bool, len(metric.LabelRename))
+		for _, to := range metric.LabelRename {
+			renamedTo[to] = true
+		}
+		for _, label := range metric.DropLabels {
+			if renamedTo[label] {
+				return fmt.Errorf("external metric %s must not drop label %s, which its label rename renames a label to for the selectors", metric.Name, label)
+			}
+		}
+		renamed := make(map[string]bool, len(metric.LabelRename))
+		for from, to := range metric.LabelRename {
+			if from == "" || to == "" {
+				return fmt.Errorf("label rename of external metric %s must not have empty label names", metric.Name)
+			}
+			if renamed[to] {
+				return fmt.Errorf("label rename of external metric %s renames several labels to %s", metric.Name, to)
+			}
+			renamed[to] = true
+		}
+	}
+	return nil
+}
+
+// FromFile loads the configuration from a particular file, see Load.
+func FromFile(filename string, strict bool) (*MetricsDiscoveryConfig, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load metrics discovery config file: %v", err)
+	}
+	defer file.Close()
+	contents, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load metrics discovery config file: %v", err)
+	}
+	c, warnings, err := Load(contents, strict)
+	for _, warning := range warnings {
+		klog.Warningf("metrics discovery config %s: %s", filename, warning)
+	}
+	return c, err
+}
+
+// FromYAML loads the configuration from a blob of YAML, warning about unknown fields.
+func FromYAML(contents []byte) (*MetricsDiscoveryConfig, error) {
+	c, warnings, err := Load(contents, false)
+	for _, warning := range warnings {
+		klog.Warningf("metrics discovery config: %s", warning)
+	}
+	return c, err
+}
+
+// Load loads the configuration from a blob of YAML, and upgrades it to CurrentAPIVersion.
+// It returns warnings about the deprecated fields, and about the unknown fields unless
+// strict is set, in which case they are rejected.
+func Load(contents []byte, strict bool) (*MetricsDiscoveryConfig, []string, error) {
+	c, warnings, err := parse(contents, strict)
+	if err != nil {
+		return nil, warnings, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, warnings, fmt.Errorf("invalid metrics discovery config: %v", err)
+	}
+	return c, warnings, nil
+}
+
+// parse is Load without the validation, which is left to after the merge of several files.
+func parse(contents []byte, strict bool) (*MetricsDiscoveryConfig, []string, error) {
+	var version struct {
+		APIVersion string `yaml:"apiVersion"`
+	}
+	if err := yaml.Unmarshal(contents, &version); err != nil {
+		return nil, nil, fmt.Errorf("unable to parse metrics discovery config: %v", err)
+	}
+
+	var (
+		c        *MetricsDiscoveryConfig
+		warnings []string
+		err      error
+	)
+	switch version.APIVersion {
+	case "", APIVersionV1:
+		var old v1Config
+		if warnings, err = unmarshal(contents, &old, strict); err == nil {
+			c, warnings = old.upgrade(), append(warnings, old.deprecations()...)
+		}
+	case CurrentAPIVersion:
+		c = &MetricsDiscoveryConfig{}
+		warnings, err = unmarshal(contents, c, strict)
+	default:
+		return nil, nil, fmt.Errorf("unsupported metrics discovery config apiVersion %q, it must be %s or %s", version.APIVersion, APIVersionV1, CurrentAPIVersion)
+	}
+	if err != nil {
+		return nil, warnings, fmt.Errorf("unable to parse metrics discovery config: %v", err)
+	}
+	return c, warnings, nil
+}
+
+// unmarshal decodes the configuration, and returns the unknown fields as warnings,
+// or as an error if strict is set.
+func unmarshal(contents []byte, out interface{}, strict bool) ([]string, error) {
+	if err := yaml.Unmarshal(contents, out); err != nil {
+		return nil, err
+	}
+	// the types match already, so the strict decoding only fails on unknown or duplicate fields
+	err := yaml.UnmarshalStrict(contents, reflect.New(reflect.TypeOf(out).Elem()).Interface())
+	if err == nil {
+		return nil, nil
+	}
+	if strict {
+		return nil, err
+	}
+	typeErr, ok := err.(*yaml.TypeError)
+	if !ok {
+		return []string{err.Error()}, nil
+	}
+	return append([]string(nil), typeErr.Errors...), nil
+}
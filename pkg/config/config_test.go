@@ -0,0 +1,768 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFromYAMLWithRuleExtensions(t *testing.T) {
+	c, err := FromYAML([]byte(`
+rules:
+- seriesQuery: 'http_requests_total{namespace!="",pod!=""}'
+  resources:
+    template: <<.Resource>>
+  name:
+    matches: ^(.*)_total
+    as: ${1}_per_second
+  metricsQuery: sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m])) by (<<.GroupBy>>)
+  labelMatchers:
+    cluster: prod
+`))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if len(c.Rules) != 1 {
+		t.Fatalf("expected 1 rule, got %d", len(c.Rules))
+	}
+	rule := c.Rules[0]
+	if rule.SeriesQuery != `http_requests_total{namespace!="",pod!=""}` || rule.Name.As != "${1}_per_second" {
+		t.Errorf("prometheus-adapter rule fields were not loaded: %+v", rule.DiscoveryRule)
+	}
+	if rule.LabelMatchers["cluster"] != "prod" {
+		t.Errorf("expected labelMatchers to be loaded, got %v", rule.LabelMatchers)
+	}
+	if len(PrometheusRules(c.Rules)) != 1 {
+		t.Errorf("expected 1 prometheus-adapter rule")
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	contents := []byte("rules:\n- seriesQuery: up\n  unknownField: true\n")
+	c, warnings, err := Load(contents, false)
+	if err != nil {
+		t.Fatalf("expected unknown fields to be only warned about, got %v", err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "unknownField") {
+		t.Errorf("expected a warning about the unknown field, got %v", warnings)
+	}
+	if len(c.Rules) != 1 || c.Rules[0].SeriesQuery != "up" {
+		t.Errorf("expected the known fields to be loaded, got %+v", c.Rules)
+	}
+
+	if _, _, err := Load(contents, true); err == nil {
+		t.Errorf("expected unknown fields to be rejected in strict mode")
+	}
+	// mismatching types are no unknown fields
+	if _, _, err := Load([]byte("rules:\n- seriesQuery: [up]\n"), false); err == nil {
+		t.Errorf("expected a malformed field to be rejected")
+	}
+}
+
+func TestLoadV1Config(t *testing.T) {
+	for _, version := range []string{"", "apiVersion: v1\n"} {
+		c, warnings, err := Load([]byte(version+`
+rules:
+- seriesQuery: 'http_requests_total{namespace!="",pod!=""}'
+  resources:
+    template: <<.Resource>>
+  metricsQuery: sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m])) by (<<.GroupBy>>)
+resourceRules:
+  window: 1m
+externalMetrics:
+- name: slb_l7_qps
+  noDataGracePeriod: 2m
+`), true)
+		if err != nil {
+			t.Fatalf("Failed to load v1 config, because of %v", err)
+		}
+		if c.APIVersion != CurrentAPIVersion {
+			t.Errorf("expected the config to be upgraded to %s, got %q", CurrentAPIVersion, c.APIVersion)
+		}
+		if len(c.Rules) != 1 || len(c.ExternalMetrics) != 1 || c.ExternalMetrics[0].NoDataGracePeriod != 2*time.Minute {
+			t.Errorf("expected the rules and external metrics to be kept, got %+v", c)
+		}
+		if len(warnings) != 1 || !strings.Contains(warnings[0], "resourceRules is deprecated") {
+			t.Errorf("expected a deprecation warning about resourceRules, got %v", warnings)
+		}
+	}
+}
+
+func TestLoadCurrentConfig(t *testing.T) {
+	c, warnings, err := Load([]byte("apiVersion: v2\nrules:\n- seriesQuery: up\n"), true)
+	if err != nil || len(warnings) != 0 {
+		t.Fatalf("Failed to load v2 config, because of %v %v", err, warnings)
+	}
+	if c.APIVersion != CurrentAPIVersion || len(c.Rules) != 1 {
+		t.Errorf("unexpected config %+v", c)
+	}
+
+	// resourceRules are gone from v2
+	if _, _, err := Load([]byte("apiVersion: v2\nresourceRules:\n  window: 1m\n"), true); err == nil {
+		t.Errorf("expected resourceRules to be an unknown field of v2")
+	}
+	if _, _, err := Load([]byte("apiVersion: v3\n"), false); err == nil {
+		t.Errorf("expected an unsupported apiVersion to be rejected")
+	}
+}
+
+func TestRecordingRuleDefaults(t *testing.T) {
+	c, err := FromYAML([]byte("rules:\n- type: recording\n  seriesQuery: '{__name__=~\"namespace_pod:.*\"}'\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	rule := c.Rules[0].PrometheusRule()
+	if rule.SeriesQuery != `{__name__=~"namespace_pod:.*"}` {
+		t.Errorf("expected the configured series query to be kept, got %s", rule.SeriesQuery)
+	}
+	if rule.Name.Matches == "" || rule.Name.As == "" || rule.MetricsQuery == "" || rule.Resources.Template == "" {
+		t.Errorf("expected recording rule defaults to be filled in, got %+v", rule)
+	}
+}
+
+func TestFromYAMLRejectsUnknownRuleType(t *testing.T) {
+	if _, err := FromYAML([]byte("rules:\n- type: histogramm\n")); err == nil {
+		t.Errorf("expected unknown rule type to be rejected")
+	}
+}
+
+func TestCustomResources(t *testing.T) {
+	c, err := FromYAML([]byte(`
+customResources:
+- group: keda.sh
+  version: v1alpha1
+  kind: ScaledJob
+- group: example.com
+  version: v1
+  kind: Cache
+  resource: cachez
+`))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if len(c.CustomResources) != 2 {
+		t.Fatalf("expected 2 custom resources, got %d", len(c.CustomResources))
+	}
+	if gvr := c.CustomResources[0].GroupVersionResource(); gvr.Resource != "scaledjobs" || gvr.Group != "keda.sh" {
+		t.Errorf("expected the resource to be guessed from the kind, got %v", gvr)
+	}
+	if gvr := c.CustomResources[1].GroupVersionResource(); gvr.Resource != "cachez" {
+		t.Errorf("expected the configured resource to be kept, got %v", gvr)
+	}
+
+	if _, err := FromYAML([]byte("customResources:\n- group: keda.sh\n  kind: ScaledJob\n")); err == nil {
+		t.Errorf("expected a custom resource without version to be rejected")
+	}
+}
+
+func TestExternalMetrics(t *testing.T) {
+	c, err := FromYAML([]byte("externalMetrics:\n- name: k8s_workload_cpu_util\n  noDataGracePeriod: 2m\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if len(c.ExternalMetrics) != 1 || c.ExternalMetrics[0].NoDataGracePeriod != 2*time.Minute {
+		t.Errorf("expected the grace period to be loaded, got %+v", c.ExternalMetrics)
+	}
+
+	if _, err := FromYAML([]byte("externalMetrics:\n- noDataGracePeriod: 2m\n")); err == nil {
+		t.Errorf("expected an external metric without name to be rejected")
+	}
+}
+
+func TestExternalMetricSmoothing(t *testing.T) {
+	c, err := FromYAML([]byte("externalMetrics:\n- name: slb_l7_qps\n  smoothing:\n    alpha: 0.5\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if s := c.ExternalMetrics[0].Smoothing; s == nil || s.Alpha != 0.5 {
+		t.Errorf("expected the smoothing to be loaded, got %+v", s)
+	}
+
+	for _, alpha := range []string{"0", "1.5", "-0.1"} {
+		if _, err := FromYAML([]byte("externalMetrics:\n- name: slb_l7_qps\n  smoothing:\n    alpha: " + alpha + "\n")); err == nil {
+			t.Errorf("expected alpha %s to be rejected", alpha)
+		}
+	}
+}
+
+func TestDerivedExternalMetrics(t *testing.T) {
+	c, err := FromYAML([]byte(`
+externalMetrics:
+- name: slb_l7_qps_smoothed
+  base: slb_l7_qps
+  smoothing:
+    alpha: 0.3
+`))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if c.ExternalMetrics[0].Base != "slb_l7_qps" {
+		t.Errorf("expected the base metric to be loaded, got %+v", c.ExternalMetrics[0])
+	}
+
+	for _, invalid := range []string{
+		"externalMetrics:\n- name: a_smoothed\n  base: a\n",
+		"externalMetrics:\n- name: a\n  base: a\n  smoothing:\n    alpha: 0.3\n",
+		"externalMetrics:\n- name: b\n  base: a\n  smoothing:\n    alpha: 0.3\n- name: c\n  base: b\n  smoothing:\n    alpha: 0.3\n",
+	} {
+		if _, err := FromYAML([]byte(invalid)); err == nil {
+			t.Errorf("expected derived metrics %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestExternalMetricLabelRename(t *testing.T) {
+	c, err := FromYAML([]byte("externalMetrics:\n- name: slb_l7_qps\n  labelRename:\n    slb.instance.id: instance\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if c.ExternalMetrics[0].LabelRename["slb.instance.id"] != "instance" {
+		t.Errorf("expected the label rename to be loaded, got %+v", c.ExternalMetrics[0])
+	}
+
+	for _, invalid := range []string{
+		"externalMetrics:\n- name: slb_l7_qps\n  labelRename:\n    slb.instance.id: \"\"\n",
+		"externalMetrics:\n- name: slb_l7_qps\n  labelRename:\n    a: instance\n    b: instance\n",
+	} {
+		if _, err := FromYAML([]byte(invalid)); err == nil {
+			t.Errorf("expected label rename %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestExternalMetricLabelFilter(t *testing.T) {
+	c, err := FromYAML([]byte("externalMetrics:\n- name: http_requests\n  keepLabels: [service]\n- name: slb_l7_qps\n  dropLabels: [pod]\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if len(c.ExternalMetrics[0].KeepLabels) != 1 || len(c.ExternalMetrics[1].DropLabels) != 1 {
+		t.Errorf("expected the keep and drop labels to be loaded, got %+v", c.ExternalMetrics)
+	}
+
+	for _, invalid := range []string{
+		"externalMetrics:\n- name: http_requests\n  keepLabels: [service]\n  dropLabels: [pod]\n",
+		"externalMetrics:\n- name: http_requests\n  dropLabels: ['']\n",
+		"externalMetrics:\n- name: http_requests\n  labelRename:\n    service_name: service\n  dropLabels: [service]\n",
+	} {
+		if _, err := FromYAML([]byte(invalid)); err == nil {
+			t.Errorf("expected label filter %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestExternalMetricPeriod(t *testing.T) {
+	c, err := FromYAML([]byte("externalMetrics:\n- name: slb_l7_qps\n  period: 300\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if c.ExternalMetrics[0].Period != 300 {
+		t.Errorf("expected the period to be loaded, got %+v", c.ExternalMetrics[0])
+	}
+
+	_, err = FromYAML([]byte("externalMetrics:\n- name: slb_l7_qps\n  period: 120\n"))
+	if err == nil || !strings.Contains(err.Error(), "period 120 of external metric slb_l7_qps is not supported by CMS") {
+		t.Errorf("expected an unsupported period to be rejected, got %v", err)
+	}
+}
+
+func TestExternalMetricStatistic(t *testing.T) {
+	c, err := FromYAML([]byte("externalMetrics:\n- name: slb_l7_qps\n  statistic: Maximum\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if c.ExternalMetrics[0].Statistic != "Maximum" {
+		t.Errorf("expected the statistic to be loaded, got %+v", c.ExternalMetrics[0])
+	}
+
+	_, err = FromYAML([]byte("externalMetrics:\n- name: slb_l7_qps\n  statistic: Sum\n"))
+	if err == nil || !strings.Contains(err.Error(), `statistic "Sum" of external metric slb_l7_qps is not supported`) {
+		t.Errorf("expected an unsupported statistic to be rejected, got %v", err)
+	}
+}
+
+func TestExternalMetricMinRefreshInterval(t *testing.T) {
+	c, err := FromYAML([]byte("externalMetrics:\n- name: slb_l7_qps\n  minRefreshInterval: 20s\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if c.ExternalMetrics[0].MinRefreshInterval != 20*time.Second {
+		t.Errorf("expected the minimum refresh interval to be loaded, got %+v", c.ExternalMetrics[0])
+	}
+
+	_, err = FromYAML([]byte("externalMetrics:\n- name: slb_l7_qps\n  minRefreshInterval: -20s\n"))
+	if err == nil || !strings.Contains(err.Error(), "minimum refresh interval of external metric slb_l7_qps must not be negative") {
+		t.Errorf("expected a negative interval to be rejected, got %v", err)
+	}
+}
+
+func TestExternalMetricRangeAggregation(t *testing.T) {
+	c, err := FromYAML([]byte("externalMetrics:\n- name: http_requests\n  rangeAggregation:\n    window: 5m\n    operator: max\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if a := c.ExternalMetrics[0].RangeAggregation; a == nil || a.Window != 5*time.Minute || a.Operator != "max" || a.Step != 0 {
+		t.Errorf("expected the range aggregation to be loaded, got %+v", a)
+	}
+
+	_, err = FromYAML([]byte("externalMetrics:\n- name: http_requests\n  rangeAggregation:\n    window: 5m\n    operator: p99\n"))
+	if err == nil || !strings.Contains(err.Error(), `range aggregation operator "p99" of external metric http_requests is not supported`) {
+		t.Errorf("expected an unsupported operator to be rejected, got %v", err)
+	}
+
+	_, err = FromYAML([]byte("externalMetrics:\n- name: http_requests\n  rangeAggregation:\n    window: 1m\n    step: 2m\n    operator: avg\n"))
+	if err == nil || !strings.Contains(err.Error(), "range aggregation of external metric http_requests must have a positive window") {
+		t.Errorf("expected a step longer than the window to be rejected, got %v", err)
+	}
+}
+
+func TestExternalMetricSampling(t *testing.T) {
+	c, err := FromYAML([]byte("externalMetrics:\n- name: http_requests\n  sampling:\n    ratio: 0.1\n    minSeries: 500\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if s := c.ExternalMetrics[0].Sampling; s == nil || s.Ratio != 0.1 || s.MinSeries != 500 {
+		t.Errorf("expected the sampling to be loaded, got %+v", s)
+	}
+
+	for _, sampling := range []string{"ratio: 0", "ratio: 1.5", "ratio: 0.5\n    minSeries: -1"} {
+		_, err = FromYAML([]byte("externalMetrics:\n- name: http_requests\n  sampling:\n    " + sampling + "\n"))
+		if err == nil || !strings.Contains(err.Error(), "sampling of external metric http_requests must have a ratio") {
+			t.Errorf("expected sampling %q to be rejected, got %v", sampling, err)
+		}
+	}
+}
+
+func TestExternalMetricNoInstancesPolicy(t *testing.T) {
+	c, err := FromYAML([]byte("externalMetrics:\n- name: slb_l7_qps\n  noInstancesPolicy: zero\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if c.ExternalMetrics[0].NoInstancesPolicy != "zero" {
+		t.Errorf("expected the policy to be loaded, got %+v", c.ExternalMetrics[0])
+	}
+
+	_, err = FromYAML([]byte("externalMetrics:\n- name: slb_l7_qps\n  noInstancesPolicy: ignore\n"))
+	if err == nil || !strings.Contains(err.Error(), `no instances policy "ignore" of external metric slb_l7_qps is not supported`) {
+		t.Errorf("expected an unsupported policy to be rejected, got %v", err)
+	}
+}
+
+func TestExternalMetricAnomalyRejection(t *testing.T) {
+	c, err := FromYAML([]byte("externalMetrics:\n- name: slb_l7_qps\n  anomalyRejection:\n    factor: 10\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if a := c.ExternalMetrics[0].AnomalyRejection; a == nil || a.Factor != 10 || a.Window != 0 {
+		t.Errorf("expected the anomaly rejection to be loaded, got %+v", a)
+	}
+
+	_, err = FromYAML([]byte("externalMetrics:\n- name: slb_l7_qps\n  anomalyRejection:\n    factor: 0.5\n"))
+	if err == nil || !strings.Contains(err.Error(), "anomaly rejection of external metric slb_l7_qps must have a factor greater than 1") {
+		t.Errorf("expected a factor below 1 to be rejected, got %v", err)
+	}
+}
+
+func TestExternalMetricScalarLabels(t *testing.T) {
+	c, err := FromYAML([]byte("externalMetrics:\n- name: http_requests\n  scalarLabels:\n    service: checkout\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if c.ExternalMetrics[0].ScalarLabels["service"] != "checkout" {
+		t.Errorf("expected the scalar labels to be loaded, got %+v", c.ExternalMetrics[0])
+	}
+
+	_, err = FromYAML([]byte("externalMetrics:\n- name: http_requests\n  scalarLabels:\n    checkout-service: \"true\"\n"))
+	if err == nil || !strings.Contains(err.Error(), `scalar label checkout-service="true" of external metric http_requests is no valid Prometheus label`) {
+		t.Errorf("expected an invalid label name to be rejected, got %v", err)
+	}
+}
+
+func TestExternalMetricFallbackRegion(t *testing.T) {
+	c, err := FromYAML([]byte("externalMetrics:\n- name: cms_custom_qps\n  fallbackRegion: cn-shanghai\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if region := c.ExternalMetrics[0].FallbackRegion; region != "cn-shanghai" {
+		t.Errorf("expected the fallback region to be loaded, got %q", region)
+	}
+
+	if _, err := FromYAML([]byte("externalMetrics:\n- name: cms_custom_qps\n  fallbackRegion: cms.cn-shanghai.aliyuncs.com\n")); err == nil {
+		t.Errorf("expected an endpoint to be rejected as fallback region")
+	}
+}
+
+func TestExternalMetricHedgeDelay(t *testing.T) {
+	c, err := FromYAML([]byte("externalMetrics:\n- name: cms_custom_qps\n  fallbackRegion: cn-shanghai\n  hedgeDelay: 300ms\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if delay := c.ExternalMetrics[0].HedgeDelay; delay != 300*time.Millisecond {
+		t.Errorf("expected the hedge delay to be loaded, got %v", delay)
+	}
+
+	if _, err := FromYAML([]byte("externalMetrics:\n- name: cms_custom_qps\n  hedgeDelay: 300ms\n")); err == nil {
+		t.Errorf("expected a hedge delay without fallback region to be rejected")
+	}
+}
+
+func TestExternalMetricExpression(t *testing.T) {
+	c, err := FromYAML([]byte("externalMetrics:\n- name: slb_l7_qps\n  expression: 'min(value / 1024, 100)'\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if c.ExternalMetrics[0].Expression != "min(value / 1024, 100)" {
+		t.Errorf("expected the expression to be loaded, got %+v", c.ExternalMetrics[0])
+	}
+
+	_, err = FromYAML([]byte("externalMetrics:\n- name: slb_l7_qps\n  expression: 'value % 2'\n"))
+	if err == nil || !strings.Contains(err.Error(), "external metric slb_l7_qps: invalid expression") {
+		t.Errorf("expected an invalid expression to be rejected, got %v", err)
+	}
+	for _, literal := range []string{"0x10", "1_000"} {
+		_, err = FromYAML([]byte("externalMetrics:\n- name: slb_l7_qps\n  expression: 'value * " + literal + "'\n"))
+		if err == nil || !strings.Contains(err.Error(), "unsupported number "+literal) {
+			t.Errorf("expected the number %s to be rejected, got %v", literal, err)
+		}
+	}
+}
+
+func TestCMSDimensionLabels(t *testing.T) {
+	c, err := FromYAML([]byte("cmsDimensionLabels:\n- label: instance\n  values:\n    checkout: i-2ze1\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if len(c.CMSDimensionLabels) != 1 || c.CMSDimensionLabels[0].Values["checkout"] != "i-2ze1" {
+		t.Errorf("expected the dimension label to be loaded, got %+v", c.CMSDimensionLabels)
+	}
+
+	for _, invalid := range []string{
+		"cmsDimensionLabels:\n- values:\n    checkout: i-2ze1\n",
+		"cmsDimensionLabels:\n- label: cms.custom.group.id\n  values:\n    checkout: i-2ze1\n",
+		"cmsDimensionLabels:\n- label: instance\n",
+		"cmsDimensionLabels:\n- label: instance\n  values:\n    a: i-1\n- label: instance\n  values:\n    b: i-2\n",
+	} {
+		if _, err := FromYAML([]byte(invalid)); err == nil {
+			t.Errorf("expected dimension labels %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestExternalMetricSources(t *testing.T) {
+	c, err := FromYAML([]byte("externalMetrics:\n- name: checkout_qps\n  sources: [cms_checkout_qps, prom_checkout_qps]\n  freshnessTolerance: 1m\n  maxParallelSources: 1\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if m := c.ExternalMetrics[0]; len(m.Sources) != 2 || m.FreshnessTolerance != time.Minute || m.MaxParallelSources != 1 {
+		t.Errorf("expected the sources to be loaded, got %+v", m)
+	}
+
+	for _, invalid := range []string{
+		"externalMetrics:\n- name: checkout_qps\n  sources: [checkout_qps, prom_checkout_qps]\n",
+		"externalMetrics:\n- name: checkout_qps\n  sources: ['', prom_checkout_qps]\n",
+		"externalMetrics:\n- name: checkout_qps\n  sources: [a, b]\n  freshnessTolerance: -1m\n",
+		"externalMetrics:\n- name: checkout_qps\n  sources: [a, b]\n  maxParallelSources: -1\n",
+		"externalMetrics:\n- name: checkout_qps\n  base: a\n  smoothing:\n    alpha: 0.5\n  sources: [a, b]\n",
+		"externalMetrics:\n- name: all_qps\n  sources: [checkout_qps, b]\n- name: checkout_qps\n  sources: [a, b]\n",
+	} {
+		if _, err := FromYAML([]byte(invalid)); err == nil {
+			t.Errorf("expected sources %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestExternalMetricRatio(t *testing.T) {
+	c, err := FromYAML([]byte("externalMetrics:\n- name: error_ratio\n  ratio:\n    numerator: http_errors\n    denominator: http_requests\n    on: [service]\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if r := c.ExternalMetrics[0].Ratio; r == nil || r.Numerator != "http_errors" || r.Denominator != "http_requests" || len(r.On) != 1 {
+		t.Errorf("expected the ratio to be loaded, got %+v", r)
+	}
+
+	for _, invalid := range []string{
+		"externalMetrics:\n- name: error_ratio\n  ratio:\n    denominator: http_requests\n",
+		"externalMetrics:\n- name: error_ratio\n  ratio:\n    numerator: error_ratio\n    denominator: http_requests\n",
+		"externalMetrics:\n- name: error_ratio\n  ratio:\n    numerator: a\n    denominator: b\n    on: ['']\n",
+		"externalMetrics:\n- name: error_ratio\n  ratio:\n    numerator: a\n    denominator: b\n  sources: [a, b]\n",
+		"externalMetrics:\n- name: error_ratio\n  ratio:\n    numerator: a\n    denominator: b\n  backend: prometheus\n",
+		"externalMetrics:\n- name: r\n  ratio:\n    numerator: error_ratio\n    denominator: b\n- name: error_ratio\n  ratio:\n    numerator: a\n    denominator: b\n",
+	} {
+		if _, err := FromYAML([]byte(invalid)); err == nil {
+			t.Errorf("expected ratio %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestExternalMetricQuantization(t *testing.T) {
+	c, err := FromYAML([]byte("externalMetrics:\n- name: slb_l7_qps\n  quantization:\n    step: 0.5\n- name: k8s_workload_cpu_util\n  quantization: {}\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if q := c.ExternalMetrics[0].Quantization; q == nil || q.Step != 0.5 {
+		t.Errorf("expected the quantization step to be loaded, got %+v", q)
+	}
+	if q := c.ExternalMetrics[1].Quantization; q == nil || q.Step != 0 {
+		t.Errorf("expected an empty quantization to be loaded, got %+v", q)
+	}
+
+	if _, err := FromYAML([]byte("externalMetrics:\n- name: slb_l7_qps\n  quantization:\n    step: -1\n")); err == nil {
+		t.Errorf("expected a negative quantization step to be rejected")
+	}
+}
+
+func TestServiceAccountLabelMatchers(t *testing.T) {
+	c, err := FromYAML([]byte(`
+serviceAccountLabelMatchers:
+- serviceAccount: team-a/reader
+  labelMatchers:
+    tenant: team-a
+`))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if m := c.ServiceAccountLabelMatchers; len(m) != 1 || m[0].ServiceAccount != "team-a/reader" || m[0].LabelMatchers["tenant"] != "team-a" {
+		t.Errorf("expected the label matchers to be loaded, got %+v", m)
+	}
+
+	for yaml, expected := range map[string]string{
+		"serviceAccountLabelMatchers:\n- serviceAccount: reader\n  labelMatchers:\n    tenant: team-a\n":                                                                     "of the form namespace/name",
+		"serviceAccountLabelMatchers:\n- serviceAccount: team-a/reader\n":                                                                                                    "service account team-a/reader must have label matchers",
+		"serviceAccountLabelMatchers:\n- serviceAccount: team-a/reader\n  labelMatchers:\n    tenant: a\n- serviceAccount: team-a/reader\n  labelMatchers:\n    tenant: b\n": "configured several times",
+	} {
+		if _, err := FromYAML([]byte(yaml)); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q to be rejected with %q, got %v", yaml, expected, err)
+		}
+	}
+}
+
+func TestRuleTimeout(t *testing.T) {
+	c, err := FromYAML([]byte(`
+rules:
+- seriesQuery: '{__name__=~"^expensive_.*"}'
+  timeout: 10s
+`))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if c.Rules[0].Timeout != 10*time.Second {
+		t.Errorf("expected a timeout of 10s, got %v", c.Rules[0].Timeout)
+	}
+
+	if _, err := FromYAML([]byte(`
+rules:
+- seriesQuery: '{__name__=~"^expensive_.*"}'
+  timeout: -1s
+`)); err == nil {
+		t.Errorf("expected a negative timeout to be rejected")
+	}
+}
+
+func TestRuleUnitConventions(t *testing.T) {
+	c, err := FromYAML([]byte(`
+rules:
+- seriesQuery: '{namespace!="",pod!=""}'
+- seriesQuery: '{__name__="http_requests_total"}'
+  unitConventions: false
+- seriesQuery: '{__name__="queue_length"}'
+  metricsQuery: 'max(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)'
+`))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	rules := WithUnitConventions(c.Rules, true, time.Minute)
+	// the first rule is expanded into a rule per convention plus one for the other series
+	if len(rules) != len(unitConventions)+3 {
+		t.Fatalf("expected only the first rule to follow the unit conventions, got %d rules", len(rules))
+	}
+	if !strings.Contains(rules[0].MetricsQuery, "[1m]") {
+		t.Errorf("expected the counters to be rates over the configured window, got %q", rules[0].MetricsQuery)
+	}
+	if len(WithUnitConventions(c.Rules, false, time.Minute)) != 3 {
+		t.Errorf("expected the unit conventions to be disabled by default")
+	}
+
+	if _, err := FromYAML([]byte(`
+rules:
+- seriesQuery: '{__name__="queue_length"}'
+  metricsQuery: 'max(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)'
+  unitConventions: true
+`)); err == nil {
+		t.Errorf("expected a rule with a metrics query to be rejected from following the unit conventions")
+	}
+}
+
+func TestReplicaDedupQuery(t *testing.T) {
+	replicaLabels := []string{"replica", "prometheus_replica"}
+	for _, tc := range []struct {
+		query    string
+		expected string
+	}{
+		{
+			query:    "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)",
+			expected: "sum(max without(replica, prometheus_replica) (<<.Series>>{<<.LabelMatchers>>})) by (<<.GroupBy>>)",
+		},
+		{
+			query:    "sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m])) by (<<.GroupBy>>)",
+			expected: "sum(max without(replica, prometheus_replica) (rate(<<.Series>>{<<.LabelMatchers>>}[2m]))) by (<<.GroupBy>>)",
+		},
+		{
+			query:    "sum(rate(<<.Series>>{<<.LabelMatchers>>,code=~\"5..\"}[2m])) / sum(<<.Series>>{<<.LabelMatchers>>})",
+			expected: "sum(max without(replica, prometheus_replica) (rate(<<.Series>>{<<.LabelMatchers>>,code=~\"5..\"}[2m]))) / sum(max without(replica, prometheus_replica) (<<.Series>>{<<.LabelMatchers>>}))",
+		},
+		{
+			query:    "sum(irate(<<.Series>>{<<.LabelMatchers>>}[1m])) / sum(<<.Series>>{<<.LabelMatchers>>})",
+			expected: "sum(max without(replica, prometheus_replica) (irate(<<.Series>>{<<.LabelMatchers>>}[1m]))) / sum(max without(replica, prometheus_replica) (<<.Series>>{<<.LabelMatchers>>}))",
+		},
+		{query: "sum(<<.Series>>{<<.LabelMatchers>>} offset 5m)"},
+		{query: "sum(<<.Series>>) by (<<.GroupBy>>)"},
+	} {
+		query, err := dedupReplicasQuery(tc.query, replicaLabels)
+		if tc.expected == "" {
+			if err == nil {
+				t.Errorf("expected the query %s not to be rewritten, got %s", tc.query, query)
+			}
+			continue
+		}
+		if err != nil || query != tc.expected {
+			t.Errorf("expected the query %s to be rewritten to %s, got %s (%v)", tc.query, tc.expected, query, err)
+		}
+	}
+}
+
+func TestWithReplicaDedup(t *testing.T) {
+	c, err := FromYAML([]byte(`
+rules:
+- seriesQuery: '{__name__=~"^.*:rate5m$"}'
+  type: recording
+- seriesQuery: '{__name__="queue_length"}'
+  metricsQuery: 'max(queue_length{<<.LabelMatchers>>}) by (<<.GroupBy>>)'
+`))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	rules, warnings := WithReplicaDedup(c.Rules, []string{"replica"})
+	if expected := "sum(max without(replica) (<<.Series>>{<<.LabelMatchers>>})) by (<<.GroupBy>>)"; rules[0].MetricsQuery != expected {
+		t.Errorf("expected the query of the recording rule to be rewritten to %s, got %s", expected, rules[0].MetricsQuery)
+	}
+	if rules[1].MetricsQuery != c.Rules[1].MetricsQuery || len(warnings) != 1 {
+		t.Errorf("expected a query without the series selector to be kept with a warning, got %s (%v)", rules[1].MetricsQuery, warnings)
+	}
+}
+
+func TestExternalMetricCustomMetric(t *testing.T) {
+	c, err := FromYAML([]byte("externalMetrics:\n- name: checkout_qps\n  customMetric: http_requests_per_second\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if c.ExternalMetrics[0].CustomMetric != "http_requests_per_second" {
+		t.Errorf("expected the custom metric to be loaded, got %+v", c.ExternalMetrics[0])
+	}
+
+	if _, err := FromYAML([]byte("externalMetrics:\n- name: checkout_qps\n  customMetric: orders_qps\n- name: orders_qps\n  customMetric: http_requests_per_second\n")); err == nil {
+		t.Errorf("expected a custom metric served from a custom metric itself to be rejected")
+	}
+}
+
+func TestHistogramRule(t *testing.T) {
+	c, err := FromYAML([]byte(`
+rules:
+- seriesQuery: '{__name__="http_request_duration_seconds_bucket",namespace!="",pod!=""}'
+  type: histogram
+  quantile: 0.95
+- seriesQuery: '{__name__="rpc_duration_seconds_bucket"}'
+  type: histogram
+  quantile: 0.999
+  window: 5m
+`))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	rule := c.Rules[0].PrometheusRule()
+	if rule.Name.Matches != `^(.*)_bucket$` || rule.Name.As != "${1}_p95" {
+		t.Errorf("expected the histogram to be named after its quantile, got %+v", rule.Name)
+	}
+	expected := "histogram_quantile(0.95, sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m])) by (<<if .GroupBy>><<.GroupBy>>, <<end>>le))"
+	if rule.MetricsQuery != expected {
+		t.Errorf("expected metrics query %q, got %q", expected, rule.MetricsQuery)
+	}
+	rule = c.Rules[1].PrometheusRule()
+	if rule.Name.As != "${1}_p99_9" || !strings.Contains(rule.MetricsQuery, "histogram_quantile(0.999, ") || !strings.Contains(rule.MetricsQuery, "[5m]") {
+		t.Errorf("expected the quantile and the window of the rule, got %+v", rule)
+	}
+
+	for _, invalid := range []string{
+		"rules:\n- seriesQuery: '{__name__=~\".*_bucket\"}'\n  type: histogram\n",
+		"rules:\n- seriesQuery: '{__name__=~\".*_bucket\"}'\n  type: histogram\n  quantile: 1.5\n",
+		"rules:\n- seriesQuery: '{__name__=~\".*_bucket\"}'\n  type: histogram\n  quantile: 0.9\n  window: -1m\n",
+		"rules:\n- seriesQuery: '{__name__=~\".*_bucket\"}'\n  quantile: 0.9\n",
+	} {
+		if _, err := FromYAML([]byte(invalid)); err == nil {
+			t.Errorf("expected histogram rule %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestExternalMetricBackend(t *testing.T) {
+	c, err := FromYAML([]byte("externalMetrics:\n- name: http_requests\n  backend: prometheus\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if c.ExternalMetrics[0].Backend != "prometheus" {
+		t.Errorf("expected the backend to be loaded, got %+v", c.ExternalMetrics[0])
+	}
+
+	_, err = FromYAML([]byte("externalMetrics:\n- name: http_requests\n  backend: promethues\n"))
+	expected := `backend "promethues" of external metric http_requests is not supported, it must be one of [prometheus cms slb sls ahas kube ess]`
+	if err == nil || !strings.HasSuffix(err.Error(), expected) {
+		t.Errorf("expected an unknown backend to be rejected with the supported ones, got %v", err)
+	}
+
+	if _, err := FromYAML([]byte("externalMetrics:\n- name: checkout_qps\n  backend: cms\n  sources: [cms_checkout_qps]\n")); err == nil {
+		t.Errorf("expected a metric served from its sources to be rejected with a backend")
+	}
+}
+
+func TestExternalMetricCMSAPI(t *testing.T) {
+	c, err := FromYAML([]byte("externalMetrics:\n- name: cms_custom_node_load\n  cmsAPI: hybrid\n  hybridNamespace: k8s-nodes\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if m := c.ExternalMetrics[0]; m.CMSAPI != "hybrid" || m.HybridNamespace != "k8s-nodes" {
+		t.Errorf("expected the cms api to be loaded, got %+v", m)
+	}
+
+	for _, invalid := range []string{
+		"externalMetrics:\n- name: cms_custom_node_load\n  cmsAPI: one\n",
+		"externalMetrics:\n- name: cms_custom_node_load\n  cmsAPI: hybrid\n",
+		"externalMetrics:\n- name: cms_custom_node_load\n  hybridNamespace: k8s-nodes\n",
+		"externalMetrics:\n- name: cms_custom_node_load\n  cmsAPI: metricList\n  hybridNamespace: k8s-nodes\n",
+		"externalMetrics:\n- name: node_load\n  cmsAPI: hybrid\n  hybridNamespace: k8s-nodes\n",
+		"externalMetrics:\n- name: cms_custom_\n  cmsAPI: hybrid\n  hybridNamespace: k8s-nodes\n",
+	} {
+		if _, err := FromYAML([]byte(invalid)); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestAnnotationMetrics(t *testing.T) {
+	c, err := FromYAML([]byte("annotationMetrics:\n- name: scale_override\n  annotation: metrics.example.com/scale-override\n  resources: [deployments.apps]\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if m := c.AnnotationMetrics[0]; m.Annotation != "metrics.example.com/scale-override" || len(m.Resources) != 1 || m.Resources[0] != "deployments.apps" {
+		t.Errorf("expected the annotation metric to be loaded, got %+v", m)
+	}
+
+	for _, invalid := range []string{
+		"annotationMetrics:\n- annotation: scale-override\n  resources: [deployments.apps]\n",
+		"annotationMetrics:\n- name: scale_override\n  annotation: scale override\n  resources: [deployments.apps]\n",
+		"annotationMetrics:\n- name: scale_override\n  annotation: scale-override\n",
+		"annotationMetrics:\n- name: scale_override\n  annotation: scale-override\n  resources: [deployments.apps]\n" +
+			"- name: scale_override\n  annotation: other-override\n  resources: [deployments.apps]\n",
+	} {
+		if _, err := FromYAML([]byte(invalid)); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
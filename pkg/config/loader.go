@@ -0,0 +1,183 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// loaderRetryInterval is the first wait before the file is read again, it doubles up to loaderMaxRetryInterval.
+	loaderRetryInterval    = 500 * time.Millisecond
+	loaderMaxRetryInterval = 5 * time.Second
+	// loaderMaxLogInterval bounds the time between the warnings about failed reloads.
+	loaderMaxLogInterval = 5 * time.Minute
+)
+
+// Loader loads the configuration files, and keeps the last configuration it loaded. A ConfigMap mount
+// may briefly be unreadable while it's updated, which must not replace a working configuration.
+type Loader struct {
+	// paths are the configuration files, or directories of them, which are merged in order
+	paths      []string
+	strict     bool
+	duplicates DuplicatePolicy
+	clock      clock.Clock
+	listFiles  func(path string) ([]string, error)
+	readFile   func(filename string) ([]byte, error)
+
+	lock        sync.Mutex
+	config      *MetricsDiscoveryConfig
+	failures    int
+	logInterval time.Duration
+	nextLog     time.Time
+}
+
+// NewLoader creates a loader of the configuration files, see Load about strict and Merge about duplicates.
+// A path may be a directory, whose YAML and JSON files are loaded in lexical order.
+func NewLoader(paths []string, strict bool, duplicates DuplicatePolicy) *Loader {
+	return newLoader(paths, strict, duplicates, clock.RealClock{}, configFiles, ioutil.ReadFile)
+}
+
+func newLoader(paths []string, strict bool, duplicates DuplicatePolicy, clock clock.Clock, listFiles func(string) ([]string, error), readFile func(string) ([]byte, error)) *Loader {
+	return &Loader{
+		paths:      paths,
+		strict:     strict,
+		duplicates: duplicates,
+		clock:      clock,
+		listFiles:  listFiles,
+		readFile:   readFile,
+	}
+}
+
+// LoadOnStartup loads the configuration, retrying for up to timeout while the file can't be read.
+// An invalid configuration isn't retried.
+func (l *Loader) LoadOnStartup(timeout time.Duration) (*MetricsDiscoveryConfig, error) {
+	deadline := l.clock.Now().Add(timeout)
+	retryInterval := loaderRetryInterval
+	for {
+		files, err := l.readFiles()
+		if err == nil {
+			c, err := l.load(files)
+			if err != nil {
+				return nil, err
+			}
+			l.lock.Lock()
+			defer l.lock.Unlock()
+			l.config = c
+			return c, nil
+		}
+		if l.clock.Now().Add(retryInterval).After(deadline) {
+			return nil, err
+		}
+		klog.Warningf("Unable to read metrics discovery config, retrying in %v: %v", retryInterval, err)
+		l.clock.Sleep(retryInterval)
+		if retryInterval *= 2; retryInterval > loaderMaxRetryInterval {
+			retryInterval = loaderMaxRetryInterval
+		}
+	}
+}
+
+// Reload loads the configuration again. When it fails the last loaded configuration is
+// returned along with the error, and the failure is logged with backoff.
+func (l *Loader) Reload() (*MetricsDiscoveryConfig, error) {
+	c, err := l.loadFile()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err != nil {
+		l.failures++
+		if l.logFailure() {
+			klog.Warningf("Keeping the running metrics discovery config, %d reloads failed: %v", l.failures, err)
+		}
+		return l.config, err
+	}
+	l.config = c
+	l.failures = 0
+	l.logInterval = 0
+	l.nextLog = time.Time{}
+	return c, nil
+}
+
+// logFailure tells whether a failed reload is logged, the interval between the logs doubles
+// while the reloads keep failing.
+func (l *Loader) logFailure() bool {
+	now := l.clock.Now()
+	if now.Before(l.nextLog) {
+		return false
+	}
+	if l.logInterval *= 2; l.logInterval == 0 {
+		l.logInterval = loaderRetryInterval
+	} else if l.logInterval > loaderMaxLogInterval {
+		l.logInterval = loaderMaxLogInterval
+	}
+	l.nextLog = now.Add(l.logInterval)
+	return true
+}
+
+func (l *Loader) loadFile() (*MetricsDiscoveryConfig, error) {
+	files, err := l.readFiles()
+	if err != nil {
+		return nil, err
+	}
+	return l.load(files)
+}
+
+// configFile is the contents of a configuration file.
+type configFile struct {
+	name     string
+	contents []byte
+}
+
+// readFiles reads the configuration files of all the paths.
+func (l *Loader) readFiles() ([]configFile, error) {
+	var files []configFile
+	for _, path := range l.paths {
+		names, err := l.listFiles(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("unable to load metrics discovery config: no config file in %s", path)
+		}
+		for _, name := range names {
+			contents, err := l.readFile(name)
+			if err != nil {
+				return nil, fmt.Errorf("unable to load metrics discovery config file: %v", err)
+			}
+			files = append(files, configFile{name: name, contents: contents})
+		}
+	}
+	return files, nil
+}
+
+// load parses the files, merges them and validates the merged configuration.
+func (l *Loader) load(files []configFile) (*MetricsDiscoveryConfig, error) {
+	configs := make([]*MetricsDiscoveryConfig, 0, len(files))
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		c, warnings, err := parse(f.contents, l.strict)
+		for _, warning := range warnings {
+			klog.Warningf("metrics discovery config %s: %s", f.name, warning)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.name, err)
+		}
+		configs = append(configs, c)
+		names = append(names, f.name)
+	}
+	c, warnings, err := Merge(configs, names, l.duplicates)
+	for _, warning := range warnings {
+		klog.Warningf("metrics discovery config: %s", warning)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to merge metrics discovery config files: %v", err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("invalid metrics discovery config: %v", err)
+	}
+	return c, nil
+}
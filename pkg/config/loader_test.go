@@ -0,0 +1,205 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+const loaderTestConfig = `
+apiVersion: v2
+externalMetrics:
+- name: slb_l7_qps
+  period: 300
+`
+
+// flakyFile is a configuration file which can't be read for a number of reads.
+type flakyFile struct {
+	contents string
+	failures int
+	reads    int
+}
+
+func (f *flakyFile) read(string) ([]byte, error) {
+	f.reads++
+	if f.reads <= f.failures {
+		return nil, os.ErrNotExist
+	}
+	return []byte(f.contents), nil
+}
+
+func TestLoadOnStartupRetries(t *testing.T) {
+	file := &flakyFile{contents: loaderTestConfig, failures: 3}
+	l := newLoader([]string{"config.yaml"}, false, DuplicatesError, clock.NewFakeClock(time.Now()), configFiles, file.read)
+
+	c, err := l.LoadOnStartup(30 * time.Second)
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if len(c.ExternalMetrics) != 1 || file.reads != 4 {
+		t.Errorf("expected the config to be loaded by the 4th read, got %v after %d reads", c.ExternalMetrics, file.reads)
+	}
+}
+
+func TestLoadOnStartupTimeout(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	file := &flakyFile{contents: loaderTestConfig, failures: 1000}
+	l := newLoader([]string{"config.yaml"}, false, DuplicatesError, fakeClock, configFiles, file.read)
+	start := fakeClock.Now()
+
+	if _, err := l.LoadOnStartup(10 * time.Second); err == nil {
+		t.Fatalf("expected a missing file to fail the startup")
+	}
+	if waited := fakeClock.Since(start); waited > 10*time.Second {
+		t.Errorf("expected the retries to stop within the timeout, waited %v", waited)
+	}
+	if file.reads < 3 {
+		t.Errorf("expected the file to be read several times, got %d reads", file.reads)
+	}
+}
+
+func TestLoadOnStartupInvalidConfig(t *testing.T) {
+	file := &flakyFile{contents: "externalMetrics: {"}
+	l := newLoader([]string{"config.yaml"}, false, DuplicatesError, clock.NewFakeClock(time.Now()), configFiles, file.read)
+
+	if _, err := l.LoadOnStartup(30 * time.Second); err == nil || file.reads != 1 {
+		t.Errorf("expected an invalid config to fail without retries, got %v after %d reads", err, file.reads)
+	}
+}
+
+func TestReloadKeepsLastConfig(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	file := &flakyFile{contents: loaderTestConfig}
+	l := newLoader([]string{"config.yaml"}, false, DuplicatesError, fakeClock, configFiles, file.read)
+	running, err := l.LoadOnStartup(30 * time.Second)
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+
+	// the mount is briefly unreadable
+	file.failures = file.reads + 2
+	for i := 0; i < 2; i++ {
+		c, err := l.Reload()
+		if err == nil || c != running {
+			t.Errorf("expected a failed reload to keep the running config, got %v (%v)", c, err)
+		}
+	}
+	// and then holds an invalid config
+	file.contents = "externalMetrics: {"
+	if c, err := l.Reload(); err == nil || c != running {
+		t.Errorf("expected an invalid config to keep the running config, got %v (%v)", c, err)
+	}
+
+	file.contents = loaderTestConfig + "- name: slb_l7_rt\n"
+	c, err := l.Reload()
+	if err != nil || len(c.ExternalMetrics) != 2 {
+		t.Errorf("expected the new config to be loaded, got %v (%v)", c, err)
+	}
+}
+
+func TestReloadFailuresLoggedWithBackoff(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	l := newLoader([]string{"config.yaml"}, false, DuplicatesError, fakeClock, configFiles, (&flakyFile{failures: 1000}).read)
+
+	logged := 0
+	for i := 0; i < 100; i++ {
+		if l.logFailure() {
+			logged++
+		}
+		fakeClock.Step(100 * time.Millisecond)
+	}
+	// 10 seconds of failures are logged after 0, 0.5, 1.5, 3.5 and 7.5 seconds
+	if logged != 5 {
+		t.Errorf("expected the failures to be logged with backoff, got %d logs", logged)
+	}
+}
+
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("Failed to create config directory, because of %v", err)
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatalf("Failed to write config file, because of %v", err)
+		}
+	}
+	return dir
+}
+
+func TestLoadMergesFiles(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"cms.yaml":        "apiVersion: v2\nexternalMetrics:\n- name: slb_l7_qps\n  period: 300\n",
+		"prometheus.yaml": "rules:\n- seriesQuery: http_requests_total\nexternalMetrics:\n- name: checkout_qps\n  sources: [slb_l7_qps, prom_checkout_qps]\n",
+		"README.md":       "not a config",
+	})
+	defer os.RemoveAll(dir)
+
+	for _, paths := range [][]string{
+		{dir},
+		{filepath.Join(dir, "cms.yaml"), filepath.Join(dir, "prometheus.yaml")},
+	} {
+		c, err := NewLoader(paths, false, DuplicatesError).LoadOnStartup(time.Second)
+		if err != nil {
+			t.Fatalf("Failed to load config %v, because of %v", paths, err)
+		}
+		if len(c.Rules) != 1 || len(c.ExternalMetrics) != 2 || c.ExternalMetrics[0].Name != "slb_l7_qps" || c.ExternalMetrics[1].Name != "checkout_qps" {
+			t.Errorf("expected the files of %v to be merged in order, got %+v", paths, c)
+		}
+	}
+}
+
+func TestLoadDuplicateMetrics(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"a.yaml": "apiVersion: v2\nexternalMetrics:\n- name: slb_l7_qps\n  period: 300\n",
+		"b.yaml": "apiVersion: v2\nexternalMetrics:\n- name: slb_l7_qps\n  period: 60\n- name: slb_l7_rt\n",
+	})
+	defer os.RemoveAll(dir)
+
+	if _, err := NewLoader([]string{dir}, false, DuplicatesError).LoadOnStartup(time.Second); err == nil || !strings.Contains(err.Error(), "external metric slb_l7_qps") {
+		t.Errorf("expected the duplicate metric to be rejected, got %v", err)
+	}
+
+	c, err := NewLoader([]string{dir}, false, DuplicatesWarn).LoadOnStartup(time.Second)
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if len(c.ExternalMetrics) != 2 || c.ExternalMetrics[0].Period != 300 || c.ExternalMetrics[1].Name != "slb_l7_rt" {
+		t.Errorf("expected the first definition of the duplicate metric to be kept, got %+v", c.ExternalMetrics)
+	}
+}
+
+func TestLoadDuplicateRuleMetrics(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"a.yaml": "rules:\n- seriesQuery: http_requests_total\n  name:\n    as: http_requests_per_second\n- seriesQuery: '{__name__=~\"^jvm_.*\"}'\n",
+		"b.yaml": "rules:\n- seriesQuery: nginx_requests_total\n  name:\n    as: http_requests_per_second\n- seriesQuery: '{__name__=~\"^go_.*\"}'\n",
+	})
+	defer os.RemoveAll(dir)
+
+	_, err := NewLoader([]string{dir}, false, DuplicatesError).LoadOnStartup(time.Second)
+	if err == nil || !strings.Contains(err.Error(), "metric of the rules http_requests_per_second of "+filepath.Join(dir, "b.yaml")+" is already defined by "+filepath.Join(dir, "a.yaml")) {
+		t.Errorf("expected the metric named by rules of both files to be rejected, naming both files, got %v", err)
+	}
+
+	c, err := NewLoader([]string{dir}, false, DuplicatesWarn).LoadOnStartup(time.Second)
+	if err != nil {
+		t.Fatalf("Failed to load config, because of %v", err)
+	}
+	if len(c.Rules) != 3 || c.Rules[0].SeriesQuery != "http_requests_total" || c.Rules[2].SeriesQuery != `{__name__=~"^go_.*"}` {
+		t.Errorf("expected the rule of the first file to be kept, and the rules of other series to be merged, got %+v", c.Rules)
+	}
+}
+
+func TestLoadEmptyConfigDirectory(t *testing.T) {
+	dir := writeConfigFiles(t, nil)
+	defer os.RemoveAll(dir)
+
+	if _, err := newLoader([]string{dir}, false, DuplicatesError, clock.NewFakeClock(time.Now()), configFiles, ioutil.ReadFile).LoadOnStartup(time.Second); err == nil {
+		t.Errorf("expected a directory without config files to fail the loading")
+	}
+}
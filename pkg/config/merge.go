@@ -0,0 +1,158 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DuplicatePolicy tells what merging the configuration files does with a metric defined by several of them.
+type DuplicatePolicy string
+
+const (
+	// DuplicatesError fails the loading of the configuration.
+	DuplicatesError DuplicatePolicy = "error"
+	// DuplicatesWarn keeps the definition of the first file and warns about the other ones.
+	DuplicatesWarn DuplicatePolicy = "warn"
+)
+
+// DuplicatePolicies are the supported policies, the first one is the default.
+var DuplicatePolicies = []DuplicatePolicy{DuplicatesError, DuplicatesWarn}
+
+// IsDuplicatePolicy tells whether the policy is one of DuplicatePolicies.
+func IsDuplicatePolicy(policy DuplicatePolicy) bool {
+	for _, p := range DuplicatePolicies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// configFileExtensions are the extensions of the files read from a configuration directory.
+var configFileExtensions = map[string]bool{".yaml": true, ".yml": true, ".json": true}
+
+// configFiles returns the configuration files of a path: the path itself unless it's a directory, in which
+// case its YAML and JSON files, in lexical order. The hidden files are skipped, e.g. the ..data link of a
+// ConfigMap mount. A path which can't be read is returned as is, for its reading to tell the error.
+func configFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return []string{path}, nil
+	}
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list metrics discovery config directory: %v", err)
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || !configFileExtensions[filepath.Ext(name)] {
+			continue
+		}
+		// the files of a ConfigMap mount are links, which Stat follows
+		if info, err := os.Stat(filepath.Join(path, name)); err != nil || info.IsDir() {
+			continue
+		}
+		files = append(files, filepath.Join(path, name))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// ruleMetrics names the metrics a rule defines, for the duplicates across files: the metric it names as, or
+// the metrics named from the series of its series query, which another rule only names the same way.
+func ruleMetrics(r DiscoveryRule) string {
+	if r.Name.As != "" && !strings.Contains(r.Name.As, "$") {
+		return r.Name.As
+	}
+	return fmt.Sprintf("named %q as %q from the series of %s", r.Name.Matches, r.Name.As, r.SeriesQuery)
+}
+
+// Merge merges the configurations loaded from several files, which are named for the errors and warnings.
+// The rules are appended in the order of the files. The metrics of the rules, external metrics, custom resources,
+// CMS dimension labels, service account label matchers and annotation metrics are each defined by a single file, a
+// definition found in several files is handled according to the duplicate policy. The merged configuration isn't validated.
+func Merge(configs []*MetricsDiscoveryConfig, filenames []string, duplicates DuplicatePolicy) (*MetricsDiscoveryConfig, []string, error) {
+	merged := &MetricsDiscoveryConfig{APIVersion: CurrentAPIVersion}
+	if len(configs) == 1 {
+		*merged = *configs[0]
+		return merged, nil, nil
+	}
+
+	var warnings []string
+	definedBy := make(map[string]string)
+	// define tells whether the definition is kept, it's a duplicate if another file defined it already
+	define := func(kind, name, filename string) (bool, error) {
+		key := kind + "/" + name
+		first, found := definedBy[key]
+		if !found || first == filename {
+			// the duplicates within a file are left to the validation
+			definedBy[key] = filename
+			return true, nil
+		}
+		message := fmt.Sprintf("%s %s of %s is already defined by %s", kind, name, filename, first)
+		if duplicates != DuplicatesWarn {
+			return false, fmt.Errorf("%s", message)
+		}
+		warnings = append(warnings, message+", ignoring it")
+		return false, nil
+	}
+
+	for i, c := range configs {
+		filename := filenames[i]
+		for _, r := range c.Rules {
+			if keep, err := define("metric of the rules", ruleMetrics(r), filename); err != nil {
+				return nil, warnings, err
+			} else if keep {
+				merged.Rules = append(merged.Rules, r)
+			}
+		}
+		for _, r := range c.ExternalRules {
+			if keep, err := define("metric of the externalRules", ruleMetrics(r), filename); err != nil {
+				return nil, warnings, err
+			} else if keep {
+				merged.ExternalRules = append(merged.ExternalRules, r)
+			}
+		}
+		for _, r := range c.CustomResources {
+			if keep, err := define("custom resource", r.GroupVersionKind().String(), filename); err != nil {
+				return nil, warnings, err
+			} else if keep {
+				merged.CustomResources = append(merged.CustomResources, r)
+			}
+		}
+		for _, m := range c.ExternalMetrics {
+			if keep, err := define("external metric", m.Name, filename); err != nil {
+				return nil, warnings, err
+			} else if keep {
+				merged.ExternalMetrics = append(merged.ExternalMetrics, m)
+			}
+		}
+		for _, l := range c.CMSDimensionLabels {
+			if keep, err := define("cms dimension label", l.Label, filename); err != nil {
+				return nil, warnings, err
+			} else if keep {
+				merged.CMSDimensionLabels = append(merged.CMSDimensionLabels, l)
+			}
+		}
+		for _, m := range c.ServiceAccountLabelMatchers {
+			if keep, err := define("label matchers of service account", m.ServiceAccount, filename); err != nil {
+				return nil, warnings, err
+			} else if keep {
+				merged.ServiceAccountLabelMatchers = append(merged.ServiceAccountLabelMatchers, m)
+			}
+		}
+		for _, m := range c.AnnotationMetrics {
+			if keep, err := define("annotation metric", m.Name, filename); err != nil {
+				return nil, warnings, err
+			} else if keep {
+				merged.AnnotationMetrics = append(merged.AnnotationMetrics, m)
+			}
+		}
+	}
+	return merged, warnings, nil
+}
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// replicaDedupSelector starts the selectors of the series of a rule in its metrics query,
+// e.g. <<.Series>>{<<.LabelMatchers>>} or <<.Series>>{<<.LabelMatchers>>,code="500"}.
+const replicaDedupSelector = "<<.Series>>{"
+
+// WithReplicaDedup makes the metrics queries of the rules collapse the series of an HA Prometheus pair
+// before they are aggregated, so that both replicas are not counted twice: each selector of the series,
+// or the function of its range, e.g. rate(<<.Series>>{<<.LabelMatchers>>}[2m]), is wrapped in
+// max without(<replica labels>). The queries of the recording and histogram rules are rewritten too.
+// The rules whose query can't be rewritten are returned as is, with a warning each.
+func WithReplicaDedup(rules []DiscoveryRule, replicaLabels []string) ([]DiscoveryRule, []string) {
+	if len(replicaLabels) == 0 {
+		return rules, nil
+	}
+	var warnings []string
+	res := make([]DiscoveryRule, 0, len(rules))
+	for _, rule := range rules {
+		query, err := dedupReplicasQuery(rule.PrometheusRule().MetricsQuery, replicaLabels)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("the replicas of the rule with series query %q are not deduplicated: %v", rule.SeriesQuery, err))
+			res = append(res, rule)
+			continue
+		}
+		rule.MetricsQuery = query
+		res = append(res, rule)
+	}
+	return res, warnings
+}
+
+// dedupReplicasQuery wraps the series of the metrics query in max without(<replica labels>).
+func dedupReplicasQuery(query string, replicaLabels []string) (string, error) {
+	if !strings.Contains(query, replicaDedupSelector) {
+		return "", fmt.Errorf("its metrics query %q doesn't select the series with %s<<.LabelMatchers>>}", query, replicaDedupSelector)
+	}
+	dedup := "max without(" + strings.Join(replicaLabels, ", ") + ") ("
+
+	// the selectors are wrapped from the last one, which keeps the positions of the previous ones
+	end := len(query)
+	for {
+		start := strings.LastIndex(query[:end], replicaDedupSelector)
+		if start < 0 {
+			return query, nil
+		}
+		closing := strings.Index(query[start:], "}")
+		if closing < 0 {
+			return "", fmt.Errorf("the selector at %d isn't closed", start)
+		}
+		exprStart, exprEnd := start, start+closing+1
+		rest := strings.TrimLeft(query[exprEnd:], " ")
+		switch {
+		case strings.HasPrefix(rest, "offset") || strings.HasPrefix(rest, "@"):
+			return "", fmt.Errorf("the modifier of the selector at %d isn't supported", start)
+		case strings.HasPrefix(rest, "["):
+			// a range vector is an argument of a function, e.g. rate, whose instant vector is wrapped
+			open := enclosingParen(query, start)
+			close := matchingParen(query, open)
+			if open < 0 || close < 0 {
+				return "", fmt.Errorf("the range selector at %d isn't the argument of a function", start)
+			}
+			exprStart, exprEnd = open, close+1
+			for exprStart > 0 && isIdentifierByte(query[exprStart-1]) {
+				exprStart--
+			}
+			if exprStart == open {
+				return "", fmt.Errorf("the range selector at %d isn't the argument of a function", start)
+			}
+		}
+		query = query[:exprStart] + dedup + query[exprStart:exprEnd] + ")" + query[exprEnd:]
+		end = exprStart
+	}
+}
+
+// enclosingParen returns the position of the unmatched parenthesis before pos, -1 if there is none.
+func enclosingParen(query string, pos int) int {
+	depth := 0
+	for i := pos - 1; i >= 0; i-- {
+		switch query[i] {
+		case ')':
+			depth++
+		case '(':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		}
+	}
+	return -1
+}
+
+// matchingParen returns the position of the parenthesis closing the one at open, -1 if there is none.
+func matchingParen(query string, open int) int {
+	if open < 0 {
+		return -1
+	}
+	depth := 0
+	for i := open; i < len(query); i++ {
+		switch query[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func isIdentifierByte(b byte) bool {
+	return b == '_' || b == ':' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9'
+}
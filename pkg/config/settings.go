@@ -0,0 +1,46 @@
+package config
+
+import "github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+
+// MetricSettings resolves the settings of the external metrics the sources apply to their queries.
+func (c *MetricsDiscoveryConfig) MetricSettings() *utils.ExternalMetricSettings {
+	settings := &utils.ExternalMetricSettings{
+		Metrics:            make(map[string]utils.MetricSettings, len(c.ExternalMetrics)),
+		CMSDimensionLabels: make(map[string]utils.CMSDimensionLabel, len(c.CMSDimensionLabels)),
+	}
+	for _, m := range c.ExternalMetrics {
+		settings.Metrics[m.Name] = m.settings()
+	}
+	for _, l := range c.CMSDimensionLabels {
+		dimension := l.Dimension
+		if dimension == "" {
+			dimension = utils.DefaultCMSDimension
+		}
+		settings.CMSDimensionLabels[l.Label] = utils.CMSDimensionLabel{Dimension: dimension, Values: l.Values}
+	}
+	return settings
+}
+
+func (m ExternalMetric) settings() utils.MetricSettings {
+	s := utils.MetricSettings{
+		Period:         m.Period,
+		Statistic:      m.Statistic,
+		NoInstances:    m.NoInstancesPolicy,
+		FallbackRegion: m.FallbackRegion,
+		HedgeDelay:     m.HedgeDelay,
+		ScaleToZero:    m.ScaleToZero,
+	}
+	if m.CMSAPI == utils.CMSHybridAPI {
+		s.HybridNamespace = m.HybridNamespace
+	}
+	if a := m.RangeAggregation; a != nil {
+		s.RangeAggregation = &utils.RangeAggregation{Window: a.Window, Operator: a.Operator, Step: a.Step}
+	}
+	if sampling := m.Sampling; sampling != nil {
+		s.Sampling = &utils.Sampling{Ratio: sampling.Ratio, MinSeries: sampling.MinSeries}
+	}
+	if len(m.ScalarLabels) > 0 {
+		s.ScalarLabels = m.ScalarLabels
+	}
+	return s
+}
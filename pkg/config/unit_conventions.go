@@ -0,0 +1,94 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+	cfg "sigs.k8s.io/prometheus-adapter/pkg/config"
+)
+
+// DefaultUnitConventionsRateWindow is the window the counters are turned into rates over by the unit conventions.
+const DefaultUnitConventionsRateWindow = 2 * time.Minute
+
+// unitConvention tells how the series whose name ends with a suffix are exposed by the rules which follow
+// the unit conventions.
+type unitConvention struct {
+	suffix string
+	// as is the name of the exposed metric, ${1} being the name of the series without the suffix
+	as string
+	// metricsQuery is the query of the metric, %s being the rate window
+	metricsQuery string
+}
+
+// unitConventions are matched in order, the first suffix a series name ends with wins.
+var unitConventions = []unitConvention{
+	// a CPU time counter is a number of cores, e.g. container_cpu_usage_seconds_total becomes container_cpu_usage
+	{suffix: "_seconds_total", as: "${1}", metricsQuery: "sum(rate(<<.Series>>{<<.LabelMatchers>>}[%s])) by (<<.GroupBy>>)"},
+	{suffix: "_total", as: "${1}_per_second", metricsQuery: "sum(rate(<<.Series>>{<<.LabelMatchers>>}[%s])) by (<<.GroupBy>>)"},
+	// sizes add up, e.g. the memory of the containers of a pod
+	{suffix: "_bytes", as: "${1}_bytes", metricsQuery: "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)"},
+	// durations don't, e.g. the latency of a pod is the average of its series
+	{suffix: "_seconds", as: "${1}_seconds", metricsQuery: "avg(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)"},
+}
+
+// unitConventionsDefaultMetricsQuery is the query of the series which don't end with a suffix of the conventions.
+const unitConventionsDefaultMetricsQuery = "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)"
+
+// followsUnitConventions tells whether the rule is expanded by WithUnitConventions, enabled telling
+// whether the conventions are enabled by default. The rules which name or query their metrics
+// themselves, or which are recording rules, are taken as is.
+func (r DiscoveryRule) followsUnitConventions(enabled bool) bool {
+	if r.UnitConventions != nil {
+		enabled = *r.UnitConventions
+	}
+	return enabled && r.Type == "" && r.MetricsQuery == "" && r.Name.Matches == "" && r.Name.As == ""
+}
+
+// WithUnitConventions expands the rules which follow the unit conventions into a rule per convention,
+// which names and queries the series of the rule whose name ends with its suffix, plus a rule for the
+// other series, which are summed as is. The counters are turned into rates over rateWindow.
+// The other rules are returned as is.
+func WithUnitConventions(rules []DiscoveryRule, enabled bool, rateWindow time.Duration) []DiscoveryRule {
+	if rateWindow <= 0 {
+		rateWindow = DefaultUnitConventionsRateWindow
+	}
+	res := make([]DiscoveryRule, 0, len(rules))
+	for _, rule := range rules {
+		if !rule.followsUnitConventions(enabled) {
+			res = append(res, rule)
+			continue
+		}
+		for i, convention := range unitConventions {
+			expanded := rule
+			expanded.UnitConventions = nil
+			expanded.SeriesFilters = append([]cfg.RegexFilter(nil), rule.SeriesFilters...)
+			// the series of the more specific suffixes are exposed by their own convention
+			for _, previous := range unitConventions[:i] {
+				if strings.HasSuffix(previous.suffix, convention.suffix) {
+					expanded.SeriesFilters = append(expanded.SeriesFilters, cfg.RegexFilter{IsNot: regexp.QuoteMeta(previous.suffix) + "$"})
+				}
+			}
+			expanded.Name = cfg.NameMapping{Matches: "^(.*)" + regexp.QuoteMeta(convention.suffix) + "$", As: convention.as}
+			expanded.MetricsQuery = convention.metricsQuery
+			if strings.Contains(convention.metricsQuery, "%s") {
+				expanded.MetricsQuery = fmt.Sprintf(convention.metricsQuery, pmodel.Duration(rateWindow))
+			}
+			res = append(res, expanded)
+		}
+
+		others := rule
+		others.UnitConventions = nil
+		suffixes := make([]string, 0, len(unitConventions))
+		for _, convention := range unitConventions {
+			suffixes = append(suffixes, regexp.QuoteMeta(convention.suffix))
+		}
+		others.SeriesFilters = append(append([]cfg.RegexFilter(nil), rule.SeriesFilters...),
+			cfg.RegexFilter{IsNot: "(" + strings.Join(suffixes, "|") + ")$"})
+		others.MetricsQuery = unitConventionsDefaultMetricsQuery
+		res = append(res, others)
+	}
+	return res
+}
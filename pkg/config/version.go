@@ -0,0 +1,37 @@
+package config
+
+import (
+	cfg "sigs.k8s.io/prometheus-adapter/pkg/config"
+)
+
+const (
+	// APIVersionV1 is the layout of the configurations written before apiVersion was introduced,
+	// which is the one of prometheus-adapter plus the extensions of this adapter.
+	APIVersionV1 = "v1"
+	// CurrentAPIVersion is the layout the configuration is kept in once loaded.
+	CurrentAPIVersion = "v2"
+)
+
+// v1Config is a configuration of APIVersionV1.
+type v1Config struct {
+	MetricsDiscoveryConfig `yaml:",inline"`
+	// ResourceRules configure the resource metrics API of prometheus-adapter, which this
+	// adapter doesn't serve. They are ignored, and dropped by v2.
+	ResourceRules *cfg.ResourceRules `yaml:"resourceRules,omitempty"`
+}
+
+// upgrade converts the configuration to CurrentAPIVersion.
+func (c *v1Config) upgrade() *MetricsDiscoveryConfig {
+	upgraded := c.MetricsDiscoveryConfig
+	upgraded.APIVersion = CurrentAPIVersion
+	return &upgraded
+}
+
+// deprecations returns a warning for every deprecated field the configuration sets.
+func (c *v1Config) deprecations() []string {
+	var warnings []string
+	if c.ResourceRules != nil {
+		warnings = append(warnings, "resourceRules is deprecated and ignored, the adapter doesn't serve the resource metrics API")
+	}
+	return warnings
+}
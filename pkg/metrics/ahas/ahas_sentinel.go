@@ -1,6 +1,7 @@
 package ahas
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strconv"
@@ -51,8 +52,11 @@ func (s *AHASSentinelMetricSource) GetExternalMetricInfoList() []provider.Extern
 	return metricInfoList
 }
 
-func (s *AHASSentinelMetricSource) GetExternalMetric(info provider.ExternalMetricInfo, namespace string, requirements labels.Requirements) (values []external_metrics.ExternalMetricValue, err error) {
-	params, err := getAhasSentinelParams(requirements, namespace)
+func (s *AHASSentinelMetricSource) GetExternalMetric(ctx context.Context, info provider.ExternalMetricInfo, namespace string, requirements labels.Requirements) (values []external_metrics.ExternalMetricValue, err error) {
+	ctx, cancel := utils.WithBackendTimeout(ctx, utils.AHASBackend)
+	defer cancel()
+
+	params, err := getAhasSentinelParams(ctx, requirements, namespace)
 	if err != nil {
 		return values, fmt.Errorf("failed to get AHAS Sentinel params, cause: %v", err)
 	}
@@ -67,12 +71,22 @@ func (s *AHASSentinelMetricSource) GetExternalMetric(info provider.ExternalMetri
 	metricRequest.AppName = params.AppName
 	interval := params.Interval
 	queryOffset := params.QueryStartOffset
-	endTimeStr := time.Now().Add(-1 * time.Duration(queryOffset) * time.Second).Format(utils.DEFAULT_TIME_FORMAT)
+	endTime := time.Now().Add(-1 * time.Duration(queryOffset) * time.Second)
+	endTimeStr := endTime.Format(utils.DEFAULT_TIME_FORMAT)
 	startTimeStr := time.Now().Add(-1 * time.Duration(interval+queryOffset) * time.Second).Format(utils.DEFAULT_TIME_FORMAT)
 	metricRequest.StartTime = startTimeStr
 	metricRequest.EndTime = endTimeStr
+	if err = utils.SetRequestDeadline(ctx, metricRequest); err != nil {
+		log.Errorf("Failed to get AHAS Sentinel response, err: %v", err)
+		return values, err
+	}
 
+	release, err := utils.AcquireBackend(ctx, utils.AHASBackend)
+	if err != nil {
+		return values, err
+	}
 	metrics, err := client.GetSentinelAppSumMetric(metricRequest)
+	release()
 	if err != nil {
 		log.Errorf("Failed to get AHAS Sentinel response, err: %v", err)
 		return values, err
@@ -81,8 +95,10 @@ func (s *AHASSentinelMetricSource) GetExternalMetric(info provider.ExternalMetri
 	values = append(values, external_metrics.ExternalMetricValue{
 		MetricName: info.Metric,
 		Value:      *resource.NewQuantity(int64(count), resource.DecimalSI),
-		Timestamp:  metav1.Now(),
+		// the sum is of the interval ending at the query offset
+		Timestamp: metav1.NewTime(endTime),
 	})
+	utils.SetWindowLabel(values, params.Interval)
 	return values, nil
 }
 
@@ -123,6 +139,9 @@ func (s *AHASSentinelMetricSource) createClient() (client *ahas.Client, err erro
 		client, err = ahas.NewClientWithAccessKey(accessUserInfo.Region, accessUserInfo.AccessKeyId, accessUserInfo.AccessKeySecret)
 
 	}
+	if err == nil {
+		utils.ApplySDKTransport(client)
+	}
 	return client, err
 }
 
@@ -130,7 +149,7 @@ type AHASSentinelParams struct {
 	SentinelGlobalParams
 }
 
-func getAhasSentinelParams(requirements labels.Requirements, k8sNamespace string) (params *AHASSentinelParams, err error) {
+func getAhasSentinelParams(ctx context.Context, requirements labels.Requirements, k8sNamespace string) (params *AHASSentinelParams, err error) {
 	params = &AHASSentinelParams{}
 	for _, r := range requirements {
 
@@ -159,7 +178,7 @@ func getAhasSentinelParams(requirements labels.Requirements, k8sNamespace string
 	}
 	if len(params.AppName) <= 0 {
 		// try to get Sentinel appName from pilot annotation.
-		pilotMetadata, err := getPilotAnnotationMetadata(k8sNamespace)
+		pilotMetadata, err := getPilotAnnotationMetadata(ctx, k8sNamespace)
 		if err != nil {
 			return params, err
 		}
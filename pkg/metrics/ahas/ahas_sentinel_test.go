@@ -1,6 +1,7 @@
 package ahas
 
 import (
+	"context"
 	"testing"
 
 	"k8s.io/apimachinery/pkg/labels"
@@ -8,7 +9,7 @@ import (
 
 func TestInvalidGetAhasSentinelParams(t *testing.T) {
 	r := make([]labels.Requirement, 0)
-	_, e := getAhasSentinelParams(r, "")
+	_, e := getAhasSentinelParams(context.TODO(), r, "")
 	if e != nil {
 		t.Log("pass TestInvalidGetAhasSentinelParams")
 		return
@@ -23,7 +24,7 @@ func TestValidGetAhasSentinelParams(t *testing.T) {
 		t.Fatalf("new requirement err: %v", e)
 	}
 	r = append(r, *requirement)
-	params, e := getAhasSentinelParams(r, "")
+	params, e := getAhasSentinelParams(context.TODO(), r, "")
 	if e == nil && params.AppName == "sentinel-console" {
 		t.Logf("Pass TestValidGetAhasSentinelParams")
 	} else {
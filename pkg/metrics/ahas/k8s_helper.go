@@ -50,13 +50,13 @@ func getCurrentK8sNamespace() (string, error) {
 	return string(bytes), nil
 }
 
-func getPilotAnnotationMetadata(namespace string) (*SentinelPilotMetadata, error) {
+func getPilotAnnotationMetadata(ctx context.Context, namespace string) (*SentinelPilotMetadata, error) {
 	println(len(namespace))
 	if len(namespace) == 0 {
 		return nil, errors.New("invalid namespace")
 	}
 	// log.Infoln("Namespace resolved:" + namespace)
-	ds, err := k8sClient.AppsV1().Deployments(namespace).List(context.Background(), metav1.ListOptions{})
+	ds, err := k8sClient.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
 	if err != nil {
 		return nil, err
 	}
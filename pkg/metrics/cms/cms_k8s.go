@@ -1,6 +1,11 @@
 package cms
 
 import (
+	"context"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/requests"
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/cms"
 	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
 	"k8s.io/apimachinery/pkg/labels"
 	log "k8s.io/klog/v2"
@@ -24,7 +29,22 @@ const (
 	K8S_WORKLOAD_NETWORKRXERRORS  = "k8s_workload_network_rx_errors"
 )
 
-type CMSMetricSource struct{}
+// workloadMetricsClient is the part of the cms client used by the workload metrics.
+type workloadMetricsClient interface {
+	DescribeMonitorGroups(request *cms.DescribeMonitorGroupsRequest) (*cms.DescribeMonitorGroupsResponse, error)
+	DescribeMetricList(request *cms.DescribeMetricListRequest) (*cms.DescribeMetricListResponse, error)
+}
+
+type CMSMetricSource struct {
+	// newRegionalClient replaces RegionalClient for the workload metrics if set
+	newRegionalClient func(region string) (workloadMetricsClient, error)
+	settings *utils.ExternalMetricSettings
+}
+
+// SetMetricSettings sets the periods, statistics, fallback regions and hedge delays of the workload metrics.
+func (cs *CMSMetricSource) SetMetricSettings(settings *utils.ExternalMetricSettings) {
+	cs.settings = settings
+}
 
 func (cs *CMSMetricSource) GetExternalMetricInfoList() []p.ExternalMetricInfo {
 	metricInfoList := make([]p.ExternalMetricInfo, 0)
@@ -50,58 +70,64 @@ func (cs *CMSMetricSource) GetExternalMetricInfoList() []p.ExternalMetricInfo {
 	return metricInfoList
 }
 
-func (cs *CMSMetricSource) GetExternalMetric(info p.ExternalMetricInfo, namespace string, requirements labels.Requirements) (values []external_metrics.ExternalMetricValue, err error) {
+func (cs *CMSMetricSource) GetExternalMetric(ctx context.Context, info p.ExternalMetricInfo, namespace string, requirements labels.Requirements) (values []external_metrics.ExternalMetricValue, err error) {
+	ctx, cancel := utils.WithBackendTimeout(ctx, utils.CMSBackend)
+	defer cancel()
+
+	// the settings are of the external metric, not of the group metric it's translated to
+	settings := cs.settings.Of(info.Metric)
+
 	switch info.Metric {
 	case K8S_WORKLOAD_CPUUTIL:
-		values, err = cs.getCMSWorkLoadMetrics(namespace, requirements, p.ExternalMetricInfo{
+		values, err = cs.getCMSWorkLoadMetrics(ctx, namespace, requirements, settings, p.ExternalMetricInfo{
 			Metric: "group.cpu.usage_rate",
 		})
 	case K8S_WORKLOAD_CPULIMIT:
-		values, err = cs.getCMSWorkLoadMetrics(namespace, requirements, p.ExternalMetricInfo{
+		values, err = cs.getCMSWorkLoadMetrics(ctx, namespace, requirements, settings, p.ExternalMetricInfo{
 			Metric: "group.cpu.limit",
 		})
 	case K8S_WORKLOAD_CPUREQUEST:
-		values, err = cs.getCMSWorkLoadMetrics(namespace, requirements, p.ExternalMetricInfo{
+		values, err = cs.getCMSWorkLoadMetrics(ctx, namespace, requirements, settings, p.ExternalMetricInfo{
 			Metric: "group.cpu.request",
 		})
 	case K8S_WORKLOAD_MEMORYUSAGE:
-		values, err = cs.getCMSWorkLoadMetrics(namespace, requirements, p.ExternalMetricInfo{
+		values, err = cs.getCMSWorkLoadMetrics(ctx, namespace, requirements, settings, p.ExternalMetricInfo{
 			Metric: "group.memory.usage",
 		})
 	case K8S_WORKLOAD_MEMORYREQUEST:
-		values, err = cs.getCMSWorkLoadMetrics(namespace, requirements, p.ExternalMetricInfo{
+		values, err = cs.getCMSWorkLoadMetrics(ctx, namespace, requirements, settings, p.ExternalMetricInfo{
 			Metric: "group.memory.request",
 		})
 	case K8S_WORKLOAD_MEMORYLIMIT:
-		values, err = cs.getCMSWorkLoadMetrics(namespace, requirements, p.ExternalMetricInfo{
+		values, err = cs.getCMSWorkLoadMetrics(ctx, namespace, requirements, settings, p.ExternalMetricInfo{
 			Metric: "group.memory.limit",
 		})
 	case K8S_WORKLOAD_MEMORYWORKINGSET:
-		values, err = cs.getCMSWorkLoadMetrics(namespace, requirements, p.ExternalMetricInfo{
+		values, err = cs.getCMSWorkLoadMetrics(ctx, namespace, requirements, settings, p.ExternalMetricInfo{
 			Metric: "group.memory.working_set",
 		})
 	case K8S_WORKLOAD_MEMORYRSS:
-		values, err = cs.getCMSWorkLoadMetrics(namespace, requirements, p.ExternalMetricInfo{
+		values, err = cs.getCMSWorkLoadMetrics(ctx, namespace, requirements, settings, p.ExternalMetricInfo{
 			Metric: "group.memory.rss",
 		})
 	case K8S_WORKLOAD_MEMORYCACHE:
-		values, err = cs.getCMSWorkLoadMetrics(namespace, requirements, p.ExternalMetricInfo{
+		values, err = cs.getCMSWorkLoadMetrics(ctx, namespace, requirements, settings, p.ExternalMetricInfo{
 			Metric: "group.memory.cache",
 		})
 	case K8S_WORKLOAD_NETWORKTXRATE:
-		values, err = cs.getCMSWorkLoadMetrics(namespace, requirements, p.ExternalMetricInfo{
+		values, err = cs.getCMSWorkLoadMetrics(ctx, namespace, requirements, settings, p.ExternalMetricInfo{
 			Metric: "group.network.tx_rate",
 		})
 	case K8S_WORKLOAD_NETWORKRXRATE:
-		values, err = cs.getCMSWorkLoadMetrics(namespace, requirements, p.ExternalMetricInfo{
+		values, err = cs.getCMSWorkLoadMetrics(ctx, namespace, requirements, settings, p.ExternalMetricInfo{
 			Metric: "group.network.rx_rate",
 		})
 	case K8S_WORKLOAD_NETWORKTXERRORS:
-		values, err = cs.getCMSWorkLoadMetrics(namespace, requirements, p.ExternalMetricInfo{
+		values, err = cs.getCMSWorkLoadMetrics(ctx, namespace, requirements, settings, p.ExternalMetricInfo{
 			Metric: "group.network.tx_errors",
 		})
 	case K8S_WORKLOAD_NETWORKRXERRORS:
-		values, err = cs.getCMSWorkLoadMetrics(namespace, requirements, p.ExternalMetricInfo{
+		values, err = cs.getCMSWorkLoadMetrics(ctx, namespace, requirements, settings, p.ExternalMetricInfo{
 			Metric: "group.network.rx_errors",
 		})
 	}
@@ -113,6 +139,32 @@ func (cs *CMSMetricSource) GetExternalMetric(info p.ExternalMetricInfo, namespac
 	return values, err
 }
 
+// QueriesAtEvaluationTime tells that CMS is queried for the workload metrics at a past time, see utils.EvaluationTime.
+func (cs *CMSMetricSource) QueriesAtEvaluationTime() bool {
+	return true
+}
+
+// Ping lists a single project of CMS, which only keeps the connections to CMS open, see utils.RunWarmUp.
+func (cs *CMSMetricSource) Ping(ctx context.Context) error {
+	client, err := cs.Client()
+	if err != nil {
+		return err
+	}
+	request := cms.CreateDescribeProjectMetaRequest()
+	request.Scheme = "https"
+	request.PageSize = requests.NewInteger(1)
+	if err := utils.SetRequestDeadline(ctx, request); err != nil {
+		return err
+	}
+	release, err := utils.AcquireBackend(ctx, utils.CMSBackend)
+	if err != nil {
+		return err
+	}
+	defer release()
+	_, err = client.DescribeProjectMeta(request)
+	return err
+}
+
 // register cms metric source to provider
 func NewCMSMetricSource() *CMSMetricSource {
 	return &CMSMetricSource{}
@@ -0,0 +1,684 @@
+package cms
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/requests"
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/responses"
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/cms"
+	"github.com/denverdino/aliyungo/metadata"
+	"github.com/prometheus/client_golang/prometheus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	log "k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+const (
+	// every custom metric pushed to cms is exposed as cms_custom_<metric name>
+	CMS_CUSTOM_METRIC_PREFIX = utils.CMSCustomMetricPrefix
+	// cms namespace of the custom metrics of an account
+	CMS_CUSTOM_NAMESPACE_PREFIX = "acs_customMetric_"
+
+	// params
+	CMS_CUSTOM_USER_ID          = "cms.custom.user.id"
+	CMS_CUSTOM_GROUP_ID         = "cms.custom.group.id"
+	CMS_CUSTOM_PERIOD           = "cms.custom.period"
+	CMS_CUSTOM_STATISTIC        = "cms.custom.statistic"
+	CMS_CUSTOM_DIMENSION_PREFIX = "cms.custom.dimension."
+
+	CMS_CUSTOM_DEFAULT_STATISTIC = utils.DefaultCMSStatistic
+
+	// custom metric list is paged by page number, data points by next token
+	CMS_CUSTOM_PAGE_SIZE = 100
+	CMS_CUSTOM_MAX_PAGES = 100
+
+	CMS_CUSTOM_DISCOVERY_INTERVAL = 5 * time.Minute
+
+	// CMS_CUSTOM_MAX_DIMENSION_VALUES is the number of dimension values CMS accepts for a single metric query
+	CMS_CUSTOM_MAX_DIMENSION_VALUES = 50
+)
+
+// discoveryPartialFailures counts the discoveries of the custom metrics which failed past the first page.
+var discoveryPartialFailures = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "adapter_cms_custom_discovery_partial_failures_total",
+		Help: "Number of discoveries of the CMS custom metrics which only listed part of the pages because a page failed.",
+	},
+)
+
+// customMetricsClient is the part of the cms client used by the custom metrics.
+type customMetricsClient interface {
+	DescribeCustomMetricList(request *cms.DescribeCustomMetricListRequest) (*cms.DescribeCustomMetricListResponse, error)
+	DescribeMetricList(request *cms.DescribeMetricListRequest) (*cms.DescribeMetricListResponse, error)
+	// DescribeMetricMetaList describes the dimensions of a metric, see utils.CMSDimensionDiscovery
+	DescribeMetricMetaList(request *cms.DescribeMetricMetaListRequest) (*cms.DescribeMetricMetaListResponse, error)
+	// ProcessCommonRequest sends the requests of the apis the cms client lacks, e.g. DescribeHybridMonitorDataList
+	ProcessCommonRequest(request *requests.CommonRequest) (*responses.CommonResponse, error)
+}
+
+type CMSCustomMetricParams struct {
+	CMSGlobalParams
+	UserId     string
+	GroupId    string
+	Statistic  string
+	Dimensions map[string]string
+	// MultiValueDimension is the dimension the selector gives several values, nil if it gives a single value to each
+	MultiValueDimension *CMSCustomMultiValueDimension
+	// Labels are the values of the labels of the selector which are neither a parameter nor translated, which
+	// are mapped to the dimensions of the metric if they're discovered, and ignored otherwise
+	Labels map[string][]string
+}
+
+// CMSCustomMultiValueDimension is a dimension a selector gives several values, e.g. `instanceId in (a,b,c)`.
+// Each value is queried on its own, and its result is returned under the label of the selector.
+type CMSCustomMultiValueDimension struct {
+	// Label is the key of the selector, which labels the value of each dimension value
+	Label     string
+	Dimension string
+	// LabelValues are the values of the label, which differ from the dimension values if the label is translated
+	LabelValues []string
+	Values      []string
+}
+
+// withDimension returns a copy of the params with the dimension set to the value.
+func (params *CMSCustomMetricParams) withDimension(dimension, value string) *CMSCustomMetricParams {
+	res := *params
+	res.Dimensions = make(map[string]string, len(params.Dimensions)+1)
+	for k, v := range params.Dimensions {
+		res.Dimensions[k] = v
+	}
+	res.Dimensions[dimension] = value
+	res.MultiValueDimension = nil
+	return &res
+}
+
+// customMetricListResult is the content of the Result field of DescribeCustomMetricList,
+// which unlike the standard cms apis is returned as a json string.
+type customMetricListResult struct {
+	Results []customMetric `json:"Results"`
+}
+
+type customMetric struct {
+	GroupId    string `json:"GroupId"`
+	MetricName string `json:"MetricName"`
+	Dimension  string `json:"Dimension"`
+}
+
+// CMSCustomMetricSource serves the metrics which are pushed to cms custom monitoring.
+// The metrics aren't known upfront, they are discovered from cms in the background.
+type CMSCustomMetricSource struct {
+	newClient func() (customMetricsClient, error)
+	// newRegionalClient creates the client of the fallback region of a metric
+	newRegionalClient func(region string) (customMetricsClient, error)
+	ownerAccountId    func() (string, error)
+	clock             clock.Clock
+
+	lock         sync.Mutex
+	metrics      []p.ExternalMetricInfo
+	discoveredAt time.Time
+	discovering  bool
+
+	// schemas are the dimensions of the metrics the labels of the selectors are mapped to
+	schemas  dimensionSchemas
+	settings *utils.ExternalMetricSettings
+}
+
+func NewCMSCustomMetricSource() *CMSCustomMetricSource {
+	utils.RegisterMetrics(discoveryPartialFailures)
+	cs := &CMSMetricSource{}
+	return &CMSCustomMetricSource{
+		newClient: func() (customMetricsClient, error) {
+			return cs.Client()
+		},
+		newRegionalClient: func(region string) (customMetricsClient, error) {
+			return cs.RegionalClient(region)
+		},
+		ownerAccountId: func() (string, error) {
+			return metadata.NewMetaData(nil).OwnerAccountID()
+		},
+		clock: clock.RealClock{},
+	}
+}
+
+// SetMetricSettings sets the periods, statistics, hybrid namespaces and regions of the custom metrics, and the
+// labels of the selectors translated to dimensions.
+func (cs *CMSCustomMetricSource) SetMetricSettings(settings *utils.ExternalMetricSettings) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.settings = settings
+}
+
+// MetricPrefix makes the manager route every metric with the prefix to this source.
+func (cs *CMSCustomMetricSource) MetricPrefix() string {
+	return CMS_CUSTOM_METRIC_PREFIX
+}
+
+// GetExternalMetricInfoList returns the custom metrics discovered so far, and triggers
+// a discovery in the background if the list is out of date.
+func (cs *CMSCustomMetricSource) GetExternalMetricInfoList() []p.ExternalMetricInfo {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	if !cs.discovering && cs.clock.Since(cs.discoveredAt) > CMS_CUSTOM_DISCOVERY_INTERVAL {
+		cs.discovering = true
+		go cs.refreshMetricInfoList()
+	}
+
+	// the metrics of the hybrid monitoring aren't discovered, they're listed as configured
+	hybridMetrics := cs.settings.HybridMetrics()
+	if len(hybridMetrics) == 0 {
+		metrics := make([]p.ExternalMetricInfo, len(cs.metrics))
+		copy(metrics, cs.metrics)
+		return metrics
+	}
+	configured := make([]p.ExternalMetricInfo, 0, len(hybridMetrics))
+	for _, m := range hybridMetrics {
+		configured = append(configured, p.ExternalMetricInfo{Metric: m})
+	}
+	return mergeMetricInfoLists(cs.metrics, configured)
+}
+
+func (cs *CMSCustomMetricSource) refreshMetricInfoList() {
+	ctx, cancel := utils.WithBackendTimeout(context.Background(), utils.CMSBackend)
+	defer cancel()
+
+	metrics, partial, err := cs.discover(ctx)
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.discovering = false
+	if err != nil {
+		// keep the previous list and retry on the next listing
+		log.Errorf("Failed to discover cms custom metrics,because of %v", err)
+		return
+	}
+	if partial {
+		// the metrics of the missing pages stay listed, and the discovery is retried on the next listing
+		cs.metrics = mergeMetricInfoLists(cs.metrics, metrics)
+		return
+	}
+	cs.metrics = metrics
+	cs.discoveredAt = cs.clock.Now()
+}
+
+// mergeMetricInfoLists returns the sorted union of the lists.
+func mergeMetricInfoLists(a, b []p.ExternalMetricInfo) []p.ExternalMetricInfo {
+	listed := make(map[p.ExternalMetricInfo]bool, len(a)+len(b))
+	merged := make([]p.ExternalMetricInfo, 0, len(a)+len(b))
+	for _, m := range append(append([]p.ExternalMetricInfo(nil), a...), b...) {
+		if !listed[m] {
+			listed[m] = true
+			merged = append(merged, m)
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Metric < merged[j].Metric })
+	return merged
+}
+
+// discover pages through the custom metric list and returns every distinct metric name. A page which
+// fails after the first one ends the paging: the metrics of the pages fetched so far are returned as a
+// partial list, so that most metrics stay available, while a failure of the first page fails the discovery.
+func (cs *CMSCustomMetricSource) discover(ctx context.Context) (metrics []p.ExternalMetricInfo, partial bool, err error) {
+	client, err := cs.newClient()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create cms client,because of %v", err)
+	}
+
+	names := make(map[string]bool)
+	for page := 1; page <= CMS_CUSTOM_MAX_PAGES; page++ {
+		results, err := describeCustomMetricListPage(ctx, client, page)
+		if err != nil {
+			if page == 1 {
+				return nil, false, err
+			}
+			discoveryPartialFailures.Inc()
+			log.Warningf("Failed to list page %d of the cms custom metrics, keeping the metrics of the first %d pages: %v", page, page-1, err)
+			partial = true
+			break
+		}
+		for _, r := range results {
+			name := r.MetricName
+			if utils.CMSNameEncoding() {
+				if name, err = utils.EncodeCMSName(name); err != nil {
+					log.Warningf("Not listing cms custom metric %s: %v", r.MetricName, err)
+					continue
+				}
+			}
+			names[name] = true
+		}
+		if len(results) < CMS_CUSTOM_PAGE_SIZE {
+			break
+		}
+	}
+
+	metrics = make([]p.ExternalMetricInfo, 0, len(names))
+	for name := range names {
+		metrics = append(metrics, p.ExternalMetricInfo{Metric: CMS_CUSTOM_METRIC_PREFIX + name})
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Metric < metrics[j].Metric })
+	return metrics, partial, nil
+}
+
+// describeCustomMetricListPage returns the custom metrics of a page of the custom metric list.
+func describeCustomMetricListPage(ctx context.Context, client customMetricsClient, page int) ([]customMetric, error) {
+	request := cms.CreateDescribeCustomMetricListRequest()
+	request.Scheme = "https"
+	request.PageNumber = strconv.Itoa(page)
+	request.PageSize = strconv.Itoa(CMS_CUSTOM_PAGE_SIZE)
+	if err := utils.SetRequestDeadline(ctx, request); err != nil {
+		return nil, fmt.Errorf("failed to describe custom metric list,because of %v", err)
+	}
+
+	release, err := utils.AcquireBackend(ctx, utils.CMSBackend)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.DescribeCustomMetricList(request)
+	release()
+	if err != nil {
+		return nil, err
+	}
+	return parseCustomMetricList(response)
+}
+
+func parseCustomMetricList(response *cms.DescribeCustomMetricListResponse) ([]customMetric, error) {
+	if response.Code != "" && response.Code != "200" {
+		return nil, cmsStatusError(CMS_CUSTOM_METRIC_PREFIX, response.Code, response.Message)
+	}
+	if response.Result == "" {
+		return nil, nil
+	}
+	var result customMetricListResult
+	if err := json.Unmarshal([]byte(response.Result), &result); err != nil {
+		return nil, fmt.Errorf("json unmarshal custom metric list exception %v", err)
+	}
+	return result.Results, nil
+}
+
+func (cs *CMSCustomMetricSource) GetExternalMetric(ctx context.Context, info p.ExternalMetricInfo, namespace string, requirements labels.Requirements) (values []external_metrics.ExternalMetricValue, err error) {
+	ctx, cancel := utils.WithBackendTimeout(ctx, utils.CMSBackend)
+	defer cancel()
+
+	metricName := strings.TrimPrefix(info.Metric, CMS_CUSTOM_METRIC_PREFIX)
+	if metricName == "" || metricName == info.Metric {
+		return values, fmt.Errorf("%s is not a cms custom metric", info.Metric)
+	}
+	if utils.CMSNameEncoding() {
+		if metricName, err = utils.DecodeCMSName(metricName); err != nil {
+			return values, apierrors.NewBadRequest(err.Error())
+		}
+	}
+
+	cs.lock.Lock()
+	settings := cs.settings
+	cs.lock.Unlock()
+	metricSettings := settings.Of(info.Metric)
+
+	params, err := getCMSCustomParams(requirements, settings, info.Metric)
+	if err != nil {
+		if apierrors.IsBadRequest(err) {
+			return values, err
+		}
+		return values, fmt.Errorf("Failed to get CMS custom params, because of %v", err)
+	}
+	query := func(ctx context.Context, client customMetricsClient) ([]external_metrics.ExternalMetricValue, error) {
+		return getCustomMetric(ctx, client, params, info.Metric, metricName)
+	}
+	if namespace := metricSettings.HybridNamespace; namespace != "" {
+		// the metrics of the hybrid monitoring are scoped by their namespace rather than by user
+		query = func(ctx context.Context, client customMetricsClient) ([]external_metrics.ExternalMetricValue, error) {
+			return getHybridMetric(ctx, client, namespace, params, info.Metric, metricName)
+		}
+	} else if params.UserId == "" {
+		if params.UserId, err = cs.ownerAccountId(); err != nil {
+			return values, fmt.Errorf("failed to get owner account id,because of %v", err)
+		}
+	}
+
+	client, err := cs.newClient()
+	if err != nil {
+		return values, fmt.Errorf("failed to create cms client,because of %v", err)
+	}
+	schemaNamespace := CMS_CUSTOM_NAMESPACE_PREFIX + params.UserId
+	if metricSettings.HybridNamespace != "" {
+		schemaNamespace = metricSettings.HybridNamespace
+	}
+	if err := cs.mapDimensionLabels(ctx, client, schemaNamespace, metricName, params); err != nil {
+		return values, convertCMSError(info.Metric, err)
+	}
+	fallback := metricSettings.FallbackRegion
+	// a slow query of a metric with a hedge delay is sent to its fallback region too, the first answer wins
+	result, hedged, err := utils.Hedge(ctx, info.Metric, metricSettings.HedgeDelay, func(ctx context.Context) (interface{}, error) {
+		return query(ctx, client)
+	}, func(ctx context.Context) (interface{}, error) {
+		client, err := cs.newRegionalClient(fallback)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cms client of region %s,because of %v", fallback, err)
+		}
+		return query(ctx, client)
+	})
+	values, _ = result.([]external_metrics.ExternalMetricValue)
+	if fallback != "" && !hedged && utils.IsRegionalFailure(ctx, err) {
+		log.Warningf("CMS failed to serve metric %s, querying its fallback region %s: %v", info.Metric, fallback, err)
+		if client, err = cs.newRegionalClient(fallback); err != nil {
+			return values, fmt.Errorf("failed to create cms client of region %s,because of %v", fallback, err)
+		}
+		values, err = query(ctx, client)
+	}
+	if err != nil {
+		return values, convertCMSError(info.Metric, err)
+	}
+	utils.SetWindowLabel(values, params.Period)
+	return values, nil
+}
+
+// getCustomMetric queries the values of the custom metric, a value per value of the multi-value dimension
+// if there is one. The errors of the cms api are returned as is, so that the caller can tell the regional failures.
+func getCustomMetric(ctx context.Context, client customMetricsClient, params *CMSCustomMetricParams, externalMetric, metricName string) ([]external_metrics.ExternalMetricValue, error) {
+	if params.MultiValueDimension != nil {
+		return getCustomMetricValues(ctx, client, params, externalMetric, metricName)
+	}
+	value, timestamp, err := getCustomMetricValue(ctx, client, params, metricName, utils.QueryTime(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return []external_metrics.ExternalMetricValue{{
+		MetricName: externalMetric,
+		Timestamp:  timestamp,
+		Value:      *resource.NewMilliQuantity(int64(value*1000), resource.DecimalSI),
+	}}, nil
+}
+
+// getCustomMetricValues queries each value of the multi-value dimension in parallel, and returns a value per
+// dimension value, labeled with the value of the selector it stands for. The dimension values without data
+// points are left out, and the query fails if none has any.
+func getCustomMetricValues(ctx context.Context, client customMetricsClient, params *CMSCustomMetricParams, externalMetric, metricName string) ([]external_metrics.ExternalMetricValue, error) {
+	multi := params.MultiValueDimension
+	labelValues := make(map[string]string, len(multi.Values))
+	for i, value := range multi.Values {
+		labelValues[value] = multi.LabelValues[i]
+	}
+
+	var lock sync.Mutex
+	results := make(map[string]external_metrics.ExternalMetricValue, len(multi.Values))
+	_, concurrency := utils.CMSBatching()
+	err := utils.RunBatches(ctx, multi.Values, 1, concurrency, func(ctx context.Context, batch []string) error {
+		value, timestamp, err := getCustomMetricValue(ctx, client, params.withDimension(multi.Dimension, batch[0]), metricName, utils.QueryTime(ctx))
+		if errors.Is(err, utils.ErrNoDataPoints) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		results[batch[0]] = external_metrics.ExternalMetricValue{
+			Timestamp: timestamp,
+			Value:     *resource.NewMilliQuantity(int64(value*1000), resource.DecimalSI),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("the values %v of dimension %s: %w", multi.Values, multi.Dimension, utils.ErrNoDataPoints)
+	}
+
+	values := make([]external_metrics.ExternalMetricValue, 0, len(results))
+	for _, value := range multi.Values {
+		result, found := results[value]
+		if !found {
+			continue
+		}
+		result.MetricName = externalMetric
+		result.MetricLabels = map[string]string{multi.Label: labelValues[value]}
+		values = append(values, result)
+	}
+	return values, nil
+}
+
+// QueriesAtEvaluationTime tells that CMS is queried for the custom metrics at a past time, see utils.EvaluationTime.
+func (cs *CMSCustomMetricSource) QueriesAtEvaluationTime() bool {
+	return true
+}
+
+// getCMSCustomParams parses the selector of a request, the period and statistic of the settings of the metric
+// are used unless the selector sets them.
+func getCMSCustomParams(requirements labels.Requirements, settings *utils.ExternalMetricSettings, metric string) (params *CMSCustomMetricParams, err error) {
+	metricSettings := settings.Of(metric)
+	params = &CMSCustomMetricParams{
+		CMSGlobalParams: CMSGlobalParams{Period: metricSettings.CMSPeriod()},
+		Statistic:       metricSettings.CMSStatistic(CMS_CUSTOM_DEFAULT_STATISTIC),
+		Dimensions:      make(map[string]string),
+		Labels:          make(map[string][]string),
+	}
+	for _, r := range requirements {
+
+		if len(r.Values().List()) <= 0 {
+			log.Warning("You don't specific any labels and skip")
+			continue
+		}
+
+		value := r.Values().List()[0]
+
+		if r.Values().Len() > 1 {
+			if err := params.setMultiValueDimension(settings, r.Key(), r.Values().List()); err != nil {
+				return params, err
+			}
+			if params.MultiValueDimension != nil && params.MultiValueDimension.Label == r.Key() {
+				continue
+			}
+		}
+
+		switch key := r.Key(); {
+		case key == CMS_CUSTOM_PERIOD:
+			if params.Period, err = strconv.Atoi(value); err != nil {
+				log.Warningf("Failed to parse period and use MIN_PERIOD(%d) as default", MIN_PERIOD)
+				continue
+			}
+		case key == CMS_CUSTOM_USER_ID:
+			params.UserId = value
+		case key == CMS_CUSTOM_GROUP_ID:
+			params.GroupId = value
+		case key == CMS_CUSTOM_STATISTIC:
+			params.Statistic = value
+		case strings.HasPrefix(key, CMS_CUSTOM_DIMENSION_PREFIX):
+			params.Dimensions[strings.TrimPrefix(key, CMS_CUSTOM_DIMENSION_PREFIX)] = value
+		default:
+			// a friendly label, e.g. the name of an instance, stands for a dimension of the lookup table
+			dimension, dimensionValue, translated, err := settings.CMSDimensionForLabel(key, value)
+			if err != nil {
+				return params, apierrors.NewBadRequest(err.Error())
+			}
+			if translated {
+				params.Dimensions[dimension] = dimensionValue
+			} else {
+				params.Labels[key] = r.Values().List()
+			}
+		}
+	}
+
+	// the labels may be mapped to dimensions once the namespace of the metric is known
+	discovery, _ := utils.CMSDimensionDiscovery()
+	if mapped := settings.CMSDimensionLabelNames(); len(mapped) > 0 && len(params.Labels) > 0 && !discovery {
+		// a label which isn't translated is likely a typo of a translated one, it would match the whole metric
+		unknown := make([]string, 0, len(params.Labels))
+		for label := range params.Labels {
+			unknown = append(unknown, label)
+		}
+		sort.Strings(unknown)
+		return params, apierrors.NewBadRequest(fmt.Sprintf("unknown labels %v of the selector, only the labels %v are translated to cms dimensions, or prefixed with %s",
+			unknown, mapped, CMS_CUSTOM_DIMENSION_PREFIX))
+	}
+	if params.GroupId == "" && len(params.Dimensions) == 0 && params.MultiValueDimension == nil && (!discovery || len(params.Labels) == 0) {
+		return params, errors.New(fmt.Sprintf("%s or %s<key> must be provided", CMS_CUSTOM_GROUP_ID, CMS_CUSTOM_DIMENSION_PREFIX))
+	}
+
+	// the values of the other clusters of the account are excluded, unless the selector picks a cluster
+	if clusterId := utils.ClusterID(); clusterId != "" {
+		if _, found := params.Dimensions[utils.ClusterDimension]; !found {
+			params.Dimensions[utils.ClusterDimension] = clusterId
+		}
+	}
+
+	// avoid too short range of period
+	if params.Period < MIN_PERIOD {
+		params.Period = MIN_PERIOD
+	}
+
+	return params, nil
+}
+
+// setMultiValueDimension records the values of a label of the selector which stands for a dimension, translated
+// by the settings. The other labels keep their first value. Only one dimension may have several values, which CMS bounds.
+func (params *CMSCustomMetricParams) setMultiValueDimension(settings *utils.ExternalMetricSettings, label string, labelValues []string) error {
+	dimension := strings.TrimPrefix(label, CMS_CUSTOM_DIMENSION_PREFIX)
+	values := labelValues
+	if dimension == label {
+		// a friendly label stands for a dimension of its lookup table, the other labels aren't dimensions
+		values = make([]string, 0, len(labelValues))
+		for _, labelValue := range labelValues {
+			d, value, translated, err := settings.CMSDimensionForLabel(label, labelValue)
+			if err != nil || !translated {
+				return err
+			}
+			dimension = d
+			values = append(values, value)
+		}
+	}
+	return params.setMultiValue(label, dimension, labelValues, values)
+}
+
+// setMultiValue records the values of the dimension the label of the selector stands for.
+func (params *CMSCustomMetricParams) setMultiValue(label, dimension string, labelValues, values []string) error {
+	if params.MultiValueDimension != nil {
+		return fmt.Errorf("only one dimension may have several values, both %s and %s have", params.MultiValueDimension.Label, label)
+	}
+	if len(values) > CMS_CUSTOM_MAX_DIMENSION_VALUES {
+		return fmt.Errorf("dimension %s has %d values, more than the %d cms accepts", dimension, len(values), CMS_CUSTOM_MAX_DIMENSION_VALUES)
+	}
+	params.MultiValueDimension = &CMSCustomMultiValueDimension{
+		Label:       label,
+		Dimension:   dimension,
+		LabelValues: labelValues,
+		Values:      values,
+	}
+	return nil
+}
+
+// customMetricDimensions builds the dimensions of a custom metric query. The dimensions
+// the metric was pushed with are matched as a single sorted k=v&k=v string.
+func customMetricDimensions(params *CMSCustomMetricParams) (string, error) {
+	dimension := make(map[string]string)
+	if params.GroupId != "" {
+		dimension["groupId"] = params.GroupId
+	}
+	if len(params.Dimensions) > 0 {
+		pairs := make([]string, 0, len(params.Dimensions))
+		for k, v := range params.Dimensions {
+			pairs = append(pairs, k+"="+v)
+		}
+		sort.Strings(pairs)
+		dimension["dimension"] = strings.Join(pairs, "&")
+	}
+	// & must not be escaped by the encoder
+	var dimensions bytes.Buffer
+	encoder := json.NewEncoder(&dimensions)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode([]map[string]string{dimension}); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(dimensions.String()), nil
+}
+
+// getCustomMetricValue pages through the data points of a custom metric in the last
+// periods and returns the statistic of the latest one, and its time.
+func getCustomMetricValue(ctx context.Context, client customMetricsClient, params *CMSCustomMetricParams, metricName string, now time.Time) (float64, metav1.Time, error) {
+	dimensions, err := customMetricDimensions(params)
+	if err != nil {
+		return 0, metav1.Time{}, err
+	}
+
+	startTime, endTime := utils.AlignedTimeRange(now, params.Period, 5)
+
+	var latest map[string]interface{}
+	var latestTimestamp float64
+	nextToken := ""
+	for page := 1; page <= CMS_CUSTOM_MAX_PAGES; page++ {
+		request := cms.CreateDescribeMetricListRequest()
+		request.Scheme = "https"
+		request.Namespace = CMS_CUSTOM_NAMESPACE_PREFIX + params.UserId
+		request.MetricName = metricName
+		request.Dimensions = dimensions
+		request.Period = strconv.Itoa(params.Period)
+		request.Length = strconv.Itoa(CMS_CUSTOM_PAGE_SIZE)
+		request.StartTime = startTime.Format(utils.DEFAULT_TIME_FORMAT)
+		request.EndTime = endTime.Format(utils.DEFAULT_TIME_FORMAT)
+		request.NextToken = nextToken
+		if err := utils.SetRequestDeadline(ctx, request); err != nil {
+			return 0, metav1.Time{}, fmt.Errorf("failed to describe custom metric,because of %v", err)
+		}
+
+		release, err := utils.AcquireBackend(ctx, utils.CMSBackend)
+		if err != nil {
+			return 0, metav1.Time{}, err
+		}
+		response, err := client.DescribeMetricList(request)
+		release()
+		if err != nil {
+			return 0, metav1.Time{}, err
+		}
+		if !response.Success {
+			return 0, metav1.Time{}, cmsStatusError(metricName, response.Code, response.Message)
+		}
+
+		var dataPoints []map[string]interface{}
+		if response.Datapoints != "" {
+			if err := json.Unmarshal([]byte(response.Datapoints), &dataPoints); err != nil {
+				return 0, metav1.Time{}, fmt.Errorf("json unmarshal datapoint exception %v", err)
+			}
+		}
+		for _, dataPoint := range dataPoints {
+			if timestamp, _ := dataPoint["timestamp"].(float64); latest == nil || timestamp >= latestTimestamp {
+				latest, latestTimestamp = dataPoint, timestamp
+			}
+		}
+
+		if response.NextToken == "" {
+			break
+		}
+		nextToken = response.NextToken
+	}
+
+	if latest == nil {
+		return 0, metav1.Time{}, fmt.Errorf("datapoint is empty: %w", utils.ErrNoDataPoints)
+	}
+	// the statistics are keyed in upper camel case, but be lenient about it
+	for key, value := range latest {
+		if strings.EqualFold(key, params.Statistic) {
+			if v, ok := value.(float64); ok {
+				return v, utils.DataPointTime(int64(latestTimestamp), now), nil
+			}
+		}
+	}
+	return 0, metav1.Time{}, fmt.Errorf("datapoint has no statistic %s", params.Statistic)
+}
+
+// ensure the cms client can serve the custom metrics
+var _ customMetricsClient = &cms.Client{}
@@ -0,0 +1,655 @@
+package cms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	sdkerrors "github.com/aliyun/alibaba-cloud-sdk-go/sdk/errors"
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/requests"
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/responses"
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/cms"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// fakeCustomMetricsClient replays canned custom metric responses.
+type fakeCustomMetricsClient struct {
+	// metric list pages, by page number
+	metricListPages map[string]string
+	// failures of the metric list pages, by page number
+	metricListErrors map[string]error
+	// data point pages, by next token
+	dataPointPages map[string]*cms.DescribeMetricListResponse
+	// hybridMonitorData is the content of the responses of DescribeHybridMonitorDataList
+	hybridMonitorData string
+
+	metricListRequests []*cms.DescribeCustomMetricListRequest
+	dataPointRequests  []*cms.DescribeMetricListRequest
+	commonRequests     []*requests.CommonRequest
+}
+
+func (c *fakeCustomMetricsClient) DescribeCustomMetricList(request *cms.DescribeCustomMetricListRequest) (*cms.DescribeCustomMetricListResponse, error) {
+	c.metricListRequests = append(c.metricListRequests, request)
+	if err := c.metricListErrors[request.PageNumber]; err != nil {
+		return nil, err
+	}
+	return &cms.DescribeCustomMetricListResponse{
+		Code:   "200",
+		Result: c.metricListPages[request.PageNumber],
+	}, nil
+}
+
+func (c *fakeCustomMetricsClient) DescribeMetricList(request *cms.DescribeMetricListRequest) (*cms.DescribeMetricListResponse, error) {
+	c.dataPointRequests = append(c.dataPointRequests, request)
+	response, found := c.dataPointPages[request.NextToken]
+	if !found {
+		return nil, fmt.Errorf("unexpected next token %q", request.NextToken)
+	}
+	return response, nil
+}
+
+func (c *fakeCustomMetricsClient) DescribeMetricMetaList(request *cms.DescribeMetricMetaListRequest) (*cms.DescribeMetricMetaListResponse, error) {
+	return nil, fmt.Errorf("unexpected metadata request of metric %s", request.MetricName)
+}
+
+func (c *fakeCustomMetricsClient) ProcessCommonRequest(request *requests.CommonRequest) (*responses.CommonResponse, error) {
+	c.commonRequests = append(c.commonRequests, request)
+	response := responses.NewCommonResponse()
+	err := responses.Unmarshal(response, &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader(c.hybridMonitorData)),
+	}, "JSON")
+	return response, err
+}
+
+// metricListPage renders a page of the custom metric list the way cms returns it.
+func metricListPage(names ...string) string {
+	results := ""
+	for i, name := range names {
+		if i > 0 {
+			results += ","
+		}
+		results += `{"GroupId":"7378","MetricName":"` + name + `","Dimension":"{\"app\":\"web\"}","Md5":"5a0d2f"}`
+	}
+	return `{"Results":[` + results + `]}`
+}
+
+func newFakeCustomMetricSource(client *fakeCustomMetricsClient) *CMSCustomMetricSource {
+	return &CMSCustomMetricSource{
+		newClient: func() (customMetricsClient, error) {
+			return client, nil
+		},
+		ownerAccountId: func() (string, error) {
+			return "1234567890", nil
+		},
+		clock: clock.NewFakeClock(time.Now()),
+	}
+}
+
+// metricSettings are the settings of a single configured metric.
+func metricSettings(metric string, settings utils.MetricSettings) *utils.ExternalMetricSettings {
+	return &utils.ExternalMetricSettings{Metrics: map[string]utils.MetricSettings{metric: settings}}
+}
+
+func customSelector(t *testing.T, selector string) labels.Requirements {
+	s, err := labels.Parse(selector)
+	if err != nil {
+		t.Fatalf("Failed to parse selector, because of %v", err)
+	}
+	requirements, _ := s.Requirements()
+	return requirements
+}
+
+func TestDiscoverCustomMetrics(t *testing.T) {
+	names := make([]string, 0, CMS_CUSTOM_PAGE_SIZE)
+	for i := 0; i < CMS_CUSTOM_PAGE_SIZE; i++ {
+		// the same metric is listed once per dimension
+		names = append(names, "qps_"+strconv.Itoa(i%2))
+	}
+	client := &fakeCustomMetricsClient{
+		metricListPages: map[string]string{
+			"1": metricListPage(names...),
+			"2": metricListPage("queue_length"),
+		},
+	}
+
+	metrics, partial, err := newFakeCustomMetricSource(client).discover(context.TODO())
+	if err != nil || partial {
+		t.Fatalf("Failed to discover custom metrics, because of %v", err)
+	}
+	if len(client.metricListRequests) != 2 {
+		t.Errorf("expected the custom metric list to be paged twice, got %d requests", len(client.metricListRequests))
+	}
+
+	expected := []string{"cms_custom_qps_0", "cms_custom_qps_1", "cms_custom_queue_length"}
+	if len(metrics) != len(expected) {
+		t.Fatalf("expected metrics %v, got %v", expected, metrics)
+	}
+	for i, m := range metrics {
+		if m.Metric != expected[i] {
+			t.Errorf("expected metric %s, got %s", expected[i], m.Metric)
+		}
+	}
+}
+
+func TestDiscoverCustomMetricsError(t *testing.T) {
+	client := &fakeCustomMetricsClient{metricListPages: map[string]string{"1": "not json"}}
+	if _, _, err := newFakeCustomMetricSource(client).discover(context.TODO()); err == nil {
+		t.Errorf("expected a malformed custom metric list to be rejected")
+	}
+}
+
+// fullMetricListPage renders a full page of distinct custom metrics, which makes the discovery list the next page.
+func fullMetricListPage(prefix string) string {
+	names := make([]string, 0, CMS_CUSTOM_PAGE_SIZE)
+	for i := 0; i < CMS_CUSTOM_PAGE_SIZE; i++ {
+		names = append(names, prefix+strconv.Itoa(i))
+	}
+	return metricListPage(names...)
+}
+
+func TestDiscoverCustomMetricsPartialFailure(t *testing.T) {
+	client := &fakeCustomMetricsClient{
+		metricListPages: map[string]string{
+			"1": fullMetricListPage("qps_"),
+			"2": fullMetricListPage("latency_"),
+			"3": metricListPage("queue_length"),
+		},
+		metricListErrors: map[string]error{"3": errors.New("cms is throttled")},
+	}
+	before := testutil.ToFloat64(discoveryPartialFailures)
+
+	source := newFakeCustomMetricSource(client)
+	metrics, partial, err := source.discover(context.TODO())
+	if err != nil || !partial {
+		t.Fatalf("expected a partial discovery, got partial %v (%v)", partial, err)
+	}
+	if len(metrics) != 2*CMS_CUSTOM_PAGE_SIZE {
+		t.Errorf("expected the metrics of the first 2 pages, got %d metrics", len(metrics))
+	}
+	if failures := testutil.ToFloat64(discoveryPartialFailures) - before; failures != 1 {
+		t.Errorf("expected the partial failure to be counted, got %v", failures)
+	}
+
+	// the metrics of the failed page which were listed before stay listed
+	source.metrics = []p.ExternalMetricInfo{{Metric: "cms_custom_queue_length"}}
+	source.refreshMetricInfoList()
+	if len(source.metrics) != 2*CMS_CUSTOM_PAGE_SIZE+1 || !source.discoveredAt.IsZero() {
+		t.Errorf("expected the partial list to be merged into the previous one and rediscovered, got %d metrics", len(source.metrics))
+	}
+
+	// a failure of the first page fails the discovery
+	client.metricListErrors = map[string]error{"1": errors.New("cms is throttled")}
+	if _, _, err := source.discover(context.TODO()); err == nil {
+		t.Errorf("expected a failure of the first page to fail the discovery")
+	}
+}
+
+func TestGetCustomMetric(t *testing.T) {
+	client := &fakeCustomMetricsClient{
+		dataPointPages: map[string]*cms.DescribeMetricListResponse{
+			"": {
+				Success:    true,
+				NextToken:  "page-2",
+				Datapoints: `[{"timestamp":1620000000000,"userId":"1234567890","groupId":"7378","dimension":"app=web&zone=a","Average":10,"Maximum":12}]`,
+			},
+			"page-2": {
+				Success:    true,
+				Datapoints: `[{"timestamp":1620000060000,"userId":"1234567890","groupId":"7378","dimension":"app=web&zone=a","Average":20.5,"Maximum":30}]`,
+			},
+		},
+	}
+	source := newFakeCustomMetricSource(client)
+
+	selector := "cms.custom.group.id=7378,cms.custom.dimension.zone=a,cms.custom.dimension.app=web"
+	values, err := source.GetExternalMetric(context.TODO(), p.ExternalMetricInfo{Metric: "cms_custom_qps"}, "default", customSelector(t, selector))
+	if err != nil {
+		t.Fatalf("Failed to get custom metric, because of %v", err)
+	}
+	if len(values) != 1 || values[0].Value.MilliValue() != 20500 {
+		t.Fatalf("expected the average of the latest data point, got %v", values)
+	}
+	if values[0].MetricName != "cms_custom_qps" {
+		t.Errorf("expected the prefixed metric name, got %s", values[0].MetricName)
+	}
+
+	if len(client.dataPointRequests) != 2 {
+		t.Fatalf("expected the data points to be paged twice, got %d requests", len(client.dataPointRequests))
+	}
+	request := client.dataPointRequests[0]
+	if request.Namespace != "acs_customMetric_1234567890" || request.MetricName != "qps" {
+		t.Errorf("unexpected custom metric request %s %s", request.Namespace, request.MetricName)
+	}
+	if request.Dimensions != `[{"dimension":"app=web&zone=a","groupId":"7378"}]` {
+		t.Errorf("unexpected custom metric dimensions %s", request.Dimensions)
+	}
+}
+
+// failingMetricsClient fails every data point query with the same error.
+type failingMetricsClient struct {
+	customMetricsClient
+	err      error
+	requests int
+}
+
+func (c *failingMetricsClient) DescribeMetricList(*cms.DescribeMetricListRequest) (*cms.DescribeMetricListResponse, error) {
+	c.requests++
+	return nil, c.err
+}
+
+func TestGetCustomMetricFallbackRegion(t *testing.T) {
+	selector := "cms.custom.group.id=7378,cms.custom.dimension.app=web"
+
+	for _, c := range []struct {
+		name     string
+		metric   string
+		err      error
+		fallback bool
+	}{
+		{name: "server error", metric: "cms_custom_qps", err: sdkerrors.NewServerError(503, `{"Code":"ServiceUnavailable"}`, ""), fallback: true},
+		{name: "unreachable", metric: "cms_custom_qps", err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, fallback: true},
+		{name: "timeout", metric: "cms_custom_qps", err: sdkerrors.NewClientError(sdkerrors.TimeoutErrorCode, "timed out", nil), fallback: true},
+		{name: "invalid request", metric: "cms_custom_qps", err: sdkerrors.NewServerError(400, `{"Code":"InvalidParameter"}`, "")},
+		{name: "no fallback region", metric: "cms_custom_rt", err: sdkerrors.NewServerError(503, `{"Code":"ServiceUnavailable"}`, "")},
+	} {
+		primary := &failingMetricsClient{err: c.err}
+		fallback := &fakeCustomMetricsClient{dataPointPages: map[string]*cms.DescribeMetricListResponse{
+			"": {Success: true, Datapoints: `[{"timestamp":1620000000000,"Average":3}]`},
+		}}
+		var regions []string
+		source := newFakeCustomMetricSource(nil)
+		source.SetMetricSettings(metricSettings("cms_custom_qps", utils.MetricSettings{FallbackRegion: "cn-shanghai"}))
+		source.newClient = func() (customMetricsClient, error) { return primary, nil }
+		source.newRegionalClient = func(region string) (customMetricsClient, error) {
+			regions = append(regions, region)
+			return fallback, nil
+		}
+
+		values, err := source.GetExternalMetric(context.TODO(), p.ExternalMetricInfo{Metric: c.metric}, "default", customSelector(t, selector))
+		if primary.requests != 1 {
+			t.Errorf("%s: expected the region of the adapter to be queried first, got %d requests", c.name, primary.requests)
+		}
+		if c.fallback {
+			if err != nil || len(values) != 1 || values[0].Value.Value() != 3 {
+				t.Errorf("%s: expected the value of the fallback region, got %v (%v)", c.name, values, err)
+			}
+			if len(regions) != 1 || regions[0] != "cn-shanghai" {
+				t.Errorf("%s: expected the fallback region to be queried, got %v", c.name, regions)
+			}
+			continue
+		}
+		if err == nil || len(regions) != 0 {
+			t.Errorf("%s: expected the failure of the region of the adapter without fallback, got %v (%v) after querying %v", c.name, values, err, regions)
+		}
+	}
+}
+
+func TestGetCustomMetricStatistic(t *testing.T) {
+	client := &fakeCustomMetricsClient{
+		dataPointPages: map[string]*cms.DescribeMetricListResponse{
+			"": {
+				Success:    true,
+				Datapoints: `[{"timestamp":1620000000000,"groupId":"7378","Average":10,"Maximum":12}]`,
+			},
+		},
+	}
+	source := newFakeCustomMetricSource(client)
+
+	selector := "cms.custom.group.id=7378,cms.custom.statistic=maximum,cms.custom.user.id=42"
+	values, err := source.GetExternalMetric(context.TODO(), p.ExternalMetricInfo{Metric: "cms_custom_qps"}, "default", customSelector(t, selector))
+	if err != nil {
+		t.Fatalf("Failed to get custom metric, because of %v", err)
+	}
+	if len(values) != 1 || values[0].Value.Value() != 12 {
+		t.Errorf("expected the maximum of the latest data point, got %v", values)
+	}
+	if client.dataPointRequests[0].Namespace != "acs_customMetric_42" {
+		t.Errorf("expected the user id of the selector to be used, got %s", client.dataPointRequests[0].Namespace)
+	}
+}
+
+func TestGetCustomMetricNoData(t *testing.T) {
+	client := &fakeCustomMetricsClient{
+		dataPointPages: map[string]*cms.DescribeMetricListResponse{
+			"": {Success: true, Datapoints: "[]"},
+		},
+	}
+	source := newFakeCustomMetricSource(client)
+
+	if _, err := source.GetExternalMetric(context.TODO(), p.ExternalMetricInfo{Metric: "cms_custom_qps"}, "default", customSelector(t, "cms.custom.group.id=7378")); err == nil {
+		t.Errorf("expected an error without data points")
+	}
+}
+
+func TestGetCMSCustomParamsRequiresGroupOrDimension(t *testing.T) {
+	if _, err := getCMSCustomParams(customSelector(t, "cms.custom.period=60"), nil, "cms_custom_qps"); err == nil {
+		t.Errorf("expected a selector without group and dimensions to be rejected")
+	}
+}
+
+func TestCustomMetricQueryIsAligned(t *testing.T) {
+	client := &fakeCustomMetricsClient{
+		dataPointPages: map[string]*cms.DescribeMetricListResponse{
+			"": {Success: true, Datapoints: `[{"timestamp":1620000000000,"Average":1}]`},
+		},
+	}
+	params, err := getCMSCustomParams(customSelector(t, "cms.custom.group.id=7378,cms.custom.period=300"), nil, "cms_custom_qps")
+	if err != nil {
+		t.Fatalf("Failed to get params, because of %v", err)
+	}
+	params.UserId = "42"
+
+	now := time.Date(2021, 5, 1, 10, 7, 30, 0, time.Local)
+	if _, _, err := getCustomMetricValue(context.TODO(), client, params, "qps", now); err != nil {
+		t.Fatalf("Failed to get custom metric, because of %v", err)
+	}
+	request := client.dataPointRequests[0]
+	if request.StartTime != "2021-05-01 09:40:00" || request.EndTime != "2021-05-01 10:05:00" {
+		t.Errorf("expected the query to be aligned to the period, got [%s, %s]", request.StartTime, request.EndTime)
+	}
+}
+
+func TestCustomMetricPeriod(t *testing.T) {
+	client := &fakeCustomMetricsClient{
+		dataPointPages: map[string]*cms.DescribeMetricListResponse{
+			"": {Success: true, Datapoints: `[{"timestamp":1620000000000,"Average":1}]`},
+		},
+	}
+	source := newFakeCustomMetricSource(client)
+	source.SetMetricSettings(metricSettings("cms_custom_qps", utils.MetricSettings{Period: 900}))
+
+	for _, c := range []struct {
+		metric   string
+		selector string
+		period   string
+	}{
+		{metric: "cms_custom_qps", selector: "cms.custom.group.id=7378", period: "900"},
+		{metric: "cms_custom_qps", selector: "cms.custom.group.id=7378,cms.custom.period=300", period: "300"},
+		{metric: "cms_custom_latency", selector: "cms.custom.group.id=7378", period: "60"},
+	} {
+		client.dataPointRequests = nil
+		if _, err := source.GetExternalMetric(context.TODO(), p.ExternalMetricInfo{Metric: c.metric}, "default", customSelector(t, c.selector)); err != nil {
+			t.Fatalf("Failed to get custom metric, because of %v", err)
+		}
+		if client.dataPointRequests[0].Period != c.period {
+			t.Errorf("expected period %s of %s with selector %s, got %s", c.period, c.metric, c.selector, client.dataPointRequests[0].Period)
+		}
+	}
+}
+
+func TestCustomMetricConfiguredStatistic(t *testing.T) {
+	client := &fakeCustomMetricsClient{
+		dataPointPages: map[string]*cms.DescribeMetricListResponse{
+			"": {Success: true, Datapoints: `[{"timestamp":1620000000000,"Average":2,"Maximum":9,"Minimum":1,"Value":4}]`},
+		},
+	}
+	source := newFakeCustomMetricSource(client)
+	source.SetMetricSettings(metricSettings("cms_custom_qps", utils.MetricSettings{Statistic: utils.CMSStatisticMaximum}))
+
+	for _, c := range []struct {
+		metric   string
+		selector string
+		value    int64
+	}{
+		{metric: "cms_custom_qps", selector: "cms.custom.group.id=7378", value: 9},
+		{metric: "cms_custom_qps", selector: "cms.custom.group.id=7378,cms.custom.statistic=Value", value: 4},
+		{metric: "cms_custom_latency", selector: "cms.custom.group.id=7378", value: 2},
+	} {
+		values, err := source.GetExternalMetric(context.TODO(), p.ExternalMetricInfo{Metric: c.metric}, "default", customSelector(t, c.selector))
+		if err != nil {
+			t.Fatalf("Failed to get custom metric, because of %v", err)
+		}
+		if len(values) != 1 || values[0].Value.Value() != c.value {
+			t.Errorf("expected value %d of %s with selector %s, got %v", c.value, c.metric, c.selector, values)
+		}
+	}
+}
+
+func TestCustomMetricClusterDimension(t *testing.T) {
+	utils.SetClusterID("c1234")
+	defer utils.SetClusterID("")
+
+	for selector, expected := range map[string]string{
+		// the values of the other clusters are excluded
+		"cms.custom.group.id=7378":                                          `[{"dimension":"clusterId=c1234","groupId":"7378"}]`,
+		"cms.custom.dimension.app=web":                                      `[{"dimension":"app=web&clusterId=c1234"}]`,
+		"cms.custom.dimension.app=web,cms.custom.dimension.clusterId=c5678": `[{"dimension":"app=web&clusterId=c5678"}]`,
+	} {
+		params, err := getCMSCustomParams(customSelector(t, selector), nil, "cms_custom_qps")
+		if err != nil {
+			t.Fatalf("Failed to get params, because of %v", err)
+		}
+		dimensions, err := customMetricDimensions(params)
+		if err != nil || dimensions != expected {
+			t.Errorf("expected dimensions %s for selector %s, got %s (%v)", expected, selector, dimensions, err)
+		}
+	}
+}
+
+func TestCustomMetricDimensionLabels(t *testing.T) {
+	settings := &utils.ExternalMetricSettings{CMSDimensionLabels: map[string]utils.CMSDimensionLabel{
+		"instance": {Dimension: "instanceId", Values: map[string]string{"checkout": "i-2ze1", "search": "i-2ze2"}},
+	}}
+
+	for selector, expected := range map[string]string{
+		"instance=checkout":                            `[{"dimension":"instanceId=i-2ze1"}]`,
+		"cms.custom.group.id=7378,instance=search":     `[{"dimension":"instanceId=i-2ze2","groupId":"7378"}]`,
+		"cms.custom.dimension.app=web,instance=search": `[{"dimension":"app=web&instanceId=i-2ze2"}]`,
+	} {
+		params, err := getCMSCustomParams(customSelector(t, selector), settings, "cms_custom_qps")
+		if err != nil {
+			t.Fatalf("Failed to get params of selector %s, because of %v", selector, err)
+		}
+		dimensions, err := customMetricDimensions(params)
+		if err != nil || dimensions != expected {
+			t.Errorf("expected dimensions %s for selector %s, got %s (%v)", expected, selector, dimensions, err)
+		}
+	}
+
+	_, err := getCMSCustomParams(customSelector(t, "cms.custom.group.id=7378,instance=cart"), settings, "cms_custom_qps")
+	if err == nil || err.Error() != `unknown value "cart" of label instance, which is translated to the cms dimension instanceId of the values [checkout search]` {
+		t.Errorf("expected an unknown instance to be rejected, got %v", err)
+	}
+
+	_, err = getCMSCustomParams(customSelector(t, "cms.custom.dimension.app=web,instanse=search"), settings, "cms_custom_qps")
+	if !apierrors.IsBadRequest(err) || !strings.Contains(err.Error(), "unknown labels [instanse] of the selector, only the labels [instance] are translated") {
+		t.Errorf("expected a label which isn't translated to be rejected with the translated labels, got %v", err)
+	}
+}
+
+// dimensionMetricsClient returns the canned data points of each dimension, and none for the others.
+type dimensionMetricsClient struct {
+	customMetricsClient
+	lock sync.Mutex
+	// data points, by the dimensions of the request
+	dataPoints map[string]string
+	dimensions []string
+}
+
+func (c *dimensionMetricsClient) DescribeMetricList(request *cms.DescribeMetricListRequest) (*cms.DescribeMetricListResponse, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dimensions = append(c.dimensions, request.Dimensions)
+	return &cms.DescribeMetricListResponse{Success: true, Datapoints: c.dataPoints[request.Dimensions]}, nil
+}
+
+func TestGetCustomMetricMultiValueDimension(t *testing.T) {
+	client := &dimensionMetricsClient{dataPoints: map[string]string{
+		`[{"dimension":"app=web&instanceId=i-1","groupId":"7378"}]`: `[{"timestamp":1620000000000,"Average":1.5}]`,
+		`[{"dimension":"app=web&instanceId=i-2","groupId":"7378"}]`: `[{"timestamp":1620000000000,"Average":2}]`,
+		// i-3 has been deleted, it has no data points
+	}}
+	source := newFakeCustomMetricSource(&fakeCustomMetricsClient{})
+	source.newClient = func() (customMetricsClient, error) { return client, nil }
+
+	selector := "cms.custom.group.id=7378,cms.custom.dimension.app=web,cms.custom.dimension.instanceId in (i-3,i-1,i-2)"
+	values, err := source.GetExternalMetric(context.TODO(), p.ExternalMetricInfo{Metric: "cms_custom_qps"}, "default", customSelector(t, selector))
+	if err != nil {
+		t.Fatalf("Failed to get custom metric, because of %v", err)
+	}
+	if len(client.dimensions) != 3 {
+		t.Errorf("expected each dimension value to be queried, got %v", client.dimensions)
+	}
+	if len(values) != 2 {
+		t.Fatalf("expected a value per dimension value with data points, got %v", values)
+	}
+	for i, expected := range map[string]int64{"i-1": 1500, "i-2": 2000} {
+		found := false
+		for _, value := range values {
+			if value.MetricLabels["cms.custom.dimension.instanceId"] == i {
+				found = true
+				if value.Value.MilliValue() != expected {
+					t.Errorf("expected the value of %s to be %d, got %d", i, expected, value.Value.MilliValue())
+				}
+			}
+		}
+		if !found {
+			t.Errorf("expected a value labeled with %s, got %v", i, values)
+		}
+	}
+
+	// none of the values has data points
+	selector = "cms.custom.group.id=7378,cms.custom.dimension.instanceId in (i-3,i-4)"
+	_, err = source.GetExternalMetric(context.TODO(), p.ExternalMetricInfo{Metric: "cms_custom_qps"}, "default", customSelector(t, selector))
+	if !errors.Is(err, utils.ErrNoDataPoints) {
+		t.Errorf("expected no data points when no value has any, got %v", err)
+	}
+}
+
+func TestGetCustomMetricMultiValueLabel(t *testing.T) {
+	settings := &utils.ExternalMetricSettings{CMSDimensionLabels: map[string]utils.CMSDimensionLabel{
+		"instance": {Dimension: "instanceId", Values: map[string]string{"checkout": "i-2ze1", "search": "i-2ze2"}},
+	}}
+	client := &dimensionMetricsClient{dataPoints: map[string]string{
+		`[{"dimension":"instanceId=i-2ze1"}]`: `[{"timestamp":1620000000000,"Average":1}]`,
+		`[{"dimension":"instanceId=i-2ze2"}]`: `[{"timestamp":1620000000000,"Average":2}]`,
+	}}
+	source := newFakeCustomMetricSource(&fakeCustomMetricsClient{})
+	source.SetMetricSettings(settings)
+	source.newClient = func() (customMetricsClient, error) { return client, nil }
+
+	values, err := source.GetExternalMetric(context.TODO(), p.ExternalMetricInfo{Metric: "cms_custom_qps"}, "default", customSelector(t, "instance in (checkout,search)"))
+	if err != nil {
+		t.Fatalf("Failed to get custom metric, because of %v", err)
+	}
+	// the values are returned in the order of the selector, under the friendly label
+	if len(values) != 2 || values[0].MetricLabels["instance"] != "checkout" || values[0].Value.Value() != 1 ||
+		values[1].MetricLabels["instance"] != "search" || values[1].Value.Value() != 2 {
+		t.Errorf("expected a value per instance labeled with its name, got %v", values)
+	}
+}
+
+func TestGetCMSCustomParamsMultiValueLimits(t *testing.T) {
+	ids := make([]string, CMS_CUSTOM_MAX_DIMENSION_VALUES+1)
+	for i := range ids {
+		ids[i] = "i-" + strconv.Itoa(i)
+	}
+	selector := "cms.custom.dimension.instanceId in (" + strings.Join(ids, ",") + ")"
+	_, err := getCMSCustomParams(customSelector(t, selector), nil, "cms_custom_qps")
+	if err == nil || !strings.Contains(err.Error(), "more than the 50 cms accepts") {
+		t.Errorf("expected too many dimension values to be rejected, got %v", err)
+	}
+
+	selector = "cms.custom.dimension.instanceId in (i-1,i-2),cms.custom.dimension.app in (web,api)"
+	_, err = getCMSCustomParams(customSelector(t, selector), nil, "cms_custom_qps")
+	if err == nil || !strings.Contains(err.Error(), "only one dimension may have several values") {
+		t.Errorf("expected several multi-value dimensions to be rejected, got %v", err)
+	}
+
+	// the other labels keep their first value
+	params, err := getCMSCustomParams(customSelector(t, "cms.custom.group.id in (7378,7379)"), nil, "cms_custom_qps")
+	if err != nil || params.GroupId != "7378" || params.MultiValueDimension != nil {
+		t.Errorf("expected the first group id, got %+v (%v)", params, err)
+	}
+}
+
+func TestWorkloadMetricCluster(t *testing.T) {
+	utils.SetClusterID("c1234")
+	defer utils.SetClusterID("")
+
+	params, err := getCMSParams("default", customSelector(t, "k8s.workload.type=deployment,k8s.workload.name=web"), utils.DefaultCMSPeriod)
+	if err != nil || params.ClusterId != "c1234" {
+		t.Errorf("expected the cluster of the adapter, got %+v (%v)", params, err)
+	}
+	params, err = getCMSParams("default", customSelector(t, "k8s.cluster.id=c5678,k8s.workload.type=deployment,k8s.workload.name=web"), utils.DefaultCMSPeriod)
+	if err != nil || params.ClusterId != "c5678" {
+		t.Errorf("expected the cluster of the selector, got %+v (%v)", params, err)
+	}
+}
+
+func TestWorkloadMetricDefaultNamespace(t *testing.T) {
+	utils.SetDefaultNamespace("apps")
+	defer utils.SetDefaultNamespace("")
+
+	for _, c := range []struct {
+		namespace string
+		selector  string
+		expected  string
+	}{
+		{namespace: "", selector: "k8s.cluster.id=c1234,k8s.workload.name=web", expected: "apps"},
+		{namespace: "default", selector: "k8s.cluster.id=c1234,k8s.workload.name=web", expected: "default"},
+		{namespace: "", selector: "k8s.cluster.id=c1234,k8s.workload.name=web,k8s.workload.namespace=shop", expected: "shop"},
+	} {
+		params, err := getCMSParams(c.namespace, customSelector(t, c.selector), utils.DefaultCMSPeriod)
+		if err != nil || params.Namespace != c.expected {
+			t.Errorf("namespace %q, selector %s: expected the namespace %s, got %+v (%v)", c.namespace, c.selector, c.expected, params, err)
+		}
+	}
+}
+
+func TestWorkloadDataPointStatistic(t *testing.T) {
+	point := DataPoint{Value: 4, Sum: 12, Average: 3, Maximum: 6, Minimum: 1}
+	for statistic, expected := range map[string]float64{
+		K8S_WORKLOAD_DEFAULT_STATISTIC: 12,
+		utils.CMSStatisticAverage:      3,
+		utils.CMSStatisticMaximum:      6,
+		utils.CMSStatisticMinimum:      1,
+		utils.CMSStatisticValue:        4,
+	} {
+		if value := point.statistic(statistic); value != expected {
+			t.Errorf("expected the %s %v to be read, got %v", statistic, expected, value)
+		}
+	}
+}
+
+func TestCustomMetricNameEncoding(t *testing.T) {
+	utils.SetCMSNameEncoding(true)
+	defer utils.SetCMSNameEncoding(false)
+
+	client := &fakeCustomMetricsClient{
+		metricListPages: map[string]string{"1": metricListPage("cpu.usage", "queue_length", "bad__name")},
+		dataPointPages: map[string]*cms.DescribeMetricListResponse{
+			"": {Success: true, Datapoints: `[{"timestamp":1620000000000,"Average":7}]`},
+		},
+	}
+	source := newFakeCustomMetricSource(client)
+	metrics, _, err := source.discover(context.TODO())
+	if err != nil {
+		t.Fatalf("Failed to discover custom metrics, because of %v", err)
+	}
+	// the name which wouldn't decode back isn't listed
+	if len(metrics) != 2 || metrics[0].Metric != "cms_custom_cpu__usage" || metrics[1].Metric != "cms_custom_queue_length" {
+		t.Fatalf("expected the encoded names, got %v", metrics)
+	}
+
+	values, err := source.GetExternalMetric(context.TODO(), metrics[0], "default", customSelector(t, "cms.custom.group.id=7378"))
+	if err != nil || len(values) != 1 || values[0].MetricName != "cms_custom_cpu__usage" {
+		t.Fatalf("expected the value of the encoded metric, got %v (%v)", values, err)
+	}
+	if name := client.dataPointRequests[0].MetricName; name != "cpu.usage" {
+		t.Errorf("expected CMS to be queried with the decoded name, got %s", name)
+	}
+}
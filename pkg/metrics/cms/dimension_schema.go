@@ -0,0 +1,136 @@
+package cms
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/cms"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	log "k8s.io/klog/v2"
+)
+
+// dimensionSchema is the set of dimensions the metadata of a metric lists.
+type dimensionSchema struct {
+	dimensions map[string]bool
+	fetched    time.Time
+}
+
+// names returns the sorted dimensions, for the errors.
+func (s dimensionSchema) names() []string {
+	names := make([]string, 0, len(s.dimensions))
+	for d := range s.dimensions {
+		names = append(names, d)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// dimensionSchemas caches the dimensions of the metrics by namespace and metric name, so that the metadata
+// isn't described on every request. Only the schemas described successfully are cached.
+type dimensionSchemas struct {
+	lock    sync.Mutex
+	schemas map[string]dimensionSchema
+}
+
+func (s *dimensionSchemas) get(key string, now time.Time, ttl time.Duration) (dimensionSchema, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	schema, found := s.schemas[key]
+	if !found || now.Sub(schema.fetched) >= ttl {
+		return dimensionSchema{}, false
+	}
+	return schema, true
+}
+
+func (s *dimensionSchemas) set(key string, schema dimensionSchema) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.schemas == nil {
+		s.schemas = make(map[string]dimensionSchema)
+	}
+	s.schemas[key] = schema
+}
+
+// mapDimensionLabels maps the labels of the selector which are neither a parameter nor translated to the
+// dimensions of the same name of the metric, if the dimensions are discovered. A label the metric has no
+// dimension of fails the request, rather than being ignored and the metric matching more series than asked.
+func (cs *CMSCustomMetricSource) mapDimensionLabels(ctx context.Context, client customMetricsClient, namespace, metricName string, params *CMSCustomMetricParams) error {
+	enabled, ttl := utils.CMSDimensionDiscovery()
+	if len(params.Labels) == 0 || !enabled {
+		return nil
+	}
+	key := namespace + "/" + metricName
+	schema, found := cs.schemas.get(key, cs.clock.Now(), ttl)
+	if !found {
+		dimensions, err := describeMetricDimensions(ctx, client, namespace, metricName)
+		if err != nil {
+			return err
+		}
+		schema = dimensionSchema{dimensions: dimensions, fetched: cs.clock.Now()}
+		cs.schemas.set(key, schema)
+		log.V(4).Infof("Discovered the dimensions %v of cms metric %s of namespace %s", schema.names(), metricName, namespace)
+	}
+
+	labels := make([]string, 0, len(params.Labels))
+	for label := range params.Labels {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		if !schema.dimensions[label] {
+			return apierrors.NewBadRequest(fmt.Sprintf("label %s of the selector is no dimension of metric %s of namespace %s, its dimensions are %v",
+				label, metricName, namespace, schema.names()))
+		}
+		values := params.Labels[label]
+		if len(values) > 1 {
+			if err := params.setMultiValue(label, label, values, values); err != nil {
+				return apierrors.NewBadRequest(err.Error())
+			}
+			continue
+		}
+		params.Dimensions[label] = values[0]
+	}
+	return nil
+}
+
+// describeMetricDimensions returns the dimensions the metadata of the metric lists, e.g. userId and instanceId.
+func describeMetricDimensions(ctx context.Context, client customMetricsClient, namespace, metricName string) (map[string]bool, error) {
+	request := cms.CreateDescribeMetricMetaListRequest()
+	request.Scheme = "https"
+	request.Namespace = namespace
+	request.MetricName = metricName
+	if err := utils.SetRequestDeadline(ctx, request); err != nil {
+		return nil, fmt.Errorf("failed to describe metric meta list,because of %v", err)
+	}
+
+	release, err := utils.AcquireBackend(ctx, utils.CMSBackend)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.DescribeMetricMetaList(request)
+	release()
+	if err != nil {
+		return nil, err
+	}
+	if !response.Success {
+		return nil, cmsStatusError(metricName, response.Code, response.Message)
+	}
+	for _, resource := range response.Resources.Resource {
+		if resource.MetricName != metricName {
+			continue
+		}
+		dimensions := make(map[string]bool)
+		for _, d := range strings.Split(resource.Dimensions, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				dimensions[d] = true
+			}
+		}
+		return dimensions, nil
+	}
+	return nil, apierrors.NewBadRequest(fmt.Sprintf("no metadata of metric %s in namespace %s to map the labels of the selector to its dimensions", metricName, namespace))
+}
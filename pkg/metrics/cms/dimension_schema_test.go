@@ -0,0 +1,152 @@
+package cms
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/cms"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/clock"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// schemaMetricsClient describes the dimensions of the metrics from a fake schema.
+type schemaMetricsClient struct {
+	*dimensionMetricsClient
+	// dimensions of the metrics, by namespace and metric name
+	schemas map[string]string
+	// failing fails the metadata requests
+	failing bool
+	// described are the metrics whose metadata was described
+	described []string
+}
+
+func (c *schemaMetricsClient) DescribeMetricMetaList(request *cms.DescribeMetricMetaListRequest) (*cms.DescribeMetricMetaListResponse, error) {
+	c.described = append(c.described, request.Namespace+"/"+request.MetricName)
+	if c.failing {
+		return nil, fmt.Errorf("connection reset")
+	}
+	response := &cms.DescribeMetricMetaListResponse{Success: true}
+	if dimensions, found := c.schemas[request.Namespace+"/"+request.MetricName]; found {
+		response.Resources.Resource = []cms.Resource{{Namespace: request.Namespace, MetricName: request.MetricName, Dimensions: dimensions}}
+	}
+	return response, nil
+}
+
+func newSchemaMetricSource(client *schemaMetricsClient) (*CMSCustomMetricSource, *clock.FakeClock) {
+	source := newFakeCustomMetricSource(&fakeCustomMetricsClient{})
+	source.newClient = func() (customMetricsClient, error) { return client, nil }
+	fakeClock := clock.NewFakeClock(time.Now())
+	source.clock = fakeClock
+	return source, fakeClock
+}
+
+func TestCustomMetricDimensionDiscovery(t *testing.T) {
+	utils.SetCMSDimensionDiscovery(true, time.Hour)
+	defer utils.SetCMSDimensionDiscovery(false, utils.DefaultCMSDimensionSchemaTTL)
+	client := &schemaMetricsClient{
+		dimensionMetricsClient: &dimensionMetricsClient{dataPoints: map[string]string{
+			`[{"dimension":"app=web&instanceId=i-1"}]`: `[{"timestamp":1620000000000,"Average":1}]`,
+			`[{"dimension":"app=web&instanceId=i-2"}]`: `[{"timestamp":1620000000000,"Average":2}]`,
+			`[{"dimension":"app=web"}]`:                `[{"timestamp":1620000000000,"Average":3}]`,
+		}},
+		schemas: map[string]string{"acs_customMetric_1234567890/qps": "app, instanceId,userId"},
+	}
+	source, fakeClock := newSchemaMetricSource(client)
+	info := p.ExternalMetricInfo{Metric: "cms_custom_qps"}
+
+	// the labels are mapped to the dimensions of the same name, without any prefix
+	values, err := source.GetExternalMetric(context.TODO(), info, "default", customSelector(t, "app=web,instanceId in (i-1,i-2)"))
+	if err != nil {
+		t.Fatalf("Failed to get custom metric, because of %v", err)
+	}
+	if len(values) != 2 || values[0].MetricLabels["instanceId"] == "" {
+		t.Errorf("expected a value per instance labeled with the label of the selector, got %v", values)
+	}
+	if _, err := source.GetExternalMetric(context.TODO(), info, "default", customSelector(t, "app=web,instanceId=i-1")); err != nil {
+		t.Fatalf("Failed to get custom metric, because of %v", err)
+	}
+	queried := append([]string(nil), client.dimensions...)
+	sort.Strings(queried)
+	if strings.Join(queried, " ") != `[{"dimension":"app=web&instanceId=i-1"}] [{"dimension":"app=web&instanceId=i-1"}] [{"dimension":"app=web&instanceId=i-2"}]` {
+		t.Errorf("expected the labels to be queried as dimensions, got %v", client.dimensions)
+	}
+	if len(client.described) != 1 {
+		t.Errorf("expected the schema to be cached, got %v described", client.described)
+	}
+
+	// a label the metric has no dimension of fails the request
+	_, err = source.GetExternalMetric(context.TODO(), info, "default", customSelector(t, "app=web,zone=cn-hangzhou-a"))
+	if !apierrors.IsBadRequest(err) || !strings.Contains(err.Error(), "label zone of the selector is no dimension of metric qps of namespace acs_customMetric_1234567890, its dimensions are [app instanceId userId]") {
+		t.Errorf("expected an unknown label to be rejected, got %v", err)
+	}
+
+	// the schema is described again once it expired
+	fakeClock.Step(time.Hour)
+	if _, err := source.GetExternalMetric(context.TODO(), info, "default", customSelector(t, "app=web,instanceId=i-2")); err != nil {
+		t.Fatalf("Failed to get custom metric, because of %v", err)
+	}
+	if len(client.described) != 2 {
+		t.Errorf("expected an expired schema to be described again, got %v described", client.described)
+	}
+
+	// the selectors with prefixed dimensions only don't need the schema
+	if _, err := source.GetExternalMetric(context.TODO(), p.ExternalMetricInfo{Metric: "cms_custom_rt"}, "default", customSelector(t, "cms.custom.dimension.app=web")); err != nil {
+		t.Fatalf("Failed to get custom metric, because of %v", err)
+	}
+	if len(client.described) != 2 {
+		t.Errorf("expected no schema to be described without labels to map, got %v described", client.described)
+	}
+	// a metric without metadata can't map its labels
+	_, err = source.GetExternalMetric(context.TODO(), p.ExternalMetricInfo{Metric: "cms_custom_rt"}, "default", customSelector(t, "app=web"))
+	if !apierrors.IsBadRequest(err) || !strings.Contains(err.Error(), "no metadata of metric rt in namespace acs_customMetric_1234567890") {
+		t.Errorf("expected the labels of a metric without metadata to be rejected, got %v", err)
+	}
+}
+
+func TestCustomMetricDimensionDiscoveryFailure(t *testing.T) {
+	utils.SetCMSDimensionDiscovery(true, time.Hour)
+	defer utils.SetCMSDimensionDiscovery(false, utils.DefaultCMSDimensionSchemaTTL)
+	client := &schemaMetricsClient{
+		dimensionMetricsClient: &dimensionMetricsClient{dataPoints: map[string]string{
+			`[{"dimension":"app=web"}]`: `[{"timestamp":1620000000000,"Average":1}]`,
+		}},
+		schemas: map[string]string{"acs_customMetric_1234567890/qps": "app"},
+		failing: true,
+	}
+	source, _ := newSchemaMetricSource(client)
+	info := p.ExternalMetricInfo{Metric: "cms_custom_qps"}
+
+	if _, err := source.GetExternalMetric(context.TODO(), info, "default", customSelector(t, "app=web")); err == nil {
+		t.Errorf("expected the request to fail without the schema")
+	}
+	// the failure isn't cached
+	client.failing = false
+	if _, err := source.GetExternalMetric(context.TODO(), info, "default", customSelector(t, "app=web")); err != nil {
+		t.Errorf("expected the schema to be described again after a failure, got %v", err)
+	}
+	if len(client.described) != 2 {
+		t.Errorf("expected the schema to be described on each request until it succeeds, got %v described", client.described)
+	}
+}
+
+func TestCustomMetricLabelsIgnoredWithoutDimensionDiscovery(t *testing.T) {
+	client := &schemaMetricsClient{
+		dimensionMetricsClient: &dimensionMetricsClient{dataPoints: map[string]string{
+			`[{"dimension":"app=web"}]`: `[{"timestamp":1620000000000,"Average":1}]`,
+		}},
+	}
+	source, _ := newSchemaMetricSource(client)
+
+	if _, err := source.GetExternalMetric(context.TODO(), p.ExternalMetricInfo{Metric: "cms_custom_qps"}, "default", customSelector(t, "cms.custom.dimension.app=web,zone=cn-hangzhou-a")); err != nil {
+		t.Fatalf("Failed to get custom metric, because of %v", err)
+	}
+	if len(client.described) != 0 {
+		t.Errorf("expected no schema to be described, got %v", client.described)
+	}
+}
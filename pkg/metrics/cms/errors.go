@@ -0,0 +1,62 @@
+package cms
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	sdkerrors "github.com/aliyun/alibaba-cloud-sdk-go/sdk/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+const (
+	// cms error codes
+	ERROR_RESOURCE_NOT_FOUND = "ResourceNotFound"
+	ERROR_THROTTLING         = "Throttling"
+	ERROR_INVALID_PARAMETER  = "InvalidParameter"
+	ERROR_MISSING_PARAMETER  = "MissingParameter"
+)
+
+// convertCMSError translates the error returned by the cms api into a kubernetes status error,
+// so that the HPA can tell a missing metric apart from a temporary failure of cms.
+func convertCMSError(metricName string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(apierrors.APIStatus); ok {
+		return err
+	}
+	if errors.Is(err, utils.ErrNoInstances) {
+		// the manager answers according to the policy of the metric
+		return err
+	}
+	if errors.Is(err, utils.ErrNoDataPoints) {
+		// the manager bridges it with the last known values of the metric, if it has a grace period
+		return err
+	}
+	if errors.Is(err, utils.ErrNotANumber) {
+		// the provider manager reports the metric as unavailable
+		return err
+	}
+	if serverErr, ok := err.(*sdkerrors.ServerError); ok {
+		return cmsStatusError(metricName, serverErr.ErrorCode(), serverErr.Message())
+	}
+	return apierrors.NewInternalError(fmt.Errorf("failed to query metric %s from cms api,because of %v", metricName, err))
+}
+
+// cmsStatusError maps a cms error code to the kubernetes status error which suits it best.
+func cmsStatusError(metricName, code, message string) error {
+	switch {
+	case code == ERROR_RESOURCE_NOT_FOUND:
+		return apierrors.NewNotFound(external_metrics.Resource(metricName), message)
+	// throttling is reported with several suffixes, e.g. Throttling.User
+	case code == ERROR_THROTTLING || strings.HasPrefix(code, ERROR_THROTTLING+"."):
+		return apierrors.NewServiceUnavailable(fmt.Sprintf("cms api is throttling the queries of metric %s: %s", metricName, message))
+	case code == ERROR_INVALID_PARAMETER || code == ERROR_MISSING_PARAMETER:
+		return apierrors.NewBadRequest(fmt.Sprintf("invalid query of metric %s: %s", metricName, message))
+	default:
+		return apierrors.NewInternalError(fmt.Errorf("failed to query metric %s from cms api, code: %s, message: %s", metricName, code, message))
+	}
+}
@@ -0,0 +1,65 @@
+package cms
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	sdkerrors "github.com/aliyun/alibaba-cloud-sdk-go/sdk/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+func TestConvertCMSError(t *testing.T) {
+	testCases := []struct {
+		code   string
+		status int
+		check  func(error) bool
+	}{
+		{code: "ResourceNotFound", status: 404, check: apierrors.IsNotFound},
+		{code: "Throttling", status: 400, check: apierrors.IsServiceUnavailable},
+		{code: "Throttling.User", status: 400, check: apierrors.IsServiceUnavailable},
+		{code: "InvalidParameter", status: 400, check: apierrors.IsBadRequest},
+		{code: "InternalError", status: 500, check: apierrors.IsInternalError},
+	}
+
+	for _, tc := range testCases {
+		serverErr := sdkerrors.NewServerError(tc.status, `{"Code":"`+tc.code+`","Message":"something went wrong"}`, "")
+		err := convertCMSError("group.cpu.usage_rate", serverErr)
+		if !tc.check(err) {
+			t.Errorf("expected cms error code %s to be mapped, got %v", tc.code, err)
+		}
+	}
+}
+
+func TestConvertUnknownCMSErrorKeepsCode(t *testing.T) {
+	serverErr := sdkerrors.NewServerError(400, `{"Code":"SomethingNew","Message":"unexpected"}`, "")
+	err := convertCMSError("group.cpu.usage_rate", serverErr)
+	if !apierrors.IsInternalError(err) {
+		t.Fatalf("expected unknown cms error code to be an internal error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "SomethingNew") {
+		t.Errorf("expected the original cms error code to be kept in %q", err.Error())
+	}
+}
+
+func TestConvertNonCMSError(t *testing.T) {
+	if err := convertCMSError("group.cpu.usage_rate", nil); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	if err := convertCMSError("group.cpu.usage_rate", errors.New("connection refused")); !apierrors.IsInternalError(err) {
+		t.Errorf("expected other errors to be internal errors, got %v", err)
+	}
+
+	notFound := cmsStatusError("group.cpu.usage_rate", ERROR_RESOURCE_NOT_FOUND, "no such group")
+	if err := convertCMSError("group.cpu.usage_rate", notFound); err != notFound {
+		t.Errorf("expected status errors to be kept as is, got %v", err)
+	}
+
+	noInstances := fmt.Errorf("no application group for workload default/web: %w", utils.ErrNoInstances)
+	if err := convertCMSError("group.cpu.usage_rate", noInstances); err != noInstances {
+		t.Errorf("expected a selector matching no instances to be left to the policy of the metric, got %v", err)
+	}
+}
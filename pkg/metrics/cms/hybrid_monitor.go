@@ -0,0 +1,190 @@
+package cms
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/requests"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+const (
+	CMS_PRODUCT     = "Cms"
+	CMS_API_VERSION = "2019-01-01"
+	// DescribeHybridMonitorDataList isn't part of the cms client of the sdk, it's sent as a common request
+	CMS_HYBRID_MONITOR_DATA_API = "DescribeHybridMonitorDataList"
+)
+
+// hybridLabelName matches the label names a PromSQL query may match on.
+var hybridLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// hybridMonitorDataList is the response of DescribeHybridMonitorDataList. The timestamps and the
+// values are documented as strings, but be lenient about numbers.
+type hybridMonitorDataList struct {
+	Code       string             `json:"Code"`
+	Message    string             `json:"Message"`
+	TimeSeries []hybridTimeSeries `json:"TimeSeries"`
+}
+
+type hybridTimeSeries struct {
+	MetricName string `json:"MetricName"`
+	Labels     []struct {
+		K string `json:"K"`
+		V string `json:"V"`
+	} `json:"Labels"`
+	Values []struct {
+		Ts interface{} `json:"Ts"`
+		V  interface{} `json:"V"`
+	} `json:"Values"`
+}
+
+// hybridPromSQL builds the PromSQL query of the custom metric with the dimensions of the params as label
+// matchers, the several values of the multi-value dimension as a single regular expression.
+func hybridPromSQL(params *CMSCustomMetricParams, metricName string) (string, error) {
+	if params.GroupId != "" {
+		return "", fmt.Errorf("%s is not supported by the hybrid monitoring, select on dimensions instead", CMS_CUSTOM_GROUP_ID)
+	}
+	matchers := make([]string, 0, len(params.Dimensions)+1)
+	for dimension, value := range params.Dimensions {
+		if !hybridLabelName.MatchString(dimension) {
+			return "", fmt.Errorf("dimension %s is not a valid label name of the hybrid monitoring", dimension)
+		}
+		matchers = append(matchers, dimension+"="+strconv.Quote(value))
+	}
+	if multi := params.MultiValueDimension; multi != nil {
+		if !hybridLabelName.MatchString(multi.Dimension) {
+			return "", fmt.Errorf("dimension %s is not a valid label name of the hybrid monitoring", multi.Dimension)
+		}
+		values := make([]string, 0, len(multi.Values))
+		for _, value := range multi.Values {
+			values = append(values, regexp.QuoteMeta(value))
+		}
+		matchers = append(matchers, multi.Dimension+"=~"+strconv.Quote(strings.Join(values, "|")))
+	}
+	sort.Strings(matchers)
+	return metricName + "{" + strings.Join(matchers, ",") + "}", nil
+}
+
+// getHybridMetric queries the custom metric reported to the namespace of the hybrid monitoring, and returns
+// the latest value of each series, labeled with the labels of the series. The errors of the cms api are
+// returned as is, so that the caller can tell the regional failures.
+func getHybridMetric(ctx context.Context, client customMetricsClient, namespace string, params *CMSCustomMetricParams, externalMetric, metricName string) ([]external_metrics.ExternalMetricValue, error) {
+	query, err := hybridPromSQL(params, metricName)
+	if err != nil {
+		return nil, err
+	}
+	startTime, endTime := utils.AlignedTimeRange(utils.QueryTime(ctx), params.Period, 5)
+
+	request := requests.NewCommonRequest()
+	request.Method = "POST"
+	request.Scheme = "https"
+	request.Product = CMS_PRODUCT
+	request.ServiceCode = CMS_PRODUCT
+	request.Version = CMS_API_VERSION
+	request.ApiName = CMS_HYBRID_MONITOR_DATA_API
+	request.QueryParams["Namespace"] = namespace
+	request.QueryParams["PromSQL"] = query
+	request.QueryParams["Start"] = strconv.FormatInt(startTime.UnixNano()/1e6, 10)
+	request.QueryParams["End"] = strconv.FormatInt(endTime.UnixNano()/1e6, 10)
+	request.QueryParams["Period"] = strconv.Itoa(params.Period)
+	if err := utils.SetRequestDeadline(ctx, request); err != nil {
+		return nil, fmt.Errorf("failed to describe hybrid monitor data,because of %v", err)
+	}
+
+	release, err := utils.AcquireBackend(ctx, utils.CMSBackend)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.ProcessCommonRequest(request)
+	release()
+	if err != nil {
+		return nil, err
+	}
+	return parseHybridMonitorDataList(response.GetHttpContentBytes(), params, externalMetric, metricName)
+}
+
+// parseHybridMonitorDataList returns the latest value of each series of the response. The series of the
+// multi-value dimension are labeled with the value of the selector they stand for.
+func parseHybridMonitorDataList(content []byte, params *CMSCustomMetricParams, externalMetric, metricName string) ([]external_metrics.ExternalMetricValue, error) {
+	var result hybridMonitorDataList
+	if err := json.Unmarshal(content, &result); err != nil {
+		return nil, fmt.Errorf("json unmarshal hybrid monitor data exception %v", err)
+	}
+	if result.Code != "" && result.Code != "200" {
+		return nil, cmsStatusError(metricName, result.Code, result.Message)
+	}
+
+	var labelValues map[string]string
+	if multi := params.MultiValueDimension; multi != nil {
+		labelValues = make(map[string]string, len(multi.Values))
+		for i, value := range multi.Values {
+			labelValues[value] = multi.LabelValues[i]
+		}
+	}
+
+	values := make([]external_metrics.ExternalMetricValue, 0, len(result.TimeSeries))
+	for _, series := range result.TimeSeries {
+		var latest, latestTimestamp float64
+		found := false
+		for _, point := range series.Values {
+			timestamp, err := hybridNumber(point.Ts)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestamp of hybrid monitor data: %v", err)
+			}
+			value, err := hybridNumber(point.V)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value of hybrid monitor data: %v", err)
+			}
+			if !found || timestamp >= latestTimestamp {
+				latest, latestTimestamp, found = value, timestamp, true
+			}
+		}
+		if !found {
+			continue
+		}
+		if math.IsNaN(latest) {
+			return nil, fmt.Errorf("latest hybrid monitor data of series %v: %w", series.Labels, utils.ErrNotANumber)
+		}
+
+		metricLabels := make(map[string]string, len(series.Labels))
+		for _, l := range series.Labels {
+			metricLabels[l.K] = l.V
+		}
+		if multi := params.MultiValueDimension; multi != nil {
+			if labelValue, found := labelValues[metricLabels[multi.Dimension]]; found {
+				metricLabels[multi.Label] = labelValue
+			}
+		}
+		values = append(values, external_metrics.ExternalMetricValue{
+			MetricName:   externalMetric,
+			MetricLabels: metricLabels,
+			Timestamp:    utils.DataPointTime(int64(latestTimestamp), time.Now()),
+			Value:        *resource.NewMilliQuantity(int64(latest*1000), resource.DecimalSI),
+		})
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("hybrid monitor data: %w", utils.ErrNoDataPoints)
+	}
+	return values, nil
+}
+
+// hybridNumber parses a timestamp or a value of the hybrid monitoring, a string or a number.
+func hybridNumber(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case string:
+		return strconv.ParseFloat(n, 64)
+	default:
+		return 0, fmt.Errorf("unexpected %v", v)
+	}
+}
@@ -0,0 +1,119 @@
+package cms
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// hybridSettings query cms_custom_node_load with the hybrid monitoring.
+var hybridSettings = metricSettings("cms_custom_node_load", utils.MetricSettings{HybridNamespace: "k8s-nodes"})
+
+func TestGetHybridMetric(t *testing.T) {
+	client := &fakeCustomMetricsClient{
+		hybridMonitorData: `{"RequestId":"6A5F022D","Code":"200","Success":"true","TimeSeries":[
+			{"MetricName":"node_load","Labels":[{"K":"instanceId","V":"i-a"}],"Values":[{"Ts":"1620000000000","V":"1.5"},{"Ts":"1620000060000","V":"2.5"}]},
+			{"MetricName":"node_load","Labels":[{"K":"instanceId","V":"i-b"}],"Values":[{"Ts":1620000060000,"V":4}]}]}`,
+	}
+	source := newFakeCustomMetricSource(client)
+	source.SetMetricSettings(hybridSettings)
+	source.ownerAccountId = func() (string, error) {
+		t.Errorf("expected the hybrid monitoring not to need the account id")
+		return "", nil
+	}
+
+	info := p.ExternalMetricInfo{Metric: "cms_custom_node_load"}
+	values, err := source.GetExternalMetric(context.TODO(), info, "default", customSelector(t, "cms.custom.dimension.instanceId in (i-a,i-b),cms.custom.period=300"))
+	if err != nil {
+		t.Fatalf("Failed to get hybrid metric, because of %v", err)
+	}
+	if len(values) != 2 || values[0].Value.MilliValue() != 2500 || values[1].Value.MilliValue() != 4000 {
+		t.Fatalf("expected the latest value of each series, got %v", values)
+	}
+	if values[0].MetricName != "cms_custom_node_load" || values[1].MetricLabels["cms.custom.dimension.instanceId"] != "i-b" {
+		t.Errorf("expected the values to be labeled with the values of the selector, got %v", values)
+	}
+
+	if len(client.commonRequests) != 1 || len(client.dataPointRequests) != 0 {
+		t.Fatalf("expected a single hybrid monitoring request, got %d and %d legacy ones", len(client.commonRequests), len(client.dataPointRequests))
+	}
+	request := client.commonRequests[0]
+	if request.ApiName != "DescribeHybridMonitorDataList" || request.Version != "2019-01-01" || request.Product != "Cms" {
+		t.Errorf("unexpected api %s %s of product %s", request.ApiName, request.Version, request.Product)
+	}
+	expected := map[string]string{
+		"Namespace": "k8s-nodes",
+		"PromSQL":   `node_load{instanceId=~"i-a|i-b"}`,
+		"Period":    "300",
+	}
+	for param, value := range expected {
+		if request.QueryParams[param] != value {
+			t.Errorf("expected %s %q, got %q", param, value, request.QueryParams[param])
+		}
+	}
+	start, _ := strconv.ParseInt(request.QueryParams["Start"], 10, 64)
+	end, _ := strconv.ParseInt(request.QueryParams["End"], 10, 64)
+	if end-start != 5*300*1000 {
+		t.Errorf("expected the last 5 periods in milliseconds, got %s to %s", request.QueryParams["Start"], request.QueryParams["End"])
+	}
+}
+
+func TestGetHybridMetricErrors(t *testing.T) {
+	info := p.ExternalMetricInfo{Metric: "cms_custom_node_load"}
+
+	for _, c := range []struct {
+		name     string
+		selector string
+		data     string
+		check    func(error) bool
+	}{
+		{
+			name:     "no data",
+			selector: "cms.custom.dimension.instanceId=i-a",
+			data:     `{"Code":"200","TimeSeries":[{"MetricName":"node_load","Values":[]}]}`,
+			check:    func(err error) bool { return errors.Is(err, utils.ErrNoDataPoints) },
+		},
+		{
+			name:     "throttled",
+			selector: "cms.custom.dimension.instanceId=i-a",
+			data:     `{"Code":"Throttling.User","Message":"Request was denied due to user flow control."}`,
+			check:    apierrors.IsServiceUnavailable,
+		},
+		{
+			name:     "group",
+			selector: "cms.custom.group.id=7378",
+			check:    func(err error) bool { return err != nil },
+		},
+		{
+			name:     "invalid label name",
+			selector: "cms.custom.dimension.instance.id=i-a",
+			check:    func(err error) bool { return err != nil },
+		},
+	} {
+		client := &fakeCustomMetricsClient{hybridMonitorData: c.data}
+		source := newFakeCustomMetricSource(client)
+		source.SetMetricSettings(hybridSettings)
+		_, err := source.GetExternalMetric(context.TODO(), info, "default", customSelector(t, c.selector))
+		if !c.check(err) {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+		}
+	}
+}
+
+func TestHybridMetricsAreListed(t *testing.T) {
+	source := newFakeCustomMetricSource(&fakeCustomMetricsClient{})
+	source.SetMetricSettings(hybridSettings)
+	source.metrics = []p.ExternalMetricInfo{{Metric: "cms_custom_qps"}}
+	// the discovery isn't due
+	source.discoveredAt = source.clock.Now()
+
+	metrics := source.GetExternalMetricInfoList()
+	if len(metrics) != 2 || metrics[0].Metric != "cms_custom_node_load" || metrics[1].Metric != "cms_custom_qps" {
+		t.Errorf("expected the configured hybrid metric to be listed with the discovered ones, got %v", metrics)
+	}
+}
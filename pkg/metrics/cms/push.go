@@ -0,0 +1,209 @@
+package cms
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/audit"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/cms"
+	"github.com/prometheus/client_golang/prometheus"
+	log "k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+const (
+	// DefaultPushNamespace prefixes the names of the pushed metrics, so they don't mix with the other custom metrics of the group.
+	DefaultPushNamespace = "adapter"
+	// DefaultPushBufferSize is the number of values which may wait to be pushed.
+	DefaultPushBufferSize = 10000
+
+	// cmsPushBatchSize is the maximum number of values PutCustomMetric accepts at once
+	cmsPushBatchSize     = 100
+	cmsPushFlushInterval = 15 * time.Second
+)
+
+// pushDropped counts the values which weren't pushed to CMS because the buffer was full.
+var pushDropped = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "adapter_cms_push_dropped_total",
+		Help: "Number of resolved metric values dropped instead of being pushed to CMS custom monitoring because the buffer was full.",
+	},
+)
+
+// pushClient is the part of the cms client used to push the custom metrics.
+type pushClient interface {
+	PutCustomMetric(request *cms.PutCustomMetricRequest) (*cms.PutCustomMetricResponse, error)
+}
+
+// CMSPusher pushes the metric values resolved by the adapter to CMS custom monitoring in the
+// background, so that they are visible in the CMS console. Pushing never blocks the caller,
+// the values are dropped when the buffer is full.
+type CMSPusher struct {
+	newClient func() (pushClient, error)
+	groupId   string
+	namespace string
+	batcher   *audit.Batcher
+}
+
+// NewCMSPusher creates a pusher to the application group which buffers up to bufferSize values.
+// The names of the pushed metrics are prefixed with the namespace.
+func NewCMSPusher(groupId, namespace string, bufferSize int) *CMSPusher {
+	cs := &CMSMetricSource{}
+	return newCMSPusher(func() (pushClient, error) {
+		return cs.Client()
+	}, groupId, namespace, bufferSize)
+}
+
+func newCMSPusher(newClient func() (pushClient, error), groupId, namespace string, bufferSize int) *CMSPusher {
+	utils.RegisterMetrics(pushDropped)
+	if bufferSize <= 0 {
+		bufferSize = DefaultPushBufferSize
+	}
+	cp := &CMSPusher{
+		newClient: newClient,
+		groupId:   groupId,
+		namespace: namespace,
+	}
+	cp.batcher = audit.NewBatcher(audit.BatcherConfig{
+		Items:         "metric values",
+		Buffer:        "cms push",
+		BufferSize:    bufferSize,
+		BatchSize:     cmsPushBatchSize,
+		FlushInterval: cmsPushFlushInterval,
+		OnDrop:        pushDropped.Inc,
+	}, cp.push)
+	return cp
+}
+
+// Push queues the samples. It's a no-op on a nil pusher.
+func (cp *CMSPusher) Push(samples ...audit.Sample) {
+	if cp == nil {
+		return
+	}
+	for _, s := range samples {
+		cp.batcher.Add(s)
+	}
+}
+
+// PushExternalMetrics queues the values of an external metric returned for the namespace.
+func (cp *CMSPusher) PushExternalMetrics(namespace string, values *external_metrics.ExternalMetricValueList) {
+	if cp == nil {
+		return
+	}
+	cp.Push(audit.ExternalSamples(namespace, values)...)
+}
+
+// PushCustomMetrics queues the values of a custom metric.
+func (cp *CMSPusher) PushCustomMetrics(values ...custom_metrics.MetricValue) {
+	if cp == nil {
+		return
+	}
+	cp.Push(audit.CustomSamples(values...)...)
+}
+
+// Dropped returns how many values have been dropped because the buffer was full.
+func (cp *CMSPusher) Dropped() uint64 {
+	return cp.batcher.Dropped()
+}
+
+// RunUntil pushes the queued values in batches until stopCh is closed.
+func (cp *CMSPusher) RunUntil(stopCh <-chan struct{}) {
+	cp.batcher.RunUntil(stopCh)
+}
+
+// push pushes a batch of values.
+func (cp *CMSPusher) push(batch []interface{}) {
+	samples := make([]audit.Sample, 0, len(batch))
+	for _, s := range batch {
+		samples = append(samples, s.(audit.Sample))
+	}
+	if err := cp.send(samples); err != nil {
+		// the console is best effort, the values are not retried
+		log.Warningf("Failed to push %d metric values to cms group %s, because of %v", len(samples), cp.groupId, err)
+	}
+}
+
+func (cp *CMSPusher) send(samples []audit.Sample) error {
+	metrics := make([]cms.PutCustomMetricMetricList, 0, len(samples))
+	for _, s := range samples {
+		metric, err := cp.customMetric(s)
+		if err != nil {
+			log.Warningf("Failed to encode metric value %s for cms, because of %v", s.Name, err)
+			continue
+		}
+		metrics = append(metrics, metric)
+	}
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	client, err := cp.newClient()
+	if err != nil {
+		return err
+	}
+
+	// the pushes share the concurrency limit and the deadline of the queries of cms
+	ctx, cancel := utils.WithBackendTimeout(context.Background(), utils.CMSBackend)
+	defer cancel()
+	request := cms.CreatePutCustomMetricRequest()
+	request.MetricList = &metrics
+	if err := utils.SetRequestDeadline(ctx, request); err != nil {
+		return err
+	}
+	release, err := utils.AcquireBackend(ctx, utils.CMSBackend)
+	if err != nil {
+		return err
+	}
+	response, err := client.PutCustomMetric(request)
+	release()
+	if err != nil {
+		return err
+	}
+	if response.Code != "" && response.Code != "200" {
+		return fmt.Errorf("code %s: %s", response.Code, response.Message)
+	}
+	return nil
+}
+
+// customMetric renders a sample as a raw custom metric value, whose dimensions are its labels
+// and the cluster of the adapter.
+func (cp *CMSPusher) customMetric(s audit.Sample) (cms.PutCustomMetricMetricList, error) {
+	dimensions := make(map[string]string, len(s.Labels)+1)
+	for k, v := range s.Labels {
+		dimensions[k] = v
+	}
+	if clusterId := utils.ClusterID(); clusterId != "" {
+		dimensions[utils.ClusterDimension] = clusterId
+	}
+	encodedDimensions, err := json.Marshal(dimensions)
+	if err != nil {
+		return cms.PutCustomMetricMetricList{}, err
+	}
+	values, err := json.Marshal(map[string]float64{"value": s.Value})
+	if err != nil {
+		return cms.PutCustomMetricMetricList{}, err
+	}
+
+	name := s.Name
+	if cp.namespace != "" {
+		name = cp.namespace + "_" + name
+	}
+	timestamp := s.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	return cms.PutCustomMetricMetricList{
+		GroupId:    cp.groupId,
+		MetricName: name,
+		Dimensions: string(encodedDimensions),
+		Values:     string(values),
+		Time:       strconv.FormatInt(timestamp.UnixNano()/int64(time.Millisecond), 10),
+		// raw values, which cms aggregates itself
+		Type: "0",
+	}, nil
+}
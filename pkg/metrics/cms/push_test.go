@@ -0,0 +1,180 @@
+package cms
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/audit"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/cms"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// fakePushClient records the custom metrics pushed to it.
+type fakePushClient struct {
+	err error
+
+	lock     sync.Mutex
+	requests []*cms.PutCustomMetricRequest
+}
+
+func (c *fakePushClient) PutCustomMetric(request *cms.PutCustomMetricRequest) (*cms.PutCustomMetricResponse, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.requests = append(c.requests, request)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &cms.PutCustomMetricResponse{Code: "200"}, nil
+}
+
+func newFakeCMSPusher(client *fakePushClient, bufferSize int) *CMSPusher {
+	return newCMSPusher(func() (pushClient, error) {
+		return client, nil
+	}, "7378", "adapter", bufferSize)
+}
+
+// drain pushes the queued values the way the pusher does when it's stopped.
+func drain(pusher *CMSPusher) {
+	pusher.batcher.Flush()
+}
+
+func TestCMSPusherPushesExternalMetrics(t *testing.T) {
+	utils.SetClusterID("c7689a1dcf77c42a3b26114f851fa8fef")
+	defer utils.SetClusterID("")
+
+	client := &fakePushClient{}
+	pusher := newFakeCMSPusher(client, 10)
+	at := time.Unix(1620000000, 0)
+	pusher.PushExternalMetrics("default", &external_metrics.ExternalMetricValueList{
+		Items: []external_metrics.ExternalMetricValue{{
+			MetricName:   "k8s_workload_cpu_util",
+			MetricLabels: map[string]string{"k8s.workload.name": "web"},
+			Timestamp:    metav1.NewTime(at),
+			Value:        *resource.NewMilliQuantity(1500, resource.DecimalSI),
+		}},
+	})
+	drain(pusher)
+
+	if len(client.requests) != 1 || len(*client.requests[0].MetricList) != 1 {
+		t.Fatalf("expected a single pushed value, got %d requests", len(client.requests))
+	}
+	metric := (*client.requests[0].MetricList)[0]
+	if metric.GroupId != "7378" || metric.MetricName != "adapter_k8s_workload_cpu_util" || metric.Time != "1620000000000" || metric.Type != "0" {
+		t.Errorf("unexpected metric %+v", metric)
+	}
+	var dimensions map[string]string
+	if err := json.Unmarshal([]byte(metric.Dimensions), &dimensions); err != nil {
+		t.Fatalf("Failed to decode dimensions, because of %v", err)
+	}
+	if dimensions["k8s.workload.name"] != "web" || dimensions["namespace"] != "default" || dimensions[utils.ClusterDimension] != "c7689a1dcf77c42a3b26114f851fa8fef" {
+		t.Errorf("unexpected dimensions %v", dimensions)
+	}
+	if metric.Values != `{"value":1.5}` {
+		t.Errorf("unexpected values %s", metric.Values)
+	}
+}
+
+func TestCMSPusherBatches(t *testing.T) {
+	client := &fakePushClient{}
+	pusher := newFakeCMSPusher(client, 1000)
+	for i := 0; i < cmsPushBatchSize+1; i++ {
+		pusher.Push(audit.Sample{Name: "qps", Value: float64(i)})
+	}
+	drain(pusher)
+
+	if len(client.requests) != 2 || len(*client.requests[0].MetricList) != cmsPushBatchSize || len(*client.requests[1].MetricList) != 1 {
+		t.Errorf("expected a full batch and a single value, got %d requests", len(client.requests))
+	}
+}
+
+func TestCMSPusherDropsOnBackpressure(t *testing.T) {
+	client := &fakePushClient{err: errors.New("throttled")}
+	pusher := newFakeCMSPusher(client, 2)
+	before := testutil.ToFloat64(pushDropped)
+
+	// nothing is pushed meanwhile, so the buffer fills up
+	for i := 0; i < 5; i++ {
+		pusher.Push(audit.Sample{Name: "qps", Value: float64(i)})
+	}
+	if pusher.Dropped() != 3 {
+		t.Errorf("expected 3 dropped values, got %d", pusher.Dropped())
+	}
+	if dropped := testutil.ToFloat64(pushDropped) - before; dropped != 3 {
+		t.Errorf("expected the dropped values to be counted, got %v", dropped)
+	}
+
+	// a failed push isn't retried
+	drain(pusher)
+	if len(client.requests) != 1 || len(*client.requests[0].MetricList) != 2 {
+		t.Errorf("expected the buffered values to be pushed once, got %d requests", len(client.requests))
+	}
+}
+
+func TestCMSPusherSkipsEmptyBatches(t *testing.T) {
+	client := &fakePushClient{}
+	pusher := newFakeCMSPusher(client, 10)
+
+	// a NaN can't be encoded, so nothing is left to push
+	pusher.Push(audit.Sample{Name: "qps", Value: math.NaN()})
+	drain(pusher)
+	if len(client.requests) != 0 {
+		t.Errorf("expected no push without values, got %d requests", len(client.requests))
+	}
+}
+
+func TestCMSPusherConcurrencyLimit(t *testing.T) {
+	utils.SetBackendConcurrency(utils.CMSBackend, 1)
+	defer utils.SetBackendConcurrency(utils.CMSBackend, utils.DefaultBackendConcurrency[utils.CMSBackend])
+
+	release, err := utils.AcquireBackend(context.TODO(), utils.CMSBackend)
+	if err != nil {
+		t.Fatalf("Failed to acquire the cms slot, because of %v", err)
+	}
+	client := &fakePushClient{}
+	pusher := newFakeCMSPusher(client, 10)
+	pusher.Push(audit.Sample{Name: "qps", Value: 1})
+	done := make(chan struct{})
+	go func() {
+		drain(pusher)
+		close(done)
+	}()
+
+	// the push waits for the query holding the only slot of cms
+	select {
+	case <-done:
+		t.Fatalf("expected the push to wait for a cms slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	<-done
+
+	if len(client.requests) != 1 {
+		t.Fatalf("expected a single push, got %d requests", len(client.requests))
+	}
+	if timeout := client.requests[0].GetReadTimeout(); timeout <= 0 || timeout > utils.BackendTimeout(utils.CMSBackend) {
+		t.Errorf("expected the push to be bounded by the cms timeout, got %v", timeout)
+	}
+}
+
+func TestNewCMSPusherTwice(t *testing.T) {
+	// each pusher registers the counter of the dropped values, once
+	for i := 0; i < 2; i++ {
+		NewCMSPusher("7378", DefaultPushNamespace, DefaultPushBufferSize)
+	}
+}
+
+func TestNilCMSPusher(t *testing.T) {
+	var pusher *CMSPusher
+	pusher.Push(audit.Sample{Name: "qps"})
+	pusher.PushExternalMetrics("default", &external_metrics.ExternalMetricValueList{})
+	pusher.PushCustomMetrics()
+}
@@ -1,6 +1,7 @@
 package cms
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,7 +14,6 @@ import (
 	"github.com/aliyun/alibaba-cloud-sdk-go/services/cms"
 	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
 	"k8s.io/apimachinery/pkg/api/resource"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	log "k8s.io/klog/v2"
 	"k8s.io/metrics/pkg/apis/external_metrics"
@@ -32,6 +32,8 @@ const (
 	K8S_PERIOD        = "k8s.period"
 	//
 	MIN_PERIOD = 60
+	// the workload metrics read the sum of the statistics unless configured otherwise
+	K8S_WORKLOAD_DEFAULT_STATISTIC = "Sum"
 )
 
 type DataPoint struct {
@@ -45,8 +47,26 @@ type DataPoint struct {
 	Minimum   float64 `json:"minimum"`
 }
 
+// statistic returns the given statistic of the data point, one of utils.CMSStatistics or the Sum.
+func (point DataPoint) statistic(name string) float64 {
+	switch name {
+	case utils.CMSStatisticAverage:
+		return point.Average
+	case utils.CMSStatisticMaximum:
+		return point.Maximum
+	case utils.CMSStatisticMinimum:
+		return point.Minimum
+	case utils.CMSStatisticValue:
+		return point.Value
+	default:
+		return point.Sum
+	}
+}
+
 type CMSMetricParams struct {
 	CMSGlobalParams
+	// Region is the region CMS is queried in, the one of the adapter if empty
+	Region       string
 	Namespace    string
 	ClusterId    string
 	WorkloadType string
@@ -57,42 +77,69 @@ type CMSGlobalParams struct {
 	Period int
 }
 
-// get cms workload metrics
-func (cs *CMSMetricSource) getCMSWorkLoadMetrics(namespace string, requires labels.Requirements, info p.ExternalMetricInfo) (values []external_metrics.ExternalMetricValue, err error) {
+// get the statistic of the cms workload metrics, with the settings of the external metric
+func (cs *CMSMetricSource) getCMSWorkLoadMetrics(ctx context.Context, namespace string, requires labels.Requirements, settings utils.MetricSettings, info p.ExternalMetricInfo) (values []external_metrics.ExternalMetricValue, err error) {
 	log.V(4).Infof("Request to getCMSWorkLoadMetrics namespace: %s,requires: %s, metric: %s\n", namespace, requires, info.Metric)
 
-	params, err := getCMSParams(namespace, requires)
+	params, err := getCMSParams(namespace, requires, settings.CMSPeriod())
 
 	if err != nil {
 		return values, fmt.Errorf("Failed to get CMS params, because of %v", err)
 	}
 
-	// get cluster id from group
-	groupId, err := cs.getGroupIdByName(params)
+	fallback := settings.FallbackRegion
+	// a slow query of a metric with a hedge delay is sent to its fallback region too, the first answer wins
+	result, hedged, err := utils.Hedge(ctx, info.Metric, settings.HedgeDelay, func(ctx context.Context) (interface{}, error) {
+		return cs.getWorkloadDataPoints(ctx, params, info.Metric)
+	}, func(ctx context.Context) (interface{}, error) {
+		fallbackParams := *params
+		fallbackParams.Region = fallback
+		return cs.getWorkloadDataPoints(ctx, &fallbackParams, info.Metric)
+	})
+	dataPoints, _ := result.([]DataPoint)
+	if fallback != "" && !hedged && utils.IsRegionalFailure(ctx, err) {
+		log.Warningf("CMS failed to serve metric %s, querying its fallback region %s: %v", info.Metric, fallback, err)
+		params.Region = fallback
+		dataPoints, err = cs.getWorkloadDataPoints(ctx, params, info.Metric)
+	}
+	if err != nil {
+		return values, convertCMSError(info.Metric, err)
+	}
 
-	if err != nil || groupId <= 0 {
-		return values, err
+	if len(dataPoints) == 0 {
+		return values, fmt.Errorf("workload %s/%s: %w", params.Namespace, params.WorkloadName, utils.ErrNoDataPoints)
 	}
+	latest := dataPoints[len(dataPoints)-1]
+	values = append(values, external_metrics.ExternalMetricValue{
+		MetricName: info.Metric,
+		Timestamp:  utils.DataPointTime(latest.Timestamp, time.Now()),
+		Value:      *resource.NewQuantity(int64(latest.statistic(settings.CMSStatistic(K8S_WORKLOAD_DEFAULT_STATISTIC))), resource.DecimalSI),
+	})
+	utils.SetWindowLabel(values, params.Period)
+	return values, nil
+}
 
-	dataPoints, err := cs.getMetricListByGroupId(params, groupId, info.Metric)
+// getWorkloadDataPoints reads the data points of the application group of the workload. The errors
+// of the cms api are returned as is, so that the caller can tell the regional failures.
+func (cs *CMSMetricSource) getWorkloadDataPoints(ctx context.Context, params *CMSMetricParams, metricName string) ([]DataPoint, error) {
+	// get cluster id from group
+	groupId, err := cs.getGroupIdByName(ctx, params)
 	if err != nil {
-		return values, err
+		return nil, err
 	}
-
-	if len(dataPoints) > 0 {
-		values = append(values, external_metrics.ExternalMetricValue{
-			MetricName: info.Metric,
-			Timestamp:  metav1.Now(),
-			Value:      *resource.NewQuantity(int64(dataPoints[len(dataPoints)-1].Sum), resource.DecimalSI),
-		})
+	if groupId <= 0 {
+		return nil, fmt.Errorf("no application group for workload %s/%s: %w", params.Namespace, params.WorkloadName, utils.ErrNoInstances)
 	}
-	return values, err
+	return cs.getMetricListByGroupId(ctx, params, groupId, metricName)
 }
 
-func getCMSParams(namespace string, requirements labels.Requirements) (params *CMSMetricParams, err error) {
+// getCMSParams parses the selector of a request, period is used unless the selector sets one.
+func getCMSParams(namespace string, requirements labels.Requirements, period int) (params *CMSMetricParams, err error) {
 	params = &CMSMetricParams{
-		Namespace:    namespace,
-		WorkloadType: K8S_DEFAULT_WORKLOAD_TYPE,
+		CMSGlobalParams: CMSGlobalParams{Period: period},
+		Namespace:       utils.NamespaceOrDefault(namespace),
+		ClusterId:       utils.ClusterID(),
+		WorkloadType:    K8S_DEFAULT_WORKLOAD_TYPE,
 	}
 	for _, r := range requirements {
 
@@ -133,7 +180,7 @@ func getCMSParams(namespace string, requirements labels.Requirements) (params *C
 }
 
 // get group id from meta
-func (cs *CMSMetricSource) getGroupIdByName(params *CMSMetricParams) (groupId int64, err error) {
+func (cs *CMSMetricSource) getGroupIdByName(ctx context.Context, params *CMSMetricParams) (groupId int64, err error) {
 
 	//generate cms GroupName
 	groupName := fmt.Sprintf("k8s-%s-%s-%s-%s", params.ClusterId, params.Namespace, params.WorkloadType, params.WorkloadName)
@@ -143,17 +190,26 @@ func (cs *CMSMetricSource) getGroupIdByName(params *CMSMetricParams) (groupId in
 	request.PageSize = requests.NewInteger(1)
 	request.GroupName = groupName
 	request.SelectContactGroups = requests.NewBoolean(false)
+	if err := utils.SetRequestDeadline(ctx, request); err != nil {
+		return 0, fmt.Errorf("failed to query workload from cms api,because of %v", err)
+	}
 
-	client, err := cs.Client()
+	client, err := cs.workloadClient(params.Region)
 
 	if err != nil {
 		return 0, fmt.Errorf("failed to create cms client,because of %v", err)
 	}
 
+	release, err := utils.AcquireBackend(ctx, utils.CMSBackend)
+	if err != nil {
+		return 0, err
+	}
 	response, err := client.DescribeMonitorGroups(request)
+	release()
 
 	if err != nil {
-		return 0, fmt.Errorf("failed to query workload from cms api,because of %v", err)
+		// keep the error of the cms api as is, so that its code can be mapped
+		return 0, err
 	}
 
 	if response.Success && response.Total == 1 {
@@ -164,7 +220,7 @@ func (cs *CMSMetricSource) getGroupIdByName(params *CMSMetricParams) (groupId in
 	return 0, err
 }
 
-func (cs *CMSMetricSource) getMetricListByGroupId(params *CMSMetricParams, groupId int64, metricName string) (values []DataPoint, err error) {
+func (cs *CMSMetricSource) getMetricListByGroupId(ctx context.Context, params *CMSMetricParams, groupId int64, metricName string) (values []DataPoint, err error) {
 	request := cms.CreateDescribeMetricListRequest()
 	request.Scheme = "https"
 
@@ -176,21 +232,29 @@ func (cs *CMSMetricSource) getMetricListByGroupId(params *CMSMetricParams, group
 	dimensions := fmt.Sprintf("[{\"groupId\":\"%d\"}]", groupId)
 	request.Dimensions = dimensions
 
-	// time range
-	startTime := time.Now().Add(-5 * time.Duration(params.Period) * time.Second).Format(utils.DEFAULT_TIME_FORMAT)
-	endTime := time.Now().Format(utils.DEFAULT_TIME_FORMAT)
+	// time range of complete periods
+	startTime, endTime := utils.AlignedTimeRange(utils.QueryTime(ctx), params.Period, 5)
 
-	request.StartTime = startTime
-	request.EndTime = endTime
+	request.StartTime = startTime.Format(utils.DEFAULT_TIME_FORMAT)
+	request.EndTime = endTime.Format(utils.DEFAULT_TIME_FORMAT)
+	if err = utils.SetRequestDeadline(ctx, request); err != nil {
+		log.Errorf("Failed to describe metric list,because of %v", err)
+		return
+	}
 
-	client, err := cs.Client()
+	client, err := cs.workloadClient(params.Region)
 
 	if err != nil {
 		log.Errorf("Failed to create cms client,because of %v", err)
 		return
 	}
 
+	release, err := utils.AcquireBackend(ctx, utils.CMSBackend)
+	if err != nil {
+		return
+	}
 	response, err := client.DescribeMetricList(request)
+	release()
 
 	if err != nil {
 		log.Errorf("Failed to describe metric list,because of %v", err)
@@ -198,9 +262,6 @@ func (cs *CMSMetricSource) getMetricListByGroupId(params *CMSMetricParams, group
 	}
 	if response.Success {
 		dataPoint := response.Datapoints
-		if dataPoint == "[]" {
-			return values, fmt.Errorf("datapoint is empty %v", err)
-		}
 
 		var res []DataPoint
 
@@ -210,21 +271,41 @@ func (cs *CMSMetricSource) getMetricListByGroupId(params *CMSMetricParams, group
 		}
 		return res, nil
 	}
-	return values, err
+	return values, cmsStatusError(metricName, response.Code, response.Message)
+}
+
+// workloadClient creates the client of the workload metrics in the region, the one of the adapter if empty.
+func (cs *CMSMetricSource) workloadClient(region string) (workloadMetricsClient, error) {
+	if cs.newRegionalClient != nil {
+		return cs.newRegionalClient(region)
+	}
+	return cs.RegionalClient(region)
 }
 
 func (cs *CMSMetricSource) Client() (client *cms.Client, err error) {
+	return cs.RegionalClient("")
+}
+
+// RegionalClient creates a client of CMS in the region, the one of the adapter if empty.
+func (cs *CMSMetricSource) RegionalClient(region string) (client *cms.Client, err error) {
 	accessUserInfo, err := utils.GetAccessUserInfo()
 	if err != nil {
 		log.Errorf("Failed to create cms client,because of %v", err)
 		return nil, err
 	}
+	if region == "" {
+		region = accessUserInfo.Region
+	}
 
 	if strings.HasPrefix(accessUserInfo.AccessKeyId, "STS.") {
-		client, err = cms.NewClientWithStsToken(accessUserInfo.Region, accessUserInfo.AccessKeyId, accessUserInfo.AccessKeySecret, accessUserInfo.Token)
+		client, err = cms.NewClientWithStsToken(region, accessUserInfo.AccessKeyId, accessUserInfo.AccessKeySecret, accessUserInfo.Token)
 	} else {
-		client, err = cms.NewClientWithAccessKey(accessUserInfo.Region, accessUserInfo.AccessKeyId, accessUserInfo.AccessKeySecret)
+		client, err = cms.NewClientWithAccessKey(region, accessUserInfo.AccessKeyId, accessUserInfo.AccessKeySecret)
 
 	}
+	if err == nil {
+		utils.ApplySDKTransport(client)
+		utils.ApplyEndpointOverride(&client.Client, utils.CMSBackend, region)
+	}
 	return client, err
 }
@@ -0,0 +1,126 @@
+package cms
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	sdkerrors "github.com/aliyun/alibaba-cloud-sdk-go/sdk/errors"
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/cms"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// fakeWorkloadMetricsClient answers the workload metric requests of a region.
+type fakeWorkloadMetricsClient struct {
+	// err fails the requests if set
+	err error
+	// delay is how long the requests take
+	delay time.Duration
+	// value is the sum of the data point
+	value float64
+
+	lock              sync.Mutex
+	dataPointRequests []*cms.DescribeMetricListRequest
+}
+
+func (c *fakeWorkloadMetricsClient) DescribeMonitorGroups(request *cms.DescribeMonitorGroupsRequest) (*cms.DescribeMonitorGroupsResponse, error) {
+	time.Sleep(c.delay)
+	if c.err != nil {
+		return nil, c.err
+	}
+	response := &cms.DescribeMonitorGroupsResponse{Success: true, Total: 1}
+	response.Resources.Resource = []cms.ResourceInDescribeMonitorGroups{{GroupId: 7378}}
+	return response, nil
+}
+
+func (c *fakeWorkloadMetricsClient) DescribeMetricList(request *cms.DescribeMetricListRequest) (*cms.DescribeMetricListResponse, error) {
+	c.lock.Lock()
+	c.dataPointRequests = append(c.dataPointRequests, request)
+	c.lock.Unlock()
+	return &cms.DescribeMetricListResponse{Success: true, Datapoints: fmt.Sprintf(`[{"timestamp":1620000000000,"Sum":%v}]`, c.value)}, nil
+}
+
+// newFakeWorkloadMetricSource queries the fake clients by region, the one of the adapter being "".
+func newFakeWorkloadMetricSource(clients map[string]*fakeWorkloadMetricsClient, settings utils.MetricSettings) *CMSMetricSource {
+	source := &CMSMetricSource{
+		newRegionalClient: func(region string) (workloadMetricsClient, error) {
+			return clients[region], nil
+		},
+	}
+	source.SetMetricSettings(metricSettings(K8S_WORKLOAD_CPUUTIL, settings))
+	return source
+}
+
+func TestWorkloadMetricSettings(t *testing.T) {
+	selector := "k8s.cluster.id=c1234,k8s.workload.name=web"
+
+	for _, c := range []struct {
+		name     string
+		settings utils.MetricSettings
+		primary  *fakeWorkloadMetricsClient
+		fallback *fakeWorkloadMetricsClient
+		// period is the period of the time range of the data point request
+		period time.Duration
+		// value is the value of the region expected to answer
+		value int64
+	}{
+		{
+			name:     "period",
+			settings: utils.MetricSettings{Period: 300},
+			primary:  &fakeWorkloadMetricsClient{value: 3},
+			period:   300 * time.Second,
+			value:    3,
+		},
+		{
+			name:     "fallback region",
+			settings: utils.MetricSettings{FallbackRegion: "cn-shanghai"},
+			primary:  &fakeWorkloadMetricsClient{err: sdkerrors.NewServerError(503, `{"Code":"ServiceUnavailable"}`, "")},
+			fallback: &fakeWorkloadMetricsClient{value: 5},
+			period:   time.Minute,
+			value:    5,
+		},
+		{
+			name:     "hedge delay",
+			settings: utils.MetricSettings{FallbackRegion: "cn-shanghai", HedgeDelay: 10 * time.Millisecond},
+			primary:  &fakeWorkloadMetricsClient{delay: time.Second, value: 3},
+			fallback: &fakeWorkloadMetricsClient{value: 5},
+			period:   time.Minute,
+			value:    5,
+		},
+	} {
+		clients := map[string]*fakeWorkloadMetricsClient{"": c.primary, "cn-shanghai": c.fallback}
+		source := newFakeWorkloadMetricSource(clients, c.settings)
+
+		began := time.Now()
+		values, err := source.GetExternalMetric(context.TODO(), p.ExternalMetricInfo{Metric: K8S_WORKLOAD_CPUUTIL}, "default", customSelector(t, selector))
+		if err != nil || len(values) != 1 || values[0].Value.Value() != c.value {
+			t.Errorf("%s: expected the value %d, got %v (%v)", c.name, c.value, values, err)
+			continue
+		}
+		if c.settings.HedgeDelay > 0 && time.Since(began) >= c.primary.delay {
+			t.Errorf("%s: expected the slow query to be hedged, took %v", c.name, time.Since(began))
+		}
+
+		answering := c.primary
+		if c.fallback != nil {
+			answering = c.fallback
+		}
+		answering.lock.Lock()
+		requests := answering.dataPointRequests
+		answering.lock.Unlock()
+		if len(requests) != 1 {
+			t.Errorf("%s: expected a data point request, got %d", c.name, len(requests))
+			continue
+		}
+		// the time range is of 5 complete periods
+		start, _ := time.Parse(utils.DEFAULT_TIME_FORMAT, requests[0].StartTime)
+		end, _ := time.Parse(utils.DEFAULT_TIME_FORMAT, requests[0].EndTime)
+		if requests[0].MetricName != "group.cpu.usage_rate" || end.Sub(start) != 5*c.period {
+			t.Errorf("%s: expected the data points of group.cpu.usage_rate of the period %v, got those of %s from %s to %s",
+				c.name, c.period, requests[0].MetricName, requests[0].StartTime, requests[0].EndTime)
+		}
+	}
+}
@@ -0,0 +1,488 @@
+package ess
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk"
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/requests"
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/responses"
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/cms"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	log "k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+const (
+	ESS_GROUP_CPU_UTILIZATION    = "ess_group_cpu_utilization"
+	ESS_GROUP_MEMORY_UTILIZATION = "ess_group_memory_utilization"
+	ESS_GROUP_LOAD_5M            = "ess_group_load_5m"
+	ESS_GROUP_INTERNET_IN_RATE   = "ess_group_internet_in_rate"
+	ESS_GROUP_INTERNET_OUT_RATE  = "ess_group_internet_out_rate"
+	ESS_GROUP_INTRANET_IN_RATE   = "ess_group_intranet_in_rate"
+	ESS_GROUP_INTRANET_OUT_RATE  = "ess_group_intranet_out_rate"
+
+	//Global Params
+	ESS_GROUP_ID    = "ess.group.id"
+	ESS_AGGREGATION = "ess.aggregation"
+	ESS_PERIOD      = "ess.period"
+
+	MIN_PERIOD = 60
+
+	// the aggregations of the values of the members
+	AggregationAvg = "avg"
+	AggregationSum = "sum"
+	AggregationMax = "max"
+
+	ecsNamespace = "acs_ecs_dashboard"
+
+	essProduct                 = "Ess"
+	essAPIVersion              = "2014-08-28"
+	essScalingInstancesAPI     = "DescribeScalingInstances"
+	essScalingInstancesPerPage = 50
+)
+
+// Aggregations are the ways the values of the members of a group are aggregated into the value of the group.
+var Aggregations = []string{AggregationAvg, AggregationSum, AggregationMax}
+
+// groupMetrics are the ECS metrics of CMS each group metric aggregates, by name.
+var groupMetrics = map[string]string{
+	ESS_GROUP_CPU_UTILIZATION:    "CPUUtilization",
+	ESS_GROUP_MEMORY_UTILIZATION: "memory_usedutilization",
+	ESS_GROUP_LOAD_5M:            "load_5m",
+	ESS_GROUP_INTERNET_IN_RATE:   "InternetInRate",
+	ESS_GROUP_INTERNET_OUT_RATE:  "InternetOutRate",
+	ESS_GROUP_INTRANET_IN_RATE:   "IntranetInRate",
+	ESS_GROUP_INTRANET_OUT_RATE:  "IntranetOutRate",
+}
+
+// memberLifecycleStates are the lifecycle states of the instances which count as members of their group, the
+// ones being added, removed or on standby don't serve.
+var memberLifecycleStates = sets.NewString("InService", "Protected")
+
+// metricListClient is the part of the cms client used by the group metrics.
+type metricListClient interface {
+	DescribeMetricList(request *cms.DescribeMetricListRequest) (*cms.DescribeMetricListResponse, error)
+}
+
+// scalingClient sends the requests of the ESS apis, which the adapter has no client of.
+type scalingClient interface {
+	ProcessCommonRequest(request *requests.CommonRequest) (*responses.CommonResponse, error)
+}
+
+// ESSMetricSource serves the ECS metrics of CMS aggregated across the members of an auto scaling group, which
+// are resolved on every request, so that the instances which joined or left the group since the last poll
+// are accounted for.
+type ESSMetricSource struct {
+	// newClient and newScalingClient replace the clients built from the credentials of the adapter if set
+	newClient        func() (metricListClient, error)
+	newScalingClient func() (client scalingClient, region string, err error)
+
+	lock sync.Mutex
+	// members are the members of each group at their last poll, by group id
+	members map[string]sets.String
+
+	settings *utils.ExternalMetricSettings
+}
+
+// SetMetricSettings sets the periods and statistics of the ess metrics.
+func (es *ESSMetricSource) SetMetricSettings(settings *utils.ExternalMetricSettings) {
+	es.settings = settings
+}
+
+func NewESSMetricSource() *ESSMetricSource {
+	return &ESSMetricSource{members: make(map[string]sets.String)}
+}
+
+// list all external metric
+func (es *ESSMetricSource) GetExternalMetricInfoList() []p.ExternalMetricInfo {
+	metricInfoList := make([]p.ExternalMetricInfo, 0, len(groupMetrics))
+	for metric := range groupMetrics {
+		metricInfoList = append(metricInfoList, p.ExternalMetricInfo{
+			Metric: metric,
+		})
+	}
+	return metricInfoList
+}
+
+// GetExternalMetric returns a single value of the group of the selector, labeled with its ess.group.id.
+func (es *ESSMetricSource) GetExternalMetric(ctx context.Context, info p.ExternalMetricInfo, namespace string, requirements labels.Requirements) (values []external_metrics.ExternalMetricValue, err error) {
+	ctx, cancel := utils.WithBackendTimeout(ctx, utils.CMSBackend)
+	defer cancel()
+
+	metric, found := groupMetrics[info.Metric]
+	if !found {
+		return nil, fmt.Errorf("the specific metric %s is not found", info.Metric)
+	}
+	values, err = es.getGroupMetric(ctx, metric, info.Metric, requirements)
+	if err != nil {
+		log.Warningf("Failed to GetExternalMetric %s,because of %v", info.Metric, err)
+	}
+	return values, err
+}
+
+// QueriesAtEvaluationTime tells that CMS is queried for the group metrics at a past time, see utils.EvaluationTime.
+// The members are the current ones though.
+func (es *ESSMetricSource) QueriesAtEvaluationTime() bool {
+	return true
+}
+
+// ESSParams are the params of the selector of a request.
+type ESSParams struct {
+	GroupId     string
+	Aggregation string
+	Period      int
+}
+
+// getESSParams parses the selector of a request, period is used unless the selector sets one.
+func getESSParams(requirements labels.Requirements, period int) (*ESSParams, error) {
+	params := &ESSParams{
+		Aggregation: AggregationAvg,
+		Period:      period,
+	}
+	for _, r := range requirements {
+		values := r.Values().List()
+		if len(values) == 0 {
+			continue
+		}
+		switch r.Key() {
+		case ESS_GROUP_ID:
+			if len(values) > 1 {
+				return nil, fmt.Errorf("%s must select a single scaling group, got %v", ESS_GROUP_ID, values)
+			}
+			params.GroupId = values[0]
+		case ESS_AGGREGATION:
+			params.Aggregation = values[0]
+		case ESS_PERIOD:
+			var err error
+			if params.Period, err = strconv.Atoi(values[0]); err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %v", ESS_PERIOD, values[0], err)
+			}
+		}
+	}
+	if params.GroupId == "" {
+		return nil, errors.New("ess.group.id must be provided")
+	}
+	switch params.Aggregation {
+	case AggregationAvg, AggregationSum, AggregationMax:
+	default:
+		return nil, fmt.Errorf("aggregation %q is not supported, it must be one of %v", params.Aggregation, Aggregations)
+	}
+	if params.Period < MIN_PERIOD {
+		log.Warningf("The period you specific is too low and use MIN_PERIOD(%d) as default", MIN_PERIOD)
+		params.Period = MIN_PERIOD
+	}
+	return params, nil
+}
+
+// getGroupMetric queries the metric of every current member of the group, and aggregates the latest values of the
+// members with data points. A member which just joined has none yet, and is left out rather than counted as 0.
+func (es *ESSMetricSource) getGroupMetric(ctx context.Context, metric, externalMetric string, requirements labels.Requirements) ([]external_metrics.ExternalMetricValue, error) {
+	settings := es.settings.Of(externalMetric)
+	params, err := getESSParams(requirements, settings.CMSPeriod())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ess params,because of %v", err)
+	}
+
+	scaling, region, err := es.scalingClient()
+	if err != nil {
+		log.Errorf("Failed to create ess client,because of %v", err)
+		return nil, err
+	}
+	instanceIds, err := listGroupMembers(ctx, scaling, region, params.GroupId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the members of scaling group %s: %v", params.GroupId, err)
+	}
+	es.recordMembers(params.GroupId, instanceIds)
+	if len(instanceIds) == 0 {
+		return nil, fmt.Errorf("scaling group %s has no members in service: %w", params.GroupId, utils.ErrNoInstances)
+	}
+
+	client, err := es.client()
+	if err != nil {
+		log.Errorf("Failed to create cms client,because of %v", err)
+		return nil, err
+	}
+	statistic := settings.CMSStatistic(utils.DefaultCMSStatistic)
+	startTime, endTime := utils.AlignedTimeRange(utils.QueryTime(ctx).Add(-2*time.Minute), params.Period, 1)
+	if err = utils.JudgeWithPeriod(startTime, endTime, params.Period); err != nil {
+		return nil, err
+	}
+
+	// several members are queried by a single call, the remaining calls run in parallel
+	var lock sync.Mutex
+	memberValues := make(map[string]float64, len(instanceIds))
+	memberTimestamps := make(map[string]int64, len(instanceIds))
+	batchSize, concurrency := utils.CMSBatching()
+	err = utils.RunBatches(ctx, instanceIds, batchSize, concurrency, func(ctx context.Context, instanceIds []string) error {
+		request := cms.CreateDescribeMetricListRequest()
+		request.Scheme = "https"
+		request.Namespace = ecsNamespace
+		request.MetricName = metric
+		request.Period = strconv.Itoa(params.Period)
+		request.StartTime = startTime.Format(utils.DEFAULT_TIME_FORMAT)
+		request.EndTime = endTime.Format(utils.DEFAULT_TIME_FORMAT)
+		dimensions, err := createDimensions(instanceIds)
+		if err != nil {
+			return err
+		}
+		request.Dimensions = dimensions
+		if err = utils.SetRequestDeadline(ctx, request); err != nil {
+			return err
+		}
+		release, err := utils.AcquireBackend(ctx, utils.CMSBackend)
+		if err != nil {
+			return err
+		}
+		response, err := client.DescribeMetricList(request)
+		release()
+		if err != nil {
+			return err
+		}
+
+		values, timestamps, err := getMetricFromDataPoints(response.Datapoints, statistic)
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		for instanceId, value := range values {
+			memberValues[instanceId] = value
+			memberTimestamps[instanceId] = timestamps[instanceId]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	value, timestamp, found := aggregate(params.Aggregation, instanceIds, memberValues, memberTimestamps)
+	if !found {
+		return nil, fmt.Errorf("the members %v of scaling group %s: %w", instanceIds, params.GroupId, utils.ErrNoDataPoints)
+	}
+	values := []external_metrics.ExternalMetricValue{{
+		MetricName:   externalMetric,
+		MetricLabels: map[string]string{ESS_GROUP_ID: params.GroupId},
+		Value:        *resource.NewMilliQuantity(int64(value*1000), resource.DecimalSI),
+		Timestamp:    utils.DataPointTime(timestamp, time.Now()),
+	}}
+	utils.SetWindowLabel(values, params.Period)
+	return values, nil
+}
+
+// aggregate aggregates the values of the members with data points, and returns the timestamp of the oldest one.
+// found is false if no member has any data point.
+func aggregate(aggregation string, instanceIds []string, values map[string]float64, timestamps map[string]int64) (value float64, timestamp int64, found bool) {
+	count := 0
+	for _, instanceId := range instanceIds {
+		v, ok := values[instanceId]
+		if !ok {
+			continue
+		}
+		switch {
+		case count == 0:
+			value = v
+		case aggregation == AggregationMax:
+			if v > value {
+				value = v
+			}
+		default:
+			value += v
+		}
+		if t := timestamps[instanceId]; count == 0 || t < timestamp {
+			timestamp = t
+		}
+		count++
+	}
+	if count == 0 {
+		return 0, 0, false
+	}
+	if aggregation == AggregationAvg {
+		value /= float64(count)
+	}
+	return value, timestamp, true
+}
+
+// recordMembers logs the instances which joined or left the group since its last poll.
+func (es *ESSMetricSource) recordMembers(groupId string, instanceIds []string) {
+	members := sets.NewString(instanceIds...)
+	es.lock.Lock()
+	defer es.lock.Unlock()
+	if last, found := es.members[groupId]; found && !last.Equal(members) {
+		log.Infof("Members of scaling group %s changed, joined: %v, left: %v", groupId, members.Difference(last).List(), last.Difference(members).List())
+	}
+	es.members[groupId] = members
+}
+
+// scalingInstances is the page of the members of a group DescribeScalingInstances returns.
+type scalingInstances struct {
+	TotalCount       int `json:"TotalCount"`
+	ScalingInstances struct {
+		ScalingInstance []struct {
+			InstanceId     string `json:"InstanceId"`
+			LifecycleState string `json:"LifecycleState"`
+		} `json:"ScalingInstance"`
+	} `json:"ScalingInstances"`
+}
+
+// listGroupMembers returns the ids of the instances of the group of the region which are in service, sorted.
+func listGroupMembers(ctx context.Context, client scalingClient, region, groupId string) ([]string, error) {
+	var instanceIds []string
+	for page, listed := 1, 0; ; page++ {
+		request := requests.NewCommonRequest()
+		request.Method = "POST"
+		request.Scheme = "https"
+		request.Product = essProduct
+		request.Version = essAPIVersion
+		request.ApiName = essScalingInstancesAPI
+		request.QueryParams["RegionId"] = region
+		request.QueryParams["ScalingGroupId"] = groupId
+		request.QueryParams["PageNumber"] = strconv.Itoa(page)
+		request.QueryParams["PageSize"] = strconv.Itoa(essScalingInstancesPerPage)
+		if err := utils.SetRequestDeadline(ctx, request); err != nil {
+			return nil, err
+		}
+		release, err := utils.AcquireBackend(ctx, utils.CMSBackend)
+		if err != nil {
+			return nil, err
+		}
+		response, err := client.ProcessCommonRequest(request)
+		release()
+		if err != nil {
+			return nil, err
+		}
+
+		var result scalingInstances
+		if err := json.Unmarshal(response.GetHttpContentBytes(), &result); err != nil {
+			return nil, fmt.Errorf("json unmarshal scaling instances exception %v", err)
+		}
+		for _, instance := range result.ScalingInstances.ScalingInstance {
+			if memberLifecycleStates.Has(instance.LifecycleState) {
+				instanceIds = append(instanceIds, instance.InstanceId)
+			}
+		}
+		listed += len(result.ScalingInstances.ScalingInstance)
+		if len(result.ScalingInstances.ScalingInstance) == 0 || listed >= result.TotalCount {
+			break
+		}
+	}
+	sort.Strings(instanceIds)
+	return instanceIds, nil
+}
+
+// Dimensions selects an ECS instance.
+type Dimensions struct {
+	InstanceId string `json:"instanceId"`
+}
+
+// createDimensions selects every instance, all of them are queried at once.
+func createDimensions(instanceIds []string) (string, error) {
+	dimensions := make([]Dimensions, 0, len(instanceIds))
+	for _, instanceId := range instanceIds {
+		dimensions = append(dimensions, Dimensions{instanceId})
+	}
+	dimensionsByte, err := json.Marshal(dimensions)
+	if err != nil {
+		return "", err
+	}
+	return string(dimensionsByte), nil
+}
+
+type DataPoint struct {
+	Timestamp  int64   `json:"timestamp"`
+	InstanceId string  `json:"instanceId"`
+	Average    float64 `json:"Average"`
+	Minimum    float64 `json:"Minimum"`
+	Maximum    float64 `json:"Maximum"`
+	Value      float64 `json:"Value"`
+}
+
+// statistic returns the given statistic of the data point, one of utils.CMSStatistics.
+func (point DataPoint) statistic(name string) float64 {
+	switch name {
+	case utils.CMSStatisticMaximum:
+		return point.Maximum
+	case utils.CMSStatisticMinimum:
+		return point.Minimum
+	case utils.CMSStatisticValue:
+		return point.Value
+	default:
+		return point.Average
+	}
+}
+
+// getMetricFromDataPoints extracts the latest value of the statistic of every instance from the data points,
+// and its timestamp in milliseconds. The instances without data points are left out.
+func getMetricFromDataPoints(datapoints, statistic string) (values map[string]float64, timestamps map[string]int64, err error) {
+	values = make(map[string]float64)
+	timestamps = make(map[string]int64)
+	if datapoints == "" {
+		return values, timestamps, nil
+	}
+	points := make([]DataPoint, 0)
+	if err = json.Unmarshal([]byte(datapoints), &points); err != nil {
+		return nil, nil, err
+	}
+	for _, point := range points {
+		if last, found := timestamps[point.InstanceId]; point.InstanceId == "" || found && last > point.Timestamp {
+			continue
+		}
+		values[point.InstanceId] = point.statistic(statistic)
+		timestamps[point.InstanceId] = point.Timestamp
+	}
+	return values, timestamps, nil
+}
+
+func (es *ESSMetricSource) client() (metricListClient, error) {
+	if es.newClient != nil {
+		return es.newClient()
+	}
+	accessUserInfo, err := utils.GetAccessUserInfo()
+	if err != nil {
+		return nil, err
+	}
+	var client *cms.Client
+	if strings.HasPrefix(accessUserInfo.AccessKeyId, "STS.") {
+		client, err = cms.NewClientWithStsToken(accessUserInfo.Region, accessUserInfo.AccessKeyId, accessUserInfo.AccessKeySecret, accessUserInfo.Token)
+	} else {
+		client, err = cms.NewClientWithAccessKey(accessUserInfo.Region, accessUserInfo.AccessKeyId, accessUserInfo.AccessKeySecret)
+	}
+	if err != nil {
+		return nil, err
+	}
+	utils.ApplySDKTransport(client)
+	utils.ApplyEndpointOverride(&client.Client, utils.CMSBackend, accessUserInfo.Region)
+	return client, nil
+}
+
+func (es *ESSMetricSource) scalingClient() (scalingClient, string, error) {
+	if es.newScalingClient != nil {
+		return es.newScalingClient()
+	}
+	accessUserInfo, err := utils.GetAccessUserInfo()
+	if err != nil {
+		return nil, "", err
+	}
+	var client *sdk.Client
+	if strings.HasPrefix(accessUserInfo.AccessKeyId, "STS.") {
+		client, err = sdk.NewClientWithStsToken(accessUserInfo.Region, accessUserInfo.AccessKeyId, accessUserInfo.AccessKeySecret, accessUserInfo.Token)
+	} else {
+		client, err = sdk.NewClientWithAccessKey(accessUserInfo.Region, accessUserInfo.AccessKeyId, accessUserInfo.AccessKeySecret)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	utils.ApplySDKTransport(client)
+	return client, accessUserInfo.Region, nil
+}
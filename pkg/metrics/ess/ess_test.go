@@ -0,0 +1,156 @@
+package ess
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/requests"
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/responses"
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/cms"
+	"k8s.io/apimachinery/pkg/labels"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// fakeScalingClient lists the members of a scaling group, a page of two at a time.
+type fakeScalingClient struct {
+	// members are the lifecycle states of the instances of the group, by instance id
+	members [][2]string
+	pages   int
+}
+
+func (c *fakeScalingClient) ProcessCommonRequest(request *requests.CommonRequest) (*responses.CommonResponse, error) {
+	c.pages++
+	if request.ApiName != essScalingInstancesAPI || request.QueryParams["ScalingGroupId"] != "asg-1" || request.QueryParams["RegionId"] != "cn-hangzhou" {
+		return nil, fmt.Errorf("unexpected request %s of %v", request.ApiName, request.QueryParams)
+	}
+	page, _ := strconv.Atoi(request.QueryParams["PageNumber"])
+	instances := make([]string, 0, 2)
+	for i := (page - 1) * 2; i < len(c.members) && i < page*2; i++ {
+		instances = append(instances, fmt.Sprintf(`{"InstanceId":%q,"LifecycleState":%q}`, c.members[i][0], c.members[i][1]))
+	}
+	body := fmt.Sprintf(`{"TotalCount":%d,"PageNumber":%d,"PageSize":2,"ScalingInstances":{"ScalingInstance":[%s]}}`,
+		len(c.members), page, strings.Join(instances, ","))
+	response := responses.NewCommonResponse()
+	err := responses.Unmarshal(response, &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}, "JSON")
+	return response, err
+}
+
+// fakeMetricListClient returns the data points of the instances of the request which have a value.
+type fakeMetricListClient struct {
+	lock    sync.Mutex
+	values  map[string]float64
+	queried []string
+}
+
+func (c *fakeMetricListClient) DescribeMetricList(request *cms.DescribeMetricListRequest) (*cms.DescribeMetricListResponse, error) {
+	var dimensions []Dimensions
+	if err := json.Unmarshal([]byte(request.Dimensions), &dimensions); err != nil {
+		return nil, err
+	}
+	points := make([]DataPoint, 0)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, d := range dimensions {
+		c.queried = append(c.queried, d.InstanceId)
+		if value, found := c.values[d.InstanceId]; found {
+			points = append(points,
+				DataPoint{Timestamp: 1620000000000, InstanceId: d.InstanceId, Average: 1000},
+				DataPoint{Timestamp: 1620000060000, InstanceId: d.InstanceId, Average: value})
+		}
+	}
+	datapoints, _ := json.Marshal(points)
+	return &cms.DescribeMetricListResponse{Success: true, Datapoints: string(datapoints)}, nil
+}
+
+func getGroupValue(t *testing.T, source *ESSMetricSource, selector string) (float64, error) {
+	metricSelector, err := labels.Parse(selector)
+	if err != nil {
+		t.Fatalf("Failed to parse selector, because of %v", err)
+	}
+	requirements, _ := metricSelector.Requirements()
+	values, err := source.GetExternalMetric(context.TODO(), p.ExternalMetricInfo{Metric: ESS_GROUP_CPU_UTILIZATION}, "default", requirements)
+	if err != nil {
+		return 0, err
+	}
+	if len(values) != 1 || values[0].MetricLabels[ESS_GROUP_ID] != "asg-1" {
+		t.Fatalf("expected a single value of the group, got %v", values)
+	}
+	return values[0].Value.AsApproximateFloat64(), nil
+}
+
+func TestGetGroupMetricFollowsMembership(t *testing.T) {
+	scaling := &fakeScalingClient{members: [][2]string{{"i-1", "InService"}, {"i-3", "Pending"}, {"i-2", "Protected"}}}
+	client := &fakeMetricListClient{values: map[string]float64{"i-1": 20, "i-2": 40, "i-3": 90, "i-4": 70}}
+	source := NewESSMetricSource()
+	source.newClient = func() (metricListClient, error) { return client, nil }
+	source.newScalingClient = func() (scalingClient, string, error) { return scaling, "cn-hangzhou", nil }
+
+	for aggregation, expected := range map[string]float64{AggregationAvg: 30, AggregationSum: 60, AggregationMax: 40} {
+		client.queried = nil
+		value, err := getGroupValue(t, source, "ess.group.id=asg-1,ess.aggregation="+aggregation)
+		if err != nil {
+			t.Fatalf("Failed to get the %s of the group, because of %v", aggregation, err)
+		}
+		if value != expected {
+			t.Errorf("expected the %s %v of the members in service, got %v", aggregation, expected, value)
+		}
+		if strings.Join(client.queried, ",") != "i-1,i-2" {
+			t.Errorf("expected the members in service to be queried, got %v", client.queried)
+		}
+	}
+	if scaling.pages != 6 {
+		t.Errorf("expected both pages of the members to be listed on every poll, got %d pages", scaling.pages)
+	}
+
+	// i-2 left and i-5, which has no data points yet, joined since the last poll
+	scaling.members = [][2]string{{"i-1", "InService"}, {"i-5", "InService"}}
+	client.queried = nil
+	value, err := getGroupValue(t, source, "ess.group.id=asg-1")
+	if err != nil {
+		t.Fatalf("Failed to get the average of the group, because of %v", err)
+	}
+	if value != 20 {
+		t.Errorf("expected the average of the members with data points, got %v", value)
+	}
+	if strings.Join(client.queried, ",") != "i-1,i-5" {
+		t.Errorf("expected the current members to be queried, got %v", client.queried)
+	}
+
+	scaling.members = [][2]string{{"i-5", "InService"}}
+	if _, err := getGroupValue(t, source, "ess.group.id=asg-1"); !errors.Is(err, utils.ErrNoDataPoints) || errors.Is(err, utils.ErrNoInstances) {
+		t.Errorf("expected members without data points not to be taken for no instances, got %v", err)
+	}
+	scaling.members = nil
+	if _, err := getGroupValue(t, source, "ess.group.id=asg-1"); !errors.Is(err, utils.ErrNoInstances) {
+		t.Errorf("expected no instances for an empty group, got %v", err)
+	}
+}
+
+func TestGetESSParams(t *testing.T) {
+	for _, selector := range []string{"ess.aggregation=avg", "ess.group.id in (asg-1,asg-2)", "ess.group.id=asg-1,ess.aggregation=p99", "ess.group.id=asg-1,ess.period=1m"} {
+		metricSelector, _ := labels.Parse(selector)
+		requirements, _ := metricSelector.Requirements()
+		if _, err := getESSParams(requirements, utils.DefaultCMSPeriod); err == nil {
+			t.Errorf("expected selector %q to be rejected", selector)
+		}
+	}
+
+	metricSelector, _ := labels.Parse("ess.group.id=asg-1,ess.period=30")
+	requirements, _ := metricSelector.Requirements()
+	params, err := getESSParams(requirements, utils.DefaultCMSPeriod)
+	if err != nil || params.Aggregation != AggregationAvg || params.Period != MIN_PERIOD {
+		t.Errorf("expected the average over the minimum period, got %+v (%v)", params, err)
+	}
+}
@@ -0,0 +1,113 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	log "k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+const (
+	// the number of pods in the namespace of the request whose labels match the selector
+	K8S_POD_COUNT = "k8s_pod_count"
+	// the number of nodes whose labels match the selector
+	K8S_NODE_COUNT = "k8s_node_count"
+)
+
+// KubeCountMetricSource counts the pods and nodes matching a selector. The counts are read from
+// an informer cache of the kube apiserver, not from Alibaba Cloud.
+type KubeCountMetricSource struct {
+	pods  corelisters.PodLister
+	nodes corelisters.NodeLister
+}
+
+func NewKubeCountMetricSource(pods corelisters.PodLister, nodes corelisters.NodeLister) *KubeCountMetricSource {
+	return &KubeCountMetricSource{
+		pods:  pods,
+		nodes: nodes,
+	}
+}
+
+// StartKubeCountMetricSource starts watching the pods and nodes until stopCh is closed,
+// and waits for the informer caches to be filled.
+func StartKubeCountMetricSource(client kubernetes.Interface, stopCh <-chan struct{}) (*KubeCountMetricSource, error) {
+	factory := informers.NewSharedInformerFactory(client, 0)
+	pods := factory.Core().V1().Pods()
+	nodes := factory.Core().V1().Nodes()
+	// the informers have to be requested before the factory is started
+	pods.Informer()
+	nodes.Informer()
+	factory.Start(stopCh)
+
+	if !cache.WaitForCacheSync(stopCh, pods.Informer().HasSynced, nodes.Informer().HasSynced) {
+		return nil, fmt.Errorf("failed to sync pod and node informers")
+	}
+	return NewKubeCountMetricSource(pods.Lister(), nodes.Lister()), nil
+}
+
+func (ks *KubeCountMetricSource) GetExternalMetricInfoList() []p.ExternalMetricInfo {
+	return []p.ExternalMetricInfo{
+		{Metric: K8S_POD_COUNT},
+		{Metric: K8S_NODE_COUNT},
+	}
+}
+
+// GetExternalMetric uses the metric selector as the label selector of the pods or nodes.
+func (ks *KubeCountMetricSource) GetExternalMetric(ctx context.Context, info p.ExternalMetricInfo, namespace string, requirements labels.Requirements) (values []external_metrics.ExternalMetricValue, err error) {
+	selector := labels.NewSelector().Add(requirements...)
+
+	var count int
+	switch info.Metric {
+	case K8S_POD_COUNT:
+		count, err = ks.countPods(namespace, selector)
+	case K8S_NODE_COUNT:
+		count, err = ks.countNodes(selector)
+	default:
+		return values, fmt.Errorf("unknown metric %s", info.Metric)
+	}
+	if err != nil {
+		log.Errorf("Failed to count %s matching %s, because of %v", info.Metric, selector, err)
+		return values, err
+	}
+
+	values = append(values, external_metrics.ExternalMetricValue{
+		MetricName: info.Metric,
+		Timestamp:  metav1.Now(),
+		Value:      *resource.NewQuantity(int64(count), resource.DecimalSI),
+	})
+	return values, nil
+}
+
+// countPods skips the pods which have terminated, they don't serve anymore.
+func (ks *KubeCountMetricSource) countPods(namespace string, selector labels.Selector) (int, error) {
+	pods, err := ks.pods.Pods(namespace).List(selector)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, pod := range pods {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		count++
+	}
+	return count, nil
+}
+
+func (ks *KubeCountMetricSource) countNodes(selector labels.Selector) (int, error) {
+	nodes, err := ks.nodes.List(selector)
+	if err != nil {
+		return 0, err
+	}
+	return len(nodes), nil
+}
@@ -0,0 +1,93 @@
+package kube
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+func pod(namespace, name, app string, phase corev1.PodPhase) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: map[string]string{"app": app}},
+		Status:     corev1.PodStatus{Phase: phase},
+	}
+}
+
+func node(name, pool string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"pool": pool}},
+	}
+}
+
+// newFakeKubeCountMetricSource fills the informer caches by hand instead of running the informers.
+func newFakeKubeCountMetricSource(t *testing.T, pods []*corev1.Pod, nodes []*corev1.Node) *KubeCountMetricSource {
+	factory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	podInformer := factory.Core().V1().Pods()
+	nodeInformer := factory.Core().V1().Nodes()
+	for _, pod := range pods {
+		if err := podInformer.Informer().GetIndexer().Add(pod); err != nil {
+			t.Fatalf("Failed to add pod, because of %v", err)
+		}
+	}
+	for _, node := range nodes {
+		if err := nodeInformer.Informer().GetIndexer().Add(node); err != nil {
+			t.Fatalf("Failed to add node, because of %v", err)
+		}
+	}
+	return NewKubeCountMetricSource(podInformer.Lister(), nodeInformer.Lister())
+}
+
+func count(t *testing.T, source *KubeCountMetricSource, metric, namespace, selector string) int64 {
+	s, err := labels.Parse(selector)
+	if err != nil {
+		t.Fatalf("Failed to parse selector, because of %v", err)
+	}
+	requirements, _ := s.Requirements()
+	values, err := source.GetExternalMetric(context.TODO(), p.ExternalMetricInfo{Metric: metric}, namespace, requirements)
+	if err != nil || len(values) != 1 {
+		t.Fatalf("Failed to get %s, because of %v", metric, err)
+	}
+	return values[0].Value.Value()
+}
+
+func TestPodCount(t *testing.T) {
+	source := newFakeKubeCountMetricSource(t, []*corev1.Pod{
+		pod("default", "web-1", "web", corev1.PodRunning),
+		pod("default", "web-2", "web", corev1.PodPending),
+		pod("default", "web-3", "web", corev1.PodSucceeded),
+		pod("default", "web-4", "web", corev1.PodFailed),
+		pod("default", "worker-1", "worker", corev1.PodRunning),
+		pod("other", "web-1", "web", corev1.PodRunning),
+	}, nil)
+
+	if c := count(t, source, K8S_POD_COUNT, "default", "app=web"); c != 2 {
+		t.Errorf("expected the 2 pods of web which haven't terminated, got %d", c)
+	}
+	if c := count(t, source, K8S_POD_COUNT, "default", "app in (web,worker)"); c != 3 {
+		t.Errorf("expected the 3 pods of web and worker, got %d", c)
+	}
+	if c := count(t, source, K8S_POD_COUNT, "other", "app=web"); c != 1 {
+		t.Errorf("expected the pods of another namespace to be counted apart, got %d", c)
+	}
+}
+
+func TestNodeCount(t *testing.T) {
+	source := newFakeKubeCountMetricSource(t, nil, []*corev1.Node{
+		node("node-1", "gpu"),
+		node("node-2", "gpu"),
+		node("node-3", "default"),
+	})
+
+	if c := count(t, source, K8S_NODE_COUNT, "default", "pool=gpu"); c != 2 {
+		t.Errorf("expected the 2 nodes of the gpu pool, got %d", c)
+	}
+	if c := count(t, source, K8S_NODE_COUNT, "default", "pool=cpu"); c != 0 {
+		t.Errorf("expected no node of the cpu pool, got %d", c)
+	}
+}
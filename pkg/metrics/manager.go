@@ -1,14 +1,23 @@
 package metrics
 
 import (
+	"context"
 	"fmt"
+	"strings"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
 	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/metrics/ahas"
 	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/metrics/cms"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/metrics/ess"
 
 	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/metrics/slb"
 	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/metrics/sls"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
 	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
 	log "k8s.io/klog/v2"
 	"k8s.io/metrics/pkg/apis/external_metrics"
 )
@@ -19,19 +28,19 @@ var (
 )
 
 func init() {
-	externalMetricsManager = &ExternalMetricsManager{
-		metricsSource: make(map[p.ExternalMetricInfo]MetricSource),
-	}
+	externalMetricsManager = newExternalMetricsManager(clock.RealClock{})
 
 	customMetricsMangaer = &CustomMetricsManager{
 		metricsSource: make(map[p.CustomMetricInfo]MetricSource),
 	}
 
 	// add metrics source
-	register(sls.NewSLSMetricSource())
-	register(slb.NewSLBMetricSource())
-	register(cms.NewCMSMetricSource())
-	register(ahas.NewAHASSentinelMetricSource())
+	register(utils.SLSProvider, sls.NewSLSMetricSource())
+	register(utils.SLBProvider, slb.NewSLBMetricSource())
+	register(utils.CMSProvider, cms.NewCMSMetricSource())
+	register(utils.CMSProvider, cms.NewCMSCustomMetricSource())
+	register(utils.AHASProvider, ahas.NewAHASSentinelMetricSource())
+	register(utils.ESSProvider, ess.NewESSMetricSource())
 }
 
 func GetExternalMetricsManager() *ExternalMetricsManager {
@@ -42,24 +51,71 @@ func GetCustomMetricsManager() *CustomMetricsManager {
 	return customMetricsMangaer
 }
 
-func register(m MetricSource) {
-	externalMetricsManager.AddMetricsSource(m)
+func register(provider string, m MetricSource) {
+	externalMetricsManager.AddMetricsSource(provider, m)
 }
 
 type MetricSource interface {
 	GetExternalMetricInfoList() []p.ExternalMetricInfo
-	GetExternalMetric(info p.ExternalMetricInfo, namespace string, requirements labels.Requirements) ([]external_metrics.ExternalMetricValue, error)
+	GetExternalMetric(ctx context.Context, info p.ExternalMetricInfo, namespace string, requirements labels.Requirements) ([]external_metrics.ExternalMetricValue, error)
+}
+
+// PrefixMetricSource is a MetricSource whose metrics are only known at runtime.
+// It serves every metric whose name starts with its prefix.
+type PrefixMetricSource interface {
+	MetricSource
+	MetricPrefix() string
+}
+
+// ConfigurableMetricSource is a MetricSource which applies the settings of the external metrics to
+// its queries, see utils.MetricSettings.
+type ConfigurableMetricSource interface {
+	MetricSource
+	SetMetricSettings(settings *utils.ExternalMetricSettings)
+}
+
+// HistoricalMetricSource is a MetricSource which can query its metrics at a past
+// evaluation time, see utils.EvaluationTime.
+type HistoricalMetricSource interface {
+	MetricSource
+	QueriesAtEvaluationTime() bool
 }
 
 type ExternalMetricsManager struct {
 	metricsSource map[p.ExternalMetricInfo]MetricSource
+	prefixSources []PrefixMetricSource
+	// providers are the names of the providers of the sources in the provider registry
+	providers       map[MetricSource]string
+	lastKnownValues *lastKnownValues
+	// settings are the settings of the external metrics, which are passed to the sources
+	settings *utils.ExternalMetricSettings
+}
+
+func newExternalMetricsManager(clock clock.Clock) *ExternalMetricsManager {
+	return &ExternalMetricsManager{
+		metricsSource:   make(map[p.ExternalMetricInfo]MetricSource),
+		providers:       make(map[MetricSource]string),
+		lastKnownValues: newLastKnownValues(clock),
+	}
 }
 
 type CustomMetricsManager struct {
 	metricsSource map[p.CustomMetricInfo]MetricSource
 }
 
-func (em *ExternalMetricsManager) AddMetricsSource(m MetricSource) {
+// AddMetricsSource adds a source of the provider, which the provider registry enables and disables.
+func (em *ExternalMetricsManager) AddMetricsSource(provider string, m MetricSource) {
+	utils.RegisterProvider(provider)
+	em.providers[m] = provider
+	if cs, ok := m.(ConfigurableMetricSource); ok && em.settings != nil {
+		cs.SetMetricSettings(em.settings)
+	}
+	// the metrics of a prefix source are listed on demand
+	if ps, ok := m.(PrefixMetricSource); ok {
+		log.Infof("Register metric prefix: %s to external metrics manager\n", ps.MetricPrefix())
+		em.prefixSources = append(em.prefixSources, ps)
+		return
+	}
 	metricInfoList := m.GetExternalMetricInfoList()
 	for _, p := range metricInfoList {
 		log.Infof("Register metric: %v to external metrics manager\n", p)
@@ -67,18 +123,97 @@ func (em *ExternalMetricsManager) AddMetricsSource(m MetricSource) {
 	}
 }
 
+// SetMetricsConfig applies the per metric settings of the configuration the manager applies itself.
+func (em *ExternalMetricsManager) SetMetricsConfig(metrics []config.ExternalMetric) {
+	gracePeriods := make(map[string]time.Duration, len(metrics))
+	providers := make(map[string]string, len(metrics))
+	for _, m := range metrics {
+		if m.Backend != "" {
+			providers[m.Name] = m.Backend
+		}
+		if m.NoDataGracePeriod > 0 {
+			gracePeriods[m.Name] = m.NoDataGracePeriod
+		}
+	}
+	em.lastKnownValues.setGracePeriods(gracePeriods)
+	utils.SetMetricProviders(providers)
+}
+
+// SetMetricSettings passes the settings of the external metrics to the sources which apply them.
+func (em *ExternalMetricsManager) SetMetricSettings(settings *utils.ExternalMetricSettings) {
+	em.settings = settings
+	for _, source := range em.sources() {
+		if cs, ok := source.(ConfigurableMetricSource); ok {
+			cs.SetMetricSettings(settings)
+		}
+	}
+}
+
+// sources returns each of the sources once.
+func (em *ExternalMetricsManager) sources() []MetricSource {
+	var sources []MetricSource
+	for source := range em.providers {
+		sources = append(sources, source)
+	}
+	return sources
+}
+
 func (em *ExternalMetricsManager) GetMetricsInfoList() []p.ExternalMetricInfo {
 	metricsInfoList := make([]p.ExternalMetricInfo, 0)
 	for source, _ := range em.metricsSource {
 		metricsInfoList = append(metricsInfoList, source)
 	}
+	for _, ps := range em.prefixSources {
+		metricsInfoList = append(metricsInfoList, ps.GetExternalMetricInfoList()...)
+	}
 	return metricsInfoList
 }
 
-func (em *ExternalMetricsManager) GetExternalMetrics(namespace string, requirements labels.Requirements, info p.ExternalMetricInfo) ([]external_metrics.ExternalMetricValue, error) {
+func (em *ExternalMetricsManager) GetExternalMetrics(ctx context.Context, namespace string, requirements labels.Requirements, info p.ExternalMetricInfo) ([]external_metrics.ExternalMetricValue, error) {
 	if source, ok := em.metricsSource[info]; ok {
-		return source.GetExternalMetric(info, namespace, requirements)
+		return em.getExternalMetrics(ctx, source, namespace, requirements, info)
+	}
+
+	for _, ps := range em.prefixSources {
+		if strings.HasPrefix(info.Metric, ps.MetricPrefix()) {
+			return em.getExternalMetrics(ctx, ps, namespace, requirements, info)
+		}
 	}
 
 	return nil, fmt.Errorf("The specific metric source %s is not found.\n", info.Metric)
 }
+
+// MetricProvider returns the name of the provider serving the external metric, false if no source has it.
+func (em *ExternalMetricsManager) MetricProvider(metric string) (string, bool) {
+	info := p.ExternalMetricInfo{Metric: metric}
+	if source, ok := em.metricsSource[info]; ok {
+		return em.providers[source], true
+	}
+	for _, ps := range em.prefixSources {
+		if strings.HasPrefix(metric, ps.MetricPrefix()) {
+			return em.providers[ps], true
+		}
+	}
+	return "", false
+}
+
+func (em *ExternalMetricsManager) getExternalMetrics(ctx context.Context, source MetricSource, namespace string, requirements labels.Requirements, info p.ExternalMetricInfo) ([]external_metrics.ExternalMetricValue, error) {
+	if provider := em.providers[source]; !utils.ProviderEnabled(provider) {
+		return nil, apierr.NewNotFound(external_metrics.Resource(info.Metric), fmt.Sprintf("provider %s is disabled", provider))
+	}
+	if backend, pinned := utils.ServingProvider(ctx, info.Metric); pinned && backend != em.providers[source] {
+		return nil, apierr.NewNotFound(external_metrics.Resource(info.Metric), fmt.Sprintf("the metric is served by provider %s rather than its backend %s", em.providers[source], backend))
+	}
+	if _, historical := utils.EvaluationTime(ctx); historical {
+		if hs, ok := source.(HistoricalMetricSource); !ok || !hs.QueriesAtEvaluationTime() {
+			return nil, apierr.NewBadRequest(fmt.Sprintf("metric %s can't be queried at a past time", info.Metric))
+		}
+		// a past value is neither the last known value of the metric, nor replaced by it
+		values, err := source.GetExternalMetric(ctx, info, namespace, requirements)
+		return resolveNoInstances(info, em.settings.Of(info.Metric).NoInstancesPolicy(), values, err)
+	}
+	values, err := source.GetExternalMetric(ctx, info, namespace, requirements)
+	// a short gap of the metric is bridged by its last known values before the policy applies
+	values, err = em.lastKnownValues.resolve(info, namespace, requirements, values, err)
+	return resolveNoInstances(info, em.settings.Of(info.Metric).NoInstancesPolicy(), values, err)
+}
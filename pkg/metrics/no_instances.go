@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// resolveNoInstances answers a query whose selector matches no instance according to the policy
+// of the metric, one of utils.NoInstancesPolicies. The other results are returned as they are.
+func resolveNoInstances(info p.ExternalMetricInfo, policy string, values []external_metrics.ExternalMetricValue, err error) ([]external_metrics.ExternalMetricValue, error) {
+	if !errors.Is(err, utils.ErrNoInstances) {
+		return values, err
+	}
+	switch policy {
+	case utils.NoInstancesZero:
+		return []external_metrics.ExternalMetricValue{{
+			MetricName: info.Metric,
+			Timestamp:  metav1.Now(),
+			Value:      *resource.NewQuantity(0, resource.DecimalSI),
+		}}, nil
+	case utils.NoInstancesError:
+		return nil, apierr.NewInternalError(fmt.Errorf("metric %s: %v", info.Metric, err))
+	default:
+		return nil, apierr.NewNotFound(external_metrics.Resource(info.Metric), err.Error())
+	}
+}
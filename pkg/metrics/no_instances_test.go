@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// deletedMetricSource matches no instance, as if the workload had been deleted.
+type deletedMetricSource struct{}
+
+func (s *deletedMetricSource) GetExternalMetricInfoList() []p.ExternalMetricInfo {
+	return []p.ExternalMetricInfo{{Metric: testMetric}}
+}
+
+func (s *deletedMetricSource) GetExternalMetric(_ context.Context, _ p.ExternalMetricInfo, _ string, _ labels.Requirements) ([]external_metrics.ExternalMetricValue, error) {
+	return nil, fmt.Errorf("no application group for workload default/web: %w", utils.ErrNoInstances)
+}
+
+// noInstancesSettings answer the requests of the test metric whose selector matches no instance by the policy.
+func noInstancesSettings(policy string) *utils.ExternalMetricSettings {
+	return &utils.ExternalMetricSettings{Metrics: map[string]utils.MetricSettings{testMetric: {NoInstances: policy}}}
+}
+
+func TestNoInstancesPolicies(t *testing.T) {
+	info := p.ExternalMetricInfo{Metric: testMetric}
+
+	for _, policy := range append([]string{""}, utils.NoInstancesPolicies...) {
+		em := newExternalMetricsManager(clock.NewFakeClock(time.Now()))
+		em.AddMetricsSource("test", &deletedMetricSource{})
+		em.SetMetricSettings(noInstancesSettings(policy))
+
+		values, err := em.GetExternalMetrics(context.TODO(), "default", testRequirements(t), info)
+		switch policy {
+		case "", utils.NoInstancesNotFound:
+			if !apierr.IsNotFound(err) {
+				t.Errorf("expected a not found error with policy %q, got %v (%v)", policy, values, err)
+			}
+		case utils.NoInstancesZero:
+			if err != nil || len(values) != 1 || values[0].MetricName != testMetric || !values[0].Value.IsZero() {
+				t.Errorf("expected a single zero value with policy %q, got %v (%v)", policy, values, err)
+			}
+		case utils.NoInstancesError:
+			if !apierr.IsInternalError(err) {
+				t.Errorf("expected a server error with policy %q, got %v (%v)", policy, values, err)
+			}
+		}
+	}
+}
+
+func TestNoInstancesPolicyAfterGracePeriod(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	em := newExternalMetricsManager(fakeClock)
+	em.AddMetricsSource("test", &deletedMetricSource{})
+	em.SetMetricsConfig([]config.ExternalMetric{{Name: testMetric, NoDataGracePeriod: time.Minute}})
+	em.SetMetricSettings(noInstancesSettings(utils.NoInstancesZero))
+
+	// the policy applies to the errors the grace period doesn't bridge
+	values, err := em.GetExternalMetrics(context.TODO(), "default", testRequirements(t), p.ExternalMetricInfo{Metric: testMetric})
+	if err != nil || len(values) != 1 || !values[0].Value.IsZero() {
+		t.Errorf("expected a zero value without last known value, got %v (%v)", values, err)
+	}
+}
+
+// laggingMetricSource has no data points yet, as when CMS is lagging.
+type laggingMetricSource struct {
+	deletedMetricSource
+}
+
+func (s *laggingMetricSource) GetExternalMetric(_ context.Context, _ p.ExternalMetricInfo, _ string, _ labels.Requirements) ([]external_metrics.ExternalMetricValue, error) {
+	return nil, fmt.Errorf("datapoint is empty: %w", utils.ErrNoDataPoints)
+}
+
+func TestNoInstancesPolicyLeavesEmptyDataPoints(t *testing.T) {
+	em := newExternalMetricsManager(clock.NewFakeClock(time.Now()))
+	em.AddMetricsSource("test", &laggingMetricSource{})
+	em.SetMetricSettings(noInstancesSettings(utils.NoInstancesZero))
+
+	// a lagging CMS must not read as 0, which would scale the workload in
+	values, err := em.GetExternalMetrics(context.TODO(), "default", testRequirements(t), p.ExternalMetricInfo{Metric: testMetric})
+	if err == nil {
+		t.Errorf("expected instances without data points to fail rather than be 0 with policy zero, got %v", values)
+	}
+}
+
+func TestNoInstancesPolicyLeavesOtherErrors(t *testing.T) {
+	em, source, _ := newGappyManager(0)
+	em.SetMetricSettings(noInstancesSettings(utils.NoInstancesZero))
+	source.noData = true
+
+	if _, err := em.GetExternalMetrics(context.TODO(), "default", testRequirements(t), p.ExternalMetricInfo{Metric: testMetric}); err == nil {
+		t.Errorf("expected an error other than no instances to be returned as it is")
+	}
+}
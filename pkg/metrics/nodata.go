@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	log "k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// StaleLabel flags the values which are returned during the no data grace period of a metric.
+const StaleLabel = "stale"
+
+type lastKnownValue struct {
+	values    []external_metrics.ExternalMetricValue
+	timestamp time.Time
+}
+
+// lastKnownValues keeps the last values of the metrics with a no data grace period, so
+// that a short gap of the metric source doesn't make the metric unavailable right away.
+type lastKnownValues struct {
+	lock         sync.Mutex
+	clock        clock.Clock
+	gracePeriods map[string]time.Duration
+	values       map[string]lastKnownValue
+}
+
+func newLastKnownValues(clock clock.Clock) *lastKnownValues {
+	return &lastKnownValues{
+		clock:        clock,
+		gracePeriods: make(map[string]time.Duration),
+		values:       make(map[string]lastKnownValue),
+	}
+}
+
+func (l *lastKnownValues) setGracePeriods(gracePeriods map[string]time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.gracePeriods = gracePeriods
+	l.values = make(map[string]lastKnownValue)
+}
+
+// resolve records the values of a successful query, or falls back to the last known values
+// flagged as stale if the query has no data and the grace period of the metric isn't over yet.
+// A query which is wrong, e.g. its selector is invalid or matches a metric which doesn't exist,
+// fails right away: the last known values would hide the error for the whole grace period.
+func (l *lastKnownValues) resolve(info p.ExternalMetricInfo, namespace string, requirements labels.Requirements, values []external_metrics.ExternalMetricValue, err error) ([]external_metrics.ExternalMetricValue, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	gracePeriod := l.gracePeriods[info.Metric]
+	if gracePeriod <= 0 {
+		return values, err
+	}
+
+	key := info.Metric + "/" + namespace + "/" + labels.NewSelector().Add(requirements...).String()
+	now := l.clock.Now()
+	if err == nil && len(values) > 0 {
+		l.values[key] = lastKnownValue{values: values, timestamp: now}
+		return values, nil
+	}
+	if isQueryError(err) {
+		return values, err
+	}
+
+	last, found := l.values[key]
+	if !found || now.Sub(last.timestamp) > gracePeriod {
+		delete(l.values, key)
+		return values, err
+	}
+
+	log.V(4).Infof("Metric %s has no data, returning the value from %v as stale, because of %v", info.Metric, last.timestamp, err)
+	stale := make([]external_metrics.ExternalMetricValue, 0, len(last.values))
+	for _, value := range last.values {
+		metricLabels := make(map[string]string, len(value.MetricLabels)+1)
+		for k, v := range value.MetricLabels {
+			metricLabels[k] = v
+		}
+		metricLabels[StaleLabel] = "true"
+		value.MetricLabels = metricLabels
+		stale = append(stale, value)
+	}
+	return stale, nil
+}
+
+// isQueryError tells whether the error is one of the query rather than a gap of the metric source,
+// e.g. a bad request or a metric which isn't found.
+func isQueryError(err error) bool {
+	switch apierr.ReasonForError(err) {
+	case metav1.StatusReasonBadRequest, metav1.StatusReasonNotFound, metav1.StatusReasonInvalid,
+		metav1.StatusReasonForbidden, metav1.StatusReasonUnauthorized, metav1.StatusReasonMethodNotAllowed:
+		return true
+	}
+	return false
+}
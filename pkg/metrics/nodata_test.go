@@ -0,0 +1,183 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+const testMetric = "k8s_workload_cpu_util"
+
+// gappyMetricSource returns a value unless it's told to have no data, or to fail with an error.
+type gappyMetricSource struct {
+	noData bool
+	err    error
+}
+
+func (s *gappyMetricSource) GetExternalMetricInfoList() []p.ExternalMetricInfo {
+	return []p.ExternalMetricInfo{{Metric: testMetric}}
+}
+
+func (s *gappyMetricSource) GetExternalMetric(_ context.Context, info p.ExternalMetricInfo, _ string, _ labels.Requirements) ([]external_metrics.ExternalMetricValue, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	if s.noData {
+		return nil, errors.New("datapoint is empty")
+	}
+	return []external_metrics.ExternalMetricValue{{
+		MetricName: info.Metric,
+		Value:      *resource.NewQuantity(42, resource.DecimalSI),
+	}}, nil
+}
+
+func newGappyManager(gracePeriod time.Duration) (*ExternalMetricsManager, *gappyMetricSource, *clock.FakeClock) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	em := newExternalMetricsManager(fakeClock)
+	source := &gappyMetricSource{}
+	em.AddMetricsSource("test", source)
+	em.SetMetricsConfig([]config.ExternalMetric{{Name: testMetric, NoDataGracePeriod: gracePeriod}})
+	return em, source, fakeClock
+}
+
+func testRequirements(t *testing.T) labels.Requirements {
+	r, err := labels.NewRequirement("k8s.workload.name", selection.Equals, []string{"web"})
+	if err != nil {
+		t.Fatalf("Failed to create requirement, because of %v", err)
+	}
+	return labels.Requirements{*r}
+}
+
+func TestNoDataInsideGracePeriod(t *testing.T) {
+	em, source, fakeClock := newGappyManager(2 * time.Minute)
+	info := p.ExternalMetricInfo{Metric: testMetric}
+
+	values, err := em.GetExternalMetrics(context.TODO(), "default", testRequirements(t), info)
+	if err != nil || len(values) != 1 {
+		t.Fatalf("expected a value, got %v (%v)", values, err)
+	}
+	if values[0].MetricLabels[StaleLabel] != "" {
+		t.Errorf("expected a fresh value not to be flagged as stale")
+	}
+
+	source.noData = true
+	fakeClock.Step(time.Minute)
+	values, err = em.GetExternalMetrics(context.TODO(), "default", testRequirements(t), info)
+	if err != nil {
+		t.Fatalf("expected the last known value inside the grace period, got %v", err)
+	}
+	if len(values) != 1 || values[0].Value.Value() != 42 || values[0].MetricLabels[StaleLabel] != "true" {
+		t.Errorf("expected the last known value flagged as stale, got %v", values)
+	}
+}
+
+func TestNoDataOutsideGracePeriod(t *testing.T) {
+	em, source, fakeClock := newGappyManager(2 * time.Minute)
+	info := p.ExternalMetricInfo{Metric: testMetric}
+
+	if _, err := em.GetExternalMetrics(context.TODO(), "default", testRequirements(t), info); err != nil {
+		t.Fatalf("Failed to get metric, because of %v", err)
+	}
+
+	source.noData = true
+	fakeClock.Step(3 * time.Minute)
+	if _, err := em.GetExternalMetrics(context.TODO(), "default", testRequirements(t), info); err == nil {
+		t.Errorf("expected the metric to be unavailable after the grace period")
+	}
+}
+
+func TestNoDataGracePeriodUpstreamErrors(t *testing.T) {
+	info := p.ExternalMetricInfo{Metric: testMetric}
+	for _, tc := range []struct {
+		err   error
+		stale bool
+	}{
+		{apierr.NewServiceUnavailable("cms api is throttling"), true},
+		{apierr.NewInternalError(errors.New("connection reset by peer")), true},
+		{apierr.NewBadRequest("invalid query of metric"), false},
+		{apierr.NewNotFound(external_metrics.Resource(testMetric), "resource not found"), false},
+		{apierr.NewForbidden(external_metrics.Resource(testMetric), testMetric, errors.New("no permission")), false},
+	} {
+		em, source, fakeClock := newGappyManager(2 * time.Minute)
+		if _, err := em.GetExternalMetrics(context.TODO(), "default", testRequirements(t), info); err != nil {
+			t.Fatalf("Failed to get metric, because of %v", err)
+		}
+
+		source.err = tc.err
+		fakeClock.Step(time.Minute)
+		values, err := em.GetExternalMetrics(context.TODO(), "default", testRequirements(t), info)
+		if tc.stale && (err != nil || len(values) != 1 || values[0].MetricLabels[StaleLabel] != "true") {
+			t.Errorf("expected the last known value to bridge %v, got %v (%v)", tc.err, values, err)
+		}
+		if !tc.stale && err == nil {
+			t.Errorf("expected %v to fail the request inside the grace period, got %v", tc.err, values)
+		}
+	}
+}
+
+func TestNoDataWithoutGracePeriod(t *testing.T) {
+	em, source, _ := newGappyManager(0)
+	info := p.ExternalMetricInfo{Metric: testMetric}
+
+	if _, err := em.GetExternalMetrics(context.TODO(), "default", testRequirements(t), info); err != nil {
+		t.Fatalf("Failed to get metric, because of %v", err)
+	}
+
+	source.noData = true
+	if _, err := em.GetExternalMetrics(context.TODO(), "default", testRequirements(t), info); err == nil {
+		t.Errorf("expected the metric to be unavailable right away without grace period")
+	}
+}
+
+// prefixMetricSource serves every metric under its prefix.
+type prefixMetricSource struct {
+	gappyMetricSource
+}
+
+func (s *prefixMetricSource) MetricPrefix() string {
+	return "custom_"
+}
+
+func (s *prefixMetricSource) GetExternalMetricInfoList() []p.ExternalMetricInfo {
+	return []p.ExternalMetricInfo{{Metric: "custom_qps"}}
+}
+
+func TestPrefixMetricSource(t *testing.T) {
+	em := newExternalMetricsManager(clock.NewFakeClock(time.Now()))
+	em.AddMetricsSource("test", &gappyMetricSource{})
+	em.AddMetricsSource("test", &prefixMetricSource{})
+
+	if list := em.GetMetricsInfoList(); len(list) != 2 {
+		t.Errorf("expected the metrics of the prefix source to be listed, got %v", list)
+	}
+
+	values, err := em.GetExternalMetrics(context.TODO(), "default", testRequirements(t), p.ExternalMetricInfo{Metric: "custom_latency"})
+	if err != nil || len(values) != 1 || values[0].MetricName != "custom_latency" {
+		t.Errorf("expected a metric under the prefix to be served, got %v (%v)", values, err)
+	}
+
+	if _, err := em.GetExternalMetrics(context.TODO(), "default", testRequirements(t), p.ExternalMetricInfo{Metric: "unknown"}); err == nil {
+		t.Errorf("expected an unknown metric to be rejected")
+	}
+}
+
+func TestEvaluationTimeUnsupported(t *testing.T) {
+	em, _, _ := newGappyManager(0)
+	ctx := utils.WithEvaluationTime(context.TODO(), time.Now().Add(-time.Hour))
+
+	_, err := em.GetExternalMetrics(ctx, "default", testRequirements(t), p.ExternalMetricInfo{Metric: testMetric})
+	if !apierr.IsBadRequest(err) {
+		t.Errorf("expected a source without past values to reject the request, got %v", err)
+	}
+}
@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/clock"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+func TestDisabledProviderNotFound(t *testing.T) {
+	em := newExternalMetricsManager(clock.NewFakeClock(time.Now()))
+	em.AddMetricsSource("toggled", &gappyMetricSource{})
+	t.Cleanup(func() { utils.SetProviderEnabled("toggled", true) })
+	info := p.ExternalMetricInfo{Metric: testMetric}
+
+	if err := utils.SetProviderEnabled("toggled", false); err != nil {
+		t.Fatalf("Failed to disable provider, because of %v", err)
+	}
+	if values, err := em.GetExternalMetrics(context.TODO(), "default", testRequirements(t), info); !apierr.IsNotFound(err) {
+		t.Errorf("expected the metric of a disabled provider not to be found, got %v (%v)", values, err)
+	}
+
+	if err := utils.SetProviderEnabled("toggled", true); err != nil {
+		t.Fatalf("Failed to enable provider, because of %v", err)
+	}
+	if values, err := em.GetExternalMetrics(context.TODO(), "default", testRequirements(t), info); err != nil || len(values) != 1 {
+		t.Errorf("expected the metric of an enabled provider to be served, got %v (%v)", values, err)
+	}
+}
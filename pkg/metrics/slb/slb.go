@@ -1,10 +1,12 @@
 package slb
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
 
@@ -16,7 +18,6 @@ import (
 	"time"
 
 	"k8s.io/apimachinery/pkg/api/resource"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	log "k8s.io/klog/v2"
 	"k8s.io/metrics/pkg/apis/external_metrics"
 )
@@ -47,7 +48,21 @@ const (
 	MIN_PERIOD = 60
 )
 
-type SLBMetricSource struct{}
+// metricListClient is the part of the cms client used by the slb metrics.
+type metricListClient interface {
+	DescribeMetricList(request *cms.DescribeMetricListRequest) (*cms.DescribeMetricListResponse, error)
+}
+
+type SLBMetricSource struct {
+	// newClient replaces Client if set
+	newClient func() (metricListClient, error)
+	settings *utils.ExternalMetricSettings
+}
+
+// SetMetricSettings sets the periods and statistics of the slb metrics.
+func (sb *SLBMetricSource) SetMetricSettings(settings *utils.ExternalMetricSettings) {
+	sb.settings = settings
+}
 
 //list all external metric
 func (sb *SLBMetricSource) GetExternalMetricInfoList() []p.ExternalMetricInfo {
@@ -79,40 +94,43 @@ func (sb *SLBMetricSource) GetExternalMetricInfoList() []p.ExternalMetricInfo {
 }
 
 //according to the incoming label, get the metric..
-func (sb *SLBMetricSource) GetExternalMetric(info p.ExternalMetricInfo, namespace string, requirements labels.Requirements) (values []external_metrics.ExternalMetricValue, err error) {
+func (sb *SLBMetricSource) GetExternalMetric(ctx context.Context, info p.ExternalMetricInfo, namespace string, requirements labels.Requirements) (values []external_metrics.ExternalMetricValue, err error) {
+	ctx, cancel := utils.WithBackendTimeout(ctx, utils.CMSBackend)
+	defer cancel()
+
 	switch info.Metric {
 	case SLB_L4_TRAFFIC_RX:
-		values, err = sb.getSLBMetrics(namespace, "TrafficRXNew", SLB_L4_TRAFFIC_RX, requirements)
+		values, err = sb.getSLBMetrics(ctx, namespace, "TrafficRXNew", SLB_L4_TRAFFIC_RX, requirements)
 	case SLB_L4_TRAFFIC_TX:
-		values, err = sb.getSLBMetrics(namespace, "TrafficTXNew", SLB_L4_TRAFFIC_TX, requirements)
+		values, err = sb.getSLBMetrics(ctx, namespace, "TrafficTXNew", SLB_L4_TRAFFIC_TX, requirements)
 	case SLB_L4_PACKET_TX:
-		values, err = sb.getSLBMetrics(namespace, "PacketTX", SLB_L4_PACKET_TX, requirements)
+		values, err = sb.getSLBMetrics(ctx, namespace, "PacketTX", SLB_L4_PACKET_TX, requirements)
 	case SLB_L4_PACKET_RX:
-		values, err = sb.getSLBMetrics(namespace, "PacketRX", SLB_L4_PACKET_RX, requirements)
+		values, err = sb.getSLBMetrics(ctx, namespace, "PacketRX", SLB_L4_PACKET_RX, requirements)
 	case SLB_L4_ACTIVE_CONNECTION:
-		values, err = sb.getSLBMetrics(namespace, "ActiveConnection", SLB_L4_ACTIVE_CONNECTION, requirements)
+		values, err = sb.getSLBMetrics(ctx, namespace, "ActiveConnection", SLB_L4_ACTIVE_CONNECTION, requirements)
 	case SLB_L4_MAX_CONNECTION:
-		values, err = sb.getSLBMetrics(namespace, "MaxConnection", SLB_L4_MAX_CONNECTION, requirements)
+		values, err = sb.getSLBMetrics(ctx, namespace, "MaxConnection", SLB_L4_MAX_CONNECTION, requirements)
 	case SLB_L4_CONNECTION_UTILIZATION:
-		values, err = sb.getSLBMetrics(namespace, "InstanceMaxConnectionUtilization", SLB_L4_CONNECTION_UTILIZATION, requirements)
+		values, err = sb.getSLBMetrics(ctx, namespace, "InstanceMaxConnectionUtilization", SLB_L4_CONNECTION_UTILIZATION, requirements)
 	case SLB_L7_QPS:
-		values, err = sb.getSLBMetrics(namespace, "Qps", SLB_L7_QPS, requirements)
+		values, err = sb.getSLBMetrics(ctx, namespace, "Qps", SLB_L7_QPS, requirements)
 	case SLB_L7_RT:
-		values, err = sb.getSLBMetrics(namespace, "Rt", SLB_L7_RT, requirements)
+		values, err = sb.getSLBMetrics(ctx, namespace, "Rt", SLB_L7_RT, requirements)
 	case SLB_L7_STATUS_2XX:
-		values, err = sb.getSLBMetrics(namespace, "StatusCode2xx", SLB_L7_STATUS_2XX, requirements)
+		values, err = sb.getSLBMetrics(ctx, namespace, "StatusCode2xx", SLB_L7_STATUS_2XX, requirements)
 	case SLB_L7_STATUS_3XX:
-		values, err = sb.getSLBMetrics(namespace, "StatusCode3xx", SLB_L7_STATUS_3XX, requirements)
+		values, err = sb.getSLBMetrics(ctx, namespace, "StatusCode3xx", SLB_L7_STATUS_3XX, requirements)
 	case SLB_L7_STATUS_4XX:
-		values, err = sb.getSLBMetrics(namespace, "StatusCode4xx", SLB_L7_STATUS_4XX, requirements)
+		values, err = sb.getSLBMetrics(ctx, namespace, "StatusCode4xx", SLB_L7_STATUS_4XX, requirements)
 	case SLB_L7_STATUS_5XX:
-		values, err = sb.getSLBMetrics(namespace, "StatusCode5xx", SLB_L7_STATUS_5XX, requirements)
+		values, err = sb.getSLBMetrics(ctx, namespace, "StatusCode5xx", SLB_L7_STATUS_5XX, requirements)
 	case SLB_L7_UPSTREAM_4XX:
-		values, err = sb.getSLBMetrics(namespace, "UpstreamCode4xx", SLB_L7_UPSTREAM_4XX, requirements)
+		values, err = sb.getSLBMetrics(ctx, namespace, "UpstreamCode4xx", SLB_L7_UPSTREAM_4XX, requirements)
 	case SLB_L7_UPSTREAM_5XX:
-		values, err = sb.getSLBMetrics(namespace, "UpstreamCode5xx", SLB_L7_UPSTREAM_5XX, requirements)
+		values, err = sb.getSLBMetrics(ctx, namespace, "UpstreamCode5xx", SLB_L7_UPSTREAM_5XX, requirements)
 	case SLB_L7_UPSTREAM_RT:
-		values, err = sb.getSLBMetrics(namespace, "UpstreamRt", SLB_L7_UPSTREAM_RT, requirements)
+		values, err = sb.getSLBMetrics(ctx, namespace, "UpstreamRt", SLB_L7_UPSTREAM_RT, requirements)
 	}
 	if err != nil {
 		log.Warningf("Failed to GetExternalMetric %s,because of %v", info.Metric, err)
@@ -120,6 +138,11 @@ func (sb *SLBMetricSource) GetExternalMetric(info p.ExternalMetricInfo, namespac
 	return values, err
 }
 
+// QueriesAtEvaluationTime tells that CMS is queried for the SLB metrics at a past time, see utils.EvaluationTime.
+func (sb *SLBMetricSource) QueriesAtEvaluationTime() bool {
+	return true
+}
+
 //the client of slb
 func (sb *SLBMetricSource) Client() (client *cms.Client, err error) {
 
@@ -135,14 +158,25 @@ func (sb *SLBMetricSource) Client() (client *cms.Client, err error) {
 		client, err = cms.NewClientWithAccessKey(accessUserInfo.Region, accessUserInfo.AccessKeyId, accessUserInfo.AccessKeySecret)
 
 	}
+	if err == nil {
+		utils.ApplySDKTransport(client)
+		utils.ApplyEndpointOverride(&client.Client, utils.CMSBackend, accessUserInfo.Region)
+	}
 	return client, err
 
 }
 
 // Global params
 type SLBGlobalParams struct {
-	InstanceId string `json:"instanceId"`
-	Port       string `json:"port"`
+	InstanceIds []string `json:"instanceIds"`
+	Port        string   `json:"port"`
+}
+
+func (sb *SLBMetricSource) client() (metricListClient, error) {
+	if sb.newClient != nil {
+		return sb.newClient()
+	}
+	return sb.Client()
 }
 
 //
@@ -156,59 +190,111 @@ type SLBParams struct {
 }
 
 //get the slb specific metric values
-func (sms *SLBMetricSource) getSLBMetrics(namespace, metric, externalMetric string, requirements labels.Requirements) (values []external_metrics.ExternalMetricValue, err error) {
+func (sms *SLBMetricSource) getSLBMetrics(ctx context.Context, namespace, metric, externalMetric string, requirements labels.Requirements) (values []external_metrics.ExternalMetricValue, err error) {
 	namespace = "acs_slb_dashboard"
 
-	params, err := getSLBParams(requirements)
+	settings := sms.settings.Of(externalMetric)
+	params, err := getSLBParams(requirements, settings.CMSPeriod())
 	if err != nil {
 		return values, fmt.Errorf("failed to get slb params,because of %v", err)
 	}
 
-	client, err := sms.Client()
+	client, err := sms.client()
 	if err != nil {
 		log.Errorf("Failed to create slb client,because of %v", err)
 		return values, err
 	}
 
-	request := cms.CreateDescribeMetricListRequest()
-	request.Scheme = "https"
-	request.Namespace = namespace
-	request.MetricName = metric
+	statistic := settings.CMSStatistic(utils.DefaultCMSStatistic)
 
 	//time range
-	endTime := time.Now().Add(-2 * time.Minute)
-	startTime := endTime.Add(-1 * time.Duration(params.Period) * time.Second)
+	startTime, endTime := utils.AlignedTimeRange(utils.QueryTime(ctx).Add(-2*time.Minute), params.Period, 1)
 	//make ensure that the starttime minus Endtime is greater than period.
 	err = utils.JudgeWithPeriod(startTime, endTime, params.Period)
 	if err != nil {
 		return values, err
 	}
 
-	request.StartTime = startTime.Format(utils.DEFAULT_TIME_FORMAT)
-	request.EndTime = endTime.Format(utils.DEFAULT_TIME_FORMAT)
+	// several instances are queried by a single call, the remaining calls run in parallel
+	var lock sync.Mutex
+	instanceValues := make(map[string]float64, len(params.InstanceIds))
+	instanceTimestamps := make(map[string]int64, len(params.InstanceIds))
+	batchSize, concurrency := utils.CMSBatching()
+	err = utils.RunBatches(ctx, params.InstanceIds, batchSize, concurrency, func(ctx context.Context, instanceIds []string) error {
+		request := cms.CreateDescribeMetricListRequest()
+		request.Scheme = "https"
+		request.Namespace = namespace
+		request.MetricName = metric
+		request.Period = strconv.Itoa(params.Period)
+		request.StartTime = startTime.Format(utils.DEFAULT_TIME_FORMAT)
+		request.EndTime = endTime.Format(utils.DEFAULT_TIME_FORMAT)
+
+		dimensions, err := createDimensions(instanceIds, params.Port)
+		if err != nil {
+			log.Errorf("Dimensions conversion to json failed: %v", err)
+			return err
+		}
+		request.Dimensions = dimensions
+		if err = utils.SetRequestDeadline(ctx, request); err != nil {
+			log.Errorf("Failed to get slb response,err: %v", err)
+			return err
+		}
+		release, err := utils.AcquireBackend(ctx, utils.CMSBackend)
+		if err != nil {
+			return err
+		}
+		response, err := client.DescribeMetricList(request)
+		release()
+		if err != nil {
+			log.Errorf("Failed to get slb response,err: %v", err)
+			return err
+		}
+
+		metricValues, timestamps, err := getMetricFromDataPoints(response.Datapoints, instanceIds, statistic)
+		if err != nil {
+			log.Errorf("Failed to get slb metrics from api,because of %v", err)
+			return err
+		}
 
-	dimensions, err := createDimensions(params.InstanceId, params.Port)
+		lock.Lock()
+		defer lock.Unlock()
+		for instanceId, value := range metricValues {
+			instanceValues[instanceId] = value
+			instanceTimestamps[instanceId] = timestamps[instanceId]
+		}
+		return nil
+	})
 	if err != nil {
-		log.Errorf("Dimensions conversion to json failed: %v", err)
 		return values, err
 	}
-	request.Dimensions = dimensions
-	response, err := client.DescribeMetricList(request)
-	if err != nil {
-		log.Errorf("Failed to get slb response,err: %v", err)
-		return values, err
+	if len(instanceValues) == 0 {
+		// the instances may have been deleted, or CMS is lagging, which can't be told apart
+		return values, fmt.Errorf("slb instances %v: %w", params.InstanceIds, utils.ErrNoDataPoints)
 	}
 
-	metricValue, err := getMetricFromDataPoints(response.Datapoints)
-	if err != nil {
-		log.Errorf("Failed to get slb metrics from api,because of %v", err)
-		return values, err
+	// the values are as old as their data points, an instance without any is as old as the latest one
+	var latest int64
+	for _, timestamp := range instanceTimestamps {
+		if timestamp > latest {
+			latest = timestamp
+		}
 	}
-	values = append(values, external_metrics.ExternalMetricValue{
-		MetricName: externalMetric,
-		Value:      *resource.NewQuantity(int64(metricValue), resource.DecimalSI),
-		Timestamp:  metav1.Now(),
-	})
+	now := time.Now()
+	for _, instanceId := range params.InstanceIds {
+		// an instance without data points has no traffic
+		metricValue := instanceValues[instanceId]
+		timestamp, found := instanceTimestamps[instanceId]
+		if !found {
+			timestamp = latest
+		}
+		values = append(values, external_metrics.ExternalMetricValue{
+			MetricName:   externalMetric,
+			MetricLabels: map[string]string{SLB_INSTANCE_ID: instanceId},
+			Value:        *resource.NewQuantity(int64(metricValue), resource.DecimalSI),
+			Timestamp:    utils.DataPointTime(timestamp, now),
+		})
+	}
+	utils.SetWindowLabel(values, params.Period)
 	return values, nil
 }
 
@@ -218,8 +304,12 @@ type Dimensions struct {
 	Port       string `json:"port"`
 }
 
-func createDimensions(instanceId, port string) (string, error) {
-	dimensions := &Dimensions{instanceId, port}
+// createDimensions selects the port of every instance, all of them are queried at once.
+func createDimensions(instanceIds []string, port string) (string, error) {
+	dimensions := make([]Dimensions, 0, len(instanceIds))
+	for _, instanceId := range instanceIds {
+		dimensions = append(dimensions, Dimensions{instanceId, port})
+	}
 	dimensionsByte, err := json.Marshal(dimensions)
 	if err != nil {
 		log.Errorf("dimensions To json err: %v", err)
@@ -229,9 +319,10 @@ func createDimensions(instanceId, port string) (string, error) {
 }
 
 //get the slb Params
-func getSLBParams(requirements labels.Requirements) (params *SLBParams, err error) {
+// getSLBParams parses the selector of a request, period is used unless the selector sets one.
+func getSLBParams(requirements labels.Requirements, period int) (params *SLBParams, err error) {
 	params = &SLBParams{
-		Period: MIN_PERIOD,
+		Period: period,
 	}
 	for _, r := range requirements {
 
@@ -243,7 +334,8 @@ func getSLBParams(requirements labels.Requirements) (params *SLBParams, err erro
 
 		switch r.Key() {
 		case SLB_INSTANCE_ID:
-			params.InstanceId = value
+			// slb.instance.id in (a,b) selects several instances
+			params.InstanceIds = r.Values().List()
 		case SLB_PORT:
 			params.Port = value
 		case SLB_PERIOD:
@@ -253,7 +345,7 @@ func getSLBParams(requirements labels.Requirements) (params *SLBParams, err erro
 			}
 		}
 	}
-	if params.InstanceId == "" || params.Port == "" {
+	if len(params.InstanceIds) == 0 || params.Port == "" {
 		return params, errors.New("InstanceId and Port must be provide")
 	}
 
@@ -266,26 +358,56 @@ func getSLBParams(requirements labels.Requirements) (params *SLBParams, err erro
 }
 
 type DataPoint struct {
-	Timestamp int64   `json:"timestamp"`
-	Vip       string  `json:"vip,omitempty"`
-	Average   float64 `json:"Average"`
-	Minimum   float64 `json:"Minimum"`
-	Maximum   float64 `json:"Maximum"`
+	Timestamp  int64   `json:"timestamp"`
+	InstanceId string  `json:"instanceId,omitempty"`
+	Vip        string  `json:"vip,omitempty"`
+	Average    float64 `json:"Average"`
+	Minimum    float64 `json:"Minimum"`
+	Maximum    float64 `json:"Maximum"`
+	Value      float64 `json:"Value"`
+}
+
+// statistic returns the given statistic of the data point, one of utils.CMSStatistics.
+func (point DataPoint) statistic(name string) float64 {
+	switch name {
+	case utils.CMSStatisticMaximum:
+		return point.Maximum
+	case utils.CMSStatisticMinimum:
+		return point.Minimum
+	case utils.CMSStatisticValue:
+		return point.Value
+	default:
+		return point.Average
+	}
 }
 
-// extract metric data points
-func getMetricFromDataPoints(datapoints string) (value float64, err error) {
+// extract the latest value of the statistic of every instance from the data points, and its timestamp in milliseconds
+func getMetricFromDataPoints(datapoints string, instanceIds []string, statistic string) (values map[string]float64, timestamps map[string]int64, err error) {
 	if datapoints == "" {
-		return 0, errors.New("NoMetricData")
+		return nil, nil, utils.ErrNoDataPoints
 	}
 
 	points := make([]DataPoint, 0)
 
 	err = json.Unmarshal([]byte(datapoints), &points)
 
-	if err != nil || len(points) == 0 {
-		return 0, err
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return points[len(points)-1].Average, nil
+	values = make(map[string]float64, len(instanceIds))
+	timestamps = make(map[string]int64, len(instanceIds))
+	for _, point := range points {
+		instanceId := point.InstanceId
+		if instanceId == "" && len(instanceIds) == 1 {
+			// a single instance may come back without its id
+			instanceId = instanceIds[0]
+		}
+		if last, found := timestamps[instanceId]; found && last > point.Timestamp {
+			continue
+		}
+		values[instanceId] = point.statistic(statistic)
+		timestamps[instanceId] = point.Timestamp
+	}
+	return values, timestamps, nil
 }
@@ -1,13 +1,24 @@
 package slb
 
 import (
-	"k8s.io/apimachinery/pkg/labels"
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/cms"
+	"k8s.io/apimachinery/pkg/labels"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
 )
 
 func TestInvalidGetSLBParams(t *testing.T) {
 	r := make([]labels.Requirement, 0)
-	_, e := getSLBParams(r)
+	_, e := getSLBParams(r, utils.DefaultCMSPeriod)
 	if e != nil {
 		t.Log("pass TestInvalidGetSLBParams")
 		return
@@ -22,7 +33,7 @@ func TestValidGetSLBParams(t *testing.T) {
 		t.Fatalf("new requirement err: %v", e)
 	}
 	r = append(r, *requirement)
-	_, e = getSLBParams(r)
+	_, e = getSLBParams(r, utils.DefaultCMSPeriod)
 	if e == nil {
 		t.Logf("Pass TstValidGetSLBParams")
 	}
@@ -35,3 +46,210 @@ func TestGetExternalMetricInfoList(t *testing.T) {
 		t.Logf("slb External Metric-Info-List include: %v", info)
 	}
 }
+
+// fakeMetricListClient returns a data point for every instance of the request.
+type fakeMetricListClient struct {
+	lock     sync.Mutex
+	requests []*cms.DescribeMetricListRequest
+}
+
+func (c *fakeMetricListClient) DescribeMetricList(request *cms.DescribeMetricListRequest) (*cms.DescribeMetricListResponse, error) {
+	c.lock.Lock()
+	c.requests = append(c.requests, request)
+	c.lock.Unlock()
+
+	var dimensions []Dimensions
+	if err := json.Unmarshal([]byte(request.Dimensions), &dimensions); err != nil {
+		return nil, err
+	}
+	points := make([]DataPoint, 0)
+	for _, d := range dimensions {
+		// the value of an instance is its number, e.g. 3 for lb-3
+		value, _ := strconv.Atoi(strings.TrimPrefix(d.InstanceId, "lb-"))
+		points = append(points,
+			DataPoint{Timestamp: 1620000000000, InstanceId: d.InstanceId, Average: 1000},
+			DataPoint{Timestamp: 1620000060000, InstanceId: d.InstanceId, Average: float64(value)})
+	}
+	datapoints, _ := json.Marshal(points)
+	return &cms.DescribeMetricListResponse{Success: true, Datapoints: string(datapoints)}, nil
+}
+
+func TestGetSLBMetricsOfSeveralInstances(t *testing.T) {
+	utils.SetCMSBatching(2, 2)
+	defer utils.SetCMSBatching(utils.DefaultCMSBatchSize, utils.DefaultCMSConcurrency)
+
+	client := &fakeMetricListClient{}
+	source := &SLBMetricSource{newClient: func() (metricListClient, error) { return client, nil }}
+
+	selector, err := labels.Parse("slb.instance.id in (lb-1,lb-2,lb-3,lb-4,lb-5),slb.instance.port=80")
+	if err != nil {
+		t.Fatalf("Failed to parse selector, because of %v", err)
+	}
+	requirements, _ := selector.Requirements()
+
+	values, err := source.GetExternalMetric(context.TODO(), p.ExternalMetricInfo{Metric: SLB_L7_QPS}, "default", requirements)
+	if err != nil {
+		t.Fatalf("Failed to get slb metrics, because of %v", err)
+	}
+
+	if len(client.requests) != 3 {
+		t.Errorf("expected 5 instances to be queried in 3 batches, got %d requests", len(client.requests))
+	}
+	if len(values) != 5 {
+		t.Fatalf("expected a value per instance, got %v", values)
+	}
+	for _, value := range values {
+		instanceId := value.MetricLabels[SLB_INSTANCE_ID]
+		expected, _ := strconv.Atoi(strings.TrimPrefix(instanceId, "lb-"))
+		if value.Value.Value() != int64(expected) {
+			t.Errorf("expected the latest value %d of instance %s, got %v", expected, instanceId, value.Value.Value())
+		}
+	}
+}
+
+func TestGetSLBMetricsTimestamp(t *testing.T) {
+	source := &SLBMetricSource{newClient: func() (metricListClient, error) { return &fakeMetricListClient{}, nil }}
+	selector, err := labels.Parse("slb.instance.id in (lb-1,lb-2),slb.instance.port=80")
+	if err != nil {
+		t.Fatalf("Failed to parse selector, because of %v", err)
+	}
+	requirements, _ := selector.Requirements()
+
+	values, err := source.GetExternalMetric(context.TODO(), p.ExternalMetricInfo{Metric: SLB_L7_QPS}, "default", requirements)
+	if err != nil {
+		t.Fatalf("Failed to get slb metrics, because of %v", err)
+	}
+	for _, value := range values {
+		if expected := time.Unix(1620000060, 0); !value.Timestamp.Time.Equal(expected) {
+			t.Errorf("expected the time %v of the latest data point, got %v", expected, value.Timestamp.Time)
+		}
+	}
+}
+
+func TestGetMetricFromDataPointsWithoutInstanceId(t *testing.T) {
+	values, _, err := getMetricFromDataPoints(`[{"timestamp":1620000000000,"Average":7}]`, []string{"lb-1"}, utils.DefaultCMSStatistic)
+	if err != nil || values["lb-1"] != 7 {
+		t.Errorf("expected the data point of a single instance to be mapped to it, got %v (%v)", values, err)
+	}
+}
+
+func TestGetMetricFromDataPointsStatistic(t *testing.T) {
+	dataPoints := `[{"timestamp":1620000000000,"instanceId":"lb-1","Average":5,"Maximum":9,"Minimum":2,"Value":4}]`
+	for statistic, expected := range map[string]float64{
+		utils.CMSStatisticAverage: 5,
+		utils.CMSStatisticMaximum: 9,
+		utils.CMSStatisticMinimum: 2,
+		utils.CMSStatisticValue:   4,
+	} {
+		values, _, err := getMetricFromDataPoints(dataPoints, []string{"lb-1"}, statistic)
+		if err != nil || values["lb-1"] != expected {
+			t.Errorf("expected the %s %v to be read, got %v (%v)", statistic, expected, values, err)
+		}
+	}
+}
+
+// emptyMetricListClient returns no data point, as for deleted instances.
+type emptyMetricListClient struct {
+	datapoints string
+}
+
+func (c *emptyMetricListClient) DescribeMetricList(_ *cms.DescribeMetricListRequest) (*cms.DescribeMetricListResponse, error) {
+	return &cms.DescribeMetricListResponse{Success: true, Datapoints: c.datapoints}, nil
+}
+
+func TestGetSLBMetricsOfNoInstances(t *testing.T) {
+	selector, err := labels.Parse("slb.instance.id in (lb-1,lb-2),slb.instance.port=80")
+	if err != nil {
+		t.Fatalf("Failed to parse selector, because of %v", err)
+	}
+	requirements, _ := selector.Requirements()
+
+	for _, datapoints := range []string{"", "[]"} {
+		client := &emptyMetricListClient{datapoints: datapoints}
+		source := &SLBMetricSource{newClient: func() (metricListClient, error) { return client, nil }}
+
+		_, err := source.GetExternalMetric(context.TODO(), p.ExternalMetricInfo{Metric: SLB_L7_QPS}, "default", requirements)
+		if !errors.Is(err, utils.ErrNoDataPoints) || errors.Is(err, utils.ErrNoInstances) {
+			t.Errorf("expected no data points %q not to be taken for no instances, got %v", datapoints, err)
+		}
+	}
+}
+
+func TestSLBMetricPeriod(t *testing.T) {
+	client := &fakeMetricListClient{}
+	source := &SLBMetricSource{newClient: func() (metricListClient, error) { return client, nil }}
+	source.SetMetricSettings(&utils.ExternalMetricSettings{Metrics: map[string]utils.MetricSettings{SLB_L7_QPS: {Period: 300}}})
+
+	for selector, expected := range map[string]string{
+		// the configured period of the metric
+		"slb.instance.id=lb-1,slb.instance.port=80": "300",
+		// the period of the selector takes precedence
+		"slb.instance.id=lb-1,slb.instance.port=80,slb.period=900": "900",
+	} {
+		client.requests = nil
+		s, err := labels.Parse(selector)
+		if err != nil {
+			t.Fatalf("Failed to parse selector, because of %v", err)
+		}
+		requirements, _ := s.Requirements()
+		if _, err := source.GetExternalMetric(context.TODO(), p.ExternalMetricInfo{Metric: SLB_L7_QPS}, "default", requirements); err != nil {
+			t.Fatalf("Failed to get slb metrics, because of %v", err)
+		}
+		if client.requests[0].Period != expected {
+			t.Errorf("expected period %s for selector %s, got %s", expected, selector, client.requests[0].Period)
+		}
+	}
+}
+
+func TestSLBMetricEvaluationTime(t *testing.T) {
+	client := &fakeMetricListClient{}
+	source := &SLBMetricSource{newClient: func() (metricListClient, error) { return client, nil }}
+
+	selector, err := labels.Parse("slb.instance.id=lb-1,slb.instance.port=80")
+	if err != nil {
+		t.Fatalf("Failed to parse selector, because of %v", err)
+	}
+	requirements, _ := selector.Requirements()
+	at := time.Date(2021, 5, 3, 10, 0, 30, 0, time.UTC)
+	ctx := utils.WithEvaluationTime(context.TODO(), at)
+	if _, err := source.GetExternalMetric(ctx, p.ExternalMetricInfo{Metric: SLB_L7_QPS}, "default", requirements); err != nil {
+		t.Fatalf("Failed to get slb metrics, because of %v", err)
+	}
+
+	// the last complete period before the data of the evaluation time is reported
+	startTime, endTime := utils.AlignedTimeRange(at.Add(-2*time.Minute), utils.DefaultCMSPeriod, 1)
+	request := client.requests[0]
+	if request.StartTime != startTime.Format(utils.DEFAULT_TIME_FORMAT) || request.EndTime != endTime.Format(utils.DEFAULT_TIME_FORMAT) {
+		t.Errorf("expected CMS to be queried from %v to %v, got %s to %s", startTime, endTime, request.StartTime, request.EndTime)
+	}
+	if !source.QueriesAtEvaluationTime() {
+		t.Errorf("expected the SLB metrics to be queried at the evaluation time")
+	}
+}
+
+func TestSLBMetricQueryTimeOffset(t *testing.T) {
+	utils.SetQueryTimeOffset(-time.Hour)
+	defer utils.SetQueryTimeOffset(utils.DefaultQueryTimeOffset)
+
+	client := &fakeMetricListClient{}
+	source := &SLBMetricSource{newClient: func() (metricListClient, error) { return client, nil }}
+
+	selector, err := labels.Parse("slb.instance.id=lb-1,slb.instance.port=80")
+	if err != nil {
+		t.Fatalf("Failed to parse selector, because of %v", err)
+	}
+	requirements, _ := selector.Requirements()
+	before := time.Now()
+	if _, err := source.GetExternalMetric(context.TODO(), p.ExternalMetricInfo{Metric: SLB_L7_QPS}, "default", requirements); err != nil {
+		t.Fatalf("Failed to get slb metrics, because of %v", err)
+	}
+	after := time.Now()
+
+	// the period may have changed during the call
+	_, endBefore := utils.AlignedTimeRange(before.Add(-time.Hour-2*time.Minute), utils.DefaultCMSPeriod, 1)
+	_, endAfter := utils.AlignedTimeRange(after.Add(-time.Hour-2*time.Minute), utils.DefaultCMSPeriod, 1)
+	request := client.requests[0]
+	if request.EndTime != endBefore.Format(utils.DEFAULT_TIME_FORMAT) && request.EndTime != endAfter.Format(utils.DEFAULT_TIME_FORMAT) {
+		t.Errorf("expected CMS to be queried until %v, got %s", endBefore, request.EndTime)
+	}
+}
@@ -1,6 +1,7 @@
 package sls
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strconv"
@@ -8,6 +9,7 @@ import (
 
 	"regexp"
 
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
 	slssdk "github.com/aliyun/aliyun-log-go-sdk"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -60,14 +62,14 @@ func (ss *SLSMetricSource) getSLSIngressQuery(params *SLSIngressParams, metricNa
 	return
 }
 
-func (ss *SLSMetricSource) getSLSIngressMetrics(namespace string, requirements labels.Requirements, metricName string) (values []external_metrics.ExternalMetricValue, err error) {
+func (ss *SLSMetricSource) getSLSIngressMetrics(ctx context.Context, namespace string, requirements labels.Requirements, metricName string) (values []external_metrics.ExternalMetricValue, err error) {
 
 	params, err := getSLSParams(requirements)
 	if err != nil {
 		return values, fmt.Errorf("failed to get sls params,because of %v", err)
 	}
 
-	client, err := ss.Client(params.Internal)
+	client, err := ss.Client(ctx, params.Internal)
 	if err != nil {
 		log.Errorf("Failed to create sls client, because of %v", err)
 		return values, err
@@ -82,45 +84,84 @@ func (ss *SLSMetricSource) getSLSIngressMetrics(namespace string, requirements l
 
 	var queryRsp *slssdk.GetLogsResponse
 	for i := 0; i < params.MaxRetry; i++ {
+		if ctx.Err() != nil {
+			return values, fmt.Errorf("query sls aborted, because of %v", ctx.Err())
+		}
+		release, acquireErr := utils.AcquireBackend(ctx, utils.SLSBackend)
+		if acquireErr != nil {
+			return values, acquireErr
+		}
 		queryRsp, err = client.GetLogs(params.Project, params.LogStore, "", begin, end, query, 100, 0, false)
+		release()
 
-		if err != nil || len(queryRsp.Logs) == 0 {
+		if err != nil {
+			utils.ObserveBackendCall(utils.SLSBackend, true)
 			return values, err
 		}
 
 		// if there are too many logs in sls, query may be not completed, we should retry
 		if !queryRsp.IsComplete() {
-			continue
-		}
-
-		value := queryRsp.Logs[0]["value"]
-		var valid = regexp.MustCompile("[0-9.]")
-		array := valid.FindAllStringSubmatch(value, -1)
-
-		valStr := ""
-		for _, i := range array {
-			if len(i) == 1 {
-				valStr += i[0]
+			utils.ObserveBackendCall(utils.SLSBackend, true)
+			if !utils.AllowRetry(utils.SLSBackend) {
+				return values, errors.New("Query sls incomplete, and the retry budget of sls is exhausted.")
 			}
+			continue
 		}
+		utils.ObserveBackendCall(utils.SLSBackend, false)
 
-		if valStr == "" {
-			valStr = "0"
-		}
-
-		val, err := strconv.ParseFloat(valStr, 64)
-
-		if err != nil {
+		scaleToZero := ss.settings.Of(metricName).ScaleToZero
+		val, found, err := ingressValue(metricName, scaleToZero, queryRsp.Logs)
+		if err != nil || !found {
 			return values, err
 		}
 
+		quantity := *resource.NewQuantity(int64(val), resource.DecimalSI)
+		if scaleToZero {
+			// keep the fractions, 0.4 requests per second aren't 0
+			quantity = *resource.NewMilliQuantity(int64(val*1000), resource.DecimalSI)
+		}
 		values = append(values, external_metrics.ExternalMetricValue{
 			MetricName: metricName,
-			Value:      *resource.NewQuantity(int64(val), resource.DecimalSI),
-			Timestamp:  metav1.Now(),
+			Value:      quantity,
+			// the value is of the interval ending at the query delay
+			Timestamp: metav1.NewTime(time.Unix(end, 0)),
 		})
+		utils.SetWindowLabel(values, params.Interval)
 
 		return values, err
 	}
 	return values, errors.New("Query sls timeout,it might because of too many logs.")
 }
+
+// ingressValue reads the value of the metric from the result of a complete query: a result without logs
+// has no value, and a value which isn't a number is 0. For a metric with scaleToZero the requests counted
+// in the interval are a genuine 0 when there are none, so that the HPAs may scale to zero, whereas the
+// latency of no requests is no data, which returns no value.
+func ingressValue(metricName string, scaleToZero bool, logs []map[string]string) (value float64, found bool, err error) {
+	if len(logs) == 0 && !scaleToZero {
+		return 0, false, nil
+	}
+
+	var valStr string
+	if len(logs) > 0 {
+		var valid = regexp.MustCompile("[0-9.]")
+		for _, i := range valid.FindAllStringSubmatch(logs[0]["value"], -1) {
+			if len(i) == 1 {
+				valStr += i[0]
+			}
+		}
+	}
+	if valStr == "" {
+		// no requests in the interval, or an aggregation of none, e.g. a null average
+		if scaleToZero && metricName != SLS_INGRESS_QPS && metricName != SLS_INGRESS_INFLOW {
+			return 0, false, nil
+		}
+		valStr = "0"
+	}
+
+	value, err = strconv.ParseFloat(valStr, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return value, true, nil
+}
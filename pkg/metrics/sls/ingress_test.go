@@ -2,8 +2,9 @@ package sls
 
 import (
 	"fmt"
-	"k8s.io/apimachinery/pkg/labels"
 	"testing"
+
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 func TestInvalidGetSLSParams(t *testing.T) {
@@ -39,3 +40,35 @@ func TestIngressQuery(t *testing.T) {
 		fmt.Printf("M:%s, B:%d, E:%d, Q:%s \n", metricInfo.Metric, begin, end, query)
 	}
 }
+
+func TestIngressValueZeroAndNoData(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		metric      string
+		logs        []map[string]string
+		scaleToZero bool
+		value       float64
+		found       bool
+	}{
+		{name: "requests", metric: SLS_INGRESS_QPS, logs: []map[string]string{{"value": "2.5"}}, scaleToZero: true, value: 2.5, found: true},
+		{name: "zero requests", metric: SLS_INGRESS_QPS, logs: []map[string]string{{"value": "0"}}, scaleToZero: true, value: 0, found: true},
+		{name: "no logs of the requests", metric: SLS_INGRESS_QPS, scaleToZero: true, value: 0, found: true},
+		{name: "no logs of the inflow", metric: SLS_INGRESS_INFLOW, scaleToZero: true, value: 0, found: true},
+		{name: "latency of no requests", metric: SLS_INGRESS_LATENCY_P99, logs: []map[string]string{{"value": "null"}}, scaleToZero: true, found: false},
+		{name: "no logs of the latency", metric: SLS_INGRESS_LATENCY_AVG, scaleToZero: true, found: false},
+		// the metrics which didn't opt in are unchanged
+		{name: "not opted in requests", metric: SLS_INGRESS_QPS, logs: []map[string]string{{"value": "2.5"}}, value: 2.5, found: true},
+		{name: "not opted in no logs of the requests", metric: SLS_INGRESS_QPS, found: false},
+		{name: "not opted in no logs of the latency", metric: SLS_INGRESS_LATENCY_AVG, found: false},
+		{name: "not opted in latency of no requests", metric: SLS_INGRESS_LATENCY_P99, logs: []map[string]string{{"value": "null"}}, value: 0, found: true},
+	} {
+		value, found, err := ingressValue(tc.metric, tc.scaleToZero, tc.logs)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		if found != tc.found || value != tc.value {
+			t.Errorf("%s: expected %v (found %v), got %v (found %v)", tc.name, tc.value, tc.found, value, found)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package sls
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
@@ -33,7 +34,14 @@ const (
 	MAX_RETRY_DEFAULT = 5
 )
 
-type SLSMetricSource struct{}
+type SLSMetricSource struct {
+	settings *utils.ExternalMetricSettings
+}
+
+// SetMetricSettings sets which sls metrics return their genuine zero values as 0.
+func (ss *SLSMetricSource) SetMetricSettings(settings *utils.ExternalMetricSettings) {
+	ss.settings = settings
+}
 
 func (ss *SLSMetricSource) GetExternalMetricInfoList() []p.ExternalMetricInfo {
 	metricInfoList := make([]p.ExternalMetricInfo, 0)
@@ -68,16 +76,23 @@ func (ss *SLSMetricSource) GetExternalMetricInfoList() []p.ExternalMetricInfo {
 	})
 	return metricInfoList
 }
-func (ss *SLSMetricSource) GetExternalMetric(info p.ExternalMetricInfo, namespace string, requirements labels.Requirements) (values []external_metrics.ExternalMetricValue, err error) {
-	values, err = ss.getSLSIngressMetrics(namespace, requirements, info.Metric)
+func (ss *SLSMetricSource) GetExternalMetric(ctx context.Context, info p.ExternalMetricInfo, namespace string, requirements labels.Requirements) (values []external_metrics.ExternalMetricValue, err error) {
+	ctx, cancel := utils.WithBackendTimeout(ctx, utils.SLSBackend)
+	defer cancel()
+
+	values, err = ss.getSLSIngressMetrics(ctx, namespace, requirements, info.Metric)
 	if err != nil {
 		log.Warningf("Failed to GetExternalMetric %s,because of %v", info.Metric, err)
 	}
 	return values, err
 }
 
-// create client with specific project
-func (ss *SLSMetricSource) Client(internal bool) (client sls.ClientInterface, err error) {
+// create client with specific project, bounded by the deadline of ctx
+func (ss *SLSMetricSource) Client(ctx context.Context, internal bool) (client sls.ClientInterface, err error) {
+	timeout, err := utils.RemainingTimeout(ctx)
+	if err != nil {
+		return client, err
+	}
 
 	accessUserInfo, err := utils.GetAccessUserInfo()
 	if err != nil {
@@ -85,12 +100,22 @@ func (ss *SLSMetricSource) Client(internal bool) (client sls.ClientInterface, er
 		return client, err
 	}
 	var endpoint string
-	if internal {
+	if host, found := utils.EndpointOverride(utils.SLSBackend, accessUserInfo.Region); found {
+		// the overridden host is used whether the query is internal or not
+		endpoint = host
+	} else if internal {
 		endpoint = fmt.Sprintf("%s-intranet.log.aliyuncs.com", accessUserInfo.Region)
 	} else {
 		endpoint = fmt.Sprintf("%s.log.aliyuncs.com", accessUserInfo.Region)
 	}
-	client = sls.CreateNormalInterface(endpoint, accessUserInfo.AccessKeyId, accessUserInfo.AccessKeySecret, accessUserInfo.Token)
+	client = &sls.Client{
+		Endpoint:        endpoint,
+		AccessKeyID:     accessUserInfo.AccessKeyId,
+		AccessKeySecret: accessUserInfo.AccessKeySecret,
+		SecurityToken:   accessUserInfo.Token,
+		RequestTimeOut:  timeout,
+		RetryTimeOut:    timeout,
+	}
 
 	return client, nil
 }
@@ -0,0 +1,134 @@
+package naming
+
+import (
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+)
+
+// customResourceMapper is a RESTMapper which knows the configured custom resources
+// on top of the resources discovered from the apiserver.
+type customResourceMapper struct {
+	apimeta.RESTMapper
+
+	// custom only contains the configured custom resources
+	custom *apimeta.DefaultRESTMapper
+}
+
+// MapperWithCustomResources extends the mapper with the given namespaced custom resources.
+// The configured resources take precedence over the discovered ones.
+func MapperWithCustomResources(mapper apimeta.RESTMapper, resources []config.CustomResource) apimeta.RESTMapper {
+	if len(resources) == 0 {
+		return mapper
+	}
+
+	groupVersions := make([]schema.GroupVersion, 0, len(resources))
+	for _, resource := range resources {
+		groupVersions = append(groupVersions, resource.GroupVersionKind().GroupVersion())
+	}
+
+	custom := apimeta.NewDefaultRESTMapper(groupVersions)
+	for _, resource := range resources {
+		// the singular name of a resource is its lowercased kind
+		_, singular := apimeta.UnsafeGuessKindToResource(resource.GroupVersionKind())
+		custom.AddSpecific(resource.GroupVersionKind(), resource.GroupVersionResource(), singular, apimeta.RESTScopeNamespace)
+	}
+
+	return &customResourceMapper{
+		RESTMapper: mapper,
+		custom:     custom,
+	}
+}
+
+func (m *customResourceMapper) KindFor(resource schema.GroupVersionResource) (schema.GroupVersionKind, error) {
+	if gvk, err := m.custom.KindFor(resource); err == nil {
+		return gvk, nil
+	}
+	return m.RESTMapper.KindFor(resource)
+}
+
+func (m *customResourceMapper) KindsFor(resource schema.GroupVersionResource) ([]schema.GroupVersionKind, error) {
+	if gvks, err := m.custom.KindsFor(resource); err == nil {
+		return gvks, nil
+	}
+	return m.RESTMapper.KindsFor(resource)
+}
+
+func (m *customResourceMapper) ResourceFor(input schema.GroupVersionResource) (schema.GroupVersionResource, error) {
+	if gvr, err := m.custom.ResourceFor(input); err == nil {
+		return gvr, nil
+	}
+	return m.RESTMapper.ResourceFor(input)
+}
+
+func (m *customResourceMapper) ResourcesFor(input schema.GroupVersionResource) ([]schema.GroupVersionResource, error) {
+	if gvrs, err := m.custom.ResourcesFor(input); err == nil {
+		return gvrs, nil
+	}
+	return m.RESTMapper.ResourcesFor(input)
+}
+
+func (m *customResourceMapper) RESTMapping(gk schema.GroupKind, versions ...string) (*apimeta.RESTMapping, error) {
+	if mapping, err := m.custom.RESTMapping(gk, versions...); err == nil {
+		return mapping, nil
+	}
+	return m.RESTMapper.RESTMapping(gk, versions...)
+}
+
+func (m *customResourceMapper) RESTMappings(gk schema.GroupKind, versions ...string) ([]*apimeta.RESTMapping, error) {
+	if mappings, err := m.custom.RESTMappings(gk, versions...); err == nil && len(mappings) > 0 {
+		return mappings, nil
+	}
+	return m.RESTMapper.RESTMappings(gk, versions...)
+}
+
+func (m *customResourceMapper) ResourceSingularizer(resource string) (string, error) {
+	if singular, err := m.custom.ResourceSingularizer(resource); err == nil {
+		return singular, nil
+	}
+	return m.RESTMapper.ResourceSingularizer(resource)
+}
+
+// workloadGroup is the group which serves the workload resources, e.g. StatefulSets and DaemonSets.
+const workloadGroup = "apps"
+
+// workloadMapper resolves the resources named without a group, e.g. the statefulset and
+// daemonset labels of kube-state-metrics, to the apps group if it serves them.
+type workloadMapper struct {
+	apimeta.RESTMapper
+}
+
+// MapperPreferringApps makes the mapper resolve workload resources to the apps group. Clusters
+// which still serve the deprecated extensions/v1beta1 DaemonSets, Deployments and ReplicaSets
+// list that group first, so their metrics would otherwise be attached to a resource which the
+// HPAs, targeting apps/v1 objects, never ask for.
+func MapperPreferringApps(mapper apimeta.RESTMapper) apimeta.RESTMapper {
+	return &workloadMapper{RESTMapper: mapper}
+}
+
+func (m *workloadMapper) ResourceFor(input schema.GroupVersionResource) (schema.GroupVersionResource, error) {
+	if input.Group == "" {
+		if gvrs, err := m.RESTMapper.ResourcesFor(input); err == nil {
+			for _, gvr := range gvrs {
+				if gvr.Group == workloadGroup {
+					return gvr, nil
+				}
+			}
+		}
+	}
+	return m.RESTMapper.ResourceFor(input)
+}
+
+func (m *workloadMapper) KindFor(resource schema.GroupVersionResource) (schema.GroupVersionKind, error) {
+	if resource.Group == "" {
+		if gvks, err := m.RESTMapper.KindsFor(resource); err == nil {
+			for _, gvk := range gvks {
+				if gvk.Group == workloadGroup {
+					return gvk, nil
+				}
+			}
+		}
+	}
+	return m.RESTMapper.KindFor(resource)
+}
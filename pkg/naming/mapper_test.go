@@ -0,0 +1,174 @@
+package naming
+
+import (
+	"testing"
+
+	pmodel "github.com/prometheus/common/model"
+
+	appsapi "k8s.io/api/apps/v1"
+	coreapi "k8s.io/api/core/v1"
+	extapi "k8s.io/api/extensions/v1beta1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	cfg "sigs.k8s.io/prometheus-adapter/pkg/config"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+)
+
+var scaledJobs = schema.GroupResource{Group: "keda.sh", Resource: "scaledjobs"}
+
+func TestMapperWithCustomResources(t *testing.T) {
+	mapper := MapperWithCustomResources(restMapper(), []config.CustomResource{
+		{Group: "keda.sh", Version: "v1alpha1", Kind: "ScaledJob"},
+	})
+
+	mapping, err := mapper.RESTMapping(schema.GroupKind{Group: "keda.sh", Kind: "ScaledJob"})
+	if err != nil {
+		t.Fatalf("Failed to map custom resource, because of %v", err)
+	}
+	if mapping.Resource != scaledJobs.WithVersion("v1alpha1") || mapping.Scope.Name() != apimeta.RESTScopeNameNamespace {
+		t.Errorf("unexpected mapping of the custom resource: %+v", mapping)
+	}
+
+	gvr, err := mapper.ResourceFor(schema.GroupVersionResource{Resource: "scaledjob"})
+	if err != nil || gvr.GroupResource() != scaledJobs {
+		t.Errorf("expected the singular name to resolve to %v, got %v (%v)", scaledJobs, gvr, err)
+	}
+
+	// the built-in resources are still known
+	if _, err := mapper.ResourceFor(schema.GroupVersionResource{Resource: "pods"}); err != nil {
+		t.Errorf("expected pods to still be mapped, because of %v", err)
+	}
+}
+
+func TestMetricForCustomResource(t *testing.T) {
+	mapper := MapperWithCustomResources(restMapper(), []config.CustomResource{
+		{Group: "keda.sh", Version: "v1alpha1", Kind: "ScaledJob"},
+	})
+	rule := testRule(nil)
+	rule.SeriesQuery = `jobs_pending{namespace!="",scaled_job!=""}`
+	rule.Resources = cfg.ResourceMapping{
+		Overrides: map[string]cfg.GroupResource{
+			"namespace":  {Resource: "namespace"},
+			"scaled_job": {Group: "keda.sh", Resource: "scaledjob"},
+		},
+	}
+
+	namers, err := NamersFromConfig([]config.DiscoveryRule{rule}, mapper, nil)
+	if err != nil {
+		t.Fatalf("Failed to create namers, because of %v", err)
+	}
+
+	series := prom.Series{Name: "jobs_pending", Labels: pmodel.LabelSet{"namespace": "default", "scaled_job": "nightly"}}
+	resources, namespaced := namers[0].ResourcesForSeries(series)
+	if !namespaced {
+		t.Errorf("expected the series to be namespaced")
+	}
+	found := false
+	for _, resource := range resources {
+		if resource == scaledJobs {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected the series to be attached to %v, got %v", scaledJobs, resources)
+	}
+
+	query, err := namers[0].QueryForSeries("jobs_pending", scaledJobs, "default", labels.Everything(), "nightly")
+	if err != nil {
+		t.Fatalf("Failed to build query, because of %v", err)
+	}
+	expected := `sum(jobs_pending{namespace="default",scaled_job="nightly"}) by (scaled_job)`
+	if string(query) != expected {
+		t.Errorf("expected query %s, got %s", expected, query)
+	}
+}
+
+var (
+	statefulSets = schema.GroupResource{Group: "apps", Resource: "statefulsets"}
+	daemonSets   = schema.GroupResource{Group: "apps", Resource: "daemonsets"}
+)
+
+// workloadRESTMapper knows the apps workloads, plus the DaemonSets still served by extensions/v1beta1.
+func workloadRESTMapper() apimeta.RESTMapper {
+	mapper := apimeta.NewDefaultRESTMapper([]schema.GroupVersion{coreapi.SchemeGroupVersion, extapi.SchemeGroupVersion, appsapi.SchemeGroupVersion})
+	mapper.Add(coreapi.SchemeGroupVersion.WithKind("Pod"), apimeta.RESTScopeNamespace)
+	mapper.Add(coreapi.SchemeGroupVersion.WithKind("Namespace"), apimeta.RESTScopeRoot)
+	mapper.Add(extapi.SchemeGroupVersion.WithKind("DaemonSet"), apimeta.RESTScopeNamespace)
+	mapper.Add(appsapi.SchemeGroupVersion.WithKind("DaemonSet"), apimeta.RESTScopeNamespace)
+	mapper.Add(appsapi.SchemeGroupVersion.WithKind("StatefulSet"), apimeta.RESTScopeNamespace)
+	return MapperPreferringApps(mapper)
+}
+
+func TestMetricForWorkloads(t *testing.T) {
+	rule := testRule(nil)
+	rule.SeriesQuery = `{namespace!="",__name__=~"kube_(statefulset|daemonset)_.*"}`
+	namers, err := NamersFromConfig([]config.DiscoveryRule{rule}, workloadRESTMapper(), nil)
+	if err != nil {
+		t.Fatalf("Failed to create namers, because of %v", err)
+	}
+
+	// kube-state-metrics labels the series with the lowercased kind of the workload
+	for _, c := range []struct {
+		series   prom.Series
+		resource schema.GroupResource
+		name     string
+		query    prom.Selector
+	}{
+		{
+			series:   prom.Series{Name: "kube_statefulset_status_replicas_ready", Labels: pmodel.LabelSet{"namespace": "default", "statefulset": "web"}},
+			resource: statefulSets,
+			name:     "web",
+			query:    `sum(kube_statefulset_status_replicas_ready{namespace="default",statefulset="web"}) by (statefulset)`,
+		},
+		{
+			series:   prom.Series{Name: "kube_daemonset_status_number_ready", Labels: pmodel.LabelSet{"namespace": "default", "daemonset": "agent"}},
+			resource: daemonSets,
+			name:     "agent",
+			query:    `sum(kube_daemonset_status_number_ready{namespace="default",daemonset="agent"}) by (daemonset)`,
+		},
+	} {
+		resources, namespaced := namers[0].ResourcesForSeries(c.series)
+		if !namespaced {
+			t.Errorf("expected %s to be namespaced", c.series.Name)
+		}
+		found := false
+		for _, resource := range resources {
+			if resource == c.resource {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected %s to be attached to %v, got %v", c.series.Name, c.resource, resources)
+			continue
+		}
+
+		query, err := namers[0].QueryForSeries(c.series.Name, c.resource, "default", labels.Everything(), c.name)
+		if err != nil {
+			t.Fatalf("Failed to build query, because of %v", err)
+		}
+		if query != c.query {
+			t.Errorf("expected query %s, got %s", c.query, query)
+		}
+	}
+}
+
+func TestMapperPreferringApps(t *testing.T) {
+	mapper := workloadRESTMapper()
+	gvr, err := mapper.ResourceFor(schema.GroupVersionResource{Resource: "daemonset"})
+	if err != nil || gvr.GroupResource() != daemonSets {
+		t.Errorf("expected daemonset to resolve to %v, got %v %v", daemonSets, gvr, err)
+	}
+	gvk, err := mapper.KindFor(schema.GroupVersionResource{Resource: "statefulsets"})
+	if err != nil || gvk != appsapi.SchemeGroupVersion.WithKind("StatefulSet") {
+		t.Errorf("expected statefulsets to be of kind apps/v1 StatefulSet, got %v %v", gvk, err)
+	}
+	// a group given explicitly is kept
+	gvr, err = mapper.ResourceFor(schema.GroupVersionResource{Group: "extensions", Resource: "daemonsets"})
+	if err != nil || gvr.Group != "extensions" {
+		t.Errorf("expected extensions daemonsets to be kept, got %v %v", gvr, err)
+	}
+}
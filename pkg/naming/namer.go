@@ -0,0 +1,127 @@
+package naming
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+)
+
+// ruleNamer is a naming.MetricNamer which applies the adapter specific extensions
+// of a discovery rule on top of the namer produced by prometheus-adapter.
+type ruleNamer struct {
+	naming.MetricNamer
+
+	// labelMatchers are ANDed into every query generated by this namer
+	labelMatchers []labels.Requirement
+	// timeout bounds the series query of the rule on a relist
+	timeout time.Duration
+}
+
+// SeriesQueryTimeout returns the timeout of the series query of the rule, 0 if it has none.
+func (n *ruleNamer) SeriesQueryTimeout() time.Duration {
+	return n.timeout
+}
+
+func (n *ruleNamer) QueryForSeries(series string, resource schema.GroupResource, namespace string, metricSelector labels.Selector, names ...string) (prom.Selector, error) {
+	return n.MetricNamer.QueryForSeries(series, resource, namespace, n.withLabelMatchers(metricSelector), names...)
+}
+
+func (n *ruleNamer) QueryForExternalSeries(series string, namespace string, metricSelector labels.Selector) (prom.Selector, error) {
+	return n.MetricNamer.QueryForExternalSeries(series, namespace, n.withLabelMatchers(metricSelector))
+}
+
+func (n *ruleNamer) withLabelMatchers(metricSelector labels.Selector) labels.Selector {
+	if len(n.labelMatchers) == 0 {
+		return metricSelector
+	}
+	if metricSelector == nil {
+		metricSelector = labels.Everything()
+	}
+	return metricSelector.Add(n.labelMatchers...)
+}
+
+// NamersFromConfig produces a MetricNamer for each rule in the given config. The
+// default label matchers are ANDed into every generated query unless a rule overrides them.
+func NamersFromConfig(rules []config.DiscoveryRule, mapper apimeta.RESTMapper, defaultLabelMatchers map[string]string) ([]naming.MetricNamer, error) {
+	namers, err := naming.NamersFromConfig(config.PrometheusRules(rules), mapper)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, rule := range rules {
+		matchers := make(map[string]string, len(defaultLabelMatchers)+len(rule.LabelMatchers))
+		for k, v := range defaultLabelMatchers {
+			matchers[k] = v
+		}
+		for k, v := range rule.LabelMatchers {
+			if v == "" {
+				delete(matchers, k)
+				continue
+			}
+			matchers[k] = v
+		}
+
+		requirements, err := labelRequirements(matchers)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label matchers associated with series query %q: %v", rule.SeriesQuery, err)
+		}
+
+		namers[i] = &ruleNamer{
+			MetricNamer:   namers[i],
+			labelMatchers: requirements,
+			timeout:       rule.Timeout,
+		}
+	}
+
+	return namers, nil
+}
+
+// ParseLabelMatchers parses a list of k=v label matchers.
+func ParseLabelMatchers(args []string) (map[string]string, error) {
+	matchers := make(map[string]string, len(args))
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("label matcher %q must be in the form of k=v", arg)
+		}
+		matchers[parts[0]] = parts[1]
+	}
+	if _, err := labelRequirements(matchers); err != nil {
+		return nil, err
+	}
+	return matchers, nil
+}
+
+func labelRequirements(matchers map[string]string) ([]labels.Requirement, error) {
+	keys := make([]string, 0, len(matchers))
+	for k := range matchers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	requirements := make([]labels.Requirement, 0, len(keys))
+	for _, k := range keys {
+		if !pmodel.LabelName(k).IsValid() {
+			return nil, fmt.Errorf("invalid label matcher %s=%s: %q is not a valid prometheus label name", k, matchers[k], k)
+		}
+		r, err := labels.NewRequirement(k, selection.Equals, []string{matchers[k]})
+		if err != nil {
+			return nil, fmt.Errorf("invalid label matcher %s=%s: %v", k, matchers[k], err)
+		}
+		requirements = append(requirements, *r)
+	}
+	return requirements, nil
+}
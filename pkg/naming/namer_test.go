@@ -0,0 +1,258 @@
+package naming
+
+import (
+	"strings"
+	"testing"
+
+	pmodel "github.com/prometheus/common/model"
+
+	coreapi "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	cfg "sigs.k8s.io/prometheus-adapter/pkg/config"
+	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+)
+
+func restMapper() apimeta.RESTMapper {
+	mapper := apimeta.NewDefaultRESTMapper([]schema.GroupVersion{coreapi.SchemeGroupVersion})
+	mapper.Add(coreapi.SchemeGroupVersion.WithKind("Pod"), apimeta.RESTScopeNamespace)
+	mapper.Add(coreapi.SchemeGroupVersion.WithKind("Namespace"), apimeta.RESTScopeRoot)
+	return mapper
+}
+
+func testRule(labelMatchers map[string]string) config.DiscoveryRule {
+	return config.DiscoveryRule{
+		DiscoveryRule: cfg.DiscoveryRule{
+			SeriesQuery:  `http_requests_total{namespace!="",pod!=""}`,
+			MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)`,
+			Resources: cfg.ResourceMapping{
+				Template: "<<.Resource>>",
+			},
+		},
+		LabelMatchers: labelMatchers,
+	}
+}
+
+func TestDefaultLabelMatchersInQueries(t *testing.T) {
+	defaults, err := ParseLabelMatchers([]string{"cluster=prod"})
+	if err != nil {
+		t.Fatalf("Failed to parse label matchers, because of %v", err)
+	}
+
+	namers, err := NamersFromConfig([]config.DiscoveryRule{testRule(nil)}, restMapper(), defaults)
+	if err != nil {
+		t.Fatalf("Failed to create namers, because of %v", err)
+	}
+
+	query, err := namers[0].QueryForSeries("http_requests_total", schema.GroupResource{Resource: "pods"}, "default", labels.Everything(), "pod-a")
+	if err != nil {
+		t.Fatalf("Failed to build query, because of %v", err)
+	}
+	if !strings.Contains(string(query), `cluster="prod"`) {
+		t.Errorf("expected custom metrics query %q to contain the default matcher", query)
+	}
+
+	query, err = namers[0].QueryForExternalSeries("http_requests_total", "default", labels.SelectorFromSet(labels.Set{"app": "web"}))
+	if err != nil {
+		t.Fatalf("Failed to build query, because of %v", err)
+	}
+	if !strings.Contains(string(query), `cluster="prod"`) || !strings.Contains(string(query), `app="web"`) {
+		t.Errorf("expected external metrics query %q to contain both the selector and the default matcher", query)
+	}
+}
+
+func TestRuleLabelMatchersOverrideDefaults(t *testing.T) {
+	defaults := map[string]string{"cluster": "prod", "region": "cn-hangzhou"}
+	rules := []config.DiscoveryRule{
+		testRule(map[string]string{"cluster": "staging", "region": ""}),
+	}
+
+	namers, err := NamersFromConfig(rules, restMapper(), defaults)
+	if err != nil {
+		t.Fatalf("Failed to create namers, because of %v", err)
+	}
+
+	query, err := namers[0].QueryForExternalSeries("http_requests_total", "", labels.Everything())
+	if err != nil {
+		t.Fatalf("Failed to build query, because of %v", err)
+	}
+	if !strings.Contains(string(query), `cluster="staging"`) || strings.Contains(string(query), `cluster="prod"`) {
+		t.Errorf("expected rule matcher to override the default one in %q", query)
+	}
+	if strings.Contains(string(query), "region") {
+		t.Errorf("expected empty rule matcher to drop the default one in %q", query)
+	}
+}
+
+func TestParseInvalidLabelMatchers(t *testing.T) {
+	for _, args := range [][]string{
+		{"cluster"},
+		{"=prod"},
+		{"cluster="},
+		{"cluster.name=prod"},
+		{"cluster=not a valid value"},
+	} {
+		if _, err := ParseLabelMatchers(args); err == nil {
+			t.Errorf("expected label matchers %v to be rejected", args)
+		}
+	}
+}
+
+func TestRecordingRuleNamer(t *testing.T) {
+	rules := []config.DiscoveryRule{
+		{Type: config.RecordingRuleType},
+	}
+	namers, err := NamersFromConfig(rules, restMapper(), nil)
+	if err != nil {
+		t.Fatalf("Failed to create namers, because of %v", err)
+	}
+	namer := namers[0]
+
+	series := []prom.Series{
+		{Name: "namespace_pod:http_requests:rate5m", Labels: pmodel.LabelSet{"namespace": "default", "pod": "pod-a"}},
+		{Name: "namespace:http_requests:rate1m", Labels: pmodel.LabelSet{"namespace": "default"}},
+		{Name: "http_requests_total", Labels: pmodel.LabelSet{"namespace": "default", "pod": "pod-a"}},
+	}
+	filtered := namer.FilterSeries(series)
+	if len(filtered) != 2 {
+		t.Fatalf("expected only recording rule series to be kept, got %v", filtered)
+	}
+
+	for series, expected := range map[string]string{
+		"namespace_pod:http_requests:rate5m": "http_requests_rate5m",
+		"namespace:http_requests:rate1m":     "http_requests_rate1m",
+	} {
+		name, err := namer.MetricNameForSeries(prom.Series{Name: series})
+		if err != nil {
+			t.Fatalf("Failed to name series %s, because of %v", series, err)
+		}
+		if name != expected {
+			t.Errorf("expected series %s to be named %s, got %s", series, expected, name)
+		}
+	}
+
+	resources, namespaced := namer.ResourcesForSeries(filtered[0])
+	if !namespaced || len(resources) != 2 {
+		t.Errorf("expected the level labels to map to pods and namespaces, got %v", resources)
+	}
+
+	query, err := namer.QueryForSeries("namespace_pod:http_requests:rate5m", schema.GroupResource{Resource: "pods"}, "default", labels.Everything(), "pod-a")
+	if err != nil {
+		t.Fatalf("Failed to build query, because of %v", err)
+	}
+	expected := `sum(namespace_pod:http_requests:rate5m{namespace="default",pod="pod-a"}) by (pod)`
+	if string(query) != expected {
+		t.Errorf("expected query %s, got %s", expected, query)
+	}
+}
+
+func TestUnitConventions(t *testing.T) {
+	rules := config.WithUnitConventions([]config.DiscoveryRule{{
+		DiscoveryRule: cfg.DiscoveryRule{
+			SeriesQuery: `{namespace!="",pod!=""}`,
+			Resources:   cfg.ResourceMapping{Template: "<<.Resource>>"},
+		},
+	}}, true, config.DefaultUnitConventionsRateWindow)
+	namers, err := NamersFromConfig(rules, restMapper(), nil)
+	if err != nil {
+		t.Fatalf("Failed to create namers, because of %v", err)
+	}
+
+	for _, tc := range []struct {
+		series string
+		metric string
+		query  string
+	}{
+		{series: "container_cpu_usage_seconds_total", metric: "container_cpu_usage", query: "sum(rate(container_cpu_usage_seconds_total{app=\"web\"}[2m]))"},
+		{series: "http_requests_total", metric: "http_requests_per_second", query: "sum(rate(http_requests_total{app=\"web\"}[2m]))"},
+		{series: "container_memory_working_set_bytes", metric: "container_memory_working_set_bytes", query: "sum(container_memory_working_set_bytes{app=\"web\"})"},
+		{series: "http_request_duration_seconds", metric: "http_request_duration_seconds", query: "avg(http_request_duration_seconds{app=\"web\"})"},
+		{series: "queue_length", metric: "queue_length", query: "sum(queue_length{app=\"web\"})"},
+	} {
+		var matched []naming.MetricNamer
+		for _, namer := range namers {
+			if len(namer.FilterSeries([]prom.Series{{Name: tc.series}})) == 1 {
+				matched = append(matched, namer)
+			}
+		}
+		if len(matched) != 1 {
+			t.Errorf("expected series %s to follow a single convention, got %d", tc.series, len(matched))
+			continue
+		}
+		metric, err := matched[0].MetricNameForSeries(prom.Series{Name: tc.series})
+		if err != nil || metric != tc.metric {
+			t.Errorf("expected series %s to be exposed as %s, got %s (%v)", tc.series, tc.metric, metric, err)
+		}
+		query, err := matched[0].QueryForExternalSeries(tc.series, "", labels.SelectorFromSet(labels.Set{"app": "web"}))
+		if err != nil || !strings.HasPrefix(string(query), tc.query) {
+			t.Errorf("expected series %s to be queried by %s, got %s (%v)", tc.series, tc.query, query, err)
+		}
+	}
+}
+
+func TestReplicaDedupQueries(t *testing.T) {
+	rules, warnings := config.WithReplicaDedup([]config.DiscoveryRule{{
+		DiscoveryRule: cfg.DiscoveryRule{
+			SeriesQuery:  `{__name__="http_requests_total",namespace!="",pod!=""}`,
+			Resources:    cfg.ResourceMapping{Template: "<<.Resource>>"},
+			MetricsQuery: "sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m])) by (<<.GroupBy>>)",
+		},
+	}}, []string{"replica", "prometheus_replica"})
+	if len(warnings) > 0 {
+		t.Fatalf("expected the aggregated rule to be deduplicated, got %v", warnings)
+	}
+	namers, err := NamersFromConfig(rules, restMapper(), nil)
+	if err != nil {
+		t.Fatalf("Failed to create namers, because of %v", err)
+	}
+
+	// the rates of the two replicas of an HA pair scraping pod-a are collapsed before they are summed,
+	// instead of summing both of them
+	query, err := namers[0].QueryForSeries("http_requests_total", schema.GroupResource{Resource: "pods"}, "default", labels.Everything(), "pod-a")
+	expected := `sum(max without(replica, prometheus_replica) (rate(http_requests_total{namespace="default",pod="pod-a"}[2m]))) by (pod)`
+	if err != nil || string(query) != expected {
+		t.Errorf("expected custom metrics query %s, got %s (%v)", expected, query, err)
+	}
+	query, err = namers[0].QueryForExternalSeries("http_requests_total", "default", labels.Everything())
+	expected = `sum(max without(replica, prometheus_replica) (rate(http_requests_total{namespace="default"}[2m]))) by ()`
+	if err != nil || string(query) != expected {
+		t.Errorf("expected external metrics query %s, got %s (%v)", expected, query, err)
+	}
+}
+
+func TestHistogramRuleQueries(t *testing.T) {
+	rules := []config.DiscoveryRule{{
+		DiscoveryRule: cfg.DiscoveryRule{
+			SeriesQuery: `{__name__="http_request_duration_seconds_bucket",namespace!="",pod!=""}`,
+			Resources:   cfg.ResourceMapping{Template: "<<.Resource>>"},
+		},
+		Type:     config.HistogramRuleType,
+		Quantile: 0.95,
+	}}
+	namers, err := NamersFromConfig(rules, restMapper(), nil)
+	if err != nil {
+		t.Fatalf("Failed to create namers, because of %v", err)
+	}
+
+	metric, err := namers[0].MetricNameForSeries(prom.Series{Name: "http_request_duration_seconds_bucket"})
+	if err != nil || metric != "http_request_duration_seconds_p95" {
+		t.Errorf("expected the quantile to be exposed as http_request_duration_seconds_p95, got %s (%v)", metric, err)
+	}
+
+	query, err := namers[0].QueryForSeries("http_request_duration_seconds_bucket", schema.GroupResource{Resource: "pods"}, "default", labels.Everything(), "pod-a")
+	expected := `histogram_quantile(0.95, sum(rate(http_request_duration_seconds_bucket{namespace="default",pod="pod-a"}[2m])) by (pod, le))`
+	if err != nil || string(query) != expected {
+		t.Errorf("expected custom metrics query %s, got %s (%v)", expected, query, err)
+	}
+
+	query, err = namers[0].QueryForExternalSeries("http_request_duration_seconds_bucket", "", labels.SelectorFromSet(labels.Set{"service": "checkout"}))
+	expected = `histogram_quantile(0.95, sum(rate(http_request_duration_seconds_bucket{service="checkout"}[2m])) by (le))`
+	if err != nil || string(query) != expected {
+		t.Errorf("expected external metrics query %s, got %s (%v)", expected, query, err)
+	}
+}
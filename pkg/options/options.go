@@ -1,21 +1,24 @@
 package options
 
 import (
-	"crypto/tls"
-	"crypto/x509"
 	"fmt"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/audit"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/metrics/cms"
 	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
 	"io/ioutil"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"net/http"
 	"net/url"
+	"os"
 	basecmd "sigs.k8s.io/custom-metrics-apiserver/pkg/cmd"
 	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
-	cfg "sigs.k8s.io/prometheus-adapter/pkg/config"
 	"strings"
 	"time"
 
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/transport"
 	"k8s.io/klog/v2"
 )
@@ -30,49 +33,405 @@ type AlibabaMetricsAdapterOptions struct {
 	PrometheusAuthConf string
 	// PrometheusCAFile points to the file containing the ca-root for connecting with Prometheus
 	PrometheusCAFile string
+	// PrometheusTLSServerName is the name the certificate of Prometheus is verified against, instead of the host of PrometheusURL
+	PrometheusTLSServerName string
+	// PrometheusHTTP2 negotiates HTTP/2 with a Prometheus served over TLS
+	PrometheusHTTP2 bool
 	// PrometheusTokenFile points to the file that contains the bearer token when connecting with Prometheus
 	PrometheusTokenFile string
+	// PrometheusTokenSecret is the namespace/name/key of the Secret that contains the bearer token when connecting with Prometheus
+	PrometheusTokenSecret string
 	// PrometheusHeaders is a k=v list of headers to set on requests to PrometheusURL
 	PrometheusHeaders []string
-	// AdapterConfigFile points to the file containing the metrics discovery configuration.
-	AdapterConfigFile string
+	// PrometheusCorrelationHeader is the header carrying the correlation ID of the requests to Prometheus, none if empty
+	PrometheusCorrelationHeader string
+	// PrometheusEndpointOverrides is a name=url list of the Prometheus endpoints a request may query instead of PrometheusURL
+	PrometheusEndpointOverrides []string
+	// CMSEndpointOverrides is a region=host list of the CMS endpoints which take precedence over the ones of the SDK
+	CMSEndpointOverrides []string
+	// SLSEndpointOverrides is a region=host list of the SLS endpoints which take precedence over the default ones
+	SLSEndpointOverrides []string
+	// ARMSPrometheus connects to the HTTP API of an ARMS (Managed Service for Prometheus) instance,
+	// authenticated with the Alibaba Cloud credentials of the adapter
+	ARMSPrometheus bool
+	// PrometheusDedupReplicas enables collapsing series of an HA Prometheus pair which only differ by a replica label
+	PrometheusDedupReplicas bool
+	// PrometheusReplicaLabels are the labels stripped from series when PrometheusDedupReplicas is set
+	PrometheusReplicaLabels []string
+	// AdapterConfigFiles point to the files, or directories of files, containing the metrics discovery configuration.
+	AdapterConfigFiles []string
+	// ConfigDuplicates is how a metric defined by several of the AdapterConfigFiles is handled, one of config.DuplicatePolicies
+	ConfigDuplicates string
+	// ConfigLoadTimeout is how long the startup waits for an unreadable configuration file
+	ConfigLoadTimeout time.Duration
+	// StrictConfig rejects the unknown fields of the metrics discovery configuration instead of warning about them
+	StrictConfig bool
+	// StrictStartup fails the startup when a rule matches no series, instead of warning about it
+	StrictStartup bool
+	// PrometheusEmptyResult is how the external metrics whose Prometheus query returns no series are answered
+	PrometheusEmptyResult string
+	// PrometheusUnitConventions names and queries the series of the rules without a name or a metrics query after their suffix
+	PrometheusUnitConventions bool
+	// PrometheusUnitConventionsRateWindow is the window the counters are turned into rates over by the unit conventions
+	PrometheusUnitConventionsRateWindow time.Duration
+	// MockMetricsFile serves the metrics of a static file instead of the backends, for testing
+	MockMetricsFile string
+	// StrictExternalRules fails the requests of the external metrics several Prometheus rules name instead of using the first rule
+	StrictExternalRules bool
+	// StrictServiceAccountLabelMatchers denies the requests of the users without serviceAccountLabelMatchers in the configuration
+	StrictServiceAccountLabelMatchers bool
+	// EnableLabelMatchersAnnotation lets the objects select the Prometheus series of their custom metrics by annotation
+	EnableLabelMatchersAnnotation bool
 	// MetricsRelistInterval is the interval at which to relist the set of available metrics
 	MetricsRelistInterval time.Duration
+	// MetricsRelistMinInterval and MetricsRelistMaxInterval bound the relist interval when it's adaptive
+	MetricsRelistMinInterval time.Duration
+	MetricsRelistMaxInterval time.Duration
 	// MetricsMaxAge is the period to query available metrics for
 	MetricsMaxAge time.Duration
+	// MetricsRelistSnapshot is the file the series of the relists are saved to and loaded from at startup
+	MetricsRelistSnapshot string
+	// PrometheusQueryTimeout is the deadline of the calls to Prometheus
+	PrometheusQueryTimeout time.Duration
+	// CMSQueryTimeout is the deadline of the calls to CMS, which SLB metrics are read from as well
+	CMSQueryTimeout time.Duration
+	// SLSQueryTimeout is the deadline of the calls to SLS
+	SLSQueryTimeout time.Duration
+	// AHASQueryTimeout is the deadline of the calls to AHAS
+	AHASQueryTimeout time.Duration
+	// PrometheusMaxConcurrentCalls is the number of calls to Prometheus which run at a time
+	PrometheusMaxConcurrentCalls int
+	// CMSMaxConcurrentCalls is the number of calls to CMS which run at a time, across all the requests
+	CMSMaxConcurrentCalls int
+	// SLSMaxConcurrentCalls is the number of calls to SLS which run at a time
+	SLSMaxConcurrentCalls int
+	// AHASMaxConcurrentCalls is the number of calls to AHAS which run at a time
+	AHASMaxConcurrentCalls int
+	// BackendFairScheduling makes the calls waiting for a slot of a backend take turns by metric
+	BackendFairScheduling bool
+	// MaxHedgedCalls is the number of hedged calls of the metrics with a hedge delay which run at a time
+	MaxHedgedCalls int
+	// RelistMaxConcurrentQueries is the number of series queries of the relists which run at a time
+	RelistMaxConcurrentQueries int
+	// RelistMaxQueriesPerSecond is the number of series queries of the relists started per second, 0 meaning no limit
+	RelistMaxQueriesPerSecond float64
+	// BackendWarmUpInterval is how often Prometheus and CMS are pinged to keep their connections open, 0 disabling it
+	BackendWarmUpInterval time.Duration
+	// SlowQueryThreshold is the duration above which a call to a backend is logged
+	SlowQueryThreshold time.Duration
+	// QueryTimeOffset is added to now by the queries to CMS, to tolerate a clock skew and the reporting lag
+	QueryTimeOffset time.Duration
+	// RetryBudgetMaxTokens is the size of the budget of the retries of the calls to SLS, 0 disabling it
+	RetryBudgetMaxTokens float64
+	// RetryBudgetTokenRatio is the share of a token of the retry budget a successful call gives back
+	RetryBudgetTokenRatio float64
+	// CMSBatchSize is the number of instances queried by a single CMS call
+	CMSBatchSize int
+	// CMSQueryConcurrency is the number of CMS calls a metric request runs in parallel
+	CMSQueryConcurrency int
+	// SDKTransport tunes the connection reuse of the Alibaba Cloud OpenAPI clients
+	SDKTransport utils.TransportConfig
+	// MaxResponseBytes bounds the bodies of the responses of Prometheus and of the Alibaba Cloud OpenAPI
+	MaxResponseBytes int64
+	// ProbeMetricName is the external metric which always returns ProbeMetricValue without querying any backend
+	ProbeMetricName string
+	// ProbeMetricValue is the value of ProbeMetricName
+	ProbeMetricValue float64
+	// ExternalMetricsCacheTTL is how long the external metric values are cached
+	ExternalMetricsCacheTTL time.Duration
+	// ExternalMetricsNotFoundCacheTTL is how long the not found errors of the external metrics are cached
+	ExternalMetricsNotFoundCacheTTL time.Duration
+	// StaleMetricMaxAge is the age of a data point beyond which an external metric is reported unavailable, 0 never
+	StaleMetricMaxAge time.Duration
+	// MaxInflightMetricRequests is how many distinct metric requests the backends serve at a time, 0 doesn't limit them
+	MaxInflightMetricRequests int
+	// InflightLimitWait is how long a request beyond MaxInflightMetricRequests waits for a slot before it's shed
+	InflightLimitWait time.Duration
+	// InflightLimitRetryAfter is the Retry-After of the requests shed
+	InflightLimitRetryAfter time.Duration
+	// ExternalMetricProviderPrecedence orders the providers serving external metrics of the same name, the first preferred
+	ExternalMetricProviderPrecedence []string
+	// SharedCacheURL is the Redis server the replicas share the external metric values through
+	SharedCacheURL string
+	// SharedCacheTTL is how long the external metric values are shared between the replicas
+	SharedCacheTTL time.Duration
+	// ClusterID scopes the CMS queries to the cluster the adapter runs in
+	ClusterID string
+	// CMSNameEncoding lists the CMS custom metrics under their encoded names, e.g. cpu__usage for cpu.usage
+	CMSNameEncoding bool
+	// CMSDimensionDiscovery maps the labels of the selectors of the CMS custom metrics to the dimensions their metadata lists
+	CMSDimensionDiscovery bool
+	// CMSDimensionSchemaTTL is how long the dimensions of a CMS custom metric are cached
+	CMSDimensionSchemaTTL time.Duration
+	// DefaultNamespace is the namespace of the CMS queries of the requests without one
+	DefaultNamespace string
+	// ExposeMetricWindow labels the external metric values with their aggregation window
+	ExposeMetricWindow bool
+	// ExposeQuery labels the external metric values from Prometheus with the query they were resolved by
+	ExposeQuery bool
+	// EnableKubeCountMetrics serves the pod and node counts read from the kube apiserver as external metrics
+	EnableKubeCountMetrics bool
+	// EnableProviderRegistry serves the /debug/providers endpoint which enables and disables the external metric providers at runtime
+	EnableProviderRegistry bool
+	// AuditRemoteWriteURL is the Prometheus remote write endpoint the returned metric values are pushed to
+	AuditRemoteWriteURL string
+	// AuditRemoteWriteBufferSize is the number of values which may wait to be pushed before new ones are dropped
+	AuditRemoteWriteBufferSize int
+	// AuditLog is the file every metric request is recorded to as a JSON line, - for the standard output
+	AuditLog string
+	// AuditLogBufferSize is the number of events which may wait to be written before new ones are dropped
+	AuditLogBufferSize int
+	// CMSPushEnabled pushes the returned metric values to CMS custom monitoring
+	CMSPushEnabled bool
+	// CMSPushGroupID is the application group the metric values are pushed to
+	CMSPushGroupID string
+	// CMSPushNamespace prefixes the names of the metrics pushed to CMS
+	CMSPushNamespace string
+	// CMSPushBufferSize is the number of values which may wait to be pushed to CMS before new ones are dropped
+	CMSPushBufferSize int
+	// DefaultLabelMatchers is a k=v list of label matchers ANDed into every generated Prometheus query
+	DefaultLabelMatchers []string
 
-	MetricsConfig *cfg.MetricsDiscoveryConfig
+	MetricsConfig *config.MetricsDiscoveryConfig
+	configLoader  *config.Loader
 }
 
 func (cmd *AlibabaMetricsAdapterOptions) AddFlags() {
 	cmd.Flags().StringVar(&cmd.PrometheusURL, "prometheus-url", cmd.PrometheusURL,
-		"URL for connecting to Prometheus.")
+		"URL for connecting to Prometheus. A unix:///path/to/socket URL connects over a unix domain socket.")
 	cmd.Flags().BoolVar(&cmd.PrometheusAuthInCluster, "prometheus-auth-incluster", cmd.PrometheusAuthInCluster,
 		"use auth details from the in-cluster kubeconfig when connecting to prometheus.")
 	cmd.Flags().StringVar(&cmd.PrometheusAuthConf, "prometheus-auth-config", cmd.PrometheusAuthConf,
 		"kubeconfig file used to configure auth when connecting to Prometheus.")
 	cmd.Flags().StringVar(&cmd.PrometheusCAFile, "prometheus-ca-file", cmd.PrometheusCAFile,
 		"Optional CA file to use when connecting with Prometheus")
+	cmd.Flags().StringVar(&cmd.PrometheusTLSServerName, "prometheus-tls-server-name", cmd.PrometheusTLSServerName,
+		"Optional name the certificate of Prometheus is verified against instead of the host of prometheus-url, e.g. to connect "+
+			"by IP to a Prometheus whose certificate names its DNS name. It requires prometheus-ca-file.")
+	cmd.Flags().BoolVar(&cmd.PrometheusHTTP2, "prometheus-http2", cmd.PrometheusHTTP2,
+		"Negotiate HTTP/2 with a Prometheus served over TLS, which multiplexes the queries over a connection. "+
+			"Disable it behind a proxy which mishandles HTTP/2. The Prometheus served over plain HTTP is queried over HTTP/1.1 anyway")
 	cmd.Flags().StringVar(&cmd.PrometheusTokenFile, "prometheus-token-file", cmd.PrometheusTokenFile,
 		"Optional file containing the bearer token to use when connecting with Prometheus")
+	cmd.Flags().StringVar(&cmd.PrometheusTokenSecret, "prometheus-token-secret", cmd.PrometheusTokenSecret,
+		"Optional namespace/name/key of the Secret containing the bearer token to use when connecting with Prometheus. "+
+			"The Secret is watched, so that a rotated token is used without a restart")
 	cmd.Flags().StringArrayVar(&cmd.PrometheusHeaders, "prometheus-header", cmd.PrometheusHeaders,
 		"Optional header to set on requests to prometheus-url. Can be repeated")
-	cmd.Flags().StringVar(&cmd.AdapterConfigFile, "config", cmd.AdapterConfigFile,
+	cmd.Flags().StringVar(&cmd.PrometheusCorrelationHeader, "prometheus-correlation-header", cmd.PrometheusCorrelationHeader,
+		"Header of the requests to Prometheus carrying the ID of the metric request they serve, which is its Audit-ID or a generated one, "+
+			"to trace a scaling decision through the logs of Prometheus. An empty header sends none")
+	cmd.Flags().StringArrayVar(&cmd.PrometheusEndpointOverrides, "prometheus-endpoint-overrides", cmd.PrometheusEndpointOverrides,
+		"Optional name=url of a Prometheus which the requests whose selector has the prometheus_endpoint=<name> label query "+
+			"instead of prometheus-url, with the same credentials, e.g. to debug or canary an HPA. Can be repeated, none is allowed by default.")
+	cmd.Flags().StringArrayVar(&cmd.CMSEndpointOverrides, "cms-endpoint-overrides", cmd.CMSEndpointOverrides,
+		"Optional region=host of the CMS endpoint of a region, e.g. cn-new=metrics.cn-new.aliyuncs.com, which takes precedence over "+
+			"the endpoint the SDK knows. Can be repeated, the other regions keep the endpoint of the SDK.")
+	cmd.Flags().StringArrayVar(&cmd.SLSEndpointOverrides, "sls-endpoint-overrides", cmd.SLSEndpointOverrides,
+		"Optional region=host of the SLS endpoint of a region, e.g. cn-new=cn-new.log.aliyuncs.com, which takes precedence over "+
+			"<region>.log.aliyuncs.com and <region>-intranet.log.aliyuncs.com. Can be repeated.")
+	cmd.Flags().BoolVar(&cmd.ARMSPrometheus, "arms-prometheus", cmd.ARMSPrometheus,
+		"prometheus-url is the HTTP API URL of an ARMS (Managed Service for Prometheus) instance. "+
+			"The requests are authenticated with the Alibaba Cloud credentials of the adapter instead of the kubeconfig or a bearer token.")
+	cmd.Flags().BoolVar(&cmd.PrometheusDedupReplicas, "prometheus-dedup-replicas", cmd.PrometheusDedupReplicas,
+		"collapse the series of an HA Prometheus pair which only differ by a replica label: the metrics queries of the rules take "+
+			"the max of the replicas before they aggregate the series, and the replica labels are stripped from the listed series.")
+	cmd.Flags().StringSliceVar(&cmd.PrometheusReplicaLabels, "prometheus-replica-labels", cmd.PrometheusReplicaLabels,
+		"labels which tell the replicas of an HA Prometheus pair apart, used with --prometheus-dedup-replicas.")
+	cmd.Flags().StringArrayVar(&cmd.AdapterConfigFiles, "config", cmd.AdapterConfigFiles,
 		"Configuration file containing details of how to transform between Prometheus metrics "+
-			"and custom metrics API resources")
+			"and custom metrics API resources. It can be repeated, once per path, or be a directory of YAML files, and the files are merged in order.")
+	cmd.Flags().StringVar(&cmd.ConfigDuplicates, "config-duplicates", cmd.ConfigDuplicates,
+		fmt.Sprintf("what to do with a metric defined by several --config files, one of %v: error fails the loading, "+
+			"warn keeps the definition of the first file.", config.DuplicatePolicies))
+	cmd.Flags().DurationVar(&cmd.ConfigLoadTimeout, "config-load-timeout", cmd.ConfigLoadTimeout,
+		"how long the startup retries to read the --config file, e.g. while its ConfigMap is mounted, before failing.")
+	cmd.Flags().BoolVar(&cmd.StrictConfig, "strict-config", cmd.StrictConfig,
+		"reject unknown fields in the --config file instead of only warning about them.")
+	cmd.Flags().BoolVar(&cmd.StrictStartup, "strict-startup", cmd.StrictStartup,
+		"fail the startup when the series query of a rule matches no series in Prometheus, which is likely a typo, "+
+			"instead of only warning about it.")
+	cmd.Flags().StringVar(&cmd.PrometheusEmptyResult, "prometheus-empty-result", cmd.PrometheusEmptyResult,
+		"how an external metric whose Prometheus query succeeds without any series is answered: NotFound, Zero, "+
+			"or LastCached to return the last values of the query. A failed query always returns a server error.")
+	cmd.Flags().BoolVar(&cmd.PrometheusUnitConventions, "prometheus-unit-conventions", cmd.PrometheusUnitConventions,
+		"name and query the series of the rules without a name or a metrics query after the suffix of their names: "+
+			"_seconds_total and _total counters become rates, _bytes are summed and _seconds are averaged. "+
+			"The unitConventions field of a rule overrides it.")
+	cmd.Flags().DurationVar(&cmd.PrometheusUnitConventionsRateWindow, "prometheus-unit-conventions-rate-window", cmd.PrometheusUnitConventionsRateWindow,
+		"window the counters are turned into rates over by the unit conventions.")
+	cmd.Flags().StringVar(&cmd.MockMetricsFile, "mock-metrics-file", cmd.MockMetricsFile,
+		"serve the custom and external metrics listed in this YAML or JSON file instead of querying Prometheus or "+
+			"Alibaba Cloud, to test the HPAs deterministically. Not meant for production.")
+	cmd.Flags().BoolVar(&cmd.StrictExternalRules, "strict-external-rules", cmd.StrictExternalRules,
+		"fail the requests of an external metric which several rules of the --config file name, "+
+			"instead of serving it with the rule declared first. The external metrics of Prometheus are served from the rules section.")
+	cmd.Flags().BoolVar(&cmd.StrictServiceAccountLabelMatchers, "strict-service-account-label-matchers", cmd.StrictServiceAccountLabelMatchers,
+		"deny the metric requests of the users which aren't a service account with serviceAccountLabelMatchers in the --config file, "+
+			"instead of serving them without label matchers.")
+	cmd.Flags().BoolVar(&cmd.EnableLabelMatchersAnnotation, "enable-label-matchers-annotation", cmd.EnableLabelMatchersAnnotation,
+		"let the object a custom metric is requested for select its Prometheus series with the "+
+			"metrics.alibabacloud.com/prometheus-label-matchers annotation, e.g. app=checkout, instead of the label of its resource. "+
+			"The annotations are read from informers, which requires watching the resources of the requested objects.")
 	cmd.Flags().DurationVar(&cmd.MetricsRelistInterval, "metrics-relist-interval", cmd.MetricsRelistInterval, ""+
 		"interval at which to re-list the set of all available metrics from Prometheus")
+	cmd.Flags().DurationVar(&cmd.MetricsRelistMinInterval, "metrics-relist-min-interval", cmd.MetricsRelistMinInterval,
+		"with --metrics-relist-max-interval, makes the relist interval adaptive: starting at --metrics-relist-interval, it's halved "+
+			"down to this minimum each time a relist finds new metric names, and doubled otherwise. 0 keeps it fixed.")
+	cmd.Flags().DurationVar(&cmd.MetricsRelistMaxInterval, "metrics-relist-max-interval", cmd.MetricsRelistMaxInterval,
+		"maximum of the adaptive relist interval, it must not be greater than --metrics-max-age. 0 keeps the interval fixed.")
 	cmd.Flags().DurationVar(&cmd.MetricsMaxAge, "metrics-max-age", cmd.MetricsMaxAge, ""+
 		"period for which to query the set of available metrics from Prometheus")
+	cmd.Flags().StringVar(&cmd.MetricsRelistSnapshot, "metrics-relist-snapshot", cmd.MetricsRelistSnapshot,
+		"file the series of each relist are saved to. At startup the metrics of the file are served right away while "+
+			"the first relist runs in the background, instead of waiting for it. Unless --strict-startup, which still relists first.")
+	cmd.Flags().DurationVar(&cmd.PrometheusQueryTimeout, "prometheus-query-timeout", cmd.PrometheusQueryTimeout,
+		"timeout of the calls to Prometheus, capped by the deadline of the request. 0 disables it.")
+	cmd.Flags().DurationVar(&cmd.CMSQueryTimeout, "cms-query-timeout", cmd.CMSQueryTimeout,
+		"timeout of the calls to CMS (used by the CMS and SLB metrics), capped by the deadline of the request. 0 disables it.")
+	cmd.Flags().DurationVar(&cmd.SLSQueryTimeout, "sls-query-timeout", cmd.SLSQueryTimeout,
+		"timeout of the calls to SLS, capped by the deadline of the request. 0 disables it.")
+	cmd.Flags().DurationVar(&cmd.AHASQueryTimeout, "ahas-query-timeout", cmd.AHASQueryTimeout,
+		"timeout of the calls to AHAS, capped by the deadline of the request. 0 disables it.")
+	cmd.Flags().IntVar(&cmd.PrometheusMaxConcurrentCalls, "prometheus-max-concurrent-calls", cmd.PrometheusMaxConcurrentCalls,
+		"number of calls to Prometheus which run at a time, the others wait for one to finish. 0 means no limit.")
+	cmd.Flags().IntVar(&cmd.CMSMaxConcurrentCalls, "cms-max-concurrent-calls", cmd.CMSMaxConcurrentCalls,
+		"number of calls to CMS (used by the CMS and SLB metrics) which run at a time across all the requests, the others wait for one to finish. 0 means no limit.")
+	cmd.Flags().IntVar(&cmd.SLSMaxConcurrentCalls, "sls-max-concurrent-calls", cmd.SLSMaxConcurrentCalls,
+		"number of calls to SLS which run at a time, the others wait for one to finish. 0 means no limit.")
+	cmd.Flags().IntVar(&cmd.AHASMaxConcurrentCalls, "ahas-max-concurrent-calls", cmd.AHASMaxConcurrentCalls,
+		"number of calls to AHAS which run at a time, the others wait for one to finish. 0 means no limit.")
+	cmd.Flags().BoolVar(&cmd.BackendFairScheduling, "backend-fair-scheduling", cmd.BackendFairScheduling,
+		"serve the calls waiting for a slot of a backend's concurrency limit one metric after the other, so that a metric making many calls doesn't hold back the calls of the others.")
+	cmd.Flags().IntVar(&cmd.MaxHedgedCalls, "max-hedged-calls", cmd.MaxHedgedCalls,
+		"number of hedged calls of the metrics with a hedgeDelay which run at a time, a slow call due for a hedge while they all run isn't hedged. 0 means no limit.")
+	cmd.Flags().IntVar(&cmd.RelistMaxConcurrentQueries, "relist-max-concurrent-queries", cmd.RelistMaxConcurrentQueries,
+		"number of series queries of the relists which run at a time, the others wait for one to finish. They don't count against "+
+			"--prometheus-max-concurrent-calls, so that a relist of many rules neither floods Prometheus nor holds the requests back. 0 means no limit.")
+	cmd.Flags().Float64Var(&cmd.RelistMaxQueriesPerSecond, "relist-max-queries-per-second", cmd.RelistMaxQueriesPerSecond,
+		"number of series queries of the relists started per second, e.g. 5. 0 means no limit.")
+	cmd.Flags().DurationVar(&cmd.BackendWarmUpInterval, "backend-warm-up-interval", cmd.BackendWarmUpInterval,
+		"how often Prometheus and CMS are pinged with a cheap call to keep their connections open, so that the first request "+
+			"after an idle period doesn't wait for a TLS handshake. It's at least 10s, 0 disables it.")
+	cmd.Flags().DurationVar(&cmd.SlowQueryThreshold, "slow-query-threshold", cmd.SlowQueryThreshold,
+		"log a warning, with the metric, selector and backend, for every call to a backend which takes longer than this, "+
+			"and count it in adapter_slow_queries_total. 0 disables it.")
+	cmd.Flags().DurationVar(&cmd.QueryTimeOffset, "query-time-offset", cmd.QueryTimeOffset,
+		"offset, negative or 0, added to the end time of the queries to CMS, so that a clock ahead of CMS or its reporting lag "+
+			"doesn't make the latest bucket empty. It doesn't apply to the requests asking for an evaluation time.")
+	cmd.Flags().Float64Var(&cmd.RetryBudgetMaxTokens, "retry-budget-max-tokens", cmd.RetryBudgetMaxTokens,
+		"size of the budget shared by the retries of the incomplete SLS queries, as in gRPC's retry throttling: a failed call takes a token, "+
+			"a successful one gives back --retry-budget-token-ratio of a token, and the retries are only made while more than half of the tokens are left. "+
+			"0 disables it.")
+	cmd.Flags().Float64Var(&cmd.RetryBudgetTokenRatio, "retry-budget-token-ratio", cmd.RetryBudgetTokenRatio,
+		"share of a token of the retry budget a successful call gives back.")
+	cmd.Flags().IntVar(&cmd.CMSBatchSize, "cms-batch-size", cmd.CMSBatchSize,
+		"number of instances queried by a single CMS call when a selector matches several SLB instances.")
+	cmd.Flags().IntVar(&cmd.CMSQueryConcurrency, "cms-query-concurrency", cmd.CMSQueryConcurrency,
+		"number of CMS calls run in parallel when a selector matches more instances than fit into a batch.")
+	cmd.Flags().BoolVar(&cmd.SDKTransport.DisableKeepAlives, "sdk-disable-keep-alives", cmd.SDKTransport.DisableKeepAlives,
+		"open a new connection for every call to the Alibaba Cloud OpenAPI (CMS, SLB, AHAS).")
+	cmd.Flags().IntVar(&cmd.SDKTransport.MaxIdleConns, "sdk-max-idle-conns", cmd.SDKTransport.MaxIdleConns,
+		"maximum number of idle connections kept open to the Alibaba Cloud OpenAPI. 0 means no limit.")
+	cmd.Flags().IntVar(&cmd.SDKTransport.MaxIdleConnsPerHost, "sdk-max-idle-conns-per-host", cmd.SDKTransport.MaxIdleConnsPerHost,
+		"maximum number of idle connections kept open to each Alibaba Cloud OpenAPI endpoint.")
+	cmd.Flags().DurationVar(&cmd.SDKTransport.IdleConnTimeout, "sdk-idle-conn-timeout", cmd.SDKTransport.IdleConnTimeout,
+		"how long an idle connection to the Alibaba Cloud OpenAPI is kept open. 0 means no limit.")
+	cmd.Flags().DurationVar(&cmd.SDKTransport.TCPKeepAlive, "sdk-tcp-keep-alive", cmd.SDKTransport.TCPKeepAlive,
+		"TCP keep-alive period of the connections to the Alibaba Cloud OpenAPI.")
+	cmd.Flags().Int64Var(&cmd.MaxResponseBytes, "max-response-bytes", cmd.MaxResponseBytes,
+		"maximum size of the body of a response of Prometheus or of the Alibaba Cloud OpenAPI, a larger response fails the request "+
+			"instead of being decoded in memory. 0 means no limit.")
+	cmd.Flags().StringVar(&cmd.ProbeMetricName, "probe-metric-name", cmd.ProbeMetricName,
+		"name of an external metric which always returns --probe-metric-value without querying any backend, to monitor "+
+			"the external metrics API independently of the health of the backends. An empty name disables it.")
+	cmd.Flags().Float64Var(&cmd.ProbeMetricValue, "probe-metric-value", cmd.ProbeMetricValue,
+		"value returned by the --probe-metric-name external metric.")
+	cmd.Flags().DurationVar(&cmd.ExternalMetricsCacheTTL, "external-metrics-cache-ttl", cmd.ExternalMetricsCacheTTL,
+		"how long the external metric values are cached. 0 disables the cache. "+
+			"A request with the cache=bypass selector label always reads the backend and refreshes the cache.")
+	cmd.Flags().DurationVar(&cmd.ExternalMetricsNotFoundCacheTTL, "external-metrics-not-found-cache-ttl", cmd.ExternalMetricsNotFoundCacheTTL,
+		"how long the not found errors of the external metrics are cached, e.g. 10s, which spares the backends the repeated queries "+
+			"of a missing metric. Keep it short, a metric showing up is only served once it expires. 0 disables it.")
+	cmd.Flags().DurationVar(&cmd.StaleMetricMaxAge, "stale-metric-max-age", cmd.StaleMetricMaxAge,
+		"age of the data point of an external metric value, as told by its timestamp, beyond which the metric is reported unavailable "+
+			"rather than scaled on, e.g. 5m. It should exceed the period and the delay of the metrics. 0 disables it.")
+	cmd.Flags().IntVar(&cmd.MaxInflightMetricRequests, "max-inflight-metric-requests", cmd.MaxInflightMetricRequests,
+		"how many distinct metric requests, by metric and selector, the backends serve at a time, e.g. to weather the HPAs of a large "+
+			"deployment polling at once. The requests beyond are shed with 429 Too Many Requests, the ones served from the cache or of a "+
+			"metric and selector in flight already are always admitted. 0 disables the limit.")
+	cmd.Flags().DurationVar(&cmd.InflightLimitWait, "inflight-limit-wait", cmd.InflightLimitWait,
+		"how long a request beyond --max-inflight-metric-requests waits for a slot before it's shed. 0 sheds it right away.")
+	cmd.Flags().DurationVar(&cmd.InflightLimitRetryAfter, "inflight-limit-retry-after", cmd.InflightLimitRetryAfter,
+		"the Retry-After of the requests shed by --max-inflight-metric-requests, rounded up to seconds.")
+	cmd.Flags().StringSliceVar(&cmd.ExternalMetricProviderPrecedence, "external-metric-provider-precedence", cmd.ExternalMetricProviderPrecedence,
+		"comma separated providers in the order they serve the external metrics of the same name, e.g. prometheus,cms to serve "+
+			"the Prometheus qps rather than the CMS one. The providers it doesn't name come after, the Alibaba Cloud ones before Prometheus. "+
+			"A metric configured with a backend, or requested with the metric_provider label, is served by that provider")
+	cmd.Flags().StringVar(&cmd.SharedCacheURL, "shared-cache-url", cmd.SharedCacheURL,
+		"Optional redis://[:password@]host:port[/db] URL of a Redis server the replicas share the external metric values through, "+
+			"so they don't all query the backend for the same values. The local cache is used while the server is unreachable.")
+	cmd.Flags().DurationVar(&cmd.SharedCacheTTL, "shared-cache-ttl", cmd.SharedCacheTTL,
+		"how long the external metric values are shared through --shared-cache-url.")
+	cmd.Flags().StringVar(&cmd.ClusterID, "cluster-id", cmd.ClusterID,
+		"ID of the ACK cluster the adapter runs in, defaults to the "+utils.ClusterIDEnv+" environment variable. "+
+			"It's the default k8s.cluster.id of the CMS workload metrics, and the clusterId dimension of the CMS custom metrics, "+
+			"so that the values of the other clusters of the account aren't returned.")
+	cmd.Flags().BoolVar(&cmd.CMSNameEncoding, "cms-name-encoding", cmd.CMSNameEncoding,
+		"list the CMS custom metrics with dots in their names under an encoded name, each dot becoming a double underscore, "+
+			"e.g. cms_custom_cpu__usage for cpu.usage, and decode the names of the requests back.")
+	cmd.Flags().BoolVar(&cmd.CMSDimensionDiscovery, "cms-dimension-discovery", cmd.CMSDimensionDiscovery,
+		"map the labels of the selectors of the CMS custom metrics which are neither a parameter nor translated, e.g. app, to the dimensions "+
+			"of the same name the metadata of the metric lists, instead of ignoring them. A label the metric has no dimension of fails the request.")
+	cmd.Flags().DurationVar(&cmd.CMSDimensionSchemaTTL, "cms-dimension-schema-ttl", cmd.CMSDimensionSchemaTTL,
+		"how long the dimensions of a CMS custom metric described for --cms-dimension-discovery are cached.")
+	cmd.Flags().StringVar(&cmd.DefaultNamespace, "default-namespace", cmd.DefaultNamespace,
+		"namespace of the CMS workload metrics requested without a namespace, unless their selector sets k8s.workload.namespace.")
+	cmd.Flags().BoolVar(&cmd.ExposeMetricWindow, "expose-metric-window", cmd.ExposeMetricWindow,
+		"label the external metric values from Alibaba Cloud with their aggregation window, e.g. window=60s.")
+	cmd.Flags().BoolVar(&cmd.ExposeQuery, "expose-query", cmd.ExposeQuery,
+		"label the external metric values from Prometheus with the PromQL query they were resolved by, e.g. for debugging with kubectl get --raw.")
+	cmd.Flags().BoolVar(&cmd.EnableKubeCountMetrics, "enable-kube-count-metrics", cmd.EnableKubeCountMetrics,
+		"serve the k8s_pod_count and k8s_node_count external metrics, the number of pods and nodes matching the selector. "+
+			"The counts are read from the kube apiserver, which requires watching all pods and nodes.")
+	cmd.Flags().BoolVar(&cmd.EnableProviderRegistry, "enable-provider-registry", cmd.EnableProviderRegistry,
+		"serve the /debug/providers endpoint on port 8080, which lists the external metric providers and enables or disables them "+
+			"at runtime, e.g. POST /debug/providers?provider=cms&enabled=false. The metrics of a disabled provider aren't found. "+
+			"The endpoint isn't authenticated.")
+	cmd.Flags().StringVar(&cmd.AuditRemoteWriteURL, "audit-remote-write-url", cmd.AuditRemoteWriteURL,
+		"Optional Prometheus remote write URL every metric value returned by the adapter is pushed to for auditing. "+
+			"The values are pushed in the background and dropped when the buffer is full")
+	cmd.Flags().IntVar(&cmd.AuditRemoteWriteBufferSize, "audit-remote-write-buffer-size", cmd.AuditRemoteWriteBufferSize,
+		"number of values which may wait to be pushed to --audit-remote-write-url before new ones are dropped.")
+	cmd.Flags().StringVar(&cmd.AuditLog, "audit-log", cmd.AuditLog,
+		"Optional file every metric request is recorded to as a JSON line, with its user, metric, selector, result, values and latency, "+
+			"or - for the standard output. The events are written in the background and dropped when the buffer is full")
+	cmd.Flags().IntVar(&cmd.AuditLogBufferSize, "audit-log-buffer-size", cmd.AuditLogBufferSize,
+		"number of events which may wait to be written to --audit-log before new ones are dropped.")
+	cmd.Flags().BoolVar(&cmd.CMSPushEnabled, "cms-push-enabled", cmd.CMSPushEnabled,
+		"push every metric value returned by the adapter to CMS custom monitoring, so that it's visible in the CMS console. "+
+			"The values are pushed in the background and dropped when the buffer is full")
+	cmd.Flags().StringVar(&cmd.CMSPushGroupID, "cms-push-group-id", cmd.CMSPushGroupID,
+		"ID of the CMS application group the values are pushed to with --cms-push-enabled.")
+	cmd.Flags().StringVar(&cmd.CMSPushNamespace, "cms-push-namespace", cmd.CMSPushNamespace,
+		"prefix of the names of the metrics pushed with --cms-push-enabled, e.g. adapter_k8s_workload_cpu_util. Empty keeps the names as is.")
+	cmd.Flags().IntVar(&cmd.CMSPushBufferSize, "cms-push-buffer-size", cmd.CMSPushBufferSize,
+		"number of values which may wait to be pushed with --cms-push-enabled before new ones are dropped.")
+	cmd.Flags().StringArrayVar(&cmd.DefaultLabelMatchers, "default-label-matchers", cmd.DefaultLabelMatchers,
+		"Optional k=v label matcher ANDed into every generated Prometheus query unless overridden by a rule. Can be repeated")
 }
 
 func (cmd *AlibabaMetricsAdapterOptions) LoadConfig() error {
 	// load metrics discovery configuration
-	if cmd.AdapterConfigFile == "" {
+	if len(cmd.AdapterConfigFiles) == 0 {
 		return fmt.Errorf("no metrics discovery configuration file specified (make sure to use --config)")
 	}
+	if !config.IsDuplicatePolicy(config.DuplicatePolicy(cmd.ConfigDuplicates)) {
+		return fmt.Errorf("--config-duplicates %q is not supported, it must be one of %v", cmd.ConfigDuplicates, config.DuplicatePolicies)
+	}
 
-	metricsConfig, err := cfg.FromFile(cmd.AdapterConfigFile)
+	cmd.configLoader = config.NewLoader(cmd.AdapterConfigFiles, cmd.StrictConfig, config.DuplicatePolicy(cmd.ConfigDuplicates))
+	metricsConfig, err := cmd.configLoader.LoadOnStartup(cmd.ConfigLoadTimeout)
 	if err != nil {
 		return fmt.Errorf("unable to load metrics discovery configuration: %v", err)
 	}
@@ -82,23 +441,66 @@ func (cmd *AlibabaMetricsAdapterOptions) LoadConfig() error {
 	return nil
 }
 
-func (cmd *AlibabaMetricsAdapterOptions) MakePromClient() (prom.Client, error) {
+// ReloadConfig loads the configuration file again. A configuration which can't be loaded
+// doesn't replace the running one.
+func (cmd *AlibabaMetricsAdapterOptions) ReloadConfig() error {
+	if cmd.configLoader == nil {
+		return cmd.LoadConfig()
+	}
+	metricsConfig, err := cmd.configLoader.Reload()
+	if err != nil {
+		return fmt.Errorf("unable to reload metrics discovery configuration: %v", err)
+	}
+	cmd.MetricsConfig = metricsConfig
+	return nil
+}
+
+func (cmd *AlibabaMetricsAdapterOptions) MakePromClient(stopCh <-chan struct{}) (prom.Client, error) {
 	baseURL, err := url.Parse(cmd.PrometheusURL)
 	if err != nil {
 		return nil, fmt.Errorf("invalid Prometheus URL %q: %v", baseURL, err)
 	}
 
+	serverURL := baseURL.String()
 	var httpClient *http.Client
 
-	if cmd.PrometheusCAFile != "" {
-		prometheusCAClient, err := makePrometheusCAClient(cmd.PrometheusCAFile)
+	endpoints, err := cmd.PrometheusEndpoints()
+	if err != nil {
+		return nil, err
+	}
+	if len(endpoints) > 0 && baseURL.Scheme == utils.UnixSocketScheme {
+		return nil, fmt.Errorf("may not override the Prometheus endpoint of a unix socket")
+	}
+	if cmd.PrometheusTLSServerName != "" && cmd.PrometheusCAFile == "" {
+		return nil, fmt.Errorf("prometheus-tls-server-name requires prometheus-ca-file")
+	}
+
+	if baseURL.Scheme == utils.UnixSocketScheme {
+		var socket string
+		socket, baseURL, err = utils.ParseUnixSocketURL(baseURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Prometheus URL: %v", err)
+		}
+		if cmd.ARMSPrometheus || cmd.PrometheusCAFile != "" || cmd.PrometheusAuthInCluster || cmd.PrometheusAuthConf != "" {
+			return nil, fmt.Errorf("may not connect to Prometheus over a unix socket with arms-prometheus, a CA file or kubeconfig auth")
+		}
+		httpClient = &http.Client{Transport: utils.NewUnixSocketTransport(socket)}
+		klog.Infof("connecting to prometheus over unix socket %s", socket)
+	} else if cmd.ARMSPrometheus {
+		httpClient, err = cmd.makeARMSPrometheusClient()
+		if err != nil {
+			return nil, err
+		}
+		klog.Info("successfully using ARMS Prometheus auth")
+	} else if cmd.PrometheusCAFile != "" {
+		prometheusCAClient, err := makePrometheusCAClient(cmd.PrometheusCAFile, cmd.PrometheusTLSServerName, cmd.PrometheusHTTP2)
 		if err != nil {
 			return nil, err
 		}
 		httpClient = prometheusCAClient
 		klog.Info("successfully loaded ca from file")
 	} else {
-		kubeconfigHTTPClient, err := makeKubeconfigHTTPClient(cmd.PrometheusAuthInCluster, cmd.PrometheusAuthConf)
+		kubeconfigHTTPClient, err := makeKubeconfigHTTPClient(cmd.PrometheusAuthInCluster, cmd.PrometheusAuthConf, cmd.PrometheusHTTP2)
 		if err != nil {
 			return nil, err
 		}
@@ -114,33 +516,172 @@ func (cmd *AlibabaMetricsAdapterOptions) MakePromClient() (prom.Client, error) {
 		httpClient.Transport = transport.NewBearerAuthRoundTripper(string(data), httpClient.Transport)
 	}
 
-	genericPromClient := prom.NewGenericAPIClient(httpClient, baseURL, parseHeaderArgs(cmd.PrometheusHeaders))
-	instrumentedGenericPromClient := utils.InstrumentGenericAPIClient(genericPromClient, baseURL.String())
-	return prom.NewClientForAPI(instrumentedGenericPromClient), nil
+	if cmd.PrometheusTokenSecret != "" {
+		if cmd.PrometheusTokenFile != "" {
+			return nil, fmt.Errorf("may not use both prometheus-token-file and prometheus-token-secret at the same time")
+		}
+		tokenTransport, err := cmd.makeSecretTokenTransport(httpClient.Transport, stopCh)
+		if err != nil {
+			return nil, err
+		}
+		// http.DefaultClient may be in use, which must not be modified
+		httpClient = &http.Client{Transport: tokenTransport, Timeout: httpClient.Timeout}
+		klog.Infof("successfully loaded bearer token from secret %s", cmd.PrometheusTokenSecret)
+	}
+
+	// http.DefaultClient may be in use, which must not be modified
+	httpClient = &http.Client{Transport: utils.NewLimitedRoundTripper(httpClient.Transport, cmd.MaxResponseBytes), Timeout: httpClient.Timeout}
+
+	promClient := cmd.newPromClient(httpClient, baseURL, serverURL)
+	if cmd.PrometheusDedupReplicas {
+		klog.Infof("deduplicating prometheus series by replica labels %v", cmd.PrometheusReplicaLabels)
+	}
+
+	if len(endpoints) > 0 {
+		clients := make(map[string]prom.Client, len(endpoints))
+		for name, endpointURL := range endpoints {
+			clients[name] = cmd.newPromClient(httpClient, endpointURL, endpointURL.String())
+			klog.Infof("allowing the requests to query the prometheus endpoint %s at %s", name, endpointURL)
+		}
+		promClient = utils.NewEndpointRoutingClient(promClient, clients)
+	}
+	return promClient, nil
+}
+
+// newPromClient creates the client of the Prometheus at baseURL, which applies the deadline and
+// the concurrency limit of Prometheus to its calls.
+func (cmd *AlibabaMetricsAdapterOptions) newPromClient(httpClient *http.Client, baseURL *url.URL, serverURL string) prom.Client {
+	genericPromClient := utils.NewCorrelatingGenericAPIClient(httpClient, baseURL, parseHeaderArgs(cmd.PrometheusHeaders), cmd.PrometheusCorrelationHeader)
+	instrumentedGenericPromClient := utils.InstrumentGenericAPIClient(genericPromClient, serverURL)
+	promClient := utils.NewTimeoutClient(prom.NewClientForAPI(instrumentedGenericPromClient), utils.PrometheusBackend)
+	if cmd.PrometheusDedupReplicas {
+		promClient = utils.NewDeduplicatingClient(promClient, cmd.PrometheusReplicaLabels)
+	}
+	return promClient
+}
+
+// PrometheusEndpoints parses the Prometheus endpoints of PrometheusEndpointOverrides, by name.
+func (cmd *AlibabaMetricsAdapterOptions) PrometheusEndpoints() (map[string]*url.URL, error) {
+	endpoints := make(map[string]*url.URL, len(cmd.PrometheusEndpointOverrides))
+	for _, arg := range cmd.PrometheusEndpointOverrides {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || len(validation.IsValidLabelValue(parts[0])) > 0 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid prometheus endpoint override %q, it must be name=url with a name which is a valid label value", arg)
+		}
+		endpointURL, err := url.Parse(parts[1])
+		if err != nil || (endpointURL.Scheme != "http" && endpointURL.Scheme != "https") || endpointURL.Host == "" {
+			return nil, fmt.Errorf("invalid url of prometheus endpoint %s, it must be an http or https URL", parts[0])
+		}
+		if _, found := endpoints[parts[0]]; found {
+			return nil, fmt.Errorf("prometheus endpoint %s is overridden several times", parts[0])
+		}
+		endpoints[parts[0]] = endpointURL
+	}
+	return endpoints, nil
+}
+
+// ApplyEndpointOverrides makes the CMS and SLS clients use the overridden endpoints of their regions.
+func (cmd *AlibabaMetricsAdapterOptions) ApplyEndpointOverrides() error {
+	for backend, args := range map[utils.Backend][]string{
+		utils.CMSBackend: cmd.CMSEndpointOverrides,
+		utils.SLSBackend: cmd.SLSEndpointOverrides,
+	} {
+		endpoints, err := utils.ParseEndpointOverrides(args)
+		if err != nil {
+			return fmt.Errorf("invalid %s endpoint overrides: %v", backend, err)
+		}
+		utils.SetEndpointOverrides(backend, endpoints)
+	}
+	return nil
 }
 
-func makePrometheusCAClient(caFilename string) (*http.Client, error) {
+// makeARMSPrometheusClient creates the client of an ARMS Prometheus instance, which is
+// authenticated with the credentials of the Alibaba Cloud credential chain.
+func (cmd *AlibabaMetricsAdapterOptions) makeARMSPrometheusClient() (*http.Client, error) {
+	if cmd.PrometheusURL == defaultPrometheusURL {
+		return nil, fmt.Errorf("arms-prometheus requires prometheus-url to be the HTTP API URL of the ARMS Prometheus instance")
+	}
+	if cmd.PrometheusTokenFile != "" || cmd.PrometheusTokenSecret != "" || cmd.PrometheusAuthInCluster || cmd.PrometheusAuthConf != "" {
+		return nil, fmt.Errorf("may not use arms-prometheus together with another Prometheus auth")
+	}
+
+	rt := utils.NewDefaultTransport(cmd.PrometheusHTTP2)
+	if cmd.PrometheusCAFile != "" {
+		caClient, err := makePrometheusCAClient(cmd.PrometheusCAFile, cmd.PrometheusTLSServerName, cmd.PrometheusHTTP2)
+		if err != nil {
+			return nil, err
+		}
+		rt = caClient.Transport
+	}
+	return &http.Client{Transport: utils.NewARMSAuthRoundTripper(utils.GetAccessUserInfo, rt)}, nil
+}
+
+// ApplyBackendTimeouts makes the configured timeouts effective on the calls to each backend.
+func (cmd *AlibabaMetricsAdapterOptions) ApplyBackendTimeouts() {
+	utils.SetBackendTimeout(utils.PrometheusBackend, cmd.PrometheusQueryTimeout)
+	utils.SetBackendTimeout(utils.CMSBackend, cmd.CMSQueryTimeout)
+	utils.SetBackendTimeout(utils.SLSBackend, cmd.SLSQueryTimeout)
+	utils.SetBackendTimeout(utils.AHASBackend, cmd.AHASQueryTimeout)
+}
+
+// ApplyBackendConcurrency makes the configured concurrency limits effective on the calls to each backend.
+func (cmd *AlibabaMetricsAdapterOptions) ApplyBackendConcurrency() {
+	utils.SetBackendFairScheduling(cmd.BackendFairScheduling)
+	utils.SetBackendConcurrency(utils.PrometheusBackend, cmd.PrometheusMaxConcurrentCalls)
+	utils.SetBackendConcurrency(utils.CMSBackend, cmd.CMSMaxConcurrentCalls)
+	utils.SetBackendConcurrency(utils.SLSBackend, cmd.SLSMaxConcurrentCalls)
+	utils.SetBackendConcurrency(utils.AHASBackend, cmd.AHASMaxConcurrentCalls)
+	utils.SetMaxHedgedCalls(cmd.MaxHedgedCalls)
+	utils.SetRelistLimits(cmd.RelistMaxConcurrentQueries, cmd.RelistMaxQueriesPerSecond)
+}
+
+// ApplyRetryBudget makes the retry budget effective on the backends whose calls the adapter retries itself,
+// which is only SLS. The OpenAPI clients retry their failed calls on their own.
+func (cmd *AlibabaMetricsAdapterOptions) ApplyRetryBudget() {
+	utils.SetRetryBudget(utils.SLSBackend, cmd.RetryBudgetMaxTokens, cmd.RetryBudgetTokenRatio)
+}
+
+// makeSecretTokenTransport wraps the transport so that it sets the bearer token kept in prometheus-token-secret.
+func (cmd *AlibabaMetricsAdapterOptions) makeSecretTokenTransport(rt http.RoundTripper, stopCh <-chan struct{}) (http.RoundTripper, error) {
+	ref, err := utils.ParseSecretKeyRef(cmd.PrometheusTokenSecret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prometheus-token-secret: %v", err)
+	}
+	client, err := cmd.KubernetesClient()
+	if err != nil {
+		return nil, err
+	}
+	return utils.NewSecretTokenRoundTripper(client, ref, rt, stopCh)
+}
+
+// KubernetesClient creates a typed client of the kube apiserver the adapter runs against.
+func (cmd *AlibabaMetricsAdapterOptions) KubernetesClient() (kubernetes.Interface, error) {
+	clientConfig, err := cmd.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct kubernetes client config: %v", err)
+	}
+	client, err := kubernetes.NewForConfig(clientConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct kubernetes client: %v", err)
+	}
+	return client, nil
+}
+
+func makePrometheusCAClient(caFilename, serverName string, http2 bool) (*http.Client, error) {
 	data, err := ioutil.ReadFile(caFilename)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read prometheus-ca-file: %v", err)
 	}
 
-	pool := x509.NewCertPool()
-	if !pool.AppendCertsFromPEM(data) {
-		return nil, fmt.Errorf("no certs found in prometheus-ca-file")
+	rt, err := utils.NewCATransport(data, serverName, http2)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prometheus-ca-file: %v", err)
 	}
-
-	return &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				RootCAs: pool,
-			},
-		},
-	}, nil
+	return &http.Client{Transport: rt}, nil
 }
 
 // makeKubeconfigHTTPClient constructs an HTTP for connecting with the given auth options.
-func makeKubeconfigHTTPClient(inClusterAuth bool, kubeConfigPath string) (*http.Client, error) {
+func makeKubeconfigHTTPClient(inClusterAuth bool, kubeConfigPath string, http2 bool) (*http.Client, error) {
 	// make sure we're not trying to use two different sources of auth
 	if inClusterAuth && kubeConfigPath != "" {
 		return nil, fmt.Errorf("may not use both in-cluster auth and an explicit kubeconfig at the same time")
@@ -148,6 +689,9 @@ func makeKubeconfigHTTPClient(inClusterAuth bool, kubeConfigPath string) (*http.
 
 	// return the default client if we're using no auth
 	if !inClusterAuth && kubeConfigPath == "" {
+		if !http2 {
+			return &http.Client{Transport: utils.NewDefaultTransport(false)}, nil
+		}
 		return http.DefaultClient, nil
 	}
 
@@ -167,6 +711,9 @@ func makeKubeconfigHTTPClient(inClusterAuth bool, kubeConfigPath string) (*http.
 			return nil, fmt.Errorf("unable to construct in-cluster auth configuration for connecting to Prometheus: %v", err)
 		}
 	}
+	if !http2 {
+		authConf.NextProtos = []string{"http/1.1"}
+	}
 	tr, err := rest.TransportFor(authConf)
 	if err != nil {
 		return nil, fmt.Errorf("unable to construct client transport for connecting to Prometheus: %v", err)
@@ -187,12 +734,66 @@ func parseHeaderArgs(args []string) http.Header {
 	return headers
 }
 
+// defaultPrometheusURL is the Prometheus installed with ack-prometheus-operator.
+const defaultPrometheusURL = "http://ack-prometheus-operator-prometheus.monitoring.svc:9090"
+
+// defaultProbeMetric is the external metric which is served without any backend.
+const defaultProbeMetric = "adapter_probe"
+
 func NewAlibabaMetricsAdapterOptions() *AlibabaMetricsAdapterOptions {
 	opts := &AlibabaMetricsAdapterOptions{
-		PrometheusURL:         "http://ack-prometheus-operator-prometheus.monitoring.svc:9090",
-		MetricsRelistInterval: 10 * time.Minute,
-		MetricsMaxAge:         20 * time.Minute,
-		MetricsConfig:         new(cfg.MetricsDiscoveryConfig),
+		PrometheusURL:                       defaultPrometheusURL,
+		PrometheusHTTP2:                     true,
+		MetricsRelistInterval:               10 * time.Minute,
+		MetricsMaxAge:                       20 * time.Minute,
+		PrometheusEmptyResult:               "NotFound",
+		PrometheusUnitConventionsRateWindow: config.DefaultUnitConventionsRateWindow,
+		MetricsConfig:                       new(config.MetricsDiscoveryConfig),
+
+		PrometheusReplicaLabels: utils.DefaultReplicaLabels,
+
+		PrometheusQueryTimeout: utils.DefaultBackendTimeouts[utils.PrometheusBackend],
+		CMSQueryTimeout:        utils.DefaultBackendTimeouts[utils.CMSBackend],
+		SLSQueryTimeout:        utils.DefaultBackendTimeouts[utils.SLSBackend],
+		AHASQueryTimeout:       utils.DefaultBackendTimeouts[utils.AHASBackend],
+
+		PrometheusMaxConcurrentCalls: utils.DefaultBackendConcurrency[utils.PrometheusBackend],
+		CMSMaxConcurrentCalls:        utils.DefaultBackendConcurrency[utils.CMSBackend],
+		SLSMaxConcurrentCalls:        utils.DefaultBackendConcurrency[utils.SLSBackend],
+		AHASMaxConcurrentCalls:       utils.DefaultBackendConcurrency[utils.AHASBackend],
+		MaxHedgedCalls:               utils.DefaultMaxHedgedCalls,
+		RelistMaxConcurrentQueries:   utils.DefaultRelistConcurrency,
+
+		CMSBatchSize:        utils.DefaultCMSBatchSize,
+		CMSQueryConcurrency: utils.DefaultCMSConcurrency,
+
+		RetryBudgetTokenRatio: utils.DefaultRetryBudgetTokenRatio,
+		QueryTimeOffset:       utils.DefaultQueryTimeOffset,
+
+		SDKTransport:     utils.DefaultTransportConfig,
+		MaxResponseBytes: utils.DefaultMaxResponseBytes,
+
+		PrometheusCorrelationHeader: utils.DefaultCorrelationHeader,
+
+		CMSDimensionSchemaTTL: utils.DefaultCMSDimensionSchemaTTL,
+
+		SharedCacheTTL: 10 * time.Second,
+
+		InflightLimitRetryAfter: time.Second,
+
+		ProbeMetricName:  defaultProbeMetric,
+		ProbeMetricValue: 1,
+
+		ConfigLoadTimeout: 30 * time.Second,
+		ConfigDuplicates:  string(config.DuplicatesError),
+
+		ClusterID: os.Getenv(utils.ClusterIDEnv),
+
+		AuditRemoteWriteBufferSize: audit.DefaultBufferSize,
+		AuditLogBufferSize:         audit.DefaultBufferSize,
+
+		CMSPushNamespace:  cms.DefaultPushNamespace,
+		CMSPushBufferSize: cms.DefaultPushBufferSize,
 	}
 	return opts
 }
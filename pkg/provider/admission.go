@@ -0,0 +1,128 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/klog/v2"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// shedRequests counts the metric requests shed because too many distinct ones were in flight.
+var shedRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "adapter_shed_metric_requests_total",
+		Help: "Metric requests answered with 429 Too Many Requests because --max-inflight-metric-requests distinct requests were in flight.",
+	},
+	[]string{"metric"},
+)
+
+// admittedKey marks the context of a request admitted already, so that the metrics it's served from, e.g. the
+// base of a derived metric, don't take a slot of their own.
+type admittedKey struct{}
+
+// admissionGate bounds the distinct metric requests served by the backends at a time, e.g. when a large deployment
+// creates hundreds of HPAs at once. A request is distinct by its metric and selector: the requests of a metric and
+// selector in flight already are admitted, they don't add a query of their own to the spike. The others wait for
+// a slot up to a maximum wait, and are shed with a 429 Too Many Requests then, which the HPAs retry on their next
+// poll. The requests served from the cache aren't counted.
+type admissionGate struct {
+	clock clock.Clock
+	limit int
+	// wait is how long a request waits for a slot before it's shed, 0 sheds it right away
+	wait time.Duration
+	// retryAfter is the Retry-After of the shed requests
+	retryAfter time.Duration
+
+	lock sync.Mutex
+	// inFlight counts the requests in flight by key
+	inFlight map[string]int
+	// released is closed and replaced whenever a key leaves, to wake the waiting requests up
+	released chan struct{}
+}
+
+// newAdmissionGate returns nil if the distinct requests aren't limited.
+func newAdmissionGate(limit int, wait, retryAfter time.Duration, clock clock.Clock) *admissionGate {
+	if limit <= 0 {
+		return nil
+	}
+	utils.RegisterMetrics(shedRequests)
+	return &admissionGate{
+		clock:      clock,
+		limit:      limit,
+		wait:       wait,
+		retryAfter: retryAfter,
+		inFlight:   make(map[string]int),
+		released:   make(chan struct{}),
+	}
+}
+
+// admit waits for the request of the metric and key to be admitted, and returns its context and the function
+// releasing its slot once it's served. It returns a 429 Too Many Requests error if it's shed.
+func (g *admissionGate) admit(ctx context.Context, metric, key string) (context.Context, func(), error) {
+	if g == nil || ctx.Value(admittedKey{}) != nil {
+		return ctx, func() {}, nil
+	}
+	var timeout <-chan time.Time
+	for {
+		g.lock.Lock()
+		if users, found := g.inFlight[key]; found || len(g.inFlight) < g.limit {
+			g.inFlight[key] = users + 1
+			g.lock.Unlock()
+			return context.WithValue(ctx, admittedKey{}, true), func() { g.release(key) }, nil
+		}
+		released := g.released
+		g.lock.Unlock()
+
+		if g.wait <= 0 {
+			return ctx, nil, g.shed(metric)
+		}
+		if timeout == nil {
+			timer := g.clock.NewTimer(g.wait)
+			defer timer.Stop()
+			timeout = timer.C()
+		}
+		select {
+		case <-released:
+		case <-timeout:
+			return ctx, nil, g.shed(metric)
+		case <-ctx.Done():
+			return ctx, nil, ctx.Err()
+		}
+	}
+}
+
+// customMetricAdmissionKey is the key of a request of a custom metric for the objects named or selected.
+func customMetricAdmissionKey(ctx context.Context, namespace string, info p.CustomMetricInfo, objects string, metricSelector labels.Selector) string {
+	key := "custom/" + info.String() + "/" + namespace + "/" + objects + "/" + metricSelector.String()
+	if endpoint, overridden := utils.PrometheusEndpoint(ctx); overridden {
+		key += "#" + endpoint
+	}
+	return key
+}
+
+func (g *admissionGate) release(key string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.inFlight[key]--
+	if g.inFlight[key] > 0 {
+		return
+	}
+	delete(g.inFlight, key)
+	close(g.released)
+	g.released = make(chan struct{})
+}
+
+func (g *admissionGate) shed(metric string) error {
+	shedRequests.WithLabelValues(metric).Inc()
+	klog.V(2).Infof("Shed a request of metric %s, %d distinct requests are in flight", metric, g.limit)
+	retryAfter := int((g.retryAfter + time.Second - 1) / time.Second)
+	return apierr.NewTooManyRequests(fmt.Sprintf("metric %s can't be served now: %d distinct metric requests are in flight, retry later", metric, g.limit), retryAfter)
+}
@@ -0,0 +1,143 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// heldExternalProvider holds every call until it's unblocked.
+type heldExternalProvider struct {
+	*countingExternalProvider
+	lock    sync.Mutex
+	started chan string
+	unblock chan struct{}
+}
+
+func (b *heldExternalProvider) GetExternalMetric(ctx context.Context, namespace string, metricSelector labels.Selector, info p.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
+	b.started <- metricSelector.String()
+	<-b.unblock
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.countingExternalProvider.GetExternalMetric(ctx, namespace, metricSelector, info)
+}
+
+func newAdmissionManager(limit int, wait time.Duration) (*providerManager, *heldExternalProvider, *clock.FakeClock) {
+	pm, backend, fakeClock := newCachingManager(0)
+	blocking := &heldExternalProvider{countingExternalProvider: backend, started: make(chan string, 100), unblock: make(chan struct{})}
+	pm.alibabaCloudProvider = blocking
+	pm.admission = newAdmissionGate(limit, wait, 2500*time.Millisecond, fakeClock)
+	return pm, blocking, fakeClock
+}
+
+func requestMetric(pm *providerManager, selector string) error {
+	metricSelector, err := labels.Parse(selector)
+	if err != nil {
+		return err
+	}
+	_, err = pm.GetExternalMetric(context.TODO(), "default", metricSelector, p.ExternalMetricInfo{Metric: "slb_l7_qps"})
+	return err
+}
+
+func TestAdmissionShedsARequestSpike(t *testing.T) {
+	pm, backend, _ := newAdmissionManager(3, 0)
+
+	errs := make(chan error, 100)
+	for i := 0; i < 3; i++ {
+		go func(i int) { errs <- requestMetric(pm, fmt.Sprintf("slb.instance.id=lb-%d", i)) }(i)
+	}
+	for i := 0; i < 3; i++ {
+		<-backend.started
+	}
+
+	// the spike of other selectors is shed while the limit is reached
+	for i := 3; i < 50; i++ {
+		err := requestMetric(pm, fmt.Sprintf("slb.instance.id=lb-%d", i))
+		if !apierr.IsTooManyRequests(err) {
+			t.Fatalf("expected request %d to be shed with 429, got %v", i, err)
+		}
+		if retryAfter, ok := apierr.SuggestsClientDelay(err); !ok || retryAfter != 3 {
+			t.Errorf("expected a Retry-After of 3s, got %d", retryAfter)
+		}
+	}
+	// a selector in flight already is admitted
+	go func() { errs <- requestMetric(pm, "slb.instance.id=lb-0") }()
+	if selector := <-backend.started; selector != "slb.instance.id=lb-0" {
+		t.Errorf("expected the selector in flight to be admitted, got %s", selector)
+	}
+
+	close(backend.unblock)
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("expected the admitted requests to be served, got %v", err)
+		}
+	}
+	if backend.calls != 4 {
+		t.Errorf("expected only the admitted requests to reach the backend, got %d calls", backend.calls)
+	}
+	// the slots are released once the requests are served
+	if err := requestMetric(pm, "slb.instance.id=lb-9"); err != nil {
+		t.Errorf("expected a request to be admitted once the spike is over, got %v", err)
+	}
+}
+
+func TestAdmissionWaitsForASlot(t *testing.T) {
+	pm, backend, fakeClock := newAdmissionManager(1, time.Minute)
+
+	first := make(chan error, 1)
+	go func() { first <- requestMetric(pm, "slb.instance.id=lb-1") }()
+	<-backend.started
+
+	// a request is shed once it waited for a slot for the whole wait
+	shed := make(chan error, 1)
+	go func() { shed <- requestMetric(pm, "slb.instance.id=lb-2") }()
+	for !fakeClock.HasWaiters() {
+		time.Sleep(time.Millisecond)
+	}
+	fakeClock.Step(time.Minute)
+	if err := <-shed; !apierr.IsTooManyRequests(err) {
+		t.Errorf("expected the request waiting beyond the wait to be shed, got %v", err)
+	}
+
+	// a request gets the slot of a request served within the wait
+	admitted := make(chan error, 1)
+	go func() { admitted <- requestMetric(pm, "slb.instance.id=lb-3") }()
+	for !fakeClock.HasWaiters() {
+		time.Sleep(time.Millisecond)
+	}
+	fakeClock.Step(30 * time.Second)
+	backend.unblock <- struct{}{}
+	if err := <-first; err != nil {
+		t.Fatalf("Failed to get metric, because of %v", err)
+	}
+	if selector := <-backend.started; selector != "slb.instance.id=lb-3" {
+		t.Errorf("expected the waiting request to get the slot, got %s", selector)
+	}
+	backend.unblock <- struct{}{}
+	if err := <-admitted; err != nil {
+		t.Errorf("expected the request which got the slot to be served, got %v", err)
+	}
+}
+
+func TestAdmissionStopsWaitingForCancelledRequests(t *testing.T) {
+	gate := newAdmissionGate(1, time.Minute, time.Second, clock.NewFakeClock(time.Now()))
+	_, release, err := gate.admit(context.TODO(), "slb_l7_qps", "lb-1")
+	if err != nil {
+		t.Fatalf("Failed to admit request, because of %v", err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := gate.admit(ctx, "slb_l7_qps", "lb-2"); err != context.Canceled {
+		t.Errorf("expected a cancelled request to stop waiting, got %v", err)
+	}
+}
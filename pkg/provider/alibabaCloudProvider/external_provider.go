@@ -16,6 +16,7 @@ limitations under the License.
 package alibabaCloudProvider
 
 import (
+	"context"
 	"errors"
 	"k8s.io/apimachinery/pkg/labels"
 	log "k8s.io/klog/v2"
@@ -24,7 +25,7 @@ import (
 )
 
 // return metrics with specific labels
-func (ep *AlibabaCloudMetricsProvider) GetExternalMetric(namespace string, metricSelector labels.Selector, info p.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
+func (ep *AlibabaCloudMetricsProvider) GetExternalMetric(ctx context.Context, namespace string, metricSelector labels.Selector, info p.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
 	log.V(4).Infof("Received request for namespace: %s, metric name: %s, metric selectors: %s", namespace, info.Metric, metricSelector.String())
 
 	r, selectable := metricSelector.Requirements()
@@ -34,7 +35,7 @@ func (ep *AlibabaCloudMetricsProvider) GetExternalMetric(namespace string, metri
 		return nil, err
 	}
 
-	metricValues, err := ep.eManager.GetExternalMetrics(namespace, r, info)
+	metricValues, err := ep.eManager.GetExternalMetrics(ctx, namespace, r, info)
 	if err != nil {
 		log.Errorf("Failed to GetExternalMetrics, because of %v ", err)
 		return nil, err
@@ -59,3 +60,8 @@ func (ep *AlibabaCloudMetricsProvider) ListAllExternalMetrics() []p.ExternalMetr
 	}
 	return externalMetricsInfo
 }
+
+// MetricProvider returns the name of the provider in the provider registry serving the metric, e.g. cms.
+func (ep *AlibabaCloudMetricsProvider) MetricProvider(metric string) (string, bool) {
+	return ep.eManager.MetricProvider(metric)
+}
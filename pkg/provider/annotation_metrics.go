@@ -0,0 +1,162 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	prometheusCustomMetricsProvider "github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/provider/prometheusProvider/custom-provider"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider/helpers"
+)
+
+// annotationMetrics serves the custom metrics configured in annotationMetrics, whose value is read from an
+// annotation of the requested object through an informer, e.g. a manual override of the scaling of a Deployment.
+type annotationMetrics struct {
+	mapper apimeta.RESTMapper
+	lister prometheusCustomMetricsProvider.ObjectAnnotationLister
+	// annotations are the annotations holding the values, by metric
+	annotations map[string]string
+	// resources are the resources each metric is served for, by metric
+	resources map[string][]schema.GroupResource
+}
+
+// newAnnotationMetrics returns nil if no annotation metric is configured.
+func newAnnotationMetrics(metrics []config.AnnotationMetric, mapper apimeta.RESTMapper, lister prometheusCustomMetricsProvider.ObjectAnnotationLister) *annotationMetrics {
+	if len(metrics) == 0 {
+		return nil
+	}
+	a := &annotationMetrics{
+		mapper:      mapper,
+		lister:      lister,
+		annotations: make(map[string]string, len(metrics)),
+		resources:   make(map[string][]schema.GroupResource, len(metrics)),
+	}
+	for _, m := range metrics {
+		a.annotations[m.Name] = m.Annotation
+		for _, r := range m.Resources {
+			a.resources[m.Name] = append(a.resources[m.Name], schema.ParseGroupResource(r))
+		}
+	}
+	return a
+}
+
+// serves tells whether the metric of the resource is read from an annotation.
+func (a *annotationMetrics) serves(info p.CustomMetricInfo) bool {
+	if a == nil {
+		return false
+	}
+	for _, r := range a.resources[info.Metric] {
+		if r == info.GroupResource {
+			return true
+		}
+	}
+	return false
+}
+
+// list adds the annotation metrics to the listed custom metrics, for the resources the apiserver knows.
+func (a *annotationMetrics) list(infos []p.CustomMetricInfo) []p.CustomMetricInfo {
+	if a == nil {
+		return infos
+	}
+	for metric, resources := range a.resources {
+		for _, r := range resources {
+			namespaced, err := a.namespaced(r)
+			if err != nil {
+				klog.V(4).Infof("Not listing annotation metric %s of %s, because of %v", metric, r, err)
+				continue
+			}
+			infos = append(infos, p.CustomMetricInfo{GroupResource: r, Namespaced: namespaced, Metric: metric})
+		}
+	}
+	return infos
+}
+
+func (a *annotationMetrics) namespaced(r schema.GroupResource) (bool, error) {
+	gvk, err := a.mapper.KindFor(r.WithVersion(""))
+	if err != nil {
+		return false, err
+	}
+	mapping, err := a.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return false, err
+	}
+	return mapping.Scope.Name() == apimeta.RESTScopeNameNamespace, nil
+}
+
+// metricByName returns the value of the annotation of the object, which is not found without the annotation.
+func (a *annotationMetrics) metricByName(ctx context.Context, name types.NamespacedName, info p.CustomMetricInfo) (*custom_metrics.MetricValue, error) {
+	gvr, err := helpers.ResourceFor(a.mapper, info)
+	if err != nil {
+		return nil, apierr.NewInternalError(fmt.Errorf("unable to map resource %s: %v", info.GroupResource, err))
+	}
+	annotations, err := a.lister.Annotations(ctx, gvr, name)
+	if err != nil {
+		return nil, apierr.NewInternalError(fmt.Errorf("unable to read the annotations of %s %s: %v", info.GroupResource, name, err))
+	}
+	raw, found := annotations[a.annotations[info.Metric]]
+	if !found {
+		return nil, apierr.NewNotFound(schema.GroupResource{Group: custom_metrics.GroupName, Resource: info.Metric},
+			fmt.Sprintf("%s %s has no annotation %s", info.GroupResource, name, a.annotations[info.Metric]))
+	}
+	return a.metricValue(name, info, raw)
+}
+
+// metricBySelector returns the values of the objects matching the selector, skipping the ones without the annotation.
+func (a *annotationMetrics) metricBySelector(ctx context.Context, namespace string, selector labels.Selector, info p.CustomMetricInfo) (*custom_metrics.MetricValueList, error) {
+	gvr, err := helpers.ResourceFor(a.mapper, info)
+	if err != nil {
+		return nil, apierr.NewInternalError(fmt.Errorf("unable to map resource %s: %v", info.GroupResource, err))
+	}
+	objects, err := a.lister.AnnotationsBySelector(ctx, gvr, namespace, selector)
+	if err != nil {
+		return nil, apierr.NewInternalError(fmt.Errorf("unable to read the annotations of %s: %v", info.GroupResource, err))
+	}
+	names := make([]string, 0, len(objects))
+	for name := range objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := &custom_metrics.MetricValueList{Items: []custom_metrics.MetricValue{}}
+	for _, name := range names {
+		raw, found := objects[name][a.annotations[info.Metric]]
+		if !found {
+			continue
+		}
+		value, err := a.metricValue(types.NamespacedName{Namespace: namespace, Name: name}, info, raw)
+		if err != nil {
+			return nil, err
+		}
+		values.Items = append(values.Items, *value)
+	}
+	return values, nil
+}
+
+func (a *annotationMetrics) metricValue(name types.NamespacedName, info p.CustomMetricInfo, raw string) (*custom_metrics.MetricValue, error) {
+	quantity, err := resource.ParseQuantity(raw)
+	if err != nil {
+		return nil, apierr.NewInternalError(fmt.Errorf("annotation %s of %s %s is no quantity, e.g. 10 or 1500m: %q",
+			a.annotations[info.Metric], info.GroupResource, name, raw))
+	}
+	ref, err := helpers.ReferenceFor(a.mapper, name, info)
+	if err != nil {
+		return nil, err
+	}
+	return &custom_metrics.MetricValue{
+		DescribedObject: ref,
+		Metric:          custom_metrics.MetricIdentifier{Name: info.Metric},
+		Timestamp:       metav1.Time{Time: time.Now()},
+		Value:           quantity,
+	}, nil
+}
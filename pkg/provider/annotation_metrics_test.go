@@ -0,0 +1,108 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	prometheusCustomMetricsProvider "github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/provider/prometheusProvider/custom-provider"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	fakedyn "k8s.io/client-go/dynamic/fake"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+const scaleOverrideAnnotation = "metrics.example.com/scale-override"
+
+var deploymentsResource = schema.GroupResource{Group: "apps", Resource: "deployments"}
+
+func annotatedDeployment(name string, annotations map[string]string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("apps/v1")
+	obj.SetKind("Deployment")
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	obj.SetLabels(map[string]string{"team": "checkout"})
+	obj.SetAnnotations(annotations)
+	return obj
+}
+
+func newTestAnnotationMetrics(t *testing.T, objects ...runtime.Object) *providerManager {
+	mapper := apimeta.NewDefaultRESTMapper([]schema.GroupVersion{{Group: "apps", Version: "v1"}})
+	mapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, apimeta.RESTScopeNamespace)
+	client := fakedyn.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{deploymentsResource.WithVersion("v1"): "DeploymentList"}, objects...)
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+
+	return &providerManager{
+		prometheusCustomProvider: &staticCustomProvider{metric: "http_requests", value: 1},
+		annotationMetrics: newAnnotationMetrics([]config.AnnotationMetric{
+			{Name: "scale_override", Annotation: scaleOverrideAnnotation, Resources: []string{"deployments.apps"}},
+		}, mapper, prometheusCustomMetricsProvider.NewInformerAnnotationLister(client, stopCh)),
+	}
+}
+
+func TestAnnotationMetricByName(t *testing.T) {
+	pm := newTestAnnotationMetrics(t,
+		annotatedDeployment("checkout", map[string]string{scaleOverrideAnnotation: "1500m"}),
+		annotatedDeployment("cart", nil),
+		annotatedDeployment("broken", map[string]string{scaleOverrideAnnotation: "many"}),
+	)
+	info := p.CustomMetricInfo{GroupResource: deploymentsResource, Namespaced: true, Metric: "scale_override"}
+
+	value, err := pm.GetMetricByName(context.TODO(), types.NamespacedName{Namespace: "default", Name: "checkout"}, info, labels.Everything())
+	if err != nil {
+		t.Fatalf("Failed to get the annotation metric, because of %v", err)
+	}
+	if value.Value.MilliValue() != 1500 || value.DescribedObject.Kind != "Deployment" || value.DescribedObject.Name != "checkout" {
+		t.Errorf("expected the value of the annotation of deployment checkout, got %v of %v", value.Value.String(), value.DescribedObject)
+	}
+
+	if _, err := pm.GetMetricByName(context.TODO(), types.NamespacedName{Namespace: "default", Name: "cart"}, info, labels.Everything()); !apierr.IsNotFound(err) {
+		t.Errorf("expected an object without the annotation not to have the metric, got %v", err)
+	}
+	if _, err := pm.GetMetricByName(context.TODO(), types.NamespacedName{Namespace: "default", Name: "broken"}, info, labels.Everything()); !apierr.IsInternalError(err) {
+		t.Errorf("expected an annotation which isn't a quantity to fail, got %v", err)
+	}
+
+	// the other metrics of the resource are still served by the backends
+	other := p.CustomMetricInfo{GroupResource: deploymentsResource, Namespaced: true, Metric: "http_requests"}
+	if value, err := pm.GetMetricByName(context.TODO(), types.NamespacedName{Namespace: "default", Name: "checkout"}, other, labels.Everything()); err != nil || value.Value.Value() != 1 {
+		t.Errorf("expected the other metrics to be served by the backends, got %v, %v", value, err)
+	}
+}
+
+func TestAnnotationMetricBySelector(t *testing.T) {
+	pm := newTestAnnotationMetrics(t,
+		annotatedDeployment("checkout", map[string]string{scaleOverrideAnnotation: "3"}),
+		annotatedDeployment("cart", nil),
+		annotatedDeployment("payment", map[string]string{scaleOverrideAnnotation: "5"}),
+	)
+	info := p.CustomMetricInfo{GroupResource: deploymentsResource, Namespaced: true, Metric: "scale_override"}
+
+	values, err := pm.GetMetricBySelector(context.TODO(), "default", labels.SelectorFromSet(labels.Set{"team": "checkout"}), info, labels.Everything())
+	if err != nil {
+		t.Fatalf("Failed to get the annotation metric, because of %v", err)
+	}
+	if len(values.Items) != 2 || values.Items[0].DescribedObject.Name != "checkout" || values.Items[0].Value.Value() != 3 ||
+		values.Items[1].DescribedObject.Name != "payment" || values.Items[1].Value.Value() != 5 {
+		t.Errorf("expected the values of the annotated deployments, got %v", values.Items)
+	}
+}
+
+func TestListAnnotationMetrics(t *testing.T) {
+	pm := newTestAnnotationMetrics(t)
+	expected := p.CustomMetricInfo{GroupResource: deploymentsResource, Namespaced: true, Metric: "scale_override"}
+	for _, info := range pm.ListAllMetrics() {
+		if info == expected {
+			return
+		}
+	}
+	t.Errorf("expected the annotation metric to be listed, got %v", pm.ListAllMetrics())
+}
@@ -0,0 +1,152 @@
+package provider
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+type anomalyState struct {
+	// recent are the last accepted values, the oldest first
+	recent      []float64
+	lastGood    resource.Quantity
+	rejections  int
+	lastQueried time.Time
+}
+
+func (s *anomalyState) accept(quantity resource.Quantity, value float64, window int) {
+	if s.recent = append(s.recent, value); len(s.recent) > window {
+		s.recent = s.recent[1:]
+	}
+	s.lastGood = quantity
+	s.rejections = 0
+}
+
+func (s *anomalyState) average() float64 {
+	var sum float64
+	for _, v := range s.recent {
+		sum += v
+	}
+	return sum / float64(len(s.recent))
+}
+
+// anomalyFilter replaces the values of the configured metrics which deviate more than a factor from
+// the average of their recent values, e.g. a bad data point, with the last good value. A value of 0
+// of a metric with scaleToZero is a genuine drop to zero, which is accepted.
+type anomalyFilter struct {
+	lock      sync.Mutex
+	clock     clock.Clock
+	rejection map[string]config.AnomalyRejection
+	// settings tell the metrics with scaleToZero, see utils.MetricSettings
+	settings  *utils.ExternalMetricSettings
+	states    map[string]*anomalyState
+	lastSweep time.Time
+}
+
+// newAnomalyFilter returns nil if no metric rejects its anomalies.
+func newAnomalyFilter(externalMetrics []config.ExternalMetric, settings *utils.ExternalMetricSettings, clock clock.Clock) *anomalyFilter {
+	rejection := make(map[string]config.AnomalyRejection)
+	for _, m := range externalMetrics {
+		if m.AnomalyRejection == nil {
+			continue
+		}
+		r := *m.AnomalyRejection
+		if r.Window == 0 {
+			r.Window = config.DefaultAnomalyWindow
+		}
+		if r.MaxRejections == 0 {
+			r.MaxRejections = config.DefaultAnomalyMaxRejections
+		}
+		if r.ExpireAfter == 0 {
+			r.ExpireAfter = config.DefaultAnomalyExpireAfter
+		}
+		rejection[m.Name] = r
+	}
+	if len(rejection) == 0 {
+		return nil
+	}
+	return &anomalyFilter{
+		clock:     clock,
+		rejection: rejection,
+		settings:  settings,
+		states:    make(map[string]*anomalyState),
+		lastSweep: clock.Now(),
+	}
+}
+
+// filter checks the values read for the request identified by key against the recent values of their
+// series, and replaces the anomalies with the last good value. The values of other metrics are returned as is.
+func (f *anomalyFilter) filter(metric, key string, values *external_metrics.ExternalMetricValueList) *external_metrics.ExternalMetricValueList {
+	if f == nil {
+		return values
+	}
+	rejection, found := f.rejection[metric]
+	if !found {
+		return values
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	now := f.clock.Now()
+	f.sweep(now, rejection.ExpireAfter)
+
+	filtered := values.DeepCopy()
+	for i := range filtered.Items {
+		item := &filtered.Items[i]
+		itemKey := key + "/" + seriesLabels(item.MetricLabels)
+		value := item.Value.AsApproximateFloat64()
+
+		state, found := f.states[itemKey]
+		if !found || now.Sub(state.lastQueried) > rejection.ExpireAfter {
+			state = &anomalyState{}
+			f.states[itemKey] = state
+		}
+		state.lastQueried = now
+		if value == 0 && f.settings.Of(metric).ScaleToZero ||
+			len(state.recent) < rejection.Window || state.rejections >= rejection.MaxRejections || !isAnomaly(value, state.average(), rejection.Factor) {
+			if state.rejections >= rejection.MaxRejections {
+				// the level of the metric changed, the average starts over from the new values
+				klog.Warningf("External metric %s of %s: accepting %v after %d rejected values in a row", metric, itemKey, value, state.rejections)
+				state.recent = nil
+			}
+			state.accept(item.Value, value, rejection.Window)
+			continue
+		}
+		state.rejections++
+		klog.Warningf("External metric %s of %s: rejecting %v, which deviates more than %v times from the recent average %v, returning the last good value",
+			metric, itemKey, value, rejection.Factor, state.average())
+		item.Value = state.lastGood
+	}
+	return filtered
+}
+
+// isAnomaly tells whether the value is more than factor times greater or smaller than the average.
+// Any value is fine for an average of 0, from which no ratio can be told.
+func isAnomaly(value, average, factor float64) bool {
+	value, average = math.Abs(value), math.Abs(average)
+	if average == 0 {
+		return false
+	}
+	return value > average*factor || value < average/factor
+}
+
+// sweep drops the recent values of the series which weren't queried for a while.
+func (f *anomalyFilter) sweep(now time.Time, expireAfter time.Duration) {
+	if now.Sub(f.lastSweep) <= expireAfter {
+		return
+	}
+	for k, state := range f.states {
+		if now.Sub(state.lastQueried) > expireAfter {
+			delete(f.states, k)
+		}
+	}
+	f.lastSweep = now
+}
@@ -0,0 +1,104 @@
+package provider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+func newTestAnomalyFilter() (*anomalyFilter, *clock.FakeClock) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	return newAnomalyFilter([]config.ExternalMetric{
+		{Name: "slb_l7_qps", AnomalyRejection: &config.AnomalyRejection{Factor: 10, Window: 3, MaxRejections: 2, ExpireAfter: time.Minute}},
+	}, nil, fakeClock), fakeClock
+}
+
+func TestAnomalyFilterRejectsOutlier(t *testing.T) {
+	filter, _ := newTestAnomalyFilter()
+
+	for i, tc := range []struct {
+		raw      int64
+		expected int64
+	}{
+		// the window fills up
+		{raw: 100, expected: 100},
+		{raw: 120, expected: 120},
+		{raw: 110, expected: 110},
+		// a bad data point 100 times the average
+		{raw: 11000, expected: 110},
+		{raw: 130, expected: 130},
+		// a drop to almost nothing
+		{raw: 1, expected: 130},
+	} {
+		filtered := filter.filter("slb_l7_qps", "key", valueList(tc.raw))
+		if value := filtered.Items[0].Value.Value(); value != tc.expected {
+			t.Errorf("poll %d: expected %d, got %d", i, tc.expected, value)
+		}
+	}
+}
+
+func TestAnomalyFilterAcceptsLastingChange(t *testing.T) {
+	filter, _ := newTestAnomalyFilter()
+	for _, raw := range []int64{100, 100, 100} {
+		filter.filter("slb_l7_qps", "key", valueList(raw))
+	}
+
+	// a real surge is rejected for MaxRejections values, then becomes the new level
+	for i, expected := range []int64{100, 100, 5000, 5000} {
+		filtered := filter.filter("slb_l7_qps", "key", valueList(5000))
+		if value := filtered.Items[0].Value.Value(); value != expected {
+			t.Errorf("poll %d of the surge: expected %d, got %d", i, expected, value)
+		}
+	}
+}
+
+func TestAnomalyFilterPerSeries(t *testing.T) {
+	filter, fakeClock := newTestAnomalyFilter()
+	for i := 0; i < 3; i++ {
+		filter.filter("slb_l7_qps", "key", valueList(10, 1000))
+	}
+
+	filtered := filter.filter("slb_l7_qps", "key", valueList(1000, 1000))
+	if a, b := filtered.Items[0].Value.Value(), filtered.Items[1].Value.Value(); a != 10 || b != 1000 {
+		t.Errorf("expected each series to be checked against its own values, got %d and %d", a, b)
+	}
+
+	// the values of other metrics, or after the expiry, are returned as is
+	if filtered := filter.filter("http_requests", "key", valueList(1)); filtered.Items[0].Value.Value() != 1 {
+		t.Errorf("expected a metric without anomaly rejection to be returned as is, got %v", filtered.Items[0].Value)
+	}
+	fakeClock.Step(2 * time.Minute)
+	if filtered := filter.filter("slb_l7_qps", "key", valueList(1)); filtered.Items[0].Value.Value() != 1 {
+		t.Errorf("expected the recent values to expire, got %v", filtered.Items[0].Value)
+	}
+}
+
+func TestAnomalyFilterAcceptsZero(t *testing.T) {
+	rejection := &config.AnomalyRejection{Factor: 10, Window: 3, MaxRejections: 2, ExpireAfter: time.Minute}
+	metricsConfig := &config.MetricsDiscoveryConfig{ExternalMetrics: []config.ExternalMetric{
+		{Name: "slb_l7_qps", AnomalyRejection: rejection, ScaleToZero: true},
+		{Name: "other_qps", AnomalyRejection: rejection},
+	}}
+	filter := newAnomalyFilter(metricsConfig.ExternalMetrics, metricsConfig.MetricSettings(), clock.NewFakeClock(time.Now()))
+	for _, raw := range []int64{100, 100, 100} {
+		filter.filter("slb_l7_qps", "key", valueList(raw))
+		filter.filter("other_qps", "other", valueList(raw))
+	}
+
+	// the traffic stopped, which lets the workload scale to zero
+	if filtered := filter.filter("slb_l7_qps", "key", valueList(0)); filtered.Items[0].Value.Value() != 0 {
+		t.Errorf("expected a genuine zero to be accepted, got %v", filtered.Items[0].Value)
+	}
+	// the metrics which didn't opt in are unchanged
+	if filtered := filter.filter("other_qps", "other", valueList(0)); filtered.Items[0].Value.Value() != 100 {
+		t.Errorf("expected a zero of a metric without scaleToZero to be rejected, got %v", filtered.Items[0].Value)
+	}
+}
+
+func TestNewAnomalyFilterWithoutRejection(t *testing.T) {
+	if filter := newAnomalyFilter([]config.ExternalMetric{{Name: "slb_l7_qps"}}, nil, clock.RealClock{}); filter != nil {
+		t.Errorf("expected no filter without anomaly rejection, got %+v", filter)
+	}
+}
@@ -0,0 +1,45 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/audit"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+func TestAuditLogRecordsEveryRequest(t *testing.T) {
+	var out bytes.Buffer
+	pm := &providerManager{
+		alibabaCloudProvider:       &countingExternalProvider{metric: "slb_l7_qps"},
+		prometheusExternalProvider: &countingExternalProvider{metric: "http_requests"},
+		cache:                      newExternalMetricsCache(time.Minute, clock.NewFakeClock(time.Now())),
+		auditLog:                   audit.NewEventLogger(&out, 10),
+	}
+
+	selector, _ := labels.Parse("slb.instance.id=lb-1")
+	for _, metric := range []string{"slb_l7_qps", "slb_l7_qps", "unknown_metric"} {
+		pm.GetExternalMetric(context.TODO(), "default", selector, p.ExternalMetricInfo{Metric: metric})
+	}
+	pm.auditLog.Flush()
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected an audit event per request, got %q", out.String())
+	}
+	for i, result := range []string{audit.ResultSuccess, audit.ResultSuccess, audit.ResultError} {
+		var event audit.Event
+		if err := json.Unmarshal([]byte(lines[i]), &event); err != nil {
+			t.Fatalf("Failed to decode audit event, because of %v", err)
+		}
+		if event.API != "external" || event.Namespace != "default" || event.Selector != "slb.instance.id=lb-1" || event.Result != result {
+			t.Errorf("unexpected audit event %d: %s", i, lines[i])
+		}
+	}
+}
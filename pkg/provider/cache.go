@@ -0,0 +1,166 @@
+package provider
+
+import (
+	"sync"
+	"time"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+const (
+	// CacheLabel is the selector label which tells how the cache serves a request.
+	// It's stripped from the selector before the request reaches a backend.
+	CacheLabel = "cache"
+	// CacheBypass forces a fresh read of the backend, which refreshes the cache.
+	CacheBypass = "bypass"
+)
+
+type cacheEntry struct {
+	values  *external_metrics.ExternalMetricValueList
+	expires time.Time
+}
+
+// externalMetricsCache keeps the external metric values for a ttl. A zero ttl disables it.
+type externalMetricsCache struct {
+	lock      sync.Mutex
+	ttl       time.Duration
+	clock     clock.Clock
+	entries   map[string]cacheEntry
+	lastSweep time.Time
+}
+
+func newExternalMetricsCache(ttl time.Duration, clock clock.Clock) *externalMetricsCache {
+	return &externalMetricsCache{
+		ttl:       ttl,
+		clock:     clock,
+		entries:   make(map[string]cacheEntry),
+		lastSweep: clock.Now(),
+	}
+}
+
+func externalMetricsCacheKey(namespace string, metricSelector labels.Selector, info p.ExternalMetricInfo) string {
+	return info.Metric + "/" + namespace + "/" + metricSelector.String()
+}
+
+func (c *externalMetricsCache) get(key string) (*external_metrics.ExternalMetricValueList, bool) {
+	if c == nil || c.ttl <= 0 {
+		return nil, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, found := c.entries[key]
+	if !found || c.clock.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.values.DeepCopy(), true
+}
+
+func (c *externalMetricsCache) set(key string, values *external_metrics.ExternalMetricValueList) {
+	if c == nil || c.ttl <= 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.clock.Now()
+	// drop the entries of the selectors which aren't queried anymore
+	if now.Sub(c.lastSweep) > c.ttl {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	c.entries[key] = cacheEntry{values: values.DeepCopy(), expires: now.Add(c.ttl)}
+}
+
+type notFoundEntry struct {
+	err     error
+	expires time.Time
+}
+
+// notFoundCache keeps the not found errors of the external metrics for a ttl, which spares the backend
+// the repeated queries of a missing metric, e.g. of a misconfigured HPA. A zero ttl disables it.
+type notFoundCache struct {
+	lock      sync.Mutex
+	ttl       time.Duration
+	clock     clock.Clock
+	entries   map[string]notFoundEntry
+	lastSweep time.Time
+}
+
+func newNotFoundCache(ttl time.Duration, clock clock.Clock) *notFoundCache {
+	return &notFoundCache{
+		ttl:       ttl,
+		clock:     clock,
+		entries:   make(map[string]notFoundEntry),
+		lastSweep: clock.Now(),
+	}
+}
+
+func (c *notFoundCache) get(key string) (error, bool) {
+	if c == nil || c.ttl <= 0 {
+		return nil, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, found := c.entries[key]
+	if !found || c.clock.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.err, true
+}
+
+// set records the error of the key if it's a not found error.
+func (c *notFoundCache) set(key string, err error) {
+	if c == nil || c.ttl <= 0 || !apierr.IsNotFound(err) {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.clock.Now()
+	if now.Sub(c.lastSweep) > c.ttl {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	c.entries[key] = notFoundEntry{err: err, expires: now.Add(c.ttl)}
+}
+
+// stripCacheLabel removes the cache label from the selector, and tells whether it asked to bypass the cache.
+func stripCacheLabel(metricSelector labels.Selector) (labels.Selector, bool) {
+	requirements, selectable := metricSelector.Requirements()
+	if !selectable {
+		return metricSelector, false
+	}
+
+	bypass := false
+	found := false
+	stripped := labels.NewSelector()
+	for _, r := range requirements {
+		if r.Key() != CacheLabel {
+			stripped = stripped.Add(r)
+			continue
+		}
+		found = true
+		if (r.Operator() == selection.Equals || r.Operator() == selection.DoubleEquals || r.Operator() == selection.In) && r.Values().Has(CacheBypass) {
+			bypass = true
+		}
+	}
+	if !found {
+		return metricSelector, false
+	}
+	return stripped, bypass
+}
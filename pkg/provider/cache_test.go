@@ -0,0 +1,172 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// countingExternalProvider serves a single metric and records the calls it gets.
+type countingExternalProvider struct {
+	metric    string
+	calls     int
+	selectors []string
+}
+
+func (c *countingExternalProvider) GetExternalMetric(_ context.Context, _ string, metricSelector labels.Selector, info p.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
+	c.calls++
+	c.selectors = append(c.selectors, metricSelector.String())
+	return &external_metrics.ExternalMetricValueList{
+		Items: []external_metrics.ExternalMetricValue{{
+			MetricName: info.Metric,
+			Value:      *resource.NewQuantity(int64(c.calls), resource.DecimalSI),
+		}},
+	}, nil
+}
+
+func (c *countingExternalProvider) ListAllExternalMetrics() []p.ExternalMetricInfo {
+	return []p.ExternalMetricInfo{{Metric: c.metric}}
+}
+
+func newCachingManager(ttl time.Duration) (*providerManager, *countingExternalProvider, *clock.FakeClock) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	backend := &countingExternalProvider{metric: "slb_l7_qps"}
+	return &providerManager{
+		alibabaCloudProvider:       backend,
+		prometheusExternalProvider: &countingExternalProvider{metric: "http_requests"},
+		cache:                      newExternalMetricsCache(ttl, fakeClock),
+	}, backend, fakeClock
+}
+
+func getMetric(t *testing.T, pm *providerManager, selector string) int64 {
+	metricSelector, err := labels.Parse(selector)
+	if err != nil {
+		t.Fatalf("Failed to parse selector, because of %v", err)
+	}
+	values, err := pm.GetExternalMetric(context.TODO(), "default", metricSelector, p.ExternalMetricInfo{Metric: "slb_l7_qps"})
+	if err != nil {
+		t.Fatalf("Failed to get metric, because of %v", err)
+	}
+	return values.Items[0].Value.Value()
+}
+
+func TestExternalMetricsCache(t *testing.T) {
+	pm, backend, fakeClock := newCachingManager(time.Minute)
+
+	getMetric(t, pm, "slb.instance.id=lb-1")
+	if value := getMetric(t, pm, "slb.instance.id=lb-1"); value != 1 || backend.calls != 1 {
+		t.Errorf("expected the second request to be served from the cache, got value %d after %d calls", value, backend.calls)
+	}
+
+	fakeClock.Step(2 * time.Minute)
+	if value := getMetric(t, pm, "slb.instance.id=lb-1"); value != 2 || backend.calls != 2 {
+		t.Errorf("expected an expired entry to be read again, got value %d after %d calls", value, backend.calls)
+	}
+}
+
+func TestExternalMetricsCacheBypass(t *testing.T) {
+	pm, backend, _ := newCachingManager(time.Minute)
+
+	getMetric(t, pm, "slb.instance.id=lb-1")
+	if value := getMetric(t, pm, "slb.instance.id=lb-1,cache=bypass"); value != 2 || backend.calls != 2 {
+		t.Errorf("expected the bypass to read the backend, got value %d after %d calls", value, backend.calls)
+	}
+	for _, selector := range backend.selectors {
+		if selector != "slb.instance.id=lb-1" {
+			t.Errorf("expected the cache label not to reach the backend, got selector %q", selector)
+		}
+	}
+
+	// the bypass refreshed the entry
+	if value := getMetric(t, pm, "slb.instance.id=lb-1"); value != 2 || backend.calls != 2 {
+		t.Errorf("expected the refreshed entry to be served from the cache, got value %d after %d calls", value, backend.calls)
+	}
+}
+
+func TestExternalMetricsCacheDisabled(t *testing.T) {
+	pm, backend, _ := newCachingManager(0)
+
+	getMetric(t, pm, "slb.instance.id=lb-1")
+	getMetric(t, pm, "slb.instance.id=lb-1,cache=bypass")
+	getMetric(t, pm, "slb.instance.id=lb-1")
+	if backend.calls != 3 {
+		t.Errorf("expected every request to read the backend without cache, got %d calls", backend.calls)
+	}
+	if backend.selectors[1] != "slb.instance.id=lb-1" {
+		t.Errorf("expected the cache label to be stripped without cache as well, got %q", backend.selectors[1])
+	}
+}
+
+// missingExternalProvider lists a metric it finds no values of.
+type missingExternalProvider struct {
+	metric string
+	calls  int
+}
+
+func (m *missingExternalProvider) GetExternalMetric(_ context.Context, _ string, _ labels.Selector, info p.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
+	m.calls++
+	return nil, apierr.NewNotFound(external_metrics.Resource(info.Metric), "")
+}
+
+func (m *missingExternalProvider) ListAllExternalMetrics() []p.ExternalMetricInfo {
+	return []p.ExternalMetricInfo{{Metric: m.metric}}
+}
+
+func TestNotFoundCache(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	backend := &missingExternalProvider{metric: "slb_l7_qps"}
+	pm := &providerManager{
+		alibabaCloudProvider:       backend,
+		prometheusExternalProvider: &countingExternalProvider{metric: "http_requests"},
+		cache:                      newExternalMetricsCache(time.Minute, fakeClock),
+		notFound:                   newNotFoundCache(10*time.Second, fakeClock),
+	}
+	get := func(selector string) error {
+		metricSelector, _ := labels.Parse(selector)
+		_, err := pm.GetExternalMetric(context.TODO(), "default", metricSelector, p.ExternalMetricInfo{Metric: "slb_l7_qps"})
+		return err
+	}
+
+	get("slb.instance.id=lb-1")
+	if err := get("slb.instance.id=lb-1"); !apierr.IsNotFound(err) || backend.calls != 1 {
+		t.Errorf("expected the not found error to be served from the cache, got %v after %d calls", err, backend.calls)
+	}
+	if get("slb.instance.id=lb-1,cache=bypass"); backend.calls != 2 {
+		t.Errorf("expected the bypass to read the backend, got %d calls", backend.calls)
+	}
+
+	fakeClock.Step(11 * time.Second)
+	if err := get("slb.instance.id=lb-1"); !apierr.IsNotFound(err) || backend.calls != 3 {
+		t.Errorf("expected an expired not found error to be queried again, got %v after %d calls", err, backend.calls)
+	}
+
+	// the other errors aren't cached
+	pm.notFound.set("other", errors.New("cms is throttled"))
+	if _, found := pm.notFound.get("other"); found {
+		t.Errorf("expected only the not found errors to be cached")
+	}
+}
+
+func TestExternalMetricBackend(t *testing.T) {
+	utils.SetMetricProviders(map[string]string{"slb_l7_qps": utils.PrometheusProvider})
+	t.Cleanup(func() { utils.SetMetricProviders(nil) })
+	alibabaCloud := &countingExternalProvider{metric: "slb_l7_qps"}
+	prometheus := &countingExternalProvider{metric: "slb_l7_qps"}
+	pm := &providerManager{alibabaCloudProvider: alibabaCloud, prometheusExternalProvider: prometheus}
+
+	if _, err := pm.GetExternalMetric(context.TODO(), "default", labels.Everything(), p.ExternalMetricInfo{Metric: "slb_l7_qps"}); err != nil {
+		t.Fatalf("Failed to get metric, because of %v", err)
+	}
+	if alibabaCloud.calls != 0 || prometheus.calls != 1 {
+		t.Errorf("expected the metric to be served by its backend only, got %d Alibaba Cloud and %d Prometheus calls", alibabaCloud.calls, prometheus.calls)
+	}
+}
@@ -0,0 +1,85 @@
+package provider
+
+import (
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// customAliases serves the external metrics configured with a customMetric on the custom metrics API as
+// well, so an HPA requests the same name from both APIs. The custom and the external metrics API are
+// different groups, the alias only shares the name and the value transforms of the metric.
+type customAliases struct {
+	// metrics are the custom metrics served by alias
+	metrics map[string]string
+}
+
+// newCustomAliases returns nil if no metric is served on the custom metrics API.
+func newCustomAliases(externalMetrics []config.ExternalMetric) *customAliases {
+	metrics := make(map[string]string)
+	for _, m := range externalMetrics {
+		if m.CustomMetric != "" {
+			metrics[m.Name] = m.CustomMetric
+		}
+	}
+	if len(metrics) == 0 {
+		return nil
+	}
+	return &customAliases{metrics: metrics}
+}
+
+// resolve returns the info of the custom metric an alias is served from, false if the metric is no alias.
+func (a *customAliases) resolve(info p.CustomMetricInfo) (p.CustomMetricInfo, bool) {
+	if a == nil {
+		return info, false
+	}
+	metric, found := a.metrics[info.Metric]
+	if !found {
+		return info, false
+	}
+	info.Metric = metric
+	return info, true
+}
+
+// list adds the aliases of the listed custom metrics, for the resources their custom metric is available for.
+func (a *customAliases) list(infos []p.CustomMetricInfo) []p.CustomMetricInfo {
+	if a == nil {
+		return infos
+	}
+	listed := make(map[p.CustomMetricInfo]bool, len(infos))
+	for _, info := range infos {
+		listed[info] = true
+	}
+	res := infos
+	for _, info := range infos {
+		for alias, metric := range a.metrics {
+			aliased := info
+			aliased.Metric = alias
+			if info.Metric == metric && !listed[aliased] {
+				listed[aliased] = true
+				res = append(res, aliased)
+			}
+		}
+	}
+	return res
+}
+
+// transformAliasedValues names the values of the custom metric of an alias after it, and post-processes
+// them like the values of the alias on the external metrics API.
+func (pm *providerManager) transformAliasedValues(alias string, values []custom_metrics.MetricValue) error {
+	external := &external_metrics.ExternalMetricValueList{Items: make([]external_metrics.ExternalMetricValue, len(values))}
+	for i := range values {
+		external.Items[i].Value = values[i].Value
+	}
+	external, err := pm.expressions.apply(alias, external)
+	if err != nil {
+		return err
+	}
+	external = pm.quantizer.quantize(alias, external)
+	for i := range values {
+		values[i].Metric.Name = alias
+		values[i].Value = external.Items[i].Value
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+var podsResource = schema.GroupResource{Resource: "pods"}
+
+// staticCustomProvider serves a single custom metric of the pods with a constant value.
+type staticCustomProvider struct {
+	metric string
+	value  int64
+}
+
+func (s *staticCustomProvider) metricValue(name string) custom_metrics.MetricValue {
+	return custom_metrics.MetricValue{
+		DescribedObject: custom_metrics.ObjectReference{Kind: "Pod", Name: name},
+		Metric:          custom_metrics.MetricIdentifier{Name: s.metric},
+		Value:           *resource.NewQuantity(s.value, resource.DecimalSI),
+	}
+}
+
+func (s *staticCustomProvider) GetMetricByName(_ context.Context, name types.NamespacedName, info p.CustomMetricInfo, _ labels.Selector) (*custom_metrics.MetricValue, error) {
+	if info.Metric != s.metric {
+		return nil, apierr.NewNotFound(schema.GroupResource{Resource: info.Metric}, name.Name)
+	}
+	value := s.metricValue(name.Name)
+	return &value, nil
+}
+
+func (s *staticCustomProvider) GetMetricBySelector(_ context.Context, _ string, _ labels.Selector, info p.CustomMetricInfo, _ labels.Selector) (*custom_metrics.MetricValueList, error) {
+	if info.Metric != s.metric {
+		return nil, apierr.NewNotFound(schema.GroupResource{Resource: info.Metric}, "")
+	}
+	return &custom_metrics.MetricValueList{Items: []custom_metrics.MetricValue{s.metricValue("pod-a"), s.metricValue("pod-b")}}, nil
+}
+
+func (s *staticCustomProvider) ListAllMetrics() []p.CustomMetricInfo {
+	return []p.CustomMetricInfo{{GroupResource: podsResource, Namespaced: true, Metric: s.metric}}
+}
+
+func TestCustomAliasServedByBothAPIs(t *testing.T) {
+	externalMetrics := []config.ExternalMetric{{Name: "checkout_qps", CustomMetric: "http_requests_per_second", Expression: "value * 2"}}
+	pm := &providerManager{
+		alibabaCloudProvider:       &countingExternalProvider{metric: "checkout_qps"},
+		prometheusExternalProvider: &countingExternalProvider{metric: "http_requests"},
+		prometheusCustomProvider:   &staticCustomProvider{metric: "http_requests_per_second", value: 3},
+		cache:                      newExternalMetricsCache(time.Minute, clock.NewFakeClock(time.Now())),
+		expressions:                newValueExpressions(externalMetrics),
+		customAliases:              newCustomAliases(externalMetrics),
+	}
+
+	external, err := pm.GetExternalMetric(context.TODO(), "default", labels.Everything(), p.ExternalMetricInfo{Metric: "checkout_qps"})
+	if err != nil {
+		t.Fatalf("Failed to get external metric, because of %v", err)
+	}
+	if value := external.Items[0].Value.Value(); value != 2 {
+		t.Errorf("expected the external value to be post-processed, got %d", value)
+	}
+
+	info := p.CustomMetricInfo{GroupResource: podsResource, Namespaced: true, Metric: "checkout_qps"}
+	value, err := pm.GetMetricByName(context.TODO(), types.NamespacedName{Namespace: "default", Name: "pod-a"}, info, labels.Everything())
+	if err != nil {
+		t.Fatalf("Failed to get custom metric, because of %v", err)
+	}
+	if value.Metric.Name != "checkout_qps" || value.Value.Value() != 6 {
+		t.Errorf("expected the custom value to be named after the alias and post-processed alike, got %s=%s", value.Metric.Name, value.Value.String())
+	}
+
+	values, err := pm.GetMetricBySelector(context.TODO(), "default", labels.Everything(), info, labels.Everything())
+	if err != nil {
+		t.Fatalf("Failed to get custom metric, because of %v", err)
+	}
+	for _, v := range values.Items {
+		if v.Metric.Name != "checkout_qps" || v.Value.Value() != 6 {
+			t.Errorf("expected the custom values to be named after the alias and post-processed alike, got %s=%s", v.Metric.Name, v.Value.String())
+		}
+	}
+
+	listed := false
+	for _, m := range pm.ListAllMetrics() {
+		listed = listed || m == info
+	}
+	if !listed {
+		t.Errorf("expected the alias to be listed for the resources of its custom metric, got %v", pm.ListAllMetrics())
+	}
+}
@@ -0,0 +1,63 @@
+package provider
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+// EvaluationTimeLabel is the selector label which asks for the value of a metric at a past
+// time, e.g. for predictive scaling. Its value is an RFC 3339 time or, since label values
+// can't contain colons, a Unix time in seconds. It's stripped from the selector before the
+// request reaches a backend.
+const EvaluationTimeLabel = "at"
+
+// stripEvaluationTimeLabel removes the evaluation time label from the selector, and returns
+// the time it asked for. A time after now is rejected.
+func stripEvaluationTimeLabel(metricSelector labels.Selector, now time.Time) (labels.Selector, time.Time, bool, error) {
+	requirements, selectable := metricSelector.Requirements()
+	if !selectable {
+		return metricSelector, time.Time{}, false, nil
+	}
+
+	var at time.Time
+	found := false
+	stripped := labels.NewSelector()
+	for _, r := range requirements {
+		if r.Key() != EvaluationTimeLabel {
+			stripped = stripped.Add(r)
+			continue
+		}
+		values := r.Values().List()
+		if (r.Operator() != selection.Equals && r.Operator() != selection.DoubleEquals) || len(values) != 1 {
+			return nil, time.Time{}, false, fmt.Errorf("the %s label must select a single time, e.g. %s=1620000000", EvaluationTimeLabel, EvaluationTimeLabel)
+		}
+		t, err := parseEvaluationTime(values[0])
+		if err != nil {
+			return nil, time.Time{}, false, err
+		}
+		if t.After(now) {
+			return nil, time.Time{}, false, fmt.Errorf("evaluation time %s is in the future", t.Format(time.RFC3339))
+		}
+		at = t
+		found = true
+	}
+	if !found {
+		return metricSelector, time.Time{}, false, nil
+	}
+	return stripped, at, true, nil
+}
+
+func parseEvaluationTime(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid evaluation time %q, it must be an RFC 3339 or a Unix time", value)
+	}
+	return t, nil
+}
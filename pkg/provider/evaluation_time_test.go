@@ -0,0 +1,102 @@
+package provider
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// timedExternalProvider records the evaluation time and the selector of the requests it gets.
+type timedExternalProvider struct {
+	times     []time.Time
+	selectors []string
+}
+
+func (t *timedExternalProvider) GetExternalMetric(ctx context.Context, _ string, metricSelector labels.Selector, info p.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
+	at, _ := utils.EvaluationTime(ctx)
+	t.times = append(t.times, at)
+	t.selectors = append(t.selectors, metricSelector.String())
+	return &external_metrics.ExternalMetricValueList{
+		Items: []external_metrics.ExternalMetricValue{{
+			MetricName: info.Metric,
+			Value:      *resource.NewQuantity(int64(len(t.times)), resource.DecimalSI),
+		}},
+	}, nil
+}
+
+func (t *timedExternalProvider) ListAllExternalMetrics() []p.ExternalMetricInfo {
+	return []p.ExternalMetricInfo{{Metric: "slb_l7_qps"}}
+}
+
+func TestEvaluationTime(t *testing.T) {
+	pm, _, _ := newCachingManager(time.Minute)
+	backend := &timedExternalProvider{}
+	pm.alibabaCloudProvider = backend
+
+	at := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, selector := range []string{
+		"slb.instance.id=lb-1,at=" + strconv.FormatInt(at.Unix(), 10),
+		"slb.instance.id=lb-1",
+		// the past value is cached apart from the current one
+		"slb.instance.id=lb-1,at=" + strconv.FormatInt(at.Unix(), 10),
+	} {
+		getMetric(t, pm, selector)
+	}
+
+	if len(backend.times) != 2 {
+		t.Fatalf("expected the backend to be read for the past and the current value, got %d calls", len(backend.times))
+	}
+	if !backend.times[0].Equal(at) {
+		t.Errorf("expected the backend to be queried at %v, got %v", at, backend.times[0])
+	}
+	if !backend.times[1].IsZero() {
+		t.Errorf("expected the current value to be queried now, got %v", backend.times[1])
+	}
+	for _, selector := range backend.selectors {
+		if selector != "slb.instance.id=lb-1" {
+			t.Errorf("expected the at label to be stripped, got %s", selector)
+		}
+	}
+}
+
+func TestEvaluationTimeRejected(t *testing.T) {
+	pm, backend, _ := newCachingManager(time.Minute)
+
+	for _, selector := range []string{
+		"slb.instance.id=lb-1,at=" + strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10),
+		"slb.instance.id=lb-1,at=yesterday",
+		"slb.instance.id=lb-1,at in (1620000000,1620000060)",
+	} {
+		metricSelector, err := labels.Parse(selector)
+		if err != nil {
+			t.Fatalf("Failed to parse selector, because of %v", err)
+		}
+		_, err = pm.GetExternalMetric(context.TODO(), "default", metricSelector, p.ExternalMetricInfo{Metric: "slb_l7_qps"})
+		if !apierr.IsBadRequest(err) {
+			t.Errorf("expected %s to be rejected, got %v", selector, err)
+		}
+	}
+	if backend.calls != 0 {
+		t.Errorf("expected the backend not to be read, got %d calls", backend.calls)
+	}
+}
+
+func TestParseEvaluationTime(t *testing.T) {
+	for value, expected := range map[string]int64{
+		"1620000000":           1620000000,
+		"2021-05-03T00:00:00Z": 1620000000,
+	} {
+		at, err := parseEvaluationTime(value)
+		if err != nil || at.Unix() != expected {
+			t.Errorf("expected %s to be parsed as %d, got %v (%v)", value, expected, at.Unix(), err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	log "k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// valueExpressions post-processes the values of the metrics configured with an expression.
+type valueExpressions struct {
+	expressions map[string]*utils.Expression
+}
+
+func newValueExpressions(externalMetrics []config.ExternalMetric) *valueExpressions {
+	e := &valueExpressions{expressions: make(map[string]*utils.Expression)}
+	for _, m := range externalMetrics {
+		if m.Expression == "" {
+			continue
+		}
+		expression, err := utils.CompileExpression(m.Expression)
+		if err != nil {
+			// the config has been validated when it was loaded
+			log.Warningf("Ignoring the expression of external metric %s, because of %v", m.Name, err)
+			continue
+		}
+		e.expressions[m.Name] = expression
+	}
+	return e
+}
+
+// apply evaluates the expression of the metric for each value. The values of a derived metric
+// went through the expression of its base already.
+func (e *valueExpressions) apply(metric string, values *external_metrics.ExternalMetricValueList) (*external_metrics.ExternalMetricValueList, error) {
+	if e == nil || values == nil {
+		return values, nil
+	}
+	expression, found := e.expressions[metric]
+	if !found {
+		return values, nil
+	}
+
+	values = values.DeepCopy()
+	for i := range values.Items {
+		value, err := expression.Eval(values.Items[i].Value.AsApproximateFloat64())
+		if errors.Is(err, utils.ErrNotANumber) {
+			return nil, fmt.Errorf("unable to post-process external metric %s: %w", metric, err)
+		}
+		if err != nil {
+			return nil, apierr.NewInternalError(fmt.Errorf("unable to post-process external metric %s: %v", metric, err))
+		}
+		values.Items[i].Value = *resource.NewMilliQuantity(int64(value*1000), resource.DecimalSI)
+	}
+	return values, nil
+}
@@ -0,0 +1,99 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+func TestValueExpressions(t *testing.T) {
+	e := newValueExpressions([]config.ExternalMetric{
+		{Name: "slb_l7_qps", Expression: "min(value * 10, 25)"},
+	})
+
+	values, err := e.apply("slb_l7_qps", valueList(1, 2, 3))
+	if err != nil {
+		t.Fatalf("Failed to apply the expression, because of %v", err)
+	}
+	for i, expected := range []float64{10, 20, 25} {
+		if value := values.Items[i].Value.AsApproximateFloat64(); value != expected {
+			t.Errorf("expected value %d to be %v, got %v", i, expected, value)
+		}
+	}
+
+	other := valueList(1)
+	if values, err := e.apply("http_requests", other); err != nil || values != other {
+		t.Errorf("expected the values of other metrics to be left alone, got %v, %v", values, err)
+	}
+}
+
+func TestValueExpressionFailure(t *testing.T) {
+	e := newValueExpressions([]config.ExternalMetric{
+		{Name: "slb_l7_qps", Expression: "100 / value"},
+	})
+	if _, err := e.apply("slb_l7_qps", valueList(0)); !apierr.IsInternalError(err) {
+		t.Errorf("expected a division by zero to be an internal error, got %v", err)
+	}
+}
+
+func TestValueExpressionNotANumber(t *testing.T) {
+	e := newValueExpressions([]config.ExternalMetric{
+		{Name: "slb_l7_qps", Expression: "value / value"},
+	})
+	if _, err := e.apply("slb_l7_qps", valueList(0)); !errors.Is(err, utils.ErrNotANumber) || apierr.IsInternalError(err) {
+		t.Errorf("expected 0 / 0 not to be a number, got %v", err)
+	}
+}
+
+func TestExternalMetricExpressionNotANumber(t *testing.T) {
+	externalMetrics := []config.ExternalMetric{
+		{Name: "slb_l7_qps", Expression: "(value - 1) / (value - 1)"},
+		{Name: "slb_l7_qps_scaled", Base: "slb_l7_qps", Expression: "value * 100"},
+	}
+	selector := labels.SelectorFromSet(labels.Set{"slb.instance.id": "lb-1"})
+	for _, metric := range []string{"slb_l7_qps", "slb_l7_qps_scaled"} {
+		// the counting backend returns 1 on its first call
+		pm, _, _ := newCachingManager(time.Minute)
+		pm.derivedMetrics = derivedMetrics(externalMetrics)
+		pm.expressions = newValueExpressions(externalMetrics)
+		values, err := pm.GetExternalMetric(context.TODO(), "default", selector, p.ExternalMetricInfo{Metric: metric})
+		if !apierr.IsServiceUnavailable(err) {
+			t.Errorf("expected the NaN of %s to be reported as unavailable rather than a value, got %v, %v", metric, values, err)
+		}
+	}
+}
+
+func TestExternalMetricExpression(t *testing.T) {
+	externalMetrics := []config.ExternalMetric{
+		{Name: "slb_l7_qps", Expression: "value / 4"},
+		{Name: "slb_l7_qps_smoothed", Base: "slb_l7_qps", Smoothing: &config.Smoothing{Alpha: 1}, Expression: "value * 100"},
+	}
+	pm, _, fakeClock := newCachingManager(time.Minute)
+	pm.smoother = newEWMASmoother(externalMetrics, fakeClock)
+	pm.derivedMetrics = derivedMetrics(externalMetrics)
+	pm.expressions = newValueExpressions(externalMetrics)
+
+	selector := labels.SelectorFromSet(labels.Set{"slb.instance.id": "lb-1"})
+	raw, err := pm.GetExternalMetric(context.TODO(), "default", selector, p.ExternalMetricInfo{Metric: "slb_l7_qps"})
+	if err != nil {
+		t.Fatalf("Failed to get metric, because of %v", err)
+	}
+	if value := raw.Items[0].Value.AsApproximateFloat64(); value != 0.25 {
+		t.Errorf("expected the expression to be applied to the value, got %v", value)
+	}
+
+	derived, err := pm.GetExternalMetric(context.TODO(), "default", selector, p.ExternalMetricInfo{Metric: "slb_l7_qps_smoothed"})
+	if err != nil {
+		t.Fatalf("Failed to get derived metric, because of %v", err)
+	}
+	if value := derived.Items[0].Value.AsApproximateFloat64(); value != 25 {
+		t.Errorf("expected the derived metric to apply its expression to the processed base value, got %v", value)
+	}
+}
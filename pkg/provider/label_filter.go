@@ -0,0 +1,88 @@
+package provider
+
+import (
+	"fmt"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// labelFilter trims the labels of the values of the metrics configured with keepLabels or dropLabels,
+// e.g. the high cardinality labels of a series which bloat the status of the HPAs. The labels the
+// selector of a request matches on are always kept, so the returned values still match it.
+type labelFilter struct {
+	// keep are the labels kept by metric, the others are dropped
+	keep map[string]sets.String
+	// drop are the labels dropped by metric
+	drop map[string]sets.String
+}
+
+// newLabelFilter returns nil if no metric filters its labels.
+func newLabelFilter(externalMetrics []config.ExternalMetric) *labelFilter {
+	f := &labelFilter{
+		keep: make(map[string]sets.String),
+		drop: make(map[string]sets.String),
+	}
+	for _, m := range externalMetrics {
+		if len(m.KeepLabels) > 0 {
+			f.keep[m.Name] = sets.NewString(m.KeepLabels...)
+		}
+		if len(m.DropLabels) > 0 {
+			f.drop[m.Name] = sets.NewString(m.DropLabels...)
+		}
+	}
+	if len(f.keep) == 0 && len(f.drop) == 0 {
+		return nil
+	}
+	return f
+}
+
+// check rejects a selector which matches on a dropped label, which the returned values wouldn't have.
+func (f *labelFilter) check(metric string, metricSelector labels.Selector) error {
+	if f == nil {
+		return nil
+	}
+	drop, found := f.drop[metric]
+	if !found {
+		return nil
+	}
+	requirements, _ := metricSelector.Requirements()
+	for _, r := range requirements {
+		if drop.Has(r.Key()) {
+			return fmt.Errorf("label %s of metric %s is dropped by its dropLabels, it can't be selected on", r.Key(), metric)
+		}
+	}
+	return nil
+}
+
+// filter returns a copy of the values with the labels of their metric trimmed.
+func (f *labelFilter) filter(metric string, metricSelector labels.Selector, values *external_metrics.ExternalMetricValueList) *external_metrics.ExternalMetricValueList {
+	if f == nil || values == nil {
+		return values
+	}
+	keep, keeping := f.keep[metric]
+	drop, dropping := f.drop[metric]
+	if !keeping && !dropping {
+		return values
+	}
+	selected := sets.NewString()
+	requirements, _ := metricSelector.Requirements()
+	for _, r := range requirements {
+		selected.Insert(r.Key())
+	}
+
+	values = values.DeepCopy()
+	for i := range values.Items {
+		metricLabels := make(map[string]string, len(values.Items[i].MetricLabels))
+		for k, v := range values.Items[i].MetricLabels {
+			if !selected.Has(k) && (keeping && !keep.Has(k) || dropping && drop.Has(k)) {
+				continue
+			}
+			metricLabels[k] = v
+		}
+		values.Items[i].MetricLabels = metricLabels
+	}
+	return values
+}
@@ -0,0 +1,86 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+func newLabelFilterManager(metric config.ExternalMetric) *providerManager {
+	return &providerManager{
+		alibabaCloudProvider: &countingExternalProvider{metric: "slb_l7_qps"},
+		prometheusExternalProvider: &selectingExternalProvider{
+			metric: "http_requests",
+			series: []map[string]string{
+				{"service_name": "web", "pod": "web-5d8f7", "zone": "a"},
+			},
+		},
+		cache:       newExternalMetricsCache(time.Minute, clock.NewFakeClock(time.Now())),
+		renamer:     newLabelRenamer([]config.ExternalMetric{metric}),
+		labelFilter: newLabelFilter([]config.ExternalMetric{metric}),
+	}
+}
+
+func getFilteredLabels(t *testing.T, pm *providerManager, selector string) map[string]string {
+	s, err := labels.Parse(selector)
+	if err != nil {
+		t.Fatalf("Failed to parse selector, because of %v", err)
+	}
+	values, err := pm.GetExternalMetric(context.TODO(), "default", s, p.ExternalMetricInfo{Metric: "http_requests"})
+	if err != nil {
+		t.Fatalf("Failed to get metric, because of %v", err)
+	}
+	if len(values.Items) != 1 {
+		t.Fatalf("expected a single value, got %v", values.Items)
+	}
+	return values.Items[0].MetricLabels
+}
+
+func TestKeepLabels(t *testing.T) {
+	pm := newLabelFilterManager(config.ExternalMetric{
+		Name:        "http_requests",
+		LabelRename: map[string]string{"service_name": "service"},
+		KeepLabels:  []string{"service"},
+	})
+
+	metricLabels := getFilteredLabels(t, pm, "service=web")
+	if len(metricLabels) != 1 || metricLabels["service"] != "web" {
+		t.Errorf("expected only the renamed service label to be kept, got %v", metricLabels)
+	}
+	// the labels of the selector are kept, so the values still match it
+	metricLabels = getFilteredLabels(t, pm, "service=web,zone=a")
+	if len(metricLabels) != 2 || metricLabels["zone"] != "a" {
+		t.Errorf("expected the selected zone label to be kept, got %v", metricLabels)
+	}
+}
+
+func TestDropLabels(t *testing.T) {
+	pm := newLabelFilterManager(config.ExternalMetric{
+		Name:       "http_requests",
+		DropLabels: []string{"pod"},
+	})
+
+	metricLabels := getFilteredLabels(t, pm, "service_name=web")
+	if len(metricLabels) != 2 || metricLabels["pod"] != "" || metricLabels["zone"] != "a" {
+		t.Errorf("expected only the pod label to be dropped, got %v", metricLabels)
+	}
+
+	selector, _ := labels.Parse("pod=web-5d8f7")
+	_, err := pm.GetExternalMetric(context.TODO(), "default", selector, p.ExternalMetricInfo{Metric: "http_requests"})
+	if !apierr.IsBadRequest(err) {
+		t.Errorf("expected a selector on a dropped label to be rejected, got %v", err)
+	}
+
+	// the other metrics keep their labels
+	values := &external_metrics.ExternalMetricValueList{Items: []external_metrics.ExternalMetricValue{{MetricLabels: map[string]string{"pod": "lb-1"}}}}
+	if filtered := pm.labelFilter.filter("slb_l7_qps", labels.Everything(), values); filtered.Items[0].MetricLabels["pod"] != "lb-1" {
+		t.Errorf("expected the labels of another metric to be kept, got %v", filtered.Items[0].MetricLabels)
+	}
+}
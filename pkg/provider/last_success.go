@@ -0,0 +1,45 @@
+package provider
+
+import (
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+// metricLastSuccess is the time each configured external metric was last resolved by its backend.
+var metricLastSuccess = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "adapter_metric_last_success_timestamp",
+		Help: "Unix time in seconds at which the backend of an external metric configured in the externalMetrics section last returned its values.",
+	},
+	[]string{"metric"},
+)
+
+// lastSuccessTracker records when the external metrics were last resolved, so that an alert can
+// tell that a metric is broken while its backend is healthy. Only the metrics of the externalMetrics
+// section are tracked, which bounds the cardinality whatever the requests ask for.
+type lastSuccessTracker struct {
+	clock   clock.Clock
+	metrics map[string]bool
+}
+
+func newLastSuccessTracker(externalMetrics []config.ExternalMetric, clock clock.Clock) *lastSuccessTracker {
+	utils.RegisterMetrics(metricLastSuccess)
+	t := &lastSuccessTracker{
+		clock:   clock,
+		metrics: make(map[string]bool, len(externalMetrics)),
+	}
+	for _, m := range externalMetrics {
+		t.metrics[m.Name] = true
+	}
+	return t
+}
+
+// succeeded records a successful resolution of the metric, if it's tracked.
+func (t *lastSuccessTracker) succeeded(metric string) {
+	if t == nil || !t.metrics[metric] {
+		return
+	}
+	metricLastSuccess.WithLabelValues(metric).Set(float64(t.clock.Now().UnixNano()) / 1e9)
+}
@@ -0,0 +1,81 @@
+package provider
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/component-base/metrics/legacyregistry"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+func TestMetricLastSuccessTimestamp(t *testing.T) {
+	pm, _, fakeClock := newCachingManager(time.Minute)
+	pm.lastSuccess = newLastSuccessTracker([]config.ExternalMetric{{Name: "slb_l7_qps"}}, fakeClock)
+	fakeClock.SetTime(time.Unix(1620000000, 0))
+
+	if _, err := pm.GetExternalMetric(context.TODO(), "default", labels.Everything(), p.ExternalMetricInfo{Metric: "slb_l7_qps"}); err != nil {
+		t.Fatalf("Failed to get metric, because of %v", err)
+	}
+	if ts := testutil.ToFloat64(metricLastSuccess.WithLabelValues("slb_l7_qps")); ts != 1620000000 {
+		t.Errorf("expected the time of the resolution, got %v", ts)
+	}
+
+	// a cached value isn't a resolution
+	fakeClock.Step(30 * time.Second)
+	if _, err := pm.GetExternalMetric(context.TODO(), "default", labels.Everything(), p.ExternalMetricInfo{Metric: "slb_l7_qps"}); err != nil {
+		t.Fatalf("Failed to get metric, because of %v", err)
+	}
+	if ts := testutil.ToFloat64(metricLastSuccess.WithLabelValues("slb_l7_qps")); ts != 1620000000 {
+		t.Errorf("expected the time of the last resolution, got %v", ts)
+	}
+
+	fakeClock.Step(time.Minute)
+	if _, err := pm.GetExternalMetric(context.TODO(), "default", labels.Everything(), p.ExternalMetricInfo{Metric: "slb_l7_qps"}); err != nil {
+		t.Fatalf("Failed to get metric, because of %v", err)
+	}
+	if ts := testutil.ToFloat64(metricLastSuccess.WithLabelValues("slb_l7_qps")); ts != 1620000090 {
+		t.Errorf("expected the time of the new resolution, got %v", ts)
+	}
+
+	// the metrics which aren't configured aren't tracked
+	if _, err := pm.GetExternalMetric(context.TODO(), "default", labels.Everything(), p.ExternalMetricInfo{Metric: "http_requests"}); err != nil {
+		t.Fatalf("Failed to get metric, because of %v", err)
+	}
+	metrics, err := legacyregistry.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics, because of %v", err)
+	}
+	for _, family := range metrics {
+		if family.GetName() != "adapter_metric_last_success_timestamp" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if strings.Contains(label.GetValue(), "http_requests") {
+					t.Errorf("expected http_requests not to be tracked")
+				}
+			}
+		}
+		return
+	}
+	t.Errorf("expected adapter_metric_last_success_timestamp to be exposed")
+}
+
+func TestNewLastSuccessTrackerTwice(t *testing.T) {
+	// e.g. a reload of the config constructs the tracker again, which registers its metric again
+	for i := 0; i < 2; i++ {
+		newLastSuccessTracker([]config.ExternalMetric{{Name: "slb_l7_qps"}}, clock.RealClock{})
+	}
+}
+
+func TestNilLastSuccessTracker(t *testing.T) {
+	var tracker *lastSuccessTracker
+	tracker.succeeded("slb_l7_qps")
+	newLastSuccessTracker(nil, clock.RealClock{}).succeeded("slb_l7_qps")
+}
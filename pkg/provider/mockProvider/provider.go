@@ -0,0 +1,179 @@
+package mockProvider
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	yaml "gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	log "k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// MetricsFile lists the values served by the mock provider, in YAML or JSON.
+type MetricsFile struct {
+	External []ExternalValue `json:"external,omitempty" yaml:"external,omitempty"`
+	Custom   []CustomValue   `json:"custom,omitempty" yaml:"custom,omitempty"`
+}
+
+// ExternalValue is a value of an external metric, returned to the requests whose selector matches its labels.
+type ExternalValue struct {
+	Metric string            `json:"metric" yaml:"metric"`
+	Labels map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Value  float64           `json:"value" yaml:"value"`
+}
+
+// CustomValue is the value of a custom metric for an object.
+type CustomValue struct {
+	Metric string `json:"metric" yaml:"metric"`
+	// Resource is the resource of the object, e.g. pods or deployments.apps.
+	Resource string `json:"resource" yaml:"resource"`
+	// Kind is the kind of the object in the returned value, e.g. Pod.
+	Kind      string `json:"kind,omitempty" yaml:"kind,omitempty"`
+	Namespace string `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+	Name      string `json:"name" yaml:"name"`
+	// Labels are the labels of the object, which the requests of the metric for several objects select.
+	Labels map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Value  float64           `json:"value" yaml:"value"`
+}
+
+// MockProvider serves the custom and external metrics of a static file instead of querying
+// any backend, so that the scaling of HPAs can be tested deterministically without Prometheus
+// or Alibaba Cloud.
+type MockProvider struct {
+	external []ExternalValue
+	custom   []CustomValue
+}
+
+// NewMockProvider loads the values of the file.
+func NewMockProvider(filename string) (*MockProvider, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load mock metrics file: %v", err)
+	}
+	return LoadMockProvider(contents)
+}
+
+// LoadMockProvider loads the values of a blob of YAML or JSON, rejecting unknown fields.
+func LoadMockProvider(contents []byte) (*MockProvider, error) {
+	var file MetricsFile
+	if err := yaml.UnmarshalStrict(contents, &file); err != nil {
+		return nil, fmt.Errorf("unable to parse mock metrics file: %v", err)
+	}
+	for _, v := range file.External {
+		if v.Metric == "" {
+			return nil, fmt.Errorf("external values of the mock metrics file must have a metric")
+		}
+	}
+	for _, v := range file.Custom {
+		if v.Metric == "" || v.Resource == "" || v.Name == "" {
+			return nil, fmt.Errorf("custom values of the mock metrics file must have a metric, a resource and a name")
+		}
+	}
+	return &MockProvider{external: file.External, custom: file.Custom}, nil
+}
+
+func (mp *MockProvider) GetExternalMetric(ctx context.Context, namespace string, metricSelector labels.Selector, info p.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
+	now := metav1.Now()
+	values := &external_metrics.ExternalMetricValueList{}
+	for _, v := range mp.external {
+		if v.Metric != info.Metric || !metricSelector.Matches(labels.Set(v.Labels)) {
+			continue
+		}
+		values.Items = append(values.Items, external_metrics.ExternalMetricValue{
+			MetricName:   v.Metric,
+			MetricLabels: v.Labels,
+			Timestamp:    now,
+			Value:        quantity(v.Value),
+		})
+	}
+	if len(values.Items) == 0 {
+		return nil, p.NewMetricNotFoundError(schema.GroupResource{}, info.Metric)
+	}
+	log.V(4).Infof("Returning %d mock values of external metric %s for selector %s", len(values.Items), info.Metric, metricSelector)
+	return values, nil
+}
+
+func (mp *MockProvider) ListAllExternalMetrics() []p.ExternalMetricInfo {
+	metrics := make([]p.ExternalMetricInfo, 0, len(mp.external))
+	listed := make(map[string]bool)
+	for _, v := range mp.external {
+		if !listed[v.Metric] {
+			listed[v.Metric] = true
+			metrics = append(metrics, p.ExternalMetricInfo{Metric: v.Metric})
+		}
+	}
+	return metrics
+}
+
+// GetMetricByName returns the value of the object. The values of custom metrics have no labels,
+// so the metric selector is ignored.
+func (mp *MockProvider) GetMetricByName(ctx context.Context, name types.NamespacedName, info p.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	for _, v := range mp.custom {
+		if v.Metric == info.Metric && isResource(v, info) && v.Namespace == name.Namespace && v.Name == name.Name {
+			value := customValue(v, metav1.Now())
+			return &value, nil
+		}
+	}
+	return nil, p.NewMetricNotFoundForError(info.GroupResource, info.Metric, name.Name)
+}
+
+// GetMetricBySelector returns the values of the objects of the namespace whose labels match the selector.
+func (mp *MockProvider) GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info p.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	now := metav1.Now()
+	values := &custom_metrics.MetricValueList{}
+	for _, v := range mp.custom {
+		if v.Metric == info.Metric && isResource(v, info) && v.Namespace == namespace && selector.Matches(labels.Set(v.Labels)) {
+			values.Items = append(values.Items, customValue(v, now))
+		}
+	}
+	if len(values.Items) == 0 {
+		return nil, p.NewMetricNotFoundError(info.GroupResource, info.Metric)
+	}
+	return values, nil
+}
+
+func (mp *MockProvider) ListAllMetrics() []p.CustomMetricInfo {
+	metrics := make([]p.CustomMetricInfo, 0, len(mp.custom))
+	listed := make(map[p.CustomMetricInfo]bool)
+	for _, v := range mp.custom {
+		info := p.CustomMetricInfo{
+			GroupResource: schema.ParseGroupResource(v.Resource),
+			Namespaced:    v.Namespace != "",
+			Metric:        v.Metric,
+		}
+		if !listed[info] {
+			listed[info] = true
+			metrics = append(metrics, info)
+		}
+	}
+	return metrics
+}
+
+func isResource(v CustomValue, info p.CustomMetricInfo) bool {
+	return schema.ParseGroupResource(v.Resource) == info.GroupResource
+}
+
+func customValue(v CustomValue, now metav1.Time) custom_metrics.MetricValue {
+	return custom_metrics.MetricValue{
+		DescribedObject: custom_metrics.ObjectReference{
+			Kind:      v.Kind,
+			Namespace: v.Namespace,
+			Name:      v.Name,
+		},
+		Metric:    custom_metrics.MetricIdentifier{Name: v.Metric},
+		Timestamp: now,
+		Value:     quantity(v.Value),
+	}
+}
+
+func quantity(value float64) resource.Quantity {
+	return *resource.NewMilliQuantity(int64(value*1000), resource.DecimalSI)
+}
@@ -0,0 +1,134 @@
+package mockProvider
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+const sampleFile = `
+external:
+- metric: slb_l7_qps
+  labels:
+    slb.instance.id: lb-1
+  value: 120
+- metric: slb_l7_qps
+  labels:
+    slb.instance.id: lb-2
+  value: 0.5
+custom:
+- metric: http_requests_per_second
+  resource: pods
+  kind: Pod
+  namespace: default
+  name: web-1
+  labels:
+    app: web
+  value: 10
+- metric: http_requests_per_second
+  resource: pods
+  namespace: default
+  name: web-2
+  labels:
+    app: web
+  value: 30
+- metric: queue_length
+  resource: deployments.apps
+  namespace: default
+  name: worker
+  value: 7
+`
+
+func newSampleProvider(t *testing.T) *MockProvider {
+	filename := filepath.Join(t.TempDir(), "metrics.yaml")
+	if err := ioutil.WriteFile(filename, []byte(sampleFile), 0644); err != nil {
+		t.Fatalf("Failed to write the sample file, because of %v", err)
+	}
+	mp, err := NewMockProvider(filename)
+	if err != nil {
+		t.Fatalf("Failed to load the sample file, because of %v", err)
+	}
+	return mp
+}
+
+func TestMockExternalMetrics(t *testing.T) {
+	mp := newSampleProvider(t)
+	if metrics := mp.ListAllExternalMetrics(); len(metrics) != 1 || metrics[0].Metric != "slb_l7_qps" {
+		t.Errorf("expected slb_l7_qps to be listed once, got %v", metrics)
+	}
+
+	info := p.ExternalMetricInfo{Metric: "slb_l7_qps"}
+	values, err := mp.GetExternalMetric(context.TODO(), "default", labels.SelectorFromSet(labels.Set{"slb.instance.id": "lb-2"}), info)
+	if err != nil {
+		t.Fatalf("Failed to get metric, because of %v", err)
+	}
+	if len(values.Items) != 1 || values.Items[0].Value.AsApproximateFloat64() != 0.5 {
+		t.Errorf("expected the value of lb-2, got %v", values.Items)
+	}
+
+	values, err = mp.GetExternalMetric(context.TODO(), "default", labels.Everything(), info)
+	if err != nil || len(values.Items) != 2 {
+		t.Errorf("expected the values of both instances, got %v, %v", values, err)
+	}
+
+	_, err = mp.GetExternalMetric(context.TODO(), "default", labels.SelectorFromSet(labels.Set{"slb.instance.id": "lb-3"}), info)
+	if !apierr.IsNotFound(err) {
+		t.Errorf("expected a selector without values to be not found, got %v", err)
+	}
+}
+
+func TestMockCustomMetrics(t *testing.T) {
+	mp := newSampleProvider(t)
+	if metrics := mp.ListAllMetrics(); len(metrics) != 2 {
+		t.Errorf("expected the two custom metrics to be listed, got %v", metrics)
+	}
+
+	pods := p.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "http_requests_per_second"}
+	value, err := mp.GetMetricByName(context.TODO(), types.NamespacedName{Namespace: "default", Name: "web-1"}, pods, labels.Everything())
+	if err != nil {
+		t.Fatalf("Failed to get metric, because of %v", err)
+	}
+	if value.Value.AsApproximateFloat64() != 10 || value.DescribedObject.Kind != "Pod" || value.DescribedObject.Name != "web-1" {
+		t.Errorf("expected the value of web-1, got %v", value)
+	}
+
+	values, err := mp.GetMetricBySelector(context.TODO(), "default", labels.SelectorFromSet(labels.Set{"app": "web"}), pods, labels.Everything())
+	if err != nil || len(values.Items) != 2 {
+		t.Errorf("expected the values of both pods, got %v, %v", values, err)
+	}
+
+	deployments := p.CustomMetricInfo{GroupResource: schema.GroupResource{Group: "apps", Resource: "deployments"}, Namespaced: true, Metric: "queue_length"}
+	value, err = mp.GetMetricByName(context.TODO(), types.NamespacedName{Namespace: "default", Name: "worker"}, deployments, labels.Everything())
+	if err != nil || value.Value.AsApproximateFloat64() != 7 {
+		t.Errorf("expected the value of the deployment, got %v, %v", value, err)
+	}
+
+	_, err = mp.GetMetricByName(context.TODO(), types.NamespacedName{Namespace: "other", Name: "web-1"}, pods, labels.Everything())
+	if !apierr.IsNotFound(err) {
+		t.Errorf("expected an object of another namespace to be not found, got %v", err)
+	}
+}
+
+func TestLoadMockProviderErrors(t *testing.T) {
+	for _, invalid := range []string{
+		"external:\n- labels: {a: b}\n  value: 1\n",
+		"custom:\n- metric: queue_length\n  name: worker\n  value: 1\n",
+		"external:\n- metric: slb_l7_qps\n  valeu: 1\n",
+		"external: [",
+	} {
+		if _, err := LoadMockProvider([]byte(invalid)); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+
+	if _, err := LoadMockProvider([]byte(`{"external": [{"metric": "slb_l7_qps", "value": 1}]}`)); err != nil {
+		t.Errorf("expected a JSON file to be loaded, got %v", err)
+	}
+}
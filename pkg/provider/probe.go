@@ -0,0 +1,47 @@
+package provider
+
+import (
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// probeMetric is an external metric which always returns the same value without querying any
+// backend, so that monitoring can tell the external metrics API works whatever the health of the backends.
+type probeMetric struct {
+	name  string
+	value resource.Quantity
+}
+
+// newProbeMetric serves the value under the name, nil if the name is empty.
+func newProbeMetric(name string, value float64) *probeMetric {
+	if name == "" {
+		return nil
+	}
+	return &probeMetric{name: name, value: *resource.NewMilliQuantity(int64(value*1000), resource.DecimalSI)}
+}
+
+// serves tells whether the metric is the probe. It's false for a nil probe.
+func (pm *probeMetric) serves(metric string) bool {
+	return pm != nil && pm.name == metric
+}
+
+// info returns the probe for the listing of the external metrics, none for a nil probe.
+func (pm *probeMetric) info() []p.ExternalMetricInfo {
+	if pm == nil {
+		return nil
+	}
+	return []p.ExternalMetricInfo{{Metric: pm.name}}
+}
+
+// values returns the single value of the probe, whatever the selector.
+func (pm *probeMetric) values() *external_metrics.ExternalMetricValueList {
+	return &external_metrics.ExternalMetricValueList{
+		Items: []external_metrics.ExternalMetricValue{{
+			MetricName: pm.name,
+			Timestamp:  metav1.Now(),
+			Value:      pm.value,
+		}},
+	}
+}
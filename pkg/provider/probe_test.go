@@ -0,0 +1,53 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+func TestProbeMetricWithoutBackend(t *testing.T) {
+	pm, backend, _ := newCachingManager(time.Minute)
+	prometheus := pm.prometheusExternalProvider.(*countingExternalProvider)
+	pm.probe = newProbeMetric("adapter_probe", 2.5)
+
+	for _, selector := range []string{"", "cache=bypass"} {
+		metricSelector, err := labels.Parse(selector)
+		if err != nil {
+			t.Fatalf("Failed to parse selector, because of %v", err)
+		}
+		values, err := pm.GetExternalMetric(context.TODO(), "default", metricSelector, p.ExternalMetricInfo{Metric: "adapter_probe"})
+		if err != nil {
+			t.Fatalf("Failed to get the probe, because of %v", err)
+		}
+		if len(values.Items) != 1 || values.Items[0].Value.MilliValue() != 2500 || values.Items[0].MetricName != "adapter_probe" {
+			t.Errorf("expected the value 2.5 of the probe, got %v", values.Items)
+		}
+	}
+	if backend.calls != 0 || prometheus.calls != 0 {
+		t.Errorf("expected the probe not to query any backend, got %d and %d calls", backend.calls, prometheus.calls)
+	}
+
+	listed := false
+	for _, m := range pm.ListAllExternalMetrics() {
+		listed = listed || m.Metric == "adapter_probe"
+	}
+	if !listed {
+		t.Errorf("expected the probe to be listed")
+	}
+}
+
+func TestDisabledProbeMetric(t *testing.T) {
+	pm, _, _ := newCachingManager(time.Minute)
+	pm.probe = newProbeMetric("", 1)
+
+	if _, err := pm.GetExternalMetric(context.TODO(), "default", labels.Everything(), p.ExternalMetricInfo{Metric: "adapter_probe"}); err == nil {
+		t.Errorf("expected the disabled probe not to be served")
+	}
+	if metrics := pm.ListAllExternalMetrics(); len(metrics) != 2 {
+		t.Errorf("expected only the metrics of the backends to be listed, got %v", metrics)
+	}
+}
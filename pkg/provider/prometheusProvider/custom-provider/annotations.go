@@ -0,0 +1,119 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// LabelMatchersAnnotation on the object a custom metric is requested for, e.g. the target Deployment
+// of an HPA, selects the Prometheus series of the object by the given label matchers instead of the
+// label of its resource, e.g. `app=checkout,env!=canary`. The values of the series are summed up.
+const LabelMatchersAnnotation = "metrics.alibabacloud.com/prometheus-label-matchers"
+
+// annotationSyncTimeout bounds the wait for the informer of a resource whose annotations are read for the first time.
+const annotationSyncTimeout = 10 * time.Second
+
+// AnnotationLister returns the annotations of the objects custom metrics are requested for.
+type AnnotationLister interface {
+	// Annotations returns the annotations of an object, nil if it doesn't exist.
+	Annotations(ctx context.Context, resource schema.GroupVersionResource, name types.NamespacedName) (map[string]string, error)
+}
+
+// ObjectAnnotationLister returns the annotations of the objects matching a selector as well.
+type ObjectAnnotationLister interface {
+	AnnotationLister
+	// AnnotationsBySelector returns the annotations of the objects of the namespace matching the selector, by name.
+	// The namespace is empty for a cluster scoped resource.
+	AnnotationsBySelector(ctx context.Context, resource schema.GroupVersionResource, namespace string, selector labels.Selector) (map[string]map[string]string, error)
+}
+
+type informerAnnotationLister struct {
+	factory dynamicinformer.DynamicSharedInformerFactory
+	stopCh  <-chan struct{}
+}
+
+// NewInformerAnnotationLister reads the annotations from informer caches, which are started
+// for a resource when the first object of the resource is requested, until stopCh is closed.
+func NewInformerAnnotationLister(client dynamic.Interface, stopCh <-chan struct{}) ObjectAnnotationLister {
+	return &informerAnnotationLister{
+		factory: dynamicinformer.NewDynamicSharedInformerFactory(client, 0),
+		stopCh:  stopCh,
+	}
+}
+
+// syncedInformer returns the informer of the resource once its cache is filled.
+func (l *informerAnnotationLister) syncedInformer(ctx context.Context, resource schema.GroupVersionResource) (informers.GenericInformer, error) {
+	informer := l.factory.ForResource(resource)
+	// only starts the informers which aren't running yet
+	l.factory.Start(l.stopCh)
+
+	ctx, cancel := context.WithTimeout(ctx, annotationSyncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.Informer().HasSynced) {
+		return nil, fmt.Errorf("failed to sync the informer of %s", resource)
+	}
+	return informer, nil
+}
+
+func (l *informerAnnotationLister) Annotations(ctx context.Context, resource schema.GroupVersionResource, name types.NamespacedName) (map[string]string, error) {
+	informer, err := l.syncedInformer(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
+
+	var obj runtime.Object
+	if name.Namespace != "" {
+		obj, err = informer.Lister().ByNamespace(name.Namespace).Get(name.Name)
+	} else {
+		obj, err = informer.Lister().Get(name.Name)
+	}
+	if apierr.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	accessor, err := apimeta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+	return accessor.GetAnnotations(), nil
+}
+
+func (l *informerAnnotationLister) AnnotationsBySelector(ctx context.Context, resource schema.GroupVersionResource, namespace string, selector labels.Selector) (map[string]map[string]string, error) {
+	informer, err := l.syncedInformer(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
+
+	var objs []runtime.Object
+	if namespace != "" {
+		objs, err = informer.Lister().ByNamespace(namespace).List(selector)
+	} else {
+		objs, err = informer.Lister().List(selector)
+	}
+	if err != nil {
+		return nil, err
+	}
+	annotations := make(map[string]map[string]string, len(objs))
+	for _, obj := range objs {
+		accessor, err := apimeta.Accessor(obj)
+		if err != nil {
+			return nil, err
+		}
+		annotations[accessor.GetName()] = accessor.GetAnnotations()
+	}
+	return annotations, nil
+}
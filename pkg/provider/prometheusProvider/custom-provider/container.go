@@ -0,0 +1,59 @@
+package provider
+
+import (
+	"fmt"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// ContainerLabel of the metric selector of a custom metric of pods scopes it to some of their containers,
+// e.g. container=app, or container in (app,sidecar) to get a value per container. The values are matched
+// to their container by the field path of the described pod, e.g. spec.containers{app}. The other
+// requirements of the label, e.g. container!=POD to leave the pause container out, are matchers of the query.
+const ContainerLabel = "container"
+
+var podsGroupResource = schema.GroupResource{Resource: "pods"}
+
+// containersOf returns the containers the metric selector selects by name for a metric of pods, and the rest
+// of the selector. It returns no containers if the metric isn't scoped to containers by name.
+func containersOf(info provider.CustomMetricInfo, metricSelector labels.Selector) ([]string, labels.Selector, error) {
+	if info.GroupResource != podsGroupResource || metricSelector == nil {
+		return nil, metricSelector, nil
+	}
+	requirements, _ := metricSelector.Requirements()
+	var containers []string
+	rest := labels.NewSelector()
+	for _, r := range requirements {
+		if r.Key() != ContainerLabel {
+			rest = rest.Add(r)
+			continue
+		}
+		switch r.Operator() {
+		case selection.Equals, selection.DoubleEquals, selection.In:
+		default:
+			// e.g. container!=POD or container notin (POD,istio-proxy), the query matches them with != or !~
+			rest = rest.Add(r)
+			continue
+		}
+		if containers != nil {
+			return nil, nil, apierr.NewBadRequest(fmt.Sprintf("the containers may only be selected by name once, e.g. with %s in (app,sidecar)", ContainerLabel))
+		}
+		containers = r.Values().List()
+	}
+	return containers, rest, nil
+}
+
+// withContainer adds the matcher of the container to the selector.
+func withContainer(selector labels.Selector, container string) labels.Selector {
+	r, _ := labels.NewRequirement(ContainerLabel, selection.Equals, []string{container})
+	return selector.Add(*r)
+}
+
+// containerFieldPath is the field path of a container of a pod, as in the references of the events.
+func containerFieldPath(container string) string {
+	return fmt.Sprintf("spec.containers{%s}", container)
+}
@@ -18,6 +18,7 @@ package provider
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math"
 	"time"
@@ -41,6 +42,8 @@ import (
 
 	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
 	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
 )
 
 // Runnable represents something that can be run until told to stop.
@@ -49,22 +52,31 @@ type Runnable interface {
 	Run()
 	// RunUntil runs the runnable until the given channel is closed.
 	RunUntil(stopChan <-chan struct{})
+	// RelistOnStartup lists the available metrics once, before the runnable is run.
+	RelistOnStartup(strict bool) error
+	// UseSnapshot lists the metrics of the snapshot until the first relist, and tells whether it had any.
+	UseSnapshot(snapshot *utils.SeriesSnapshot) bool
 }
 
 type prometheusProvider struct {
 	mapper     apimeta.RESTMapper
 	kubeClient dynamic.Interface
 	promClient prom.Client
+	// annotations are the annotations of the requested objects, nil if the LabelMatchersAnnotation is ignored
+	annotations AnnotationLister
 
 	SeriesRegistry
 }
 
-func NewPrometheusProvider(mapper apimeta.RESTMapper, kubeClient dynamic.Interface, promClient prom.Client, namers []naming.MetricNamer, updateInterval time.Duration, maxAge time.Duration) (provider.CustomMetricsProvider, Runnable) {
+// NewPrometheusProvider creates a CustomMetricsProvider serving the metrics of the series discovered by the namers.
+// The LabelMatchersAnnotation of the requested objects is read from annotations, unless it's nil.
+func NewPrometheusProvider(mapper apimeta.RESTMapper, kubeClient dynamic.Interface, promClient prom.Client, namers []naming.MetricNamer, updateInterval time.Duration, maxAge time.Duration, annotations AnnotationLister) (provider.CustomMetricsProvider, Runnable) {
 	lister := &cachingMetricsLister{
 		updateInterval: updateInterval,
 		maxAge:         maxAge,
 		promClient:     promClient,
 		namers:         namers,
+		relists:        utils.NewRelistScheduler("custom", updateInterval),
 
 		SeriesRegistry: &basicSeriesRegistry{
 			mapper: mapper,
@@ -76,6 +88,8 @@ func NewPrometheusProvider(mapper apimeta.RESTMapper, kubeClient dynamic.Interfa
 		kubeClient: kubeClient,
 		promClient: promClient,
 
+		annotations: annotations,
+
 		SeriesRegistry: lister,
 	}, lister
 }
@@ -144,24 +158,119 @@ func (p *prometheusProvider) buildQuery(ctx context.Context, info provider.Custo
 		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
 	}
 
+	return p.query(ctx, info, query, false)
+}
+
+// query runs the query of a metric. A scalar result is only allowed if the values don't have to be
+// matched to objects, it's then returned as a single sample without labels.
+func (p *prometheusProvider) query(ctx context.Context, info provider.CustomMetricInfo, query prom.Selector, scalarAllowed bool) (pmodel.Vector, error) {
 	klog.V(4).Infof("Custom metrics: %s query: %s", info.Metric, query)
 	// TODO: use an actual context
 	queryResults, err := p.promClient.Query(ctx, pmodel.Now(), query)
 	if err != nil {
 		klog.Errorf("unable to fetch metrics from prometheus: %v", err)
-		// don't leak implementation details to the user
-		return nil, apierr.NewInternalError(fmt.Errorf("unable to fetch metrics"))
+		// don't leak implementation details to the user, only the reason of the failure
+		return nil, utils.PrometheusQueryError(err)
 	}
 
+	if queryResults.Type == pmodel.ValScalar && scalarAllowed && queryResults.Scalar != nil {
+		return pmodel.Vector{{Value: queryResults.Scalar.Value, Timestamp: queryResults.Scalar.Timestamp}}, nil
+	}
+	if queryResults.Type == pmodel.ValScalar {
+		klog.Errorf("the query %s of custom metric %s returns a scalar, which has no labels to match objects", query, info.Metric)
+		return nil, utils.ScalarResultError(info.Metric)
+	}
 	if queryResults.Type != pmodel.ValVector {
 		klog.Errorf("unexpected results from prometheus: expected %s, got %s on results %v", pmodel.ValVector, queryResults.Type, queryResults)
-		return nil, apierr.NewInternalError(fmt.Errorf("unable to fetch metrics"))
+		return nil, utils.UnexpectedPrometheusResultError(queryResults.Type)
 	}
 
 	return *queryResults.Vector, nil
 }
 
+// labelMatchersFor returns the LabelMatchersAnnotation of the requested object, if it has one.
+func (p *prometheusProvider) labelMatchersFor(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo) (labels.Selector, bool, error) {
+	if p.annotations == nil {
+		return nil, false, nil
+	}
+	resource, err := p.mapper.ResourceFor(info.GroupResource.WithVersion(""))
+	if err != nil {
+		klog.Errorf("unable to find the resource of %s: %v", info.GroupResource, err)
+		return nil, false, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+	}
+	annotations, err := p.annotations.Annotations(ctx, resource, name)
+	if err != nil {
+		klog.Errorf("unable to read the annotations of %s %s: %v", info.GroupResource, name, err)
+		// don't leak implementation details to the user
+		return nil, false, apierr.NewInternalError(fmt.Errorf("unable to read the annotations of the object"))
+	}
+	matchers, found := annotations[LabelMatchersAnnotation]
+	if !found {
+		return nil, false, nil
+	}
+	selector, err := labels.Parse(matchers)
+	if err != nil {
+		return nil, false, apierr.NewBadRequest(fmt.Sprintf("invalid %s annotation of %s %s: %v", LabelMatchersAnnotation, info.GroupResource, name, err))
+	}
+	return selector, true, nil
+}
+
+// metricByLabelMatchers returns the sum of the values of the series matching the label matchers of the object.
+func (p *prometheusProvider) metricByLabelMatchers(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector, matchers labels.Selector) (*custom_metrics.MetricValue, error) {
+	selector := matchers
+	if metricSelector != nil {
+		requirements, _ := metricSelector.Requirements()
+		selector = selector.Add(requirements...)
+	}
+	query, found := p.QueryForLabelMatchers(info, name.Namespace, selector)
+	if !found {
+		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+	}
+	// the values are summed up for the object, so a scalar does
+	queryResults, err := p.query(ctx, info, query, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(queryResults) < 1 {
+		return nil, utils.NoSeriesMatchedError(info.Metric)
+	}
+
+	var sum pmodel.SampleValue
+	for _, sample := range queryResults {
+		sum += sample.Value
+	}
+	return p.metricFor(sum, name, info, metricSelector)
+}
+
 func (p *prometheusProvider) GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	containers, rest, err := containersOf(info, metricSelector)
+	if err != nil {
+		return nil, err
+	}
+	if len(containers) == 0 {
+		return p.getMetricByName(ctx, name, info, metricSelector)
+	}
+	if len(containers) > 1 {
+		return nil, apierr.NewBadRequest(fmt.Sprintf("the metric of a single pod may only be scoped to a single container, got %v", containers))
+	}
+	value, err := p.getMetricByName(ctx, name, info, withContainer(rest, containers[0]))
+	if err != nil {
+		return nil, err
+	}
+	value.DescribedObject.FieldPath = containerFieldPath(containers[0])
+	return value, nil
+}
+
+func (p *prometheusProvider) getMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	// the object may select its series itself
+	matchers, found, err := p.labelMatchersFor(ctx, name, info)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return p.metricByLabelMatchers(ctx, name, info, metricSelector, matchers)
+	}
+
 	// construct a query
 	queryResults, err := p.buildQuery(ctx, info, name.Namespace, metricSelector, name.Name)
 	if err != nil {
@@ -170,7 +279,7 @@ func (p *prometheusProvider) GetMetricByName(ctx context.Context, name types.Nam
 
 	// associate the metrics
 	if len(queryResults) < 1 {
-		return nil, provider.NewMetricNotFoundForError(info.GroupResource, info.Metric, name.Name)
+		return nil, utils.NoSeriesMatchedError(info.Metric)
 	}
 
 	namedValues, found := p.MatchValuesToNames(info, queryResults)
@@ -201,6 +310,30 @@ func (p *prometheusProvider) GetMetricBySelector(ctx context.Context, namespace
 		return nil, apierr.NewInternalError(fmt.Errorf("unable to list matching resources"))
 	}
 
+	containers, rest, err := containersOf(info, metricSelector)
+	if err != nil {
+		return nil, err
+	}
+	if len(containers) == 0 {
+		return p.getMetricsByNames(ctx, namespace, resourceNames, info, metricSelector)
+	}
+
+	// a value per pod and container, each container being queried on its own
+	res := &custom_metrics.MetricValueList{Items: []custom_metrics.MetricValue{}}
+	for _, container := range containers {
+		values, err := p.getMetricsByNames(ctx, namespace, resourceNames, info, withContainer(rest, container))
+		if err != nil {
+			return nil, err
+		}
+		for i := range values.Items {
+			values.Items[i].DescribedObject.FieldPath = containerFieldPath(container)
+		}
+		res.Items = append(res.Items, values.Items...)
+	}
+	return res, nil
+}
+
+func (p *prometheusProvider) getMetricsByNames(ctx context.Context, namespace string, resourceNames []string, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
 	// construct the actual query
 	queryResults, err := p.buildQuery(ctx, info, namespace, metricSelector, resourceNames...)
 	if err != nil {
@@ -218,6 +351,15 @@ type cachingMetricsLister struct {
 	updateInterval time.Duration
 	maxAge         time.Duration
 	namers         []naming.MetricNamer
+
+	// lastSeries are the series of the last relist by query, kept for the rules which time out
+	lastSeries map[prom.Selector][]prom.Series
+	// snapshot persists the series of the relists, nil if they aren't
+	snapshot *utils.SeriesSnapshot
+	// relists tells when to relist next
+	relists *utils.RelistScheduler
+	// relistedOnStartup tells whether the series were relisted on startup, the first periodic relist waits an interval then
+	relistedOnStartup bool
 }
 
 func (l *cachingMetricsLister) Run() {
@@ -225,11 +367,11 @@ func (l *cachingMetricsLister) Run() {
 }
 
 func (l *cachingMetricsLister) RunUntil(stopChan <-chan struct{}) {
-	go wait.Until(func() {
+	utils.RunRelists(func() {
 		if err := l.updateMetrics(); err != nil {
 			utilruntime.HandleError(err)
 		}
-	}, l.updateInterval, stopChan)
+	}, l.relists, l.relistedOnStartup, stopChan)
 }
 
 type selectorSeries struct {
@@ -237,7 +379,47 @@ type selectorSeries struct {
 	series   []prom.Series
 }
 
+// RelistOnStartup lists the series of the rules once. A rule whose series query matches no
+// series likely has a typo: it fails the startup in strict mode, and is only logged otherwise.
+func (l *cachingMetricsLister) RelistOnStartup(strict bool) error {
+	unmatched, err := l.relist()
+	l.relistedOnStartup = err == nil
+	if err == nil && len(unmatched) > 0 {
+		err = fmt.Errorf("the series queries of %d rules matched no series: %v", len(unmatched), unmatched)
+	}
+	if err != nil && !strict {
+		klog.Warningf("Initial relist of the metrics: %v", err)
+		return nil
+	}
+	return err
+}
+
+// UseSnapshot sets the series of the snapshot as if they had been relisted, and saves the next relists to it.
+func (l *cachingMetricsLister) UseSnapshot(snapshot *utils.SeriesSnapshot) bool {
+	l.snapshot = snapshot
+	series, err := snapshot.Load()
+	if err != nil {
+		klog.Warningf("Ignoring the relist snapshot of the custom metrics: %v", err)
+		return false
+	}
+	if len(series) == 0 {
+		return false
+	}
+	l.lastSeries = series
+	if _, err := l.setSeries(series); err != nil {
+		klog.Warningf("Ignoring the relist snapshot of the custom metrics: %v", err)
+		return false
+	}
+	return true
+}
+
 func (l *cachingMetricsLister) updateMetrics() error {
+	_, err := l.relist()
+	return err
+}
+
+// relist updates the available metrics, and returns the series queries of the rules which matched no series.
+func (l *cachingMetricsLister) relist() ([]prom.Selector, error) {
 	startTime := pmodel.Now().Add(-1 * l.maxAge)
 
 	// don't do duplicate queries when it's just the matchers that change
@@ -248,7 +430,9 @@ func (l *cachingMetricsLister) updateMetrics() error {
 	selectors := make(map[prom.Selector]struct{})
 	selectorSeriesChan := make(chan selectorSeries, len(l.namers))
 	errs := make(chan error, len(l.namers))
+	lastSeries := l.lastSeries
 	for _, namer := range l.namers {
+		namer := namer
 		sel := namer.Selector()
 		if _, ok := selectors[sel]; ok {
 			errs <- nil
@@ -257,7 +441,10 @@ func (l *cachingMetricsLister) updateMetrics() error {
 		}
 		selectors[sel] = struct{}{}
 		go func() {
-			series, err := l.promClient.Series(context.TODO(), pmodel.Interval{startTime, 0}, sel)
+			series, err := utils.ListRuleSeries(context.TODO(), l.promClient, pmodel.Interval{startTime, 0}, namer)
+			if errors.Is(err, utils.ErrRuleTimeout) {
+				series, err = lastSeries[sel], nil
+			}
 			if err != nil {
 				errs <- fmt.Errorf("unable to fetch metrics for query %q: %v", sel, err)
 				return
@@ -273,27 +460,43 @@ func (l *cachingMetricsLister) updateMetrics() error {
 	// iterate through, blocking until we've got all results
 	for range l.namers {
 		if err := <-errs; err != nil {
-			return fmt.Errorf("unable to update list of all metrics: %v", err)
+			return nil, fmt.Errorf("unable to update list of all metrics: %v", err)
 		}
 		if ss := <-selectorSeriesChan; ss.series != nil {
 			seriesCacheByQuery[ss.selector] = ss.series
 		}
 	}
 	close(errs)
+	l.lastSeries = seriesCacheByQuery
+	if err := l.snapshot.Save(seriesCacheByQuery); err != nil {
+		klog.Warningf("Failed to save the relist snapshot: %v", err)
+	}
+	return l.setSeries(seriesCacheByQuery)
+}
 
+// setSeries updates the available metrics from the series listed by query, and returns the series
+// queries of the rules which matched no series.
+func (l *cachingMetricsLister) setSeries(seriesCacheByQuery map[prom.Selector][]prom.Series) ([]prom.Selector, error) {
 	newSeries := make([][]prom.Series, 0)
 	newNamers := make([]naming.MetricNamer, 0)
+	var unmatched []prom.Selector
 	for _, namer := range l.namers {
 		series, cached := seriesCacheByQuery[namer.Selector()]
 		if !cached {
 			klog.Warningf("unable to update custom metrics: no metrics retrieved for query %q", namer.Selector())
+			unmatched = append(unmatched, namer.Selector())
 			continue
 		}
-		newSeries = append(newSeries, namer.FilterSeries(series))
+		series = namer.FilterSeries(series)
+		if len(series) == 0 {
+			unmatched = append(unmatched, namer.Selector())
+		}
+		newSeries = append(newSeries, series)
 		newNamers = append(newNamers, namer)
 	}
 
 	klog.V(10).Infof("Set available custom metrics list from Prometheus to: %v", newSeries)
+	l.relists.Observe(newSeries)
 
-	return l.SetSeries(newSeries, newNamers)
+	return unmatched, l.SetSeries(newSeries, newNamers)
 }
@@ -17,13 +17,19 @@ limitations under the License.
 package provider
 
 import (
+	"context"
 	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	pmodel "github.com/prometheus/common/model"
 
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	fakedyn "k8s.io/client-go/dynamic/fake"
 
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
@@ -31,6 +37,7 @@ import (
 	config "sigs.k8s.io/prometheus-adapter/cmd/config-gen/utils"
 	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
 	fakeprom "sigs.k8s.io/prometheus-adapter/pkg/client/fake"
+	pconfig "sigs.k8s.io/prometheus-adapter/pkg/config"
 	"sigs.k8s.io/prometheus-adapter/pkg/naming"
 )
 
@@ -45,7 +52,7 @@ func setupPrometheusProvider() (provider.CustomMetricsProvider, *fakeprom.FakePr
 	namers, err := naming.NamersFromConfig(cfg.Rules, restMapper())
 	Expect(err).NotTo(HaveOccurred())
 
-	prov, _ := NewPrometheusProvider(restMapper(), fakeKubeClient, fakeProm, namers, fakeProviderUpdateInterval, fakeProviderStartDuration)
+	prov, _ := NewPrometheusProvider(restMapper(), fakeKubeClient, fakeProm, namers, fakeProviderUpdateInterval, fakeProviderStartDuration, nil)
 
 	containerSel := prom.MatchSeries("", prom.NameMatches("^container_.*"), prom.LabelNeq("container", "POD"), prom.LabelNeq("namespace", ""), prom.LabelNeq("pod", ""))
 	namespacedSel := prom.MatchSeries("", prom.LabelNeq("namespace", ""), prom.NameNotMatches("^container_.*"))
@@ -80,6 +87,45 @@ func setupPrometheusProvider() (provider.CustomMetricsProvider, *fakeprom.FakePr
 }
 
 var _ = Describe("Custom Metrics Provider", func() {
+	It("should fail the startup in strict mode when a rule matches no series", func() {
+		By("setting up the provider with a misspelled rule")
+		rules := []pconfig.DiscoveryRule{
+			{
+				SeriesQuery: `{__name__="ingress_hits_total",namespace!=""}`,
+				Resources:   pconfig.ResourceMapping{Template: "<<.Resource>>"},
+			},
+			{
+				SeriesQuery: `{__name__="ingres_requests_total",namespace!=""}`,
+				Resources:   pconfig.ResourceMapping{Template: "<<.Resource>>"},
+			},
+		}
+		namers, err := naming.NamersFromConfig(rules, restMapper())
+		Expect(err).NotTo(HaveOccurred())
+		fakeProm := &fakeprom.FakePrometheusClient{
+			AcceptableInterval: pmodel.Interval{Start: 0, End: pmodel.Latest},
+			SeriesResults: map[prom.Selector][]prom.Series{
+				prom.Selector(rules[0].SeriesQuery): {
+					{
+						Name:   "ingress_hits_total",
+						Labels: pmodel.LabelSet{"service": "somesvc", "namespace": "somens"},
+					},
+				},
+			},
+		}
+		prov, runner := NewPrometheusProvider(restMapper(), &fakedyn.FakeDynamicClient{}, fakeProm, namers, fakeProviderUpdateInterval, fakeProviderStartDuration, nil)
+
+		By("relisting in strict mode")
+		err = runner.RelistOnStartup(true)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("ingres_requests_total"))
+
+		By("relisting without strict mode, which only warns about the rule")
+		Expect(runner.RelistOnStartup(false)).To(Succeed())
+		Expect(prov.ListAllMetrics()).To(ContainElement(
+			provider.CustomMetricInfo{schema.GroupResource{Resource: "services"}, true, "ingress_hits_total"},
+		))
+	})
+
 	It("should be able to list all metrics", func() {
 		By("setting up the provider")
 		prov, fakeProm := setupPrometheusProvider()
@@ -110,4 +156,212 @@ var _ = Describe("Custom Metrics Provider", func() {
 			provider.CustomMetricInfo{schema.GroupResource{Resource: "pods"}, true, "some_usage"},
 		))
 	})
+
+	It("should select the series of an object by its label matchers annotation", func() {
+		By("setting up the provider with the listed metrics and annotated deployments")
+		deployment := func(name string, annotations map[string]string) *unstructured.Unstructured {
+			obj := &unstructured.Unstructured{}
+			obj.SetAPIVersion("extensions/v1beta1")
+			obj.SetKind("Deployment")
+			obj.SetNamespace("somens")
+			obj.SetName(name)
+			obj.SetAnnotations(annotations)
+			return obj
+		}
+		deployments := schema.GroupVersionResource{Group: "extensions", Version: "v1beta1", Resource: "deployments"}
+		kubeClient := fakedyn.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+			map[schema.GroupVersionResource]string{deployments: "DeploymentList"},
+			deployment("checkout", map[string]string{LabelMatchersAnnotation: "app=checkout"}),
+			deployment("somedep", nil),
+			deployment("broken", map[string]string{LabelMatchersAnnotation: "app in checkout"}),
+		)
+		stopCh := make(chan struct{})
+		defer close(stopCh)
+
+		cfg := config.DefaultConfig(1*time.Minute, "")
+		namers, err := naming.NamersFromConfig(cfg.Rules, restMapper())
+		Expect(err).NotTo(HaveOccurred())
+		fakeProm := &fakeprom.FakePrometheusClient{
+			AcceptableInterval: pmodel.Interval{Start: 0, End: pmodel.Latest},
+			SeriesResults: map[prom.Selector][]prom.Series{
+				prom.MatchSeries("", prom.LabelNeq("namespace", ""), prom.NameNotMatches("^container_.*")): {
+					{
+						Name:   "work_queue_wait_seconds_total",
+						Labels: pmodel.LabelSet{"deployment": "somedep", "namespace": "somens"},
+					},
+				},
+			},
+		}
+		prov, runner := NewPrometheusProvider(restMapper(), kubeClient, fakeProm, namers, fakeProviderUpdateInterval, fakeProviderStartDuration,
+			NewInformerAnnotationLister(kubeClient, stopCh))
+		Expect(runner.RelistOnStartup(false)).To(Succeed())
+		info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Group: "extensions", Resource: "deployments"}, Namespaced: true, Metric: "work_queue_wait"}
+
+		By("querying the series matching the annotation of the object instead of its resource label")
+		selector, err := labels.Parse("app=checkout")
+		Expect(err).NotTo(HaveOccurred())
+		query, found := prov.(*prometheusProvider).QueryForLabelMatchers(info, "somens", selector)
+		Expect(found).To(BeTrue())
+		Expect(string(query)).To(ContainSubstring(`app="checkout"`))
+		Expect(string(query)).NotTo(ContainSubstring("deployment="))
+		fakeProm.QueryResults = map[prom.Selector]prom.QueryResult{
+			query: {Type: pmodel.ValVector, Vector: &pmodel.Vector{{Value: 2}, {Value: 3}}},
+		}
+		value, err := prov.GetMetricByName(context.TODO(), types.NamespacedName{Namespace: "somens", Name: "checkout"}, info, labels.Everything())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value.Value.MilliValue()).To(Equal(int64(5000)))
+		Expect(value.DescribedObject.Name).To(Equal("checkout"))
+
+		By("summing up a scalar, which doesn't have to be matched to the object")
+		fakeProm.QueryResults[query] = prom.QueryResult{Type: pmodel.ValScalar, Scalar: &pmodel.Scalar{Value: 4}}
+		value, err = prov.GetMetricByName(context.TODO(), types.NamespacedName{Namespace: "somens", Name: "checkout"}, info, labels.Everything())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value.Value.MilliValue()).To(Equal(int64(4000)))
+
+		By("querying an object without the annotation by its resource label")
+		query, found = prov.(*prometheusProvider).QueryForMetric(info, "somens", labels.Everything(), "somedep")
+		Expect(found).To(BeTrue())
+		fakeProm.QueryResults[query] = prom.QueryResult{Type: pmodel.ValVector, Vector: &pmodel.Vector{
+			{Metric: pmodel.Metric{"deployment": "somedep"}, Value: 7},
+		}}
+		value, err = prov.GetMetricByName(context.TODO(), types.NamespacedName{Namespace: "somens", Name: "somedep"}, info, labels.Everything())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value.Value.MilliValue()).To(Equal(int64(7000)))
+
+		By("rejecting an invalid annotation")
+		_, err = prov.GetMetricByName(context.TODO(), types.NamespacedName{Namespace: "somens", Name: "broken"}, info, labels.Everything())
+		Expect(apierr.IsBadRequest(err)).To(BeTrue())
+	})
+
+	It("should resolve a metric of pods per container", func() {
+		By("setting up the provider with the listed metrics and a pod")
+		pod := &unstructured.Unstructured{}
+		pod.SetAPIVersion("v1")
+		pod.SetKind("Pod")
+		pod.SetNamespace("somens")
+		pod.SetName("somepod")
+		pods := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+		kubeClient := fakedyn.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{pods: "PodList"}, pod)
+
+		cfg := config.DefaultConfig(1*time.Minute, "")
+		namers, err := naming.NamersFromConfig(cfg.Rules, restMapper())
+		Expect(err).NotTo(HaveOccurred())
+		fakeProm := &fakeprom.FakePrometheusClient{
+			AcceptableInterval: pmodel.Interval{Start: 0, End: pmodel.Latest},
+			SeriesResults: map[prom.Selector][]prom.Series{
+				prom.MatchSeries("", prom.NameMatches("^container_.*"), prom.LabelNeq("container", "POD"), prom.LabelNeq("namespace", ""), prom.LabelNeq("pod", "")): {
+					{
+						Name:   "container_some_usage",
+						Labels: pmodel.LabelSet{"pod": "somepod", "namespace": "somens", "container": "app"},
+					},
+					{
+						Name:   "container_some_usage",
+						Labels: pmodel.LabelSet{"pod": "somepod", "namespace": "somens", "container": "sidecar"},
+					},
+				},
+			},
+		}
+		prov, runner := NewPrometheusProvider(restMapper(), kubeClient, fakeProm, namers, fakeProviderUpdateInterval, fakeProviderStartDuration, nil)
+		Expect(runner.RelistOnStartup(false)).To(Succeed())
+		info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "some_usage"}
+
+		By("adding a matcher of the container to the query")
+		fakeProm.QueryResults = map[prom.Selector]prom.QueryResult{}
+		for container, value := range map[string]pmodel.SampleValue{"app": 2, "sidecar": 3} {
+			query, found := prov.(*prometheusProvider).QueryForMetric(info, "somens", withContainer(labels.NewSelector(), container), "somepod")
+			Expect(found).To(BeTrue())
+			Expect(string(query)).To(ContainSubstring(`container="` + container + `"`))
+			fakeProm.QueryResults[query] = prom.QueryResult{Type: pmodel.ValVector, Vector: &pmodel.Vector{
+				{Metric: pmodel.Metric{"pod": "somepod"}, Value: value},
+			}}
+		}
+
+		By("resolving the metric of a container of the pod")
+		selector, err := labels.Parse("container=sidecar")
+		Expect(err).NotTo(HaveOccurred())
+		value, err := prov.GetMetricByName(context.TODO(), types.NamespacedName{Namespace: "somens", Name: "somepod"}, info, selector)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value.Value.MilliValue()).To(Equal(int64(3000)))
+		Expect(value.DescribedObject.Name).To(Equal("somepod"))
+		Expect(value.DescribedObject.FieldPath).To(Equal("spec.containers{sidecar}"))
+
+		By("resolving the metric of each container of the pods")
+		selector, err = labels.Parse("container in (app,sidecar)")
+		Expect(err).NotTo(HaveOccurred())
+		values, err := prov.GetMetricBySelector(context.TODO(), "somens", labels.Everything(), info, selector)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(values.Items).To(HaveLen(2))
+		byContainer := map[string]int64{}
+		for _, item := range values.Items {
+			Expect(item.DescribedObject.Name).To(Equal("somepod"))
+			byContainer[item.DescribedObject.FieldPath] = item.Value.MilliValue()
+		}
+		Expect(byContainer).To(Equal(map[string]int64{"spec.containers{app}": 2000, "spec.containers{sidecar}": 3000}))
+
+		By("rejecting several containers for a single value")
+		_, err = prov.GetMetricByName(context.TODO(), types.NamespacedName{Namespace: "somens", Name: "somepod"}, info, selector)
+		Expect(apierr.IsBadRequest(err)).To(BeTrue())
+
+		By("passing the containers left out through as matchers of the query")
+		for selector, matcher := range map[string]string{
+			"container!=POD":                    `container!="POD"`,
+			"container notin (POD,istio-proxy)": `container!~"POD|istio-proxy"`,
+		} {
+			metricSelector, err := labels.Parse(selector)
+			Expect(err).NotTo(HaveOccurred())
+			containers, rest, err := containersOf(info, metricSelector)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(containers).To(BeEmpty())
+			query, found := prov.(*prometheusProvider).QueryForMetric(info, "somens", rest, "somepod")
+			Expect(found).To(BeTrue())
+			Expect(string(query)).To(ContainSubstring(matcher))
+		}
+		selector, err = labels.Parse("container in (app,sidecar),container!=POD")
+		Expect(err).NotTo(HaveOccurred())
+		containers, rest, err := containersOf(info, selector)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(containers).To(Equal([]string{"app", "sidecar"}))
+		Expect(rest.String()).To(Equal("container!=POD"))
+	})
+
+	It("should return the reason of a failed query", func() {
+		By("setting up the provider with the listed metrics")
+		prov, fakeProm := setupPrometheusProvider()
+		fakeProm.AcceptableInterval = pmodel.Interval{Start: 0, End: pmodel.Latest}
+		lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+		Expect(lister.updateMetrics()).To(Succeed())
+
+		info := provider.CustomMetricInfo{schema.GroupResource{Resource: "pods"}, true, "ingress_hits"}
+		name := types.NamespacedName{Namespace: "somens", Name: "backend1"}
+
+		By("querying a metric without any series")
+		_, err := prov.GetMetricByName(context.TODO(), name, info, labels.Everything())
+		Expect(apierr.IsNotFound(err)).To(BeTrue())
+		Expect(err.Error()).To(Equal("no series matched for metric ingress_hits"))
+
+		By("querying a metric while prometheus times out")
+		query, found := prov.(*prometheusProvider).QueryForMetric(info, name.Namespace, labels.Everything(), name.Name)
+		Expect(found).To(BeTrue())
+		fakeProm.ErrQueries = map[prom.Selector]error{
+			query: &prom.Error{Type: prom.ErrTimeout, Msg: "query timed out in expression evaluation"},
+		}
+		_, err = prov.GetMetricByName(context.TODO(), name, info, labels.Everything())
+		Expect(apierr.IsTimeout(err)).To(BeTrue())
+		Expect(err.Error()).To(Equal("prometheus query timeout"))
+
+		By("querying a metric whose query returns a scalar, which can't be matched to the pod")
+		delete(fakeProm.ErrQueries, query)
+		fakeProm.QueryResults = map[prom.Selector]prom.QueryResult{
+			query: {Type: pmodel.ValScalar, Scalar: &pmodel.Scalar{Value: 4}},
+		}
+		_, err = prov.GetMetricByName(context.TODO(), name, info, labels.Everything())
+		Expect(apierr.IsInternalError(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("the query returns a scalar, which can't be matched to objects for metric ingress_hits"))
+
+		By("querying a metric prometheus rejects")
+		fakeProm.ErrQueries[query] = &prom.Error{Type: prom.ErrBadData, Msg: "parse error"}
+		_, err = prov.GetMetricByName(context.TODO(), name, info, labels.Everything())
+		Expect(apierr.IsBadRequest(err)).To(BeTrue())
+		Expect(err.Error()).To(Equal("prometheus rejected the query as invalid"))
+	})
 })
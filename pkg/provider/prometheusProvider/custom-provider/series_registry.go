@@ -55,6 +55,9 @@ type SeriesRegistry interface {
 	// SeriesForMetric looks up the minimum required series information to make a query for the given metric
 	// against the given resource (namespace may be empty for non-namespaced resources)
 	QueryForMetric(info provider.CustomMetricInfo, namespace string, metricSelector labels.Selector, resourceNames ...string) (query prom.Selector, found bool)
+	// QueryForLabelMatchers produces the query of the given metric for the series matching the given selector,
+	// instead of the series carrying the label of a resource (namespace may be empty for non-namespaced resources)
+	QueryForLabelMatchers(info provider.CustomMetricInfo, namespace string, selector labels.Selector) (query prom.Selector, found bool)
 	// MatchValuesToNames matches result values to resource names for the given metric and value set
 	MatchValuesToNames(metricInfo provider.CustomMetricInfo, values pmodel.Vector) (matchedValues map[string]pmodel.SampleValue, found bool)
 }
@@ -169,6 +172,41 @@ func (r *basicSeriesRegistry) QueryForMetric(metricInfo provider.CustomMetricInf
 	return query, true
 }
 
+func (r *basicSeriesRegistry) QueryForLabelMatchers(metricInfo provider.CustomMetricInfo, namespace string, selector labels.Selector) (prom.Selector, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	metricInfo, _, err := metricInfo.Normalized(r.mapper)
+	if err != nil {
+		klog.Errorf("unable to normalize group resource while producing a query: %v", err)
+		return "", false
+	}
+
+	// the series selected by label matchers may not carry the label of the resource,
+	// so the metric may only be registered for other resources
+	info, infoFound := r.info[metricInfo]
+	for _, other := range r.metrics {
+		if infoFound {
+			break
+		}
+		if other.Metric == metricInfo.Metric {
+			info, infoFound = r.info[other]
+		}
+	}
+	if !infoFound {
+		klog.V(10).Infof("metric %v not registered", metricInfo)
+		return "", false
+	}
+
+	query, err := info.namer.QueryForExternalSeries(info.seriesName, namespace, selector)
+	if err != nil {
+		klog.Errorf("unable to construct query for metric %s: %v", metricInfo.String(), err)
+		return "", false
+	}
+
+	return query, true
+}
+
 func (r *basicSeriesRegistry) MatchValuesToNames(metricInfo provider.CustomMetricInfo, values pmodel.Vector) (matchedValues map[string]pmodel.SampleValue, found bool) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
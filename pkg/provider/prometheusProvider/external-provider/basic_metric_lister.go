@@ -18,6 +18,7 @@ package provider
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -27,6 +28,8 @@ import (
 	"sigs.k8s.io/prometheus-adapter/pkg/naming"
 
 	pmodel "github.com/prometheus/common/model"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
 )
 
 // Runnable represents something that can be run until told to stop.
@@ -35,6 +38,8 @@ type Runnable interface {
 	Run()
 	// RunUntil runs the runnable until the given channel is closed.
 	RunUntil(stopChan <-chan struct{})
+	// UseSnapshot lists the metrics of the snapshot until the first relist, and tells whether it had any.
+	UseSnapshot(snapshot *utils.SeriesSnapshot) bool
 }
 
 // A MetricLister provides a window into all of the metrics that are available within a given
@@ -60,6 +65,16 @@ type basicMetricLister struct {
 	promClient prom.Client
 	namers     []naming.MetricNamer
 	lookback   time.Duration
+
+	// lastSeries are the series of the last relist by query, kept for the rules which time out
+	lastSeries map[prom.Selector][]prom.Series
+	// snapshot persists the series of the relists, nil if they aren't
+	snapshot *utils.SeriesSnapshot
+}
+
+// snapshotLister is a MetricLister which starts from the series of a snapshot, and saves its relists to it.
+type snapshotLister interface {
+	useSnapshot(snapshot *utils.SeriesSnapshot) (MetricUpdateResult, bool)
 }
 
 // NewBasicMetricLister creates a MetricLister that is capable of interactly directly with Prometheus to list metrics.
@@ -78,6 +93,22 @@ type selectorSeries struct {
 	series   []prom.Series
 }
 
+// useSnapshot loads the series of the snapshot as if they had been relisted, and saves the next relists to it.
+// It tells whether the snapshot had series.
+func (l *basicMetricLister) useSnapshot(snapshot *utils.SeriesSnapshot) (MetricUpdateResult, bool) {
+	l.snapshot = snapshot
+	series, err := snapshot.Load()
+	if err != nil {
+		klog.Warningf("Ignoring the relist snapshot of the external metrics: %v", err)
+		return MetricUpdateResult{}, false
+	}
+	if len(series) == 0 {
+		return MetricUpdateResult{}, false
+	}
+	l.lastSeries = series
+	return l.resultFor(series), true
+}
+
 func (l *basicMetricLister) ListAllMetrics() (MetricUpdateResult, error) {
 	result := MetricUpdateResult{
 		series: make([][]prom.Series, 0),
@@ -91,7 +122,9 @@ func (l *basicMetricLister) ListAllMetrics() (MetricUpdateResult, error) {
 	selectors := make(map[prom.Selector]struct{})
 	selectorSeriesChan := make(chan selectorSeries, len(l.namers))
 	errs := make(chan error, len(l.namers))
+	lastSeries := l.lastSeries
 	for _, converter := range l.namers {
+		converter := converter
 		sel := converter.Selector()
 		if _, ok := selectors[sel]; ok {
 			errs <- nil
@@ -100,7 +133,10 @@ func (l *basicMetricLister) ListAllMetrics() (MetricUpdateResult, error) {
 		}
 		selectors[sel] = struct{}{}
 		go func() {
-			series, err := l.promClient.Series(context.TODO(), pmodel.Interval{startTime, 0}, sel)
+			series, err := utils.ListRuleSeries(context.TODO(), l.promClient, pmodel.Interval{startTime, 0}, converter)
+			if errors.Is(err, utils.ErrRuleTimeout) {
+				series, err = lastSeries[sel], nil
+			}
 			if err != nil {
 				errs <- fmt.Errorf("unable to fetch metrics for query %q: %v", sel, err)
 				return
@@ -132,7 +168,16 @@ func (l *basicMetricLister) ListAllMetrics() (MetricUpdateResult, error) {
 		}
 	}
 	close(errs)
+	l.lastSeries = seriesCacheByQuery
+	if err := l.snapshot.Save(seriesCacheByQuery); err != nil {
+		klog.Warningf("Failed to save the relist snapshot: %v", err)
+	}
 
+	return l.resultFor(seriesCacheByQuery), nil
+}
+
+// resultFor returns the metrics of the namers from the series listed by query.
+func (l *basicMetricLister) resultFor(seriesCacheByQuery map[prom.Selector][]prom.Series) MetricUpdateResult {
 	// Now that we've collected all of the results into `seriesCacheByQuery`
 	// we can start processing them.
 	newSeries := make([][]prom.Series, 0)
@@ -151,9 +196,10 @@ func (l *basicMetricLister) ListAllMetrics() (MetricUpdateResult, error) {
 
 	klog.V(10).Infof("Set available external metric list from Prometheus to: %v", newSeries)
 
-	result.series = newSeries
-	result.namers = newNamers
-	return result, nil
+	return MetricUpdateResult{
+		series: newSeries,
+		namers: newNamers,
+	}
 }
 
 // MetricUpdateResult represents the output of a periodic inspection of metrics found to be
@@ -0,0 +1,140 @@
+package provider
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	fakeprom "sigs.k8s.io/prometheus-adapter/pkg/client/fake"
+	cfg "sigs.k8s.io/prometheus-adapter/pkg/config"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/naming"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+)
+
+// slowPrometheusClient doesn't answer the series queries of the slow selectors before their deadline.
+type slowPrometheusClient struct {
+	*fakeprom.FakePrometheusClient
+	slow map[prom.Selector]bool
+}
+
+func (c *slowPrometheusClient) Series(ctx context.Context, interval pmodel.Interval, selectors ...prom.Selector) ([]prom.Series, error) {
+	if c.slow[selectors[0]] {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return c.FakePrometheusClient.Series(ctx, interval, selectors...)
+}
+
+func externalRule(seriesQuery string, timeout time.Duration) config.DiscoveryRule {
+	return config.DiscoveryRule{
+		DiscoveryRule: cfg.DiscoveryRule{
+			SeriesQuery:  seriesQuery,
+			Resources:    cfg.ResourceMapping{Template: "<<.Resource>>"},
+			MetricsQuery: "sum(<<.Series>>)",
+		},
+		Timeout: timeout,
+	}
+}
+
+func TestListAllMetricsWithSlowRule(t *testing.T) {
+	rules := []config.DiscoveryRule{
+		externalRule(`{__name__="http_requests_total"}`, time.Second),
+		externalRule(`{__name__="expensive_total"}`, 50*time.Millisecond),
+		externalRule(`{__name__="queue_length"}`, 0),
+	}
+	namers, err := naming.NamersFromConfig(rules, nil, nil)
+	require.NoError(t, err)
+
+	client := &slowPrometheusClient{
+		FakePrometheusClient: &fakeprom.FakePrometheusClient{
+			AcceptableInterval: pmodel.Interval{Start: 0, End: pmodel.Latest},
+			SeriesResults:      make(map[prom.Selector][]prom.Series),
+		},
+		slow: make(map[prom.Selector]bool),
+	}
+	for _, rule := range rules {
+		name := rule.SeriesQuery[len(`{__name__="`) : len(rule.SeriesQuery)-2]
+		client.SeriesResults[prom.Selector(rule.SeriesQuery)] = []prom.Series{{Name: name}}
+	}
+	lister := NewBasicMetricLister(client, namers, time.Minute)
+
+	// the slow rule is skipped on the first relist, the others are listed
+	client.slow[prom.Selector(rules[1].SeriesQuery)] = true
+	result, err := lister.ListAllMetrics()
+	require.NoError(t, err)
+	require.Len(t, result.series, 2)
+
+	client.slow = map[prom.Selector]bool{}
+	result, err = lister.ListAllMetrics()
+	require.NoError(t, err)
+	require.Len(t, result.series, 3)
+
+	// once it's slow again, the rule keeps its previous series
+	client.slow[prom.Selector(rules[1].SeriesQuery)] = true
+	delete(client.SeriesResults, prom.Selector(rules[1].SeriesQuery))
+	result, err = lister.ListAllMetrics()
+	require.NoError(t, err)
+	require.Len(t, result.series, 3)
+	require.Equal(t, "expensive_total", result.series[1][0].Name)
+}
+
+func TestListAllMetricsFromSnapshot(t *testing.T) {
+	rules := []config.DiscoveryRule{
+		externalRule(`{__name__="http_requests_total"}`, 0),
+		externalRule(`{__name__="queue_length"}`, 0),
+	}
+	namers, err := naming.NamersFromConfig(rules, nil, nil)
+	require.NoError(t, err)
+
+	// the snapshot saved before the restart knows both metrics
+	snapshot := utils.NewSeriesSnapshot(filepath.Join(t.TempDir(), "relist.json"))
+	require.NoError(t, snapshot.Save(map[prom.Selector][]prom.Series{
+		prom.Selector(rules[0].SeriesQuery): {{Name: "http_requests_total"}},
+		prom.Selector(rules[1].SeriesQuery): {{Name: "queue_length"}},
+	}))
+
+	client := &fakeprom.FakePrometheusClient{
+		AcceptableInterval: pmodel.Interval{Start: 0, End: pmodel.Latest},
+		SeriesResults: map[prom.Selector][]prom.Series{
+			prom.Selector(rules[0].SeriesQuery): {{Name: "http_requests_total"}},
+		},
+	}
+	lister, _ := NewPeriodicMetricLister(NewBasicMetricLister(client, namers, time.Minute), time.Minute)
+	periodicLister := lister.(*periodicMetricLister)
+
+	// the metrics of the snapshot are listed before the first relist
+	require.True(t, periodicLister.UseSnapshot(snapshot))
+	result, err := periodicLister.ListAllMetrics()
+	require.NoError(t, err)
+	require.Len(t, result.series, 2)
+
+	// the relist in the background replaces them, and is saved to the snapshot
+	require.NoError(t, periodicLister.updateMetrics())
+	result, err = periodicLister.ListAllMetrics()
+	require.NoError(t, err)
+	require.Len(t, result.series, 2)
+	require.Equal(t, "http_requests_total", result.series[0][0].Name)
+	require.Empty(t, result.series[1])
+
+	saved, err := snapshot.Load()
+	require.NoError(t, err)
+	require.Equal(t, []prom.Series{{Name: "http_requests_total", Labels: pmodel.LabelSet{}}}, saved[prom.Selector(rules[0].SeriesQuery)])
+	require.Empty(t, saved[prom.Selector(rules[1].SeriesQuery)])
+}
+
+func TestListAllMetricsWithoutSnapshot(t *testing.T) {
+	namers, err := naming.NamersFromConfig([]config.DiscoveryRule{externalRule(`{__name__="queue_length"}`, 0)}, nil, nil)
+	require.NoError(t, err)
+	lister, _ := NewPeriodicMetricLister(NewBasicMetricLister(&fakeprom.FakePrometheusClient{}, namers, time.Minute), time.Minute)
+
+	// the snapshot wasn't saved yet, the metrics wait for the first relist
+	snapshot := utils.NewSeriesSnapshot(filepath.Join(t.TempDir(), "relist.json"))
+	require.False(t, lister.(*periodicMetricLister).UseSnapshot(snapshot))
+	require.False(t, lister.(*periodicMetricLister).UseSnapshot(nil))
+}
@@ -0,0 +1,79 @@
+package provider
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+// EmptyResultPolicy is how an external metric whose query succeeds without any series is answered.
+// A failed query is never subject to it, and always returns a server error the HPA retries.
+type EmptyResultPolicy string
+
+const (
+	// EmptyResultNotFound returns a not found error, which the HPA reports as the metric being missing.
+	EmptyResultNotFound EmptyResultPolicy = "NotFound"
+	// EmptyResultZero returns a single zero value, e.g. for a rate of requests which has no series while idle.
+	EmptyResultZero EmptyResultPolicy = "Zero"
+	// EmptyResultLastCached returns the last values the query returned, or a not found error if it never returned any.
+	EmptyResultLastCached EmptyResultPolicy = "LastCached"
+)
+
+// EmptyResultPolicies are the supported policies.
+var EmptyResultPolicies = []EmptyResultPolicy{EmptyResultNotFound, EmptyResultZero, EmptyResultLastCached}
+
+// ParseEmptyResultPolicy parses the name of a policy. An empty name stands for EmptyResultNotFound.
+func ParseEmptyResultPolicy(name string) (EmptyResultPolicy, error) {
+	if name == "" {
+		return EmptyResultNotFound, nil
+	}
+	for _, policy := range EmptyResultPolicies {
+		if string(policy) == name {
+			return policy, nil
+		}
+	}
+	return "", fmt.Errorf("unknown empty result policy %q, it must be one of %v", name, EmptyResultPolicies)
+}
+
+// lastResults keeps the last non empty values of the queries for EmptyResultLastCached.
+type lastResults struct {
+	lock   sync.Mutex
+	values map[string]*external_metrics.ExternalMetricValueList
+}
+
+func lastResultKey(info provider.ExternalMetricInfo, selector prom.Selector) string {
+	return info.Metric + "/" + string(selector)
+}
+
+func (r *lastResults) set(key string, values *external_metrics.ExternalMetricValueList) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.values == nil {
+		r.values = make(map[string]*external_metrics.ExternalMetricValueList)
+	}
+	r.values[key] = values
+}
+
+func (r *lastResults) get(key string) (*external_metrics.ExternalMetricValueList, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	values, found := r.values[key]
+	return values, found
+}
+
+// zeroResult is the single zero value returned by EmptyResultZero.
+func zeroResult(info provider.ExternalMetricInfo, at time.Time) *external_metrics.ExternalMetricValueList {
+	return &external_metrics.ExternalMetricValueList{
+		Items: []external_metrics.ExternalMetricValue{{
+			MetricName: info.Metric,
+			Timestamp:  metav1.NewTime(at),
+			Value:      *resource.NewMilliQuantity(0, resource.DecimalSI),
+		}},
+	}
+}
@@ -14,6 +14,7 @@ limitations under the License.
 package provider
 
 import (
+	"fmt"
 	"sync"
 
 	"k8s.io/apimachinery/pkg/labels"
@@ -42,6 +43,10 @@ type externalSeriesRegistry struct {
 	metrics []provider.ExternalMetricInfo
 	// metricsInfo is a lookup from a metric to SeriesConverter for the sake of generating queries
 	metricsInfo map[string]seriesInfo
+	// ambiguous maps the metrics served by several rules to the indexes of these rules
+	ambiguous map[string][]int
+	// strict fails the queries of the ambiguous metrics instead of using their first rule
+	strict bool
 }
 
 type seriesInfo struct {
@@ -50,13 +55,19 @@ type seriesInfo struct {
 
 	// namer is the MetricNamer used to name this series
 	namer naming.MetricNamer
+
+	// rule is the index of the rule of the namer in the config
+	rule int
 }
 
 // NewExternalSeriesRegistry creates an ExternalSeriesRegistry driven by the data from the provided MetricLister.
-func NewExternalSeriesRegistry(lister MetricListerWithNotification) ExternalSeriesRegistry {
+// A metric which several rules name is served by the rule declared first, unless strict is set, in which
+// case its queries fail.
+func NewExternalSeriesRegistry(lister MetricListerWithNotification, strict bool) ExternalSeriesRegistry {
 	var registry = externalSeriesRegistry{
 		metrics:     make([]provider.ExternalMetricInfo, 0),
 		metricsInfo: map[string]seriesInfo{},
+		strict:      strict,
 	}
 
 	lister.AddNotificationReceiver(registry.filterAndStoreMetrics)
@@ -73,6 +84,7 @@ func (r *externalSeriesRegistry) filterAndStoreMetrics(result MetricUpdateResult
 	}
 	apiMetricsCache := make([]provider.ExternalMetricInfo, 0)
 	rawMetricsCache := make(map[string]seriesInfo)
+	ambiguous := make(map[string][]int)
 
 	for i, newSeries := range newSeriesSlices {
 		namer := namers[i]
@@ -85,12 +97,26 @@ func (r *externalSeriesRegistry) filterAndStoreMetrics(result MetricUpdateResult
 			}
 
 			name := identity
+			if served, found := rawMetricsCache[name]; found && served.rule != i {
+				// the namers are in the order of the rules, the first one keeps the metric
+				if len(ambiguous[name]) == 0 {
+					ambiguous[name] = []int{served.rule}
+				}
+				if rules := ambiguous[name]; rules[len(rules)-1] != i {
+					ambiguous[name] = append(rules, i)
+				}
+				continue
+			}
 			rawMetricsCache[name] = seriesInfo{
 				seriesName: series.Name,
 				namer:      namer,
+				rule:       i,
 			}
 		}
 	}
+	for name, rules := range ambiguous {
+		klog.V(2).Infof("external metric %q is named by the rules %v, the rule %d serves it", name, rules, rules[0])
+	}
 
 	for metricName := range rawMetricsCache {
 		apiMetricsCache = append(apiMetricsCache, provider.ExternalMetricInfo{
@@ -103,6 +129,7 @@ func (r *externalSeriesRegistry) filterAndStoreMetrics(result MetricUpdateResult
 
 	r.metrics = apiMetricsCache
 	r.metricsInfo = rawMetricsCache
+	r.ambiguous = ambiguous
 
 }
 
@@ -123,7 +150,23 @@ func (r *externalSeriesRegistry) QueryForMetric(namespace string, metricName str
 		klog.V(10).Infof("external metric %q not found", metricName)
 		return "", false, nil
 	}
+	if rules, ambiguous := r.ambiguous[metricName]; ambiguous && r.strict {
+		return "", true, &AmbiguousMetricError{Metric: metricName, Rules: rules}
+	}
+	klog.V(4).Infof("external metric %q served by the rule %d with series query %s", metricName, info.rule, info.namer.Selector())
 	query, err := info.namer.QueryForExternalSeries(info.seriesName, namespace, metricSelector)
 
 	return query, found, err
 }
+
+// AmbiguousMetricError is the error of the queries of a metric which several rules name, when their
+// precedence is strict.
+type AmbiguousMetricError struct {
+	Metric string
+	// Rules are the indexes of the rules of the rules section of the config
+	Rules []int
+}
+
+func (e *AmbiguousMetricError) Error() string {
+	return fmt.Sprintf("external metric %q is ambiguous, it is named by the rules %v", e.Metric, e.Rules)
+}
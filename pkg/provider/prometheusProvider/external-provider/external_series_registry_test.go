@@ -0,0 +1,87 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	fakeprom "sigs.k8s.io/prometheus-adapter/pkg/client/fake"
+	cfg "sigs.k8s.io/prometheus-adapter/pkg/config"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/naming"
+)
+
+// overlappingRegistry registers series named http_requests by two rules with different queries, and
+// series named queue_length by a single one.
+func overlappingRegistry(t *testing.T, strict bool) *externalSeriesRegistry {
+	rule := func(seriesQuery, matches, metricsQuery string) config.DiscoveryRule {
+		return config.DiscoveryRule{
+			DiscoveryRule: cfg.DiscoveryRule{
+				SeriesQuery:  seriesQuery,
+				Resources:    cfg.ResourceMapping{Template: "<<.Resource>>"},
+				Name:         cfg.NameMapping{Matches: matches, As: "${1}"},
+				MetricsQuery: metricsQuery,
+			},
+		}
+	}
+	rules := []config.DiscoveryRule{
+		rule(`{__name__="http_requests_total"}`, "^(http_requests)_.*$", "sum(rate(<<.Series>>[1m]))"),
+		rule(`{__name__=~"http_requests_.*|queue_length"}`, "^(http_requests|queue_length).*$", "max(<<.Series>>)"),
+	}
+	namers, err := naming.NamersFromConfig(rules, nil, nil)
+	require.NoError(t, err)
+
+	lister, _ := NewPeriodicMetricLister(&fakeLister{}, time.Minute)
+	r := NewExternalSeriesRegistry(lister, strict).(*externalSeriesRegistry)
+	r.filterAndStoreMetrics(MetricUpdateResult{
+		series: [][]prom.Series{
+			{{Name: "http_requests_total"}},
+			{{Name: "http_requests_count"}, {Name: "queue_length"}},
+		},
+		namers: namers,
+	})
+	return r
+}
+
+func TestQueryForMetricPrefersTheFirstRule(t *testing.T) {
+	r := overlappingRegistry(t, false)
+	require.Len(t, r.ListAllMetrics(), 2)
+
+	query, found, err := r.QueryForMetric("", "http_requests", labels.Everything())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, prom.Selector("sum(rate(http_requests_total[1m]))"), query)
+
+	query, found, err = r.QueryForMetric("", "queue_length", labels.Everything())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, prom.Selector("max(queue_length)"), query)
+}
+
+func TestQueryForMetricStrictRules(t *testing.T) {
+	r := overlappingRegistry(t, true)
+
+	_, found, err := r.QueryForMetric("", "http_requests", labels.Everything())
+	require.True(t, found)
+	require.Equal(t, &AmbiguousMetricError{Metric: "http_requests", Rules: []int{0, 1}}, err)
+
+	// the metrics of a single rule are served as usual
+	query, _, err := r.QueryForMetric("", "queue_length", labels.Everything())
+	require.NoError(t, err)
+	require.Equal(t, prom.Selector("max(queue_length)"), query)
+
+	p := &externalPrometheusProvider{
+		promClient:      &fakeprom.FakePrometheusClient{},
+		metricConverter: NewMetricConverter(nil),
+		seriesRegistry:  r,
+	}
+	_, err = p.GetExternalMetric(context.TODO(), "", labels.Everything(), provider.ExternalMetricInfo{Metric: "http_requests"})
+	require.True(t, apierr.IsInternalError(err))
+	require.Contains(t, err.Error(), `external metric "http_requests" is ambiguous, it is named by the rules [0 1]`)
+}
@@ -16,6 +16,7 @@ package provider
 import (
 	"errors"
 	"fmt"
+	"math"
 
 	"github.com/prometheus/common/model"
 
@@ -26,6 +27,8 @@ import (
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
 
 	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
 )
 
 // MetricConverter provides a unified interface for converting the results of
@@ -35,12 +38,15 @@ type MetricConverter interface {
 }
 
 type metricConverter struct {
+	// settings label the scalar results, see utils.MetricSettings
+	settings *utils.ExternalMetricSettings
 }
 
 // NewMetricConverter creates a MetricCoverter, capable of converting any of the three metric types
-// returned by the Prometheus client into external metrics types.
-func NewMetricConverter() MetricConverter {
-	return &metricConverter{}
+// returned by the Prometheus client into external metrics types. The scalar results are labeled with
+// the scalar labels of the settings of their metric.
+func NewMetricConverter(settings *utils.ExternalMetricSettings) MetricConverter {
+	return &metricConverter{settings: settings}
 }
 
 func (c *metricConverter) Convert(info provider.ExternalMetricInfo, queryResult prom.QueryResult) (*external_metrics.ExternalMetricValueList, error) {
@@ -56,6 +62,9 @@ func (c *metricConverter) Convert(info provider.ExternalMetricInfo, queryResult
 }
 
 func (c *metricConverter) convertSample(info provider.ExternalMetricInfo, sample *model.Sample) (*external_metrics.ExternalMetricValue, error) {
+	if math.IsNaN(float64(sample.Value)) {
+		return nil, fmt.Errorf("sample of series %s: %w", sample.Metric, utils.ErrNotANumber)
+	}
 	labels := c.convertLabels(sample.Metric)
 
 	singleMetric := external_metrics.ExternalMetricValue{
@@ -105,7 +114,7 @@ func (c *metricConverter) convertVector(info provider.ExternalMetricInfo, queryR
 		singleMetric, err := c.convertSample(info, val)
 
 		if err != nil {
-			return nil, fmt.Errorf("unable to convert vector: %v", err)
+			return nil, fmt.Errorf("unable to convert vector: %w", err)
 		}
 
 		items = append(items, *singleMetric)
@@ -127,6 +136,9 @@ func (c *metricConverter) convertScalar(info provider.ExternalMetricInfo, queryR
 	if toConvert == nil {
 		return nil, errors.New("the provided input did not contain scalar query results")
 	}
+	if math.IsNaN(float64(toConvert.Value)) {
+		return nil, fmt.Errorf("scalar: %w", utils.ErrNotANumber)
+	}
 
 	result := external_metrics.ExternalMetricValueList{
 		Items: []external_metrics.ExternalMetricValue{
@@ -136,8 +148,23 @@ func (c *metricConverter) convertScalar(info provider.ExternalMetricInfo, queryR
 					toConvert.Timestamp.Time(),
 				},
 				Value: *resource.NewMilliQuantity(int64(toConvert.Value*1000.0), resource.DecimalSI),
+				// a scalar has no labels, unless the metric is configured with some
+				MetricLabels: c.scalarLabels(info.Metric),
 			},
 		},
 	}
 	return &result, nil
 }
+
+// scalarLabels returns a copy of the scalar labels of the metric, nil if they aren't configured.
+func (c *metricConverter) scalarLabels(metric string) map[string]string {
+	labels := c.settings.Of(metric).ScalarLabels
+	if labels == nil {
+		return nil
+	}
+	res := make(map[string]string, len(labels))
+	for k, v := range labels {
+		res[k] = v
+	}
+	return res
+}
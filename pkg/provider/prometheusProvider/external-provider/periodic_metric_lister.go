@@ -22,6 +22,8 @@ import (
 
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
 )
 
 type periodicMetricLister struct {
@@ -29,6 +31,8 @@ type periodicMetricLister struct {
 	updateInterval   time.Duration
 	mostRecentResult MetricUpdateResult
 	callbacks        []MetricUpdateCallback
+	// relists tells when to relist next
+	relists *utils.RelistScheduler
 }
 
 // NewPeriodicMetricLister creates a MetricLister that periodically pulls the list of available metrics
@@ -38,6 +42,7 @@ func NewPeriodicMetricLister(realLister MetricLister, updateInterval time.Durati
 		updateInterval: updateInterval,
 		realLister:     realLister,
 		callbacks:      make([]MetricUpdateCallback, 0),
+		relists:        utils.NewRelistScheduler("external", updateInterval),
 	}
 
 	return &lister, &lister
@@ -51,16 +56,32 @@ func (l *periodicMetricLister) ListAllMetrics() (MetricUpdateResult, error) {
 	return l.mostRecentResult, nil
 }
 
+// UseSnapshot lists the metrics of the snapshot until the first relist, which saves its series to it.
+// It tells whether the snapshot had series.
+func (l *periodicMetricLister) UseSnapshot(snapshot *utils.SeriesSnapshot) bool {
+	lister, ok := l.realLister.(snapshotLister)
+	if !ok {
+		return false
+	}
+	result, loaded := lister.useSnapshot(snapshot)
+	if loaded {
+		l.mostRecentResult = result
+		l.relists.Observe(result.series)
+		l.notifyListeners()
+	}
+	return loaded
+}
+
 func (l *periodicMetricLister) Run() {
 	l.RunUntil(wait.NeverStop)
 }
 
 func (l *periodicMetricLister) RunUntil(stopChan <-chan struct{}) {
-	go wait.Until(func() {
+	utils.RunRelists(func() {
 		if err := l.updateMetrics(); err != nil {
 			utilruntime.HandleError(err)
 		}
-	}, l.updateInterval, stopChan)
+	}, l.relists, false, stopChan)
 }
 
 func (l *periodicMetricLister) updateMetrics() error {
@@ -72,6 +93,7 @@ func (l *periodicMetricLister) updateMetrics() error {
 
 	//Cache the result.
 	l.mostRecentResult = result
+	l.relists.Observe(result.series)
 	klog.Infof("periodic fetch metrics from prometheus %v for external metrics", result)
 	//Let our listeners know we've got new data ready for them.
 	l.notifyListeners()
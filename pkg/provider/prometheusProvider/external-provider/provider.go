@@ -15,9 +15,11 @@ package provider
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
 	pmodel "github.com/prometheus/common/model"
 
 	apierr "k8s.io/apimachinery/pkg/api/errors"
@@ -37,11 +39,20 @@ type externalPrometheusProvider struct {
 	metricConverter MetricConverter
 
 	seriesRegistry ExternalSeriesRegistry
+
+	emptyResultPolicy EmptyResultPolicy
+	lastResults       lastResults
+	settings          *utils.ExternalMetricSettings
 }
 
 func (p *externalPrometheusProvider) GetExternalMetric(ctx context.Context, namespace string, metricSelector labels.Selector, info provider.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
 	selector, found, err := p.seriesRegistry.QueryForMetric(namespace, info.Metric, metricSelector)
 
+	var ambiguous *AmbiguousMetricError
+	if errors.As(err, &ambiguous) {
+		// the config has to be fixed, which the message tells how
+		return nil, apierr.NewInternalError(ambiguous)
+	}
 	if err != nil {
 		klog.Errorf("unable to generate a query for the metric: %v", err)
 		return nil, apierr.NewInternalError(fmt.Errorf("unable to fetch metrics"))
@@ -53,14 +64,141 @@ func (p *externalPrometheusProvider) GetExternalMetric(ctx context.Context, name
 
 	klog.V(4).Infof("External metrics: %s query: %s", info.Metric, selector)
 	// Here is where we're making the query, need to be before here xD
-	queryResults, err := p.promClient.Query(ctx, pmodel.Now(), selector)
+	queryTime := pmodel.Now()
+	if at, ok := utils.EvaluationTime(ctx); ok {
+		queryTime = pmodel.TimeFromUnixNano(at.UnixNano())
+	}
+	queryResults, err := p.query(ctx, info.Metric, queryTime, selector)
 
 	if err != nil {
 		klog.Errorf("unable to fetch metrics from prometheus: %v", err)
-		// don't leak implementation details to the user
-		return nil, apierr.NewInternalError(fmt.Errorf("unable to fetch metrics"))
+		// don't leak implementation details to the user, only the reason of the failure
+		return nil, utils.PrometheusQueryError(err)
+	}
+
+	queryResults = sampleVector(info.Metric, p.settings.Of(info.Metric).Sampling, queryResults)
+	values, err := p.metricConverter.Convert(info, queryResults)
+	if errors.Is(err, utils.ErrNotANumber) {
+		// the manager reports the metric as unavailable
+		return nil, err
+	}
+	if err != nil {
+		klog.Errorf("unable to convert the results of query %s: %v", selector, err)
+		return nil, utils.UnexpectedPrometheusResultError(queryResults.Type)
+	}
+	utils.SetQueryLabel(values.Items, string(selector))
+	_, historical := utils.EvaluationTime(ctx)
+	if len(values.Items) == 0 {
+		return p.emptyResult(info, selector, queryTime, historical)
+	}
+	if p.emptyResultPolicy == EmptyResultLastCached && !historical {
+		p.lastResults.set(lastResultKey(info, selector), values)
+	}
+	return values, nil
+}
+
+// query runs an instant query at the query time, or a range query over the window before it which
+// is reduced to an instant vector if the metric has a range aggregation.
+func (p *externalPrometheusProvider) query(ctx context.Context, metric string, queryTime pmodel.Time, selector prom.Selector) (prom.QueryResult, error) {
+	aggregation := p.settings.Of(metric).RangeAggregation
+	if aggregation == nil {
+		return p.promClient.Query(ctx, queryTime, selector)
+	}
+	r := prom.Range{Start: queryTime.Add(-aggregation.Window), End: queryTime, Step: aggregation.ResolutionStep()}
+	res, err := p.promClient.QueryRange(ctx, r, selector)
+	if err != nil || res.Type != pmodel.ValMatrix || res.Matrix == nil {
+		// the converter rejects the unexpected results
+		return res, err
+	}
+	return reduceMatrix(*res.Matrix, *aggregation), nil
+}
+
+// sampleVector estimates the total of the series of a vector from a sample of them if the metric has a sampling:
+// the sum of the values of the series kept is scaled up by how many series there are per series kept, and returned
+// as a single value, with the labels shared by all the series. The sampled series aren't returned on their own,
+// because their values aren't estimates of anything. The vector is returned whole if none of its series would be kept.
+func sampleVector(metric string, sampling *utils.Sampling, res prom.QueryResult) prom.QueryResult {
+	if sampling == nil || res.Type != pmodel.ValVector || res.Vector == nil || !sampling.Applies(len(*res.Vector)) {
+		return res
+	}
+	var (
+		kept      int
+		sum       pmodel.SampleValue
+		timestamp pmodel.Time
+		shared    pmodel.Metric
+	)
+	for _, s := range *res.Vector {
+		if s == nil {
+			continue
+		}
+		shared = sharedLabels(shared, s.Metric)
+		if !sampling.Keeps(uint64(s.Metric.Fingerprint())) {
+			continue
+		}
+		kept++
+		sum += s.Value
+		if s.Timestamp.After(timestamp) {
+			timestamp = s.Timestamp
+		}
+	}
+	if kept == 0 {
+		return res
+	}
+	estimate := pmodel.Vector{{
+		Metric:    shared,
+		Value:     sum * pmodel.SampleValue(len(*res.Vector)) / pmodel.SampleValue(kept),
+		Timestamp: timestamp,
+	}}
+	klog.V(4).Infof("External metrics: %s query returned %d series, estimated their total from %d of them", metric, len(*res.Vector), kept)
+	return prom.QueryResult{Type: pmodel.ValVector, Vector: &estimate}
+}
+
+// sharedLabels returns the labels of shared which the series has too, those of the series if shared is nil.
+func sharedLabels(shared, series pmodel.Metric) pmodel.Metric {
+	if shared == nil {
+		return series.Clone()
+	}
+	for name, value := range shared {
+		if series[name] != value {
+			delete(shared, name)
+		}
 	}
-	return p.metricConverter.Convert(info, queryResults)
+	return shared
+}
+
+// reduceMatrix reduces the samples of each series to a single one at the time of its latest sample.
+func reduceMatrix(matrix pmodel.Matrix, aggregation utils.RangeAggregation) prom.QueryResult {
+	vector := make(pmodel.Vector, 0, len(matrix))
+	for _, stream := range matrix {
+		if stream == nil || len(stream.Values) == 0 {
+			continue
+		}
+		values := make([]float64, len(stream.Values))
+		for i, sample := range stream.Values {
+			values[i] = float64(sample.Value)
+		}
+		vector = append(vector, &pmodel.Sample{
+			Metric:    stream.Metric,
+			Value:     pmodel.SampleValue(aggregation.Reduce(values)),
+			Timestamp: stream.Values[len(stream.Values)-1].Timestamp,
+		})
+	}
+	return prom.QueryResult{Type: pmodel.ValVector, Vector: &vector}
+}
+
+// emptyResult answers a query which succeeded without any series according to the empty result policy.
+// The last values are only used for the current values, not for the ones at a past evaluation time.
+func (p *externalPrometheusProvider) emptyResult(info provider.ExternalMetricInfo, selector prom.Selector, queryTime pmodel.Time, historical bool) (*external_metrics.ExternalMetricValueList, error) {
+	switch p.emptyResultPolicy {
+	case EmptyResultZero:
+		return zeroResult(info, queryTime.Time()), nil
+	case EmptyResultLastCached:
+		if values, found := p.lastResults.get(lastResultKey(info, selector)); found && !historical {
+			klog.V(4).Infof("External metrics: %s query returned no series, returning its last values", info.Metric)
+			return values, nil
+		}
+	}
+	return nil, utils.NoSeriesMatchedError(info.Metric)
 }
 
 func (p *externalPrometheusProvider) ListAllExternalMetrics() []provider.ExternalMetricInfo {
@@ -78,15 +216,21 @@ func (p *externalPrometheusProvider) selectGroupResource(namespace string) schem
 	}
 }
 
-// NewExternalPrometheusProvider creates an ExternalMetricsProvider capable of responding to Kubernetes requests for external metric data
-func NewExternalPrometheusProvider(promClient prom.Client, namers []naming.MetricNamer, updateInterval time.Duration, maxAge time.Duration) (provider.ExternalMetricsProvider, Runnable) {
-	metricConverter := NewMetricConverter()
+// NewExternalPrometheusProvider creates an ExternalMetricsProvider capable of responding to Kubernetes requests for external metric data.
+// The queries which succeed without any series are answered according to emptyResultPolicy, and the metrics
+// which several rules name fail if strictRules is set, instead of being served by the rule declared first.
+// The queries apply the settings of their metric.
+func NewExternalPrometheusProvider(promClient prom.Client, namers []naming.MetricNamer, updateInterval time.Duration, maxAge time.Duration, emptyResultPolicy EmptyResultPolicy, strictRules bool, settings *utils.ExternalMetricSettings) (provider.ExternalMetricsProvider, Runnable) {
+	metricConverter := NewMetricConverter(settings)
 	basicLister := NewBasicMetricLister(promClient, namers, maxAge)
 	periodicLister, _ := NewPeriodicMetricLister(basicLister, updateInterval)
-	seriesRegistry := NewExternalSeriesRegistry(periodicLister)
+	seriesRegistry := NewExternalSeriesRegistry(periodicLister, strictRules)
 	return &externalPrometheusProvider{
 		promClient:      promClient,
 		seriesRegistry:  seriesRegistry,
 		metricConverter: metricConverter,
+
+		emptyResultPolicy: emptyResultPolicy,
+		settings:          settings,
 	}, periodicLister
 }
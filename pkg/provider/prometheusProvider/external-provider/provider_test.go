@@ -0,0 +1,353 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	fakeprom "sigs.k8s.io/prometheus-adapter/pkg/client/fake"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+)
+
+const fakeQuery = prom.Selector("sum(http_requests_total)")
+
+type fakeSeriesRegistry struct{}
+
+func (r *fakeSeriesRegistry) ListAllMetrics() []provider.ExternalMetricInfo {
+	return []provider.ExternalMetricInfo{{Metric: "http_requests"}}
+}
+
+func (r *fakeSeriesRegistry) QueryForMetric(namespace string, metricName string, metricSelector labels.Selector) (prom.Selector, bool, error) {
+	return fakeQuery, metricName == "http_requests", nil
+}
+
+func newFakeExternalProvider(promClient prom.Client) *externalPrometheusProvider {
+	return &externalPrometheusProvider{
+		promClient:      promClient,
+		metricConverter: NewMetricConverter(nil),
+		seriesRegistry:  &fakeSeriesRegistry{},
+	}
+}
+
+// setMetricSettings makes the provider apply the settings to the queries of the metric.
+func (p *externalPrometheusProvider) setMetricSettings(metric string, settings utils.MetricSettings) {
+	p.settings = &utils.ExternalMetricSettings{Metrics: map[string]utils.MetricSettings{metric: settings}}
+	p.metricConverter = NewMetricConverter(p.settings)
+}
+
+func TestGetExternalMetricErrorReasons(t *testing.T) {
+	fakeProm := &fakeprom.FakePrometheusClient{
+		AcceptableInterval: pmodel.Interval{Start: 0, End: pmodel.Latest},
+	}
+	p := newFakeExternalProvider(fakeProm)
+	info := provider.ExternalMetricInfo{Metric: "http_requests"}
+
+	// the query succeeds without any series
+	_, err := p.GetExternalMetric(context.TODO(), "default", labels.Everything(), info)
+	require.True(t, apierr.IsNotFound(err))
+	require.Equal(t, "no series matched for metric http_requests", err.Error())
+
+	fakeProm.ErrQueries = map[prom.Selector]error{
+		fakeQuery: &prom.Error{Type: prom.ErrTimeout, Msg: "query timed out in expression evaluation"},
+	}
+	_, err = p.GetExternalMetric(context.TODO(), "default", labels.Everything(), info)
+	require.True(t, apierr.IsTimeout(err))
+	require.Equal(t, "prometheus query timeout", err.Error())
+
+	fakeProm.ErrQueries[fakeQuery] = &prom.Error{Type: prom.ErrExec, Msg: "query processing would load too many samples"}
+	_, err = p.GetExternalMetric(context.TODO(), "default", labels.Everything(), info)
+	require.True(t, apierr.IsInternalError(err))
+	require.Equal(t, "prometheus failed to execute the query", err.Error())
+
+	delete(fakeProm.ErrQueries, fakeQuery)
+	fakeProm.QueryResults = map[prom.Selector]prom.QueryResult{
+		fakeQuery: {Type: pmodel.ValMatrix, Matrix: &pmodel.Matrix{}},
+	}
+	_, err = p.GetExternalMetric(context.TODO(), "default", labels.Everything(), info)
+	require.True(t, apierr.IsInternalError(err))
+	require.Equal(t, "unexpected response from prometheus: result of type matrix", err.Error())
+}
+
+func TestGetExternalMetricValues(t *testing.T) {
+	fakeProm := &fakeprom.FakePrometheusClient{
+		AcceptableInterval: pmodel.Interval{Start: 0, End: pmodel.Latest},
+		QueryResults: map[prom.Selector]prom.QueryResult{
+			fakeQuery: {Type: pmodel.ValVector, Vector: &pmodel.Vector{{Value: 42}}},
+		},
+	}
+	p := newFakeExternalProvider(fakeProm)
+
+	values, err := p.GetExternalMetric(context.TODO(), "default", labels.Everything(), provider.ExternalMetricInfo{Metric: "http_requests"})
+	require.NoError(t, err)
+	require.Len(t, values.Items, 1)
+	require.Equal(t, int64(42), values.Items[0].Value.Value())
+}
+
+func TestGetExternalMetricScalar(t *testing.T) {
+	fakeProm := &fakeprom.FakePrometheusClient{
+		AcceptableInterval: pmodel.Interval{Start: 0, End: pmodel.Latest},
+		QueryResults: map[prom.Selector]prom.QueryResult{
+			fakeQuery: {Type: pmodel.ValScalar, Scalar: &pmodel.Scalar{Value: 42, Timestamp: 1620000000000}},
+		},
+	}
+	p := newFakeExternalProvider(fakeProm)
+	info := provider.ExternalMetricInfo{Metric: "http_requests"}
+
+	values, err := p.GetExternalMetric(context.TODO(), "default", labels.Everything(), info)
+	require.NoError(t, err)
+	require.Len(t, values.Items, 1)
+	require.Equal(t, int64(42), values.Items[0].Value.Value())
+	require.Equal(t, int64(1620000000), values.Items[0].Timestamp.Unix())
+	require.Empty(t, values.Items[0].MetricLabels)
+
+	// the configured labels of the metric
+	p.setMetricSettings("http_requests", utils.MetricSettings{ScalarLabels: map[string]string{"service": "checkout"}})
+	values, err = p.GetExternalMetric(context.TODO(), "default", labels.Everything(), info)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"service": "checkout"}, values.Items[0].MetricLabels)
+}
+
+func TestGetExternalMetricQueryLabel(t *testing.T) {
+	fakeProm := &fakeprom.FakePrometheusClient{
+		AcceptableInterval: pmodel.Interval{Start: 0, End: pmodel.Latest},
+		QueryResults: map[prom.Selector]prom.QueryResult{
+			fakeQuery: {Type: pmodel.ValVector, Vector: &pmodel.Vector{{Metric: pmodel.Metric{"service": "checkout"}, Value: 42}}},
+		},
+	}
+	p := newFakeExternalProvider(fakeProm)
+	info := provider.ExternalMetricInfo{Metric: "http_requests"}
+
+	values, err := p.GetExternalMetric(context.TODO(), "default", labels.Everything(), info)
+	require.NoError(t, err)
+	require.NotContains(t, values.Items[0].MetricLabels, utils.QueryLabel)
+
+	utils.SetExposeQuery(true)
+	defer utils.SetExposeQuery(false)
+	values, err = p.GetExternalMetric(context.TODO(), "default", labels.Everything(), info)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"service": "checkout", utils.QueryLabel: string(fakeQuery)}, values.Items[0].MetricLabels)
+}
+
+func TestGetExternalMetricAtEvaluationTime(t *testing.T) {
+	at := time.Now().Add(-time.Hour)
+	queryTime := pmodel.TimeFromUnixNano(at.UnixNano())
+	// the fake only accepts queries at the evaluation time
+	fakeProm := &fakeprom.FakePrometheusClient{
+		AcceptableInterval: pmodel.Interval{Start: queryTime, End: queryTime},
+		QueryResults: map[prom.Selector]prom.QueryResult{
+			fakeQuery: {Type: pmodel.ValVector, Vector: &pmodel.Vector{{Value: 42}}},
+		},
+	}
+	p := newFakeExternalProvider(fakeProm)
+	info := provider.ExternalMetricInfo{Metric: "http_requests"}
+
+	values, err := p.GetExternalMetric(utils.WithEvaluationTime(context.TODO(), at), "default", labels.Everything(), info)
+	require.NoError(t, err)
+	require.Equal(t, int64(42), values.Items[0].Value.Value())
+
+	_, err = p.GetExternalMetric(context.TODO(), "default", labels.Everything(), info)
+	require.Error(t, err)
+}
+
+func TestGetExternalMetricEmptyResultPolicies(t *testing.T) {
+	info := provider.ExternalMetricInfo{Metric: "http_requests"}
+	vector := func(values ...pmodel.SampleValue) map[prom.Selector]prom.QueryResult {
+		samples := pmodel.Vector{}
+		for _, value := range values {
+			samples = append(samples, &pmodel.Sample{Value: value})
+		}
+		return map[prom.Selector]prom.QueryResult{fakeQuery: {Type: pmodel.ValVector, Vector: &samples}}
+	}
+
+	for _, policy := range EmptyResultPolicies {
+		fakeProm := &fakeprom.FakePrometheusClient{
+			AcceptableInterval: pmodel.Interval{Start: 0, End: pmodel.Latest},
+			QueryResults:       vector(42),
+		}
+		p := newFakeExternalProvider(fakeProm)
+		p.emptyResultPolicy = policy
+
+		values, err := p.GetExternalMetric(context.TODO(), "default", labels.Everything(), info)
+		require.NoError(t, err, policy)
+		require.Equal(t, int64(42), values.Items[0].Value.Value(), policy)
+
+		// the query succeeds without any series
+		fakeProm.QueryResults = vector()
+		values, err = p.GetExternalMetric(context.TODO(), "default", labels.Everything(), info)
+		switch policy {
+		case EmptyResultNotFound:
+			require.True(t, apierr.IsNotFound(err), policy)
+		case EmptyResultZero:
+			require.NoError(t, err, policy)
+			require.Len(t, values.Items, 1, policy)
+			require.Equal(t, "http_requests", values.Items[0].MetricName, policy)
+			require.True(t, values.Items[0].Value.IsZero(), policy)
+		case EmptyResultLastCached:
+			require.NoError(t, err, policy)
+			require.Len(t, values.Items, 1, policy)
+			require.Equal(t, int64(42), values.Items[0].Value.Value(), policy)
+		}
+
+		// a failed query is a server error whatever the policy, so the last values aren't returned either
+		fakeProm.ErrQueries = map[prom.Selector]error{
+			fakeQuery: &prom.Error{Type: prom.ErrBadResponse, Msg: "unknown response code 502"},
+		}
+		_, err = p.GetExternalMetric(context.TODO(), "default", labels.Everything(), info)
+		require.Error(t, err, policy)
+		require.False(t, apierr.IsNotFound(err), policy)
+		require.Equal(t, int32(http.StatusBadGateway), err.(apierr.APIStatus).Status().Code, policy)
+	}
+}
+
+func TestGetExternalMetricLastCachedWithoutValues(t *testing.T) {
+	fakeProm := &fakeprom.FakePrometheusClient{
+		AcceptableInterval: pmodel.Interval{Start: 0, End: pmodel.Latest},
+		QueryResults: map[prom.Selector]prom.QueryResult{
+			fakeQuery: {Type: pmodel.ValVector, Vector: &pmodel.Vector{}},
+		},
+	}
+	p := newFakeExternalProvider(fakeProm)
+	p.emptyResultPolicy = EmptyResultLastCached
+
+	// the query never returned any values to fall back to
+	_, err := p.GetExternalMetric(context.TODO(), "default", labels.Everything(), provider.ExternalMetricInfo{Metric: "http_requests"})
+	require.True(t, apierr.IsNotFound(err))
+}
+
+// rangePrometheusClient records the range queries and answers them with a matrix.
+type rangePrometheusClient struct {
+	*fakeprom.FakePrometheusClient
+	ranges []prom.Range
+	matrix pmodel.Matrix
+}
+
+func (c *rangePrometheusClient) QueryRange(_ context.Context, r prom.Range, query prom.Selector) (prom.QueryResult, error) {
+	c.ranges = append(c.ranges, r)
+	return prom.QueryResult{Type: pmodel.ValMatrix, Matrix: &c.matrix}, nil
+}
+
+func TestGetExternalMetricRangeAggregation(t *testing.T) {
+	at := time.Unix(1620000600, 0)
+	queryTime := pmodel.TimeFromUnixNano(at.UnixNano())
+	fakeProm := &rangePrometheusClient{
+		// an instant query would return no series
+		FakePrometheusClient: &fakeprom.FakePrometheusClient{AcceptableInterval: pmodel.Interval{Start: 0, End: pmodel.Latest}},
+		matrix: pmodel.Matrix{
+			{
+				Metric: pmodel.Metric{"service": "checkout"},
+				Values: []pmodel.SamplePair{{Timestamp: queryTime.Add(-2 * time.Minute), Value: 10}, {Timestamp: queryTime.Add(-time.Minute), Value: 40}, {Timestamp: queryTime, Value: 10}},
+			},
+			{
+				Metric: pmodel.Metric{"service": "cart"},
+				Values: []pmodel.SamplePair{{Timestamp: queryTime, Value: 3}},
+			},
+			{Metric: pmodel.Metric{"service": "empty"}},
+		},
+	}
+	p := newFakeExternalProvider(fakeProm)
+	info := provider.ExternalMetricInfo{Metric: "http_requests"}
+
+	for operator, expected := range map[string]int64{utils.RangeAggregationAvg: 20, utils.RangeAggregationMax: 40} {
+		fakeProm.ranges = nil
+		p.setMetricSettings("http_requests", utils.MetricSettings{
+			RangeAggregation: &utils.RangeAggregation{Window: 5 * time.Minute, Operator: operator},
+		})
+
+		values, err := p.GetExternalMetric(utils.WithEvaluationTime(context.TODO(), at), "default", labels.Everything(), info)
+		require.NoError(t, err, operator)
+		require.Equal(t, []prom.Range{{Start: queryTime.Add(-5 * time.Minute), End: queryTime, Step: 30 * time.Second}}, fakeProm.ranges, operator)
+		// the series without samples is dropped
+		require.Len(t, values.Items, 2, operator)
+		require.Equal(t, "checkout", values.Items[0].MetricLabels["service"], operator)
+		require.Equal(t, expected, values.Items[0].Value.Value(), operator)
+		require.Equal(t, at, values.Items[0].Timestamp.Time, operator)
+		require.Equal(t, int64(3), values.Items[1].Value.Value(), operator)
+	}
+
+	// the other metrics keep being queried at an instant
+	fakeProm.ranges = nil
+	_, err := p.GetExternalMetric(context.TODO(), "default", labels.Everything(), provider.ExternalMetricInfo{Metric: "queue_length"})
+	require.True(t, apierr.IsNotFound(err))
+	require.Empty(t, fakeProm.ranges)
+}
+
+type vectorPrometheusClient struct {
+	*fakeprom.FakePrometheusClient
+	vector pmodel.Vector
+}
+
+func (c *vectorPrometheusClient) Query(_ context.Context, t pmodel.Time, query prom.Selector) (prom.QueryResult, error) {
+	return prom.QueryResult{Type: pmodel.ValVector, Vector: &c.vector}, nil
+}
+
+func TestGetExternalMetricSampling(t *testing.T) {
+	fakeProm := &vectorPrometheusClient{FakePrometheusClient: &fakeprom.FakePrometheusClient{}}
+	for i := 0; i < 1000; i++ {
+		fakeProm.vector = append(fakeProm.vector, &pmodel.Sample{Metric: pmodel.Metric{"app": "web", "pod": pmodel.LabelValue(fmt.Sprintf("web-%d", i))}, Value: 2})
+	}
+	p := newFakeExternalProvider(fakeProm)
+	info := provider.ExternalMetricInfo{Metric: "http_requests"}
+
+	values, err := p.GetExternalMetric(context.TODO(), "default", labels.Everything(), info)
+	require.NoError(t, err)
+	require.Len(t, values.Items, 1000)
+
+	p.setMetricSettings("http_requests", utils.MetricSettings{Sampling: &utils.Sampling{Ratio: 0.1}})
+	values, err = p.GetExternalMetric(context.TODO(), "default", labels.Everything(), info)
+	require.NoError(t, err)
+	// the total of all the series is estimated from the sample, as a single value with their shared labels
+	require.Len(t, values.Items, 1)
+	require.InDelta(t, 2000, values.Items[0].Value.AsApproximateFloat64(), 1)
+	require.Equal(t, "web", values.Items[0].MetricLabels["app"])
+	require.NotContains(t, values.Items[0].MetricLabels, "pod")
+
+	// a result of at most minSeries series is returned whole
+	p.setMetricSettings("http_requests", utils.MetricSettings{Sampling: &utils.Sampling{Ratio: 0.1, MinSeries: 1000}})
+	values, err = p.GetExternalMetric(context.TODO(), "default", labels.Everything(), info)
+	require.NoError(t, err)
+	require.Len(t, values.Items, 1000)
+	require.Equal(t, int64(2), values.Items[0].Value.Value())
+}
+
+func TestSampleVectorEstimate(t *testing.T) {
+	sampling := &utils.Sampling{Ratio: 0.5}
+	vector := pmodel.Vector{}
+	kept, sum := 0, 0.0
+	for i := 0; i < 100; i++ {
+		metric := pmodel.Metric{"pod": pmodel.LabelValue(fmt.Sprintf("web-%d", i))}
+		vector = append(vector, &pmodel.Sample{Metric: metric, Value: pmodel.SampleValue(i)})
+		if sampling.Keeps(uint64(metric.Fingerprint())) {
+			kept++
+			sum += float64(i)
+		}
+	}
+
+	res := sampleVector("http_requests", sampling, prom.QueryResult{Type: pmodel.ValVector, Vector: &vector})
+	require.Len(t, *res.Vector, 1)
+	estimate := (*res.Vector)[0]
+	// the sum of the sampled series scaled by the share kept, without the labels they don't share
+	require.InDelta(t, sum*100/float64(kept), float64(estimate.Value), 1e-9)
+	require.Empty(t, estimate.Metric)
+}
+
+func TestParseEmptyResultPolicy(t *testing.T) {
+	policy, err := ParseEmptyResultPolicy("")
+	require.NoError(t, err)
+	require.Equal(t, EmptyResultNotFound, policy)
+
+	policy, err = ParseEmptyResultPolicy("LastCached")
+	require.NoError(t, err)
+	require.Equal(t, EmptyResultLastCached, policy)
+
+	_, err = ParseEmptyResultPolicy("zero")
+	require.Error(t, err)
+}
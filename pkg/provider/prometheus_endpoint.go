@@ -0,0 +1,46 @@
+package provider
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+// PrometheusEndpointLabel of a selector sends the Prometheus queries of the request to one of the
+// endpoints allowed by --prometheus-endpoint-overrides instead of --prometheus-url, e.g.
+// prometheus_endpoint=canary. It's removed from the selector before the request reaches a backend.
+const PrometheusEndpointLabel = "prometheus_endpoint"
+
+// stripPrometheusEndpointLabel removes the endpoint label from the selector, and returns the endpoint it asked for,
+// which must be one of the allowed ones. Without allowed endpoints the label is left alone, as a matcher of the series.
+func stripPrometheusEndpointLabel(metricSelector labels.Selector, allowed map[string]bool) (labels.Selector, string, error) {
+	if len(allowed) == 0 {
+		return metricSelector, "", nil
+	}
+	requirements, selectable := metricSelector.Requirements()
+	if !selectable {
+		return metricSelector, "", nil
+	}
+
+	endpoint := ""
+	stripped := labels.NewSelector()
+	for _, r := range requirements {
+		if r.Key() != PrometheusEndpointLabel {
+			stripped = stripped.Add(r)
+			continue
+		}
+		values := r.Values().List()
+		if (r.Operator() != selection.Equals && r.Operator() != selection.DoubleEquals) || len(values) != 1 {
+			return nil, "", fmt.Errorf("the %s label must select a single endpoint, e.g. %s=canary", PrometheusEndpointLabel, PrometheusEndpointLabel)
+		}
+		if !allowed[values[0]] {
+			return nil, "", fmt.Errorf("prometheus endpoint %q isn't allowed by --prometheus-endpoint-overrides", values[0])
+		}
+		endpoint = values[0]
+	}
+	if endpoint == "" {
+		return metricSelector, "", nil
+	}
+	return stripped, endpoint, nil
+}
@@ -0,0 +1,62 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+func TestStripPrometheusEndpointLabel(t *testing.T) {
+	allowed := map[string]bool{"canary": true}
+	for _, c := range []struct {
+		selector string
+		allowed  map[string]bool
+		stripped string
+		endpoint string
+		invalid  bool
+	}{
+		{selector: "app=web,prometheus_endpoint=canary", allowed: allowed, stripped: "app=web", endpoint: "canary"},
+		{selector: "app=web", allowed: allowed, stripped: "app=web"},
+		{selector: "app=web,prometheus_endpoint=staging", allowed: allowed, invalid: true},
+		{selector: "app=web,prometheus_endpoint in (canary,staging)", allowed: allowed, invalid: true},
+		// without allowed endpoints the label is an ordinary matcher
+		{selector: "app=web,prometheus_endpoint=canary", stripped: "app=web,prometheus_endpoint=canary"},
+	} {
+		metricSelector, err := labels.Parse(c.selector)
+		if err != nil {
+			t.Fatalf("Failed to parse selector, because of %v", err)
+		}
+		stripped, endpoint, err := stripPrometheusEndpointLabel(metricSelector, c.allowed)
+		if c.invalid {
+			if err == nil {
+				t.Errorf("expected %s to be rejected", c.selector)
+			}
+			continue
+		}
+		if err != nil || stripped.String() != c.stripped || endpoint != c.endpoint {
+			t.Errorf("expected %s to select %s of endpoint %q, got %v of endpoint %q (%v)", c.selector, c.stripped, c.endpoint, stripped, endpoint, err)
+		}
+	}
+}
+
+func TestPrometheusEndpointOverride(t *testing.T) {
+	pm, backend, _ := newCachingManager(time.Minute)
+	pm.prometheusEndpoints = map[string]bool{"canary": true}
+
+	getMetric(t, pm, "slb.instance.id=lb-1")
+	if value := getMetric(t, pm, "slb.instance.id=lb-1,prometheus_endpoint=canary"); value != 2 || backend.calls != 2 {
+		t.Errorf("expected the values of the default endpoint not to be served to the override, got value %d after %d calls", value, backend.calls)
+	}
+	if backend.selectors[1] != "slb.instance.id=lb-1" {
+		t.Errorf("expected the endpoint label to be stripped, got %s", backend.selectors[1])
+	}
+
+	metricSelector, _ := labels.Parse("slb.instance.id=lb-1,prometheus_endpoint=staging")
+	if _, err := pm.GetExternalMetric(context.TODO(), "default", metricSelector, p.ExternalMetricInfo{Metric: "slb_l7_qps"}); !apierr.IsBadRequest(err) {
+		t.Errorf("expected an endpoint which isn't allowed to be rejected, got %v", err)
+	}
+}
@@ -2,19 +2,35 @@ package provider
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/audit"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/metrics"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/metrics/cms"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/metrics/kube"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/naming"
 	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/options"
 	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/provider/alibabaCloudProvider"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/provider/mockProvider"
 	prometheusCustomMetricsProvider "github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/provider/prometheusProvider/custom-provider"
 	prometheusExternalMetricsProvider "github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/provider/prometheusProvider/external-provider"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	pmodel "github.com/prometheus/common/model"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/klog/v2"
 	"k8s.io/metrics/pkg/apis/custom_metrics"
 	"k8s.io/metrics/pkg/apis/external_metrics"
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
 	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
-	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	"strconv"
+	"time"
 )
 
 // custom and external api manager
@@ -22,17 +38,148 @@ import (
 // convert to map would be better
 // 2022/01/08
 type providerManager struct {
-	alibabaCloudProvider       *alibabaCloudProvider.AlibabaCloudMetricsProvider
+	alibabaCloudProvider       p.ExternalMetricsProvider
 	prometheusCustomProvider   p.CustomMetricsProvider
 	prometheusExternalProvider p.ExternalMetricsProvider
+
+	// cache keeps the external metric values for a while
+	cache *externalMetricsCache
+	// notFound keeps the not found errors of the external metrics for a while, nil if they aren't cached
+	notFound *notFoundCache
+	// shared shares the external metric values between the replicas, nil if no shared store is configured
+	shared *sharedCache
+	// smoother averages the values of the metrics configured with smoothing
+	smoother *ewmaSmoother
+	// anomalies rejects the outliers of the metrics configured with anomaly rejection
+	anomalies *anomalyFilter
+	// derivedMetrics maps the derived metrics to their base metric
+	derivedMetrics map[string]string
+	// sourcedMetrics maps the metrics served by the freshest of several metrics to their sources
+	sourcedMetrics map[string]sourcedMetric
+	// ratioMetrics maps the metrics served by dividing two other metrics to their ratio
+	ratioMetrics map[string]config.Ratio
+	// customAliases serves the external metrics configured with a customMetric on the custom metrics API, nil if none is
+	customAliases *customAliases
+	// annotationMetrics serves the custom metrics read from an annotation of the requested object, nil if none is
+	annotationMetrics *annotationMetrics
+	// renamer renames the labels of the metrics configured with labelRename
+	renamer *labelRenamer
+	// labelFilter trims the labels of the metrics configured with keepLabels or dropLabels, nil if none is
+	labelFilter *labelFilter
+	// expressions post-process the values of the metrics configured with an expression
+	expressions *valueExpressions
+	// quantizer rounds the values of the metrics configured with quantization
+	quantizer *quantizer
+	// auditor pushes the returned values to a remote write endpoint, nil if auditing is disabled
+	auditor *audit.RemoteWriter
+	// auditLog records every metric request as a JSON event, nil if the audit log is disabled
+	auditLog *audit.EventLogger
+	// refreshFloor spaces the backend calls of the metrics configured with a minimum refresh interval, nil if none is
+	refreshFloor *refreshFloor
+	// lastSuccess records when the configured external metrics were last resolved
+	lastSuccess *lastSuccessTracker
+	// staleness reports the external metrics whose data points are too old as unavailable, nil if their age isn't checked
+	staleness *stalenessCheck
+	// cmsPusher pushes the returned values to CMS custom monitoring, nil if pushing is disabled
+	cmsPusher *cms.CMSPusher
+	// probe is the external metric which is served without any backend, nil if it's disabled
+	probe *probeMetric
+	// serviceAccounts restrict the series the requesting service accounts read, nil if none is restricted
+	serviceAccounts *serviceAccountMatchers
+	// prometheusEndpoints are the Prometheus endpoints a request may query instead of the default one, by name
+	prometheusEndpoints map[string]bool
+	// admission sheds the distinct metric requests beyond the limit of those in flight, nil if they aren't limited
+	admission *admissionGate
 }
 
 func (pm *providerManager) GetMetricByName(ctx context.Context, name types.NamespacedName, info p.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
-	return pm.prometheusCustomProvider.GetMetricByName(ctx, name, info, metricSelector)
+	start := time.Now()
+	value, err := pm.getMetricByName(ctx, name, info, metricSelector)
+	if pm.auditLog != nil {
+		event := audit.NewEvent(ctx, "custom", info.Metric, name.Namespace, info.GroupResource.String()+"/"+name.Name, metricSelector.String(), start, err)
+		if value != nil {
+			event = event.WithCustomValues(*value)
+		}
+		pm.auditLog.Log(event)
+	}
+	return value, err
+}
+
+func (pm *providerManager) getMetricByName(ctx context.Context, name types.NamespacedName, info p.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	if pm.annotationMetrics.serves(info) {
+		// the value is read from the object rather than from a backend
+		return pm.annotationMetrics.metricByName(ctx, name, info)
+	}
+	ctx, metricSelector, err := pm.withPrometheusEndpoint(ctx, metricSelector)
+	if err != nil {
+		return nil, err
+	}
+	metricSelector, err = pm.serviceAccounts.selector(ctx, metricSelector)
+	if err != nil {
+		return nil, apierr.NewForbidden(schema.GroupResource{Group: custom_metrics.GroupName, Resource: info.Metric}, name.Name, err)
+	}
+	ctx = utils.WithQuery(ctx, info.Metric, metricSelector.String())
+	ctx, release, err := pm.admission.admit(ctx, info.Metric, customMetricAdmissionKey(ctx, name.Namespace, info, name.Name, metricSelector))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	target, aliased := pm.customAliases.resolve(info)
+	value, err := pm.prometheusCustomProvider.GetMetricByName(ctx, name, target, metricSelector)
+	if aliased && err == nil && value != nil {
+		values := []custom_metrics.MetricValue{*value.DeepCopy()}
+		err = pm.transformAliasedValues(info.Metric, values)
+		value = &values[0]
+	}
+	if err == nil && value != nil {
+		pm.auditor.WriteCustomMetrics(*value)
+		pm.cmsPusher.PushCustomMetrics(*value)
+	}
+	return value, err
 }
 
 func (pm *providerManager) GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info p.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
-	return pm.prometheusCustomProvider.GetMetricBySelector(ctx, namespace, selector, info, metricSelector)
+	start := time.Now()
+	values, err := pm.getMetricBySelector(ctx, namespace, selector, info, metricSelector)
+	if pm.auditLog != nil {
+		event := audit.NewEvent(ctx, "custom", info.Metric, namespace, info.GroupResource.String()+"/"+selector.String(), metricSelector.String(), start, err)
+		if values != nil {
+			event = event.WithCustomValues(values.Items...)
+		}
+		pm.auditLog.Log(event)
+	}
+	return values, err
+}
+
+func (pm *providerManager) getMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info p.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	if pm.annotationMetrics.serves(info) {
+		return pm.annotationMetrics.metricBySelector(ctx, namespace, selector, info)
+	}
+	ctx, metricSelector, err := pm.withPrometheusEndpoint(ctx, metricSelector)
+	if err != nil {
+		return nil, err
+	}
+	metricSelector, err = pm.serviceAccounts.selector(ctx, metricSelector)
+	if err != nil {
+		return nil, apierr.NewForbidden(schema.GroupResource{Group: custom_metrics.GroupName, Resource: info.Metric}, "", err)
+	}
+	ctx = utils.WithQuery(ctx, info.Metric, metricSelector.String())
+	ctx, release, err := pm.admission.admit(ctx, info.Metric, customMetricAdmissionKey(ctx, namespace, info, selector.String(), metricSelector))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	target, aliased := pm.customAliases.resolve(info)
+	values, err := pm.prometheusCustomProvider.GetMetricBySelector(ctx, namespace, selector, target, metricSelector)
+	if aliased && err == nil && values != nil {
+		values = values.DeepCopy()
+		err = pm.transformAliasedValues(info.Metric, values.Items)
+	}
+	if err == nil && values != nil {
+		pm.auditor.WriteCustomMetrics(values.Items...)
+		pm.cmsPusher.PushCustomMetrics(values.Items...)
+	}
+	return values, err
 }
 
 // ListAllMetrics provides a list of all available metrics at
@@ -40,25 +187,178 @@ func (pm *providerManager) GetMetricBySelector(ctx context.Context, namespace st
 // an error, so it is reccomended that implementors cache and
 // periodically update this list, instead of querying every time.
 func (pm *providerManager) ListAllMetrics() []p.CustomMetricInfo {
-	return pm.prometheusCustomProvider.ListAllMetrics()
+	return pm.annotationMetrics.list(pm.customAliases.list(pm.prometheusCustomProvider.ListAllMetrics()))
 }
 
 func (pm *providerManager) GetExternalMetric(ctx context.Context, namespace string, metricSelector labels.Selector, info p.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
-	alibabaCloudMetrics := pm.alibabaCloudProvider.ListAllExternalMetrics()
+	start := time.Now()
+	values, err := pm.serveExternalMetric(ctx, namespace, metricSelector, info)
+	if pm.auditLog != nil {
+		pm.auditLog.Log(audit.NewEvent(ctx, "external", info.Metric, namespace, "", metricSelector.String(), start, err).WithExternalValues(values))
+	}
+	return values, err
+}
 
-	for _, m := range alibabaCloudMetrics {
-		if m.Metric == info.Metric {
-			// found metric
-			return pm.alibabaCloudProvider.GetExternalMetric(namespace, metricSelector, info)
+func (pm *providerManager) serveExternalMetric(ctx context.Context, namespace string, metricSelector labels.Selector, info p.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
+	if pm.probe.serves(info.Metric) {
+		// the probe only tells the api works, its value is neither cached nor recorded
+		return pm.probe.values(), nil
+	}
+	// the cache label only tells how to serve the request, it's no matcher of the metric
+	metricSelector, bypass := stripCacheLabel(metricSelector)
+	// the evaluation time tells the backends when to query the metric at
+	metricSelector, at, historical, err := stripEvaluationTimeLabel(metricSelector, time.Now())
+	if err != nil {
+		return nil, apierr.NewBadRequest(err.Error())
+	}
+	if historical {
+		ctx = utils.WithEvaluationTime(ctx, at)
+	}
+	ctx, metricSelector, err = pm.withPrometheusEndpoint(ctx, metricSelector)
+	if err != nil {
+		return nil, err
+	}
+	// the provider label only tells which provider serves the metric, it's no matcher of the metric
+	metricSelector, provider, err := stripMetricProviderLabel(metricSelector)
+	if err != nil {
+		return nil, apierr.NewBadRequest(err.Error())
+	}
+	if provider != "" {
+		ctx = utils.WithRequestProvider(ctx, provider)
+	}
+	_, overridden := utils.PrometheusEndpoint(ctx)
+	if err := pm.labelFilter.check(info.Metric, metricSelector); err != nil {
+		return nil, apierr.NewBadRequest(err.Error())
+	}
+	requestSelector := metricSelector
+	// the backend only knows the labels by their original names
+	metricSelector = pm.renamer.selector(info.Metric, metricSelector)
+	// the matchers of the service account are part of the cache key, so the tenants don't share values
+	metricSelector, err = pm.serviceAccounts.selector(ctx, metricSelector)
+	if err != nil {
+		return nil, apierr.NewForbidden(schema.GroupResource{Group: external_metrics.GroupName, Resource: info.Metric}, "", err)
+	}
+	values, err := pm.getCachedExternalMetric(ctx, namespace, metricSelector, info, bypass)
+	if err != nil {
+		return nil, err
+	}
+	if !historical {
+		// the cached values age too, so they're checked on every request
+		if err := pm.staleness.check(info.Metric, values); err != nil {
+			return nil, err
 		}
 	}
-	prometheusMetrics := pm.prometheusExternalProvider.ListAllExternalMetrics()
+	values = pm.renamer.rename(info.Metric, values)
+	values = pm.labelFilter.filter(info.Metric, requestSelector, values)
+	pm.auditor.WriteExternalMetrics(namespace, values)
+	if !historical && !overridden {
+		// the past values, or the ones of another Prometheus, would show up as the latest ones in the console
+		pm.cmsPusher.PushExternalMetrics(namespace, values)
+	}
+	return values, nil
+}
 
-	for _, m := range prometheusMetrics {
-		if m.Metric == info.Metric {
-			// found metric
-			return pm.prometheusExternalProvider.GetExternalMetric(ctx, namespace, metricSelector, info)
+func (pm *providerManager) getCachedExternalMetric(ctx context.Context, namespace string, metricSelector labels.Selector, info p.ExternalMetricInfo, bypass bool) (*external_metrics.ExternalMetricValueList, error) {
+	key := externalMetricsCacheKey(namespace, metricSelector, info)
+	at, historical := utils.EvaluationTime(ctx)
+	if historical {
+		key += "@" + strconv.FormatInt(at.Unix(), 10)
+	}
+	endpoint, overridden := utils.PrometheusEndpoint(ctx)
+	if overridden {
+		key += "#" + endpoint
+	}
+	if provider, requested := utils.RequestProvider(ctx); requested {
+		key += "%" + provider
+	}
+	if !bypass {
+		if values, found := pm.cache.get(key); found {
+			return values, nil
+		}
+		if values, found := pm.shared.get(ctx, key); found {
+			pm.cache.set(key, values)
+			return values, nil
 		}
+		if err, found := pm.notFound.get(key); found {
+			return nil, err
+		}
+	}
+	// only the requests which reach the backends take a slot
+	ctx, release, err := pm.admission.admit(ctx, info.Metric, key)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var values *external_metrics.ExternalMetricValueList
+	if base, derived := pm.derivedMetrics[info.Metric]; derived {
+		// a derived metric reuses the values of its base, so the backend isn't queried twice
+		values, err = pm.getCachedExternalMetric(ctx, namespace, metricSelector, p.ExternalMetricInfo{Metric: base}, bypass)
+		if err == nil {
+			values = values.DeepCopy()
+			for i := range values.Items {
+				values.Items[i].MetricName = info.Metric
+			}
+		}
+	} else if sourced, found := pm.sourcedMetrics[info.Metric]; found {
+		values, err = pm.getFreshestExternalMetric(ctx, namespace, metricSelector, info, sourced, bypass)
+	} else if ratio, found := pm.ratioMetrics[info.Metric]; found {
+		values, err = pm.getRatioExternalMetric(ctx, namespace, metricSelector, info, ratio, bypass)
+	} else {
+		// the floor holds even if the request bypasses the cache
+		values, err = pm.refreshFloor.refresh(info.Metric, key, func() (*external_metrics.ExternalMetricValueList, error) {
+			return pm.getExternalMetric(ctx, namespace, metricSelector, info)
+		})
+	}
+	if err == nil {
+		values, err = pm.expressions.apply(info.Metric, values)
+	}
+	if errors.Is(err, utils.ErrNotANumber) {
+		// a NaN has no value to scale on, and the 0 it would be read as scales the workloads in
+		err = utils.NotANumberError(info.Metric, err)
+	}
+	if err != nil {
+		pm.notFound.set(key, err)
+		return nil, err
+	}
+	// a past value, or one of another Prometheus, isn't part of the moving average of the current ones
+	if !historical && !overridden {
+		pm.lastSuccess.succeeded(info.Metric)
+		values = pm.anomalies.filter(info.Metric, key, values)
+		values = pm.smoother.smooth(info.Metric, key, values)
+	}
+	values = pm.quantizer.quantize(info.Metric, values)
+	pm.cache.set(key, values)
+	pm.shared.set(ctx, key, values)
+	return values, nil
+}
+
+// withPrometheusEndpoint removes the endpoint label from the selector, and asks the Prometheus
+// queries of the request to be sent to the endpoint it names.
+func (pm *providerManager) withPrometheusEndpoint(ctx context.Context, metricSelector labels.Selector) (context.Context, labels.Selector, error) {
+	metricSelector, endpoint, err := stripPrometheusEndpointLabel(metricSelector, pm.prometheusEndpoints)
+	if err != nil {
+		return nil, nil, apierr.NewBadRequest(err.Error())
+	}
+	if endpoint != "" {
+		ctx = utils.WithPrometheusEndpoint(ctx, endpoint)
+	}
+	return ctx, metricSelector, nil
+}
+
+func (pm *providerManager) getExternalMetric(ctx context.Context, namespace string, metricSelector labels.Selector, info p.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
+	ctx = utils.WithQuery(ctx, info.Metric, metricSelector.String())
+	// a metric configured with a backend, or requested from a provider, is only served by that provider
+	backend, pinned := utils.ServingProvider(ctx, info.Metric)
+	for _, c := range pm.externalMetricCandidates(info.Metric) {
+		isPrometheus := c.provider == pm.prometheusExternalProvider
+		if pinned && isPrometheus != (backend == utils.PrometheusProvider) {
+			continue
+		}
+		if isPrometheus && !utils.ProviderEnabled(utils.PrometheusProvider) {
+			return nil, apierr.NewNotFound(external_metrics.Resource(info.Metric), fmt.Sprintf("provider %s is disabled", utils.PrometheusProvider))
+		}
+		return c.provider.GetExternalMetric(ctx, namespace, metricSelector, info)
 	}
 	return nil, fmt.Errorf("no any matched metrics from provider: %v", info)
 }
@@ -69,6 +369,37 @@ func (pm *providerManager) ListAllExternalMetrics() []p.ExternalMetricInfo {
 	prometheusMetrics := pm.prometheusExternalProvider.ListAllExternalMetrics()
 	metrics = append(metrics, alibabaCloudMetrics...)
 	metrics = append(metrics, prometheusMetrics...)
+	metrics = append(metrics, pm.probe.info()...)
+
+	// the metrics with sources are available as long as one of their sources is
+	listed := make(map[string]bool, len(metrics))
+	for _, m := range metrics {
+		listed[m.Metric] = true
+	}
+	for name, sourced := range pm.sourcedMetrics {
+		for _, source := range sourced.sources {
+			if listed[source] {
+				metrics = append(metrics, p.ExternalMetricInfo{Metric: name})
+				break
+			}
+		}
+	}
+
+	// the ratios are available as long as both their metrics are
+	for name, ratio := range pm.ratioMetrics {
+		if listed[ratio.Numerator] && listed[ratio.Denominator] {
+			metrics = append(metrics, p.ExternalMetricInfo{Metric: name})
+		}
+	}
+
+	// the derived metrics are available as long as their base is
+	for _, m := range metrics {
+		for derived, base := range pm.derivedMetrics {
+			if m.Metric == base {
+				metrics = append(metrics, p.ExternalMetricInfo{Metric: derived})
+			}
+		}
+	}
 	return metrics
 }
 
@@ -78,6 +409,15 @@ func NewProviderManager(opts *options.AlibabaMetricsAdapterOptions, stopCh chan
 	var customRunner prometheusCustomMetricsProvider.Runnable
 	var externalRunner prometheusExternalMetricsProvider.Runnable
 
+	if opts.MockMetricsFile != "" {
+		mock, err := mockProvider.NewMockProvider(opts.MockMetricsFile)
+		if err != nil {
+			return nil, err
+		}
+		klog.Warningf("Serving the metrics of the mock metrics file %s instead of querying the backends", opts.MockMetricsFile)
+		return mock, nil
+	}
+
 	mapper, err := opts.RESTMapper()
 	if err != nil {
 		return nil, fmt.Errorf("unable to construct discovery REST mapper: %v", err)
@@ -95,35 +435,213 @@ func NewProviderManager(opts *options.AlibabaMetricsAdapterOptions, stopCh chan
 
 	pm := &providerManager{
 		alibabaCloudProvider: alibabaCloudProviderInstance,
+		cache:                newExternalMetricsCache(opts.ExternalMetricsCacheTTL, clock.RealClock{}),
+		notFound:             newNotFoundCache(opts.ExternalMetricsNotFoundCacheTTL, clock.RealClock{}),
+		probe:                newProbeMetric(opts.ProbeMetricName, opts.ProbeMetricValue),
 	}
 
 	if opts.MetricsMaxAge < opts.MetricsRelistInterval {
 		return nil, fmt.Errorf("max age must not be less than relist interval")
 	}
+	if (opts.MetricsRelistMinInterval > 0) != (opts.MetricsRelistMaxInterval > 0) {
+		return nil, fmt.Errorf("--metrics-relist-min-interval and --metrics-relist-max-interval must be set together")
+	}
+	if opts.MetricsRelistMinInterval > 0 {
+		if opts.MetricsRelistMinInterval > opts.MetricsRelistInterval || opts.MetricsRelistInterval > opts.MetricsRelistMaxInterval {
+			return nil, fmt.Errorf("relist interval %v must be between --metrics-relist-min-interval %v and --metrics-relist-max-interval %v",
+				opts.MetricsRelistInterval, opts.MetricsRelistMinInterval, opts.MetricsRelistMaxInterval)
+		}
+		if opts.MetricsMaxAge < opts.MetricsRelistMaxInterval {
+			return nil, fmt.Errorf("max age must not be less than max relist interval")
+		}
+	}
+	utils.SetRelistIntervalBounds(opts.MetricsRelistMinInterval, opts.MetricsRelistMaxInterval)
+
+	if opts.SharedCacheURL != "" {
+		store, err := utils.NewRedisStore(opts.SharedCacheURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shared cache: %v", err)
+		}
+		pm.shared = newSharedCache(store, opts.SharedCacheTTL, clock.RealClock{})
+	}
+
+	opts.ApplyBackendTimeouts()
+	opts.ApplyBackendConcurrency()
+	if opts.RetryBudgetMaxTokens > 0 && opts.RetryBudgetTokenRatio <= 0 {
+		return nil, fmt.Errorf("--retry-budget-token-ratio must be positive, or the retry budget never recovers")
+	}
+	opts.ApplyRetryBudget()
+	if err := opts.ApplyEndpointOverrides(); err != nil {
+		return nil, err
+	}
+	utils.SetExposeMetricWindow(opts.ExposeMetricWindow)
+	utils.SetExposeQuery(opts.ExposeQuery)
+	utils.SetClusterID(opts.ClusterID)
+	utils.SetCMSNameEncoding(opts.CMSNameEncoding)
+	utils.SetCMSDimensionDiscovery(opts.CMSDimensionDiscovery, opts.CMSDimensionSchemaTTL)
+	if err := utils.SetProviderPrecedence(opts.ExternalMetricProviderPrecedence); err != nil {
+		return nil, fmt.Errorf("invalid --external-metric-provider-precedence: %v", err)
+	}
+	if errs := validation.IsDNS1123Label(opts.DefaultNamespace); opts.DefaultNamespace != "" && len(errs) > 0 {
+		return nil, fmt.Errorf("--default-namespace %q is not a valid namespace: %s", opts.DefaultNamespace, errs[0])
+	}
+	utils.SetDefaultNamespace(opts.DefaultNamespace)
+	utils.SetSDKTransport(opts.SDKTransport, opts.MaxResponseBytes)
+	utils.SetCMSBatching(opts.CMSBatchSize, opts.CMSQueryConcurrency)
+	utils.SetSlowQueryThreshold(opts.SlowQueryThreshold)
+	if opts.QueryTimeOffset > 0 {
+		return nil, fmt.Errorf("--query-time-offset must not be positive, the metrics of the future aren't reported yet")
+	}
+	utils.SetQueryTimeOffset(opts.QueryTimeOffset)
+
+	if opts.AuditRemoteWriteURL != "" {
+		pm.auditor = audit.NewRemoteWriter(opts.AuditRemoteWriteURL, opts.AuditRemoteWriteBufferSize)
+		pm.auditor.RunUntil(stopCh)
+	}
+	if opts.AuditLog != "" {
+		out, err := audit.OpenEventLog(opts.AuditLog)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open --audit-log: %v", err)
+		}
+		pm.auditLog = audit.NewEventLogger(out, opts.AuditLogBufferSize)
+		pm.auditLog.RunUntil(stopCh)
+	}
+
+	if opts.CMSPushEnabled {
+		if opts.CMSPushGroupID == "" {
+			return nil, fmt.Errorf("--cms-push-enabled requires the --cms-push-group-id to push the metrics to")
+		}
+		pm.cmsPusher = cms.NewCMSPusher(opts.CMSPushGroupID, opts.CMSPushNamespace, opts.CMSPushBufferSize)
+		pm.cmsPusher.RunUntil(stopCh)
+	}
+
+	defaultLabelMatchers, err := naming.ParseLabelMatchers(opts.DefaultLabelMatchers)
+	if err != nil {
+		return nil, fmt.Errorf("invalid default label matchers: %v", err)
+	}
 
 	err = opts.LoadConfig()
 	if err != nil {
-		klog.Warningf("failed to load prometheus rules from file: %s", opts.AdapterConfigFile)
+		// the adapter still serves the Alibaba Cloud metrics without a config
+		if len(opts.AdapterConfigFiles) > 0 {
+			return nil, err
+		}
+		klog.Warningf("no prometheus rules loaded: %v", err)
 	}
 
 
+	// the settings of the external metrics are resolved once, for the sources of every provider
+	settings := opts.MetricsConfig.MetricSettings()
+	metrics.GetExternalMetricsManager().SetMetricsConfig(opts.MetricsConfig.ExternalMetrics)
+	metrics.GetExternalMetricsManager().SetMetricSettings(settings)
+	if opts.EnableKubeCountMetrics {
+		kubeClient, err := opts.KubernetesClient()
+		if err != nil {
+			return nil, err
+		}
+		kubeCountMetricSource, err := kube.StartKubeCountMetricSource(kubeClient, stopCh)
+		if err != nil {
+			return nil, fmt.Errorf("unable to start kube count metrics: %v", err)
+		}
+		metrics.GetExternalMetricsManager().AddMetricsSource(utils.KubeProvider, kubeCountMetricSource)
+	}
+	pm.smoother = newEWMASmoother(opts.MetricsConfig.ExternalMetrics, clock.RealClock{})
+	pm.anomalies = newAnomalyFilter(opts.MetricsConfig.ExternalMetrics, settings, clock.RealClock{})
+	pm.derivedMetrics = derivedMetrics(opts.MetricsConfig.ExternalMetrics)
+	pm.sourcedMetrics = sourcedMetrics(opts.MetricsConfig.ExternalMetrics)
+	pm.ratioMetrics = ratioMetrics(opts.MetricsConfig.ExternalMetrics)
+	pm.renamer = newLabelRenamer(opts.MetricsConfig.ExternalMetrics)
+	pm.labelFilter = newLabelFilter(opts.MetricsConfig.ExternalMetrics)
+	pm.expressions = newValueExpressions(opts.MetricsConfig.ExternalMetrics)
+	pm.quantizer = newQuantizer(opts.MetricsConfig.ExternalMetrics)
+	pm.customAliases = newCustomAliases(opts.MetricsConfig.ExternalMetrics)
+	pm.refreshFloor = newRefreshFloor(opts.MetricsConfig.ExternalMetrics, clock.RealClock{})
+	pm.lastSuccess = newLastSuccessTracker(opts.MetricsConfig.ExternalMetrics, clock.RealClock{})
+	pm.staleness = newStalenessCheck(opts.StaleMetricMaxAge, clock.RealClock{})
+	pm.admission = newAdmissionGate(opts.MaxInflightMetricRequests, opts.InflightLimitWait, opts.InflightLimitRetryAfter, clock.RealClock{})
+	pm.serviceAccounts, err = newServiceAccountMatchers(opts.MetricsConfig.ServiceAccountLabelMatchers, opts.StrictServiceAccountLabelMatchers)
+	if err != nil {
+		return nil, err
+	}
+
+	// let the rules attach metrics to the configured custom resources and to the apps workloads
+	mapper = naming.MapperPreferringApps(naming.MapperWithCustomResources(mapper, opts.MetricsConfig.CustomResources))
+
 	// extract the namers
-	namers, err := naming.NamersFromConfig(opts.MetricsConfig.Rules, mapper)
+	if opts.PrometheusUnitConventionsRateWindow <= 0 {
+		return nil, fmt.Errorf("--prometheus-unit-conventions-rate-window must be positive")
+	}
+	rules := config.WithUnitConventions(opts.MetricsConfig.Rules, opts.PrometheusUnitConventions, opts.PrometheusUnitConventionsRateWindow)
+	if opts.PrometheusDedupReplicas {
+		// the replicas are collapsed by the queries, before the series are aggregated
+		var warnings []string
+		rules, warnings = config.WithReplicaDedup(rules, opts.PrometheusReplicaLabels)
+		for _, warning := range warnings {
+			klog.Warningf("prometheus-dedup-replicas: %s", warning)
+		}
+	}
+	namers, err := naming.NamersFromConfig(rules, mapper, defaultLabelMatchers)
 	if err != nil {
 		return nil, fmt.Errorf("unable to construct naming scheme from metrics rules: %v", err)
 	}
 
+	emptyResultPolicy, err := prometheusExternalMetricsProvider.ParseEmptyResultPolicy(opts.PrometheusEmptyResult)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --prometheus-empty-result: %v", err)
+	}
+
+	utils.RegisterProvider(utils.PrometheusProvider)
+
 	// make the prometheus client
-	promClient, err := opts.MakePromClient()
+	promClient, err := opts.MakePromClient(stopCh)
 	if err != nil {
 		klog.Fatalf("unable to construct Prometheus client: %v", err)
 	}
+	endpoints, err := opts.PrometheusEndpoints()
+	if err != nil {
+		return nil, err
+	}
+	pm.prometheusEndpoints = make(map[string]bool, len(endpoints))
+	for name := range endpoints {
+		pm.prometheusEndpoints[name] = true
+	}
+
+	if opts.BackendWarmUpInterval > 0 {
+		utils.RunWarmUp(utils.PrometheusBackend, opts.BackendWarmUpInterval, func(ctx context.Context) error {
+			// the cheapest query there is, which still goes through the api
+			_, err := promClient.Query(ctx, pmodel.Now(), prom.Selector("1"))
+			return err
+		}, stopCh)
+		utils.RunWarmUp(utils.CMSBackend, opts.BackendWarmUpInterval, cms.NewCMSMetricSource().Ping, stopCh)
+	}
 
 	// construct the provider and start it
-	prometheusCustomMetricsProviderInstance, customRunner = prometheusCustomMetricsProvider.NewPrometheusProvider(mapper, dynamicClient, promClient, namers, opts.MetricsRelistInterval, opts.MetricsMaxAge)
+	// the annotation metrics and the label matchers annotation share the informers
+	var lister prometheusCustomMetricsProvider.ObjectAnnotationLister
+	if opts.EnableLabelMatchersAnnotation || len(opts.MetricsConfig.AnnotationMetrics) > 0 {
+		lister = prometheusCustomMetricsProvider.NewInformerAnnotationLister(dynamicClient, stopCh)
+	}
+	var annotations prometheusCustomMetricsProvider.AnnotationLister
+	if opts.EnableLabelMatchersAnnotation {
+		annotations = lister
+	}
+	pm.annotationMetrics = newAnnotationMetrics(opts.MetricsConfig.AnnotationMetrics, mapper, lister)
+	// the relists run in the background right away, the metrics of the snapshot are served until they're done
+	snapshot := utils.NewSeriesSnapshot(opts.MetricsRelistSnapshot)
+	prometheusCustomMetricsProviderInstance, customRunner = prometheusCustomMetricsProvider.NewPrometheusProvider(mapper, dynamicClient, promClient, namers, opts.MetricsRelistInterval, opts.MetricsMaxAge, annotations)
+	if loaded := customRunner.UseSnapshot(snapshot); !loaded || opts.StrictStartup {
+		if err := customRunner.RelistOnStartup(opts.StrictStartup); err != nil {
+			return nil, fmt.Errorf("unable to start with --strict-startup: %v", err)
+		}
+	} else {
+		klog.Infof("Serving the custom metrics of relist snapshot %s until the first relist", opts.MetricsRelistSnapshot)
+	}
 	customRunner.RunUntil(stopCh)
 
-	prometheusExternalMetricsProviderInstance, externalRunner = prometheusExternalMetricsProvider.NewExternalPrometheusProvider(promClient, namers, opts.MetricsRelistInterval, opts.MetricsMaxAge)
+	prometheusExternalMetricsProviderInstance, externalRunner = prometheusExternalMetricsProvider.NewExternalPrometheusProvider(promClient, namers, opts.MetricsRelistInterval, opts.MetricsMaxAge, emptyResultPolicy, opts.StrictExternalRules, settings)
+	if externalRunner.UseSnapshot(snapshot) {
+		klog.Infof("Serving the external metrics of relist snapshot %s until the first relist", opts.MetricsRelistSnapshot)
+	}
 	externalRunner.RunUntil(stopCh)
 	pm.prometheusCustomProvider = prometheusCustomMetricsProviderInstance
 	pm.prometheusExternalProvider = prometheusExternalMetricsProviderInstance
@@ -0,0 +1,40 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	"k8s.io/klog/v2"
+)
+
+// ProviderRegistryHandler serves the registry of the external metric providers: a GET returns whether each
+// provider is enabled, and a POST with the provider and enabled parameters, e.g. ?provider=cms&enabled=false,
+// enables or disables a provider until the restart of the adapter.
+func ProviderRegistryHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			name := r.URL.Query().Get("provider")
+			enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid enabled parameter: %v", err), http.StatusBadRequest)
+				return
+			}
+			if err := utils.SetProviderEnabled(name, enabled); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			klog.Warningf("Provider %s enabled: %v, by %s", name, enabled, r.RemoteAddr)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "only GET and POST are supported", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(utils.Providers())
+	})
+}
@@ -0,0 +1,56 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+func toggleProvider(query string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	ProviderRegistryHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/debug/providers?"+query, nil))
+	return recorder
+}
+
+func TestProviderRegistryTogglesProvider(t *testing.T) {
+	utils.RegisterProvider(utils.PrometheusProvider)
+	t.Cleanup(func() { utils.SetProviderEnabled(utils.PrometheusProvider, true) })
+	pm, _, _ := newCachingManager(time.Minute)
+	prometheus := pm.prometheusExternalProvider.(*countingExternalProvider)
+	info := p.ExternalMetricInfo{Metric: "http_requests"}
+
+	if recorder := toggleProvider("provider=prometheus&enabled=false"); recorder.Code != http.StatusOK {
+		t.Fatalf("Failed to disable provider: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if _, err := pm.GetExternalMetric(context.TODO(), "default", labels.Everything(), info); !apierr.IsNotFound(err) || prometheus.calls != 0 {
+		t.Errorf("expected the metric of the disabled provider not to be found without calling it, got %v after %d calls", err, prometheus.calls)
+	}
+	// the other providers still serve their metrics
+	if _, err := pm.GetExternalMetric(context.TODO(), "default", labels.Everything(), p.ExternalMetricInfo{Metric: "slb_l7_qps"}); err != nil {
+		t.Errorf("expected the metrics of the other providers to be served, got %v", err)
+	}
+
+	recorder := toggleProvider("provider=prometheus&enabled=true")
+	var providers map[string]bool
+	if err := json.Unmarshal(recorder.Body.Bytes(), &providers); err != nil || !providers[utils.PrometheusProvider] {
+		t.Errorf("expected the enabled provider to be listed, got %s (%v)", recorder.Body.String(), err)
+	}
+	if _, err := pm.GetExternalMetric(context.TODO(), "default", labels.Everything(), info); err != nil || prometheus.calls != 1 {
+		t.Errorf("expected the metric of the enabled provider to be served, got %v after %d calls", err, prometheus.calls)
+	}
+
+	if recorder := toggleProvider("provider=unknown&enabled=false"); recorder.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown provider to be rejected, got %d", recorder.Code)
+	}
+	if recorder := toggleProvider("provider=prometheus&enabled=maybe"); recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected an invalid enabled parameter to be rejected, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,93 @@
+package provider
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// MetricProviderLabel of a selector asks the external metric to be served by one of utils.KnownProviders, e.g.
+// metric_provider=prometheus for a Prometheus metric named like a CMS one. It's removed from the selector before
+// the request reaches a backend.
+const MetricProviderLabel = "metric_provider"
+
+// stripMetricProviderLabel removes the provider label from the selector, and returns the provider it asked for.
+func stripMetricProviderLabel(metricSelector labels.Selector) (labels.Selector, string, error) {
+	requirements, selectable := metricSelector.Requirements()
+	if !selectable {
+		return metricSelector, "", nil
+	}
+
+	provider := ""
+	stripped := labels.NewSelector()
+	for _, r := range requirements {
+		if r.Key() != MetricProviderLabel {
+			stripped = stripped.Add(r)
+			continue
+		}
+		values := r.Values().List()
+		if (r.Operator() != selection.Equals && r.Operator() != selection.DoubleEquals) || len(values) != 1 {
+			return nil, "", fmt.Errorf("the %s label must select a single provider, e.g. %s=prometheus", MetricProviderLabel, MetricProviderLabel)
+		}
+		if !utils.IsKnownProvider(values[0]) {
+			return nil, "", fmt.Errorf("provider %q of the %s label is not supported, it must be one of %v", values[0], MetricProviderLabel, utils.KnownProviders)
+		}
+		provider = values[0]
+	}
+	if provider == "" {
+		return metricSelector, "", nil
+	}
+	return stripped, provider, nil
+}
+
+// metricProviderNamer tells which provider of the registry serves an external metric, e.g. the Alibaba Cloud
+// provider which serves the metrics of CMS, SLB, SLS and AHAS.
+type metricProviderNamer interface {
+	MetricProvider(metric string) (string, bool)
+}
+
+// externalMetricCandidate is a provider which has an external metric.
+type externalMetricCandidate struct {
+	// name is the name of the provider in the registry, empty if it isn't known
+	name     string
+	provider p.ExternalMetricsProvider
+}
+
+// externalMetricCandidates returns the providers which have the metric, the preferred one first. The Alibaba Cloud
+// provider comes before the Prometheus one unless the provider precedence orders them otherwise.
+func (pm *providerManager) externalMetricCandidates(metric string) []externalMetricCandidate {
+	var candidates []externalMetricCandidate
+	for _, m := range listExternalMetrics(pm.alibabaCloudProvider) {
+		if m.Metric != metric {
+			continue
+		}
+		c := externalMetricCandidate{provider: pm.alibabaCloudProvider}
+		if namer, ok := pm.alibabaCloudProvider.(metricProviderNamer); ok {
+			c.name, _ = namer.MetricProvider(metric)
+		}
+		candidates = append(candidates, c)
+		break
+	}
+	for _, m := range listExternalMetrics(pm.prometheusExternalProvider) {
+		if m.Metric == metric {
+			candidates = append(candidates, externalMetricCandidate{name: utils.PrometheusProvider, provider: pm.prometheusExternalProvider})
+			break
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return utils.ProviderRank(candidates[i].name) < utils.ProviderRank(candidates[j].name)
+	})
+	return candidates
+}
+
+// listExternalMetrics lists the metrics of the provider, none if it isn't set up.
+func listExternalMetrics(provider p.ExternalMetricsProvider) []p.ExternalMetricInfo {
+	if provider == nil {
+		return nil
+	}
+	return provider.ListAllExternalMetrics()
+}
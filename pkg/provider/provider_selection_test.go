@@ -0,0 +1,81 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// namedExternalProvider is a countingExternalProvider which tells the registry name of the provider of its metric.
+type namedExternalProvider struct {
+	countingExternalProvider
+	name string
+}
+
+func (n *namedExternalProvider) MetricProvider(metric string) (string, bool) {
+	return n.name, metric == n.metric
+}
+
+func TestExternalMetricNameCollision(t *testing.T) {
+	defer utils.SetProviderPrecedence(nil)
+	cloud := &namedExternalProvider{countingExternalProvider: countingExternalProvider{metric: "qps"}, name: utils.CMSProvider}
+	prometheus := &countingExternalProvider{metric: "qps"}
+	pm := &providerManager{
+		alibabaCloudProvider:       cloud,
+		prometheusExternalProvider: prometheus,
+		cache:                      newExternalMetricsCache(time.Minute, clock.NewFakeClock(time.Now())),
+	}
+
+	tests := []struct {
+		name       string
+		precedence []string
+		selector   string
+		// cloud tells whether the Alibaba Cloud provider is expected to serve the request rather than Prometheus
+		cloud bool
+	}{
+		{name: "alibaba cloud first by default", selector: "app=web", cloud: true},
+		{name: "precedence", precedence: []string{utils.PrometheusProvider}, selector: "app=web,zone=a", cloud: false},
+		{name: "unnamed providers come after", precedence: []string{utils.SLBProvider, utils.PrometheusProvider}, selector: "app=web,zone=b", cloud: false},
+		{name: "label over precedence", precedence: []string{utils.PrometheusProvider}, selector: "app=web,metric_provider=cms", cloud: true},
+		{name: "label over default", selector: "app=web,metric_provider=prometheus", cloud: false},
+	}
+	for _, test := range tests {
+		if err := utils.SetProviderPrecedence(test.precedence); err != nil {
+			t.Fatalf("%s: failed to set the precedence, because of %v", test.name, err)
+		}
+		cloudCalls, prometheusCalls := cloud.calls, prometheus.calls
+		selector, _ := labels.Parse(test.selector)
+		if _, err := pm.GetExternalMetric(context.TODO(), "default", selector, p.ExternalMetricInfo{Metric: "qps"}); err != nil {
+			t.Fatalf("%s: failed to get the metric, because of %v", test.name, err)
+		}
+		if servedByCloud := cloud.calls > cloudCalls; servedByCloud != test.cloud || cloud.calls+prometheus.calls != cloudCalls+prometheusCalls+1 {
+			t.Errorf("%s: expected the request to be served once by the Alibaba Cloud provider: %v, got %d and %d calls",
+				test.name, test.cloud, cloud.calls-cloudCalls, prometheus.calls-prometheusCalls)
+		}
+	}
+
+	// the provider label reaches no backend, and the values it asked for aren't shared with the other requests
+	if got := cloud.selectors[len(cloud.selectors)-1]; got != "app=web" {
+		t.Errorf("expected the provider label to be stripped from the selector, got %q", got)
+	}
+	if got := prometheus.selectors[len(prometheus.selectors)-1]; got != "app=web" {
+		t.Errorf("expected the provider label to be stripped from the selector, got %q", got)
+	}
+
+	for _, selector := range []string{"app=web,metric_provider=influxdb", "app=web,metric_provider in (cms,prometheus)"} {
+		metricSelector, _ := labels.Parse(selector)
+		_, err := pm.GetExternalMetric(context.TODO(), "default", metricSelector, p.ExternalMetricInfo{Metric: "qps"})
+		if !apierr.IsBadRequest(err) {
+			t.Errorf("expected selector %q to be a bad request, got %v", selector, err)
+		}
+	}
+	if err := utils.SetProviderPrecedence([]string{"influxdb"}); err == nil {
+		t.Errorf("expected an unknown provider in the precedence to be rejected")
+	}
+}
@@ -0,0 +1,53 @@
+package provider
+
+import (
+	"math"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// quantizer rounds the values of the metrics configured with quantization.
+type quantizer struct {
+	// steps maps the metrics to the multiple their values are rounded to
+	steps map[string]float64
+}
+
+func newQuantizer(externalMetrics []config.ExternalMetric) *quantizer {
+	q := &quantizer{steps: make(map[string]float64)}
+	for _, m := range externalMetrics {
+		if m.Quantization == nil {
+			continue
+		}
+		step := m.Quantization.Step
+		if step == 0 {
+			step = 1
+		}
+		q.steps[m.Name] = step
+	}
+	return q
+}
+
+// quantize rounds each value of the metric to the nearest multiple of its step.
+func (q *quantizer) quantize(metric string, values *external_metrics.ExternalMetricValueList) *external_metrics.ExternalMetricValueList {
+	if q == nil || values == nil {
+		return values
+	}
+	step, found := q.steps[metric]
+	if !found {
+		return values
+	}
+
+	values = values.DeepCopy()
+	for i := range values.Items {
+		value := math.Round(values.Items[i].Value.AsApproximateFloat64()/step) * step
+		if value == math.Trunc(value) && math.Abs(value) < math.MaxInt64 {
+			// whole values are returned without any milli unit
+			values.Items[i].Value = *resource.NewQuantity(int64(value), resource.DecimalSI)
+		} else {
+			values.Items[i].Value = *resource.NewMilliQuantity(int64(math.Round(value*1000)), resource.DecimalSI)
+		}
+	}
+	return values
+}
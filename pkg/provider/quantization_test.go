@@ -0,0 +1,84 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+func milliValueList(values ...int64) *external_metrics.ExternalMetricValueList {
+	list := &external_metrics.ExternalMetricValueList{}
+	for _, v := range values {
+		list.Items = append(list.Items, external_metrics.ExternalMetricValue{
+			MetricName: "slb_l7_qps",
+			Value:      *resource.NewMilliQuantity(v, resource.DecimalSI),
+		})
+	}
+	return list
+}
+
+func TestQuantizeToIntegers(t *testing.T) {
+	q := newQuantizer([]config.ExternalMetric{{Name: "slb_l7_qps", Quantization: &config.Quantization{}}})
+
+	values := q.quantize("slb_l7_qps", milliValueList(1499, 1500, 123456789, -2600, 0))
+	for i, expected := range []string{"1", "2", "123457", "-3", "0"} {
+		if value := values.Items[i].Value.String(); value != expected {
+			t.Errorf("expected value %d to be rounded to %s, got %s", i, expected, value)
+		}
+	}
+}
+
+func TestQuantizeToStep(t *testing.T) {
+	for _, c := range []struct {
+		step     float64
+		value    int64
+		expected string
+	}{
+		{step: 10, value: 14999, expected: "10"},
+		{step: 10, value: 15000, expected: "20"},
+		{step: 0.5, value: 1240, expected: "1"},
+		{step: 0.5, value: 1260, expected: "1500m"},
+		{step: 0.25, value: 130, expected: "250m"},
+	} {
+		q := newQuantizer([]config.ExternalMetric{{Name: "slb_l7_qps", Quantization: &config.Quantization{Step: c.step}}})
+		if value := q.quantize("slb_l7_qps", milliValueList(c.value)).Items[0].Value.String(); value != c.expected {
+			t.Errorf("expected %dm to be quantized to %s by a step of %v, got %s", c.value, c.expected, c.step, value)
+		}
+	}
+}
+
+func TestQuantizeOtherMetrics(t *testing.T) {
+	q := newQuantizer([]config.ExternalMetric{{Name: "slb_l7_qps", Quantization: &config.Quantization{}}})
+	values := milliValueList(1499)
+	if quantized := q.quantize("http_requests", values); quantized != values {
+		t.Errorf("expected the values of other metrics to be left alone, got %v", quantized)
+	}
+}
+
+func TestQuantizedSmoothedMetric(t *testing.T) {
+	externalMetrics := []config.ExternalMetric{
+		{Name: "slb_l7_qps", Smoothing: &config.Smoothing{Alpha: 0.5}, Quantization: &config.Quantization{}},
+	}
+	pm, _, fakeClock := newCachingManager(time.Minute)
+	pm.smoother = newEWMASmoother(externalMetrics, fakeClock)
+	pm.quantizer = newQuantizer(externalMetrics)
+
+	selector := labels.SelectorFromSet(labels.Set{"slb.instance.id": "lb-1"})
+	// the backend returns 1, 2, 3, whose averages are 1, 1.5 and 2.25
+	for poll, expected := range []int64{1, 2, 2} {
+		values, err := pm.GetExternalMetric(context.TODO(), "default", selector, p.ExternalMetricInfo{Metric: "slb_l7_qps"})
+		if err != nil {
+			t.Fatalf("Failed to get metric, because of %v", err)
+		}
+		if value := values.Items[0].Value.MilliValue(); value != expected*1000 {
+			t.Errorf("poll %d: expected the average to be rounded to %d, got %dm", poll, expected, value)
+		}
+		fakeClock.Step(2 * time.Minute)
+	}
+}
@@ -0,0 +1,151 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// ratioMetrics maps the metrics configured with a ratio to it.
+func ratioMetrics(externalMetrics []config.ExternalMetric) map[string]config.Ratio {
+	ratios := make(map[string]config.Ratio)
+	for _, m := range externalMetrics {
+		if m.Ratio != nil {
+			ratios[m.Name] = *m.Ratio
+		}
+	}
+	return ratios
+}
+
+// ratioGroup sums the values of a group of both metrics of a ratio.
+type ratioGroup struct {
+	labels      map[string]string
+	numerator   float64
+	denominator float64
+	found       [2]bool
+	// timestamp is the oldest of the latest values of both metrics, which the ratio is as old as
+	timestamp [2]metav1.Time
+}
+
+// getRatioExternalMetric queries both metrics of the ratio in parallel, with the selector of the request, and
+// divides their values group by group. The groups which only one of the metrics has are left out, and so are the
+// groups whose denominator is 0, which have no ratio. If every group has a denominator of 0, the metric is
+// unavailable, as a NaN makes it.
+func (pm *providerManager) getRatioExternalMetric(ctx context.Context, namespace string, metricSelector labels.Selector, info p.ExternalMetricInfo, ratio config.Ratio, bypass bool) (*external_metrics.ExternalMetricValueList, error) {
+	operands := []string{ratio.Numerator, ratio.Denominator}
+	results := make([]*external_metrics.ExternalMetricValueList, len(operands))
+	errs := make([]error, len(operands))
+	done := make(chan struct{}, len(operands))
+	for i, operand := range operands {
+		i, operand := i, operand
+		go func() {
+			defer func() { done <- struct{}{} }()
+			results[i], errs[i] = pm.getCachedExternalMetric(ctx, namespace, metricSelector, p.ExternalMetricInfo{Metric: operand}, bypass)
+		}()
+	}
+	for range operands {
+		<-done
+	}
+	for i, operand := range operands {
+		if errs[i] != nil {
+			return nil, ratioError(info.Metric, operand, errs[i])
+		}
+	}
+
+	groups := make(map[string]*ratioGroup)
+	for i, values := range results {
+		for _, item := range values.Items {
+			groupLabels := ratioLabels(item.MetricLabels, ratio.On)
+			key := labels.Set(groupLabels).String()
+			group, found := groups[key]
+			if !found {
+				group = &ratioGroup{labels: groupLabels}
+				groups[key] = group
+			}
+			if i == 0 {
+				group.numerator += item.Value.AsApproximateFloat64()
+			} else {
+				group.denominator += item.Value.AsApproximateFloat64()
+			}
+			if !group.found[i] || item.Timestamp.After(group.timestamp[i].Time) {
+				group.timestamp[i] = item.Timestamp
+			}
+			group.found[i] = true
+		}
+	}
+
+	keys := make([]string, 0, len(groups))
+	for key, group := range groups {
+		if group.found[0] && group.found[1] {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, apierr.NewNotFound(external_metrics.Resource(info.Metric),
+			fmt.Sprintf("no values of %s and %s share their labels %v", ratio.Numerator, ratio.Denominator, ratio.On))
+	}
+	sort.Strings(keys)
+
+	values := &external_metrics.ExternalMetricValueList{Items: make([]external_metrics.ExternalMetricValue, 0, len(keys))}
+	for _, key := range keys {
+		group := groups[key]
+		if group.denominator == 0 {
+			klog.V(4).Infof("Leaving group {%s} out of ratio %s, its %s is 0", key, info.Metric, ratio.Denominator)
+			continue
+		}
+		value := group.numerator / group.denominator
+		timestamp := group.timestamp[0]
+		if group.timestamp[1].Before(&timestamp) {
+			timestamp = group.timestamp[1]
+		}
+		values.Items = append(values.Items, external_metrics.ExternalMetricValue{
+			MetricName:   info.Metric,
+			MetricLabels: group.labels,
+			Timestamp:    timestamp,
+			Value:        *resource.NewMilliQuantity(int64(math.Round(value*1000)), resource.DecimalSI),
+		})
+	}
+	if len(values.Items) == 0 {
+		return nil, fmt.Errorf("%s is 0 for every group of ratio %s: %w", ratio.Denominator, info.Metric, utils.ErrNotANumber)
+	}
+	return values, nil
+}
+
+// ratioLabels returns the labels of the group of a value, the on labels it has, or all its labels.
+func ratioLabels(metricLabels map[string]string, on []string) map[string]string {
+	group := make(map[string]string, len(metricLabels))
+	if len(on) == 0 {
+		for k, v := range metricLabels {
+			group[k] = v
+		}
+		return group
+	}
+	for _, label := range on {
+		if v, found := metricLabels[label]; found {
+			group[label] = v
+		}
+	}
+	return group
+}
+
+// ratioError tells which metric of the ratio failed, keeping the status of its error, e.g. a not found.
+func ratioError(metric, operand string, err error) error {
+	message := fmt.Sprintf("metric %s of the ratio %s failed: %v", operand, metric, err)
+	if status, ok := err.(apierr.APIStatus); ok {
+		s := status.Status()
+		s.Message = message
+		return &apierr.StatusError{ErrStatus: s}
+	}
+	return fmt.Errorf("metric %s of the ratio %s failed: %w", operand, metric, err)
+}
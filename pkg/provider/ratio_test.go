@@ -0,0 +1,145 @@
+package provider
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// seriesExternalProvider serves the values of each metric by their labels.
+type seriesExternalProvider struct {
+	series map[string]map[string]int64
+	at     time.Time
+}
+
+func (s *seriesExternalProvider) GetExternalMetric(_ context.Context, _ string, _ labels.Selector, info p.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
+	series, found := s.series[info.Metric]
+	if !found {
+		return nil, apierr.NewNotFound(external_metrics.Resource(info.Metric), info.Metric)
+	}
+	values := &external_metrics.ExternalMetricValueList{}
+	for selector, value := range series {
+		set, _ := labels.ConvertSelectorToLabelsMap(selector)
+		values.Items = append(values.Items, external_metrics.ExternalMetricValue{
+			MetricName:   info.Metric,
+			MetricLabels: set,
+			Timestamp:    metav1.NewTime(s.at),
+			Value:        *resource.NewQuantity(value, resource.DecimalSI),
+		})
+	}
+	return values, nil
+}
+
+func (s *seriesExternalProvider) ListAllExternalMetrics() []p.ExternalMetricInfo {
+	var infos []p.ExternalMetricInfo
+	for metric := range s.series {
+		infos = append(infos, p.ExternalMetricInfo{Metric: metric})
+	}
+	return infos
+}
+
+func newRatioManager(series map[string]map[string]int64, ratio config.Ratio) *providerManager {
+	backend := &seriesExternalProvider{series: series, at: time.Now()}
+	return &providerManager{
+		alibabaCloudProvider:       backend,
+		prometheusExternalProvider: &seriesExternalProvider{},
+		cache:                      newExternalMetricsCache(0, clock.NewFakeClock(time.Now())),
+		ratioMetrics:               ratioMetrics([]config.ExternalMetric{{Name: "error_ratio", Ratio: &ratio}}),
+	}
+}
+
+func getRatio(pm *providerManager) (*external_metrics.ExternalMetricValueList, error) {
+	return pm.GetExternalMetric(context.TODO(), "default", labels.Everything(), p.ExternalMetricInfo{Metric: "error_ratio"})
+}
+
+func TestRatioMetricMatchesLabels(t *testing.T) {
+	pm := newRatioManager(map[string]map[string]int64{
+		"http_errors":   {"service=cart": 5, "service=checkout": 1, "service=search": 3},
+		"http_requests": {"service=cart": 100, "service=checkout": 4, "service=payment": 50},
+	}, config.Ratio{Numerator: "http_errors", Denominator: "http_requests"})
+
+	values, err := getRatio(pm)
+	if err != nil {
+		t.Fatalf("Failed to get the ratio, because of %v", err)
+	}
+	// the services which only one of the metrics has are left out
+	expected := map[string]int64{"cart": 50, "checkout": 250}
+	if len(values.Items) != len(expected) {
+		t.Fatalf("expected a ratio per service of both metrics, got %v", values.Items)
+	}
+	for _, item := range values.Items {
+		service := item.MetricLabels["service"]
+		if item.MetricName != "error_ratio" || item.Value.MilliValue() != expected[service] {
+			t.Errorf("expected the ratio of service %s to be %dm, got %v of %s", service, expected[service], item.Value.String(), item.MetricName)
+		}
+	}
+}
+
+func TestRatioMetricGroupsOnLabels(t *testing.T) {
+	pm := newRatioManager(map[string]map[string]int64{
+		"http_errors":   {"service=cart,code=500": 3, "service=cart,code=503": 1},
+		"http_requests": {"service=cart,code=200": 30, "service=cart,code=500": 3, "service=cart,code=503": 7},
+	}, config.Ratio{Numerator: "http_errors", Denominator: "http_requests", On: []string{"service"}})
+
+	values, err := getRatio(pm)
+	if err != nil {
+		t.Fatalf("Failed to get the ratio, because of %v", err)
+	}
+	if len(values.Items) != 1 || values.Items[0].Value.MilliValue() != 100 || len(values.Items[0].MetricLabels) != 1 {
+		t.Errorf("expected the codes of the service to be summed into 4/40, got %v", values.Items)
+	}
+}
+
+func TestRatioMetricDivisionByZero(t *testing.T) {
+	pm := newRatioManager(map[string]map[string]int64{
+		"http_errors":   {"service=cart": 0},
+		"http_requests": {"service=cart": 0},
+	}, config.Ratio{Numerator: "http_errors", Denominator: "http_requests"})
+
+	if _, err := getRatio(pm); !apierr.IsServiceUnavailable(err) {
+		t.Errorf("expected a denominator of 0 in every group to make the ratio unavailable as a NaN, got %v", err)
+	}
+
+	pm = newRatioManager(map[string]map[string]int64{
+		"http_errors":   {"service=cart": 0, "service=checkout": 1},
+		"http_requests": {"service=cart": 0, "service=checkout": 4},
+	}, config.Ratio{Numerator: "http_errors", Denominator: "http_requests"})
+	values, err := getRatio(pm)
+	if err != nil {
+		t.Fatalf("Failed to get the ratio, because of %v", err)
+	}
+	if len(values.Items) != 1 || values.Items[0].MetricLabels["service"] != "checkout" || values.Items[0].Value.MilliValue() != 250 {
+		t.Errorf("expected only the group with a denominator of 0 to be left out, got %v", values.Items)
+	}
+}
+
+func TestRatioMetricErrors(t *testing.T) {
+	pm := newRatioManager(map[string]map[string]int64{
+		"http_errors": {"service=cart": 1},
+	}, config.Ratio{Numerator: "http_errors", Denominator: "http_requests"})
+	if _, err := getRatio(pm); err == nil || !strings.Contains(err.Error(), "http_requests") {
+		t.Errorf("expected the failed denominator to fail the ratio, got %v", err)
+	}
+
+	pm = newRatioManager(map[string]map[string]int64{
+		"http_errors":   {"service=cart": 1},
+		"http_requests": {"service=search": 10},
+	}, config.Ratio{Numerator: "http_errors", Denominator: "http_requests"})
+	if _, err := getRatio(pm); !apierr.IsNotFound(err) {
+		t.Errorf("expected a ratio without matching labels to be not found, got %v", err)
+	}
+
+	if listed := pm.ListAllExternalMetrics(); len(listed) != 3 {
+		t.Errorf("expected the ratio to be listed with both its metrics, got %v", listed)
+	}
+}
@@ -0,0 +1,119 @@
+package provider
+
+import (
+	"sync"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// refreshEntry is the last value of the backend for a metric and selector.
+type refreshEntry struct {
+	// lock serializes the refreshes, so that concurrent requests don't query the backend twice
+	lock      sync.Mutex
+	values    *external_metrics.ExternalMetricValueList
+	refreshed time.Time
+	// users is the number of requests holding the entry, which isn't swept while it's in use
+	users int
+}
+
+// refreshFloor guarantees the backend is queried at most once per minimum refresh interval for
+// each metric and selector, whatever the requests and the cache ask for. Between two refreshes,
+// the last value of the backend is returned.
+type refreshFloor struct {
+	lock  sync.Mutex
+	clock clock.Clock
+	// floors maps the metrics to their minimum refresh interval
+	floors    map[string]time.Duration
+	entries   map[string]*refreshEntry
+	lastSweep time.Time
+	// maxFloor is the longest interval, after which the entries of the selectors which aren't queried anymore are dropped
+	maxFloor time.Duration
+}
+
+// newRefreshFloor returns nil if no metric has a minimum refresh interval.
+func newRefreshFloor(externalMetrics []config.ExternalMetric, clock clock.Clock) *refreshFloor {
+	floors := make(map[string]time.Duration)
+	var maxFloor time.Duration
+	for _, m := range externalMetrics {
+		if m.MinRefreshInterval <= 0 {
+			continue
+		}
+		floors[m.Name] = m.MinRefreshInterval
+		if m.MinRefreshInterval > maxFloor {
+			maxFloor = m.MinRefreshInterval
+		}
+	}
+	if len(floors) == 0 {
+		return nil
+	}
+	return &refreshFloor{
+		clock:     clock,
+		floors:    floors,
+		entries:   make(map[string]*refreshEntry),
+		lastSweep: clock.Now(),
+		maxFloor:  maxFloor,
+	}
+}
+
+// refresh calls the backend if the key wasn't refreshed for the minimum refresh interval of the metric,
+// and returns the last value otherwise. Only the values count as a refresh: a failure, e.g. a transient
+// error of the backend, is returned to its request only, and the next request queries the backend again.
+// It always calls the backend for a metric without interval, or a nil floor.
+func (f *refreshFloor) refresh(metric, key string, backend func() (*external_metrics.ExternalMetricValueList, error)) (*external_metrics.ExternalMetricValueList, error) {
+	if f == nil {
+		return backend()
+	}
+	floor, found := f.floors[metric]
+	if !found {
+		return backend()
+	}
+
+	entry := f.acquire(key)
+	defer f.release(entry)
+	entry.lock.Lock()
+	defer entry.lock.Unlock()
+
+	if !entry.refreshed.IsZero() && f.clock.Since(entry.refreshed) < floor {
+		return entry.values.DeepCopy(), nil
+	}
+	values, err := backend()
+	if err != nil {
+		return nil, err
+	}
+	entry.refreshed = f.clock.Now()
+	entry.values = values.DeepCopy()
+	return values, nil
+}
+
+// acquire returns the entry of the key, creating it if needed.
+func (f *refreshFloor) acquire(key string) *refreshEntry {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	now := f.clock.Now()
+	// drop the entries of the selectors which aren't queried anymore
+	if now.Sub(f.lastSweep) > f.maxFloor {
+		for k, entry := range f.entries {
+			if entry.users == 0 && now.Sub(entry.refreshed) > f.maxFloor {
+				delete(f.entries, k)
+			}
+		}
+		f.lastSweep = now
+	}
+	entry, found := f.entries[key]
+	if !found {
+		entry = &refreshEntry{}
+		f.entries[key] = entry
+	}
+	entry.users++
+	return entry
+}
+
+func (f *refreshFloor) release(entry *refreshEntry) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	entry.users--
+}
@@ -0,0 +1,167 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// clockedExternalProvider records when it's called.
+type clockedExternalProvider struct {
+	*countingExternalProvider
+	clock clock.Clock
+	times []time.Time
+}
+
+func (t *clockedExternalProvider) GetExternalMetric(ctx context.Context, namespace string, metricSelector labels.Selector, info p.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
+	t.times = append(t.times, t.clock.Now())
+	return t.countingExternalProvider.GetExternalMetric(ctx, namespace, metricSelector, info)
+}
+
+func newRefreshFloorManager(floor time.Duration) (*providerManager, *clockedExternalProvider, *clock.FakeClock) {
+	// the cache is disabled, so that only the floor spaces the calls
+	pm, backend, fakeClock := newCachingManager(0)
+	clocked := &clockedExternalProvider{countingExternalProvider: backend, clock: fakeClock}
+	pm.alibabaCloudProvider = clocked
+	pm.refreshFloor = newRefreshFloor([]config.ExternalMetric{{Name: "slb_l7_qps", MinRefreshInterval: floor}}, fakeClock)
+	return pm, clocked, fakeClock
+}
+
+func TestRefreshFloorSpacesBackendCalls(t *testing.T) {
+	pm, backend, fakeClock := newRefreshFloorManager(20 * time.Second)
+
+	// an HPA polling every 5s, some of its requests bypassing the cache
+	for i := 0; i < 24; i++ {
+		selector := "slb.instance.id=lb-1"
+		if i%3 == 0 {
+			selector += ",cache=bypass"
+		}
+		if value := getMetric(t, pm, selector); value != int64(backend.calls) {
+			t.Errorf("expected the last value of the backend %d, got %d", backend.calls, value)
+		}
+		fakeClock.Step(5 * time.Second)
+	}
+
+	if len(backend.times) != 6 {
+		t.Errorf("expected the backend to be called every 20s over 2 minutes, got %d calls", len(backend.times))
+	}
+	for i := 1; i < len(backend.times); i++ {
+		if gap := backend.times[i].Sub(backend.times[i-1]); gap < 20*time.Second {
+			t.Errorf("expected the calls to the backend to be at least 20s apart, got %v between calls %d and %d", gap, i-1, i)
+		}
+	}
+}
+
+func TestRefreshFloorPerSelector(t *testing.T) {
+	pm, backend, fakeClock := newRefreshFloorManager(20 * time.Second)
+
+	getMetric(t, pm, "slb.instance.id=lb-1")
+	getMetric(t, pm, "slb.instance.id=lb-2")
+	if backend.calls != 2 {
+		t.Errorf("expected each selector to be refreshed on its own, got %d calls", backend.calls)
+	}
+
+	fakeClock.Step(10 * time.Second)
+	getMetric(t, pm, "slb.instance.id=lb-1")
+	getMetric(t, pm, "slb.instance.id=lb-2")
+	if backend.calls != 2 {
+		t.Errorf("expected the selectors not to be refreshed before the floor, got %d calls", backend.calls)
+	}
+
+	// the other metrics aren't floored
+	for i := 0; i < 2; i++ {
+		if _, err := pm.GetExternalMetric(context.TODO(), "default", labels.Everything(), p.ExternalMetricInfo{Metric: "http_requests"}); err != nil {
+			t.Fatalf("Failed to get metric, because of %v", err)
+		}
+	}
+	if calls := pm.prometheusExternalProvider.(*countingExternalProvider).calls; calls != 2 {
+		t.Errorf("expected a metric without floor to be queried on each request, got %d calls", calls)
+	}
+}
+
+func TestRefreshFloorConcurrentRequests(t *testing.T) {
+	pm, backend, _ := newRefreshFloorManager(20 * time.Second)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			getMetric(t, pm, "slb.instance.id=lb-1")
+		}()
+	}
+	wg.Wait()
+	if backend.calls != 1 {
+		t.Errorf("expected concurrent requests to share a single call, got %d calls", backend.calls)
+	}
+}
+
+func TestRefreshFloorLetsFailuresThrough(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	floor := newRefreshFloor([]config.ExternalMetric{{Name: "slb_l7_qps", MinRefreshInterval: 20 * time.Second}}, fakeClock)
+	calls := 0
+	failing := func() (*external_metrics.ExternalMetricValueList, error) {
+		calls++
+		return nil, fmt.Errorf("throttled")
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := floor.refresh("slb_l7_qps", "key", failing); err == nil || err.Error() != "throttled" {
+			t.Errorf("expected the failure to be returned, got %v", err)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("expected a failure not to be kept, so that each request queries the backend again, got %d calls", calls)
+	}
+
+	// the first value is kept until the floor, whatever failed before
+	serving := func() (*external_metrics.ExternalMetricValueList, error) {
+		calls++
+		return &external_metrics.ExternalMetricValueList{}, nil
+	}
+	for i := 0; i < 2; i++ {
+		if values, err := floor.refresh("slb_l7_qps", "key", serving); err != nil || values == nil {
+			t.Errorf("expected the value to be returned, got %v", err)
+		}
+	}
+	if calls != 4 {
+		t.Errorf("expected the value to be kept until the floor, got %d calls", calls)
+	}
+}
+
+func TestRefreshFloorForgetsCancelledRequests(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	floor := newRefreshFloor([]config.ExternalMetric{{Name: "slb_l7_qps", MinRefreshInterval: 20 * time.Second}}, fakeClock)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := func() (*external_metrics.ExternalMetricValueList, error) {
+		// the apiserver cancels the request while the backend is queried
+		cancel()
+		return nil, ctx.Err()
+	}
+	if _, err := floor.refresh("slb_l7_qps", "key", cancelled); err != context.Canceled {
+		t.Errorf("expected the cancellation to be returned, got %v", err)
+	}
+
+	calls := 0
+	values, err := floor.refresh("slb_l7_qps", "key", func() (*external_metrics.ExternalMetricValueList, error) {
+		calls++
+		return &external_metrics.ExternalMetricValueList{}, nil
+	})
+	if err != nil || values == nil || calls != 1 {
+		t.Errorf("expected the next request to query the backend rather than get the cancellation, got %v after %d calls", err, calls)
+	}
+}
+
+func TestNewRefreshFloorWithoutIntervals(t *testing.T) {
+	if floor := newRefreshFloor([]config.ExternalMetric{{Name: "slb_l7_qps"}}, clock.RealClock{}); floor != nil {
+		t.Errorf("expected no floor without intervals, got %+v", floor)
+	}
+}
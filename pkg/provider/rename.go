@@ -0,0 +1,91 @@
+package provider
+
+import (
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	"k8s.io/apimachinery/pkg/labels"
+	log "k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// labelRenamer renames the labels of the values of the metrics configured with labelRename.
+// The selectors of the requests use the new names, so they are translated back to the names
+// the backend knows before querying it.
+type labelRenamer struct {
+	// renames maps the metrics to the old label names to the new ones
+	renames map[string]map[string]string
+	// originals maps the metrics to the new label names to the old ones
+	originals map[string]map[string]string
+}
+
+func newLabelRenamer(externalMetrics []config.ExternalMetric) *labelRenamer {
+	r := &labelRenamer{
+		renames:   make(map[string]map[string]string),
+		originals: make(map[string]map[string]string),
+	}
+	for _, m := range externalMetrics {
+		if len(m.LabelRename) == 0 {
+			continue
+		}
+		originals := make(map[string]string, len(m.LabelRename))
+		for from, to := range m.LabelRename {
+			originals[to] = from
+		}
+		r.renames[m.Name] = m.LabelRename
+		r.originals[m.Name] = originals
+	}
+	return r
+}
+
+// selector translates the requirements on renamed labels back to the names of the backend.
+func (r *labelRenamer) selector(metric string, metricSelector labels.Selector) labels.Selector {
+	if r == nil {
+		return metricSelector
+	}
+	originals, found := r.originals[metric]
+	if !found {
+		return metricSelector
+	}
+	requirements, selectable := metricSelector.Requirements()
+	if !selectable {
+		return metricSelector
+	}
+
+	translated := labels.NewSelector()
+	for _, requirement := range requirements {
+		if original, renamed := originals[requirement.Key()]; renamed {
+			t, err := labels.NewRequirement(original, requirement.Operator(), requirement.Values().List())
+			if err != nil {
+				// the new name was a valid key already, so is the old one unless the config is off
+				log.Warningf("Failed to translate label %s of metric %s back to %s, because of %v", requirement.Key(), metric, original, err)
+			} else {
+				requirement = *t
+			}
+		}
+		translated = translated.Add(requirement)
+	}
+	return translated
+}
+
+// rename returns a copy of the values with their labels renamed.
+func (r *labelRenamer) rename(metric string, values *external_metrics.ExternalMetricValueList) *external_metrics.ExternalMetricValueList {
+	if r == nil || values == nil {
+		return values
+	}
+	renames, found := r.renames[metric]
+	if !found {
+		return values
+	}
+
+	values = values.DeepCopy()
+	for i := range values.Items {
+		metricLabels := make(map[string]string, len(values.Items[i].MetricLabels))
+		for k, v := range values.Items[i].MetricLabels {
+			if to, renamed := renames[k]; renamed {
+				k = to
+			}
+			metricLabels[k] = v
+		}
+		values.Items[i].MetricLabels = metricLabels
+	}
+	return values
+}
@@ -0,0 +1,93 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// selectingExternalProvider returns the series whose labels match the selector, like Prometheus does.
+type selectingExternalProvider struct {
+	metric string
+	series []map[string]string
+}
+
+func (s *selectingExternalProvider) GetExternalMetric(_ context.Context, _ string, metricSelector labels.Selector, info p.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
+	values := &external_metrics.ExternalMetricValueList{}
+	for i, series := range s.series {
+		if metricSelector.Matches(labels.Set(series)) {
+			values.Items = append(values.Items, external_metrics.ExternalMetricValue{
+				MetricName:   info.Metric,
+				MetricLabels: series,
+				Value:        *resource.NewQuantity(int64(i+1), resource.DecimalSI),
+			})
+		}
+	}
+	return values, nil
+}
+
+func (s *selectingExternalProvider) ListAllExternalMetrics() []p.ExternalMetricInfo {
+	return []p.ExternalMetricInfo{{Metric: s.metric}}
+}
+
+func TestLabelRename(t *testing.T) {
+	backend := &selectingExternalProvider{
+		metric: "http_requests",
+		series: []map[string]string{
+			{"service_name": "web", "zone": "a"},
+			{"service_name": "api", "zone": "a"},
+		},
+	}
+	pm := &providerManager{
+		alibabaCloudProvider:       &countingExternalProvider{metric: "slb_l7_qps"},
+		prometheusExternalProvider: backend,
+		cache:                      newExternalMetricsCache(time.Minute, clock.NewFakeClock(time.Now())),
+		renamer: newLabelRenamer([]config.ExternalMetric{{
+			Name:        "http_requests",
+			LabelRename: map[string]string{"service_name": "service"},
+		}}),
+	}
+
+	selector, err := labels.Parse("service=web,zone=a")
+	if err != nil {
+		t.Fatalf("Failed to parse selector, because of %v", err)
+	}
+	values, err := pm.GetExternalMetric(context.TODO(), "default", selector, p.ExternalMetricInfo{Metric: "http_requests"})
+	if err != nil {
+		t.Fatalf("Failed to get metric, because of %v", err)
+	}
+
+	if len(values.Items) != 1 || values.Items[0].Value.Value() != 1 {
+		t.Fatalf("expected the series of web to match the renamed label, got %v", values.Items)
+	}
+	metricLabels := values.Items[0].MetricLabels
+	if metricLabels["service"] != "web" || metricLabels["service_name"] != "" || metricLabels["zone"] != "a" {
+		t.Errorf("expected service_name to be renamed to service, got %v", metricLabels)
+	}
+	if !selector.Matches(labels.Set(metricLabels)) {
+		t.Errorf("expected the returned labels %v to match the selector %s", metricLabels, selector)
+	}
+
+	// the backend series are left untouched
+	if backend.series[0]["service_name"] != "web" {
+		t.Errorf("expected the backend labels not to be modified, got %v", backend.series[0])
+	}
+}
+
+func TestLabelRenameOtherMetrics(t *testing.T) {
+	renamer := newLabelRenamer([]config.ExternalMetric{{
+		Name:        "http_requests",
+		LabelRename: map[string]string{"service_name": "service"},
+	}})
+	selector, _ := labels.Parse("service=web")
+	if translated := renamer.selector("slb_l7_qps", selector); translated.String() != "service=web" {
+		t.Errorf("expected the selector of another metric to be left as is, got %s", translated)
+	}
+}
@@ -0,0 +1,74 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apiserver/pkg/authentication/serviceaccount"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+// serviceAccountMatchers ANDs the label matchers configured for the service account which
+// requests a metric into its selector, so that a tenant only reads its own series.
+type serviceAccountMatchers struct {
+	// matchers are the label matchers of the service accounts, by namespace/name
+	matchers map[string][]labels.Requirement
+	// strict denies the requests of the users without label matchers instead of leaving their selectors alone
+	strict bool
+}
+
+// newServiceAccountMatchers returns nil if no service account has label matchers and strict is false.
+func newServiceAccountMatchers(mappings []config.ServiceAccountLabelMatchers, strict bool) (*serviceAccountMatchers, error) {
+	if len(mappings) == 0 && !strict {
+		return nil, nil
+	}
+	m := &serviceAccountMatchers{
+		matchers: make(map[string][]labels.Requirement, len(mappings)),
+		strict:   strict,
+	}
+	for _, mapping := range mappings {
+		names := make([]string, 0, len(mapping.LabelMatchers))
+		for name := range mapping.LabelMatchers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		requirements := make([]labels.Requirement, 0, len(names))
+		for _, name := range names {
+			requirement, err := labels.NewRequirement(name, selection.Equals, []string{mapping.LabelMatchers[name]})
+			if err != nil {
+				return nil, fmt.Errorf("invalid label matcher of service account %s: %v", mapping.ServiceAccount, err)
+			}
+			requirements = append(requirements, *requirement)
+		}
+		m.matchers[mapping.ServiceAccount] = requirements
+	}
+	return m, nil
+}
+
+// selector adds the label matchers of the user of the request to the selector. It fails in
+// strict mode if the user isn't a service account with label matchers. It's a no-op on nil matchers.
+func (m *serviceAccountMatchers) selector(ctx context.Context, metricSelector labels.Selector) (labels.Selector, error) {
+	if m == nil {
+		return metricSelector, nil
+	}
+	u, found := request.UserFrom(ctx)
+	if !found {
+		if m.strict {
+			return nil, fmt.Errorf("the request has no user to look up the label matchers of")
+		}
+		return metricSelector, nil
+	}
+	if namespace, name, err := serviceaccount.SplitUsername(u.GetName()); err == nil {
+		if requirements, found := m.matchers[namespace+"/"+name]; found {
+			return metricSelector.Add(requirements...), nil
+		}
+	}
+	if m.strict {
+		return nil, fmt.Errorf("no label matchers are configured for %s", u.GetName())
+	}
+	return metricSelector, nil
+}
@@ -0,0 +1,86 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+func newServiceAccountManager(t *testing.T, strict bool) (*providerManager, *countingExternalProvider) {
+	pm, backend, _ := newCachingManager(time.Minute)
+	matchers, err := newServiceAccountMatchers([]config.ServiceAccountLabelMatchers{
+		{ServiceAccount: "team-a/reader", LabelMatchers: map[string]string{"tenant": "team-a"}},
+		{ServiceAccount: "team-b/reader", LabelMatchers: map[string]string{"tenant": "team-b"}},
+	}, strict)
+	if err != nil {
+		t.Fatalf("Failed to create the service account matchers, because of %v", err)
+	}
+	pm.serviceAccounts = matchers
+	return pm, backend
+}
+
+func getMetricAs(pm *providerManager, username string) error {
+	ctx := context.TODO()
+	if username != "" {
+		ctx = request.WithUser(ctx, &user.DefaultInfo{Name: username})
+	}
+	metricSelector, _ := labels.Parse("slb.instance.id=lb-1")
+	_, err := pm.GetExternalMetric(ctx, "default", metricSelector, p.ExternalMetricInfo{Metric: "slb_l7_qps"})
+	return err
+}
+
+func TestServiceAccountLabelMatchers(t *testing.T) {
+	pm, backend := newServiceAccountManager(t, false)
+
+	for _, username := range []string{"system:serviceaccount:team-a:reader", "system:serviceaccount:team-b:reader", "system:serviceaccount:team-c:reader", "alice", ""} {
+		if err := getMetricAs(pm, username); err != nil {
+			t.Fatalf("Failed to get metric as %q, because of %v", username, err)
+		}
+	}
+
+	expected := []string{
+		"slb.instance.id=lb-1,tenant=team-a",
+		"slb.instance.id=lb-1,tenant=team-b",
+		// the users without label matchers are served as they ask
+		"slb.instance.id=lb-1",
+	}
+	if len(backend.selectors) != len(expected) {
+		t.Fatalf("expected the tenants not to share the cached values, got the selectors %v", backend.selectors)
+	}
+	for i, selector := range expected {
+		if backend.selectors[i] != selector {
+			t.Errorf("expected the backend to be queried with %s, got %s", selector, backend.selectors[i])
+		}
+	}
+}
+
+func TestStrictServiceAccountLabelMatchers(t *testing.T) {
+	pm, backend := newServiceAccountManager(t, true)
+
+	if err := getMetricAs(pm, "system:serviceaccount:team-a:reader"); err != nil {
+		t.Fatalf("Failed to get metric, because of %v", err)
+	}
+	for _, username := range []string{"system:serviceaccount:team-c:reader", "alice", ""} {
+		if err := getMetricAs(pm, username); !apierr.IsForbidden(err) {
+			t.Errorf("expected the request of %q to be forbidden, got %v", username, err)
+		}
+	}
+	if backend.calls != 1 {
+		t.Errorf("expected the denied requests not to query the backend, got %d calls", backend.calls)
+	}
+}
+
+func TestInvalidServiceAccountLabelMatchers(t *testing.T) {
+	if _, err := newServiceAccountMatchers([]config.ServiceAccountLabelMatchers{
+		{ServiceAccount: "team-a/reader", LabelMatchers: map[string]string{"tenant": "not a value"}},
+	}, false); err == nil {
+		t.Errorf("expected an invalid label value to be rejected")
+	}
+}
@@ -0,0 +1,110 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+const (
+	// sharedCacheKeyPrefix keeps the entries of the adapter apart from the other users of the store.
+	sharedCacheKeyPrefix = "alibaba-cloud-metrics-adapter/external/"
+	// sharedCacheTimeout bounds an operation of the store, so a slow store doesn't slow down the requests.
+	sharedCacheTimeout = 200 * time.Millisecond
+	// sharedCacheBackoff is how long the store isn't used after it failed.
+	sharedCacheBackoff = 30 * time.Second
+)
+
+// SharedStore is a key value store shared by the replicas of the adapter, e.g. Redis.
+type SharedStore interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
+
+// sharedCache shares the external metric values between the replicas for a ttl, so they
+// don't all query the backend for the same values. When the store is unreachable the
+// replicas fall back to their local cache.
+type sharedCache struct {
+	store SharedStore
+	ttl   time.Duration
+	clock clock.Clock
+
+	lock             sync.Mutex
+	unavailableUntil time.Time
+}
+
+func newSharedCache(store SharedStore, ttl time.Duration, clock clock.Clock) *sharedCache {
+	return &sharedCache{
+		store: store,
+		ttl:   ttl,
+		clock: clock,
+	}
+}
+
+func (c *sharedCache) get(ctx context.Context, key string) (*external_metrics.ExternalMetricValueList, bool) {
+	if !c.available() {
+		return nil, false
+	}
+	storeCtx, cancel := context.WithTimeout(ctx, sharedCacheTimeout)
+	defer cancel()
+
+	data, found, err := c.store.Get(storeCtx, sharedCacheKeyPrefix+key)
+	if err != nil {
+		c.failed(ctx, err)
+		return nil, false
+	}
+	if !found {
+		return nil, false
+	}
+	values := &external_metrics.ExternalMetricValueList{}
+	if err := json.Unmarshal(data, values); err != nil {
+		klog.Warningf("Ignoring the invalid shared cache entry of %s: %v", key, err)
+		return nil, false
+	}
+	return values, true
+}
+
+func (c *sharedCache) set(ctx context.Context, key string, values *external_metrics.ExternalMetricValueList) {
+	if !c.available() {
+		return
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		klog.Warningf("Failed to encode the shared cache entry of %s: %v", key, err)
+		return
+	}
+	storeCtx, cancel := context.WithTimeout(ctx, sharedCacheTimeout)
+	defer cancel()
+
+	if err := c.store.Set(storeCtx, sharedCacheKeyPrefix+key, data, c.ttl); err != nil {
+		c.failed(ctx, err)
+	}
+}
+
+func (c *sharedCache) available() bool {
+	if c == nil || c.ttl <= 0 {
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return !c.clock.Now().Before(c.unavailableUntil)
+}
+
+// failed stops using the store for a while, the local cache still serves the requests meanwhile.
+// The store isn't backed off when the request of the caller was cancelled or timed out.
+func (c *sharedCache) failed(ctx context.Context, err error) {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		klog.V(4).Infof("Shared cache operation abandoned by the caller: %v", err)
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.unavailableUntil = c.clock.Now().Add(sharedCacheBackoff)
+	klog.Warningf("Shared cache unavailable, using the local cache for %v: %v", sharedCacheBackoff, err)
+}
@@ -0,0 +1,123 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+// fakeSharedStore is an in memory shared store, which fails while it's down.
+type fakeSharedStore struct {
+	lock    sync.Mutex
+	entries map[string][]byte
+	down    bool
+	calls   int
+}
+
+func newFakeSharedStore() *fakeSharedStore {
+	return &fakeSharedStore{entries: make(map[string][]byte)}
+}
+
+func (s *fakeSharedStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.calls++
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	if s.down {
+		return nil, false, errors.New("connection refused")
+	}
+	value, found := s.entries[key]
+	return value, found, nil
+}
+
+func (s *fakeSharedStore) Set(ctx context.Context, key string, value []byte, _ time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.calls++
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.down {
+		return errors.New("connection refused")
+	}
+	s.entries[key] = value
+	return nil
+}
+
+func newSharingManager(store SharedStore) (*providerManager, *countingExternalProvider, *clock.FakeClock) {
+	pm, backend, fakeClock := newCachingManager(time.Minute)
+	pm.shared = newSharedCache(store, time.Minute, fakeClock)
+	return pm, backend, fakeClock
+}
+
+func TestSharedCache(t *testing.T) {
+	store := newFakeSharedStore()
+	pm1, backend1, _ := newSharingManager(store)
+	pm2, backend2, _ := newSharingManager(store)
+
+	getMetric(t, pm1, "slb.instance.id=lb-1")
+	if value := getMetric(t, pm2, "slb.instance.id=lb-1"); value != 1 || backend2.calls != 0 {
+		t.Errorf("expected the second replica to be served from the shared cache, got value %d after %d calls", value, backend2.calls)
+	}
+	if value := getMetric(t, pm2, "slb.instance.id=lb-2"); value != 1 || backend2.calls != 1 {
+		t.Errorf("expected another selector to read the backend, got value %d after %d calls", value, backend2.calls)
+	}
+	if backend1.calls != 1 {
+		t.Errorf("expected the first replica to read the backend once, got %d calls", backend1.calls)
+	}
+
+	// the bypass reads the backend and shares the fresh value
+	getMetric(t, pm2, "slb.instance.id=lb-1,cache=bypass")
+	pm1.cache = newExternalMetricsCache(0, clock.RealClock{})
+	if value := getMetric(t, pm1, "slb.instance.id=lb-1"); value != 2 || backend1.calls != 1 {
+		t.Errorf("expected the refreshed value to be shared, got value %d after %d calls", value, backend1.calls)
+	}
+}
+
+func TestSharedCacheUnavailable(t *testing.T) {
+	store := newFakeSharedStore()
+	store.down = true
+	pm, backend, fakeClock := newSharingManager(store)
+
+	if value := getMetric(t, pm, "slb.instance.id=lb-1"); value != 1 || backend.calls != 1 {
+		t.Errorf("expected the backend to be read while the shared store is down, got value %d after %d calls", value, backend.calls)
+	}
+	if value := getMetric(t, pm, "slb.instance.id=lb-1"); value != 1 || backend.calls != 1 {
+		t.Errorf("expected the local cache to serve the request, got value %d after %d calls", value, backend.calls)
+	}
+	if store.calls != 1 {
+		t.Errorf("expected the shared store not to be used after it failed, got %d calls", store.calls)
+	}
+
+	// the store is used again once it's back and the backoff expired
+	store.down = false
+	fakeClock.Step(2 * time.Minute)
+	getMetric(t, pm, "slb.instance.id=lb-1")
+	if len(store.entries) != 1 {
+		t.Errorf("expected the value to be shared again, got %d entries", len(store.entries))
+	}
+}
+
+func TestSharedCacheCancelledRequest(t *testing.T) {
+	store := newFakeSharedStore()
+	cache := newSharedCache(store, time.Minute, clock.NewFakeClock(time.Now()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, found := cache.get(ctx, "key"); found {
+		t.Errorf("expected the cancelled request not to find a value")
+	}
+	cache.set(ctx, "key", valueList(1))
+	if !cache.available() {
+		t.Errorf("expected the shared store to stay available after a cancelled request")
+	}
+	if store.calls != 2 {
+		t.Errorf("expected the shared store to be used by both requests, got %d calls", store.calls)
+	}
+}
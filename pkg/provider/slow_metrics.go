@@ -0,0 +1,30 @@
+package provider
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+)
+
+// defaultSlowMetrics is the number of metrics the slow metrics endpoint lists by default.
+const defaultSlowMetrics = 10
+
+// SlowMetricsHandler lists the metrics with the highest recent average backend latency, the slowest first.
+// The n parameter sets how many metrics are listed, 10 by default.
+func SlowMetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := defaultSlowMetrics
+		if param := r.URL.Query().Get("n"); param != "" {
+			parsed, err := strconv.Atoi(param)
+			if err != nil || parsed <= 0 {
+				http.Error(w, "n must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			n = parsed
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(utils.SlowestMetrics(n))
+	})
+}
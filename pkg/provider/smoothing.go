@@ -0,0 +1,136 @@
+package provider
+
+import (
+	"sync"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/metrics"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+type ewmaState struct {
+	value       float64
+	lastQueried time.Time
+	// expireAfter is the ExpireAfter of the metric of the average
+	expireAfter time.Duration
+}
+
+// expired tells whether the average wasn't queried for longer than its metric keeps it.
+func (state *ewmaState) expired(now time.Time) bool {
+	return now.Sub(state.lastQueried) > state.expireAfter
+}
+
+// ewmaSmoother replaces the values of the configured metrics with their exponentially
+// weighted moving average, so that a spiky metric doesn't make the HPA flap.
+type ewmaSmoother struct {
+	lock      sync.Mutex
+	clock     clock.Clock
+	smoothing map[string]config.Smoothing
+	states    map[string]*ewmaState
+	lastSweep time.Time
+	// sweepInterval is the shortest ExpireAfter of the metrics
+	sweepInterval time.Duration
+}
+
+func newEWMASmoother(externalMetrics []config.ExternalMetric, clock clock.Clock) *ewmaSmoother {
+	smoothing := make(map[string]config.Smoothing)
+	var sweepInterval time.Duration
+	for _, m := range externalMetrics {
+		if m.Smoothing == nil {
+			continue
+		}
+		s := *m.Smoothing
+		if s.ExpireAfter == 0 {
+			s.ExpireAfter = config.DefaultSmoothingExpireAfter
+		}
+		smoothing[m.Name] = s
+		if sweepInterval == 0 || s.ExpireAfter < sweepInterval {
+			sweepInterval = s.ExpireAfter
+		}
+	}
+	return &ewmaSmoother{
+		clock:         clock,
+		smoothing:     smoothing,
+		states:        make(map[string]*ewmaState),
+		lastSweep:     clock.Now(),
+		sweepInterval: sweepInterval,
+	}
+}
+
+// smooth feeds the values read for the request identified by key into the moving averages
+// of the metric, and returns the averages. The values of other metrics are returned as is.
+func (s *ewmaSmoother) smooth(metric, key string, values *external_metrics.ExternalMetricValueList) *external_metrics.ExternalMetricValueList {
+	if s == nil {
+		return values
+	}
+	smoothing, found := s.smoothing[metric]
+	if !found {
+		return values
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.clock.Now()
+	s.sweep(now)
+
+	smoothed := values.DeepCopy()
+	for i := range smoothed.Items {
+		item := &smoothed.Items[i]
+		itemKey := key + "/" + seriesLabels(item.MetricLabels)
+		raw := item.Value.AsApproximateFloat64()
+
+		state, found := s.states[itemKey]
+		if !found || state.expired(now) {
+			// the average starts over from the first value
+			state = &ewmaState{value: raw}
+			s.states[itemKey] = state
+		} else {
+			state.value = smoothing.Alpha*raw + (1-smoothing.Alpha)*state.value
+		}
+		state.lastQueried = now
+		state.expireAfter = smoothing.ExpireAfter
+		item.Value = *resource.NewMilliQuantity(int64(state.value*1000), resource.DecimalSI)
+	}
+	return smoothed
+}
+
+// sweep drops the moving averages which weren't queried for longer than their metric keeps them.
+func (s *ewmaSmoother) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) <= s.sweepInterval {
+		return
+	}
+	for k, state := range s.states {
+		if state.expired(now) {
+			delete(s.states, k)
+		}
+	}
+	s.lastSweep = now
+}
+
+// seriesLabels identifies a series of a metric by its labels, leaving out the
+// labels which only tell how its value was read.
+func seriesLabels(metricLabels map[string]string) string {
+	set := make(labels.Set, len(metricLabels))
+	for k, v := range metricLabels {
+		if k != metrics.StaleLabel {
+			set[k] = v
+		}
+	}
+	return set.String()
+}
+
+// derivedMetrics maps the derived metrics of the config to their base metric.
+func derivedMetrics(externalMetrics []config.ExternalMetric) map[string]string {
+	derived := make(map[string]string)
+	for _, m := range externalMetrics {
+		if m.Base != "" {
+			derived[m.Name] = m.Base
+		}
+	}
+	return derived
+}
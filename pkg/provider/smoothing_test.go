@@ -0,0 +1,156 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+func valueList(values ...int64) *external_metrics.ExternalMetricValueList {
+	list := &external_metrics.ExternalMetricValueList{}
+	for i, v := range values {
+		list.Items = append(list.Items, external_metrics.ExternalMetricValue{
+			MetricName:   "slb_l7_qps",
+			MetricLabels: map[string]string{"port": string(rune('a' + i))},
+			Value:        *resource.NewQuantity(v, resource.DecimalSI),
+		})
+	}
+	return list
+}
+
+func newTestSmoother() (*ewmaSmoother, *clock.FakeClock) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	return newEWMASmoother([]config.ExternalMetric{
+		{Name: "slb_l7_qps", Smoothing: &config.Smoothing{Alpha: 0.5, ExpireAfter: time.Minute}},
+	}, fakeClock), fakeClock
+}
+
+func TestEWMASmoothing(t *testing.T) {
+	smoother, _ := newTestSmoother()
+
+	for i, tc := range []struct {
+		raw      int64
+		expected float64
+	}{
+		{raw: 10, expected: 10},
+		{raw: 20, expected: 15},
+		{raw: 40, expected: 27.5},
+		{raw: 0, expected: 13.75},
+	} {
+		smoothed := smoother.smooth("slb_l7_qps", "key", valueList(tc.raw))
+		if value := smoothed.Items[0].Value.AsApproximateFloat64(); value != tc.expected {
+			t.Errorf("poll %d: expected smoothed value %v, got %v", i, tc.expected, value)
+		}
+	}
+}
+
+func TestEWMASmoothingPerSeries(t *testing.T) {
+	smoother, _ := newTestSmoother()
+
+	smoother.smooth("slb_l7_qps", "key", valueList(10, 100))
+	smoothed := smoother.smooth("slb_l7_qps", "key", valueList(20, 200))
+	if a, b := smoothed.Items[0].Value.AsApproximateFloat64(), smoothed.Items[1].Value.AsApproximateFloat64(); a != 15 || b != 150 {
+		t.Errorf("expected each series to be smoothed on its own, got %v and %v", a, b)
+	}
+
+	smoothed = smoother.smooth("slb_l7_qps", "other-key", valueList(40))
+	if value := smoothed.Items[0].Value.AsApproximateFloat64(); value != 40 {
+		t.Errorf("expected another selector to start its own average, got %v", value)
+	}
+}
+
+func TestEWMASmoothingExpires(t *testing.T) {
+	smoother, fakeClock := newTestSmoother()
+
+	smoother.smooth("slb_l7_qps", "key", valueList(10))
+	fakeClock.Step(2 * time.Minute)
+	smoothed := smoother.smooth("slb_l7_qps", "key", valueList(30))
+	if value := smoothed.Items[0].Value.AsApproximateFloat64(); value != 30 {
+		t.Errorf("expected the expired average to start over, got %v", value)
+	}
+	if len(smoother.states) != 1 {
+		t.Errorf("expected the expired state to be dropped, got %d states", len(smoother.states))
+	}
+}
+
+func TestEWMASmoothingExpiresPerMetric(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	smoother := newEWMASmoother([]config.ExternalMetric{
+		{Name: "slb_l7_qps", Smoothing: &config.Smoothing{Alpha: 0.5, ExpireAfter: time.Minute}},
+		{Name: "slb_l7_rt", Smoothing: &config.Smoothing{Alpha: 0.5, ExpireAfter: time.Hour}},
+	}, fakeClock)
+
+	smoother.smooth("slb_l7_rt", "rt-key", valueList(10))
+	fakeClock.Step(2 * time.Minute)
+	// the sweep of the short lived metric keeps the average of the other one
+	smoother.smooth("slb_l7_qps", "qps-key", valueList(10))
+	smoothed := smoother.smooth("slb_l7_rt", "rt-key", valueList(30))
+	if value := smoothed.Items[0].Value.AsApproximateFloat64(); value != 20 {
+		t.Errorf("expected the average of the other metric to be kept, got %v", value)
+	}
+}
+
+func TestEWMASmoothingOtherMetrics(t *testing.T) {
+	smoother, _ := newTestSmoother()
+
+	raw := valueList(10)
+	if smoothed := smoother.smooth("slb_l7_rt", "key", raw); smoothed != raw {
+		t.Errorf("expected the metrics without smoothing to be returned as is")
+	}
+}
+
+func TestDerivedSmoothedMetric(t *testing.T) {
+	externalMetrics := []config.ExternalMetric{
+		{Name: "slb_l7_qps_smoothed", Base: "slb_l7_qps", Smoothing: &config.Smoothing{Alpha: 0.5}},
+	}
+	pm, backend, fakeClock := newCachingManager(time.Minute)
+	pm.smoother = newEWMASmoother(externalMetrics, fakeClock)
+	pm.derivedMetrics = derivedMetrics(externalMetrics)
+
+	found := false
+	for _, m := range pm.ListAllExternalMetrics() {
+		if m.Metric == "slb_l7_qps_smoothed" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected the derived metric to be listed")
+	}
+
+	selector := labels.SelectorFromSet(labels.Set{"slb.instance.id": "lb-1"})
+	var average float64
+	for poll := 1; poll <= 3; poll++ {
+		raw, err := pm.GetExternalMetric(context.TODO(), "default", selector, p.ExternalMetricInfo{Metric: "slb_l7_qps"})
+		if err != nil {
+			t.Fatalf("Failed to get base metric, because of %v", err)
+		}
+		smoothed, err := pm.GetExternalMetric(context.TODO(), "default", selector, p.ExternalMetricInfo{Metric: "slb_l7_qps_smoothed"})
+		if err != nil {
+			t.Fatalf("Failed to get derived metric, because of %v", err)
+		}
+
+		rawValue := raw.Items[0].Value.AsApproximateFloat64()
+		if poll == 1 {
+			average = rawValue
+		} else {
+			average = 0.5*rawValue + 0.5*average
+		}
+		if rawValue != float64(poll) {
+			t.Errorf("poll %d: expected the base metric to keep its raw value, got %v", poll, rawValue)
+		}
+		if value := smoothed.Items[0].Value.AsApproximateFloat64(); value != average || smoothed.Items[0].MetricName != "slb_l7_qps_smoothed" {
+			t.Errorf("poll %d: expected the derived metric to be the average %v of the base, got %v", poll, average, smoothed.Items[0])
+		}
+		if backend.calls != poll {
+			t.Errorf("poll %d: expected the derived metric to reuse the base values, got %d backend calls", poll, backend.calls)
+		}
+		fakeClock.Step(2 * time.Minute)
+	}
+}
@@ -0,0 +1,140 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// sourcedMetric is an external metric served by the freshest of its sources.
+type sourcedMetric struct {
+	// sources are the names of the source metrics, in order of preference
+	sources []string
+	// tolerance is how much staler than the newest source a preferred source may be
+	tolerance time.Duration
+	// parallelism is how many sources are queried at a time, all of them if zero
+	parallelism int
+}
+
+type sourceResult struct {
+	index  int
+	values *external_metrics.ExternalMetricValueList
+	err    error
+}
+
+func sourcedMetrics(externalMetrics []config.ExternalMetric) map[string]sourcedMetric {
+	sourced := make(map[string]sourcedMetric)
+	for _, m := range externalMetrics {
+		if len(m.Sources) > 0 {
+			sourced[m.Name] = sourcedMetric{sources: m.Sources, tolerance: m.FreshnessTolerance, parallelism: m.MaxParallelSources}
+		}
+	}
+	return sourced
+}
+
+// getFreshestExternalMetric queries the sources of the metric, at most metric.parallelism at a time, and
+// returns the values of the first source whose latest value is within the tolerance of the newest one.
+// The sources which fail, or aren't resolved before the deadline of the request, are skipped: the request
+// only fails if all of them do.
+func (pm *providerManager) getFreshestExternalMetric(ctx context.Context, namespace string, metricSelector labels.Selector, info p.ExternalMetricInfo, metric sourcedMetric, bypass bool) (*external_metrics.ExternalMetricValueList, error) {
+	parallelism := metric.parallelism
+	if parallelism <= 0 || parallelism > len(metric.sources) {
+		parallelism = len(metric.sources)
+	}
+	slots := make(chan struct{}, parallelism)
+	// buffered for the sources still running at the deadline not to leak
+	resolved := make(chan sourceResult, len(metric.sources))
+	for i, source := range metric.sources {
+		i, source := i, source
+		go func() {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				resolved <- sourceResult{index: i, err: ctx.Err()}
+				return
+			}
+			defer func() { <-slots }()
+			values, err := pm.getCachedExternalMetric(ctx, namespace, metricSelector, p.ExternalMetricInfo{Metric: source}, bypass)
+			resolved <- sourceResult{index: i, values: values, err: err}
+		}()
+	}
+
+	results := make([]*external_metrics.ExternalMetricValueList, len(metric.sources))
+	errs := make([]error, len(metric.sources))
+	done := make([]bool, len(metric.sources))
+wait:
+	for range metric.sources {
+		select {
+		case r := <-resolved:
+			results[r.index], errs[r.index], done[r.index] = r.values, r.err, true
+		case <-ctx.Done():
+			for i := range done {
+				if !done[i] {
+					errs[i] = fmt.Errorf("not resolved before the deadline: %v", ctx.Err())
+				}
+			}
+			break wait
+		}
+	}
+
+	latest := make([]time.Time, len(metric.sources))
+	var newest time.Time
+	for i := range metric.sources {
+		if errs[i] != nil {
+			klog.V(4).Infof("Source %s of external metric %s failed: %v", metric.sources[i], info.Metric, errs[i])
+			continue
+		}
+		latest[i] = latestTimestamp(results[i])
+		if latest[i].After(newest) {
+			newest = latest[i]
+		}
+	}
+
+	for i, source := range metric.sources {
+		if errs[i] != nil || latest[i].Before(newest.Add(-metric.tolerance)) {
+			continue
+		}
+		klog.V(4).Infof("External metric %s served by its source %s, whose latest value is at %v", info.Metric, source, latest[i])
+		values := results[i].DeepCopy()
+		for j := range values.Items {
+			values.Items[j].MetricName = info.Metric
+		}
+		return values, nil
+	}
+	return nil, sourcesError(info.Metric, metric.sources, errs)
+}
+
+// sourcesError combines the errors of all the sources of the metric. It keeps the status of the error of
+// the first source, e.g. a not found, if it has one.
+func sourcesError(metric string, sources []string, errs []error) error {
+	messages := make([]string, len(sources))
+	for i, source := range sources {
+		messages[i] = fmt.Sprintf("%s: %v", source, errs[i])
+	}
+	message := fmt.Sprintf("all the sources of external metric %s failed: %s", metric, strings.Join(messages, "; "))
+	if status, ok := errs[0].(apierr.APIStatus); ok {
+		s := status.Status()
+		s.Message = message
+		return &apierr.StatusError{ErrStatus: s}
+	}
+	return fmt.Errorf("%s", message)
+}
+
+// latestTimestamp returns the time of the newest value, zero if there are none.
+func latestTimestamp(values *external_metrics.ExternalMetricValueList) time.Time {
+	var latest time.Time
+	for _, item := range values.Items {
+		if item.Timestamp.Time.After(latest) {
+			latest = item.Timestamp.Time
+		}
+	}
+	return latest
+}
@@ -0,0 +1,228 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	p "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// stampedExternalProvider serves a metric whose latest value is at a given time.
+type stampedExternalProvider struct {
+	metric string
+	value  int64
+	at     time.Time
+	err    error
+}
+
+func (s *stampedExternalProvider) GetExternalMetric(_ context.Context, _ string, _ labels.Selector, info p.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &external_metrics.ExternalMetricValueList{
+		Items: []external_metrics.ExternalMetricValue{{
+			MetricName: info.Metric,
+			Timestamp:  metav1.NewTime(s.at),
+			Value:      *resource.NewQuantity(s.value, resource.DecimalSI),
+		}},
+	}, nil
+}
+
+func (s *stampedExternalProvider) ListAllExternalMetrics() []p.ExternalMetricInfo {
+	return []p.ExternalMetricInfo{{Metric: s.metric}}
+}
+
+func newSourcedManager(cms, prometheus *stampedExternalProvider) *providerManager {
+	externalMetrics := []config.ExternalMetric{
+		{Name: "checkout_qps", Sources: []string{"cms_checkout_qps", "prom_checkout_qps"}, FreshnessTolerance: time.Minute},
+	}
+	return &providerManager{
+		alibabaCloudProvider:       cms,
+		prometheusExternalProvider: prometheus,
+		cache:                      newExternalMetricsCache(0, clock.NewFakeClock(time.Now())),
+		sourcedMetrics:             sourcedMetrics(externalMetrics),
+	}
+}
+
+func getSourcedMetric(t *testing.T, pm *providerManager) *external_metrics.ExternalMetricValueList {
+	values, err := pm.GetExternalMetric(context.TODO(), "default", labels.Everything(), p.ExternalMetricInfo{Metric: "checkout_qps"})
+	if err != nil {
+		t.Fatalf("Failed to get metric, because of %v", err)
+	}
+	return values
+}
+
+func TestSourcedMetricPrefersTheFirstFreshSource(t *testing.T) {
+	now := time.Now()
+	for _, c := range []struct {
+		name     string
+		cmsAt    time.Time
+		promAt   time.Time
+		expected int64
+	}{
+		{name: "first source newest", cmsAt: now, promAt: now.Add(-5 * time.Minute), expected: 1},
+		{name: "first source within tolerance", cmsAt: now.Add(-30 * time.Second), promAt: now, expected: 1},
+		{name: "first source stale", cmsAt: now.Add(-5 * time.Minute), promAt: now, expected: 2},
+	} {
+		pm := newSourcedManager(
+			&stampedExternalProvider{metric: "cms_checkout_qps", value: 1, at: c.cmsAt},
+			&stampedExternalProvider{metric: "prom_checkout_qps", value: 2, at: c.promAt},
+		)
+		values := getSourcedMetric(t, pm)
+		if values.Items[0].Value.Value() != c.expected || values.Items[0].MetricName != "checkout_qps" {
+			t.Errorf("%s: expected the value %d of checkout_qps, got %v", c.name, c.expected, values.Items[0])
+		}
+	}
+}
+
+func TestSourcedMetricSkipsFailedSources(t *testing.T) {
+	pm := newSourcedManager(
+		&stampedExternalProvider{metric: "cms_checkout_qps", err: errors.New("cms is throttled")},
+		&stampedExternalProvider{metric: "prom_checkout_qps", value: 2, at: time.Now().Add(-time.Hour)},
+	)
+	if value := getSourcedMetric(t, pm).Items[0].Value.Value(); value != 2 {
+		t.Errorf("expected the value of the working source, got %d", value)
+	}
+
+	pm = newSourcedManager(
+		&stampedExternalProvider{metric: "cms_checkout_qps", err: errors.New("cms is throttled")},
+		&stampedExternalProvider{metric: "prom_checkout_qps", err: errors.New("prometheus is down")},
+	)
+	_, err := pm.GetExternalMetric(context.TODO(), "default", labels.Everything(), p.ExternalMetricInfo{Metric: "checkout_qps"})
+	expected := "all the sources of external metric checkout_qps failed: cms_checkout_qps: cms is throttled; prom_checkout_qps: prometheus is down"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected the errors of all the sources, got %v", err)
+	}
+
+	pm = newSourcedManager(
+		&stampedExternalProvider{metric: "cms_checkout_qps", err: apierr.NewNotFound(schema.GroupResource{Resource: "cms_checkout_qps"}, "")},
+		&stampedExternalProvider{metric: "prom_checkout_qps", err: errors.New("prometheus is down")},
+	)
+	_, err = pm.GetExternalMetric(context.TODO(), "default", labels.Everything(), p.ExternalMetricInfo{Metric: "checkout_qps"})
+	if !apierr.IsNotFound(err) {
+		t.Errorf("expected the status of the error of the first source, got %v", err)
+	}
+}
+
+// blockingExternalProvider serves the value of its metrics once released, and counts the concurrent queries.
+type blockingExternalProvider struct {
+	metrics []string
+	value   int64
+	release chan struct{}
+	lock    sync.Mutex
+	running int
+	peak    int
+}
+
+func (b *blockingExternalProvider) GetExternalMetric(ctx context.Context, _ string, _ labels.Selector, info p.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
+	b.lock.Lock()
+	if b.running++; b.running > b.peak {
+		b.peak = b.running
+	}
+	b.lock.Unlock()
+	defer func() {
+		b.lock.Lock()
+		b.running--
+		b.lock.Unlock()
+	}()
+	select {
+	case <-b.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return &external_metrics.ExternalMetricValueList{
+		Items: []external_metrics.ExternalMetricValue{{
+			MetricName: info.Metric,
+			Timestamp:  metav1.Now(),
+			Value:      *resource.NewQuantity(b.value, resource.DecimalSI),
+		}},
+	}, nil
+}
+
+func (b *blockingExternalProvider) ListAllExternalMetrics() []p.ExternalMetricInfo {
+	var infos []p.ExternalMetricInfo
+	for _, m := range b.metrics {
+		infos = append(infos, p.ExternalMetricInfo{Metric: m})
+	}
+	return infos
+}
+
+func newParallelSourcedManager(backend *blockingExternalProvider, parallelism int) *providerManager {
+	externalMetrics := []config.ExternalMetric{
+		{Name: "checkout_qps", Sources: backend.metrics, MaxParallelSources: parallelism},
+	}
+	return &providerManager{
+		alibabaCloudProvider: backend,
+		cache:                newExternalMetricsCache(0, clock.NewFakeClock(time.Now())),
+		sourcedMetrics:       sourcedMetrics(externalMetrics),
+	}
+}
+
+func TestSourcedMetricResolvesSourcesInParallel(t *testing.T) {
+	for _, c := range []struct {
+		parallelism int
+		expected    int
+	}{
+		{parallelism: 0, expected: 3},
+		{parallelism: 2, expected: 2},
+		{parallelism: 1, expected: 1},
+	} {
+		backend := &blockingExternalProvider{metrics: []string{"a_qps", "b_qps", "c_qps"}, value: 1, release: make(chan struct{})}
+		pm := newParallelSourcedManager(backend, c.parallelism)
+		go func() {
+			// let the queries pile up before releasing them one by one
+			for i := 0; i < 3; i++ {
+				time.Sleep(50 * time.Millisecond)
+				backend.release <- struct{}{}
+			}
+		}()
+		if value := getSourcedMetric(t, pm).Items[0].Value.Value(); value != 1 {
+			t.Errorf("parallelism %d: expected the value of the sources, got %d", c.parallelism, value)
+		}
+		if backend.peak != c.expected {
+			t.Errorf("parallelism %d: expected %d sources to be queried at a time, got %d", c.parallelism, c.expected, backend.peak)
+		}
+	}
+}
+
+func TestSourcedMetricRespectsTheDeadline(t *testing.T) {
+	backend := &blockingExternalProvider{metrics: []string{"a_qps", "b_qps", "c_qps"}, value: 1, release: make(chan struct{})}
+	pm := newParallelSourcedManager(backend, 1)
+	ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := pm.GetExternalMetric(ctx, "default", labels.Everything(), p.ExternalMetricInfo{Metric: "checkout_qps"})
+	if err == nil {
+		t.Errorf("expected no source to be resolved before the deadline")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the request to return at its deadline, it took %v", elapsed)
+	}
+}
+
+func TestSourcedMetricIsListed(t *testing.T) {
+	pm := newSourcedManager(
+		&stampedExternalProvider{metric: "cms_checkout_qps"},
+		&stampedExternalProvider{metric: "prom_checkout_qps"},
+	)
+	count := 0
+	for _, m := range pm.ListAllExternalMetrics() {
+		if m.Metric == "checkout_qps" {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("expected checkout_qps to be listed once, got %d", count)
+	}
+}
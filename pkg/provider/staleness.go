@@ -0,0 +1,61 @@
+package provider
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/metrics"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/klog/v2"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// staleValues counts the requests of each external metric answered as unavailable because a value was too old.
+var staleValues = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "adapter_external_metric_stale_values_total",
+		Help: "Requests of each external metric answered as unavailable because the data point of a value was older than --stale-metric-max-age.",
+	},
+	[]string{"metric"},
+)
+
+// stalenessCheck reports an external metric as unavailable when the data point of one of its values, whose
+// time the timestamp of the value is, is older than a maximum age, e.g. because the backend stopped ingesting
+// it. Scaling on such a value would act on a load which has long changed.
+type stalenessCheck struct {
+	clock  clock.Clock
+	maxAge time.Duration
+}
+
+// newStalenessCheck returns nil if the age of the values isn't checked.
+func newStalenessCheck(maxAge time.Duration, clock clock.Clock) *stalenessCheck {
+	if maxAge <= 0 {
+		return nil
+	}
+	utils.RegisterMetrics(staleValues)
+	return &stalenessCheck{clock: clock, maxAge: maxAge}
+}
+
+// check returns a service unavailable error if a value of the metric is older than the maximum age. The last
+// known values returned during the no data grace period of a metric are old on purpose, and aren't checked.
+func (s *stalenessCheck) check(metric string, values *external_metrics.ExternalMetricValueList) error {
+	if s == nil || values == nil {
+		return nil
+	}
+	now := s.clock.Now()
+	for _, item := range values.Items {
+		if item.MetricLabels[metrics.StaleLabel] == "true" {
+			continue
+		}
+		if age := now.Sub(item.Timestamp.Time); age > s.maxAge {
+			staleValues.WithLabelValues(metric).Inc()
+			klog.Warningf("External metric %s is unavailable, because its data point of %v is %v old", metric, item.Timestamp.Time, age.Round(time.Second))
+			return apierr.NewServiceUnavailable(fmt.Sprintf("external metric %s is unavailable: its data point of %v is older than %v",
+				metric, item.Timestamp.Time, s.maxAge))
+		}
+	}
+	return nil
+}
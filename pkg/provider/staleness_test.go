@@ -0,0 +1,58 @@
+package provider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/metrics"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+func timedValueList(timestamps ...time.Time) *external_metrics.ExternalMetricValueList {
+	list := valueList(make([]int64, len(timestamps))...)
+	for i, timestamp := range timestamps {
+		list.Items[i].Timestamp = metav1.NewTime(timestamp)
+	}
+	return list
+}
+
+func TestStalenessCheck(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	check := newStalenessCheck(5*time.Minute, fakeClock)
+	now := fakeClock.Now()
+
+	if err := check.check("slb_l7_qps", timedValueList(now.Add(-time.Minute), now.Add(-5*time.Minute))); err != nil {
+		t.Errorf("expected fresh data points to be served, got %v", err)
+	}
+
+	err := check.check("slb_l7_qps", timedValueList(now.Add(-time.Minute), now.Add(-6*time.Minute)))
+	if !apierr.IsServiceUnavailable(err) {
+		t.Errorf("expected a stale data point to make the metric unavailable, got %v", err)
+	}
+
+	// the values cached while fresh become stale too
+	values := timedValueList(now.Add(-4 * time.Minute))
+	fakeClock.Step(2 * time.Minute)
+	if err := check.check("slb_l7_qps", values); !apierr.IsServiceUnavailable(err) {
+		t.Errorf("expected a value which aged beyond the maximum age to make the metric unavailable, got %v", err)
+	}
+
+	// the last known values of the no data grace period are old on purpose
+	values.Items[0].MetricLabels[metrics.StaleLabel] = "true"
+	if err := check.check("slb_l7_qps", values); err != nil {
+		t.Errorf("expected the last known values to be served, got %v", err)
+	}
+}
+
+func TestStalenessCheckDisabled(t *testing.T) {
+	check := newStalenessCheck(0, clock.RealClock{})
+	if check != nil {
+		t.Fatalf("expected no check without a maximum age, got %+v", check)
+	}
+	if err := check.check("slb_l7_qps", timedValueList(time.Unix(0, 0))); err != nil {
+		t.Errorf("expected any data point to be served without a maximum age, got %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// ARMSSecurityTokenHeader carries the security token of STS credentials to ARMS Prometheus.
+	ARMSSecurityTokenHeader = "X-Acs-Security-Token"
+
+	// armsCredentialsRefresh is how often the credentials are read from the credential chain again.
+	// STS credentials are rotated well before they expire.
+	armsCredentialsRefresh = 5 * time.Minute
+)
+
+// CredentialProvider returns the current credentials of the Alibaba Cloud credential chain.
+type CredentialProvider func() (*AccessUserInfo, error)
+
+// armsAuthRoundTripper authenticates the requests to ARMS Prometheus with the AccessKey of the
+// credential chain as basic auth, plus the security token of STS credentials.
+type armsAuthRoundTripper struct {
+	credentials CredentialProvider
+	clock       clock.Clock
+	rt          http.RoundTripper
+
+	lock        sync.Mutex
+	current     *AccessUserInfo
+	refreshedAt time.Time
+}
+
+// NewARMSAuthRoundTripper authenticates the requests to ARMS Prometheus with the given credentials.
+func NewARMSAuthRoundTripper(credentials CredentialProvider, rt http.RoundTripper) http.RoundTripper {
+	return newARMSAuthRoundTripper(credentials, clock.RealClock{}, rt)
+}
+
+func newARMSAuthRoundTripper(credentials CredentialProvider, clock clock.Clock, rt http.RoundTripper) *armsAuthRoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &armsAuthRoundTripper{
+		credentials: credentials,
+		clock:       clock,
+		rt:          rt,
+	}
+}
+
+// accessUserInfo returns the cached credentials, and reads them again once they are due.
+// The previous credentials keep being used if the credential chain fails.
+func (rt *armsAuthRoundTripper) accessUserInfo() (*AccessUserInfo, error) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	now := rt.clock.Now()
+	if rt.current != nil && now.Sub(rt.refreshedAt) < armsCredentialsRefresh && !credentialsExpired(rt.current, now) {
+		return rt.current, nil
+	}
+
+	info, err := rt.credentials()
+	if err != nil {
+		if rt.current != nil && !credentialsExpired(rt.current, now) {
+			klog.Warningf("Failed to refresh ARMS Prometheus credentials, keep using the current ones, because of %v", err)
+			return rt.current, nil
+		}
+		return nil, fmt.Errorf("failed to get ARMS Prometheus credentials: %v", err)
+	}
+	rt.current = info
+	rt.refreshedAt = now
+	return info, nil
+}
+
+func credentialsExpired(info *AccessUserInfo, now time.Time) bool {
+	if info.Expiration == "" {
+		return false
+	}
+	expiration, err := time.Parse("2006-01-02T15:04:05Z", info.Expiration)
+	return err == nil && !now.Before(expiration)
+}
+
+func (rt *armsAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	info, err := rt.accessUserInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	// the request must not be modified by a RoundTripper
+	req = req.Clone(req.Context())
+	setARMSAuth(req.Header, info)
+	return rt.rt.RoundTrip(req)
+}
+
+// setARMSAuth sets the auth headers of a request to ARMS Prometheus.
+func setARMSAuth(header http.Header, info *AccessUserInfo) {
+	r := http.Request{Header: header}
+	r.SetBasicAuth(info.AccessKeyId, info.AccessKeySecret)
+	if info.Token != "" {
+		header.Set(ARMSSecurityTokenHeader, info.Token)
+	} else {
+		header.Del(ARMSSecurityTokenHeader)
+	}
+}
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+// requestRecorder records the last request.
+type requestRecorder struct {
+	req *http.Request
+}
+
+func (r *requestRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.req = req
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+}
+
+func sendARMSRequest(t *testing.T, rt http.RoundTripper, recorder *requestRecorder) *http.Request {
+	req, _ := http.NewRequest(http.MethodGet, "https://cn-hangzhou.arms.aliyuncs.com/api/v1/query", nil)
+	if _, err := rt.RoundTrip(req); err != nil {
+		t.Fatalf("Failed to send request, because of %v", err)
+	}
+	if req.Header.Get("Authorization") != "" {
+		t.Errorf("expected the original request to be left untouched")
+	}
+	return recorder.req
+}
+
+func TestARMSAuthWithAccessKey(t *testing.T) {
+	recorder := &requestRecorder{}
+	rt := NewARMSAuthRoundTripper(func() (*AccessUserInfo, error) {
+		return &AccessUserInfo{AccessKeyId: "LTAI-id", AccessKeySecret: "secret"}, nil
+	}, recorder)
+
+	req := sendARMSRequest(t, rt, recorder)
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte("LTAI-id:secret"))
+	if auth := req.Header.Get("Authorization"); auth != expected {
+		t.Errorf("expected basic auth with the access key, got %q", auth)
+	}
+	if token := req.Header.Get(ARMSSecurityTokenHeader); token != "" {
+		t.Errorf("expected no security token for an access key, got %q", token)
+	}
+}
+
+func TestARMSAuthWithSTSToken(t *testing.T) {
+	recorder := &requestRecorder{}
+	rt := NewARMSAuthRoundTripper(func() (*AccessUserInfo, error) {
+		return &AccessUserInfo{AccessKeyId: "STS.id", AccessKeySecret: "secret", Token: "security-token"}, nil
+	}, recorder)
+
+	req := sendARMSRequest(t, rt, recorder)
+	user, password, ok := req.BasicAuth()
+	if !ok || user != "STS.id" || password != "secret" {
+		t.Errorf("expected basic auth with the sts access key, got %q %q", user, password)
+	}
+	if token := req.Header.Get(ARMSSecurityTokenHeader); token != "security-token" {
+		t.Errorf("expected the security token to be sent, got %q", token)
+	}
+}
+
+func TestARMSAuthRefreshesCredentials(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC))
+	calls := 0
+	var failure error
+	recorder := &requestRecorder{}
+	rt := newARMSAuthRoundTripper(func() (*AccessUserInfo, error) {
+		if failure != nil {
+			return nil, failure
+		}
+		calls++
+		return &AccessUserInfo{AccessKeyId: "STS.id", AccessKeySecret: "secret", Token: "token", Expiration: "2021-05-01T11:00:00Z"}, nil
+	}, fakeClock, recorder)
+
+	sendARMSRequest(t, rt, recorder)
+	sendARMSRequest(t, rt, recorder)
+	if calls != 1 {
+		t.Errorf("expected the credentials to be cached, got %d reads", calls)
+	}
+
+	fakeClock.Step(armsCredentialsRefresh)
+	sendARMSRequest(t, rt, recorder)
+	if calls != 2 {
+		t.Errorf("expected the credentials to be read again after the refresh interval, got %d reads", calls)
+	}
+
+	// a failing credential chain keeps the current credentials until they expire
+	failure = errors.New("metadata server unavailable")
+	fakeClock.Step(armsCredentialsRefresh)
+	if req := sendARMSRequest(t, rt, recorder); req.Header.Get(ARMSSecurityTokenHeader) != "token" {
+		t.Errorf("expected the current credentials to be kept")
+	}
+
+	fakeClock.Step(time.Hour)
+	req, _ := http.NewRequest(http.MethodGet, "https://cn-hangzhou.arms.aliyuncs.com/api/v1/query", nil)
+	if _, err := rt.RoundTrip(req); err == nil {
+		t.Errorf("expected expired credentials not to be used")
+	}
+}
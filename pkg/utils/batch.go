@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"context"
+	"sync"
+)
+
+const (
+	// DefaultCMSBatchSize is the number of instances queried by a single CMS call.
+	DefaultCMSBatchSize = 10
+	// DefaultCMSConcurrency is the number of CMS calls a single metric request runs in parallel.
+	DefaultCMSConcurrency = 4
+)
+
+var (
+	cmsBatchLock   sync.RWMutex
+	cmsBatchSize   = DefaultCMSBatchSize
+	cmsConcurrency = DefaultCMSConcurrency
+)
+
+// SetCMSBatching sets how many instances are queried per CMS call and how many calls run
+// in parallel. Values below 1 fall back to 1.
+func SetCMSBatching(batchSize, concurrency int) {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	cmsBatchLock.Lock()
+	defer cmsBatchLock.Unlock()
+	cmsBatchSize = batchSize
+	cmsConcurrency = concurrency
+}
+
+// CMSBatching returns the batch size and the concurrency of the CMS multi-instance queries.
+func CMSBatching() (batchSize, concurrency int) {
+	cmsBatchLock.RLock()
+	defer cmsBatchLock.RUnlock()
+	return cmsBatchSize, cmsConcurrency
+}
+
+// RunBatches splits the items into batches of batchSize and calls fn on them with at most
+// concurrency calls at a time. It returns the first error, and cancels the context of the
+// remaining calls once a call failed.
+func RunBatches(ctx context.Context, items []string, batchSize, concurrency int, fn func(ctx context.Context, batch []string) error) error {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	slots := make(chan struct{}, concurrency)
+	for start := 0; start < len(items); start += batchSize {
+		end := start + batchSize
+		if end > len(items) {
+			end = len(items)
+		}
+		batch := items[start:end]
+
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if err := ctx.Err(); err != nil {
+			once.Do(func() { firstErr = err })
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := fn(ctx, batch); err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
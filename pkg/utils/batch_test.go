@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunBatches(t *testing.T) {
+	items := []string{"a", "b", "c", "d", "e", "f", "g"}
+
+	var lock sync.Mutex
+	var batches []string
+	var running, maxRunning int32
+	err := RunBatches(context.TODO(), items, 3, 2, func(_ context.Context, batch []string) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		lock.Lock()
+		defer lock.Unlock()
+		batches = append(batches, strings.Join(batch, ""))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to run batches, because of %v", err)
+	}
+
+	sort.Strings(batches)
+	if strings.Join(batches, ",") != "abc,def,g" {
+		t.Errorf("expected the items to be split into batches of 3, got %v", batches)
+	}
+	if maxRunning > 2 {
+		t.Errorf("expected at most 2 batches at a time, got %d", maxRunning)
+	}
+}
+
+func TestRunBatchesError(t *testing.T) {
+	items := []string{"a", "b", "c", "d"}
+	failure := errors.New("throttled")
+
+	var calls int32
+	err := RunBatches(context.TODO(), items, 1, 1, func(ctx context.Context, batch []string) error {
+		atomic.AddInt32(&calls, 1)
+		if batch[0] == "b" {
+			return failure
+		}
+		return nil
+	})
+	if err != failure {
+		t.Errorf("expected the error of the failed batch, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("expected no batch to be started after the failure, got %d calls", calls)
+	}
+}
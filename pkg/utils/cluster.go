@@ -0,0 +1,43 @@
+package utils
+
+import "sync/atomic"
+
+const (
+	// ClusterIDEnv is the environment variable the cluster ID is read from unless --cluster-id is set,
+	// e.g. filled from a ConfigMap by the deployment.
+	ClusterIDEnv = "CLUSTER_ID"
+	// ClusterDimension is the CMS dimension which scopes a custom metric to a cluster.
+	ClusterDimension = "clusterId"
+)
+
+var (
+	clusterID        atomic.Value
+	defaultNamespace atomic.Value
+)
+
+// SetClusterID sets the ID of the ACK cluster the adapter runs in, which scopes the CMS queries
+// to that cluster when an account monitors several clusters. An empty ID doesn't scope them.
+func SetClusterID(id string) {
+	clusterID.Store(id)
+}
+
+// ClusterID returns the ID of the cluster the CMS queries are scoped to, empty if they aren't.
+func ClusterID() string {
+	id, _ := clusterID.Load().(string)
+	return id
+}
+
+// SetDefaultNamespace sets the namespace the CMS queries map a request without a namespace to, e.g. a
+// request of an external metric outside of any namespace. An empty namespace leaves them without one.
+func SetDefaultNamespace(namespace string) {
+	defaultNamespace.Store(namespace)
+}
+
+// NamespaceOrDefault returns the namespace of a request, or the default one if the request has none.
+func NamespaceOrDefault(namespace string) string {
+	if namespace != "" {
+		return namespace
+	}
+	namespace, _ = defaultNamespace.Load().(string)
+	return namespace
+}
@@ -0,0 +1,26 @@
+package utils
+
+// The APIs of CMS the custom metrics are queried with.
+const (
+	// CMSMetricListAPI is DescribeMetricList, which serves the metrics pushed to the custom monitoring.
+	CMSMetricListAPI = "metricList"
+	// CMSHybridAPI is DescribeHybridMonitorDataList, which serves the metrics reported to a namespace of
+	// the hybrid monitoring, which DescribeMetricList returns no data for.
+	CMSHybridAPI = "hybrid"
+)
+
+// CMSCustomMetricPrefix prefixes the names of the external metrics served from CMS custom metrics.
+const CMSCustomMetricPrefix = "cms_custom_"
+
+// CMSAPIs are the supported APIs, the first one is the default.
+var CMSAPIs = []string{CMSMetricListAPI, CMSHybridAPI}
+
+// IsCMSAPI tells whether the api is one of CMSAPIs.
+func IsCMSAPI(api string) bool {
+	for _, a := range CMSAPIs {
+		if a == api {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultCMSDimensionSchemaTTL is how long the dimensions of a CMS metric are cached unless configured otherwise.
+// The dimensions a metric is pushed with rarely change.
+const DefaultCMSDimensionSchemaTTL = time.Hour
+
+var (
+	cmsDimensionDiscoveryLock sync.RWMutex
+	cmsDimensionDiscovery     bool
+	cmsDimensionSchemaTTL     = DefaultCMSDimensionSchemaTTL
+)
+
+// SetCMSDimensionDiscovery makes the labels of the selectors of the CMS custom metrics which are neither a
+// parameter nor translated be mapped to the dimensions of the same name the metadata of the metric lists,
+// which are cached for the ttl.
+func SetCMSDimensionDiscovery(enabled bool, ttl time.Duration) {
+	cmsDimensionDiscoveryLock.Lock()
+	defer cmsDimensionDiscoveryLock.Unlock()
+	cmsDimensionDiscovery = enabled
+	cmsDimensionSchemaTTL = ttl
+}
+
+// CMSDimensionDiscovery tells whether the labels are mapped to the dimensions of the metadata, and how long
+// the dimensions of a metric are cached.
+func CMSDimensionDiscovery() (bool, time.Duration) {
+	cmsDimensionDiscoveryLock.RLock()
+	defer cmsDimensionDiscoveryLock.RUnlock()
+	return cmsDimensionDiscovery, cmsDimensionSchemaTTL
+}
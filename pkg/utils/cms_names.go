@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// cmsNameEncoding is 1 when the names of the CMS custom metrics are encoded with EncodeCMSName.
+var cmsNameEncoding int32
+
+// SetCMSNameEncoding makes the CMS custom metrics be listed under their names encoded with EncodeCMSName,
+// and decodes the names of the requests, instead of using the names of CMS as is.
+func SetCMSNameEncoding(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&cmsNameEncoding, v)
+}
+
+// CMSNameEncoding tells whether the names of the CMS custom metrics are encoded.
+func CMSNameEncoding() bool {
+	return atomic.LoadInt32(&cmsNameEncoding) == 1
+}
+
+// EncodeCMSName encodes a name of CMS, e.g. the dotted name of a custom metric like cpu.usage, into a name
+// the external metrics may have, which DecodeCMSName turns back into the name of CMS. Each dot becomes a
+// double underscore, e.g. cpu__usage, and the other characters are kept. The names which wouldn't decode
+// back are rejected: the ones with characters other than letters, digits, underscores, dots and dashes,
+// with a double underscore, or with an underscore next to a dot.
+func EncodeCMSName(name string) (string, error) {
+	for _, c := range name {
+		if !isCMSNameChar(c) {
+			return "", fmt.Errorf("CMS name %q has the unsupported character %q", name, c)
+		}
+	}
+	if strings.Contains(name, "__") || strings.Contains(name, "_.") || strings.Contains(name, "._") {
+		return "", fmt.Errorf("CMS name %q can't be encoded, it has a double underscore or an underscore next to a dot", name)
+	}
+	return strings.Replace(name, ".", "__", -1), nil
+}
+
+// DecodeCMSName decodes a name encoded by EncodeCMSName: a single underscore stays an underscore and each
+// pair of underscores becomes a dot. A name with dots is returned as is, it isn't encoded.
+func DecodeCMSName(encoded string) (string, error) {
+	if strings.Contains(encoded, ".") {
+		return encoded, nil
+	}
+	var decoded strings.Builder
+	for i := 0; i < len(encoded); {
+		if encoded[i] != '_' {
+			decoded.WriteByte(encoded[i])
+			i++
+			continue
+		}
+		run := 0
+		for ; i+run < len(encoded) && encoded[i+run] == '_'; run++ {
+		}
+		switch {
+		case run == 1:
+			decoded.WriteByte('_')
+		case run%2 == 0:
+			decoded.WriteString(strings.Repeat(".", run/2))
+		default:
+			return "", fmt.Errorf("%q is not an encoded CMS name, it has %d underscores in a row", encoded, run)
+		}
+		i += run
+	}
+	return decoded.String(), nil
+}
+
+func isCMSNameChar(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.' || c == '-'
+}
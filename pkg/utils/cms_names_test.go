@@ -0,0 +1,44 @@
+package utils
+
+import "testing"
+
+func TestCMSNameRoundTrip(t *testing.T) {
+	for name, expected := range map[string]string{
+		"acs_rds_dashboard.CpuUsage": "acs_rds_dashboard__CpuUsage",
+		"cpu.usage":                  "cpu__usage",
+		"group.cpu.usage_rate":       "group__cpu__usage_rate",
+		"http..requests":             "http____requests",
+		"queue-length.p99":           "queue-length__p99",
+		".leading.trailing.":         "__leading__trailing__",
+		"qps":                        "qps",
+	} {
+		encoded, err := EncodeCMSName(name)
+		if err != nil {
+			t.Errorf("Failed to encode %q, because of %v", name, err)
+			continue
+		}
+		if encoded != expected {
+			t.Errorf("expected %q to be encoded as %q, got %q", name, expected, encoded)
+		}
+		decoded, err := DecodeCMSName(encoded)
+		if err != nil || decoded != name {
+			t.Errorf("expected %q to decode back to %q, got %q (%v)", encoded, name, decoded, err)
+		}
+	}
+}
+
+func TestCMSNameUnsupported(t *testing.T) {
+	// these wouldn't decode back to themselves
+	for _, name := range []string{"cpu__usage", "cpu_.usage", "cpu._usage", "cpu usage", "cpu/usage"} {
+		if encoded, err := EncodeCMSName(name); err == nil {
+			t.Errorf("expected %q to be rejected, got %q", name, encoded)
+		}
+	}
+	if _, err := DecodeCMSName("cpu___usage"); err == nil {
+		t.Errorf("expected an odd run of underscores to be rejected")
+	}
+	// the dotted names of the requests which predate the encoding are served as is
+	if decoded, err := DecodeCMSName("cpu.usage"); err != nil || decoded != "cpu.usage" {
+		t.Errorf("expected a dotted name to be kept, got %q (%v)", decoded, err)
+	}
+}
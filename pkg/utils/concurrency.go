@@ -0,0 +1,261 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultBackendConcurrency are the numbers of calls each backend serves at a time. Prometheus
+// copes with far more parallel queries than the throttled Alibaba Cloud apis.
+var DefaultBackendConcurrency = map[Backend]int{
+	PrometheusBackend: 100,
+	CMSBackend:        10,
+	SLSBackend:        10,
+	AHASBackend:       10,
+}
+
+// backendSaturation is the share of the concurrency limit of each backend which is in use.
+var backendSaturation = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "adapter_backend_concurrency_saturation",
+		Help: "Share of the concurrent calls allowed to each backend which are in flight, 1 when calls are waiting for a slot.",
+	},
+	[]string{"backend"},
+)
+
+// backendQueueWait is how long the calls for each metric waited for a slot of their backend.
+var backendQueueWait = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "adapter_backend_queue_wait_seconds",
+		Help:    "Time the calls to each backend waited for a slot of its concurrency limit, by metric.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	},
+	[]string{"backend", "metric"},
+)
+
+// backendLimit is the semaphore of a backend, a limit of 0 meaning no limit. When the scheduling is
+// fair, the freed slots are handed out to the waiting calls by fair, otherwise to any of them.
+type backendLimit struct {
+	limit int
+	slots chan struct{}
+	fair  *fairQueue
+}
+
+var (
+	backendLimitsLock sync.RWMutex
+	backendLimits     = make(map[Backend]*backendLimit)
+	// fairScheduling tells whether the limits created from now on are fair
+	fairScheduling bool
+)
+
+func init() {
+	RegisterMetrics(backendSaturation, backendQueueWait)
+	for backend, limit := range DefaultBackendConcurrency {
+		SetBackendConcurrency(backend, limit)
+	}
+}
+
+// SetBackendConcurrency sets how many calls to the given backend may run at a time. A limit
+// of zero lets any number run. The calls which are in flight keep counting against the old limit.
+func SetBackendConcurrency(backend Backend, limit int) {
+	backendLimitsLock.Lock()
+	defer backendLimitsLock.Unlock()
+	setBackendConcurrency(backend, limit)
+}
+
+func setBackendConcurrency(backend Backend, limit int) {
+	l := &backendLimit{}
+	if limit > 0 {
+		l.limit = limit
+		if fairScheduling {
+			l.fair = newFairQueue()
+		} else {
+			l.slots = make(chan struct{}, limit)
+		}
+	}
+	backendLimits[backend] = l
+	backendSaturation.WithLabelValues(string(backend)).Set(0)
+}
+
+// SetBackendFairScheduling makes the calls waiting for a slot of a backend take turns by metric, so that
+// a metric making many calls doesn't hold the calls of the others back. The calls of a metric are served
+// in the order they came. It resets the limits of all the backends.
+func SetBackendFairScheduling(enabled bool) {
+	backendLimitsLock.Lock()
+	defer backendLimitsLock.Unlock()
+	fairScheduling = enabled
+	for backend, l := range backendLimits {
+		setBackendConcurrency(backend, l.limit)
+	}
+}
+
+// AcquireBackend waits until a call to the given backend may run, or the context is done.
+// The returned function has to be called once the call has returned, which also reports
+// the call to the slow query log.
+func AcquireBackend(ctx context.Context, backend Backend) (func(), error) {
+	backendLimitsLock.RLock()
+	l := backendLimits[backend]
+	backendLimitsLock.RUnlock()
+	limited := l != nil && l.limit > 0
+
+	if limited {
+		q, _ := ctx.Value(queryKey{}).(query)
+		waitStart := time.Now()
+		if err := l.acquire(ctx, backend, q.metric); err != nil {
+			return nil, fmt.Errorf("too many concurrent calls to %s: %w", backend, err)
+		}
+		backendQueueWait.WithLabelValues(string(backend), q.metric).Observe(time.Since(waitStart).Seconds())
+	}
+
+	// the wait for a slot isn't part of the duration of the call
+	start := time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if limited {
+				l.release(backend)
+			}
+			observeQuery(ctx, backend, time.Since(start))
+		})
+	}, nil
+}
+
+func (l *backendLimit) acquire(ctx context.Context, backend Backend, metric string) error {
+	if l.fair != nil {
+		return l.fair.acquire(ctx, backend, metric, l.limit)
+	}
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		// all the slots are taken, the call has to wait for one
+		backendSaturation.WithLabelValues(string(backend)).Set(1)
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	backendSaturation.WithLabelValues(string(backend)).Set(float64(len(l.slots)) / float64(l.limit))
+	return nil
+}
+
+func (l *backendLimit) release(backend Backend) {
+	if l.fair != nil {
+		l.fair.release(backend, l.limit)
+		return
+	}
+	<-l.slots
+	backendSaturation.WithLabelValues(string(backend)).Set(float64(len(l.slots)) / float64(l.limit))
+}
+
+// fairQueue hands the freed slots of a backend out to the metrics with waiting calls in turn,
+// one call of each metric at a time.
+type fairQueue struct {
+	lock     sync.Mutex
+	inFlight int
+	// waiting are the calls waiting for a slot by metric, the first one served first
+	waiting map[string][]chan struct{}
+	// turns are the metrics with waiting calls, the one whose turn is next first
+	turns []string
+}
+
+func newFairQueue() *fairQueue {
+	return &fairQueue{waiting: make(map[string][]chan struct{})}
+}
+
+func (q *fairQueue) acquire(ctx context.Context, backend Backend, metric string, limit int) error {
+	q.lock.Lock()
+	if q.inFlight < limit && len(q.turns) == 0 {
+		q.inFlight++
+		q.observe(backend, limit)
+		q.lock.Unlock()
+		return nil
+	}
+	// the slot is handed over by the call releasing it, the channel doesn't block it
+	granted := make(chan struct{}, 1)
+	if len(q.waiting[metric]) == 0 {
+		q.turns = append(q.turns, metric)
+	}
+	q.waiting[metric] = append(q.waiting[metric], granted)
+	q.observe(backend, limit)
+	q.lock.Unlock()
+
+	select {
+	case <-granted:
+		return nil
+	case <-ctx.Done():
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	select {
+	case <-granted:
+		// the slot was handed over meanwhile, it goes to the next call
+		q.handOver(backend, limit)
+	default:
+		q.remove(metric, granted)
+		q.observe(backend, limit)
+	}
+	return ctx.Err()
+}
+
+func (q *fairQueue) release(backend Backend, limit int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.handOver(backend, limit)
+}
+
+// handOver gives the slot of a finished call to the first call of the metric whose turn it is,
+// which then waits for its next turn if it has more calls waiting.
+func (q *fairQueue) handOver(backend Backend, limit int) {
+	if len(q.turns) == 0 {
+		q.inFlight--
+		q.observe(backend, limit)
+		return
+	}
+	metric := q.turns[0]
+	q.turns = q.turns[1:]
+	waiting := q.waiting[metric]
+	waiting[0] <- struct{}{}
+	if len(waiting) > 1 {
+		q.waiting[metric] = waiting[1:]
+		q.turns = append(q.turns, metric)
+	} else {
+		delete(q.waiting, metric)
+	}
+	q.observe(backend, limit)
+}
+
+// remove drops a call which stopped waiting.
+func (q *fairQueue) remove(metric string, granted chan struct{}) {
+	waiting := q.waiting[metric]
+	for i, c := range waiting {
+		if c == granted {
+			waiting = append(waiting[:i:i], waiting[i+1:]...)
+			break
+		}
+	}
+	if len(waiting) > 0 {
+		q.waiting[metric] = waiting
+		return
+	}
+	delete(q.waiting, metric)
+	for i, m := range q.turns {
+		if m == metric {
+			q.turns = append(q.turns[:i:i], q.turns[i+1:]...)
+			break
+		}
+	}
+}
+
+func (q *fairQueue) observe(backend Backend, limit int) {
+	if len(q.turns) > 0 {
+		backendSaturation.WithLabelValues(string(backend)).Set(1)
+		return
+	}
+	backendSaturation.WithLabelValues(string(backend)).Set(float64(q.inFlight) / float64(limit))
+}
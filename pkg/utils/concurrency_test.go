@@ -0,0 +1,223 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	pmodel "github.com/prometheus/common/model"
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+// withConcurrency sets the backend concurrency limits for the duration of a test.
+func withConcurrency(t *testing.T, limits map[Backend]int) {
+	for backend, limit := range limits {
+		SetBackendConcurrency(backend, limit)
+		backend := backend
+		t.Cleanup(func() { SetBackendConcurrency(backend, DefaultBackendConcurrency[backend]) })
+	}
+}
+
+func acquire(t *testing.T, backend Backend) func() {
+	release, err := AcquireBackend(context.TODO(), backend)
+	if err != nil {
+		t.Fatalf("Failed to acquire a slot of %s, because of %v", backend, err)
+	}
+	return release
+}
+
+func saturation(backend Backend) float64 {
+	return testutil.ToFloat64(backendSaturation.WithLabelValues(string(backend)))
+}
+
+func TestBackendConcurrencyLimitsAreIndependent(t *testing.T) {
+	withConcurrency(t, map[Backend]int{PrometheusBackend: 3, CMSBackend: 1})
+
+	cmsRelease := acquire(t, CMSBackend)
+	if saturation(CMSBackend) != 1 {
+		t.Errorf("expected CMS to be saturated, got %v", saturation(CMSBackend))
+	}
+
+	// CMS is saturated, which doesn't hold the Prometheus calls back
+	var releases []func()
+	for i := 0; i < 3; i++ {
+		releases = append(releases, acquire(t, PrometheusBackend))
+	}
+	if saturation(PrometheusBackend) != 1 {
+		t.Errorf("expected Prometheus to be saturated, got %v", saturation(PrometheusBackend))
+	}
+
+	// the calls over the limit wait until the context is done
+	for _, backend := range []Backend{PrometheusBackend, CMSBackend} {
+		ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+		_, err := AcquireBackend(ctx, backend)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected the call to %s to wait for a slot, got %v", backend, err)
+		}
+	}
+
+	// a released slot serves the next call, releasing twice doesn't free another one
+	cmsRelease()
+	cmsRelease()
+	if saturation(CMSBackend) != 0 {
+		t.Errorf("expected no CMS call in flight, got %v", saturation(CMSBackend))
+	}
+	release := acquire(t, CMSBackend)
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := AcquireBackend(ctx, CMSBackend); err == nil {
+		t.Errorf("expected the limit of CMS to still be 1")
+	}
+	release()
+
+	releases[0]()
+	if s := saturation(PrometheusBackend); s < 0.66 || s > 0.67 {
+		t.Errorf("expected 2 of 3 Prometheus slots in use, got %v", s)
+	}
+	for _, release := range releases[1:] {
+		release()
+	}
+}
+
+func TestBackendConcurrencyWithoutLimit(t *testing.T) {
+	withConcurrency(t, map[Backend]int{SLSBackend: 0})
+	for i := 0; i < 1000; i++ {
+		acquire(t, SLSBackend)
+	}
+}
+
+// withFairScheduling enables the fair scheduling of the backends for the duration of a test.
+func withFairScheduling(t *testing.T) {
+	SetBackendFairScheduling(true)
+	t.Cleanup(func() { SetBackendFairScheduling(false) })
+}
+
+// waitForWaitingCalls waits until n calls wait for a slot of the backend.
+func waitForWaitingCalls(t *testing.T, backend Backend, n int) {
+	backendLimitsLock.RLock()
+	q := backendLimits[backend].fair
+	backendLimitsLock.RUnlock()
+	for i := 0; i < 1000; i++ {
+		q.lock.Lock()
+		waiting := 0
+		for _, calls := range q.waiting {
+			waiting += len(calls)
+		}
+		q.lock.Unlock()
+		if waiting == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d calls waiting for a slot of %s", n, backend)
+}
+
+type servedCall struct {
+	metric  string
+	release func()
+}
+
+func TestBackendFairScheduling(t *testing.T) {
+	withFairScheduling(t)
+	withConcurrency(t, map[Backend]int{CMSBackend: 1})
+
+	held := acquire(t, CMSBackend)
+	served := make(chan servedCall)
+	call := func(metric string) {
+		release, err := AcquireBackend(WithQuery(context.TODO(), metric, ""), CMSBackend)
+		if err != nil {
+			t.Errorf("Failed to acquire a slot for %s, because of %v", metric, err)
+			return
+		}
+		served <- servedCall{metric: metric, release: release}
+	}
+	// the greedy metric queues its calls before the light one
+	for i := 1; i <= 5; i++ {
+		go call("greedy")
+		waitForWaitingCalls(t, CMSBackend, i)
+	}
+	go call("light")
+	waitForWaitingCalls(t, CMSBackend, 6)
+	if saturation(CMSBackend) != 1 {
+		t.Errorf("expected CMS to be saturated, got %v", saturation(CMSBackend))
+	}
+
+	held()
+	var order []string
+	for i := 0; i < 6; i++ {
+		c := <-served
+		order = append(order, c.metric)
+		c.release()
+	}
+	// the light metric gets its turn right after the first greedy call rather than after all of them
+	expected := []string{"greedy", "light", "greedy", "greedy", "greedy", "greedy"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("expected the calls to be served in order %v, got %v", expected, order)
+	}
+	if saturation(CMSBackend) != 0 {
+		t.Errorf("expected no CMS call in flight, got %v", saturation(CMSBackend))
+	}
+	if count := testutil.CollectAndCount(backendQueueWait); count < 2 {
+		t.Errorf("expected the queue wait of both metrics, got %d series", count)
+	}
+}
+
+func TestBackendFairSchedulingCanceledCall(t *testing.T) {
+	withFairScheduling(t)
+	withConcurrency(t, map[Backend]int{CMSBackend: 1})
+
+	held := acquire(t, CMSBackend)
+	ctx, cancel := context.WithTimeout(WithQuery(context.TODO(), "greedy", ""), 10*time.Millisecond)
+	defer cancel()
+	if _, err := AcquireBackend(ctx, CMSBackend); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the call to wait for a slot, got %v", err)
+	}
+	// the canceled call doesn't wait anymore, the freed slot is available to the next one
+	waitForWaitingCalls(t, CMSBackend, 0)
+	held()
+	acquire(t, CMSBackend)()
+	if saturation(CMSBackend) != 0 {
+		t.Errorf("expected no CMS call in flight, got %v", saturation(CMSBackend))
+	}
+}
+
+// heldQueryClient holds the queries until it's unblocked.
+type heldQueryClient struct {
+	fakeHAClient
+	started chan struct{}
+	unblock chan struct{}
+}
+
+func (c *heldQueryClient) Query(ctx context.Context, t pmodel.Time, query prom.Selector) (prom.QueryResult, error) {
+	c.started <- struct{}{}
+	<-c.unblock
+	return prom.QueryResult{}, nil
+}
+
+func TestTimeoutClientLimitsConcurrency(t *testing.T) {
+	withConcurrency(t, map[Backend]int{PrometheusBackend: 1})
+	blocking := &heldQueryClient{started: make(chan struct{}, 1), unblock: make(chan struct{})}
+	client := NewTimeoutClient(blocking, PrometheusBackend)
+
+	done := make(chan error)
+	go func() {
+		_, err := client.Query(context.TODO(), pmodel.Now(), "up")
+		done <- err
+	}()
+	<-blocking.started
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := client.Query(ctx, pmodel.Now(), "up"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the second query to wait for the first one, got %v", err)
+	}
+
+	close(blocking.unblock)
+	if err := <-done; err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
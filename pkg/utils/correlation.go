@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+// DefaultCorrelationHeader is the header of the requests to Prometheus which carries the correlation ID
+// unless configured otherwise.
+const DefaultCorrelationHeader = "X-Request-Id"
+
+// CorrelationID returns the ID which correlates the backend calls with the metric request of ctx: its audit ID,
+// which the apiserver reads from the Audit-ID header of the request or generates. A call made outside of a
+// request, e.g. by a relist, gets a new ID.
+func CorrelationID(ctx context.Context) string {
+	if id, found := request.AuditIDFrom(ctx); found && id != "" {
+		return string(id)
+	}
+	return string(uuid.NewUUID())
+}
+
+// correlatingGenericClient sets the correlation ID of the context of each call on its request, and aborts the
+// request once the context is done.
+type correlatingGenericClient struct {
+	client  *http.Client
+	baseURL *url.URL
+	headers http.Header
+	header  string
+}
+
+// NewCorrelatingGenericAPIClient creates the client of the Prometheus at baseURL which sets the correlation ID of
+// each call in the header, so that a scaling decision can be traced through the logs of Prometheus. An empty header
+// doesn't set any. The client of prometheus-adapter doesn't pass the context of a call to its request, so the ID is
+// set here rather than by a round tripper, and the context is applied by the transport of each call: a request the
+// apiserver cancels, or whose backend timeout expires, aborts its query rather than waiting for Prometheus.
+func NewCorrelatingGenericAPIClient(client *http.Client, baseURL *url.URL, headers http.Header, header string) prom.GenericAPIClient {
+	return &correlatingGenericClient{
+		client:  client,
+		baseURL: baseURL,
+		headers: headers,
+		header:  header,
+	}
+}
+
+func (c *correlatingGenericClient) Do(ctx context.Context, verb, endpoint string, query url.Values) (prom.APIResponse, error) {
+	headers := c.headers
+	if c.header != "" {
+		// the headers are shared by the requests of the client, each call gets its own copy
+		headers = c.headers.Clone()
+		if headers == nil {
+			headers = make(http.Header, 1)
+		}
+		headers.Set(c.header, CorrelationID(ctx))
+	}
+	client, cancel := clientWithContext(ctx, c.client)
+	defer cancel()
+	return prom.NewGenericAPIClient(client, c.baseURL, headers).Do(ctx, verb, endpoint, query)
+}
+
+// contextTransport sends the requests with its context instead of theirs.
+type contextTransport struct {
+	ctx       context.Context
+	transport http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.transport.RoundTrip(req.WithContext(t.ctx))
+}
+
+// clientWithContext returns a copy of the client which sends its requests with ctx, sharing the connections of the
+// client. The timeout of the client bounds ctx instead, as the client only applies it to the context of the request.
+// The responses must have been read before the context is cancelled.
+func clientWithContext(ctx context.Context, client *http.Client) (*http.Client, context.CancelFunc) {
+	cancel := context.CancelFunc(func() {})
+	withContext := *client
+	if client.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, client.Timeout)
+		withContext.Timeout = 0
+	}
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	withContext.Transport = &contextTransport{ctx: ctx, transport: transport}
+	return &withContext, cancel
+}
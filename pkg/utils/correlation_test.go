@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+func TestCorrelatingGenericAPIClient(t *testing.T) {
+	received := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer server.Close()
+	baseURL, _ := url.Parse(server.URL)
+	headers := http.Header{"Authorization": []string{"Bearer token"}}
+
+	client := NewCorrelatingGenericAPIClient(server.Client(), baseURL, headers, DefaultCorrelationHeader)
+	ctx := request.WithAuditID(context.Background(), types.UID("4c9e6b3c-hpa"))
+	if _, err := client.Do(ctx, http.MethodGet, "/api/v1/query", url.Values{"query": []string{"up"}}); err != nil {
+		t.Fatalf("Failed to query, because of %v", err)
+	}
+	sent := <-received
+	if id := sent.Get(DefaultCorrelationHeader); id != "4c9e6b3c-hpa" {
+		t.Errorf("Expected the audit ID of the request in %s, got %q", DefaultCorrelationHeader, id)
+	}
+	if sent.Get("Authorization") != "Bearer token" {
+		t.Errorf("Expected the configured headers to be sent too, got %v", sent)
+	}
+	if headers.Get(DefaultCorrelationHeader) != "" {
+		t.Errorf("Expected the configured headers to be left unchanged, got %v", headers)
+	}
+
+	// a call outside of a request gets a new ID every time
+	var ids []string
+	for i := 0; i < 2; i++ {
+		if _, err := client.Do(context.Background(), http.MethodGet, "/api/v1/query", nil); err != nil {
+			t.Fatalf("Failed to query, because of %v", err)
+		}
+		ids = append(ids, (<-received).Get(DefaultCorrelationHeader))
+	}
+	if ids[0] == "" || ids[0] == ids[1] {
+		t.Errorf("Expected a new ID for each call without a request, got %v", ids)
+	}
+
+	client = NewCorrelatingGenericAPIClient(server.Client(), baseURL, headers, "")
+	if _, err := client.Do(ctx, http.MethodGet, "/api/v1/query", nil); err != nil {
+		t.Fatalf("Failed to query, because of %v", err)
+	}
+	if id := (<-received).Get(DefaultCorrelationHeader); id != "" {
+		t.Errorf("Expected no correlation ID without a header, got %q", id)
+	}
+}
+
+func TestCorrelatingGenericAPIClientAbortsCancelledCalls(t *testing.T) {
+	started := make(chan struct{}, 1)
+	aborted := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		select {
+		case <-r.Context().Done():
+			aborted <- struct{}{}
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer server.Close()
+	baseURL, _ := url.Parse(server.URL)
+	client := NewCorrelatingGenericAPIClient(server.Client(), baseURL, nil, DefaultCorrelationHeader)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Do(ctx, http.MethodGet, "/api/v1/query", url.Values{"query": []string{"up"}})
+		done <- err
+	}()
+	<-started
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected the call to fail with the cancellation, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the call to return once its context is cancelled")
+	}
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the request to Prometheus to be aborted")
+	}
+
+	// the timeout of the client still applies
+	timed := server.Client()
+	timed.Timeout = 100 * time.Millisecond
+	client = NewCorrelatingGenericAPIClient(timed, baseURL, nil, "")
+	if _, err := client.Do(context.Background(), http.MethodGet, "/api/v1/query", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the call to time out, got %v", err)
+	}
+	<-started
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the request to Prometheus to be aborted once it timed out")
+	}
+}
@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"context"
+
+	pmodel "github.com/prometheus/common/model"
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+// DefaultReplicaLabels are the labels HA Prometheus pairs usually attach to tell replicas apart.
+var DefaultReplicaLabels = []string{"replica", "prometheus_replica"}
+
+// deduplicatingClient is a client.Client which strips the replica labels of an HA
+// Prometheus pair from every result and collapses the series that became identical,
+// so that both replicas are not listed twice. The aggregations of the rules only count
+// the replicas once if their queries collapse them, see config.WithReplicaDedup.
+type deduplicatingClient struct {
+	client        prom.Client
+	replicaLabels []pmodel.LabelName
+}
+
+func (c *deduplicatingClient) Series(ctx context.Context, interval pmodel.Interval, selectors ...prom.Selector) ([]prom.Series, error) {
+	series, err := c.client.Series(ctx, interval, selectors...)
+	if err != nil {
+		return series, err
+	}
+
+	seen := make(map[pmodel.Fingerprint]struct{}, len(series))
+	res := make([]prom.Series, 0, len(series))
+	for _, s := range series {
+		labels := c.stripLabels(pmodel.Metric(s.Labels))
+		withName := labels.Clone()
+		withName[pmodel.MetricNameLabel] = pmodel.LabelValue(s.Name)
+		fp := withName.Fingerprint()
+		if _, found := seen[fp]; found {
+			continue
+		}
+		seen[fp] = struct{}{}
+		res = append(res, prom.Series{
+			Name:   s.Name,
+			Labels: pmodel.LabelSet(labels),
+		})
+	}
+	return res, nil
+}
+
+func (c *deduplicatingClient) Query(ctx context.Context, t pmodel.Time, query prom.Selector) (prom.QueryResult, error) {
+	res, err := c.client.Query(ctx, t, query)
+	if err != nil {
+		return res, err
+	}
+	return c.deduplicate(res), nil
+}
+
+func (c *deduplicatingClient) QueryRange(ctx context.Context, r prom.Range, query prom.Selector) (prom.QueryResult, error) {
+	res, err := c.client.QueryRange(ctx, r, query)
+	if err != nil {
+		return res, err
+	}
+	return c.deduplicate(res), nil
+}
+
+func (c *deduplicatingClient) deduplicate(res prom.QueryResult) prom.QueryResult {
+	switch {
+	case res.Type == pmodel.ValVector && res.Vector != nil:
+		seen := make(map[pmodel.Fingerprint]struct{}, len(*res.Vector))
+		vector := make(pmodel.Vector, 0, len(*res.Vector))
+		for _, sample := range *res.Vector {
+			if sample == nil {
+				continue
+			}
+			metric := c.stripLabels(sample.Metric)
+			fp := metric.Fingerprint()
+			if _, found := seen[fp]; found {
+				continue
+			}
+			seen[fp] = struct{}{}
+			vector = append(vector, &pmodel.Sample{
+				Metric:    metric,
+				Value:     sample.Value,
+				Timestamp: sample.Timestamp,
+			})
+		}
+		res.Vector = &vector
+	case res.Type == pmodel.ValMatrix && res.Matrix != nil:
+		seen := make(map[pmodel.Fingerprint]struct{}, len(*res.Matrix))
+		matrix := make(pmodel.Matrix, 0, len(*res.Matrix))
+		for _, stream := range *res.Matrix {
+			if stream == nil {
+				continue
+			}
+			metric := c.stripLabels(stream.Metric)
+			fp := metric.Fingerprint()
+			if _, found := seen[fp]; found {
+				continue
+			}
+			seen[fp] = struct{}{}
+			matrix = append(matrix, &pmodel.SampleStream{
+				Metric: metric,
+				Values: stream.Values,
+			})
+		}
+		res.Matrix = &matrix
+	}
+	return res
+}
+
+// stripLabels returns a copy of the given metric without any of the replica labels.
+func (c *deduplicatingClient) stripLabels(metric pmodel.Metric) pmodel.Metric {
+	stripped := metric.Clone()
+	for _, name := range c.replicaLabels {
+		delete(stripped, name)
+	}
+	return stripped
+}
+
+// NewDeduplicatingClient wraps the given client so that series only differing by one
+// of the given replica labels are collapsed into a single series.
+func NewDeduplicatingClient(client prom.Client, replicaLabels []string) prom.Client {
+	labels := make([]pmodel.LabelName, 0, len(replicaLabels))
+	for _, l := range replicaLabels {
+		labels = append(labels, pmodel.LabelName(l))
+	}
+	return &deduplicatingClient{
+		client:        client,
+		replicaLabels: labels,
+	}
+}
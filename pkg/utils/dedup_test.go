@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"context"
+	"testing"
+
+	pmodel "github.com/prometheus/common/model"
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+type fakeHAClient struct {
+	series []prom.Series
+	result prom.QueryResult
+}
+
+func (c *fakeHAClient) Series(_ context.Context, _ pmodel.Interval, _ ...prom.Selector) ([]prom.Series, error) {
+	return c.series, nil
+}
+
+func (c *fakeHAClient) Query(_ context.Context, _ pmodel.Time, _ prom.Selector) (prom.QueryResult, error) {
+	return c.result, nil
+}
+
+func (c *fakeHAClient) QueryRange(_ context.Context, _ prom.Range, _ prom.Selector) (prom.QueryResult, error) {
+	return c.result, nil
+}
+
+func TestDeduplicatingClientQuery(t *testing.T) {
+	vector := pmodel.Vector{
+		{Metric: pmodel.Metric{"pod": "a", "replica": "0"}, Value: 1},
+		{Metric: pmodel.Metric{"pod": "a", "replica": "1"}, Value: 1},
+		{Metric: pmodel.Metric{"pod": "b", "prometheus_replica": "prometheus-0"}, Value: 2},
+		{Metric: pmodel.Metric{"pod": "b", "prometheus_replica": "prometheus-1"}, Value: 2},
+	}
+	client := NewDeduplicatingClient(&fakeHAClient{
+		result: prom.QueryResult{Type: pmodel.ValVector, Vector: &vector},
+	}, DefaultReplicaLabels)
+
+	res, err := client.Query(context.TODO(), pmodel.Now(), "up")
+	if err != nil {
+		t.Fatalf("Failed to query, because of %v", err)
+	}
+	if len(*res.Vector) != 2 {
+		t.Fatalf("expected duplicate series to collapse into 2 samples, got %v", *res.Vector)
+	}
+
+	var sum pmodel.SampleValue
+	for _, sample := range *res.Vector {
+		if _, found := sample.Metric["replica"]; found {
+			t.Errorf("replica label was not stripped from %v", sample.Metric)
+		}
+		if _, found := sample.Metric["prometheus_replica"]; found {
+			t.Errorf("prometheus_replica label was not stripped from %v", sample.Metric)
+		}
+		sum += sample.Value
+	}
+	if sum != 3 {
+		t.Errorf("expected the sum over deduplicated samples to be 3, got %v", sum)
+	}
+}
+
+func TestDeduplicatingClientSeries(t *testing.T) {
+	client := NewDeduplicatingClient(&fakeHAClient{
+		series: []prom.Series{
+			{Name: "http_requests_total", Labels: pmodel.LabelSet{"pod": "a", "replica": "0"}},
+			{Name: "http_requests_total", Labels: pmodel.LabelSet{"pod": "a", "replica": "1"}},
+			{Name: "http_errors_total", Labels: pmodel.LabelSet{"pod": "a", "replica": "0"}},
+		},
+	}, []string{"replica"})
+
+	series, err := client.Series(context.TODO(), pmodel.Interval{}, "{pod!=\"\"}")
+	if err != nil {
+		t.Fatalf("Failed to list series, because of %v", err)
+	}
+	if len(series) != 2 {
+		t.Fatalf("expected 2 series after deduplication, got %v", series)
+	}
+}
+
+func TestDeduplicatingClientKeepsDistinctSeries(t *testing.T) {
+	vector := pmodel.Vector{
+		{Metric: pmodel.Metric{"pod": "a", "replica": "0"}, Value: 1},
+		{Metric: pmodel.Metric{"pod": "b", "replica": "0"}, Value: 2},
+	}
+	client := NewDeduplicatingClient(&fakeHAClient{
+		result: prom.QueryResult{Type: pmodel.ValVector, Vector: &vector},
+	}, DefaultReplicaLabels)
+
+	res, err := client.Query(context.TODO(), pmodel.Now(), "up")
+	if err != nil {
+		t.Fatalf("Failed to query, because of %v", err)
+	}
+	if len(*res.Vector) != 2 {
+		t.Errorf("expected distinct series to be kept, got %v", *res.Vector)
+	}
+}
@@ -0,0 +1,11 @@
+package utils
+
+// DefaultCMSDimension is the CMS dimension the labels of the selectors are translated to by default.
+const DefaultCMSDimension = "instanceId"
+
+// CMSDimensionLabel translates the friendly values of a label of the selectors, e.g. the name of
+// an instance, to the values of a CMS dimension, e.g. its instance id.
+type CMSDimensionLabel struct {
+	Dimension string
+	Values    map[string]string
+}
@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+var (
+	endpointOverridesLock sync.RWMutex
+	endpointOverrides     = make(map[Backend]map[string]string)
+)
+
+// ParseEndpointOverrides parses region=host arguments into the hosts of the regions, e.g.
+// cn-new=metrics.cn-new.aliyuncs.com. A host may have a port, but no scheme or path.
+func ParseEndpointOverrides(args []string) (map[string]string, error) {
+	endpoints := make(map[string]string, len(args))
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid endpoint override %q, it must be region=host", arg)
+		}
+		if err := validateEndpointHost(parts[1]); err != nil {
+			return nil, fmt.Errorf("invalid host of region %s: %v", parts[0], err)
+		}
+		if _, found := endpoints[parts[0]]; found {
+			return nil, fmt.Errorf("the endpoint of region %s is overridden several times", parts[0])
+		}
+		endpoints[parts[0]] = parts[1]
+	}
+	return endpoints, nil
+}
+
+func validateEndpointHost(endpoint string) error {
+	host := endpoint
+	if strings.Contains(endpoint, ":") {
+		h, port, err := net.SplitHostPort(endpoint)
+		if err != nil {
+			return err
+		}
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return fmt.Errorf("invalid port %q", port)
+		}
+		host = h
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	if errs := validation.IsDNS1123Subdomain(host); len(errs) > 0 {
+		return fmt.Errorf("%q is no host name: %s", host, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// SetEndpointOverrides sets the hosts of the backend by region, which take precedence over the
+// endpoints the SDK knows. The regions without host keep the endpoint of the SDK.
+func SetEndpointOverrides(backend Backend, endpoints map[string]string) {
+	endpointOverridesLock.Lock()
+	defer endpointOverridesLock.Unlock()
+	endpointOverrides[backend] = endpoints
+}
+
+// EndpointOverride returns the host of the backend in the region, false if it isn't overridden.
+func EndpointOverride(backend Backend, region string) (string, bool) {
+	endpointOverridesLock.RLock()
+	defer endpointOverridesLock.RUnlock()
+	host, found := endpointOverrides[backend][region]
+	return host, found
+}
+
+// ApplyEndpointOverride makes the OpenAPI client of the backend send its requests to the host of
+// the region, if it's overridden.
+func ApplyEndpointOverride(client *sdk.Client, backend Backend, region string) {
+	if host, found := EndpointOverride(backend, region); found {
+		client.Domain = host
+	}
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/cms"
+)
+
+func TestParseEndpointOverrides(t *testing.T) {
+	endpoints, err := ParseEndpointOverrides([]string{"cn-new=metrics.cn-new.aliyuncs.com", "cn-test=10.0.0.1:8080"})
+	if err != nil {
+		t.Fatalf("Failed to parse endpoint overrides, because of %v", err)
+	}
+	if endpoints["cn-new"] != "metrics.cn-new.aliyuncs.com" || endpoints["cn-test"] != "10.0.0.1:8080" {
+		t.Errorf("unexpected endpoints %v", endpoints)
+	}
+
+	for _, args := range [][]string{
+		{"metrics.cn-new.aliyuncs.com"},
+		{"=metrics.cn-new.aliyuncs.com"},
+		{"cn-new=https://metrics.cn-new.aliyuncs.com"},
+		{"cn-new=metrics.cn-new.aliyuncs.com/path"},
+		{"cn-new=metrics.cn-new.aliyuncs.com:http"},
+		{"cn-new=metrics.cn-new.aliyuncs.com", "cn-new=metrics.cn-new2.aliyuncs.com"},
+	} {
+		if _, err := ParseEndpointOverrides(args); err == nil {
+			t.Errorf("expected %v to be rejected", args)
+		}
+	}
+}
+
+// hostRecorder records the host of the requests, which it fails.
+type hostRecorder struct {
+	hosts []string
+}
+
+func (r *hostRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.hosts = append(r.hosts, req.URL.Host)
+	return nil, errors.New("not sent")
+}
+
+func TestApplyEndpointOverride(t *testing.T) {
+	SetEndpointOverrides(CMSBackend, map[string]string{"cn-new": "metrics.cn-new.example.com"})
+	defer SetEndpointOverrides(CMSBackend, nil)
+
+	for region, expected := range map[string]string{
+		"cn-new": "metrics.cn-new.example.com",
+		// the other regions keep the endpoint of the SDK
+		"cn-hangzhou": "metrics.cn-hangzhou.aliyuncs.com",
+	} {
+		client, err := cms.NewClientWithAccessKey(region, "ak", "sk")
+		if err != nil {
+			t.Fatalf("Failed to create cms client, because of %v", err)
+		}
+		client.GetConfig().AutoRetry = false
+		recorder := &hostRecorder{}
+		client.SetTransport(recorder)
+		ApplyEndpointOverride(&client.Client, CMSBackend, region)
+
+		client.DescribeMetricList(cms.CreateDescribeMetricListRequest())
+		// the SDK may ask its location service for the endpoint first
+		if len(recorder.hosts) == 0 || recorder.hosts[len(recorder.hosts)-1] != expected {
+			t.Errorf("expected region %s to be queried at %s, got %v", region, expected, recorder.hosts)
+		}
+	}
+}
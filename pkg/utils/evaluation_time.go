@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultQueryTimeOffset moves the queries of now slightly back, so that a clock ahead of the
+// backend's or its reporting lag doesn't make the latest bucket empty.
+const DefaultQueryTimeOffset = -10 * time.Second
+
+var queryTimeOffset = int64(DefaultQueryTimeOffset)
+
+// SetQueryTimeOffset sets the offset added to now by QueryTime, which must not be positive.
+func SetQueryTimeOffset(offset time.Duration) {
+	atomic.StoreInt64(&queryTimeOffset, int64(offset))
+}
+
+type evaluationTimeKey struct{}
+
+// WithEvaluationTime asks the backends to query the metrics at a past time instead of now.
+func WithEvaluationTime(ctx context.Context, at time.Time) context.Context {
+	return context.WithValue(ctx, evaluationTimeKey{}, at)
+}
+
+// EvaluationTime returns the time the metrics of a request are queried at, if it isn't now.
+func EvaluationTime(ctx context.Context) (time.Time, bool) {
+	at, ok := ctx.Value(evaluationTimeKey{}).(time.Time)
+	return at, ok
+}
+
+// QueryTime returns the time the metrics of a request are queried at, which is now moved by
+// the query time offset unless the request asked for a past evaluation time.
+func QueryTime(ctx context.Context) time.Time {
+	if at, ok := EvaluationTime(ctx); ok {
+		return at
+	}
+	return time.Now().Add(time.Duration(atomic.LoadInt64(&queryTimeOffset)))
+}
@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestQueryTimeOffset(t *testing.T) {
+	SetQueryTimeOffset(-time.Minute)
+	defer SetQueryTimeOffset(DefaultQueryTimeOffset)
+
+	before := time.Now()
+	queryTime := QueryTime(context.TODO())
+	after := time.Now()
+	if queryTime.Before(before.Add(-time.Minute)) || queryTime.After(after.Add(-time.Minute)) {
+		t.Errorf("expected now to be moved back by a minute, got %v at %v", queryTime, before)
+	}
+
+	// an evaluation time is queried as is
+	at := time.Date(2021, 5, 3, 10, 0, 30, 0, time.UTC)
+	if queryTime := QueryTime(WithEvaluationTime(context.TODO(), at)); !queryTime.Equal(at) {
+		t.Errorf("expected the evaluation time %v, got %v", at, queryTime)
+	}
+}
@@ -0,0 +1,198 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ExpressionValue is the name the raw value of a metric goes by in an expression.
+const ExpressionValue = "value"
+
+// expressionFunctions are the functions an expression may call, by their minimum and maximum number of arguments.
+var expressionFunctions = map[string][2]int{
+	"min":   {2, -1},
+	"max":   {2, -1},
+	"abs":   {1, 1},
+	"floor": {1, 1},
+	"ceil":  {1, 1},
+	"round": {1, 1},
+}
+
+// Expression is an arithmetic expression of the raw value of a metric, e.g. `value / 1024` or
+// `min(value, 100)`. It only knows numbers, the value, + - * /, parentheses and the functions
+// min, max, abs, floor, ceil and round, so it's safe to evaluate whatever the configuration holds.
+type Expression struct {
+	source string
+	expr   ast.Expr
+}
+
+// CompileExpression parses and checks an expression, so that it only fails to evaluate on the
+// values it's undefined for, e.g. a division by zero.
+func CompileExpression(source string) (*Expression, error) {
+	expr, err := parser.ParseExpr(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", source, err)
+	}
+	if err := checkExpression(expr); err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", source, err)
+	}
+	return &Expression{source: source, expr: expr}, nil
+}
+
+// String returns the source of the expression.
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Eval evaluates the expression for the raw value. It fails if the result isn't a finite number,
+// with an error wrapping ErrNotANumber for NaN.
+func (e *Expression) Eval(value float64) (float64, error) {
+	result, err := evalExpression(e.expr, value)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(result) {
+		return 0, fmt.Errorf("expression %q for value %v: %w", e.source, value, ErrNotANumber)
+	}
+	if math.IsInf(result, 0) {
+		return 0, fmt.Errorf("expression %q is not a finite number for value %v", e.source, value)
+	}
+	return result, nil
+}
+
+func checkExpression(expr ast.Expr) error {
+	switch n := expr.(type) {
+	case *ast.BasicLit:
+		if n.Kind != token.INT && n.Kind != token.FLOAT {
+			return fmt.Errorf("unsupported literal %s", n.Value)
+		}
+		// Go literals such as 0x10 or 1_000 are tokenized as numbers, but aren't decimal numbers
+		if _, err := strconv.ParseFloat(n.Value, 64); err != nil || strings.Trim(n.Value, "0123456789.eE+-") != "" {
+			return fmt.Errorf("unsupported number %s, only decimal numbers are supported", n.Value)
+		}
+		return nil
+	case *ast.Ident:
+		if n.Name != ExpressionValue {
+			return fmt.Errorf("unknown identifier %s, only %s is known", n.Name, ExpressionValue)
+		}
+		return nil
+	case *ast.ParenExpr:
+		return checkExpression(n.X)
+	case *ast.UnaryExpr:
+		if n.Op != token.SUB && n.Op != token.ADD {
+			return fmt.Errorf("unsupported operator %s", n.Op)
+		}
+		return checkExpression(n.X)
+	case *ast.BinaryExpr:
+		switch n.Op {
+		case token.ADD, token.SUB, token.MUL, token.QUO:
+		default:
+			return fmt.Errorf("unsupported operator %s", n.Op)
+		}
+		if err := checkExpression(n.X); err != nil {
+			return err
+		}
+		return checkExpression(n.Y)
+	case *ast.CallExpr:
+		name, ok := n.Fun.(*ast.Ident)
+		if !ok {
+			return errors.New("only the functions min, max, abs, floor, ceil and round can be called")
+		}
+		arity, found := expressionFunctions[name.Name]
+		if !found {
+			return fmt.Errorf("unknown function %s", name.Name)
+		}
+		if len(n.Args) < arity[0] || (arity[1] >= 0 && len(n.Args) > arity[1]) || n.Ellipsis.IsValid() {
+			return fmt.Errorf("wrong number of arguments of %s", name.Name)
+		}
+		for _, arg := range n.Args {
+			if err := checkExpression(arg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported expression %T", expr)
+}
+
+func evalExpression(expr ast.Expr, value float64) (float64, error) {
+	switch n := expr.(type) {
+	case *ast.BasicLit:
+		return strconv.ParseFloat(n.Value, 64)
+	case *ast.Ident:
+		return value, nil
+	case *ast.ParenExpr:
+		return evalExpression(n.X, value)
+	case *ast.UnaryExpr:
+		x, err := evalExpression(n.X, value)
+		if n.Op == token.SUB {
+			x = -x
+		}
+		return x, err
+	case *ast.BinaryExpr:
+		x, err := evalExpression(n.X, value)
+		if err != nil {
+			return 0, err
+		}
+		y, err := evalExpression(n.Y, value)
+		if err != nil {
+			return 0, err
+		}
+		switch n.Op {
+		case token.ADD:
+			return x + y, nil
+		case token.SUB:
+			return x - y, nil
+		case token.MUL:
+			return x * y, nil
+		default:
+			if x == 0 && y == 0 {
+				// 0 / 0 has no value, unlike the division of any other number by zero
+				return math.NaN(), nil
+			}
+			if y == 0 {
+				return 0, fmt.Errorf("division by zero for value %v", value)
+			}
+			return x / y, nil
+		}
+	case *ast.CallExpr:
+		args := make([]float64, 0, len(n.Args))
+		for _, arg := range n.Args {
+			x, err := evalExpression(arg, value)
+			if err != nil {
+				return 0, err
+			}
+			args = append(args, x)
+		}
+		switch n.Fun.(*ast.Ident).Name {
+		case "min":
+			result := args[0]
+			for _, x := range args[1:] {
+				result = math.Min(result, x)
+			}
+			return result, nil
+		case "max":
+			result := args[0]
+			for _, x := range args[1:] {
+				result = math.Max(result, x)
+			}
+			return result, nil
+		case "abs":
+			return math.Abs(args[0]), nil
+		case "floor":
+			return math.Floor(args[0]), nil
+		case "ceil":
+			return math.Ceil(args[0]), nil
+		case "round":
+			return math.Round(args[0]), nil
+		}
+	}
+	// checkExpression rejects anything else
+	return 0, fmt.Errorf("unsupported expression %T", expr)
+}
@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestExpressionEval(t *testing.T) {
+	for _, tc := range []struct {
+		expression string
+		value      float64
+		expected   float64
+	}{
+		{"value", 42, 42},
+		{"value / 1024", 2048, 2},
+		{"min(value, 100)", 250, 100},
+		{"min(value, 100)", 25, 25},
+		{"max(value, 1, 2.5)", 0, 2.5},
+		{"(value - 10) * -2", 15, -10},
+		{"abs(value - 100)", 40, 60},
+		{"round(value / 3)", 10, 3},
+		{"ceil(value) + floor(value)", 1.5, 3},
+		{"1e3 * value", 0.5, 500},
+	} {
+		e, err := CompileExpression(tc.expression)
+		if err != nil {
+			t.Errorf("Failed to compile %q, because of %v", tc.expression, err)
+			continue
+		}
+		actual, err := e.Eval(tc.value)
+		if err != nil {
+			t.Errorf("Failed to evaluate %q for %v, because of %v", tc.expression, tc.value, err)
+			continue
+		}
+		if actual != tc.expected {
+			t.Errorf("expected %q to be %v for %v, got %v", tc.expression, tc.expected, tc.value, actual)
+		}
+	}
+}
+
+func TestCompileExpressionErrors(t *testing.T) {
+	for expression, message := range map[string]string{
+		"":                   "invalid expression",
+		"value /":            "invalid expression",
+		"value % 2":          "unsupported operator %",
+		"value && 1":         "unsupported operator &&",
+		"!value":             "unsupported operator !",
+		"other + 1":          "unknown identifier other",
+		"sqrt(value)":        "unknown function sqrt",
+		"min(value)":         "wrong number of arguments of min",
+		"abs(value, 1)":      "wrong number of arguments of abs",
+		"math.Abs(value)":    "only the functions",
+		`"1" + value`:        "unsupported literal",
+		"0x10 * value":       "unsupported number 0x10",
+		"1_000 * value":      "unsupported number 1_000",
+		"value / 0o17":       "unsupported number 0o17",
+		"0x1p4 + value":      "unsupported number 0x1p4",
+		"value[0]":           "unsupported expression",
+		"func() int { 1 }()": "only the functions",
+	} {
+		if _, err := CompileExpression(expression); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("expected %q to be rejected with %q, got %v", expression, message, err)
+		}
+	}
+}
+
+func TestExpressionEvalErrors(t *testing.T) {
+	for expression, value := range map[string]float64{
+		"1 / value":          0,
+		"100 / (value - 1)":  1,
+		"value * 1e308 * 10": 1e10,
+	} {
+		e, err := CompileExpression(expression)
+		if err != nil {
+			t.Fatalf("Failed to compile %q, because of %v", expression, err)
+		}
+		if _, err := e.Eval(value); err == nil {
+			t.Errorf("expected %q to fail for %v", expression, value)
+		}
+	}
+}
+
+func TestExpressionEvalNotANumber(t *testing.T) {
+	e, err := CompileExpression("(value - 1) / (value - 1)")
+	if err != nil {
+		t.Fatalf("Failed to compile, because of %v", err)
+	}
+	if _, err := e.Eval(1); !errors.Is(err, ErrNotANumber) {
+		t.Errorf("expected 0 / 0 not to be a number, got %v", err)
+	}
+	if _, err := e.Eval(2); err != nil {
+		t.Errorf("expected the expression to be defined for 2, got %v", err)
+	}
+	if _, err := e.Eval(0); err != nil {
+		t.Errorf("expected the expression to be defined for 0, got %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"regexp"
+	"strings"
+
+	sdkerrors "github.com/aliyun/alibaba-cloud-sdk-go/sdk/errors"
+)
+
+// regionPattern matches the ids of the Alibaba Cloud regions, e.g. cn-hangzhou.
+var regionPattern = regexp.MustCompile(`^[a-z]+(-[a-z0-9]+)+$`)
+
+// IsRegion tells whether the region looks like the id of an Alibaba Cloud region.
+func IsRegion(region string) bool {
+	return regionPattern.MatchString(region)
+}
+
+// IsRegionalFailure tells whether a call to an OpenAPI of the region failed because of the region
+// rather than of the request: the endpoint is unreachable, timed out or answered with a server error.
+// The failures of a request whose own deadline passed or which was canceled aren't regional.
+func IsRegionalFailure(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	var serverErr *sdkerrors.ServerError
+	if errors.As(err, &serverErr) {
+		// the quotas are per region, but a throttled adapter would only move its load to the other region
+		return serverErr.HttpStatus() >= 500 && !strings.HasPrefix(serverErr.ErrorCode(), "Throttling")
+	}
+	var clientErr *sdkerrors.ClientError
+	if errors.As(err, &clientErr) {
+		return clientErr.ErrorCode() == sdkerrors.TimeoutErrorCode
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
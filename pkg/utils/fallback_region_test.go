@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	sdkerrors "github.com/aliyun/alibaba-cloud-sdk-go/sdk/errors"
+)
+
+func TestIsRegion(t *testing.T) {
+	for region, expected := range map[string]bool{
+		"cn-hangzhou":            true,
+		"ap-southeast-1":         true,
+		"cn-hangzhou-finance":    true,
+		"":                       false,
+		"hangzhou":               false,
+		"cms.cn-hangzhou.aliyun": false,
+	} {
+		if IsRegion(region) != expected {
+			t.Errorf("expected IsRegion(%q) to be %v", region, expected)
+		}
+	}
+}
+
+func TestIsRegionalFailure(t *testing.T) {
+	unreachable := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	for _, c := range []struct {
+		err      error
+		expected bool
+	}{
+		{err: nil},
+		{err: sdkerrors.NewServerError(500, `{"Code":"InternalError"}`, ""), expected: true},
+		{err: sdkerrors.NewServerError(400, `{"Code":"InvalidParameter"}`, "")},
+		{err: sdkerrors.NewServerError(503, `{"Code":"Throttling.User"}`, "")},
+		{err: sdkerrors.NewClientError(sdkerrors.TimeoutErrorCode, "timed out", unreachable), expected: true},
+		{err: sdkerrors.NewClientError(sdkerrors.InvalidParamErrorCode, "invalid", nil)},
+		{err: fmt.Errorf("failed to query: %w", unreachable), expected: true},
+		{err: errors.New("json unmarshal datapoint exception")},
+	} {
+		if IsRegionalFailure(context.TODO(), c.err) != c.expected {
+			t.Errorf("expected IsRegionalFailure(%v) to be %v", c.err, c.expected)
+		}
+	}
+
+	// the request itself ran out of time, another region won't make it in time either
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	if IsRegionalFailure(ctx, unreachable) {
+		t.Errorf("expected the failure of a canceled request not to be regional")
+	}
+}
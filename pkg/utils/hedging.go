@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog/v2"
+)
+
+// DefaultMaxHedgedCalls is the number of hedged calls which run at a time unless configured otherwise.
+const DefaultMaxHedgedCalls = 10
+
+// The outcomes of a call of a metric with a hedge delay.
+const (
+	hedgePrimary = "primary"
+	hedgeHedged  = "hedge"
+	// hedgeSkipped is a call slower than the delay which wasn't hedged, because of the bound of the hedged calls
+	hedgeSkipped = "skipped"
+)
+
+// hedgedCalls counts the calls of the metrics with a hedge delay by the call which answered.
+var hedgedCalls = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "adapter_hedged_calls_total",
+		Help: "Calls of the external metrics with a hedge delay, by metric and outcome: answered by the primary call, answered by the hedge, or not hedged because too many hedges were running.",
+	},
+	[]string{"metric", "outcome"},
+)
+
+var (
+	hedgeSlotsLock sync.RWMutex
+	// hedgeSlots bounds the hedged calls running at a time, nil means no bound
+	hedgeSlots = make(chan struct{}, DefaultMaxHedgedCalls)
+)
+
+func init() {
+	RegisterMetrics(hedgedCalls)
+}
+
+// SetMaxHedgedCalls sets the number of hedged calls which run at a time across all the metrics, 0 means no limit.
+// A call which is due for a hedge while the others run isn't hedged.
+func SetMaxHedgedCalls(max int) {
+	hedgeSlotsLock.Lock()
+	defer hedgeSlotsLock.Unlock()
+	if max <= 0 {
+		hedgeSlots = nil
+		return
+	}
+	hedgeSlots = make(chan struct{}, max)
+}
+
+// acquireHedgeSlot returns the release of a slot of the hedged calls, false if they're all in use.
+func acquireHedgeSlot() (func(), bool) {
+	hedgeSlotsLock.RLock()
+	slots := hedgeSlots
+	hedgeSlotsLock.RUnlock()
+	if slots == nil {
+		return func() {}, true
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, true
+	default:
+		return nil, false
+	}
+}
+
+type hedgeResult struct {
+	value  interface{}
+	err    error
+	hedged bool
+}
+
+// Hedge runs the primary call of the metric, and the hedge call in parallel once the primary one ran for the
+// hedge delay, e.g. the same query sent to a fallback region. The first call which succeeds wins,
+// and the context of the other one is canceled. If both fail, the error of the primary call is returned.
+// hedged tells whether the hedge call has run, whatever its outcome. A delay of 0 only runs the primary call.
+func Hedge(ctx context.Context, metric string, delay time.Duration, primary, hedge func(context.Context) (interface{}, error)) (value interface{}, hedged bool, err error) {
+	if delay <= 0 {
+		value, err = primary(ctx)
+		return value, false, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	// the losing call is canceled when the winner returns
+	defer cancel()
+	// buffered, so that the losing call doesn't leak blocked on its send
+	results := make(chan hedgeResult, 2)
+	go func() {
+		value, err := primary(ctx)
+		results <- hedgeResult{value: value, err: err}
+	}()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		hedgedCalls.WithLabelValues(metric, hedgePrimary).Inc()
+		return r.value, false, r.err
+	case <-timer.C:
+	}
+
+	release, acquired := acquireHedgeSlot()
+	if !acquired {
+		hedgedCalls.WithLabelValues(metric, hedgeSkipped).Inc()
+		r := <-results
+		return r.value, false, r.err
+	}
+	klog.V(4).Infof("Call of metric %s still running after %v, hedging it", metric, delay)
+	go func() {
+		defer release()
+		value, err := hedge(ctx)
+		results <- hedgeResult{value: value, err: err, hedged: true}
+	}()
+
+	var primaryErr error
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.err == nil {
+			outcome := hedgePrimary
+			if r.hedged {
+				outcome = hedgeHedged
+			}
+			hedgedCalls.WithLabelValues(metric, outcome).Inc()
+			return r.value, true, nil
+		}
+		if !r.hedged {
+			primaryErr = r.err
+		}
+	}
+	return nil, true, primaryErr
+}
@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHedgeFastPrimary(t *testing.T) {
+	value, hedged, err := Hedge(context.TODO(), "cms_custom_qps", time.Second, func(context.Context) (interface{}, error) {
+		return "primary", nil
+	}, func(context.Context) (interface{}, error) {
+		t.Errorf("expected a call returning within the delay not to be hedged")
+		return "hedge", nil
+	})
+	if err != nil || hedged || value != "primary" {
+		t.Errorf("expected the value of the primary call, got %v, %v, %v", value, hedged, err)
+	}
+}
+
+func TestHedgeSlowPrimary(t *testing.T) {
+	delay := 50 * time.Millisecond
+	start := time.Now()
+	var hedgedAfter time.Duration
+	primaryCanceled := make(chan struct{})
+	value, hedged, err := Hedge(context.TODO(), "cms_custom_qps", delay, func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		close(primaryCanceled)
+		return nil, ctx.Err()
+	}, func(context.Context) (interface{}, error) {
+		hedgedAfter = time.Since(start)
+		return "hedge", nil
+	})
+	if err != nil || !hedged || value != "hedge" {
+		t.Fatalf("expected the value of the hedge call, got %v, %v, %v", value, hedged, err)
+	}
+	if hedgedAfter < delay {
+		t.Errorf("expected the hedge to fire after %v, it fired after %v", delay, hedgedAfter)
+	}
+	select {
+	case <-primaryCanceled:
+	case <-time.After(time.Second):
+		t.Errorf("expected the primary call to be canceled once the hedge won")
+	}
+}
+
+func TestHedgeFirstSuccessWins(t *testing.T) {
+	delay := 10 * time.Millisecond
+
+	// the hedge fails first, the primary call still answers
+	release := make(chan struct{})
+	value, hedged, err := Hedge(context.TODO(), "cms_custom_qps", delay, func(context.Context) (interface{}, error) {
+		<-release
+		return "primary", nil
+	}, func(context.Context) (interface{}, error) {
+		defer close(release)
+		return nil, errors.New("fallback region unreachable")
+	})
+	if err != nil || !hedged || value != "primary" {
+		t.Errorf("expected the value of the primary call after the hedge failed, got %v, %v, %v", value, hedged, err)
+	}
+
+	primaryErr := errors.New("region unreachable")
+	_, hedged, err = Hedge(context.TODO(), "cms_custom_qps", delay, func(context.Context) (interface{}, error) {
+		time.Sleep(20 * time.Millisecond)
+		return nil, primaryErr
+	}, func(context.Context) (interface{}, error) {
+		return nil, errors.New("fallback region unreachable")
+	})
+	if err != primaryErr || !hedged {
+		t.Errorf("expected the error of the primary call when both fail, got %v, %v", hedged, err)
+	}
+}
+
+func TestHedgeBound(t *testing.T) {
+	SetMaxHedgedCalls(1)
+	defer SetMaxHedgedCalls(DefaultMaxHedgedCalls)
+
+	release, acquired := acquireHedgeSlot()
+	if !acquired {
+		t.Fatalf("expected a free hedge slot")
+	}
+	defer release()
+
+	value, hedged, err := Hedge(context.TODO(), "cms_custom_qps", 10*time.Millisecond, func(context.Context) (interface{}, error) {
+		time.Sleep(30 * time.Millisecond)
+		return "primary", nil
+	}, func(context.Context) (interface{}, error) {
+		t.Errorf("expected no hedge beyond the bound of the hedged calls")
+		return "hedge", nil
+	})
+	if err != nil || hedged || value != "primary" {
+		t.Errorf("expected the value of the primary call, got %v, %v, %v", value, hedged, err)
+	}
+}
@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// metricLatencySamples is the number of recent backend calls the latency of a metric is averaged over.
+	metricLatencySamples = 32
+	// maxLatencyMetrics bounds the metrics whose latency is tracked, the metrics beyond it aren't.
+	maxLatencyMetrics = 1000
+)
+
+// MetricLatency is the recent average latency of the backend calls of a metric.
+type MetricLatency struct {
+	Metric         string  `json:"metric"`
+	AverageSeconds float64 `json:"averageSeconds"`
+	// Samples is the number of calls the average is computed over
+	Samples int `json:"samples"`
+}
+
+// latencyRing keeps the latencies of the last calls of a metric.
+type latencyRing struct {
+	samples [metricLatencySamples]time.Duration
+	next    int
+	count   int
+	sum     time.Duration
+}
+
+func (r *latencyRing) add(d time.Duration) {
+	if r.count == len(r.samples) {
+		r.sum -= r.samples[r.next]
+	} else {
+		r.count++
+	}
+	r.samples[r.next] = d
+	r.sum += d
+	r.next = (r.next + 1) % len(r.samples)
+}
+
+var (
+	metricLatenciesLock sync.Mutex
+	metricLatencies     = make(map[string]*latencyRing)
+)
+
+// observeMetricLatency records the latency of a backend call of the metric.
+func observeMetricLatency(metric string, duration time.Duration) {
+	if metric == "" {
+		return
+	}
+	metricLatenciesLock.Lock()
+	defer metricLatenciesLock.Unlock()
+	ring, found := metricLatencies[metric]
+	if !found {
+		if len(metricLatencies) >= maxLatencyMetrics {
+			return
+		}
+		ring = &latencyRing{}
+		metricLatencies[metric] = ring
+	}
+	ring.add(duration)
+}
+
+// SlowestMetrics returns the n metrics with the highest recent average backend latency, the slowest first.
+func SlowestMetrics(n int) []MetricLatency {
+	metricLatenciesLock.Lock()
+	latencies := make([]MetricLatency, 0, len(metricLatencies))
+	for metric, ring := range metricLatencies {
+		latencies = append(latencies, MetricLatency{
+			Metric:         metric,
+			AverageSeconds: (ring.sum / time.Duration(ring.count)).Seconds(),
+			Samples:        ring.count,
+		})
+	}
+	metricLatenciesLock.Unlock()
+
+	sort.Slice(latencies, func(i, j int) bool {
+		if latencies[i].AverageSeconds != latencies[j].AverageSeconds {
+			return latencies[i].AverageSeconds > latencies[j].AverageSeconds
+		}
+		return latencies[i].Metric < latencies[j].Metric
+	})
+	if n >= 0 && len(latencies) > n {
+		latencies = latencies[:n]
+	}
+	return latencies
+}
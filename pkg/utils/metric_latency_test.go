@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func resetMetricLatencies(t *testing.T) {
+	reset := func() {
+		metricLatenciesLock.Lock()
+		metricLatencies = make(map[string]*latencyRing)
+		metricLatenciesLock.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestSlowestMetrics(t *testing.T) {
+	resetMetricLatencies(t)
+	for metric, latencies := range map[string][]time.Duration{
+		"slb_l7_qps":        {2 * time.Second, 4 * time.Second},
+		"http_requests":     {100 * time.Millisecond},
+		"sls_ingress_qps":   {time.Second, time.Second, time.Second},
+		"k8s_workload_cpu":  {500 * time.Millisecond},
+		"cms_custom_orders": {10 * time.Second},
+	} {
+		for _, latency := range latencies {
+			observeQuery(WithQuery(context.TODO(), metric, ""), CMSBackend, latency)
+		}
+	}
+
+	slowest := SlowestMetrics(3)
+	expected := []MetricLatency{
+		{Metric: "cms_custom_orders", AverageSeconds: 10, Samples: 1},
+		{Metric: "slb_l7_qps", AverageSeconds: 3, Samples: 2},
+		{Metric: "sls_ingress_qps", AverageSeconds: 1, Samples: 3},
+	}
+	if len(slowest) != len(expected) {
+		t.Fatalf("expected the 3 slowest metrics, got %+v", slowest)
+	}
+	for i := range expected {
+		if slowest[i] != expected[i] {
+			t.Errorf("expected %+v at rank %d, got %+v", expected[i], i, slowest[i])
+		}
+	}
+}
+
+func TestMetricLatencyIsRolling(t *testing.T) {
+	resetMetricLatencies(t)
+	ctx := WithQuery(context.TODO(), "slb_l7_qps", "")
+	observeQuery(ctx, CMSBackend, time.Minute)
+	for i := 0; i < metricLatencySamples; i++ {
+		observeQuery(ctx, CMSBackend, time.Second)
+	}
+	if slowest := SlowestMetrics(1); slowest[0].AverageSeconds != 1 || slowest[0].Samples != metricLatencySamples {
+		t.Errorf("expected the old calls to leave the average, got %+v", slowest[0])
+	}
+}
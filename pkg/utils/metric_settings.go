@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// MetricSettings are the settings of an external metric the sources apply to its queries,
+// resolved once from its configuration. The zero value is the settings of a metric which
+// isn't configured.
+type MetricSettings struct {
+	// Period is the CMS statistics period in seconds, DefaultCMSPeriod if 0. The period given
+	// in the selector of a request still takes precedence.
+	Period int
+	// Statistic is the statistic read from the CMS data points, the default of the source if empty.
+	Statistic string
+	// NoInstances is the policy answering the requests of a CMS metric whose selector matches no
+	// instance, DefaultNoInstancesPolicy if empty.
+	NoInstances string
+	// FallbackRegion is the region CMS is queried in when the region of the adapter fails, none if empty.
+	FallbackRegion string
+	// HedgeDelay is how long a CMS query runs before it's hedged to the fallback region, 0 if it isn't hedged.
+	HedgeDelay time.Duration
+	// HybridNamespace is the hybrid monitoring namespace of a CMS custom metric queried with CMSHybridAPI,
+	// empty if it's queried with CMSMetricListAPI.
+	HybridNamespace string
+	// RangeAggregation queries a Prometheus metric over a window, nil if it's queried at an instant.
+	RangeAggregation *RangeAggregation
+	// Sampling keeps a share of the series of a Prometheus metric, nil if all of them are returned.
+	Sampling *Sampling
+	// ScalarLabels label the value of a Prometheus metric whose query returns a scalar.
+	ScalarLabels map[string]string
+	// ScaleToZero returns the genuine zero values of the metric as 0.
+	ScaleToZero bool
+}
+
+// ExternalMetricSettings are the settings of the external metrics, which the manager of the external
+// metrics passes to its sources.
+type ExternalMetricSettings struct {
+	// Metrics are the settings of the configured metrics, by metric name.
+	Metrics map[string]MetricSettings
+	// CMSDimensionLabels are the labels of the selectors of the CMS custom metrics which are translated
+	// to dimensions, by label name.
+	CMSDimensionLabels map[string]CMSDimensionLabel
+}
+
+// Of returns the settings of an external metric, the zero value if it isn't configured.
+func (s *ExternalMetricSettings) Of(metric string) MetricSettings {
+	if s == nil {
+		return MetricSettings{}
+	}
+	return s.Metrics[metric]
+}
+
+// CMSPeriod returns the CMS statistics period in seconds.
+func (s MetricSettings) CMSPeriod() int {
+	if s.Period == 0 {
+		return DefaultCMSPeriod
+	}
+	return s.Period
+}
+
+// CMSStatistic returns the statistic read from the CMS data points, or defaultStatistic if it isn't configured.
+func (s MetricSettings) CMSStatistic(defaultStatistic string) string {
+	if s.Statistic == "" {
+		return defaultStatistic
+	}
+	return s.Statistic
+}
+
+// NoInstancesPolicy returns the policy answering the requests of a CMS metric whose selector matches no instance.
+func (s MetricSettings) NoInstancesPolicy() string {
+	if s.NoInstances == "" {
+		return DefaultNoInstancesPolicy
+	}
+	return s.NoInstances
+}
+
+// HybridMetrics returns the names of the metrics queried with CMSHybridAPI, sorted.
+func (s *ExternalMetricSettings) HybridMetrics() []string {
+	if s == nil {
+		return nil
+	}
+	var metrics []string
+	for metric, settings := range s.Metrics {
+		if settings.HybridNamespace != "" {
+			metrics = append(metrics, metric)
+		}
+	}
+	sort.Strings(metrics)
+	return metrics
+}
+
+// CMSDimensionLabelNames returns the labels of the selectors which are translated to dimensions, sorted.
+func (s *ExternalMetricSettings) CMSDimensionLabelNames() []string {
+	if s == nil {
+		return nil
+	}
+	names := make([]string, 0, len(s.CMSDimensionLabels))
+	for label := range s.CMSDimensionLabels {
+		names = append(names, label)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CMSDimensionForLabel translates a label of a selector to a CMS dimension. It returns false if the
+// label isn't translated, and an error if the value isn't in the lookup table of the label.
+func (s *ExternalMetricSettings) CMSDimensionForLabel(label, value string) (dimension string, dimensionValue string, translated bool, err error) {
+	if s == nil {
+		return "", "", false, nil
+	}
+	translation, found := s.CMSDimensionLabels[label]
+	if !found {
+		return "", "", false, nil
+	}
+	dimensionValue, found = translation.Values[value]
+	if !found {
+		known := make([]string, 0, len(translation.Values))
+		for v := range translation.Values {
+			known = append(known, v)
+		}
+		sort.Strings(known)
+		return "", "", true, fmt.Errorf("unknown value %q of label %s, which is translated to the cms dimension %s of the values %v", value, label, translation.Dimension, known)
+	}
+	return translation.Dimension, dimensionValue, true, nil
+}
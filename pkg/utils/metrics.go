@@ -22,10 +22,6 @@ var (
 	)
 )
 
-func init() {
-	prometheus.MustRegister(queryLatency)
-}
-
 // instrumentedClient is a client.GenericAPIClient which instruments calls to Do,
 // capturing request latency.
 type instrumentedGenericClient struct {
@@ -53,6 +49,7 @@ func (c *instrumentedGenericClient) Do(ctx context.Context, verb, endpoint strin
 }
 
 func InstrumentGenericAPIClient(client prom.GenericAPIClient, serverName string) prom.GenericAPIClient {
+	RegisterMetrics(queryLatency)
 	return &instrumentedGenericClient{
 		serverName: serverName,
 		client:     client,
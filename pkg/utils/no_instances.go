@@ -0,0 +1,39 @@
+package utils
+
+import "errors"
+
+// ErrNoInstances is wrapped by the errors of the CMS metric sources when the selector of a request
+// is confirmed to match no instance, e.g. because the workload has no application group anymore, or
+// the scaling group has no members.
+var ErrNoInstances = errors.New("the selector matches no instances")
+
+// ErrNoDataPoints is wrapped by the errors of the CMS metric sources when the instances of a request have
+// no data points, e.g. because CMS is lagging. It isn't answered by the no instances policy of the metric:
+// an instance without data points may still exist.
+var ErrNoDataPoints = errors.New("no data points")
+
+// The policies answering the requests of a CMS metric whose selector matches no instance.
+const (
+	// NoInstancesNotFound answers with a not found error, the HPA reports the metric as missing.
+	NoInstancesNotFound = "notfound"
+	// NoInstancesZero answers with a single value of 0, so that the HPA may scale in.
+	NoInstancesZero = "zero"
+	// NoInstancesError answers with a server error.
+	NoInstancesError = "error"
+)
+
+// DefaultNoInstancesPolicy is the policy of the CMS metrics whose policy isn't configured.
+const DefaultNoInstancesPolicy = NoInstancesNotFound
+
+// NoInstancesPolicies are the policies which may be configured for a metric served from CMS.
+var NoInstancesPolicies = []string{NoInstancesNotFound, NoInstancesZero, NoInstancesError}
+
+// IsNoInstancesPolicy tells whether the policy may be configured for a metric served from CMS.
+func IsNoInstancesPolicy(policy string) bool {
+	for _, p := range NoInstancesPolicies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
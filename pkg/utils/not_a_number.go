@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/klog/v2"
+)
+
+// ErrNotANumber is wrapped by the errors of the metric sources and the value expressions which yield NaN,
+// e.g. a Prometheus query dividing 0 by 0.
+var ErrNotANumber = errors.New("the value is not a number")
+
+// notANumberValues counts the requests of each external metric answered as unavailable because of a NaN.
+var notANumberValues = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "adapter_external_metric_nan_values_total",
+		Help: "Requests of each external metric answered as unavailable because its value was NaN.",
+	},
+	[]string{"metric"},
+)
+
+func init() {
+	RegisterMetrics(notANumberValues)
+}
+
+// NotANumberError reports the external metric as unavailable because of err, which wraps ErrNotANumber.
+// A NaN is never turned into 0, which would scale the workloads to their minimum.
+func NotANumberError(metric string, err error) error {
+	notANumberValues.WithLabelValues(metric).Inc()
+	klog.Warningf("External metric %s is unavailable, because of %v", metric, err)
+	return apierr.NewServiceUnavailable(fmt.Sprintf("external metric %s is unavailable: %v", metric, err))
+}
@@ -0,0 +1,18 @@
+package utils
+
+// DefaultCMSPeriod is the statistics period in seconds of the CMS metrics whose period isn't configured.
+const DefaultCMSPeriod = 60
+
+// CMSPeriods are the statistics periods in seconds which CMS aggregates the metrics by.
+// Coarser periods are cheaper to query and less spiky.
+var CMSPeriods = []int{60, 300, 900, 3600}
+
+// IsCMSPeriod tells whether CMS aggregates the metrics by the given period in seconds.
+func IsCMSPeriod(period int) bool {
+	for _, p := range CMSPeriods {
+		if p == period {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+
+	pmodel "github.com/prometheus/common/model"
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+type prometheusEndpointKey struct{}
+
+// WithPrometheusEndpoint asks the Prometheus queries of a request to be sent to the named endpoint instead of the default one.
+func WithPrometheusEndpoint(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, prometheusEndpointKey{}, name)
+}
+
+// PrometheusEndpoint returns the endpoint the Prometheus queries of a request are sent to, if it isn't the default one.
+func PrometheusEndpoint(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(prometheusEndpointKey{}).(string)
+	return name, ok
+}
+
+// endpointRoutingClient is a client.Client which sends the queries of a request to the endpoint it asked for.
+type endpointRoutingClient struct {
+	defaultClient prom.Client
+	endpoints     map[string]prom.Client
+}
+
+// NewEndpointRoutingClient sends the queries to the client of the endpoint named by WithPrometheusEndpoint,
+// or to the default client. The queries for an unknown endpoint fail.
+func NewEndpointRoutingClient(defaultClient prom.Client, endpoints map[string]prom.Client) prom.Client {
+	return &endpointRoutingClient{
+		defaultClient: defaultClient,
+		endpoints:     endpoints,
+	}
+}
+
+func (c *endpointRoutingClient) client(ctx context.Context) (prom.Client, error) {
+	name, ok := PrometheusEndpoint(ctx)
+	if !ok {
+		return c.defaultClient, nil
+	}
+	client, found := c.endpoints[name]
+	if !found {
+		return nil, fmt.Errorf("unknown prometheus endpoint %q", name)
+	}
+	return client, nil
+}
+
+func (c *endpointRoutingClient) Series(ctx context.Context, interval pmodel.Interval, selectors ...prom.Selector) ([]prom.Series, error) {
+	client, err := c.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.Series(ctx, interval, selectors...)
+}
+
+func (c *endpointRoutingClient) Query(ctx context.Context, t pmodel.Time, query prom.Selector) (prom.QueryResult, error) {
+	client, err := c.client(ctx)
+	if err != nil {
+		return prom.QueryResult{}, err
+	}
+	return client.Query(ctx, t, query)
+}
+
+func (c *endpointRoutingClient) QueryRange(ctx context.Context, r prom.Range, query prom.Selector) (prom.QueryResult, error) {
+	client, err := c.client(ctx)
+	if err != nil {
+		return prom.QueryResult{}, err
+	}
+	return client.QueryRange(ctx, r, query)
+}
@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"context"
+	"testing"
+
+	pmodel "github.com/prometheus/common/model"
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	fakeprom "sigs.k8s.io/prometheus-adapter/pkg/client/fake"
+)
+
+// scalarClient answers the query `up` with its value.
+func scalarClient(value pmodel.SampleValue) prom.Client {
+	return &fakeprom.FakePrometheusClient{
+		AcceptableInterval: pmodel.Interval{End: 100},
+		QueryResults: map[prom.Selector]prom.QueryResult{
+			"up": {Type: pmodel.ValScalar, Scalar: &pmodel.Scalar{Value: value}},
+		},
+	}
+}
+
+func TestEndpointRoutingClient(t *testing.T) {
+	client := NewEndpointRoutingClient(scalarClient(1), map[string]prom.Client{"canary": scalarClient(2)})
+
+	for ctx, expected := range map[context.Context]pmodel.SampleValue{
+		context.TODO(): 1,
+		WithPrometheusEndpoint(context.TODO(), "canary"): 2,
+	} {
+		result, err := client.Query(ctx, 10, "up")
+		if err != nil {
+			t.Fatalf("Failed to query, because of %v", err)
+		}
+		if result.Scalar.Value != expected {
+			t.Errorf("expected the query to be answered by the endpoint of value %v, got %v", expected, result.Scalar.Value)
+		}
+	}
+
+	if _, err := client.Query(WithPrometheusEndpoint(context.TODO(), "unknown"), 10, "up"); err == nil {
+		t.Errorf("expected the query of an unknown endpoint to fail")
+	}
+}
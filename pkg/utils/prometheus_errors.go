@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	pmodel "github.com/prometheus/common/model"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+// The reasons of the failed Prometheus queries. They end up in the conditions of the HPA,
+// so they tell what went wrong without leaking the query or the address of Prometheus.
+const (
+	PrometheusQueryTimeout     = "prometheus query timeout"
+	PrometheusQueryCanceled    = "prometheus query canceled"
+	PrometheusQueryInvalid     = "prometheus rejected the query as invalid"
+	PrometheusQueryExecFailed  = "prometheus failed to execute the query"
+	PrometheusBadResponse      = "unexpected response from prometheus"
+	PrometheusResponseTooLarge = "prometheus response too large"
+	PrometheusUnreachable      = "prometheus unreachable"
+	PrometheusQueryFailed      = "unable to fetch metrics"
+	NoSeriesMatched            = "no series matched"
+	ScalarPerObject            = "the query returns a scalar, which can't be matched to objects"
+)
+
+// PrometheusQueryError converts the error of a Prometheus query into a status error whose
+// message is a concise reason of the failure. The error itself should be logged by the caller.
+func PrometheusQueryError(err error) error {
+	var tooLarge *ResponseTooLargeError
+	if errors.As(err, &tooLarge) {
+		return statusError(http.StatusBadGateway, metav1.StatusReasonInternalError, PrometheusResponseTooLarge)
+	}
+
+	var promErr *prom.Error
+	if errors.As(err, &promErr) {
+		switch promErr.Type {
+		case prom.ErrTimeout:
+			return statusError(http.StatusGatewayTimeout, metav1.StatusReasonTimeout, PrometheusQueryTimeout)
+		case prom.ErrCanceled:
+			return statusError(http.StatusServiceUnavailable, metav1.StatusReasonServiceUnavailable, PrometheusQueryCanceled)
+		case prom.ErrBadData:
+			return statusError(http.StatusBadRequest, metav1.StatusReasonBadRequest, PrometheusQueryInvalid)
+		case prom.ErrExec:
+			return statusError(http.StatusInternalServerError, metav1.StatusReasonInternalError, PrometheusQueryExecFailed)
+		case prom.ErrBadResponse:
+			// the client only keeps the message of the errors of the decoding
+			if strings.HasPrefix(promErr.Msg, responseTooLarge) {
+				return statusError(http.StatusBadGateway, metav1.StatusReasonInternalError, PrometheusResponseTooLarge)
+			}
+			return statusError(http.StatusBadGateway, metav1.StatusReasonInternalError, PrometheusBadResponse)
+		}
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return statusError(http.StatusGatewayTimeout, metav1.StatusReasonTimeout, PrometheusQueryTimeout)
+	case errors.Is(err, context.Canceled):
+		return statusError(http.StatusServiceUnavailable, metav1.StatusReasonServiceUnavailable, PrometheusQueryCanceled)
+	case netErr != nil:
+		return statusError(http.StatusServiceUnavailable, metav1.StatusReasonServiceUnavailable, PrometheusUnreachable)
+	}
+	return statusError(http.StatusInternalServerError, metav1.StatusReasonInternalError, PrometheusQueryFailed)
+}
+
+// UnexpectedPrometheusResultError is returned when a query returns a result of another type
+// than the caller can handle.
+func UnexpectedPrometheusResultError(resultType pmodel.ValueType) error {
+	return statusError(http.StatusInternalServerError, metav1.StatusReasonInternalError,
+		fmt.Sprintf("%s: result of type %s", PrometheusBadResponse, resultType))
+}
+
+// ScalarResultError is returned when the query of a custom metric, whose values are matched to objects
+// by the labels of their series, returns a scalar, e.g. because its metricsQuery uses scalar().
+func ScalarResultError(metric string) error {
+	return statusError(http.StatusInternalServerError, metav1.StatusReasonInternalError,
+		fmt.Sprintf("%s for metric %s, its metricsQuery must return a vector grouped by the resource labels", ScalarPerObject, metric))
+}
+
+// NoSeriesMatchedError is returned when the query of a metric succeeds without any result.
+func NoSeriesMatchedError(metric string) error {
+	return statusError(http.StatusNotFound, metav1.StatusReasonNotFound,
+		fmt.Sprintf("%s for metric %s", NoSeriesMatched, metric))
+}
+
+func statusError(code int32, reason metav1.StatusReason, message string) error {
+	return &apierr.StatusError{ErrStatus: metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    code,
+		Reason:  reason,
+		Message: message,
+	}}
+}
@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	pmodel "github.com/prometheus/common/model"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+func TestPrometheusQueryError(t *testing.T) {
+	cases := []struct {
+		name    string
+		err     error
+		code    int32
+		message string
+	}{
+		{
+			name:    "deadline of the request",
+			err:     &url.Error{Op: "Get", URL: "http://prometheus/api/v1/query", Err: context.DeadlineExceeded},
+			code:    http.StatusGatewayTimeout,
+			message: PrometheusQueryTimeout,
+		},
+		{
+			name:    "timeout reported by prometheus",
+			err:     &prom.Error{Type: prom.ErrTimeout, Msg: "query timed out in expression evaluation"},
+			code:    http.StatusGatewayTimeout,
+			message: PrometheusQueryTimeout,
+		},
+		{
+			name:    "canceled request",
+			err:     fmt.Errorf("query failed: %w", context.Canceled),
+			code:    http.StatusServiceUnavailable,
+			message: PrometheusQueryCanceled,
+		},
+		{
+			name:    "invalid query",
+			err:     &prom.Error{Type: prom.ErrBadData, Msg: "parse error at char 5"},
+			code:    http.StatusBadRequest,
+			message: PrometheusQueryInvalid,
+		},
+		{
+			name:    "failed execution",
+			err:     &prom.Error{Type: prom.ErrExec, Msg: "query processing would load too many samples"},
+			code:    http.StatusInternalServerError,
+			message: PrometheusQueryExecFailed,
+		},
+		{
+			name:    "unexpected response",
+			err:     &prom.Error{Type: prom.ErrBadResponse, Msg: "unknown response code 502"},
+			code:    http.StatusBadGateway,
+			message: PrometheusBadResponse,
+		},
+		{
+			name:    "connection refused",
+			err:     &url.Error{Op: "Get", URL: "http://prometheus/api/v1/query", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}},
+			code:    http.StatusServiceUnavailable,
+			message: PrometheusUnreachable,
+		},
+		{
+			name:    "unknown failure",
+			err:     errors.New("something broke"),
+			code:    http.StatusInternalServerError,
+			message: PrometheusQueryFailed,
+		},
+	}
+
+	for _, c := range cases {
+		err := PrometheusQueryError(c.err)
+		status, ok := err.(apierr.APIStatus)
+		if !ok {
+			t.Errorf("%s: expected a status error, got %v", c.name, err)
+			continue
+		}
+		if status.Status().Code != c.code || status.Status().Message != c.message {
+			t.Errorf("%s: expected %d %q, got %d %q", c.name, c.code, c.message, status.Status().Code, status.Status().Message)
+		}
+	}
+}
+
+func TestNoSeriesMatchedError(t *testing.T) {
+	err := NoSeriesMatchedError("http_requests")
+	if !apierr.IsNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+	if err.Error() != "no series matched for metric http_requests" {
+		t.Errorf("unexpected message %q", err.Error())
+	}
+}
+
+func TestUnexpectedPrometheusResultError(t *testing.T) {
+	err := UnexpectedPrometheusResultError(pmodel.ValMatrix)
+	if !apierr.IsInternalError(err) {
+		t.Errorf("expected an internal error, got %v", err)
+	}
+	if err.Error() != "unexpected response from prometheus: result of type matrix" {
+		t.Errorf("unexpected message %q", err.Error())
+	}
+}
+
+func TestScalarResultError(t *testing.T) {
+	err := ScalarResultError("http_requests")
+	if !apierr.IsInternalError(err) {
+		t.Errorf("expected an internal error, got %v", err)
+	}
+	if !strings.HasPrefix(err.Error(), "the query returns a scalar, which can't be matched to objects for metric http_requests") {
+		t.Errorf("unexpected message %q", err.Error())
+	}
+}
@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// The external metric providers of the registry, which the metrics are served by.
+const (
+	PrometheusProvider = "prometheus"
+	CMSProvider        = "cms"
+	SLBProvider        = "slb"
+	SLSProvider        = "sls"
+	AHASProvider       = "ahas"
+	KubeProvider       = "kube"
+	ESSProvider        = "ess"
+)
+
+// KnownProviders are the providers the adapter supports, which a metric may be served by.
+var KnownProviders = []string{PrometheusProvider, CMSProvider, SLBProvider, SLSProvider, AHASProvider, KubeProvider, ESSProvider}
+
+// IsKnownProvider tells whether the provider is one of KnownProviders.
+func IsKnownProvider(name string) bool {
+	for _, p := range KnownProviders {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	metricProvidersLock sync.RWMutex
+	metricProviders     = make(map[string]string)
+)
+
+// SetMetricProviders sets the provider each external metric configured with a backend is served by, by metric name.
+func SetMetricProviders(providers map[string]string) {
+	metricProvidersLock.Lock()
+	defer metricProvidersLock.Unlock()
+	metricProviders = make(map[string]string, len(providers))
+	for metric, provider := range providers {
+		metricProviders[metric] = provider
+	}
+}
+
+// MetricProvider returns the provider an external metric is served by, false if it's served by whichever provider has it.
+func MetricProvider(metric string) (string, bool) {
+	metricProvidersLock.RLock()
+	defer metricProvidersLock.RUnlock()
+	provider, found := metricProviders[metric]
+	return provider, found
+}
+
+type requestProviderKey struct{}
+
+// WithRequestProvider asks the external metric of the request to be served by the provider, whichever other
+// provider has a metric of the same name.
+func WithRequestProvider(ctx context.Context, provider string) context.Context {
+	return context.WithValue(ctx, requestProviderKey{}, provider)
+}
+
+// RequestProvider returns the provider the request asks for, false if it doesn't ask for any.
+func RequestProvider(ctx context.Context) (string, bool) {
+	provider, found := ctx.Value(requestProviderKey{}).(string)
+	return provider, found
+}
+
+// ServingProvider returns the provider an external metric is served by: the one the request asks for, else the
+// backend of the metric. It's false if the metric is served by whichever provider has it.
+func ServingProvider(ctx context.Context, metric string) (string, bool) {
+	if provider, found := RequestProvider(ctx); found {
+		return provider, true
+	}
+	return MetricProvider(metric)
+}
+
+var (
+	providerPrecedenceLock sync.RWMutex
+	providerPrecedence     []string
+)
+
+// SetProviderPrecedence sets the order the providers serving external metrics of the same name are preferred in,
+// e.g. prometheus before cms. The providers it doesn't name come after the ones it does.
+func SetProviderPrecedence(providers []string) error {
+	for _, p := range providers {
+		if !IsKnownProvider(p) {
+			return fmt.Errorf("unknown provider %q in the provider precedence, it must be one of %v", p, KnownProviders)
+		}
+	}
+	providerPrecedenceLock.Lock()
+	defer providerPrecedenceLock.Unlock()
+	providerPrecedence = append([]string(nil), providers...)
+	return nil
+}
+
+// ProviderRank returns the rank of the provider in the precedence, the lower the more preferred.
+func ProviderRank(provider string) int {
+	providerPrecedenceLock.RLock()
+	defer providerPrecedenceLock.RUnlock()
+	for i, p := range providerPrecedence {
+		if p == provider {
+			return i
+		}
+	}
+	return len(providerPrecedence)
+}
+
+var (
+	providersLock sync.RWMutex
+	// providers tells whether each registered provider is enabled
+	providers = make(map[string]bool)
+)
+
+// RegisterProvider adds an enabled provider to the registry, it's a no-op for a registered one.
+func RegisterProvider(name string) {
+	providersLock.Lock()
+	defer providersLock.Unlock()
+	if _, found := providers[name]; !found {
+		providers[name] = true
+	}
+}
+
+// Providers returns whether each registered provider is enabled, by name.
+func Providers() map[string]bool {
+	providersLock.RLock()
+	defer providersLock.RUnlock()
+	res := make(map[string]bool, len(providers))
+	for name, enabled := range providers {
+		res[name] = enabled
+	}
+	return res
+}
+
+// SetProviderEnabled enables or disables a registered provider at runtime, e.g. a failing backend
+// during an incident. The metrics of a disabled provider aren't found.
+func SetProviderEnabled(name string, enabled bool) error {
+	providersLock.Lock()
+	defer providersLock.Unlock()
+	if _, found := providers[name]; !found {
+		return fmt.Errorf("unknown provider %q", name)
+	}
+	providers[name] = enabled
+	return nil
+}
+
+// ProviderEnabled tells whether a provider serves its metrics. The providers which aren't registered are.
+func ProviderEnabled(name string) bool {
+	providersLock.RLock()
+	defer providersLock.RUnlock()
+	enabled, found := providers[name]
+	return enabled || !found
+}
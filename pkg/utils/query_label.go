@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"sync/atomic"
+
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// QueryLabel is the label of the external metric values which tells the query they were resolved by,
+// for debugging with kubectl get --raw. HPAs match external metrics by name and selector, so the
+// extra label doesn't affect them.
+const QueryLabel = "query"
+
+var exposeQuery int32
+
+// SetExposeQuery toggles the query label on the external metric values resolved from Prometheus.
+func SetExposeQuery(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&exposeQuery, v)
+}
+
+// SetQueryLabel labels the values with the query sent to the backend, if exposing the query is enabled.
+func SetQueryLabel(values []external_metrics.ExternalMetricValue, query string) {
+	if atomic.LoadInt32(&exposeQuery) == 0 {
+		return
+	}
+	for i := range values {
+		if values[i].MetricLabels == nil {
+			values[i].MetricLabels = make(map[string]string, 1)
+		}
+		values[i].MetricLabels[QueryLabel] = query
+	}
+}
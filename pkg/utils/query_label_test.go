@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"testing"
+
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+func TestSetQueryLabel(t *testing.T) {
+	defer SetExposeQuery(false)
+
+	query := `sum(rate(http_requests_total{service="checkout"}[2m]))`
+	values := []external_metrics.ExternalMetricValue{
+		{MetricName: "http_requests"},
+		{MetricName: "http_requests", MetricLabels: map[string]string{"service": "checkout"}},
+	}
+	SetQueryLabel(values, query)
+	for _, value := range values {
+		if _, found := value.MetricLabels[QueryLabel]; found {
+			t.Errorf("expected no query label unless enabled, got %v", value.MetricLabels)
+		}
+	}
+
+	SetExposeQuery(true)
+	SetQueryLabel(values, query)
+	for _, value := range values {
+		if value.MetricLabels[QueryLabel] != query {
+			t.Errorf("expected query label %s, got %v", query, value.MetricLabels)
+		}
+	}
+	if values[1].MetricLabels["service"] != "checkout" {
+		t.Errorf("expected the other labels to be kept, got %v", values[1].MetricLabels)
+	}
+}
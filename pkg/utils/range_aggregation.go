@@ -0,0 +1,71 @@
+package utils
+
+import "time"
+
+// The operators reducing the samples of a range query to a single value per series.
+const (
+	RangeAggregationAvg = "avg"
+	RangeAggregationMax = "max"
+	RangeAggregationMin = "min"
+	RangeAggregationSum = "sum"
+)
+
+// RangeAggregationOperators are the operators which may be configured for the range aggregation of a metric.
+var RangeAggregationOperators = []string{RangeAggregationAvg, RangeAggregationMax, RangeAggregationMin, RangeAggregationSum}
+
+// defaultRangeAggregationSteps is the number of steps of the window when its step isn't configured.
+const defaultRangeAggregationSteps = 10
+
+// RangeAggregation queries the values of an external metric served from Prometheus over a window
+// instead of at an instant, and reduces the samples of each series with an operator.
+type RangeAggregation struct {
+	Window   time.Duration
+	Operator string
+	// Step is the resolution of the range query, a tenth of the window if it's 0.
+	Step time.Duration
+}
+
+// IsRangeAggregationOperator tells whether the operator may be configured for the range aggregation of a metric.
+func IsRangeAggregationOperator(operator string) bool {
+	for _, o := range RangeAggregationOperators {
+		if o == operator {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolutionStep returns the step of the range query.
+func (a RangeAggregation) ResolutionStep() time.Duration {
+	if a.Step > 0 {
+		return a.Step
+	}
+	step := a.Window / defaultRangeAggregationSteps
+	if step < time.Second {
+		step = time.Second
+	}
+	return step
+}
+
+// Reduce applies the operator to the samples of a series, which must not be empty.
+func (a RangeAggregation) Reduce(values []float64) float64 {
+	res := values[0]
+	for _, v := range values[1:] {
+		switch a.Operator {
+		case RangeAggregationMax:
+			if v > res {
+				res = v
+			}
+		case RangeAggregationMin:
+			if v < res {
+				res = v
+			}
+		default:
+			res += v
+		}
+	}
+	if a.Operator == RangeAggregationAvg {
+		res /= float64(len(values))
+	}
+	return res
+}
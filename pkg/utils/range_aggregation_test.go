@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRangeAggregationReduce(t *testing.T) {
+	values := []float64{4, 1, 7}
+	for operator, expected := range map[string]float64{
+		RangeAggregationAvg: 4,
+		RangeAggregationMax: 7,
+		RangeAggregationMin: 1,
+		RangeAggregationSum: 12,
+	} {
+		if got := (RangeAggregation{Operator: operator}).Reduce(values); got != expected {
+			t.Errorf("expected the %s of %v to be %v, got %v", operator, values, expected, got)
+		}
+	}
+}
+
+func TestRangeAggregationResolutionStep(t *testing.T) {
+	for _, c := range []struct {
+		aggregation RangeAggregation
+		expected    time.Duration
+	}{
+		{RangeAggregation{Window: 5 * time.Minute}, 30 * time.Second},
+		{RangeAggregation{Window: 5 * time.Minute, Step: time.Minute}, time.Minute},
+		{RangeAggregation{Window: 5 * time.Second}, time.Second},
+	} {
+		if got := c.aggregation.ResolutionStep(); got != c.expected {
+			t.Errorf("expected the step of %+v to be %v, got %v", c.aggregation, c.expected, got)
+		}
+	}
+}
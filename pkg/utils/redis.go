@@ -0,0 +1,195 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	redisDialTimeout = 2 * time.Second
+	// redisMaxIdleConns is the number of connections kept open between the commands.
+	redisMaxIdleConns = 4
+)
+
+// RedisStore is a client of the GET and SET commands of a Redis server, which is all the
+// shared cache of the replicas needs.
+type RedisStore struct {
+	addr     string
+	password string
+	db       int
+	dialer   net.Dialer
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// NewRedisStore creates a client of the server at a redis://[:password@]host:port[/db] URL.
+func NewRedisStore(rawURL string) (*RedisStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %v", err)
+	}
+	if u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("invalid redis URL %q, it should be of the form redis://[:password@]host:port[/db]", u.Redacted())
+	}
+
+	store := &RedisStore{
+		addr:   u.Host,
+		dialer: net.Dialer{Timeout: redisDialTimeout},
+		idle:   make(chan *redisConn, redisMaxIdleConns),
+	}
+	if u.Port() == "" {
+		store.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		store.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if store.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+	return store, nil
+}
+
+// Get returns the value of the key, and whether it's set.
+func (s *RedisStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	reply, err := s.do(ctx, "GET", key)
+	if err != nil {
+		return nil, false, err
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, false, nil
+	}
+	return value, true, nil
+}
+
+// Set sets the value of the key, which expires after the ttl.
+func (s *RedisStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	_, err := s.do(ctx, "SET", key, string(value), "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	return err
+}
+
+// do sends a command and reads its reply. The connection is only reused if both succeeded.
+func (s *RedisStore) do(ctx context.Context, args ...string) (interface{}, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.do(ctx, args...)
+	if err != nil {
+		var redisErr redisError
+		if !errors.As(err, &redisErr) {
+			conn.Close()
+			return nil, err
+		}
+	}
+	select {
+	case s.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+func (s *RedisStore) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-s.idle:
+		return conn, nil
+	default:
+	}
+
+	c, err := s.dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: c, reader: bufio.NewReader(c)}
+	if s.password != "" {
+		if _, err := conn.do(ctx, "AUTH", s.password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to authenticate to redis: %v", err)
+		}
+	}
+	if s.db != 0 {
+		if _, err := conn.do(ctx, "SELECT", strconv.Itoa(s.db)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to select redis database %d: %v", s.db, err)
+		}
+	}
+	return conn, nil
+}
+
+// redisError is an error reply of the server, after which the connection is still usable.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func (c *redisConn) do(ctx context.Context, args ...string) (interface{}, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Time{}
+	}
+	if err := c.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	// commands are sent as an array of bulk strings
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.Conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// readReply reads a simple string, error, integer or bulk string reply. A nil bulk string is returned as nil.
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis bulk string length %q", line[1:])
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		value := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, value); err != nil {
+			return nil, err
+		}
+		return value[:size], nil
+	}
+	return nil, fmt.Errorf("unexpected redis reply %q", line)
+}
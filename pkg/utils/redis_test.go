@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveFakeRedis serves GET, SET, AUTH and SELECT from memory, and records the commands.
+func serveFakeRedis(t *testing.T, password string) (string, *[]string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen, because of %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	commands := &[]string{}
+	entries := make(map[string]string)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				authenticated := password == ""
+				for {
+					args, err := readFakeRedisCommand(reader)
+					if err != nil {
+						return
+					}
+					*commands = append(*commands, args[0])
+					switch {
+					case args[0] == "AUTH" && args[1] == password:
+						authenticated = true
+						io.WriteString(conn, "+OK\r\n")
+					case !authenticated:
+						io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+					case args[0] == "SELECT":
+						io.WriteString(conn, "+OK\r\n")
+					case args[0] == "SET":
+						entries[args[1]] = args[2]
+						io.WriteString(conn, "+OK\r\n")
+					case args[0] == "GET":
+						if value, found := entries[args[1]]; found {
+							fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+						} else {
+							io.WriteString(conn, "$-1\r\n")
+						}
+					default:
+						io.WriteString(conn, "-ERR unknown command\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), commands
+}
+
+func readFakeRedisCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, count)
+	for i := range args {
+		if line, err = reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, arg); err != nil {
+			return nil, err
+		}
+		args[i] = string(arg[:size])
+	}
+	return args, nil
+}
+
+func TestRedisStore(t *testing.T) {
+	addr, commands := serveFakeRedis(t, "secret")
+	store, err := NewRedisStore("redis://:secret@" + addr + "/2")
+	if err != nil {
+		t.Fatalf("Failed to create the store, because of %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, found, err := store.Get(ctx, "missing"); err != nil || found {
+		t.Errorf("expected a missing key, got found %v and error %v", found, err)
+	}
+	if err := store.Set(ctx, "key", []byte("a\r\nvalue"), time.Minute); err != nil {
+		t.Fatalf("Failed to set the key, because of %v", err)
+	}
+	value, found, err := store.Get(ctx, "key")
+	if err != nil || !found || string(value) != "a\r\nvalue" {
+		t.Errorf("unexpected value %q, found %v and error %v", value, found, err)
+	}
+	// the connection is authenticated once and reused
+	if got := strings.Join(*commands, ","); got != "AUTH,SELECT,GET,SET,GET" {
+		t.Errorf("unexpected commands %s", got)
+	}
+}
+
+func TestRedisStoreErrors(t *testing.T) {
+	addr, _ := serveFakeRedis(t, "secret")
+	store, err := NewRedisStore("redis://" + addr)
+	if err != nil {
+		t.Fatalf("Failed to create the store, because of %v", err)
+	}
+	if _, _, err := store.Get(context.TODO(), "key"); err == nil || err.Error() != "redis: NOAUTH Authentication required." {
+		t.Errorf("expected the error reply of the server, got %v", err)
+	}
+
+	for _, url := range []string{"http://localhost:6379", "redis://localhost:6379/db", "redis://"} {
+		if _, err := NewRedisStore(url); err == nil {
+			t.Errorf("expected %s to be rejected", url)
+		}
+	}
+}
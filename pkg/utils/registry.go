@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+var (
+	registeredLock sync.Mutex
+	// registered are the collectors already registered, which registering again would panic on
+	registered = make(map[prometheus.Collector]bool)
+)
+
+// RegisterMetrics registers the collectors with the legacy registry, whose metrics the apiserver
+// serves on /metrics. A collector is only registered once however often it's passed, so that
+// the constructors may register their metrics and be called again, e.g. by the tests or on reload.
+func RegisterMetrics(cs ...prometheus.Collector) {
+	registeredLock.Lock()
+	defer registeredLock.Unlock()
+	for _, c := range cs {
+		if registered[c] {
+			continue
+		}
+		legacyregistry.RawMustRegister(c)
+		registered[c] = true
+	}
+}
@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+func TestRegisterMetricsTwice(t *testing.T) {
+	counter := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "adapter_test_registrations_total",
+		Help: "Counter registered twice by the tests.",
+	})
+
+	// registering a collector again would panic without the registry of the adapter
+	RegisterMetrics(counter)
+	RegisterMetrics(counter, queryLatency)
+	RegisterMetrics(queryLatency)
+
+	families, err := legacyregistry.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics, because of %v", err)
+	}
+	found := 0
+	for _, family := range families {
+		if family.GetName() == "adapter_test_registrations_total" {
+			found++
+		}
+	}
+	if found != 1 {
+		t.Errorf("expected the counter to be exposed once, got %d times", found)
+	}
+}
@@ -0,0 +1,184 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	pmodel "github.com/prometheus/common/model"
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/klog/v2"
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+)
+
+// ErrRuleTimeout is returned by ListRuleSeries when the series query of a rule takes longer than its timeout.
+var ErrRuleTimeout = errors.New("series query of the rule timed out")
+
+// ruleTimeouts counts the relists which skipped a rule because its series query timed out.
+var ruleTimeouts = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "adapter_relist_rule_timeouts_total",
+		Help: "Number of relists which kept the previous series of a rule because its series query timed out.",
+	},
+	[]string{"series_query"},
+)
+
+// DefaultRelistConcurrency is the number of series queries of the relists which run at a time unless configured otherwise.
+const DefaultRelistConcurrency = 10
+
+// relistRateWindow is the window the rate of the series queries of the relists is averaged over.
+const relistRateWindow = time.Minute
+
+// relistQueryRate is the rate of the series queries of the relists, averaged over relistRateWindow.
+var relistQueryRate = prometheus.NewGaugeFunc(
+	prometheus.GaugeOpts{
+		Name: "adapter_relist_query_rate",
+		Help: "Series queries per second the relists sent to Prometheus, averaged over the last minute.",
+	},
+	func() float64 { return relistQueries.rate(time.Now()) },
+)
+
+// relistLimit bounds the series queries of the relists apart from the queries serving the requests, whose
+// concurrency limit they don't take from, so that a relist of many rules doesn't flood Prometheus.
+type relistLimit struct {
+	// slots bounds the queries running at a time, nil means no bound
+	slots chan struct{}
+	// limiter bounds the queries started per second, nil means no bound
+	limiter flowcontrol.RateLimiter
+}
+
+var (
+	relistLimitLock sync.RWMutex
+	relistLimits    = &relistLimit{slots: make(chan struct{}, DefaultRelistConcurrency)}
+)
+
+// relistCallKey marks the context of a series query of a relist.
+type relistCallKey struct{}
+
+func init() {
+	RegisterMetrics(ruleTimeouts, relistQueryRate)
+}
+
+// SetRelistLimits sets how many series queries of the relists run at a time, and how many are started per second,
+// 0 meaning no limit for either. These queries don't count against the concurrency limit of Prometheus.
+func SetRelistLimits(concurrency int, queriesPerSecond float64) {
+	l := &relistLimit{}
+	if concurrency > 0 {
+		l.slots = make(chan struct{}, concurrency)
+	}
+	if queriesPerSecond > 0 {
+		burst := int(queriesPerSecond)
+		if burst < 1 {
+			burst = 1
+		}
+		l.limiter = flowcontrol.NewTokenBucketRateLimiter(float32(queriesPerSecond), burst)
+	}
+	relistLimitLock.Lock()
+	defer relistLimitLock.Unlock()
+	relistLimits = l
+}
+
+// acquireRelist waits until a series query of a relist may run, or the context is done.
+// The returned function has to be called once the query has returned.
+func acquireRelist(ctx context.Context) (func(), error) {
+	relistLimitLock.RLock()
+	l := relistLimits
+	relistLimitLock.RUnlock()
+
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("too many concurrent series queries of the relist: %w", ctx.Err())
+		}
+	}
+	release := func() {
+		if l.slots != nil {
+			<-l.slots
+		}
+	}
+	if l.limiter != nil {
+		if err := l.limiter.Wait(ctx); err != nil {
+			release()
+			return nil, fmt.Errorf("too many series queries of the relist per second: %w", err)
+		}
+	}
+	relistQueries.add(time.Now())
+	return release, nil
+}
+
+// isRelistCall tells whether the call is a series query of a relist, which is bounded by the relist limits.
+func isRelistCall(ctx context.Context) bool {
+	relist, _ := ctx.Value(relistCallKey{}).(bool)
+	return relist
+}
+
+// queryTimes keeps the start times of the queries of the last relistRateWindow.
+type queryTimes struct {
+	lock  sync.Mutex
+	times []time.Time
+}
+
+var relistQueries = &queryTimes{}
+
+func (q *queryTimes) add(now time.Time) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.prune(now)
+	q.times = append(q.times, now)
+}
+
+func (q *queryTimes) rate(now time.Time) float64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.prune(now)
+	return float64(len(q.times)) / relistRateWindow.Seconds()
+}
+
+func (q *queryTimes) prune(now time.Time) {
+	i := 0
+	for i < len(q.times) && now.Sub(q.times[i]) > relistRateWindow {
+		i++
+	}
+	q.times = q.times[i:]
+}
+
+// RuleTimeoutNamer is a namer whose series query has a timeout.
+type RuleTimeoutNamer interface {
+	SeriesQueryTimeout() time.Duration
+}
+
+// ListRuleSeries lists the series of a rule on a relist, bounded by the timeout of the rule and by the relist limits,
+// see SetRelistLimits. The wait for the limits isn't part of the timeout of the rule.
+// When it times out ErrRuleTimeout is returned, the caller should keep the previous series of the rule.
+func ListRuleSeries(ctx context.Context, client prom.Client, interval pmodel.Interval, namer naming.MetricNamer) ([]prom.Series, error) {
+	release, err := acquireRelist(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	ctx = context.WithValue(ctx, relistCallKey{}, true)
+
+	var timeout time.Duration
+	if n, ok := namer.(RuleTimeoutNamer); ok {
+		timeout = n.SeriesQueryTimeout()
+	}
+	if timeout <= 0 {
+		return client.Series(ctx, interval, namer.Selector())
+	}
+
+	ruleCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	series, err := client.Series(ruleCtx, interval, namer.Selector())
+	// the deadline of the caller isn't the timeout of the rule
+	if err != nil && ctx.Err() == nil && errors.Is(ruleCtx.Err(), context.DeadlineExceeded) {
+		ruleTimeouts.WithLabelValues(string(namer.Selector())).Inc()
+		klog.Warningf("Series query %q timed out after %v, keeping the previous series of the rule", namer.Selector(), timeout)
+		return nil, ErrRuleTimeout
+	}
+	return series, err
+}
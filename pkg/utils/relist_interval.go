@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+// relistInterval is the current interval between the relists of the custom and external metrics.
+var relistInterval = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "adapter_relist_interval_seconds",
+		Help: "Interval until the next relist of the series of the custom or external metrics.",
+	},
+	[]string{"api"},
+)
+
+var (
+	relistBoundsLock                     sync.RWMutex
+	relistMinInterval, relistMaxInterval time.Duration
+)
+
+func init() {
+	RegisterMetrics(relistInterval)
+}
+
+// SetRelistIntervalBounds makes the relist interval adaptive between min and max, 0 for both keeping it fixed.
+// It applies to the relist schedulers created from now on.
+func SetRelistIntervalBounds(min, max time.Duration) {
+	relistBoundsLock.Lock()
+	defer relistBoundsLock.Unlock()
+	relistMinInterval, relistMaxInterval = min, max
+}
+
+// RelistScheduler tells how long to wait until the next relist. When the interval is adaptive, it's
+// halved each time a relist finds metric names the previous one didn't, down to the minimum, and
+// doubled each time a relist finds the same names, up to the maximum.
+type RelistScheduler struct {
+	lock     sync.Mutex
+	api      string
+	interval time.Duration
+	min      time.Duration
+	max      time.Duration
+	// names are the metric names of the last relist, nil before the first one
+	names sets.String
+}
+
+// NewRelistScheduler creates the scheduler of the relists of the metrics of the api, starting at interval.
+func NewRelistScheduler(api string, interval time.Duration) *RelistScheduler {
+	relistBoundsLock.RLock()
+	min, max := relistMinInterval, relistMaxInterval
+	relistBoundsLock.RUnlock()
+	if min <= 0 || max <= 0 {
+		min, max = interval, interval
+	}
+	relistInterval.WithLabelValues(api).Set(interval.Seconds())
+	return &RelistScheduler{api: api, interval: interval, min: min, max: max}
+}
+
+// Interval returns how long to wait until the next relist.
+func (s *RelistScheduler) Interval() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.interval
+}
+
+// Observe adapts the interval to the series of a relist, listed by rule, and returns it.
+func (s *RelistScheduler) Observe(series [][]prom.Series) time.Duration {
+	names := sets.NewString()
+	for _, list := range series {
+		for _, one := range list {
+			names.Insert(one.Name)
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	previous := s.names
+	s.names = names
+	if previous == nil || s.min == s.max {
+		return s.interval
+	}
+	interval := s.interval
+	if added := names.Difference(previous); added.Len() > 0 {
+		interval /= 2
+		if interval < s.min {
+			interval = s.min
+		}
+		klog.V(4).Infof("The relist of the %s metrics found %d new metric names, relisting in %v", s.api, added.Len(), interval)
+	} else {
+		interval *= 2
+		if interval > s.max {
+			interval = s.max
+		}
+	}
+	s.interval = interval
+	relistInterval.WithLabelValues(s.api).Set(interval.Seconds())
+	return interval
+}
+
+// RunRelists calls relist until stopCh is closed, waiting the interval of the scheduler after each call.
+// If the series were relisted already, e.g. synchronously on startup, the first call waits an interval as well.
+func RunRelists(relist func(), scheduler *RelistScheduler, relisted bool, stopCh <-chan struct{}) {
+	go func() {
+		for {
+			if relisted {
+				timer := time.NewTimer(scheduler.Interval())
+				select {
+				case <-stopCh:
+					timer.Stop()
+					return
+				case <-timer.C:
+				}
+			}
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+			relist()
+			relisted = true
+		}
+	}()
+}
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+// withRelistIntervalBounds sets the bounds of the adaptive relist interval for the duration of a test.
+func withRelistIntervalBounds(t *testing.T, min, max time.Duration) {
+	SetRelistIntervalBounds(min, max)
+	t.Cleanup(func() { SetRelistIntervalBounds(0, 0) })
+}
+
+func relisted(names ...string) [][]prom.Series {
+	var series []prom.Series
+	for _, name := range names {
+		series = append(series, prom.Series{Name: name})
+	}
+	return [][]prom.Series{series}
+}
+
+func TestAdaptiveRelistInterval(t *testing.T) {
+	withRelistIntervalBounds(t, time.Minute, 16*time.Minute)
+	s := NewRelistScheduler("custom", 4*time.Minute)
+
+	for i, step := range []struct {
+		names    []string
+		interval time.Duration
+	}{
+		// the first relist has nothing to compare with
+		{names: []string{"a", "b"}, interval: 4 * time.Minute},
+		// new metrics appear, the relists speed up down to the minimum
+		{names: []string{"a", "b", "c"}, interval: 2 * time.Minute},
+		{names: []string{"a", "b", "c", "d"}, interval: time.Minute},
+		{names: []string{"a", "b", "c", "d", "e"}, interval: time.Minute},
+		// the metrics are stable, the relists slow down up to the maximum
+		{names: []string{"a", "b", "c", "d", "e"}, interval: 2 * time.Minute},
+		// metrics going away don't make new ones more likely
+		{names: []string{"a"}, interval: 4 * time.Minute},
+		{names: []string{"a"}, interval: 8 * time.Minute},
+		{names: []string{"a"}, interval: 16 * time.Minute},
+		{names: []string{"a"}, interval: 16 * time.Minute},
+		{names: []string{"a", "f"}, interval: 8 * time.Minute},
+	} {
+		if interval := s.Observe(relisted(step.names...)); interval != step.interval {
+			t.Errorf("relist %d of %v: expected interval %v, got %v", i, step.names, step.interval, interval)
+		}
+	}
+	if s.Interval() != 8*time.Minute {
+		t.Errorf("expected interval 8m, got %v", s.Interval())
+	}
+	if gauge := testutil.ToFloat64(relistInterval.WithLabelValues("custom")); gauge != 480 {
+		t.Errorf("expected the gauge of the interval to be 480, got %v", gauge)
+	}
+}
+
+func TestFixedRelistInterval(t *testing.T) {
+	s := NewRelistScheduler("external", 10*time.Minute)
+	s.Observe(relisted("a"))
+	for _, names := range [][]string{{"a", "b"}, {"a", "b"}} {
+		if interval := s.Observe(relisted(names...)); interval != 10*time.Minute {
+			t.Errorf("expected the interval to stay fixed, got %v", interval)
+		}
+	}
+}
+
+func TestRunRelists(t *testing.T) {
+	withRelistIntervalBounds(t, time.Millisecond, time.Hour)
+	s := NewRelistScheduler("custom", time.Millisecond)
+	relists := make(chan struct{}, 10)
+	stopCh := make(chan struct{})
+	RunRelists(func() {
+		// a new metric each time keeps the interval at its minimum
+		s.Observe(relisted(time.Now().String()))
+		relists <- struct{}{}
+	}, s, false, stopCh)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-relists:
+		case <-time.After(time.Second):
+			t.Fatalf("expected relist %d within the interval", i)
+		}
+	}
+	close(stopCh)
+}
+
+func TestRunRelistsAfterARelist(t *testing.T) {
+	withRelistIntervalBounds(t, time.Millisecond, time.Hour)
+	s := NewRelistScheduler("custom", time.Hour)
+	relists := make(chan struct{}, 10)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	RunRelists(func() { relists <- struct{}{} }, s, true, stopCh)
+	select {
+	case <-relists:
+		t.Errorf("expected the first relist to wait an interval after the relist on startup")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	pmodel "github.com/prometheus/common/model"
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	fakeprom "sigs.k8s.io/prometheus-adapter/pkg/client/fake"
+	"sigs.k8s.io/prometheus-adapter/pkg/naming"
+)
+
+// blockingClient doesn't answer the series queries before their deadline.
+type blockingClient struct {
+	fakeprom.FakePrometheusClient
+}
+
+func (c *blockingClient) Series(ctx context.Context, _ pmodel.Interval, _ ...prom.Selector) ([]prom.Series, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// timeoutNamer is a namer of a rule with a timeout.
+type timeoutNamer struct {
+	naming.MetricNamer
+	selector prom.Selector
+	timeout  time.Duration
+}
+
+func (n *timeoutNamer) Selector() prom.Selector {
+	return n.selector
+}
+
+func (n *timeoutNamer) SeriesQueryTimeout() time.Duration {
+	return n.timeout
+}
+
+func TestListRuleSeriesTimeout(t *testing.T) {
+	namer := &timeoutNamer{selector: `{__name__="expensive_total"}`, timeout: 10 * time.Millisecond}
+	counter := ruleTimeouts.WithLabelValues(string(namer.selector))
+	before := testutil.ToFloat64(counter)
+
+	_, err := ListRuleSeries(context.TODO(), &blockingClient{}, pmodel.Interval{}, namer)
+	if err != ErrRuleTimeout {
+		t.Errorf("expected the rule to time out, got %v", err)
+	}
+	if timeouts := testutil.ToFloat64(counter) - before; timeouts != 1 {
+		t.Errorf("expected the timeout to be counted once, got %v", timeouts)
+	}
+
+	// the deadline of the caller isn't the timeout of the rule
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	defer cancel()
+	namer.timeout = time.Minute
+	if _, err := ListRuleSeries(ctx, &blockingClient{}, pmodel.Interval{}, namer); err == ErrRuleTimeout || err == nil {
+		t.Errorf("expected the error of the caller's deadline, got %v", err)
+	}
+}
+
+// concurrencyClient records the most series queries running at a time.
+type concurrencyClient struct {
+	fakeprom.FakePrometheusClient
+	lock    sync.Mutex
+	running int
+	max     int
+}
+
+func (c *concurrencyClient) Series(ctx context.Context, _ pmodel.Interval, _ ...prom.Selector) ([]prom.Series, error) {
+	c.lock.Lock()
+	c.running++
+	if c.running > c.max {
+		c.max = c.running
+	}
+	c.lock.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	c.lock.Lock()
+	c.running--
+	c.lock.Unlock()
+	return []prom.Series{{Name: "http_requests_total"}}, nil
+}
+
+func TestListRuleSeriesRelistLimit(t *testing.T) {
+	SetRelistLimits(2, 0)
+	defer SetRelistLimits(DefaultRelistConcurrency, 0)
+	SetBackendConcurrency(PrometheusBackend, 1)
+	defer SetBackendConcurrency(PrometheusBackend, DefaultBackendConcurrency[PrometheusBackend])
+
+	// the only serving slot is taken, which doesn't hold the relist back
+	release, err := AcquireBackend(context.TODO(), PrometheusBackend)
+	if err != nil {
+		t.Fatalf("Failed to acquire the serving slot, because of %v", err)
+	}
+	defer release()
+
+	backend := &concurrencyClient{}
+	client := NewTimeoutClient(backend, PrometheusBackend)
+	namer := &timeoutNamer{selector: `{__name__="http_requests_total"}`}
+	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	errs := make(chan error, 6)
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := ListRuleSeries(ctx, client, pmodel.Interval{}, namer)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("expected the relist not to wait for the serving slot, got %v", err)
+		}
+	}
+	if backend.max != 2 {
+		t.Errorf("expected at most 2 series queries of the relist at a time, got %d", backend.max)
+	}
+
+	// the serving calls still wait for their own slot
+	servingCtx, servingCancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	defer servingCancel()
+	if _, err := client.Series(servingCtx, pmodel.Interval{}, namer.selector); err == nil {
+		t.Errorf("expected a serving call to wait for the serving slot")
+	}
+}
+
+func TestRelistQueryRate(t *testing.T) {
+	q := &queryTimes{}
+	now := time.Now()
+	for i := 0; i < 30; i++ {
+		q.add(now.Add(-90 * time.Second))
+	}
+	for i := 0; i < 120; i++ {
+		q.add(now.Add(-time.Duration(i) * 100 * time.Millisecond))
+	}
+	if rate := q.rate(now); rate != 2 {
+		t.Errorf("expected the 120 queries of the last minute to be 2 queries per second, got %v", rate)
+	}
+	if rate := q.rate(now.Add(2 * time.Minute)); rate != 0 {
+		t.Errorf("expected the rate to drop to 0 without queries, got %v", rate)
+	}
+}
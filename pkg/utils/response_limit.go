@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// DefaultMaxResponseBytes bounds the bodies of the backend responses, which are decoded in memory.
+const DefaultMaxResponseBytes = 128 << 20
+
+// responseTooLarge starts the message of ResponseTooLargeError, which is all that's left of the
+// error once the Prometheus client has turned it into a bad response.
+const responseTooLarge = "response body exceeds the limit"
+
+// ResponseTooLargeError is returned while reading a backend response whose body exceeds the limit.
+type ResponseTooLargeError struct {
+	Limit int64
+}
+
+func (e *ResponseTooLargeError) Error() string {
+	return fmt.Sprintf("%s of %d bytes", responseTooLarge, e.Limit)
+}
+
+// limitedRoundTripper fails the reads of the response bodies beyond the limit.
+type limitedRoundTripper struct {
+	rt    http.RoundTripper
+	limit int64
+}
+
+// NewLimitedRoundTripper bounds the bodies of the responses of the round tripper to limit bytes,
+// so that a misbehaving backend can't make the adapter run out of memory. A limit of zero or less
+// doesn't bound them.
+func NewLimitedRoundTripper(rt http.RoundTripper, limit int64) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	if limit <= 0 {
+		return rt
+	}
+	return &limitedRoundTripper{rt: rt, limit: limit}
+}
+
+func (t *limitedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	// the length isn't known upfront for chunked or compressed responses
+	if resp.ContentLength > t.limit {
+		resp.Body.Close()
+		return nil, &ResponseTooLargeError{Limit: t.limit}
+	}
+	resp.Body = &limitedBody{
+		reader: io.LimitReader(resp.Body, t.limit+1),
+		closer: resp.Body,
+		limit:  t.limit,
+	}
+	return resp, nil
+}
+
+// limitedBody reads one byte past the limit, to tell a body of exactly the limit from a larger one.
+type limitedBody struct {
+	reader io.Reader
+	closer io.Closer
+	limit  int64
+	read   int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	b.read += int64(n)
+	if b.read > b.limit {
+		return n - int(b.read-b.limit), &ResponseTooLargeError{Limit: b.limit}
+	}
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	return b.closer.Close()
+}
@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/requests"
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/cms"
+	pmodel "github.com/prometheus/common/model"
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+// cannedServer answers every request with the body, chunked unless withLength is set.
+func cannedServer(body string, withLength bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !withLength {
+			// flushing before writing the body drops the content length
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte(body))
+	}))
+}
+
+func TestLimitedRoundTripper(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	for _, withLength := range []bool{true, false} {
+		server := cannedServer(body, withLength)
+
+		client := &http.Client{Transport: NewLimitedRoundTripper(nil, 100)}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("Failed to get a body of exactly the limit, because of %v", err)
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || len(data) != 100 {
+			t.Errorf("expected a body of exactly the limit to be read, got %d bytes (%v)", len(data), err)
+		}
+
+		client = &http.Client{Transport: NewLimitedRoundTripper(nil, 99)}
+		resp, err = client.Get(server.URL)
+		if err == nil {
+			_, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		var tooLarge *ResponseTooLargeError
+		if !errors.As(err, &tooLarge) || tooLarge.Limit != 99 {
+			t.Errorf("expected an oversized body to fail with content length %v, got %v", withLength, err)
+		}
+		server.Close()
+	}
+}
+
+func TestPrometheusResponseTooLarge(t *testing.T) {
+	// a large but otherwise valid vector
+	result := `{"metric":{"pod":"web"},"value":[1620000000,"1"]},`
+	server := cannedServer(`{"status":"success","data":{"resultType":"vector","result":[`+strings.Repeat(result, 1000)+`{"metric":{},"value":[1620000000,"1"]}]}}`, false)
+	defer server.Close()
+
+	baseURL, _ := url.Parse(server.URL)
+	for limit, expected := range map[int64]string{
+		0:    "",
+		1024: PrometheusResponseTooLarge,
+	} {
+		httpClient := &http.Client{Transport: NewLimitedRoundTripper(http.DefaultTransport, limit)}
+		client := prom.NewClientForAPI(prom.NewGenericAPIClient(httpClient, baseURL, nil))
+		_, err := client.Query(context.TODO(), pmodel.Now(), "up")
+		if expected == "" {
+			if err != nil {
+				t.Errorf("expected an unbounded response to be decoded, got %v", err)
+			}
+			continue
+		}
+		if err == nil || PrometheusQueryError(err).Error() != expected {
+			t.Errorf("expected the query to fail with %q, got %v", expected, err)
+		}
+	}
+}
+
+func TestSDKResponseTooLarge(t *testing.T) {
+	server := cannedServer(`{"RequestId":"test","Success":true,"Code":"200","Datapoints":"[`+strings.Repeat(`{"Average":1},`, 1000)+`{}]"}`, true)
+	defer server.Close()
+
+	SetSDKTransport(DefaultTransportConfig, 1024)
+	defer func() {
+		sdkTransportLock.Lock()
+		sharedSDKSender = nil
+		sdkTransportLock.Unlock()
+	}()
+
+	client, err := cms.NewClientWithAccessKey("cn-hangzhou", "ak", "sk")
+	if err != nil {
+		t.Fatalf("Failed to create cms client, because of %v", err)
+	}
+	client.GetConfig().AutoRetry = false
+	ApplySDKTransport(client)
+
+	request := cms.CreateDescribeMetricListRequest()
+	request.Scheme = requests.HTTP
+	request.Domain = strings.TrimPrefix(server.URL, "http://")
+	if _, err := client.DescribeMetricList(request); err == nil || !strings.Contains(err.Error(), "response body exceeds the limit of 1024 bytes") {
+		t.Errorf("expected the oversized response to fail the call, got %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultRetryBudgetTokenRatio is the share of a token a successful call gives back, as in gRPC's retry throttling.
+const DefaultRetryBudgetTokenRatio = 0.1
+
+// retryBudgetTokens is the number of tokens left in the retry budget of each backend.
+var retryBudgetTokens = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "adapter_retry_budget_tokens",
+		Help: "Number of tokens left in the retry budget of each backend, the retries being allowed above half of --retry-budget-max-tokens.",
+	},
+	[]string{"backend"},
+)
+
+// retryBudget throttles the retries of the calls to a backend the way gRPC does: each failed call
+// takes a token, each successful one gives back tokenRatio of a token, and the retries are only
+// allowed while more than half of the tokens are left. So the retries stop while most of the calls
+// fail, and resume once enough calls succeed again.
+type retryBudget struct {
+	lock       sync.Mutex
+	backend    Backend
+	maxTokens  float64
+	tokenRatio float64
+	tokens     float64
+}
+
+var (
+	retryBudgetsLock sync.RWMutex
+	retryBudgets     = make(map[Backend]*retryBudget)
+)
+
+func init() {
+	RegisterMetrics(retryBudgetTokens)
+}
+
+// SetRetryBudget shares a budget of maxTokens tokens between the retries of the calls to the backend,
+// which starts full. A maxTokens of zero removes the budget, every retry is allowed.
+func SetRetryBudget(backend Backend, maxTokens, tokenRatio float64) {
+	retryBudgetsLock.Lock()
+	defer retryBudgetsLock.Unlock()
+	if maxTokens <= 0 {
+		delete(retryBudgets, backend)
+		retryBudgetTokens.DeleteLabelValues(string(backend))
+		return
+	}
+	retryBudgets[backend] = &retryBudget{backend: backend, maxTokens: maxTokens, tokenRatio: tokenRatio, tokens: maxTokens}
+	retryBudgetTokens.WithLabelValues(string(backend)).Set(maxTokens)
+}
+
+func retryBudgetOf(backend Backend) *retryBudget {
+	retryBudgetsLock.RLock()
+	defer retryBudgetsLock.RUnlock()
+	return retryBudgets[backend]
+}
+
+// ObserveBackendCall takes a token from the retry budget of the backend if the call failed, and gives
+// back a share of a token if it succeeded.
+func ObserveBackendCall(backend Backend, failed bool) {
+	b := retryBudgetOf(backend)
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if failed {
+		if b.tokens--; b.tokens < 0 {
+			b.tokens = 0
+		}
+	} else if b.tokens += b.tokenRatio; b.tokens > b.maxTokens {
+		b.tokens = b.maxTokens
+	}
+	retryBudgetTokens.WithLabelValues(string(b.backend)).Set(b.tokens)
+}
+
+// AllowRetry tells whether a failed call to the backend may be retried, which it always may without budget.
+func AllowRetry(backend Backend) bool {
+	b := retryBudgetOf(backend)
+	if b == nil {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.tokens > b.maxTokens/2
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRetryBudgetExhaustionAndRecovery(t *testing.T) {
+	SetRetryBudget(SLSBackend, 10, 0.5)
+	defer SetRetryBudget(SLSBackend, 0, 0)
+
+	tokens := func() float64 {
+		return testutil.ToFloat64(retryBudgetTokens.WithLabelValues(string(SLSBackend)))
+	}
+	if !AllowRetry(SLSBackend) || tokens() != 10 {
+		t.Fatalf("expected a full budget, got %v tokens", tokens())
+	}
+
+	// an outage: the retries stop once half of the tokens are taken
+	for i := 0; i < 5; i++ {
+		if !AllowRetry(SLSBackend) {
+			t.Fatalf("expected the retries to be allowed after %d failures", i)
+		}
+		ObserveBackendCall(SLSBackend, true)
+	}
+	if AllowRetry(SLSBackend) {
+		t.Errorf("expected the retries to stop with %v tokens left", tokens())
+	}
+	for i := 0; i < 20; i++ {
+		ObserveBackendCall(SLSBackend, true)
+	}
+	if tokens() != 0 {
+		t.Errorf("expected the budget not to go below 0, got %v tokens", tokens())
+	}
+
+	// the recovery: each success gives back half a token
+	for i := 0; i < 10; i++ {
+		ObserveBackendCall(SLSBackend, false)
+	}
+	if AllowRetry(SLSBackend) {
+		t.Errorf("expected the retries to stay stopped with %v tokens left", tokens())
+	}
+	for i := 0; i < 2; i++ {
+		ObserveBackendCall(SLSBackend, false)
+	}
+	if !AllowRetry(SLSBackend) {
+		t.Errorf("expected the retries to resume with %v tokens left", tokens())
+	}
+	for i := 0; i < 100; i++ {
+		ObserveBackendCall(SLSBackend, false)
+	}
+	if tokens() != 10 {
+		t.Errorf("expected the budget not to go above its max, got %v tokens", tokens())
+	}
+}
+
+func TestRetryBudgetDisabled(t *testing.T) {
+	SetRetryBudget(CMSBackend, 0, 0)
+	for i := 0; i < 100; i++ {
+		ObserveBackendCall(CMSBackend, true)
+	}
+	if !AllowRetry(CMSBackend) {
+		t.Errorf("expected every retry to be allowed without budget")
+	}
+}
@@ -0,0 +1,23 @@
+package utils
+
+// Sampling keeps a share of the series a query of an external metric served from Prometheus returns,
+// e.g. a tenth of thousands of per pod series, to estimate the total of all of them.
+type Sampling struct {
+	// Ratio is the share of the series which are kept, between 0 (exclusive) and 1.
+	Ratio float64
+	// MinSeries is how many series a result has at most to be returned whole, 0 samples every result.
+	MinSeries int
+}
+
+// Applies tells whether a result of so many series is sampled.
+func (s Sampling) Applies(series int) bool {
+	return s.Ratio > 0 && s.Ratio < 1 && series > s.MinSeries
+}
+
+// Keeps tells whether the series with the hash of its labels, e.g. its Prometheus fingerprint, is in the sample.
+// The same series are kept by every query as long as they exist, so the sampled values don't jump
+// between polls because other series were picked.
+func (s Sampling) Keeps(hash uint64) bool {
+	// spread the hash over [0, 1) with a Fibonacci multiplier, the low bits of a hash may be biased
+	return float64((hash*0x9e3779b97f4a7c15)>>11)/(1<<53) < s.Ratio
+}
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"hash/fnv"
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestSamplingKeeps(t *testing.T) {
+	sampling := Sampling{Ratio: 0.1}
+	kept := 0
+	for i := 0; i < 10000; i++ {
+		h := fnv.New64a()
+		h.Write([]byte("pod-" + strconv.Itoa(i)))
+		hash := h.Sum64()
+		if sampling.Keeps(hash) {
+			kept++
+		}
+		if sampling.Keeps(hash) != sampling.Keeps(hash) {
+			t.Fatalf("expected series %d to be kept or not deterministically", i)
+		}
+	}
+	if math.Abs(float64(kept)-1000) > 100 {
+		t.Errorf("expected about a tenth of the series to be kept, got %d", kept)
+	}
+}
+
+func TestSamplingApplies(t *testing.T) {
+	for _, c := range []struct {
+		sampling Sampling
+		series   int
+		expected bool
+	}{
+		{Sampling{Ratio: 0.1}, 1, true},
+		{Sampling{Ratio: 0.1, MinSeries: 100}, 100, false},
+		{Sampling{Ratio: 0.1, MinSeries: 100}, 101, true},
+		{Sampling{Ratio: 1}, 1000, false},
+	} {
+		if got := c.sampling.Applies(c.series); got != c.expected {
+			t.Errorf("expected %+v to apply to %d series: %v, got %v", c.sampling, c.series, c.expected, got)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// SecretKeyRef points to a key of a Secret.
+type SecretKeyRef struct {
+	Namespace string
+	Name      string
+	Key       string
+}
+
+func (r SecretKeyRef) String() string {
+	return fmt.Sprintf("%s/%s/%s", r.Namespace, r.Name, r.Key)
+}
+
+// ParseSecretKeyRef parses a secret key reference in the form of namespace/name/key.
+func ParseSecretKeyRef(ref string) (SecretKeyRef, error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return SecretKeyRef{}, fmt.Errorf("secret reference %q must be in the form of namespace/name/key", ref)
+	}
+	return SecretKeyRef{Namespace: parts[0], Name: parts[1], Key: parts[2]}, nil
+}
+
+// secretTokenRoundTripper sets the bearer token stored in a Secret on every request.
+// The token is replaced in place whenever the Secret changes.
+type secretTokenRoundTripper struct {
+	ref SecretKeyRef
+	rt  http.RoundTripper
+
+	lock  sync.RWMutex
+	token string
+}
+
+// NewSecretTokenRoundTripper reads the bearer token from the referenced Secret and keeps
+// watching it until stopCh is closed, so that a rotated token is picked up without a restart.
+func NewSecretTokenRoundTripper(client kubernetes.Interface, ref SecretKeyRef, rt http.RoundTripper, stopCh <-chan struct{}) (http.RoundTripper, error) {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	secret, err := client.CoreV1().Secrets(ref.Namespace).Get(context.TODO(), ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret %s/%s: %v", ref.Namespace, ref.Name, err)
+	}
+	token, err := tokenFromSecret(secret, ref.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenRT := &secretTokenRoundTripper{
+		ref:   ref,
+		rt:    rt,
+		token: token,
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(ref.Namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", ref.Name).String()
+		}))
+	factory.Core().V1().Secrets().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: tokenRT.updateToken,
+		UpdateFunc: func(_, obj interface{}) {
+			tokenRT.updateToken(obj)
+		},
+	})
+	factory.Start(stopCh)
+
+	return tokenRT, nil
+}
+
+func (rt *secretTokenRoundTripper) updateToken(obj interface{}) {
+	secret, ok := obj.(*corev1.Secret)
+	if !ok || secret.Name != rt.ref.Name {
+		return
+	}
+	token, err := tokenFromSecret(secret, rt.ref.Key)
+	if err != nil {
+		// keep using the previous token rather than sending none
+		klog.Errorf("Failed to update bearer token from secret %s, because of %v", rt.ref, err)
+		return
+	}
+
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	if rt.token != token {
+		klog.Infof("bearer token updated from secret %s", rt.ref)
+		rt.token = token
+	}
+}
+
+func (rt *secretTokenRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.lock.RLock()
+	token := rt.token
+	rt.lock.RUnlock()
+
+	// the request must not be modified by a RoundTripper
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return rt.rt.RoundTrip(req)
+}
+
+func tokenFromSecret(secret *corev1.Secret, key string) (string, error) {
+	data, found := secret.Data[key]
+	if !found || len(data) == 0 {
+		return "", fmt.Errorf("secret %s/%s has no token under key %s", secret.Namespace, secret.Name, key)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// headerRecorder records the Authorization header of the last request.
+type headerRecorder struct {
+	authorization string
+}
+
+func (r *headerRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.authorization = req.Header.Get("Authorization")
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+}
+
+func tokenSecret(token string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "monitoring", Name: "prometheus-token"},
+		Data:       map[string][]byte{"token": []byte(token)},
+	}
+}
+
+func authorizationOf(t *testing.T, rt http.RoundTripper, recorder *headerRecorder) string {
+	req, _ := http.NewRequest(http.MethodGet, "http://prometheus:9090/api/v1/query", nil)
+	if _, err := rt.RoundTrip(req); err != nil {
+		t.Fatalf("Failed to send request, because of %v", err)
+	}
+	if req.Header.Get("Authorization") != "" {
+		t.Errorf("expected the original request to be left untouched")
+	}
+	return recorder.authorization
+}
+
+func TestSecretTokenRoundTripper(t *testing.T) {
+	client := fake.NewSimpleClientset(tokenSecret("first-token\n"))
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	recorder := &headerRecorder{}
+	ref := SecretKeyRef{Namespace: "monitoring", Name: "prometheus-token", Key: "token"}
+	rt, err := NewSecretTokenRoundTripper(client, ref, recorder, stopCh)
+	if err != nil {
+		t.Fatalf("Failed to create round tripper, because of %v", err)
+	}
+
+	if auth := authorizationOf(t, rt, recorder); auth != "Bearer first-token" {
+		t.Fatalf("expected the token from the secret to be used, got %q", auth)
+	}
+
+	if _, err := client.CoreV1().Secrets("monitoring").Update(context.TODO(), tokenSecret("rotated-token"), metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update secret, because of %v", err)
+	}
+
+	err = wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return authorizationOf(t, rt, recorder) == "Bearer rotated-token", nil
+	})
+	if err != nil {
+		t.Errorf("expected the rotated token to be used, got %q", recorder.authorization)
+	}
+}
+
+func TestSecretTokenRoundTripperMissingKey(t *testing.T) {
+	client := fake.NewSimpleClientset(tokenSecret("token"))
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	ref := SecretKeyRef{Namespace: "monitoring", Name: "prometheus-token", Key: "password"}
+	if _, err := NewSecretTokenRoundTripper(client, ref, nil, stopCh); err == nil {
+		t.Errorf("expected a missing key to be rejected")
+	}
+}
+
+func TestParseSecretKeyRef(t *testing.T) {
+	ref, err := ParseSecretKeyRef("monitoring/prometheus-token/token")
+	if err != nil {
+		t.Fatalf("Failed to parse secret reference, because of %v", err)
+	}
+	if ref.Namespace != "monitoring" || ref.Name != "prometheus-token" || ref.Key != "token" {
+		t.Errorf("unexpected secret reference %+v", ref)
+	}
+
+	for _, invalid := range []string{"prometheus-token", "monitoring/prometheus-token", "monitoring//token", "a/b/c/d"} {
+		if _, err := ParseSecretKeyRef(invalid); err == nil {
+			t.Errorf("expected secret reference %q to be rejected", invalid)
+		}
+	}
+}
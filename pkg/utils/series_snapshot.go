@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+// SeriesSnapshot persists the series of the last relist of the Prometheus rules to a file, so that
+// a restarted adapter serves the metrics it knew right away while its first relist runs in the background.
+type SeriesSnapshot struct {
+	path string
+	lock sync.Mutex
+}
+
+// seriesSnapshotFile is the content of the snapshot file. The series are written the way Prometheus
+// returns them, with their name as the __name__ label.
+type seriesSnapshotFile struct {
+	SavedAt time.Time                         `json:"savedAt"`
+	Series  map[prom.Selector][]pmodel.Metric `json:"series"`
+}
+
+// NewSeriesSnapshot returns the snapshot kept at path, nil if the path is empty.
+func NewSeriesSnapshot(path string) *SeriesSnapshot {
+	if path == "" {
+		return nil
+	}
+	return &SeriesSnapshot{path: path}
+}
+
+// Load reads the series of the snapshot by series query. A nil snapshot or a missing file has no series.
+func (s *SeriesSnapshot) Load() (map[prom.Selector][]prom.Series, error) {
+	if s == nil {
+		return nil, nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read relist snapshot %s: %v", s.path, err)
+	}
+	var file seriesSnapshotFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("unable to decode relist snapshot %s: %v", s.path, err)
+	}
+	series := make(map[prom.Selector][]prom.Series, len(file.Series))
+	for selector, metrics := range file.Series {
+		// a rule which matched no series still has an empty list
+		series[selector] = make([]prom.Series, 0, len(metrics))
+		for _, metric := range metrics {
+			labels := make(pmodel.LabelSet, len(metric))
+			for name, value := range metric {
+				if name != pmodel.MetricNameLabel {
+					labels[name] = value
+				}
+			}
+			series[selector] = append(series[selector], prom.Series{Name: string(metric[pmodel.MetricNameLabel]), Labels: labels})
+		}
+	}
+	return series, nil
+}
+
+// Save replaces the series of the snapshot. The file is replaced at once, a failed save leaves the previous one.
+// It's a no-op on a nil snapshot.
+func (s *SeriesSnapshot) Save(series map[prom.Selector][]prom.Series) error {
+	if s == nil {
+		return nil
+	}
+	file := seriesSnapshotFile{
+		SavedAt: time.Now(),
+		Series:  make(map[prom.Selector][]pmodel.Metric, len(series)),
+	}
+	for selector, list := range series {
+		metrics := make([]pmodel.Metric, 0, len(list))
+		for _, one := range list {
+			metric := make(pmodel.Metric, len(one.Labels)+1)
+			for name, value := range one.Labels {
+				metric[name] = value
+			}
+			metric[pmodel.MetricNameLabel] = pmodel.LabelValue(one.Name)
+			metrics = append(metrics, metric)
+		}
+		file.Series[selector] = metrics
+	}
+	data, err := json.Marshal(file)
+	if err != nil {
+		return fmt.Errorf("unable to encode relist snapshot: %v", err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), "."+filepath.Base(s.path))
+	if err != nil {
+		return fmt.Errorf("unable to write relist snapshot %s: %v", s.path, err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write relist snapshot %s: %v", s.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	pmodel "github.com/prometheus/common/model"
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+func TestSeriesSnapshot(t *testing.T) {
+	snapshot := NewSeriesSnapshot(filepath.Join(t.TempDir(), "relist.json"))
+
+	// nothing was saved yet, there is nothing to serve
+	series, err := snapshot.Load()
+	if err != nil || series != nil {
+		t.Fatalf("expected no series before the first save, got %v, %v", series, err)
+	}
+
+	saved := map[prom.Selector][]prom.Series{
+		`{__name__=~"^http_requests_.*"}`: {
+			{Name: "http_requests_total", Labels: pmodel.LabelSet{"namespace": "default", "pod": "web-0"}},
+			{Name: "http_requests_failed", Labels: pmodel.LabelSet{"namespace": "default"}},
+		},
+		`{__name__="queue_length"}`: {{Name: "queue_length", Labels: pmodel.LabelSet{}}},
+	}
+	if err := snapshot.Save(saved); err != nil {
+		t.Fatalf("Failed to save the snapshot, because of %v", err)
+	}
+	// a restarted adapter loads the snapshot from the disk
+	series, err = NewSeriesSnapshot(snapshot.path).Load()
+	if err != nil {
+		t.Fatalf("Failed to load the snapshot, because of %v", err)
+	}
+	if !reflect.DeepEqual(series, saved) {
+		t.Errorf("expected the saved series %v, got %v", saved, series)
+	}
+}
+
+func TestSeriesSnapshotErrors(t *testing.T) {
+	var disabled *SeriesSnapshot
+	if err := disabled.Save(map[prom.Selector][]prom.Series{"up": {{Name: "up"}}}); err != nil {
+		t.Errorf("expected a nil snapshot to save nothing, got %v", err)
+	}
+	if series, err := disabled.Load(); err != nil || series != nil {
+		t.Errorf("expected a nil snapshot to have no series, got %v, %v", series, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "relist.json")
+	if err := ioutil.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSeriesSnapshot(path).Load(); err == nil {
+		t.Errorf("expected a corrupted snapshot to fail to load")
+	}
+	if err := NewSeriesSnapshot(filepath.Join(path, "relist.json")).Save(nil); err == nil {
+		t.Errorf("expected a snapshot in a missing directory to fail to save")
+	}
+}
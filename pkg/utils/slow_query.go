@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "k8s.io/klog/v2"
+)
+
+// slowQueries counts the calls to each backend which took longer than the slow query threshold.
+var slowQueries = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "adapter_slow_queries_total",
+		Help: "Number of calls to each backend which took longer than --slow-query-threshold.",
+	},
+	[]string{"backend"},
+)
+
+// slowQueryThreshold is the duration in nanoseconds above which a call is logged, 0 disabling the log.
+var slowQueryThreshold int64
+
+func init() {
+	RegisterMetrics(slowQueries)
+}
+
+// SetSlowQueryThreshold logs the calls to the backends which take longer than the threshold. 0 disables it.
+func SetSlowQueryThreshold(threshold time.Duration) {
+	atomic.StoreInt64(&slowQueryThreshold, int64(threshold))
+}
+
+type queryKey struct{}
+
+// query is the metric request the calls to the backends are made for.
+type query struct {
+	metric   string
+	selector string
+}
+
+// WithQuery tells the slow query log which metric and selector the calls to the backends are made for.
+func WithQuery(ctx context.Context, metric, selector string) context.Context {
+	return context.WithValue(ctx, queryKey{}, query{metric: metric, selector: selector})
+}
+
+// observeQuery records the latency of a call to the backend for its metric, and logs and counts the
+// call if it took longer than the threshold.
+func observeQuery(ctx context.Context, backend Backend, duration time.Duration) {
+	q, _ := ctx.Value(queryKey{}).(query)
+	observeMetricLatency(q.metric, duration)
+	threshold := time.Duration(atomic.LoadInt64(&slowQueryThreshold))
+	if threshold <= 0 || duration <= threshold {
+		return
+	}
+	slowQueries.WithLabelValues(string(backend)).Inc()
+	log.Warningf("Slow query: the call to %s for metric %q with selector %q took %v", backend, q.metric, q.selector, duration)
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "k8s.io/klog/v2"
+)
+
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.LogToStderr(false)
+	log.SetOutput(&buf)
+	t.Cleanup(func() {
+		log.SetOutput(nil)
+		log.LogToStderr(true)
+	})
+	return &buf
+}
+
+func TestSlowQueryLog(t *testing.T) {
+	SetSlowQueryThreshold(time.Second)
+	defer SetSlowQueryThreshold(0)
+	buf := captureLog(t)
+	before := testutil.ToFloat64(slowQueries.WithLabelValues(string(SLSBackend)))
+
+	ctx := WithQuery(context.TODO(), "sls_ingress_qps", "sls.project=web")
+	observeQuery(ctx, SLSBackend, 500*time.Millisecond)
+	if buf.Len() != 0 {
+		t.Errorf("expected a call below the threshold not to be logged, got %q", buf.String())
+	}
+
+	observeQuery(ctx, SLSBackend, 2*time.Second)
+	logged := buf.String()
+	for _, expected := range []string{"sls", "sls_ingress_qps", "sls.project=web", "2s"} {
+		if !strings.Contains(logged, expected) {
+			t.Errorf("expected the slow query log to contain %q, got %q", expected, logged)
+		}
+	}
+	if count := testutil.ToFloat64(slowQueries.WithLabelValues(string(SLSBackend))) - before; count != 1 {
+		t.Errorf("expected a single slow query to be counted, got %v", count)
+	}
+}
+
+func TestSlowQueryLogOfBackendCall(t *testing.T) {
+	SetSlowQueryThreshold(time.Nanosecond)
+	defer SetSlowQueryThreshold(0)
+	buf := captureLog(t)
+
+	release, err := AcquireBackend(WithQuery(context.TODO(), "slb_l7_qps", "slb.instance.id=lb-1"), CMSBackend)
+	if err != nil {
+		t.Fatalf("Failed to acquire the backend, because of %v", err)
+	}
+	time.Sleep(time.Millisecond)
+	release()
+	if !strings.Contains(buf.String(), "slb_l7_qps") {
+		t.Errorf("expected the released call to be logged, got %q", buf.String())
+	}
+}
+
+func TestSlowQueryLogDisabled(t *testing.T) {
+	buf := captureLog(t)
+	observeQuery(context.TODO(), CMSBackend, time.Hour)
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing to be logged without a threshold, got %q", buf.String())
+	}
+}
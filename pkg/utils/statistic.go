@@ -0,0 +1,25 @@
+package utils
+
+// The statistics CMS returns for each data point of a metric.
+const (
+	CMSStatisticAverage = "Average"
+	CMSStatisticMaximum = "Maximum"
+	CMSStatisticMinimum = "Minimum"
+	CMSStatisticValue   = "Value"
+)
+
+// DefaultCMSStatistic is the statistic read from the data points of the CMS metrics whose statistic isn't configured.
+const DefaultCMSStatistic = CMSStatisticAverage
+
+// CMSStatistics are the statistics which may be configured for a metric served from CMS.
+var CMSStatistics = []string{CMSStatisticAverage, CMSStatisticMaximum, CMSStatisticMinimum, CMSStatisticValue}
+
+// IsCMSStatistic tells whether the statistic may be configured for a metric served from CMS.
+func IsCMSStatistic(statistic string) bool {
+	for _, s := range CMSStatistics {
+		if s == statistic {
+			return true
+		}
+	}
+	return false
+}
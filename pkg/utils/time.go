@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"strconv"
 	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func JudgeWithPeriod(startTime, endTime time.Time, period int) error {
@@ -19,3 +21,25 @@ func JudgeWithPeriod(startTime, endTime time.Time, period int) error {
 
 	return nil
 }
+
+// AlignedTimeRange returns the time range of the last periods complete periods before now.
+// CMS reports on period boundaries, so a range which isn't aligned to them gets an empty
+// or partial last bucket.
+func AlignedTimeRange(now time.Time, period, periods int) (startTime, endTime time.Time) {
+	if period <= 0 {
+		return now, now
+	}
+	seconds := int64(period)
+	end := now.Unix() - now.Unix()%seconds
+	start := end - seconds*int64(periods)
+	return time.Unix(start, 0).In(now.Location()), time.Unix(end, 0).In(now.Location())
+}
+
+// DataPointTime returns the time of a data point from its timestamp in milliseconds, which is the
+// timestamp of the value it's returned as. A data point without a timestamp is taken to be of now.
+func DataPointTime(timestamp int64, now time.Time) metav1.Time {
+	if timestamp <= 0 {
+		return metav1.NewTime(now)
+	}
+	return metav1.NewTime(time.Unix(0, timestamp*int64(time.Millisecond)))
+}
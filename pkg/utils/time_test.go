@@ -24,3 +24,36 @@ func TestJudgeWithPeriod(t *testing.T) {
 		}
 	})
 }
+
+func TestAlignedTimeRange(t *testing.T) {
+	testCases := []struct {
+		now    string
+		period int
+		start  string
+		end    string
+	}{
+		{now: "2021-05-01T10:00:00Z", period: 60, start: "2021-05-01T09:55:00Z", end: "2021-05-01T10:00:00Z"},
+		{now: "2021-05-01T10:00:01Z", period: 60, start: "2021-05-01T09:55:00Z", end: "2021-05-01T10:00:00Z"},
+		{now: "2021-05-01T10:00:59Z", period: 60, start: "2021-05-01T09:55:00Z", end: "2021-05-01T10:00:00Z"},
+		{now: "2021-05-01T10:07:30Z", period: 300, start: "2021-05-01T09:40:00Z", end: "2021-05-01T10:05:00Z"},
+		{now: "2021-05-01T00:00:30Z", period: 60, start: "2021-04-30T23:55:00Z", end: "2021-05-01T00:00:00Z"},
+	}
+
+	for _, tc := range testCases {
+		now, _ := time.Parse(time.RFC3339, tc.now)
+		start, end := AlignedTimeRange(now, tc.period, 5)
+		if start.Format(time.RFC3339) != tc.start || end.Format(time.RFC3339) != tc.end {
+			t.Errorf("expected %s with period %d to be aligned to [%s, %s], got [%s, %s]",
+				tc.now, tc.period, tc.start, tc.end, start.Format(time.RFC3339), end.Format(time.RFC3339))
+		}
+	}
+}
+
+func TestAlignedTimeRangeKeepsLocation(t *testing.T) {
+	location := time.FixedZone("CST", 8*60*60)
+	now := time.Date(2021, 5, 1, 18, 3, 20, 0, location)
+	start, end := AlignedTimeRange(now, 60, 1)
+	if start != time.Date(2021, 5, 1, 18, 2, 0, 0, location) || end != time.Date(2021, 5, 1, 18, 3, 0, 0, location) {
+		t.Errorf("unexpected aligned range [%v, %v]", start, end)
+	}
+}
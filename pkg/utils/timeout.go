@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/requests"
+	pmodel "github.com/prometheus/common/model"
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+// Backend is the kind of service the metrics are read from.
+type Backend string
+
+const (
+	PrometheusBackend Backend = "prometheus"
+	// CMSBackend also covers the SLB and the scaling group metrics, which are read through the CMS api,
+	// and the members of the scaling groups.
+	CMSBackend  Backend = "cms"
+	SLSBackend  Backend = "sls"
+	AHASBackend Backend = "ahas"
+)
+
+// DefaultBackendTimeouts are the deadlines applied to the calls of each backend.
+// CMS is by far the slowest one, while SLS queries which take longer than a few
+// seconds usually won't complete anyway.
+var DefaultBackendTimeouts = map[Backend]time.Duration{
+	PrometheusBackend: 30 * time.Second,
+	CMSBackend:        45 * time.Second,
+	SLSBackend:        10 * time.Second,
+	AHASBackend:       15 * time.Second,
+}
+
+var (
+	backendTimeoutsLock sync.RWMutex
+	backendTimeouts     = make(map[Backend]time.Duration)
+)
+
+func init() {
+	for backend, timeout := range DefaultBackendTimeouts {
+		backendTimeouts[backend] = timeout
+	}
+}
+
+// SetBackendTimeout overrides the deadline of the calls to the given backend.
+// A timeout of zero leaves the calls bounded by the request deadline only.
+func SetBackendTimeout(backend Backend, timeout time.Duration) {
+	backendTimeoutsLock.Lock()
+	defer backendTimeoutsLock.Unlock()
+	backendTimeouts[backend] = timeout
+}
+
+// BackendTimeout returns the deadline of the calls to the given backend.
+func BackendTimeout(backend Backend) time.Duration {
+	backendTimeoutsLock.RLock()
+	defer backendTimeoutsLock.RUnlock()
+	return backendTimeouts[backend]
+}
+
+// WithBackendTimeout derives a context which expires once the timeout of the given
+// backend elapses. The deadline of the parent context still applies if it's earlier.
+func WithBackendTimeout(ctx context.Context, backend Backend) (context.Context, context.CancelFunc) {
+	timeout := BackendTimeout(backend)
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// RemainingTimeout returns the time left until the deadline of the context, for
+// the clients which only accept a timeout. It's zero if the context has no deadline.
+func RemainingTimeout(ctx context.Context) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, nil
+	}
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return 0, context.DeadlineExceeded
+	}
+	return remaining, nil
+}
+
+// SetRequestDeadline applies the deadline of the context to an Alibaba Cloud api request.
+func SetRequestDeadline(ctx context.Context, request requests.AcsRequest) error {
+	remaining, err := RemainingTimeout(ctx)
+	if err != nil {
+		return fmt.Errorf("no time left to send the request: %v", err)
+	}
+	if remaining > 0 {
+		request.SetConnectTimeout(remaining)
+		request.SetReadTimeout(remaining)
+	}
+	return nil
+}
+
+// timeoutClient is a client.Client which applies the deadline and the concurrency limit of a backend to every call.
+type timeoutClient struct {
+	client  prom.Client
+	backend Backend
+}
+
+// NewTimeoutClient wraps the client so that each call is bounded by the timeout and the concurrency limit of the given backend.
+func NewTimeoutClient(client prom.Client, backend Backend) prom.Client {
+	return &timeoutClient{
+		client:  client,
+		backend: backend,
+	}
+}
+
+func (c *timeoutClient) Series(ctx context.Context, interval pmodel.Interval, selectors ...prom.Selector) ([]prom.Series, error) {
+	ctx, cancel := WithBackendTimeout(ctx, c.backend)
+	defer cancel()
+	if isRelistCall(ctx) {
+		// the relists are bounded by their own limits, so they don't hold the serving calls back
+		return c.client.Series(ctx, interval, selectors...)
+	}
+	release, err := AcquireBackend(ctx, c.backend)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return c.client.Series(ctx, interval, selectors...)
+}
+
+func (c *timeoutClient) Query(ctx context.Context, t pmodel.Time, query prom.Selector) (prom.QueryResult, error) {
+	ctx, cancel := WithBackendTimeout(ctx, c.backend)
+	defer cancel()
+	release, err := AcquireBackend(ctx, c.backend)
+	if err != nil {
+		return prom.QueryResult{}, err
+	}
+	defer release()
+	return c.client.Query(ctx, t, query)
+}
+
+func (c *timeoutClient) QueryRange(ctx context.Context, r prom.Range, query prom.Selector) (prom.QueryResult, error) {
+	ctx, cancel := WithBackendTimeout(ctx, c.backend)
+	defer cancel()
+	release, err := AcquireBackend(ctx, c.backend)
+	if err != nil {
+		return prom.QueryResult{}, err
+	}
+	defer release()
+	return c.client.QueryRange(ctx, r, query)
+}
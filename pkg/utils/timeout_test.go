@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/cms"
+	pmodel "github.com/prometheus/common/model"
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+// deadlineClient records the deadline of the context it was called with.
+type deadlineClient struct {
+	fakeHAClient
+	deadline time.Time
+}
+
+func (c *deadlineClient) Query(ctx context.Context, t pmodel.Time, query prom.Selector) (prom.QueryResult, error) {
+	c.deadline, _ = ctx.Deadline()
+	return c.fakeHAClient.Query(ctx, t, query)
+}
+
+// withTimeouts sets the backend timeouts for the duration of a test.
+func withTimeouts(t *testing.T, timeouts map[Backend]time.Duration) {
+	for backend, timeout := range timeouts {
+		previous := BackendTimeout(backend)
+		SetBackendTimeout(backend, timeout)
+		backend := backend
+		t.Cleanup(func() { SetBackendTimeout(backend, previous) })
+	}
+}
+
+func assertDeadline(t *testing.T, backend Backend, deadline time.Time, expected time.Duration) {
+	remaining := time.Until(deadline)
+	if remaining > expected || remaining < expected-time.Second {
+		t.Errorf("expected a deadline of %v for backend %s, got %v", expected, backend, remaining)
+	}
+}
+
+func TestWithBackendTimeout(t *testing.T) {
+	withTimeouts(t, map[Backend]time.Duration{
+		PrometheusBackend: 30 * time.Second,
+		CMSBackend:        45 * time.Second,
+		SLSBackend:        10 * time.Second,
+		AHASBackend:       15 * time.Second,
+	})
+
+	for backend, expected := range map[Backend]time.Duration{
+		PrometheusBackend: 30 * time.Second,
+		CMSBackend:        45 * time.Second,
+		SLSBackend:        10 * time.Second,
+		AHASBackend:       15 * time.Second,
+	} {
+		ctx, cancel := WithBackendTimeout(context.Background(), backend)
+		deadline, ok := ctx.Deadline()
+		cancel()
+		if !ok {
+			t.Errorf("expected a deadline for backend %s", backend)
+			continue
+		}
+		assertDeadline(t, backend, deadline, expected)
+	}
+}
+
+func TestRequestDeadlineCapsBackendTimeout(t *testing.T) {
+	withTimeouts(t, map[Backend]time.Duration{CMSBackend: time.Minute})
+
+	parent, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ctx, cancel := WithBackendTimeout(parent, CMSBackend)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	assertDeadline(t, CMSBackend, deadline, 5*time.Second)
+}
+
+func TestZeroBackendTimeout(t *testing.T) {
+	withTimeouts(t, map[Backend]time.Duration{SLSBackend: 0})
+
+	ctx, cancel := WithBackendTimeout(context.Background(), SLSBackend)
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Errorf("expected no deadline when the backend timeout is disabled")
+	}
+}
+
+func TestSetRequestDeadline(t *testing.T) {
+	withTimeouts(t, map[Backend]time.Duration{CMSBackend: 45 * time.Second})
+
+	ctx, cancel := WithBackendTimeout(context.Background(), CMSBackend)
+	defer cancel()
+
+	request := cms.CreateDescribeMetricListRequest()
+	if err := SetRequestDeadline(ctx, request); err != nil {
+		t.Fatalf("Failed to set request deadline, because of %v", err)
+	}
+	assertDeadline(t, CMSBackend, time.Now().Add(request.GetReadTimeout()), 45*time.Second)
+	assertDeadline(t, CMSBackend, time.Now().Add(request.GetConnectTimeout()), 45*time.Second)
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if err := SetRequestDeadline(expired, request); err == nil {
+		t.Errorf("expected an expired context to be rejected")
+	}
+}
+
+func TestTimeoutClient(t *testing.T) {
+	withTimeouts(t, map[Backend]time.Duration{PrometheusBackend: 30 * time.Second})
+
+	vector := pmodel.Vector{}
+	fake := &deadlineClient{fakeHAClient: fakeHAClient{
+		result: prom.QueryResult{Type: pmodel.ValVector, Vector: &vector},
+	}}
+	client := NewTimeoutClient(fake, PrometheusBackend)
+
+	if _, err := client.Query(context.Background(), pmodel.Now(), "up"); err != nil {
+		t.Fatalf("Failed to query, because of %v", err)
+	}
+	assertDeadline(t, PrometheusBackend, fake.deadline, 30*time.Second)
+}
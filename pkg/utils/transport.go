@@ -0,0 +1,221 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// TransportConfig tunes the connection reuse of the Alibaba Cloud OpenAPI clients.
+type TransportConfig struct {
+	DisableKeepAlives   bool
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	// TCPKeepAlive is the keep-alive period of the TCP connections.
+	TCPKeepAlive time.Duration
+	DialTimeout  time.Duration
+}
+
+// DefaultTransportConfig keeps the connections to the OpenAPI endpoints open between calls,
+// sparing a TLS handshake per call.
+var DefaultTransportConfig = TransportConfig{
+	MaxIdleConns:        100,
+	MaxIdleConnsPerHost: 10,
+	IdleConnTimeout:     90 * time.Second,
+	TCPKeepAlive:        30 * time.Second,
+	DialTimeout:         5 * time.Second,
+}
+
+// NewTransport creates a transport with the given settings.
+func NewTransport(config TransportConfig) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   config.DialTimeout,
+			KeepAlive: config.TCPKeepAlive,
+		}).DialContext,
+		DisableKeepAlives:   config.DisableKeepAlives,
+		MaxIdleConns:        config.MaxIdleConns,
+		MaxIdleConnsPerHost: config.MaxIdleConnsPerHost,
+		IdleConnTimeout:     config.IdleConnTimeout,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+}
+
+var (
+	sdkTransportLock sync.RWMutex
+	// sharedSDKSender sends the requests of the OpenAPI clients, whose connections it keeps open between calls
+	sharedSDKSender http.RoundTripper
+)
+
+// SetSDKTransport makes the OpenAPI clients share a transport with the given settings, whose
+// responses are bounded to maxResponseBytes.
+func SetSDKTransport(config TransportConfig, maxResponseBytes int64) {
+	sdkTransportLock.Lock()
+	defer sdkTransportLock.Unlock()
+	sharedSDKSender = NewLimitedRoundTripper(newSDKSender(config), maxResponseBytes)
+}
+
+// sdkClientTransportKey is the key of the transport of the client of a request in its context.
+type sdkClientTransportKey struct{}
+
+// sdkClientTransport returns the transport of the client which sent the request of ctx, nil if none.
+func sdkClientTransport(ctx context.Context) *http.Transport {
+	transport, _ := ctx.Value(sdkClientTransportKey{}).(*http.Transport)
+	return transport
+}
+
+// newSDKSender creates the transport shared by the OpenAPI clients. It dials with the connect timeout,
+// the proxy and the TLS settings the SDK applied to the transport of the client of each request. An open
+// connection is reused by the other clients, whose settings are the same in the adapter.
+func newSDKSender(config TransportConfig) *http.Transport {
+	sender := NewTransport(config)
+	dialer := &net.Dialer{Timeout: config.DialTimeout, KeepAlive: config.TCPKeepAlive}
+	sender.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if client := sdkClientTransport(ctx); client != nil && client.DialContext != nil {
+			return client.DialContext(ctx, network, address)
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+	sender.Proxy = func(req *http.Request) (*url.URL, error) {
+		if client := sdkClientTransport(req.Context()); client != nil && client.Proxy != nil {
+			return client.Proxy(req)
+		}
+		return http.ProxyFromEnvironment(req)
+	}
+	sender.DialTLSContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := sender.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig := &tls.Config{}
+		if client := sdkClientTransport(ctx); client != nil && client.TLSClientConfig != nil {
+			tlsConfig = client.TLSClientConfig.Clone()
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(address)
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+	return sender
+}
+
+// sdkClientRoundTripper sends the requests of a client with the shared transport, telling it the
+// transport of the client.
+type sdkClientRoundTripper struct {
+	transport *http.Transport
+	sender    http.RoundTripper
+}
+
+func (t *sdkClientRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.sender.RoundTrip(req.WithContext(context.WithValue(req.Context(), sdkClientTransportKey{}, t.transport)))
+}
+
+// newSDKTransport creates the transport of a client. The SDK only applies the connect timeout, the proxy
+// and the TLS settings of its requests to an *http.Transport, which it modifies in place, so each client
+// has its own. Its requests are handed to the sender, which keeps the connections open between calls.
+func newSDKTransport(sender http.RoundTripper) *http.Transport {
+	transport := &http.Transport{}
+	rt := &sdkClientRoundTripper{transport: transport, sender: sender}
+	transport.RegisterProtocol("http", rt)
+	transport.RegisterProtocol("https", rt)
+	return transport
+}
+
+// SDKClient is the part of the OpenAPI clients (e.g. cms.Client) which sets their transport.
+type SDKClient interface {
+	SetTransport(transport http.RoundTripper)
+}
+
+// ApplySDKTransport makes the client use the shared transport, if any. Only the transport is
+// replaced, so the retry and timeout settings of the client are kept.
+func ApplySDKTransport(client SDKClient) {
+	sdkTransportLock.RLock()
+	defer sdkTransportLock.RUnlock()
+	if sharedSDKSender != nil {
+		client.SetTransport(newSDKTransport(sharedSDKSender))
+	}
+}
+
+// UnixSocketScheme is the scheme of the URLs of an HTTP API served over a unix domain socket,
+// e.g. unix:///var/run/prom.sock.
+const UnixSocketScheme = "unix"
+
+// ParseUnixSocketURL splits a unix:// URL into the path of the socket and the base URL of the
+// requests sent over it. The query parameters are kept on the base URL.
+func ParseUnixSocketURL(u *url.URL) (socket string, baseURL *url.URL, err error) {
+	if u.Scheme != UnixSocketScheme {
+		return "", nil, fmt.Errorf("%q is no %s:// URL", u, UnixSocketScheme)
+	}
+	if u.Host != "" || u.Path == "" {
+		return "", nil, fmt.Errorf("%q should be of the form unix:///path/to/socket", u)
+	}
+	// the host only ends up in the Host header, the socket is dialed whatever it is
+	return u.Path, &url.URL{Scheme: "http", Host: "localhost", RawQuery: u.RawQuery}, nil
+}
+
+// NewUnixSocketTransport creates a transport which connects to the unix domain socket at
+// path, whatever the address of the request.
+func NewUnixSocketTransport(path string) *http.Transport {
+	dialer := &net.Dialer{Timeout: DefaultTransportConfig.DialTimeout}
+	return &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", path)
+		},
+		MaxIdleConns:        DefaultTransportConfig.MaxIdleConns,
+		MaxIdleConnsPerHost: DefaultTransportConfig.MaxIdleConnsPerHost,
+		IdleConnTimeout:     DefaultTransportConfig.IdleConnTimeout,
+	}
+}
+
+// NewCATransport creates a transport which verifies the certificate of the server against the CA certificates
+// of caPEM. The certificate has to be issued for serverName rather than for the host of the URL if it isn't
+// empty, e.g. to connect by IP to a server whose certificate only names its DNS name. The transport negotiates
+// HTTP/2 with the servers which support it if http2 is set, and sticks to HTTP/1.1 otherwise.
+func NewCATransport(caPEM []byte, serverName string, http2 bool) (*http.Transport, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certs found")
+	}
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs:    pool,
+			ServerName: serverName,
+		},
+	}
+	setHTTP2(transport, http2)
+	return transport, nil
+}
+
+// NewDefaultTransport returns http.DefaultTransport, which negotiates HTTP/2 with the servers which support it,
+// or a copy of it which sticks to HTTP/1.1 unless http2 is set, e.g. for a proxy which mishandles HTTP/2.
+func NewDefaultTransport(http2 bool) http.RoundTripper {
+	if http2 {
+		return http.DefaultTransport
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	setHTTP2(transport, false)
+	return transport
+}
+
+// setHTTP2 enables HTTP/2 on the transport, which a transport with its own TLS config or dialer lacks by default,
+// or disables it.
+func setHTTP2(transport *http.Transport, enabled bool) {
+	transport.ForceAttemptHTTP2 = enabled
+	if !enabled {
+		// a non-nil empty map is how HTTP/2 is turned off
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+}
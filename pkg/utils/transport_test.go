@@ -0,0 +1,304 @@
+package utils
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/requests"
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/cms"
+	pmodel "github.com/prometheus/common/model"
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+)
+
+// countingTransport counts the requests sent through it.
+type countingTransport struct {
+	rt       http.RoundTripper
+	requests int
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests++
+	return t.rt.RoundTrip(req)
+}
+
+// setSDKSender makes the OpenAPI clients share the sender until the test ends.
+func setSDKSender(t *testing.T, sender http.RoundTripper) {
+	sdkTransportLock.Lock()
+	sharedSDKSender = sender
+	sdkTransportLock.Unlock()
+	t.Cleanup(func() {
+		sdkTransportLock.Lock()
+		sharedSDKSender = nil
+		sdkTransportLock.Unlock()
+	})
+}
+
+// newSDKTestClient creates a cms client of the shared transport, which doesn't retry.
+func newSDKTestClient(t *testing.T) *cms.Client {
+	client, err := cms.NewClientWithAccessKey("cn-hangzhou", "ak", "sk")
+	if err != nil {
+		t.Fatalf("Failed to create cms client, because of %v", err)
+	}
+	client.GetConfig().AutoRetry = false
+	ApplySDKTransport(client)
+	return client
+}
+
+// describeMetricList sends a DescribeMetricList request to the server, with the connect timeout if set.
+func describeMetricList(client *cms.Client, serverURL string, scheme string, connectTimeout time.Duration) error {
+	request := cms.CreateDescribeMetricListRequest()
+	request.Scheme = scheme
+	request.Domain = strings.TrimPrefix(strings.TrimPrefix(serverURL, "http://"), "https://")
+	request.SetConnectTimeout(connectTimeout)
+	_, err := client.DescribeMetricList(request)
+	return err
+}
+
+func TestApplySDKTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"RequestId":"test","Success":true,"Code":"200","Datapoints":"[]"}`))
+	}))
+	defer server.Close()
+
+	counting := &countingTransport{rt: newSDKSender(DefaultTransportConfig)}
+	setSDKSender(t, counting)
+
+	client, err := cms.NewClientWithAccessKey("cn-hangzhou", "ak", "sk")
+	if err != nil {
+		t.Fatalf("Failed to create cms client, because of %v", err)
+	}
+	retries := client.GetConfig().MaxRetryTime
+	ApplySDKTransport(client)
+
+	request := cms.CreateDescribeMetricListRequest()
+	request.Scheme = requests.HTTP
+	request.Domain = strings.TrimPrefix(server.URL, "http://")
+	if _, err := client.DescribeMetricList(request); err != nil {
+		t.Fatalf("Failed to describe metric list, because of %v", err)
+	}
+
+	if counting.requests != 1 {
+		t.Errorf("expected the request to go through the shared transport, got %d requests", counting.requests)
+	}
+	if !client.GetConfig().AutoRetry || client.GetConfig().MaxRetryTime != retries {
+		t.Errorf("expected the retry settings of the client to be kept, got %+v", client.GetConfig())
+	}
+}
+
+// describeMetricListHandler answers the DescribeMetricList requests.
+func describeMetricListHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"RequestId":"test","Success":true,"Code":"200","Datapoints":"[]"}`))
+}
+
+func TestSDKTransportConnectTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(describeMetricListHandler))
+	defer server.Close()
+	setSDKSender(t, newSDKSender(DefaultTransportConfig))
+
+	// the connect timeout of the request expires before the connection is established
+	err := describeMetricList(newSDKTestClient(t), server.URL, requests.HTTP, time.Nanosecond)
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("expected the connect timeout of the request to fail it, got %v", err)
+	}
+	if err := describeMetricList(newSDKTestClient(t), server.URL, requests.HTTP, 0); err != nil {
+		t.Errorf("expected the request to succeed with the default connect timeout, got %v", err)
+	}
+}
+
+func TestSDKTransportProxyAndTLS(t *testing.T) {
+	setSDKSender(t, newSDKSender(DefaultTransportConfig))
+
+	var proxied int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host == "metrics.example.invalid" {
+			atomic.AddInt32(&proxied, 1)
+		}
+		describeMetricListHandler(w, r)
+	}))
+	defer proxy.Close()
+	client := newSDKTestClient(t)
+	client.SetHttpProxy(proxy.URL)
+	if err := describeMetricList(client, "metrics.example.invalid", requests.HTTP, 0); err != nil || atomic.LoadInt32(&proxied) != 1 {
+		t.Errorf("expected the request to be sent through the proxy of the client, got %d requests (%v)", proxied, err)
+	}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(describeMetricListHandler))
+	defer server.Close()
+	if err := describeMetricList(newSDKTestClient(t), server.URL, requests.HTTPS, 0); err == nil {
+		t.Errorf("expected the self-signed certificate of the server to be rejected")
+	}
+	client = newSDKTestClient(t)
+	client.SetHTTPSInsecure(true)
+	if err := describeMetricList(client, server.URL, requests.HTTPS, 0); err != nil {
+		t.Errorf("expected the client skipping the verification to accept the certificate, got %v", err)
+	}
+}
+
+func TestSDKTransportReusesConnections(t *testing.T) {
+	var connections int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(describeMetricListHandler))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+	setSDKSender(t, newSDKSender(DefaultTransportConfig))
+
+	// the clients are created per call, their connections are shared
+	for i := 0; i < 3; i++ {
+		if err := describeMetricList(newSDKTestClient(t), server.URL, requests.HTTP, 0); err != nil {
+			t.Fatalf("Failed to describe metric list, because of %v", err)
+		}
+	}
+	if connections := atomic.LoadInt32(&connections); connections != 1 {
+		t.Errorf("expected the clients to reuse a connection, got %d connections", connections)
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	transport := NewTransport(TransportConfig{MaxIdleConns: 50, MaxIdleConnsPerHost: 5, DisableKeepAlives: true})
+	if transport.MaxIdleConns != 50 || transport.MaxIdleConnsPerHost != 5 || !transport.DisableKeepAlives {
+		t.Errorf("expected the settings to be applied to the transport, got %+v", transport)
+	}
+}
+
+func TestParseUnixSocketURL(t *testing.T) {
+	u, _ := url.Parse("unix:///var/run/prom.sock?timeout=10s")
+	socket, baseURL, err := ParseUnixSocketURL(u)
+	if err != nil {
+		t.Fatalf("Failed to parse the unix socket URL, because of %v", err)
+	}
+	if socket != "/var/run/prom.sock" || baseURL.String() != "http://localhost?timeout=10s" {
+		t.Errorf("unexpected socket %s and base URL %s", socket, baseURL)
+	}
+
+	for _, invalid := range []string{"unix://prometheus/var/run/prom.sock", "unix://", "http://prometheus:9090"} {
+		u, _ := url.Parse(invalid)
+		if _, _, err := ParseUnixSocketURL(u); err == nil {
+			t.Errorf("expected %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestPrometheusOverUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "prom.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s, because of %v", socket, err)
+	}
+
+	var path string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":{"resultType":"scalar","result":[1620000000,"42"]}}`))
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	u, _ := url.Parse("unix://" + socket)
+	_, baseURL, err := ParseUnixSocketURL(u)
+	if err != nil {
+		t.Fatalf("Failed to parse the unix socket URL, because of %v", err)
+	}
+	httpClient := &http.Client{Transport: NewUnixSocketTransport(socket)}
+	client := prom.NewClientForAPI(prom.NewGenericAPIClient(httpClient, baseURL, nil))
+
+	result, err := client.Query(context.TODO(), pmodel.Now(), "vector(42)")
+	if err != nil {
+		t.Fatalf("Failed to query over the unix socket, because of %v", err)
+	}
+	if path != "/api/v1/query" {
+		t.Errorf("expected the query API to be requested, got %s", path)
+	}
+	if result.Type != pmodel.ValScalar || result.Scalar.Value != 42 {
+		t.Errorf("unexpected result %v", result)
+	}
+}
+
+func TestNewCATransportServerName(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	defer server.Close()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	// the certificate of the test server names example.com, which is connected to by IP
+	rt, err := NewCATransport(caPEM, "example.com", true)
+	if err != nil {
+		t.Fatalf("Failed to create the transport, because of %v", err)
+	}
+	if name := rt.TLSClientConfig.ServerName; name != "example.com" {
+		t.Errorf("expected the server name example.com, got %q", name)
+	}
+	resp, err := (&http.Client{Transport: rt}).Get(server.URL)
+	if err != nil {
+		t.Fatalf("expected the certificate to be verified against the server name, got %v", err)
+	}
+	resp.Body.Close()
+
+	rt, err = NewCATransport(caPEM, "prometheus.example.org", true)
+	if err != nil {
+		t.Fatalf("Failed to create the transport, because of %v", err)
+	}
+	if _, err := (&http.Client{Transport: rt}).Get(server.URL); err == nil {
+		t.Errorf("expected a certificate which doesn't name the server name to be rejected")
+	}
+
+	if _, err := NewCATransport([]byte("not a certificate"), "", true); err == nil {
+		t.Errorf("expected a CA file without certificates to be rejected")
+	}
+}
+
+func TestPrometheusTransportHTTP2(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	for _, http2 := range []bool{true, false} {
+		rt, err := NewCATransport(caPEM, "", http2)
+		if err != nil {
+			t.Fatalf("Failed to create the transport, because of %v", err)
+		}
+		if rt.ForceAttemptHTTP2 != http2 {
+			t.Errorf("expected ForceAttemptHTTP2 to be %v, got %v", http2, rt.ForceAttemptHTTP2)
+		}
+		resp, err := (&http.Client{Transport: rt}).Get(server.URL)
+		if err != nil {
+			t.Fatalf("Failed to get, because of %v", err)
+		}
+		resp.Body.Close()
+		if expected := map[bool]int{true: 2, false: 1}[http2]; resp.ProtoMajor != expected {
+			t.Errorf("expected HTTP/%d with http2 %v, got %s", expected, http2, resp.Proto)
+		}
+	}
+
+	if NewDefaultTransport(true) != http.DefaultTransport {
+		t.Errorf("expected the default transport with HTTP/2")
+	}
+	rt := NewDefaultTransport(false).(*http.Transport)
+	if rt.ForceAttemptHTTP2 || rt.TLSNextProto == nil || len(rt.TLSNextProto) > 0 {
+		t.Errorf("expected a copy of the default transport without HTTP/2, got %+v", rt)
+	}
+}
@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The build of the adapter, injected by the Makefile with
+// -ldflags "-X github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/utils.Version=..."
+var (
+	Version   = "unknown"
+	GitCommit = "unknown"
+)
+
+// buildInfo tells which build of the adapter is running, it's always 1.
+var buildInfo = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "adapter_build_info",
+		Help: "Build of the alibaba-cloud-metrics-adapter, labeled by version, git commit and Go version. Always 1.",
+	},
+	[]string{"version", "git_commit", "go_version"},
+)
+
+func init() {
+	RegisterMetrics(buildInfo)
+	buildInfo.WithLabelValues(Version, GitCommit, runtime.Version()).Set(1)
+}
@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"runtime"
+	"testing"
+
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+func TestBuildInfoMetric(t *testing.T) {
+	families, err := legacyregistry.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather the metrics, because of %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "adapter_build_info" {
+			continue
+		}
+		if len(family.Metric) != 1 {
+			t.Fatalf("expected a single build, got %d", len(family.Metric))
+		}
+		labels := make(map[string]string)
+		for _, label := range family.Metric[0].Label {
+			labels[label.GetName()] = label.GetValue()
+		}
+		expected := map[string]string{"version": Version, "git_commit": GitCommit, "go_version": runtime.Version()}
+		for name, value := range expected {
+			if labels[name] != value {
+				t.Errorf("expected label %s=%q, got %q", name, value, labels[name])
+			}
+		}
+		if value := family.Metric[0].GetGauge().GetValue(); value != 1 {
+			t.Errorf("expected the value 1, got %v", value)
+		}
+		return
+	}
+	t.Errorf("adapter_build_info isn't registered")
+}
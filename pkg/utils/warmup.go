@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+	log "k8s.io/klog/v2"
+)
+
+// MinWarmUpInterval bounds the pings to a backend, so that keeping its connections warm doesn't add meaningful load.
+const MinWarmUpInterval = 10 * time.Second
+
+// Ping is a cheap call to a backend, which only keeps its connections open.
+type Ping func(ctx context.Context) error
+
+// RunWarmUp pings the backend every interval until stopCh is closed, so that the first request
+// after an idle period doesn't wait for a new connection and its TLS handshake. An interval
+// shorter than MinWarmUpInterval is raised to it.
+func RunWarmUp(backend Backend, interval time.Duration, ping Ping, stopCh <-chan struct{}) {
+	go runWarmUp(backend, interval, ping, clock.RealClock{}, stopCh)
+}
+
+func runWarmUp(backend Backend, interval time.Duration, ping Ping, clk clock.Clock, stopCh <-chan struct{}) {
+	if interval < MinWarmUpInterval {
+		interval = MinWarmUpInterval
+	}
+	ticker := clk.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C():
+			// a single ping at a time, bounded by the timeout of the backend
+			ctx, cancel := WithBackendTimeout(context.Background(), backend)
+			if err := ping(ctx); err != nil {
+				log.V(4).Infof("Failed to ping %s to keep its connections warm, because of %v", backend, err)
+			}
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+func TestWarmUpPingsOnSchedule(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	pings := make(chan struct{}, 10)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	go runWarmUp(PrometheusBackend, 30*time.Second, func(ctx context.Context) error {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Errorf("expected the ping to be bounded by the backend timeout")
+		}
+		pings <- struct{}{}
+		return nil
+	}, fakeClock, stopCh)
+	for !fakeClock.HasWaiters() {
+		time.Sleep(time.Millisecond)
+	}
+
+	fakeClock.Step(20 * time.Second)
+	select {
+	case <-pings:
+		t.Fatalf("expected no ping before the interval elapsed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for i := 0; i < 3; i++ {
+		fakeClock.Step(30 * time.Second)
+		select {
+		case <-pings:
+		case <-time.After(time.Second):
+			t.Fatalf("expected a ping after %d intervals", i+1)
+		}
+	}
+}
+
+func TestWarmUpIntervalIsBounded(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	pings := make(chan struct{}, 10)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	go runWarmUp(CMSBackend, time.Second, func(context.Context) error {
+		pings <- struct{}{}
+		return nil
+	}, fakeClock, stopCh)
+	for !fakeClock.HasWaiters() {
+		time.Sleep(time.Millisecond)
+	}
+
+	fakeClock.Step(MinWarmUpInterval / 2)
+	select {
+	case <-pings:
+		t.Fatalf("expected the interval to be raised to %v", MinWarmUpInterval)
+	case <-time.After(50 * time.Millisecond):
+	}
+	fakeClock.Step(MinWarmUpInterval / 2)
+	select {
+	case <-pings:
+	case <-time.After(time.Second):
+		t.Fatalf("expected a ping after %v", MinWarmUpInterval)
+	}
+}
@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// WindowLabel is the label of the external metric values which tells the aggregation window of the value.
+// HPAs match external metrics by name and selector, so the extra label doesn't affect them.
+const WindowLabel = "window"
+
+var exposeMetricWindow int32
+
+// SetExposeMetricWindow toggles the window label on the returned external metric values.
+func SetExposeMetricWindow(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&exposeMetricWindow, v)
+}
+
+// SetWindowLabel labels the values with the aggregation window in seconds, e.g. window=60s,
+// if exposing the window is enabled.
+func SetWindowLabel(values []external_metrics.ExternalMetricValue, windowSeconds int) {
+	if atomic.LoadInt32(&exposeMetricWindow) == 0 {
+		return
+	}
+	for i := range values {
+		if values[i].MetricLabels == nil {
+			values[i].MetricLabels = make(map[string]string, 1)
+		}
+		values[i].MetricLabels[WindowLabel] = fmt.Sprintf("%ds", windowSeconds)
+	}
+}
@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"testing"
+
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+func TestSetWindowLabel(t *testing.T) {
+	defer SetExposeMetricWindow(false)
+
+	values := []external_metrics.ExternalMetricValue{
+		{MetricName: "slb_l7_qps"},
+		{MetricName: "slb_l7_qps", MetricLabels: map[string]string{"vip": "10.0.0.1"}},
+	}
+	SetWindowLabel(values, 60)
+	for _, value := range values {
+		if _, found := value.MetricLabels[WindowLabel]; found {
+			t.Errorf("expected no window label unless enabled, got %v", value.MetricLabels)
+		}
+	}
+
+	SetExposeMetricWindow(true)
+	SetWindowLabel(values, 60)
+	for _, value := range values {
+		if value.MetricLabels[WindowLabel] != "60s" {
+			t.Errorf("expected window label 60s, got %v", value.MetricLabels)
+		}
+	}
+	if values[1].MetricLabels["vip"] != "10.0.0.1" {
+		t.Errorf("expected the other labels to be kept, got %v", values[1].MetricLabels)
+	}
+}
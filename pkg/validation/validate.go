@@ -0,0 +1,77 @@
+package validation
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+)
+
+// RuleResult is the outcome of running the series query of a rule against Prometheus.
+type RuleResult struct {
+	// Kind is either "rules" or "externalRules", the section of the config the rule comes from.
+	Kind        string
+	Index       int
+	SeriesQuery string
+	Series      int
+	Err         error
+}
+
+// Failed tells whether the rule is broken. A rule matching no series only fails with failOnZeroSeries.
+func (r RuleResult) Failed(failOnZeroSeries bool) bool {
+	return r.Err != nil || (failOnZeroSeries && r.Series == 0)
+}
+
+func (r RuleResult) String() string {
+	if r.Err != nil {
+		return fmt.Sprintf("%s[%d] %s: error: %v", r.Kind, r.Index, r.SeriesQuery, r.Err)
+	}
+	return fmt.Sprintf("%s[%d] %s: %d series", r.Kind, r.Index, r.SeriesQuery, r.Series)
+}
+
+// ValidateRules runs the series query of every rule against Prometheus, looking back maxAge.
+func ValidateRules(ctx context.Context, client prom.Client, metricsConfig *config.MetricsDiscoveryConfig, maxAge time.Duration) []RuleResult {
+	now := pmodel.Now()
+	interval := pmodel.Interval{Start: now.Add(-maxAge), End: now}
+
+	results := make([]RuleResult, 0, len(metricsConfig.Rules)+len(metricsConfig.ExternalRules))
+	for _, section := range []struct {
+		kind  string
+		rules []config.DiscoveryRule
+	}{
+		{kind: "rules", rules: metricsConfig.Rules},
+		{kind: "externalRules", rules: metricsConfig.ExternalRules},
+	} {
+		for i, rule := range section.rules {
+			seriesQuery := rule.PrometheusRule().SeriesQuery
+			result := RuleResult{Kind: section.kind, Index: i, SeriesQuery: seriesQuery}
+			if seriesQuery == "" {
+				result.Err = fmt.Errorf("no series query")
+			} else {
+				series, err := client.Series(ctx, interval, prom.Selector(seriesQuery))
+				result.Series, result.Err = len(series), err
+			}
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// Report writes the results and tells whether all rules passed.
+func Report(w io.Writer, results []RuleResult, failOnZeroSeries bool) bool {
+	passed := true
+	for _, result := range results {
+		status := "OK  "
+		if result.Failed(failOnZeroSeries) {
+			status = "FAIL"
+			passed = false
+		}
+		fmt.Fprintf(w, "%s %s\n", status, result)
+	}
+	return passed
+}
@@ -0,0 +1,84 @@
+package validation
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+	prom "sigs.k8s.io/prometheus-adapter/pkg/client"
+	cfg "sigs.k8s.io/prometheus-adapter/pkg/config"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/config"
+)
+
+// fakeSeriesClient answers series queries from a map, failing the unknown ones.
+type fakeSeriesClient struct {
+	series map[prom.Selector][]prom.Series
+}
+
+func (c *fakeSeriesClient) Series(_ context.Context, _ pmodel.Interval, selectors ...prom.Selector) ([]prom.Series, error) {
+	series, found := c.series[selectors[0]]
+	if !found {
+		return nil, errors.New("bad_data: parse error")
+	}
+	return series, nil
+}
+
+func (c *fakeSeriesClient) Query(_ context.Context, _ pmodel.Time, _ prom.Selector) (prom.QueryResult, error) {
+	return prom.QueryResult{}, nil
+}
+
+func (c *fakeSeriesClient) QueryRange(_ context.Context, _ prom.Range, _ prom.Selector) (prom.QueryResult, error) {
+	return prom.QueryResult{}, nil
+}
+
+func rule(seriesQuery string) config.DiscoveryRule {
+	return config.DiscoveryRule{DiscoveryRule: cfg.DiscoveryRule{SeriesQuery: seriesQuery}}
+}
+
+func TestValidateRules(t *testing.T) {
+	client := &fakeSeriesClient{series: map[prom.Selector][]prom.Series{
+		`http_requests_total{pod!=""}`: {{Name: "http_requests_total"}, {Name: "http_requests_total"}},
+		`queue_length`:                 {},
+	}}
+	metricsConfig := &config.MetricsDiscoveryConfig{
+		Rules:         []config.DiscoveryRule{rule(`http_requests_total{pod!=""}`), rule(`{broken`)},
+		ExternalRules: []config.DiscoveryRule{rule(`queue_length`)},
+	}
+
+	results := ValidateRules(context.TODO(), client, metricsConfig, 20*time.Minute)
+	if len(results) != 3 {
+		t.Fatalf("expected a result per rule, got %v", results)
+	}
+	if results[0].Err != nil || results[0].Series != 2 {
+		t.Errorf("expected the first rule to match 2 series, got %v", results[0])
+	}
+	if results[1].Err == nil {
+		t.Errorf("expected the query error of the second rule to be reported")
+	}
+	if results[2].Kind != "externalRules" || results[2].Series != 0 {
+		t.Errorf("expected the external rule to match no series, got %v", results[2])
+	}
+}
+
+func TestReport(t *testing.T) {
+	zeroMatch := []RuleResult{{Kind: "rules", SeriesQuery: "up", Series: 0}}
+
+	var out bytes.Buffer
+	if Report(&out, zeroMatch, true) {
+		t.Errorf("expected a rule matching no series to fail")
+	}
+	if !strings.Contains(out.String(), "FAIL") {
+		t.Errorf("expected the failure to be reported, got %q", out.String())
+	}
+	if !Report(&out, zeroMatch, false) {
+		t.Errorf("expected a rule matching no series to pass when allowed")
+	}
+	if Report(&out, []RuleResult{{Kind: "rules", SeriesQuery: "up", Series: 1, Err: errors.New("timeout")}}, false) {
+		t.Errorf("expected a query error to fail")
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/options"
+	"github.com/AliyunContainerService/alibaba-cloud-metrics-adapter/pkg/validation"
+)
+
+const validateConfigCommand = "validate-config"
+
+// validateConfig checks the rules of the config against a live Prometheus without starting
+// the server, and returns the exit code.
+func validateConfig(opts *options.AlibabaMetricsAdapterOptions, failOnZeroSeries bool) int {
+	if err := opts.LoadConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config: %v\n", err)
+		return 1
+	}
+	opts.ApplyBackendTimeouts()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	promClient, err := opts.MakePromClient(stopCh)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to construct Prometheus client: %v\n", err)
+		return 1
+	}
+
+	results := validation.ValidateRules(context.Background(), promClient, opts.MetricsConfig, opts.MetricsMaxAge)
+	if !validation.Report(os.Stdout, results, failOnZeroSeries) {
+		return 1
+	}
+	return 0
+}